@@ -0,0 +1,210 @@
+package crosscoap
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// AccessLogFormat shapes the line written to AccessLog for each request,
+// once it has been answered.
+type AccessLogFormat struct {
+	parts []accessLogPart
+}
+
+// accessLogPart is a literal, or a token if value is nil.
+type accessLogPart struct {
+	literal string
+	value   func(e *accessLogEntry) string
+}
+
+// accessLogEntry is a request and its response (nil if none was sent).
+type accessLogEntry struct {
+	client    *net.UDPAddr
+	request   *coap.Message
+	response  *translatedCOAPMessage
+	latency   time.Duration
+	tenant    string
+	identity  string
+	backend   string
+	principal string
+}
+
+// accessLogTokens are the tokens of an access log format.
+var accessLogTokens = []struct {
+	name  string
+	value func(e *accessLogEntry) string
+}{
+	{"latency_ms", func(e *accessLogEntry) string {
+		return strconv.FormatFloat(float64(e.latency)/float64(time.Millisecond), 'f', 3, 64)
+	}},
+	{"truncated", func(e *accessLogEntry) string {
+		return strconv.FormatBool(e.response != nil && e.response.IsTruncated)
+	}},
+	{"client", func(e *accessLogEntry) string { return e.client.String() }},
+	{"method", func(e *accessLogEntry) string { return methodName(e.request.Code) }},
+	{"status", func(e *accessLogEntry) string {
+		if e.response == nil || e.response.httpStatus == 0 {
+			return "-"
+		}
+		return strconv.Itoa(e.response.httpStatus)
+	}},
+	{"bytes", func(e *accessLogEntry) string {
+		if e.response == nil {
+			return "0"
+		}
+		return strconv.Itoa(len(e.response.Payload))
+	}},
+	{"path", func(e *accessLogEntry) string { return "/" + e.request.PathString() }},
+	{"tenant", func(e *accessLogEntry) string { return e.tenant }},
+	{"identity", func(e *accessLogEntry) string {
+		if e.identity == "" {
+			return "-"
+		}
+		return e.identity
+	}},
+	{"principal", func(e *accessLogEntry) string {
+		if e.principal == "" {
+			return "-"
+		}
+		return e.principal
+	}},
+	{"backend", func(e *accessLogEntry) string {
+		if e.backend == "" {
+			return "-"
+		}
+		return e.backend
+	}},
+	{"code", func(e *accessLogEntry) string {
+		if e.response == nil {
+			return "-"
+		}
+		return codeString(e.response.Code)
+	}},
+	{"content_type", func(e *accessLogEntry) string {
+		if e.response == nil {
+			return "-"
+		}
+		return orDash(e.response.contentType)
+	}},
+	{"content_format", func(e *accessLogEntry) string { return contentFormatString(e.response) }},
+	{"oversize", func(e *accessLogEntry) string {
+		if e.response == nil {
+			return "-"
+		}
+		return orDash(e.response.oversize)
+	}},
+	{"cache", func(e *accessLogEntry) string {
+		if e.response == nil {
+			return "-"
+		}
+		return orDash(e.response.cache)
+	}},
+	{"translation", func(e *accessLogEntry) string {
+		if e.response == nil {
+			return "-"
+		}
+		r := e.response
+		status := "-"
+		if r.httpStatus != 0 {
+			status = strconv.Itoa(r.httpStatus)
+		}
+		return fmt.Sprintf("status=%v type=%v code=%v format=%v oversize=%v cache=%v",
+			status, orDash(r.contentType), codeString(r.Code), contentFormatString(r), orDash(r.oversize), orDash(r.cache))
+	}},
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// contentFormatString returns the Content-Format of the response, or -.
+func contentFormatString(r *translatedCOAPMessage) string {
+	if r == nil {
+		return "-"
+	}
+	if format, ok := r.Option(coap.ContentFormat).(coap.MediaType); ok {
+		return strconv.Itoa(int(format))
+	}
+	return "-"
+}
+
+// ParseAccessLogFormat parses an access log format, in which %client,
+// %method, %path, %code (the CoAP response code, such as 2.05, or - if no
+// response was sent), %status (the HTTP status of the backend response, or
+// -), %bytes (of the response payload), %latency_ms, %truncated (true or
+// false), %tenant (or -), %identity (the authenticated identity of the
+// client, or -), %principal (on whose behalf the request was made, as told
+// by the Authenticators, or -) and %backend (the resolved backend address the request was
+// sent to, or -) are replaced by the values of the request, and %% by %.
+// The decisions of the translator are given by %content_type (of the
+// backend response, or -), %content_format (of the CoAP response, or -),
+// %oversize (truncated, block2, compressed or rejected if the payload
+// didn't fit in a packet, else -), %cache (hit, miss, stale or bypass, or -
+// if the response can't be cached) and %translation, which sums them up
+// with the status and code as in "status=404 type=text/plain code=4.04
+// format=0 oversize=- cache=miss".
+func ParseAccessLogFormat(format string) (*AccessLogFormat, error) {
+	f := &AccessLogFormat{}
+	var literal strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		rest := format[i+1:]
+		if strings.HasPrefix(rest, "%") {
+			literal.WriteByte('%')
+			i++
+			continue
+		}
+		found := false
+		for _, token := range accessLogTokens {
+			if strings.HasPrefix(rest, token.name) {
+				if literal.Len() > 0 {
+					f.parts = append(f.parts, accessLogPart{literal: literal.String()})
+					literal.Reset()
+				}
+				f.parts = append(f.parts, accessLogPart{value: token.value})
+				i += len(token.name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown token at %q in access log format", format[i:])
+		}
+	}
+	if literal.Len() > 0 {
+		f.parts = append(f.parts, accessLogPart{literal: literal.String()})
+	}
+	return f, nil
+}
+
+func (f *AccessLogFormat) format(e *accessLogEntry) string {
+	var line strings.Builder
+	for _, part := range f.parts {
+		if part.value != nil {
+			line.WriteString(part.value(e))
+		} else {
+			line.WriteString(part.literal)
+		}
+	}
+	return line.String()
+}
+
+// logRequest writes the AccessLogFormat line of a request in the exchange
+// rc, answered by coapResp.
+func (p *proxyHandler) logRequest(rc *RequestContext, m *coap.Message, coapResp *translatedCOAPMessage, latency time.Duration) {
+	if p.AccessLogFormat == nil || p.AccessLog == nil || p.quiet(m) {
+		return
+	}
+	p.AccessLog.Print(p.AccessLogFormat.format(&accessLogEntry{rc.Client, m, coapResp, latency, p.tenantName(m), rc.Identity, rc.Backend, rc.Principal}))
+}
@@ -0,0 +1,90 @@
+package crosscoap
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestParseAccessLogFormat(t *testing.T) {
+	for _, format := range []string{"%client %unknown", "100%"} {
+		if _, err := ParseAccessLogFormat(format); err == nil {
+			t.Errorf("format '%v' is accepted", format)
+		}
+	}
+	f, err := ParseAccessLogFormat(`%client "%method %path" %code %status %bytes %truncated 100%%`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &coap.Message{Code: coap.GET}
+	m.SetPathString("/a/b")
+	e := &accessLogEntry{
+		client:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5683},
+		request:  m,
+		response: &translatedCOAPMessage{Message: coap.Message{Code: coap.Content, Payload: []byte("abc")}, IsTruncated: true, httpStatus: 200},
+	}
+	if line := f.format(e); line != `10.0.0.1:5683 "GET /a/b" 2.05 200 3 true 100%` {
+		t.Errorf("line is '%v'", line)
+	}
+	e.response = nil
+	if line := f.format(e); line != `10.0.0.1:5683 "GET /a/b" - - 0 false 100%` {
+		t.Errorf("line without response is '%v'", line)
+	}
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("missing"))
+	}))
+	defer backend.Close()
+	format, _ := ParseAccessLogFormat("%client %path %code %status %bytes %latency_ms")
+	var accessLog bytes.Buffer
+	p := newProxyHandler(&Proxy{
+		BackendURL:      backend.URL,
+		AccessLog:       log.New(&accessLog, "", 0),
+		AccessLogFormat: format,
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	m.SetPathString("/missing")
+	p.handleRequest(a, m, nil)
+
+	if !regexp.MustCompile(`^127\.0\.0\.1:5683 /missing 4\.04 404 7 \d+\.\d{3}\n$`).MatchString(accessLog.String()) {
+		t.Errorf("access log is '%v'", accessLog.String())
+	}
+}
+
+func TestAccessLogTranslation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("config"))
+	}))
+	defer backend.Close()
+	format, _ := ParseAccessLogFormat("%path %translation")
+	var accessLog bytes.Buffer
+	p := newProxyHandler(&Proxy{
+		BackendURL:      backend.URL,
+		AccessLog:       log.New(&accessLog, "", 0),
+		AccessLogFormat: format,
+		CacheMaxSize:    1 << 20,
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	for i := 0; i < 2; i++ {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: uint16(i)}
+		m.SetPathString("/config")
+		p.handleRequest(a, m, nil)
+	}
+	expected := "/config status=200 type=text/plain code=2.05 format=0 oversize=- cache=miss\n" +
+		"/config status=200 type=text/plain code=2.05 format=0 oversize=- cache=hit\n"
+	if accessLog.String() != expected {
+		t.Errorf("access log is '%v'", accessLog.String())
+	}
+}
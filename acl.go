@@ -0,0 +1,184 @@
+package crosscoap
+
+import (
+	"net"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// AccessAction is the decision taken by an access rule.
+type AccessAction int
+
+const (
+	// Allow lets the request through to the backend.
+	Allow AccessAction = iota
+	// Deny rejects the request without contacting the backend.
+	Deny
+)
+
+// AccessRule matches incoming CoAP requests by method and path prefix.
+type AccessRule struct {
+	Action AccessAction
+
+	// Methods restricts the rule to the given request codes (coap.GET,
+	// coap.POST, ...).  If empty, the rule matches every method.
+	Methods []coap.COAPCode
+
+	// PathPrefix restricts the rule to the given path and everything below
+	// it, matched on whole path segments ("/telemetry" matches
+	// "/telemetry/temp" but not "/telemetry2").  If empty, the rule matches
+	// every path.
+	PathPrefix string
+
+	// Principals restricts the rule to the requests of the given principals
+	// (see Authenticator), "*" standing for any authenticated one.  If
+	// empty, the rule matches every request.
+	Principals []string
+}
+
+// AccessPolicy is an ordered list of access rules which is evaluated before
+// a request is translated; the first matching rule decides.  Requests denied
+// by a rule which lists methods are answered with 4.05 Method Not Allowed,
+// all other denied requests with 4.03 Forbidden, and requests with a "." or
+// ".." Uri-Path segment, or one containing a slash, with 4.00 Bad Request.
+type AccessPolicy struct {
+	Rules []AccessRule
+
+	// DefaultAction applies to requests which match none of the rules.
+	DefaultAction AccessAction
+}
+
+func (r *AccessRule) matches(m *coap.Message, principal string) bool {
+	if len(r.Methods) > 0 && !containsCode(r.Methods, m.Code) {
+		return false
+	}
+	if len(r.Principals) > 0 && !matchesPrincipal(r.Principals, principal) {
+		return false
+	}
+	return hasPathPrefix(m.PathString(), r.PathPrefix)
+}
+
+// matchesPrincipal reports whether principals lists principal, or "*" and
+// principal isn't empty.
+func matchesPrincipal(principals []string, principal string) bool {
+	for _, p := range principals {
+		if p == principal || (p == "*" && principal != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns whether the request of principal (if any) is allowed, and
+// the CoAP response code to use if it isn't.
+func (ap *AccessPolicy) check(m *coap.Message, principal string) (bool, coap.COAPCode) {
+	if !validPath(m) {
+		return false, coap.BadRequest
+	}
+	for i := range ap.Rules {
+		rule := &ap.Rules[i]
+		if !rule.matches(m, principal) {
+			continue
+		}
+		if rule.Action == Allow {
+			return true, 0
+		}
+		if len(rule.Methods) > 0 {
+			return false, coap.MethodNotAllowed
+		}
+		return false, coap.Forbidden
+	}
+	return ap.DefaultAction == Allow, coap.Forbidden
+}
+
+func containsCode(codes []coap.COAPCode, code coap.COAPCode) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// validPath reports whether the Uri-Path segments of m are neither "." nor
+// "..", nor contain a slash, so that the path matched by the access rules
+// and routes is the one the backend gets.
+func validPath(m *coap.Message) bool {
+	for _, segment := range m.Path() {
+		if segment == "." || segment == ".." || strings.Contains(segment, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPathPrefix reports whether path is prefix or lies below it, comparing
+// whole path segments.  Leading and trailing slashes are ignored.
+func hasPathPrefix(path, prefix string) bool {
+	path = strings.Trim(path, "/")
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" || path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, prefix+"/")
+}
+
+// metricDeniedClients counts the requests from clients outside of the
+// allowed networks, labeled by outcome: rejected (with 4.03) or ignored.
+const metricDeniedClients = "denied_clients"
+
+// clientAllowed checks the client address against the proxy's
+// DeniedClients and AllowedClients networks.
+func (p *Proxy) clientAllowed(ip net.IP) bool {
+	if ipInNetworks(ip, p.DeniedClients) {
+		return false
+	}
+	return len(p.AllowedClients) == 0 || ipInNetworks(ip, p.AllowedClients)
+}
+
+// admitClient checks the client a of m against the allowed and denied
+// networks, returning false and the response to m (if any) if it's denied.
+func (p *proxyHandler) admitClient(a *net.UDPAddr, m *coap.Message, requestID string) (*translatedCOAPMessage, bool) {
+	if p.clientAllowed(a.IP) {
+		return nil, true
+	}
+	p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied client", a, methodName(m.Code), m.PathString(), requestID)
+	if p.RejectDeniedClients {
+		p.metrics().Counter(metricDeniedClients, 1, Labels{"outcome": "rejected"})
+		return p.errorResponse(m, coap.Forbidden, "client not allowed"), false
+	}
+	p.metrics().Counter(metricDeniedClients, 1, Labels{"outcome": "ignored"})
+	return nil, false
+}
+
+// admitUpload checks the client, the path and, unless authenticated
+// principals may change its decision, the access policy of the block of an
+// upload m before its payload is kept, returning false and the response to
+// m (if any) if it's denied.  The whole request is checked again once
+// reassembled.
+func (p *proxyHandler) admitUpload(a *net.UDPAddr, m *coap.Message, requestID string) (*translatedCOAPMessage, bool) {
+	if denied, ok := p.admitClient(a, m, requestID); !ok {
+		return denied, false
+	}
+	if !validPath(m) {
+		p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v invalid path", a, methodName(m.Code), m.PathString(), requestID)
+		return p.errorResponse(m, coap.BadRequest, "invalid Uri-Path segment"), false
+	}
+	if p.AccessPolicy != nil && len(p.Authenticators) == 0 {
+		if allowed, code := p.AccessPolicy.check(m, ""); !allowed {
+			p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied by access policy", a, methodName(m.Code), m.PathString(), requestID)
+			return p.errorResponse(m, code, "denied by access policy"), false
+		}
+	}
+	return nil, true
+}
+
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	policy := AccessPolicy{
+		Rules: []AccessRule{
+			{Action: Deny, Methods: []coap.COAPCode{coap.DELETE}},
+			{Action: Allow, PathPrefix: "/telemetry"},
+		},
+		DefaultAction: Deny,
+	}
+	tests := []struct {
+		code     coap.COAPCode
+		path     string
+		allowed  bool
+		respCode coap.COAPCode
+	}{
+		{coap.GET, "/telemetry", true, 0},
+		{coap.POST, "/telemetry/temp", true, 0},
+		{coap.DELETE, "/telemetry/temp", false, coap.MethodNotAllowed},
+		{coap.GET, "/telemetry2", false, coap.Forbidden},
+		{coap.GET, "/config", false, coap.Forbidden},
+		{coap.GET, "/telemetry/../admin", false, coap.BadRequest},
+		{coap.GET, "/telemetry/./temp", false, coap.BadRequest},
+	}
+	for _, test := range tests {
+		m := coap.Message{Type: coap.Confirmable, Code: test.code}
+		m.SetPathString(test.path)
+		allowed, code := policy.check(&m, "")
+		if allowed != test.allowed || (!allowed && code != test.respCode) {
+			t.Errorf("%v %v: got allowed=%v code=%v; expected allowed=%v code=%v",
+				test.code, test.path, allowed, code, test.allowed, test.respCode)
+		}
+	}
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		expected     bool
+	}{
+		{"a/b/c", "", true},
+		{"a/b/c", "/", true},
+		{"a/b/c", "/a", true},
+		{"a/b/c", "a/b/", true},
+		{"a/b/c", "a/b/c", true},
+		{"a/bc", "a/b", false},
+		{"a", "a/b", false},
+	}
+	for _, test := range tests {
+		if got := hasPathPrefix(test.path, test.prefix); got != test.expected {
+			t.Errorf("hasPathPrefix(%q, %q) is %v", test.path, test.prefix, got)
+		}
+	}
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("Error parsing CIDR %v: %v", s, err)
+	}
+	return network
+}
+
+func TestClientAllowed(t *testing.T) {
+	p := Proxy{
+		AllowedClients: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8"), mustParseCIDR(t, "fd00::/8")},
+		DeniedClients:  []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")},
+	}
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"192.168.1.1", false},
+		{"fd00::1", true},
+	}
+	for _, test := range tests {
+		if got := p.clientAllowed(net.ParseIP(test.ip)); got != test.expected {
+			t.Errorf("clientAllowed(%v) is %v", test.ip, got)
+		}
+	}
+	if !(&Proxy{}).clientAllowed(net.ParseIP("192.168.1.1")) {
+		t.Error("Expected all clients to be allowed by default")
+	}
+}
+
+func TestDeniedClientMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics("crosscoap")
+	for _, reject := range []bool{true, false, false} {
+		p := newProxyHandler(&Proxy{
+			DeniedClients:       []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")},
+			RejectDeniedClients: reject,
+			Metrics:             metrics,
+		})
+		m := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString("/status")
+		coapResp := p.serveCOAP(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5683}, &m, nil, nil)
+		if (coapResp != nil) != reject {
+			t.Errorf("rejecting %v: response is %v", reject, coapResp)
+		}
+	}
+	w := adminRequest(newProxyHandler(&Proxy{Metrics: metrics}).adminHandler("secret"), "GET", "/metrics", "secret", "")
+	if body := w.Body.String(); !strings.Contains(body, `crosscoap_denied_clients_total{outcome="rejected"} 1`) || !strings.Contains(body, `crosscoap_denied_clients_total{outcome="ignored"} 2`) {
+		t.Errorf("metrics are %v", body)
+	}
+}
+
+func TestDotSegmentBypass(t *testing.T) {
+	var requested bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{
+		BackendURL: backend.URL,
+		AccessPolicy: &AccessPolicy{
+			Rules:         []AccessRule{{Action: Allow, PathPrefix: "/telemetry"}},
+			DefaultAction: Deny,
+		},
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	for _, path := range [][]string{{"telemetry", "..", "admin"}, {"telemetry", "x/../../admin"}, {"telemetry", "."}} {
+		m := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPath(path)
+		if coapResp := p.serveCOAP(a, &m, nil, nil); coapResp == nil || coapResp.Code != coap.BadRequest {
+			t.Errorf("%q: response is %v", path, coapResp)
+		}
+		if _, err := p.translator.TranslateRequest(&m); err == nil {
+			t.Errorf("%q: translated", path)
+		}
+	}
+	if requested {
+		t.Errorf("backend got a request with a dot segment")
+	}
+}
@@ -0,0 +1,633 @@
+package crosscoap
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminConfig is the configuration of a proxy shown by the admin API,
+// without secrets such as signing credentials, OSCORE keys and header
+// values.
+type adminConfig struct {
+	Version                 string        `json:"version"`
+	GoVersion               string        `json:"goVersion"`
+	Listeners               []string      `json:"listeners"`
+	BackendURL              string        `json:"backendURL"`
+	BackendHost             string        `json:"backendHost,omitempty"`
+	BackendAddresses        []string      `json:"backendAddresses,omitempty"`
+	ShadowBackendURL        string        `json:"shadowBackendURL,omitempty"`
+	FailoverBackendURLs     []string      `json:"failoverBackendURLs,omitempty"`
+	CanaryRoutes            []string      `json:"canaryRoutes,omitempty"`
+	Tenants                 []adminTenant `json:"tenants,omitempty"`
+	DryRun                  bool          `json:"dryRun"`
+	Timeout                 string        `json:"timeout"`
+	DialTimeout             string        `json:"dialTimeout,omitempty"`
+	TLSHandshakeTimeout     string        `json:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout   string        `json:"responseHeaderTimeout,omitempty"`
+	UserAgent               string        `json:"userAgent"`
+	ExpectContinue          bool          `json:"expectContinue"`
+	MapTrailers             bool          `json:"mapTrailers"`
+	ForwardMessageMetadata  bool          `json:"forwardMessageMetadata"`
+	ForwardClientAddress    bool          `json:"forwardClientAddress"`
+	AuthChallenges          bool          `json:"authChallenges"`
+	DefaultHeaders          []string      `json:"defaultHeaders,omitempty"`
+	BackendCredentials      bool          `json:"backendCredentials"`
+	CredentialsByURIHost    bool          `json:"credentialsByURIHost"`
+	RequireCredentials      bool          `json:"requireCredentials"`
+	SigV4                   bool          `json:"sigV4"`
+	HMAC                    bool          `json:"hmac"`
+	AccessPolicy            bool          `json:"accessPolicy"`
+	Authenticators          int           `json:"authenticators"`
+	RequireAuthentication   bool          `json:"requireAuthentication"`
+	PrincipalHeader         string        `json:"principalHeader,omitempty"`
+	AllowedClients          []string      `json:"allowedClients,omitempty"`
+	DeniedClients           []string      `json:"deniedClients,omitempty"`
+	RejectDeniedClients     bool          `json:"rejectDeniedClients"`
+	VerifyClientAddresses   bool          `json:"verifyClientAddresses"`
+	AmplificationLimit      int           `json:"amplificationLimit,omitempty"`
+	MaxRequestBodyBytes     int           `json:"maxRequestBodyBytes"`
+	StreamBlock1            bool          `json:"streamBlock1"`
+	StreamBlock2            bool          `json:"streamBlock2"`
+	OversizePolicy          string        `json:"oversizePolicy"`
+	RouteOversizePolicies   int           `json:"routeOversizePolicies"`
+	Routes                  int           `json:"routes"`
+	OSCOREBackendURL        string        `json:"oscoreBackendURL,omitempty"`
+	OSCOREContexts          int           `json:"oscoreContexts"`
+	OSCOREContextSource     bool          `json:"oscoreContextSource"`
+	DiagnosticPayloads      bool          `json:"diagnosticPayloads"`
+	StrictContentFormat     bool          `json:"strictContentFormat"`
+	DefaultContentType      string        `json:"defaultContentType,omitempty"`
+	TranscodeCBOR           bool          `json:"transcodeCBOR"`
+	TranscodeResponses      bool          `json:"transcodeResponses"`
+	NormalizeSenML          bool          `json:"normalizeSenML"`
+	TranslateLinkFormat     bool          `json:"translateLinkFormat"`
+	DeflateJSON             bool          `json:"deflateJSON"`
+	InflateRequests         []string      `json:"inflateRequests,omitempty"`
+	SeparateResponseDelay   string        `json:"separateResponseDelay,omitempty"`
+	ObserveInterval         string        `json:"observeInterval,omitempty"`
+	ObserveMaxBackoff       string        `json:"observeMaxBackoff,omitempty"`
+	QueueSize               int           `json:"queueSize,omitempty"`
+	SessionTTL              string        `json:"sessionTTL,omitempty"`
+	DrainTimeout            string        `json:"drainTimeout,omitempty"`
+	CacheMaxSize            int           `json:"cacheMaxSize,omitempty"`
+	NegativeCacheTTL        string        `json:"negativeCacheTTL,omitempty"`
+	RouteCachePolicies      int           `json:"routeCachePolicies"`
+	Prefetch                []string      `json:"prefetch,omitempty"`
+	ServeStale              string        `json:"serveStale,omitempty"`
+	RevalidateDownloads     bool          `json:"revalidateDownloads"`
+	AckTimeout              string        `json:"ackTimeout,omitempty"`
+	MaxRetransmit           int           `json:"maxRetransmit"`
+	ExchangeDeadlines       bool          `json:"exchangeDeadlines"`
+	RespondToNonConfirmable bool          `json:"respondToNonConfirmable"`
+	RewriteRules            int           `json:"rewriteRules"`
+	QueryRules              int           `json:"queryRules"`
+	URITemplate             bool          `json:"uriTemplate"`
+	ForwardProxy            bool          `json:"forwardProxy"`
+	MaxRedirects            int           `json:"maxRedirects,omitempty"`
+	TranslateRedirects      bool          `json:"translateRedirects"`
+	FetchMethod             string        `json:"fetchMethod,omitempty"`
+	ServeDiscovery          bool          `json:"serveDiscovery"`
+	ServeHealth             bool          `json:"serveHealth"`
+	StaticRoutes            []string      `json:"staticRoutes,omitempty"`
+	ResourceDirectory       string        `json:"resourceDirectory,omitempty"`
+	Multicast               string        `json:"multicast,omitempty"`
+	Middleware              int           `json:"middleware"`
+	PayloadTransformers     int           `json:"payloadTransformers"`
+	RequestValidation       bool          `json:"requestValidation"`
+	MaxTrackedClients       int           `json:"maxTrackedClients"`
+	MaxOutstanding          int           `json:"maxOutstanding,omitempty"`
+	DropExcessRequests      bool          `json:"dropExcessRequests"`
+	PacingRate              float64       `json:"pacingRate,omitempty"`
+	PacingQueueSize         int           `json:"pacingQueueSize,omitempty"`
+	ExchangeLifetime        string        `json:"exchangeLifetime,omitempty"`
+	NonDeduplication        int           `json:"nonDeduplication"`
+	UploadLifetime          string        `json:"uploadLifetime"`
+	DownloadLifetime        string        `json:"downloadLifetime"`
+	MaxConcurrentRequests   int           `json:"maxConcurrentRequests,omitempty"`
+	RequestQueueSize        int           `json:"requestQueueSize,omitempty"`
+	RecordExchanges         int           `json:"recordExchanges"`
+	ExchangeLog             bool          `json:"exchangeLog"`
+	MetricLabels            []string      `json:"metricLabels,omitempty"`
+	MetricLabelValues       int           `json:"metricLabelValues,omitempty"`
+	SLOWindow               string        `json:"sloWindow,omitempty"`
+	RouteSLOs               int           `json:"routeSLOs"`
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func networkStrings(networks []*net.IPNet) []string {
+	var s []string
+	for _, n := range networks {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+func (p *proxyHandler) adminConfig() *adminConfig {
+	c := &adminConfig{
+		BackendURL:              p.BackendURL,
+		BackendHost:             p.BackendHost,
+		ShadowBackendURL:        p.ShadowBackendURL,
+		FailoverBackendURLs:     p.FailoverBackendURLs,
+		DryRun:                  p.DryRun,
+		Timeout:                 p.timeout().String(),
+		DialTimeout:             durationString(p.DialTimeout),
+		TLSHandshakeTimeout:     durationString(p.TLSHandshakeTimeout),
+		ResponseHeaderTimeout:   durationString(p.ResponseHeaderTimeout),
+		UserAgent:               p.userAgent(),
+		Version:                 Version(),
+		GoVersion:               runtime.Version(),
+		ExpectContinue:          p.ExpectContinue,
+		MapTrailers:             p.MapTrailers,
+		ForwardMessageMetadata:  p.ForwardMessageMetadata,
+		ForwardClientAddress:    p.ForwardClientAddress,
+		AuthChallenges:          p.AuthChallenges != nil,
+		SigV4:                   p.SigV4 != nil,
+		HMAC:                    p.HMAC != nil,
+		AccessPolicy:            p.AccessPolicy != nil,
+		Authenticators:          len(p.Authenticators),
+		RequireAuthentication:   p.RequireAuthentication,
+		PrincipalHeader:         p.PrincipalHeader,
+		AllowedClients:          networkStrings(p.AllowedClients),
+		DeniedClients:           networkStrings(p.DeniedClients),
+		RejectDeniedClients:     p.RejectDeniedClients,
+		VerifyClientAddresses:   p.VerifyClientAddresses,
+		AmplificationLimit:      p.AmplificationLimit,
+		MaxRequestBodyBytes:     p.MaxRequestBodyBytes,
+		StreamBlock1:            p.StreamBlock1,
+		StreamBlock2:            p.StreamBlock2,
+		OversizePolicy:          p.OversizePolicy.String(),
+		RouteOversizePolicies:   len(p.RouteOversizePolicies),
+		Routes:                  len(p.Routes),
+		OSCOREBackendURL:        p.OSCOREBackendURL,
+		OSCOREContexts:          len(p.OSCOREContexts),
+		OSCOREContextSource:     p.OSCOREContextSource != nil,
+		BackendCredentials:      p.BackendCredentials != nil,
+		CredentialsByURIHost:    p.CredentialsByURIHost,
+		RequireCredentials:      p.RequireCredentials,
+		DiagnosticPayloads:      p.DiagnosticPayloads,
+		StrictContentFormat:     p.StrictContentFormat,
+		DefaultContentType:      p.DefaultContentType,
+		TranscodeCBOR:           p.TranscodeCBOR,
+		TranscodeResponses:      p.translator.Converters != nil,
+		NormalizeSenML:          p.NormalizeSenML,
+		TranslateLinkFormat:     p.TranslateLinkFormat,
+		DeflateJSON:             p.DeflateJSON,
+		InflateRequests:         p.InflateRequests,
+		SeparateResponseDelay:   durationString(p.SeparateResponseDelay),
+		ObserveInterval:         durationString(p.ObserveInterval),
+		ObserveMaxBackoff:       durationString(p.ObserveMaxBackoff),
+		QueueSize:               p.QueueSize,
+		SessionTTL:              durationString(p.SessionTTL),
+		DrainTimeout:            durationString(p.DrainTimeout),
+		CacheMaxSize:            p.CacheMaxSize,
+		NegativeCacheTTL:        durationString(p.NegativeCacheTTL),
+		RouteCachePolicies:      len(p.RouteCachePolicies),
+		Prefetch:                p.Prefetch,
+		ServeStale:              durationString(p.ServeStale),
+		RevalidateDownloads:     p.RevalidateDownloads,
+		AckTimeout:              durationString(p.AckTimeout),
+		MaxRetransmit:           p.MaxRetransmit,
+		ExchangeDeadlines:       p.ExchangeDeadlines,
+		RespondToNonConfirmable: p.RespondToNonConfirmable,
+		RewriteRules:            len(p.RewriteRules),
+		QueryRules:              len(p.QueryRules),
+		URITemplate:             p.URITemplate != nil,
+		ForwardProxy:            p.ForwardProxy != nil,
+		MaxRedirects:            p.MaxRedirects,
+		TranslateRedirects:      p.TranslateRedirects,
+		FetchMethod:             p.FetchMethod,
+		ServeDiscovery:          p.ServeDiscovery,
+		ServeHealth:             p.ServeHealth,
+		StaticRoutes:            p.staticRoutePaths(),
+		Middleware:              len(p.middleware),
+		PayloadTransformers:     len(p.PayloadTransformers),
+		RequestValidation:       p.RequestValidator != nil,
+		MaxTrackedClients:       p.clients.max,
+		MaxOutstanding:          p.MaxOutstanding,
+		DropExcessRequests:      p.DropExcessRequests,
+		PacingRate:              p.PacingRate,
+		PacingQueueSize:         p.PacingQueueSize,
+		ExchangeLifetime:        durationString(p.ExchangeLifetime),
+		NonDeduplication:        len(p.NonDeduplication),
+		UploadLifetime:          durationString(p.uploads.lifetime),
+		DownloadLifetime:        durationString(p.downloads.lifetime),
+		MaxConcurrentRequests:   p.MaxConcurrentRequests,
+		RequestQueueSize:        p.RequestQueueSize,
+		RecordExchanges:         p.RecordExchanges,
+		ExchangeLog:             p.ExchangeLog != nil,
+		RouteSLOs:               len(p.RouteSLOs),
+	}
+	if p.slo != nil {
+		c.SLOWindow = p.slo.window.String()
+	}
+	if p.metricLabels != nil {
+		c.MetricLabels = p.metricLabels.names
+		c.MetricLabelValues = p.metricLabels.maxValues
+	}
+	for _, l := range append([]*net.UDPConn{p.Listener}, p.Listeners...) {
+		if l != nil {
+			c.Listeners = append(c.Listeners, l.LocalAddr().String())
+		}
+	}
+	if p.backends != nil {
+		c.BackendAddresses = p.backends.current()
+	}
+	for _, route := range p.CanaryRoutes {
+		c.CanaryRoutes = append(c.CanaryRoutes, fmt.Sprintf("%v=%v:%v", route.PathPrefix, route.Percent, route.BackendURL))
+	}
+	for _, t := range p.Tenants {
+		tenant := adminTenant{Name: t.Name, Host: t.Host, PathPrefix: t.PathPrefix, BackendURL: t.BackendURL, RateLimit: t.RateLimit, Burst: t.Burst}
+		for _, route := range t.Routes {
+			tenant.Routes = append(tenant.Routes, newAdminRoute(route))
+		}
+		c.Tenants = append(c.Tenants, tenant)
+	}
+	for name := range p.DefaultHeaders {
+		c.DefaultHeaders = append(c.DefaultHeaders, name)
+	}
+	if p.ResourceDirectory != nil {
+		c.ResourceDirectory = p.ResourceDirectory.Addr
+	}
+	if p.MulticastListener != nil {
+		c.Multicast = p.MulticastListener.LocalAddr().String()
+	}
+	return c
+}
+
+// adminRoute is a RouteConfig in the admin API, with durations such as
+// "5m"; a nonDeduplication of "0s" exempts the route.
+type adminRoute struct {
+	PathPrefix          string   `json:"pathPrefix"`
+	Timeout             string   `json:"timeout,omitempty"`
+	MaxRequestBodyBytes int      `json:"maxRequestBodyBytes,omitempty"`
+	Oversize            string   `json:"oversize,omitempty"`
+	CacheTTL            string   `json:"cacheTTL,omitempty"`
+	CacheBypass         bool     `json:"cacheBypass,omitempty"`
+	CacheMethods        []string `json:"cacheMethods,omitempty"`
+	NonDeduplication    string   `json:"nonDeduplication,omitempty"`
+	RateLimit           float64  `json:"rateLimit,omitempty"`
+	Burst               int      `json:"burst,omitempty"`
+	Quiet               bool     `json:"quiet,omitempty"`
+}
+
+// adminTenant is a Tenant in the admin API.
+type adminTenant struct {
+	Name       string  `json:"name"`
+	Host       string  `json:"host,omitempty"`
+	PathPrefix string  `json:"pathPrefix,omitempty"`
+	BackendURL string  `json:"backendURL,omitempty"`
+	RateLimit  float64 `json:"rateLimit,omitempty"`
+	Burst      int     `json:"burst,omitempty"`
+
+	Routes []adminRoute `json:"routes,omitempty"`
+}
+
+// adminStats are the statistics shown by the admin API.
+type adminStats struct {
+	Routes           []RouteStats `json:"routes"`
+	PendingUploads   int          `json:"pendingUploads"`
+	PendingDownloads int          `json:"pendingDownloads"`
+	Observers        int          `json:"observers"`
+	PushObservations int          `json:"pushObservations"`
+	Sessions         int          `json:"sessions"`
+	Cache            *CacheStats  `json:"cache,omitempty"`
+}
+
+func (ts *transfers) count() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.pending)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// adminHandler returns the handler of the admin API, whose requests must
+// carry token as a bearer token:
+//
+//	GET /config  shows the proxy configuration, without secrets
+//	GET /stats   shows per-route statistics, pending block-wise transfers
+//	             and the numbers of observers and client sessions, and the
+//	             cache statistics
+//	GET /slo     shows the latency percentiles, error rate and payload
+//	             sizes of each route over the SLOWindow, with the RouteSLOs
+//	             they breach
+//	GET /clients shows per-client statistics, ordered by ?sort=requests
+//	             (the default), errors, bytes or lastSeen, and at most
+//	             ?limit=N clients
+//	GET /exchanges shows the last RecordExchanges exchanges as a HAR log
+//	GET /routes  lists the routes: Routes, then those of the deprecated
+//	             per-setting route lists
+//	PUT /routes  replaces all of them with the JSON list in the body, e.g.
+//	             [{"pathPrefix": "/firmware", "timeout": "5m",
+//	             "maxRequestBodyBytes": 65536, "oversize": "block2",
+//	             "cacheTTL": "1m", "cacheBypass": false, "cacheMethods":
+//	             ["GET"], "nonDeduplication": "10s", "rateLimit": 10,
+//	             "burst": 20, "quiet": true}], each route setting at
+//	             least one of them; rate limits start afresh
+//	GET /devices lists the endpoints of the devices in the registry
+//	POST /push   sends the CoAP request {"device": "ID or HOST:PORT",
+//	             "method": "POST", "path": "/a?b=c", "payload": "text" (or
+//	             "payloadBase64"), "contentFormat": 0} to a device and
+//	             shows its response {"code": "2.04", "payload": ...}; if
+//	             QueueSize is set, a request which the device doesn't
+//	             acknowledge (or with "queue": true) is queued instead, to
+//	             be delivered when it next contacts the proxy
+//	GET /observe?device=ID&path=/a?b=c subscribes to a device resource
+//	             with CoAP Observe, shared by its subscribers: with Accept:
+//	             text/event-stream, the notifications {"seq": 1,
+//	             "observing": true, "code": "2.05", "payload": ...} are
+//	             streamed as server-sent events; otherwise the request
+//	             long-polls for the first one after ?since=SEQ, or answers
+//	             204 No Content after ?wait=DURATION (default 30s)
+//	GET /queue   lists the devices with queued requests
+//	DELETE /cache?prefix=PATTERN purges the cached responses whose backend
+//	             URL (or path, if PATTERN starts with a slash) starts with
+//	             PATTERN, in which * stands for any characters, and shows
+//	             their number {"purged": 3}
+//	GET /metrics shows the Metrics in the Prometheus text format, if they
+//	             are PrometheusMetrics
+//
+// The probes GET /healthz (all listeners are being served) and GET /readyz
+// (also, the backend is reachable) need no token, so that load balancers
+// and Kubernetes can use them; they answer 200 OK or 503 Service
+// Unavailable.
+//
+// If AdminDebug is set, it also serves the runtime profiles of
+// net/http/pprof under /debug/pprof/ and the expvar variables under
+// /debug/vars.
+func (p *proxyHandler) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, p.adminConfig())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, &adminStats{
+			Routes:           p.stats.snapshot(),
+			PendingUploads:   p.uploads.count(),
+			PendingDownloads: p.downloads.count(),
+			Observers:        p.observers.count(),
+			PushObservations: p.observations.count(),
+			Sessions:         p.sessions.size(),
+			Cache:            p.cache.stats(),
+		})
+	})
+	mux.HandleFunc("/slo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, p.slo.snapshot(time.Now()))
+	})
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		query := r.URL.Query()
+		sortBy := query.Get("sort")
+		switch sortBy {
+		case "", "requests", "errors", "bytes", "lastSeen":
+		default:
+			writeJSONError(w, http.StatusBadRequest, "invalid sort order "+sortBy)
+			return
+		}
+		limit := 0
+		if s := query.Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid limit "+s)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, p.clients.snapshot(sortBy, limit))
+	})
+	mux.HandleFunc("/exchanges", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, p.recorder.harLog())
+	})
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			var routes []adminRoute
+			if err := json.NewDecoder(r.Body).Decode(&routes); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+				return
+			}
+			configs, err := parseAdminRoutes(routes)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			p.routes.set(newRouteOverrides(configs))
+			p.logError("Admin API: replaced the routes with %v routes", len(configs))
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		routes := []adminRoute{}
+		for _, route := range p.routes.get() {
+			routes = append(routes, newAdminRoute(route.RouteConfig))
+		}
+		writeJSON(w, http.StatusOK, routes)
+	})
+	mux.HandleFunc("/push", p.servePush)
+	mux.HandleFunc("/observe", p.serveObserve)
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, p.devices.snapshot())
+	})
+	if p.queues != nil {
+		mux.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			writeJSON(w, http.StatusOK, p.queues.snapshot())
+		})
+	}
+	if p.cache != nil {
+		mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "DELETE" {
+				writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			pattern := r.URL.Query().Get("prefix")
+			if pattern == "" {
+				writeJSONError(w, http.StatusBadRequest, "missing prefix")
+				return
+			}
+			purged := p.PurgeCache(pattern)
+			p.logError("Admin API: purged %v cached responses matching %v", purged, pattern)
+			writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+		})
+	}
+	if metrics, ok := p.Metrics.(*PrometheusMetrics); ok {
+		mux.Handle("/metrics", metrics)
+	}
+	if p.AdminDebug {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			serveHTTPHealth(w, p.health.live)
+			return
+		case "/readyz":
+			serveHTTPHealth(w, func() error { return p.health.ready(p.checkedBackendURL()) })
+			return
+		}
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) || subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="crosscoap"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// newAdminRoute returns the route r in the admin API.
+func newAdminRoute(r RouteConfig) adminRoute {
+	route := adminRoute{
+		PathPrefix:          r.PathPrefix,
+		MaxRequestBodyBytes: r.MaxRequestBodyBytes,
+		CacheBypass:         r.CacheBypass,
+		CacheMethods:        r.CacheMethods,
+		RateLimit:           r.RateLimit,
+		Burst:               r.Burst,
+		Quiet:               r.Quiet,
+	}
+	if r.Timeout > 0 {
+		route.Timeout = r.Timeout.String()
+	}
+	if r.Oversize != nil {
+		route.Oversize = r.Oversize.String()
+	}
+	if r.CacheTTL > 0 {
+		route.CacheTTL = r.CacheTTL.String()
+	}
+	if r.NonDeduplication > 0 {
+		route.NonDeduplication = r.NonDeduplication.String()
+	} else if r.NonDeduplication < 0 {
+		route.NonDeduplication = "0s"
+	}
+	return route
+}
+
+// parseAdminRoutes returns the RouteConfigs of the routes of the admin API.
+func parseAdminRoutes(routes []adminRoute) ([]RouteConfig, error) {
+	var configs []RouteConfig
+	for _, route := range routes {
+		config, err := route.config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %v: %v", route.PathPrefix, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// config returns the RouteConfig of r.
+func (r *adminRoute) config() (RouteConfig, error) {
+	config := RouteConfig{
+		PathPrefix:          r.PathPrefix,
+		MaxRequestBodyBytes: r.MaxRequestBodyBytes,
+		CacheBypass:         r.CacheBypass,
+		CacheMethods:        r.CacheMethods,
+		RateLimit:           r.RateLimit,
+		Burst:               r.Burst,
+		Quiet:               r.Quiet,
+	}
+	if r.MaxRequestBodyBytes < 0 || r.RateLimit < 0 || r.Burst < 0 {
+		return config, errors.New("negative setting")
+	}
+	duration := func(name, s string) (time.Duration, error) {
+		if s == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid %v %q", name, s)
+		}
+		return d, nil
+	}
+	var err error
+	if config.Timeout, err = duration("timeout", r.Timeout); err != nil {
+		return config, err
+	}
+	if config.CacheTTL, err = duration("cacheTTL", r.CacheTTL); err != nil {
+		return config, err
+	}
+	if config.NonDeduplication, err = duration("nonDeduplication", r.NonDeduplication); err != nil {
+		return config, err
+	}
+	if r.NonDeduplication != "" && config.NonDeduplication == 0 {
+		config.NonDeduplication = -1 // exempt
+	}
+	if r.Oversize != "" {
+		policy, err := ParseOversizePolicy(r.Oversize)
+		if err != nil {
+			return config, err
+		}
+		config.Oversize = &policy
+	}
+	if config.Timeout == 0 && config.MaxRequestBodyBytes == 0 && config.Oversize == nil && config.CacheTTL == 0 && !config.CacheBypass &&
+		config.NonDeduplication == 0 && config.RateLimit == 0 && !config.Quiet {
+		return config, errors.New("no setting")
+	}
+	return config, nil
+}
+
+// serveAdmin serves the admin API on AdminListener until it fails.
+func (p *proxyHandler) serveAdmin() {
+	// No WriteTimeout, which would cut CPU profiles and traces short
+	server := &http.Server{Handler: p.adminHandler(p.AdminToken), ReadHeaderTimeout: 10 * time.Second}
+	if err := server.Serve(p.AdminListener); err != nil && !p.life.isHandedOver() {
+		p.logError("Error serving the admin API: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func adminRequest(handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAPIAuthentication(t *testing.T) {
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1", DefaultHeaders: http.Header{"Authorization": {"Bearer backend-secret"}}})
+	handler := p.adminHandler("secret")
+	for _, token := range []string{"", "wrong", "secre"} {
+		if w := adminRequest(handler, "GET", "/config", token, ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("response with token '%v' is %v", token, w.Code)
+		}
+	}
+	w := adminRequest(handler, "GET", "/config", "secret", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("response is %v", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "backend-secret") {
+		t.Errorf("config shows a secret: %v", w.Body)
+	}
+	var config adminConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil || config.BackendURL != "http://127.0.0.1:1" || len(config.DefaultHeaders) != 1 {
+		t.Errorf("config is '%+v' (error %v)", config, err)
+	}
+}
+
+func TestAdminAPIStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, RouteTimeouts: []RouteTimeout{{PathPrefix: "/sensors/", Timeout: time.Second}}})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	for _, path := range []string{"/sensors/1", "/sensors/2", "/missing"} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(path)
+		p.handleRequest(a, m, nil)
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/stats", "secret", "")
+	var stats adminStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || len(stats.Routes) != 2 {
+		t.Fatalf("stats are '%v' (error %v)", w.Body, err)
+	}
+	if r := stats.Routes[0]; r.Route != "/missing" || r.Requests != 1 || r.Responses["4.04"] != 1 {
+		t.Errorf("first route stats are '%+v'", r)
+	}
+	if r := stats.Routes[1]; r.Route != "/sensors" || r.Requests != 2 || r.Responses["2.05"] != 2 || r.MaxLatency <= 0 {
+		t.Errorf("second route stats are '%+v'", r)
+	}
+}
+
+func TestAdminAPIRoutes(t *testing.T) {
+	timeout := 5 * time.Second
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1", Timeout: &timeout})
+	handler := p.adminHandler("secret")
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	m.SetPathString("/firmware/image")
+	if timeout := p.requestTimeout(m); timeout != 5*time.Second {
+		t.Errorf("timeout before reload is %v", timeout)
+	}
+
+	w := adminRequest(handler, "PUT", "/routes", "secret", `[{"pathPrefix": "/firmware", "timeout": "5m"}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("response is %v: %v", w.Code, w.Body)
+	}
+	if timeout := p.requestTimeout(m); timeout != 5*time.Minute {
+		t.Errorf("timeout after reload is %v", timeout)
+	}
+	if w := adminRequest(handler, "GET", "/routes", "secret", ""); !strings.Contains(w.Body.String(), `"timeout":"5m0s"`) {
+		t.Errorf("routes are '%v'", w.Body)
+	}
+
+	for _, body := range []string{
+		`{}`,
+		`[{"pathPrefix": "/a", "timeout": "soon"}]`,
+		`[{"pathPrefix": "/a"}]`,
+		`[{"pathPrefix": "/a", "oversize": "drop"}]`,
+		`[{"pathPrefix": "/a", "maxRequestBodyBytes": -1}]`,
+	} {
+		if w := adminRequest(handler, "PUT", "/routes", "secret", body); w.Code != http.StatusBadRequest {
+			t.Errorf("response to '%v' is %v", body, w.Code)
+		}
+	}
+	if timeout := p.requestTimeout(m); timeout != 5*time.Minute {
+		t.Errorf("timeout after invalid reloads is %v", timeout)
+	}
+}
+
+func TestAdminAPIRouteConfigs(t *testing.T) {
+	block2 := Block2Oversize
+	p := newProxyHandler(&Proxy{
+		BackendURL:          "http://127.0.0.1:1",
+		MaxRequestBodyBytes: 10,
+		Routes:              []RouteConfig{{PathPrefix: "/firmware", Timeout: time.Minute, Oversize: &block2}},
+		RouteTimeouts:       []RouteTimeout{{PathPrefix: "/telemetry", Timeout: time.Second}},
+	})
+	handler := p.adminHandler("secret")
+	request := func(path string) *coap.Message {
+		m := &coap.Message{Type: coap.NonConfirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(path)
+		return m
+	}
+
+	// Routes and the deprecated lists make up one table
+	w := adminRequest(handler, "GET", "/routes", "secret", "")
+	var routes []adminRoute
+	if err := json.Unmarshal(w.Body.Bytes(), &routes); err != nil || len(routes) != 2 {
+		t.Fatalf("routes are '%v' (error %v)", w.Body, err)
+	}
+	if r := routes[0]; r.PathPrefix != "/firmware" || r.Timeout != "1m0s" || r.Oversize != "block2" {
+		t.Errorf("first route is %+v", r)
+	}
+	if r := routes[1]; r.PathPrefix != "/telemetry" || r.Timeout != "1s" {
+		t.Errorf("second route is %+v", r)
+	}
+
+	w = adminRequest(handler, "PUT", "/routes", "secret", `[
+		{"pathPrefix": "/telemetry/raw", "nonDeduplication": "0s"},
+		{"pathPrefix": "/telemetry", "timeout": "2s", "maxRequestBodyBytes": 100, "oversize": "compress",
+		 "cacheTTL": "1m", "cacheMethods": ["GET"], "nonDeduplication": "10s", "rateLimit": 5, "quiet": true}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("response is %v: %v", w.Code, w.Body)
+	}
+	for _, tt := range []struct {
+		path           string
+		expectedWindow time.Duration
+	}{
+		{"/telemetry/temp", 10 * time.Second},
+		{"/telemetry/raw", 0},
+	} {
+		m := request(tt.path)
+		if timeout := p.requestTimeout(m); timeout != 2*time.Second {
+			t.Errorf("%v: timeout is %v", tt.path, timeout)
+		}
+		if max := p.maxRequestBodyBytes(m); max != 100 {
+			t.Errorf("%v: maximum payload size is %v", tt.path, max)
+		}
+		if policy := p.oversizePolicy(m); policy != CompressOversize {
+			t.Errorf("%v: oversize policy is %v", tt.path, policy)
+		}
+		if policy := p.cachePolicy(m); policy == nil || policy.TTL != time.Minute {
+			t.Errorf("%v: cache policy is %+v", tt.path, policy)
+		}
+		if window := p.nonDedupWindow(m); window != tt.expectedWindow {
+			t.Errorf("%v: NON deduplication window is %v", tt.path, window)
+		}
+		if r := p.routeLimiter(m); r == nil || !p.quiet(m) {
+			t.Errorf("%v: rate limited route is %v (quiet %v)", tt.path, r, p.quiet(m))
+		}
+	}
+	if p.routes.routeName("/telemetry/raw/1") != "/telemetry/raw" {
+		t.Errorf("stats route is %v", p.routes.routeName("/telemetry/raw/1"))
+	}
+
+	// The routes given at startup are replaced too
+	m := request("/firmware")
+	if timeout := p.requestTimeout(m); timeout != defaultHTTPTimeout {
+		t.Errorf("firmware timeout after reload is %v", timeout)
+	}
+	if max := p.maxRequestBodyBytes(m); max != 10 {
+		t.Errorf("firmware maximum payload size after reload is %v", max)
+	}
+	w = adminRequest(handler, "GET", "/routes", "secret", "")
+	if !strings.Contains(w.Body.String(), `{"pathPrefix":"/telemetry/raw","nonDeduplication":"0s"}`) || strings.Contains(w.Body.String(), "/firmware") {
+		t.Errorf("routes after reload are '%v'", w.Body)
+	}
+}
+
+func TestAdminAPIDebug(t *testing.T) {
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1"})
+	if w := adminRequest(p.adminHandler("secret"), "GET", "/debug/vars", "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("response without AdminDebug is %v", w.Code)
+	}
+	p = newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1", AdminDebug: true})
+	handler := p.adminHandler("secret")
+	if w := adminRequest(handler, "GET", "/debug/vars", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("response without token is %v", w.Code)
+	}
+	if w := adminRequest(handler, "GET", "/debug/vars", "secret", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "memstats") {
+		t.Errorf("expvar response is %v", w.Code)
+	}
+	if w := adminRequest(handler, "GET", "/debug/pprof/goroutine?debug=1", "secret", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Errorf("goroutine profile response is %v", w.Code)
+	}
+}
+
+func TestAdminAPIClients(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, MaxTrackedClients: 2})
+	udpListener, _ := createLocalUDPListener(t)
+	defer udpListener.Close()
+	send := func(port int, path string) {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(path)
+		packet, _ := m.MarshalBinary()
+		p.handlePacket(p.transportOf(udpListener), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, packet)
+	}
+	send(1001, "/a")
+	send(1002, "/a")
+	send(1002, "/missing")
+	send(1003, "/a")
+	send(1003, "/a")
+	send(1003, "/a")
+	p.handlePacket(p.transportOf(udpListener), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1002}, []byte{0xff})
+
+	handler := p.adminHandler("secret")
+	w := adminRequest(handler, "GET", "/clients", "secret", "")
+	var clients []ClientStats
+	if err := json.Unmarshal(w.Body.Bytes(), &clients); err != nil || len(clients) != 2 {
+		t.Fatalf("clients are '%v' (error %v)", w.Body, err)
+	}
+	if c := clients[0]; c.Address != "127.0.0.1:1003" || c.Requests != 3 || c.Errors != 0 || c.BytesIn == 0 || c.BytesOut == 0 {
+		t.Errorf("first client is '%+v'", c)
+	}
+	if c := clients[1]; c.Address != "127.0.0.1:1002" || c.Requests != 2 || c.Errors != 2 || c.LastSeen.IsZero() {
+		t.Errorf("second client is '%+v'", c)
+	}
+
+	w = adminRequest(handler, "GET", "/clients?sort=errors&limit=1", "secret", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &clients); err != nil || len(clients) != 1 || clients[0].Address != "127.0.0.1:1002" {
+		t.Errorf("clients with the most errors are '%v' (error %v)", w.Body, err)
+	}
+	for _, query := range []string{"sort=name", "limit=-1", "limit=x"} {
+		if w := adminRequest(handler, "GET", "/clients?"+query, "secret", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("response to '%v' is %v", query, w.Code)
+		}
+	}
+}
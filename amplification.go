@@ -0,0 +1,157 @@
+package crosscoap
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// amplificationIdle is how long the budget of a client endpoint, and its
+// verification, is kept after its last packet.
+const amplificationIdle = 5 * time.Minute
+
+// metricAmplificationGuarded counts the messages to unverified client
+// endpoints which exceeded their AmplificationLimit budget, labeled by
+// action: challenged (replaced by an Echo challenge) or dropped.
+const metricAmplificationGuarded = "amplification_guarded_messages"
+
+// amplificationBudget is the token bucket of a client endpoint: the bytes
+// which may still be sent to it.
+type amplificationBudget struct {
+	tokens   int
+	verified bool // the endpoint echoed an Echo value
+	seen     time.Time
+}
+
+// amplificationGuard caps the bytes sent to unverified client endpoints to
+// AmplificationLimit times the bytes received from them.
+type amplificationGuard struct {
+	factor int
+	echo   *echoVerifier
+
+	mu        sync.Mutex
+	endpoints map[string]*amplificationBudget
+}
+
+// newAmplificationGuard returns the guard of AmplificationLimit, or nil if
+// it's zero.  It shares the Echo values of VerifyClientAddresses.
+func (p *proxyHandler) newAmplificationGuard() *amplificationGuard {
+	if p.AmplificationLimit <= 0 {
+		return nil
+	}
+	echo := p.echo
+	if echo == nil {
+		echo = newEchoVerifier()
+	}
+	return &amplificationGuard{factor: p.AmplificationLimit, echo: echo, endpoints: make(map[string]*amplificationBudget)}
+}
+
+// received credits the budget of a with a packet of size bytes carrying
+// options, verifying a if they include a fresh Echo value.  The budget is
+// capped at the credit of a full-sized packet.
+func (g *amplificationGuard) received(a *net.UDPAddr, options []rawOption, size int, now time.Time) {
+	if g == nil {
+		return
+	}
+	value, echoed := findOption(options, optionEcho)
+	verified := echoed && g.echo.verify(a, value)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b := g.endpoints[a.String()]
+	if b == nil {
+		b = &amplificationBudget{}
+		g.endpoints[a.String()] = b
+	}
+	b.seen = now
+	b.verified = b.verified || verified
+	b.tokens += g.factor * size
+	if max := g.factor * maxCOAPPacketLen; b.tokens > max {
+		b.tokens = max
+	}
+}
+
+// spend reports whether size bytes may be sent to a, taking them from its
+// budget unless a is verified.
+func (g *amplificationGuard) spend(a *net.UDPAddr, size int) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b := g.endpoints[a.String()]
+	switch {
+	case b != nil && b.verified:
+		return true
+	case b == nil || b.tokens < size:
+		return false
+	}
+	b.tokens -= size
+	return true
+}
+
+// expire forgets the endpoints idle since amplificationIdle before now, and
+// returns their number.
+func (g *amplificationGuard) expire(now time.Time) int {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	expired := 0
+	for key, b := range g.endpoints {
+		if now.Sub(b.seen) >= amplificationIdle {
+			delete(g.endpoints, key)
+			expired++
+		}
+	}
+	return expired
+}
+
+// guardAmplification returns data, the encoding of coapResp, if it fits in
+// the budget of a; otherwise a response gets replaced by a 4.01
+// Unauthorized with an Echo option encoded into data, which the client
+// repeats its request with to verify its address (RFC 9175 section 2.4),
+// if that fits, and nil is returned if nothing does.
+func (p *proxyHandler) guardAmplification(a *net.UDPAddr, coapResp *translatedCOAPMessage, data []byte) []byte {
+	g := p.amplification
+	if g.spend(a, len(data)) {
+		return data
+	}
+	if coapResp.Code>>5 >= 2 {
+		challenge := coap.Message{Type: coapResp.Type, Code: coap.Unauthorized, MessageID: coapResp.MessageID, Token: coapResp.Token}
+		echo := []rawOption{{ID: optionEcho, Value: g.echo.value(a)}}
+		if data, err := appendMessage(data[:0], &challenge, echo); err == nil && g.spend(a, len(data)) {
+			p.metrics().Counter(metricAmplificationGuarded, 1, Labels{"action": "challenged"})
+			p.logAccess("%v: CoAP %v response withheld beyond the amplification limit, until the client address is verified", a, codeString(coapResp.Code))
+			return data
+		}
+	}
+	p.amplificationDropped(a, len(data))
+	return nil
+}
+
+// exceedsAmplification reports whether the message m with the extra
+// options, sent to a as a separate response or a notification, is dropped
+// for exceeding the budget of a.
+func (p *proxyHandler) exceedsAmplification(a *net.UDPAddr, m *coap.Message, extra []rawOption) bool {
+	if p.amplification == nil {
+		return false
+	}
+	buf := getPacketBuffer()
+	defer putPacketBuffer(buf)
+	data, err := appendMessage((*buf)[:0], m, extra)
+	if err != nil || p.amplification.spend(a, len(data)) {
+		return false
+	}
+	p.amplificationDropped(a, len(data))
+	return true
+}
+
+// amplificationDropped measures a message of size bytes to a dropped for
+// exceeding its budget.
+func (p *proxyHandler) amplificationDropped(a *net.UDPAddr, size int) {
+	p.metrics().Counter(metricAmplificationGuarded, 1, Labels{"action": "dropped"})
+	p.logAccess("%v: CoAP message of %v bytes dropped beyond the amplification limit", a, size)
+}
@@ -0,0 +1,91 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestAmplificationGuard(t *testing.T) {
+	p := newProxyHandler(&Proxy{AmplificationLimit: 3})
+	g := p.amplification
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	now := time.Now()
+	if g.spend(a, 1) {
+		t.Errorf("unknown endpoint has a budget")
+	}
+	g.received(a, nil, 10, now)
+	if !g.spend(a, 20) || g.spend(a, 11) || !g.spend(a, 10) {
+		t.Errorf("budget of 10 bytes received isn't 30 bytes")
+	}
+	g.received(a, nil, 2*maxCOAPPacketLen, now)
+	if g.spend(a, 3*maxCOAPPacketLen+1) {
+		t.Errorf("budget isn't capped")
+	}
+	g.received(a, []rawOption{{ID: optionEcho, Value: g.echo.value(a)}}, 10, now)
+	if !g.spend(a, 10*maxCOAPPacketLen) {
+		t.Errorf("verified endpoint has a budget")
+	}
+	if expired := g.expire(now.Add(amplificationIdle)); expired != 1 || g.spend(a, 1) {
+		t.Errorf("%v endpoints expired", expired)
+	}
+}
+
+func TestProxyWithAmplificationLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{Listener: server, BackendURL: backend.URL, AmplificationLimit: 3, Metrics: metrics})
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	exchange := func(mid uint16, echo []byte) (*coap.Message, []rawOption) {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: mid, Token: []byte{1}}
+		m.SetPathString("/large")
+		var extra []rawOption
+		if echo != nil {
+			extra = []rawOption{{ID: optionEcho, Value: echo}}
+		}
+		packet, _ := appendMessage(nil, m, extra)
+		p.handlePacket(p.transportOf(server), clientAddr, packet)
+		buf := make([]byte, maxCOAPPacketLen)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			return nil, nil
+		}
+		coapResp, options, _ := parsePacket(buf[:n])
+		return coapResp, options
+	}
+
+	coapResp, options := exchange(1, nil)
+	if coapResp == nil || coapResp.Code != coap.Unauthorized {
+		t.Fatalf("response to unverified client is '%v'", coapResp)
+	}
+	echo, found := findOption(options, optionEcho)
+	if !found {
+		t.Fatalf("challenge has no Echo option: '%v'", coapResp)
+	}
+	if coapResp, _ = exchange(2, echo); coapResp == nil || coapResp.Code != coap.Content || !bytes.Equal(coapResp.Payload, body) {
+		t.Errorf("response to client echoing the challenge is '%v'", coapResp)
+	}
+	if coapResp, _ = exchange(3, nil); coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("response to verified client is '%v'", coapResp)
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	if !strings.Contains(w.Body.String(), `crosscoap_amplification_guarded_messages_total{action="challenged"} 1`) {
+		t.Errorf("metrics are %v", w.Body)
+	}
+}
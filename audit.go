@@ -0,0 +1,37 @@
+package crosscoap
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// audit records a request in the exchange rc answered by coapResp to
+// AuditLog if the response is an error.
+func (p *proxyHandler) audit(rc *RequestContext, m *coap.Message, coapResp *translatedCOAPMessage, latency time.Duration) {
+	if p.AuditLog == nil || coapResp == nil || coapResp.Code < coap.BadRequest {
+		return
+	}
+	backendURL, backendResult := "-", "-"
+	if coapResp.backendURL != "" {
+		backendURL = coapResp.backendURL
+	}
+	if coapResp.backendErr != nil {
+		backendResult = coapResp.backendErr.Error()
+	} else if coapResp.httpStatus != 0 {
+		backendResult = fmt.Sprintf("%v %v", coapResp.httpStatus, http.StatusText(coapResp.httpStatus))
+	}
+	identity := rc.Identity
+	if identity == "" {
+		identity = "-"
+	}
+	principal := rc.Principal
+	if principal == "" {
+		principal = "-"
+	}
+	p.AuditLog.Printf("%v: CoAP %v %v MID=%v Token=%x URI-Path=%v URI-Query=%v Payload=%vB -> %v Backend-URL=%v Backend=%q Latency=%v Request-ID=%v Tenant=%v Identity=%v Principal=%v",
+		rc.Client, m.Type, m.Code, m.MessageID, m.Token, m.PathString(), m.Options(coap.URIQuery), len(m.Payload),
+		codeString(coapResp.Code), backendURL, backendResult, latency, rc.RequestID, p.tenantName(m), identity, principal)
+}
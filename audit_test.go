@@ -0,0 +1,40 @@
+package crosscoap
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestAuditLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	var auditLog bytes.Buffer
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, AuditLog: log.New(&auditLog, "", 0)})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	for i, path := range []string{"/ok", "/fail"} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: uint16(i), Token: []byte{0xab}}
+		m.SetPathString(path)
+		p.handleRequest(a, m, nil)
+	}
+
+	lines := strings.Split(strings.TrimSpace(auditLog.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("audit log is '%v'", auditLog.String())
+	}
+	for _, s := range []string{"127.0.0.1:5683", "MID=1", "Token=ab", "URI-Path=fail", "-> 5.03", "Backend-URL=" + backend.URL + "/fail", `Backend="503 Service Unavailable"`, "Request-ID=ab-"} {
+		if !strings.Contains(lines[0], s) {
+			t.Errorf("audit line '%v' lacks '%v'", lines[0], s)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package crosscoap
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// metricAuthentications counts the requests run through the
+// Authenticators, labeled by outcome: authenticated, anonymous,
+// unauthenticated or forbidden.
+const metricAuthentications = "authentications"
+
+// Authenticator authenticates the CoAP clients of the proxy, before their
+// requests are translated.
+type Authenticator interface {
+	// Authenticate returns the principal on whose behalf the request m in
+	// the exchange rc is made, such as a device or user name, or "" if m
+	// carries no credentials the authenticator knows of.  Invalid
+	// credentials are reported with an error, answered with 4.01
+	// Unauthorized, or with 4.03 Forbidden if it wraps ErrForbidden.
+	Authenticate(rc *RequestContext, m *coap.Message) (string, error)
+}
+
+// authenticate runs the request m in the exchange rc through the
+// Authenticators: the first one returning a principal or an error decides.
+// It sets the principal of rc, and returns nil if the request may go on,
+// else the response denying it.
+func (p *proxyHandler) authenticate(rc *RequestContext, m *coap.Message) *translatedCOAPMessage {
+	if len(p.Authenticators) == 0 {
+		return nil
+	}
+	metrics := p.metrics()
+	for _, authenticator := range p.Authenticators {
+		principal, err := authenticator.Authenticate(rc, m)
+		switch {
+		case errors.Is(err, ErrForbidden):
+			metrics.Counter(metricAuthentications, 1, Labels{"outcome": "forbidden"})
+			p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied: %v", rc.Client, methodName(m.Code), m.PathString(), rc.RequestID, err)
+			return p.errorResponse(m, coap.Forbidden, "forbidden")
+		case err != nil:
+			metrics.Counter(metricAuthentications, 1, Labels{"outcome": "unauthenticated"})
+			p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied: %v", rc.Client, methodName(m.Code), m.PathString(), rc.RequestID, err)
+			return p.errorResponse(m, coap.Unauthorized, "authentication failed")
+		case principal != "":
+			metrics.Counter(metricAuthentications, 1, Labels{"outcome": "authenticated"})
+			rc.Principal = principal
+			return nil
+		}
+	}
+	if p.RequireAuthentication {
+		metrics.Counter(metricAuthentications, 1, Labels{"outcome": "unauthenticated"})
+		p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied: no credentials", rc.Client, methodName(m.Code), m.PathString(), rc.RequestID)
+		return p.errorResponse(m, coap.Unauthorized, "authentication required")
+	}
+	metrics.Counter(metricAuthentications, 1, Labels{"outcome": "anonymous"})
+	return nil
+}
+
+// PSKAuthenticator authenticates the clients by the identity of the
+// pre-shared key they secure their requests with: the Recipient ID of
+// their OSCORE context (see RequestContext), the proxy having no DTLS.
+type PSKAuthenticator struct {
+	// Principals maps the identities of the keys, such as "oscore:0a", to
+	// the principals of their clients.  Clients with a key not listed are
+	// forbidden.
+	Principals map[string]string
+}
+
+// Authenticate returns the principal of the key identity of rc.
+func (a *PSKAuthenticator) Authenticate(rc *RequestContext, m *coap.Message) (string, error) {
+	if rc.Identity == "" {
+		return "", nil
+	}
+	principal, found := a.Principals[rc.Identity]
+	if !found {
+		return "", fmt.Errorf("%w: unknown key identity %v", ErrForbidden, rc.Identity)
+	}
+	return principal, nil
+}
+
+// jwtLeeway is the clock skew tolerated when checking the validity period
+// of JSON Web Tokens.
+const jwtLeeway = 30 * time.Second
+
+// JWTQueryAuthenticator authenticates the clients by a JSON Web Token (RFC
+// 7519) in a query parameter of their requests, such as
+// "?token=eyJhbGciOi...", signed with HS256, RS256 or ES256.  The
+// parameter is forwarded to the backend unless a QueryRule removes it.
+type JWTQueryAuthenticator struct {
+	// Param is the query parameter carrying the token.  If empty, "token".
+	Param string
+
+	// Secret is the key of HS256 tokens.
+	Secret []byte
+
+	// PublicKey is the *rsa.PublicKey of RS256 tokens or the
+	// *ecdsa.PublicKey (P-256) of ES256 ones.
+	PublicKey crypto.PublicKey
+
+	// Issuer and Audience, if set, must be the iss claim and one of the
+	// aud claims of the tokens.
+	Issuer   string
+	Audience string
+
+	// Claim is the claim naming the principal.  If empty, "sub".
+	Claim string
+}
+
+// token returns the token in the query of m, or "".
+func (a *JWTQueryAuthenticator) token(m *coap.Message) string {
+	param := a.Param
+	if param == "" {
+		param = "token"
+	}
+	for _, q := range m.Options(coap.URIQuery) {
+		if values, err := url.ParseQuery(q.(string)); err == nil && values.Get(param) != "" {
+			return values.Get(param)
+		}
+	}
+	return ""
+}
+
+// Authenticate returns the principal claimed by the token of m, once its
+// signature and claims are verified.
+func (a *JWTQueryAuthenticator) Authenticate(rc *RequestContext, m *coap.Message) (string, error) {
+	token := a.token(m)
+	if token == "" {
+		return "", nil
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return "", err
+	}
+	now := rc.Received
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return "", errors.New("expired token")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errors.New("token not valid yet")
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return "", fmt.Errorf("token issuer %v", claims["iss"])
+	}
+	if a.Audience != "" && !jwtHasAudience(claims["aud"], a.Audience) {
+		return "", fmt.Errorf("token audience %v", claims["aud"])
+	}
+	claim := a.Claim
+	if claim == "" {
+		claim = "sub"
+	}
+	principal, _ := claims[claim].(string)
+	if principal == "" {
+		return "", fmt.Errorf("token without %v claim", claim)
+	}
+	return principal, nil
+}
+
+// verify checks the signature of token and returns its claims.
+func (a *JWTQueryAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+	valid := false
+	switch key := a.PublicKey.(type) {
+	case *rsa.PublicKey:
+		valid = header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if header.Alg == "ES256" && len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(key, digest[:], r, s)
+		}
+	}
+	if !valid && header.Alg == "HS256" && len(a.Secret) > 0 {
+		mac := hmac.New(sha256.New, a.Secret)
+		mac.Write(signed)
+		valid = hmac.Equal(mac.Sum(nil), signature)
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid %v token signature", header.Alg)
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// jwtHasAudience reports whether the aud claim, a string or an array of
+// them, lists audience.
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package crosscoap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// signJWT returns a token of the claims, signed with HS256 with secret or
+// with ES256 with key.
+func signJWT(claims map[string]interface{}, secret []byte, key *ecdsa.PrivateKey) string {
+	alg := "HS256"
+	if key != nil {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	if key != nil {
+		digest := sha256.Sum256([]byte(signed))
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTQueryAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now()
+	a := &JWTQueryAuthenticator{Secret: secret, PublicKey: &key.PublicKey, Issuer: "idp", Audience: "gateway"}
+	valid := map[string]interface{}{"sub": "alice", "iss": "idp", "aud": []string{"gateway"}, "exp": now.Add(time.Hour).Unix()}
+	for _, tt := range []struct {
+		token     string
+		principal string
+		fails     bool
+	}{
+		{"", "", false},
+		{signJWT(valid, secret, nil), "alice", false},
+		{signJWT(valid, nil, key), "alice", false},
+		{signJWT(valid, []byte("other"), nil), "", true},
+		{signJWT(valid, nil, otherKey), "", true},
+		{signJWT(map[string]interface{}{"sub": "alice", "iss": "idp", "aud": "gateway", "exp": now.Add(-time.Hour).Unix()}, secret, nil), "", true},
+		{signJWT(map[string]interface{}{"sub": "alice", "iss": "other", "aud": "gateway"}, secret, nil), "", true},
+		{signJWT(map[string]interface{}{"sub": "alice", "iss": "idp"}, secret, nil), "", true},
+		{signJWT(map[string]interface{}{"iss": "idp", "aud": "gateway"}, secret, nil), "", true},
+		{"not.a.token", "", true},
+	} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString("/a")
+		m.AddOption(coap.URIQuery, "x=1")
+		if tt.token != "" {
+			m.AddOption(coap.URIQuery, "token="+tt.token)
+		}
+		principal, err := a.Authenticate(&RequestContext{Received: now}, m)
+		if principal != tt.principal || (err != nil) != tt.fails {
+			t.Errorf("%v: principal is '%v' (error %v)", tt.token, principal, err)
+		}
+	}
+}
+
+func TestPSKAuthenticator(t *testing.T) {
+	a := &PSKAuthenticator{Principals: map[string]string{"oscore:0a": "sensor-1"}}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	if principal, err := a.Authenticate(&RequestContext{Identity: "oscore:0a"}, m); principal != "sensor-1" || err != nil {
+		t.Errorf("principal is '%v' (error %v)", principal, err)
+	}
+	if principal, err := a.Authenticate(&RequestContext{}, m); principal != "" || err != nil {
+		t.Errorf("principal without identity is '%v' (error %v)", principal, err)
+	}
+	if _, err := a.Authenticate(&RequestContext{Identity: "oscore:0b"}, m); !errors.Is(err, ErrForbidden) {
+		t.Errorf("error of an unknown identity is %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.Header.Get("X-Principal") + " " + r.URL.RawQuery))
+	}))
+	defer backend.Close()
+	secret := []byte("secret")
+	p := newProxyHandler(&Proxy{
+		BackendURL:            backend.URL,
+		CacheMaxSize:          1 << 20,
+		Authenticators:        []Authenticator{&JWTQueryAuthenticator{Secret: secret}},
+		RequireAuthentication: true,
+		PrincipalHeader:       "X-Principal",
+		OptionMappings:        []OptionMapping{{Option: 65000, Header: "X-Principal"}},
+		QueryRules:            []QueryRule{{Action: RemoveQuery, Name: "token"}},
+		AccessPolicy: &AccessPolicy{
+			Rules: []AccessRule{{Action: Allow, Methods: []coap.COAPCode{coap.POST}, Principals: []string{"admin"}}, {Action: Deny, Methods: []coap.COAPCode{coap.POST}}},
+		},
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	request := func(code coap.COAPCode, token string) *translatedCOAPMessage {
+		m := &coap.Message{Type: coap.Confirmable, Code: code, MessageID: 1, Token: []byte{1}}
+		m.SetPathString("/a")
+		m.AddOption(coap.URIQuery, "x=1")
+		if token != "" {
+			m.AddOption(coap.URIQuery, "token="+token)
+		}
+		return p.handleRequest(a, m, []rawOption{{ID: 65000, Value: []byte("mallory")}})
+	}
+
+	alice := signJWT(map[string]interface{}{"sub": "alice"}, secret, nil)
+	if coapResp := request(coap.GET, alice); coapResp == nil || coapResp.Code != coap.Content || string(coapResp.Payload) != "alice x=1" {
+		t.Errorf("authenticated response is '%v'", coapResp)
+	}
+	// The response to alice isn't cached for bob
+	if coapResp := request(coap.GET, signJWT(map[string]interface{}{"sub": "bob"}, secret, nil)); coapResp == nil || string(coapResp.Payload) != "bob x=1" {
+		t.Errorf("response to bob is '%v'", coapResp)
+	}
+	if coapResp := request(coap.POST, alice); coapResp == nil || coapResp.Code != coap.MethodNotAllowed {
+		t.Errorf("response to a POST of alice is '%v'", coapResp)
+	}
+	if coapResp := request(coap.POST, signJWT(map[string]interface{}{"sub": "admin"}, secret, nil)); coapResp == nil || coapResp.Code != coap.Changed {
+		t.Errorf("response to a POST of admin is '%v'", coapResp)
+	}
+	if coapResp := request(coap.GET, signJWT(map[string]interface{}{"sub": "alice"}, []byte("other"), nil)); coapResp == nil || coapResp.Code != coap.Unauthorized {
+		t.Errorf("response with an invalid token is '%v'", coapResp)
+	}
+	if coapResp := request(coap.GET, ""); coapResp == nil || coapResp.Code != coap.Unauthorized {
+		t.Errorf("response without token is '%v'", coapResp)
+	}
+}
@@ -0,0 +1,215 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// AuthChallengePolicy surfaces the WWW-Authenticate challenges of backend
+// 401 Unauthorized responses to CoAP clients, so that a device can tell,
+// for example, an expired token (error="invalid_token") from a missing
+// scope and refresh its credentials accordingly.
+type AuthChallengePolicy struct {
+	// Params lists the challenge parameters kept (for example realm,
+	// error and scope), matched case-insensitively.  If empty, all of them
+	// and any token68 credentials are kept.
+	Params []string
+
+	// Option is the CoAP option number which carries each challenge as a
+	// string, such as `Bearer error="invalid_token"`.  If zero, the
+	// challenges are instead appended as "WWW-Authenticate: challenge"
+	// lines to the diagnostic payload of the 4.01 responses (responses
+	// whose payload has a Content-Format are left alone).
+	Option uint16
+}
+
+// authChallenge is a challenge of a WWW-Authenticate header (RFC 7235
+// section 4.1).
+type authChallenge struct {
+	scheme  string
+	token68 string
+	params  []authParam
+}
+
+type authParam struct {
+	name  string
+	value string
+}
+
+// parseAuthChallenges returns the challenges listed in the WWW-Authenticate
+// header values.  Malformed parts are skipped.
+func parseAuthChallenges(values []string) []authChallenge {
+	var challenges []authChallenge
+	for _, s := range values {
+		current := -1
+		comma := false
+		for i := 0; i < len(s); {
+			switch s[i] {
+			case ' ', '\t':
+				i++
+				continue
+			case ',':
+				comma = true
+				i++
+				continue
+			}
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t,=\"", rune(s[i])) {
+				i++
+			}
+			token := s[start:i]
+			if token == "" {
+				// A stray '=' or quoted string
+				if s[i] == '"' {
+					_, i = readAuthParamValue(s, i)
+				} else {
+					i++
+				}
+				continue
+			}
+			bare := current >= 0 && !comma && challenges[current].token68 == "" && len(challenges[current].params) == 0
+			j := skipAuthSpaces(s, i)
+			if j < len(s) && s[j] == '=' {
+				k := j
+				for k < len(s) && s[k] == '=' {
+					k++
+				}
+				if end := skipAuthSpaces(s, k); bare && (end == len(s) || s[end] == ',') {
+					// token68 with padding, such as "Basic dXNlcg=="
+					challenges[current].token68 = s[start:k]
+					i = k
+					continue
+				}
+				var value string
+				value, i = readAuthParamValue(s, skipAuthSpaces(s, j+1))
+				if current >= 0 {
+					challenges[current].params = append(challenges[current].params, authParam{strings.ToLower(token), value})
+				}
+				comma = false
+				continue
+			}
+			if bare {
+				challenges[current].token68 = token
+				continue
+			}
+			challenges = append(challenges, authChallenge{scheme: token})
+			current = len(challenges) - 1
+			comma = false
+		}
+	}
+	return challenges
+}
+
+func skipAuthSpaces(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// readAuthParamValue reads the token or quoted string starting at i, and
+// returns it with the index following it.
+func readAuthParamValue(s string, i int) (string, int) {
+	if i >= len(s) || s[i] != '"' {
+		start := i
+		for i < len(s) && !strings.ContainsRune(" \t,", rune(s[i])) {
+			i++
+		}
+		return s[start:i], i
+	}
+	var value strings.Builder
+	for i++; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return value.String(), i + 1
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return value.String(), i
+}
+
+// String returns the challenge with its parameter values quoted.
+func (c *authChallenge) String() string {
+	var parts []string
+	for _, param := range c.params {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(param.value)
+		parts = append(parts, param.name+`="`+value+`"`)
+	}
+	s := c.scheme
+	if c.token68 != "" {
+		s += " " + c.token68
+	}
+	if len(parts) > 0 {
+		s += " " + strings.Join(parts, ", ")
+	}
+	return s
+}
+
+// challenges returns the challenges of the WWW-Authenticate headers of a
+// backend response, with the parameters kept by the policy.
+func (ap *AuthChallengePolicy) challenges(header http.Header) []string {
+	var challenges []string
+	for _, c := range parseAuthChallenges(header.Values("WWW-Authenticate")) {
+		if len(ap.Params) > 0 {
+			c.token68 = ""
+			var kept []authParam
+			for _, param := range c.params {
+				for _, name := range ap.Params {
+					if strings.EqualFold(param.name, name) {
+						kept = append(kept, param)
+						break
+					}
+				}
+			}
+			c.params = kept
+		}
+		challenges = append(challenges, c.String())
+	}
+	return challenges
+}
+
+// authChallengeOptions returns the options carrying the challenges of a
+// backend response translated to code, if AuthChallenges has an Option.
+func (t *Translator) authChallengeOptions(code coap.COAPCode, header http.Header) []rawOption {
+	ap := t.AuthChallenges
+	if ap == nil || ap.Option == 0 || code != coap.Unauthorized {
+		return nil
+	}
+	var options []rawOption
+	for _, challenge := range ap.challenges(header) {
+		options = append(options, rawOption{ID: ap.Option, Value: []byte(challenge)})
+	}
+	return options
+}
+
+// appendAuthChallenges appends the challenges of a backend response
+// translated to code to its diagnostic payload, if AuthChallenges has no
+// Option.
+func (t *Translator) appendAuthChallenges(code coap.COAPCode, payload []byte, header http.Header) []byte {
+	ap := t.AuthChallenges
+	if ap == nil || ap.Option != 0 || code != coap.Unauthorized {
+		return payload
+	}
+	challenges := ap.challenges(header)
+	if len(challenges) == 0 {
+		return payload
+	}
+	var buf bytes.Buffer
+	buf.Write(payload)
+	for _, challenge := range challenges {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString("WWW-Authenticate: " + challenge)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,65 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestParseAuthChallenges(t *testing.T) {
+	for _, tt := range []struct {
+		header   string
+		expected []string
+	}{
+		{`Basic realm="devices"`, []string{`Basic realm="devices"`}},
+		{`Bearer realm="api", error="invalid_token", error_description="The token \"t1\" expired"`, []string{`Bearer realm="api", error="invalid_token", error_description="The token \"t1\" expired"`}},
+		{`Negotiate dXNlcg==, Basic realm=devices`, []string{`Negotiate dXNlcg==`, `Basic realm="devices"`}},
+		{`Bearer, Basic Realm="a, b"`, []string{`Bearer`, `Basic realm="a, b"`}},
+		{`="x", Bearer scope=read`, []string{`Bearer scope="read"`}},
+	} {
+		var challenges []string
+		for _, c := range parseAuthChallenges([]string{tt.header}) {
+			challenges = append(challenges, c.String())
+		}
+		if !reflect.DeepEqual(challenges, tt.expected) {
+			t.Errorf("%v: challenges are %q", tt.header, challenges)
+		}
+	}
+}
+
+func TestAuthChallenges(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="devices", error="invalid_token", scope="telemetry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		policy          *AuthChallengePolicy
+		expectedPayload string
+		expectedOption  string
+	}{
+		{nil, "", ""},
+		{&AuthChallengePolicy{}, `WWW-Authenticate: Bearer realm="devices", error="invalid_token", scope="telemetry"`, ""},
+		{&AuthChallengePolicy{Params: []string{"Error"}, Option: 2056}, "", `Bearer error="invalid_token"`},
+	} {
+		p := newProxyHandler(&Proxy{BackendURL: backend.URL, AuthChallenges: tt.policy})
+		req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		req.SetPathString("/telemetry")
+		coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+		if coapResp == nil || coapResp.Code != coap.Unauthorized {
+			t.Fatalf("%+v: response is %v", tt.policy, coapResp)
+		}
+		if string(coapResp.Payload) != tt.expectedPayload {
+			t.Errorf("%+v: payload is '%s'", tt.policy, coapResp.Payload)
+		}
+		value, _ := findOption(coapResp.ExtraOptions, 2056)
+		if string(value) != tt.expectedOption {
+			t.Errorf("%+v: option is '%s'", tt.policy, value)
+		}
+	}
+}
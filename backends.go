@@ -0,0 +1,425 @@
+package crosscoap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultResolveInterval is how often the backend addresses are resolved
+// again when BackendResolveInterval is zero.
+const defaultResolveInterval = 30 * time.Second
+
+// metricBackendAddresses is the number of backend addresses currently
+// resolved.
+const metricBackendAddresses = "backend_addresses"
+
+// metricBackendRequests counts the requests sent to each resolved backend
+// address, and metricBackendLatency is the time each took to answer them
+// (up to the response headers).
+const (
+	metricBackendRequests = "backend_requests"
+	metricBackendLatency  = "backend_latency_seconds"
+)
+
+// BackendResolver looks up the addresses ("host:port") of the servers
+// behind BackendURL, for backends whose location changes.
+type BackendResolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// SRVResolver resolves the backend from the DNS SRV records of Name (for
+// instance "_http._tcp.api.example.com"), keeping the targets of the
+// highest priority (lowest value).
+type SRVResolver struct {
+	Name     string
+	Resolver *net.Resolver // if nil, net.DefaultResolver
+}
+
+// Resolve returns the targets of the SRV records.
+func (r *SRVResolver) Resolve(ctx context.Context) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, "", "", r.Name)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, record := range records {
+		if record.Priority != records[0].Priority {
+			break // sorted by priority
+		}
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+	return addrs, nil
+}
+
+// HostResolver resolves the backend from the DNS address records of Host,
+// served on Port: a headless Kubernetes service, for instance, whose
+// records follow the pods.
+type HostResolver struct {
+	Host     string
+	Port     string
+	Resolver *net.Resolver // if nil, net.DefaultResolver
+}
+
+// Resolve returns the addresses of Host.
+func (r *HostResolver) Resolve(ctx context.Context) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	hosts, err := resolver.LookupHost(ctx, r.Host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, r.Port)
+	}
+	return addrs, nil
+}
+
+// ConsulResolver resolves the backend from the healthy instances of
+// Service registered in the Consul agent at Address (by default
+// http://127.0.0.1:8500).
+type ConsulResolver struct {
+	Address string
+	Service string
+	Client  *http.Client // if nil, http.DefaultClient
+}
+
+// consulServiceEntry is the part of the entries of Consul's
+// /v1/health/service endpoint which locates an instance.
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Resolve returns the addresses of the instances passing their health
+// checks.
+func (r *ConsulResolver) Resolve(ctx context.Context) ([]string, error) {
+	address := r.Address
+	if address == "" {
+		address = "http://127.0.0.1:8500"
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(address, "/")+"/v1/health/service/"+url.PathEscape(r.Service)+"?passing=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Consul answered %v", resp.Status)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid Consul response: %v", err)
+	}
+	var addrs []string
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return addrs, nil
+}
+
+// backendPool spreads the requests to BackendURL over the addresses found
+// by BackendResolver, which it resolves again periodically.
+type backendPool struct {
+	resolver  BackendResolver
+	backend   *url.URL
+	transport http.RoundTripper // presenting the backend host name in TLS
+	interval  time.Duration
+	timeout   time.Duration // of a resolution
+	rebalance func()        // drops the connections to previous addresses
+	strategy  BackendStrategy
+	weights   map[string]float64
+
+	mu    sync.Mutex
+	addrs []*backendAddr // sorted
+}
+
+// backendAddr is a resolved backend address and its load.
+type backendAddr struct {
+	address     string
+	outstanding int
+	latency     time.Duration // moving average
+}
+
+// backendLatencyWeight is the weight of the latest response time in the
+// moving average of a backend address.
+const backendLatencyWeight = 0.3
+
+// newBackendPool returns the backend pool of p, or nil if it has neither
+// BackendResolver nor BackendResolveInterval.  The addresses are resolved
+// once before it returns.
+func (p *proxyHandler) newBackendPool() *backendPool {
+	if p.BackendResolver == nil && p.BackendResolveInterval <= 0 {
+		return nil
+	}
+	backend, err := url.Parse(p.BackendURL)
+	if err != nil || backend.Host == "" {
+		p.logError("Invalid backend URL, not resolving the backend: %v", err)
+		return nil
+	}
+	resolver := p.BackendResolver
+	if resolver == nil {
+		port := backend.Port()
+		if port == "" {
+			port = "80"
+			if backend.Scheme == "https" {
+				port = "443"
+			}
+		}
+		resolver = &HostResolver{Host: backend.Hostname(), Port: port}
+	}
+	serverName := backend.Hostname()
+	if p.BackendHost != "" {
+		serverName = p.BackendHost
+		if h, _, err := net.SplitHostPort(serverName); err == nil {
+			serverName = h
+		}
+	}
+	transport, _ := p.transport.(*http.Transport)
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.ServerName = serverName
+	b := &backendPool{
+		resolver:  resolver,
+		backend:   backend,
+		transport: transport,
+		interval:  p.BackendResolveInterval,
+		timeout:   p.timeout(),
+		strategy:  p.BackendStrategy,
+		weights:   p.BackendWeights,
+	}
+	if b.strategy == nil {
+		b.strategy = NewRoundRobinStrategy()
+	}
+	b.rebalance = p.closeIdleConnections
+	if b.interval <= 0 {
+		b.interval = defaultResolveInterval
+	}
+	p.resolveBackend(b)
+	return b
+}
+
+// closeIdleConnections closes the idle connections to the backend, so that
+// the next requests connect to the current addresses.
+func (p *proxyHandler) closeIdleConnections() {
+	transports := []http.RoundTripper{p.transport, p.hostTransport}
+	if p.backends != nil {
+		transports = append(transports, p.backends.transport)
+	}
+	for _, transport := range transports {
+		if t, ok := transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// resolveBackend updates the addresses of b.  The previous addresses are
+// kept if the resolution fails or finds none.
+func (p *proxyHandler) resolveBackend(b *backendPool) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	addrs, err := b.resolver.Resolve(ctx)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		p.logError("Error resolving the backend, keeping %v previous addresses: %v", len(b.current()), err)
+		return
+	}
+	if b.update(addrs) {
+		p.logAccess("Backend resolved to %v", strings.Join(addrs, ", "))
+		b.rebalance()
+	}
+	p.metrics().Gauge(metricBackendAddresses, float64(len(addrs)), nil)
+}
+
+// update replaces the addresses of b, and reports whether they changed.
+// The load of the addresses which remain is kept.
+func (b *backendPool) update(addrs []string) bool {
+	addrs = append([]string(nil), addrs...)
+	sort.Strings(addrs)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := make(map[string]*backendAddr, len(b.addrs))
+	for _, a := range b.addrs {
+		previous[a.address] = a
+	}
+	changed := len(addrs) != len(b.addrs)
+	updated := make([]*backendAddr, len(addrs))
+	for i, address := range addrs {
+		if updated[i] = previous[address]; updated[i] == nil {
+			updated[i] = &backendAddr{address: address}
+			changed = true
+		}
+	}
+	b.addrs = updated
+	return changed
+}
+
+// current returns the addresses of b.
+func (b *backendPool) current() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := make([]string, len(b.addrs))
+	for i, a := range b.addrs {
+		addrs[i] = a.address
+	}
+	return addrs
+}
+
+// pick returns the address of the next backend request, chosen by the
+// strategy of b, or nil if none was resolved yet.  The caller reports the
+// end of the request with done.
+func (b *backendPool) pick() *backendAddr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.addrs) == 0 {
+		return nil
+	}
+	states := make([]BackendState, len(b.addrs))
+	for i, a := range b.addrs {
+		weight, found := b.weights[a.address]
+		if !found {
+			weight = 1
+		}
+		states[i] = BackendState{Address: a.address, Weight: weight, Outstanding: a.outstanding, Latency: a.latency}
+	}
+	i := b.strategy.Choose(states)
+	if i < 0 || i >= len(b.addrs) {
+		i = 0
+	}
+	a := b.addrs[i]
+	a.outstanding++
+	return a
+}
+
+// done records the end of a request to a, which took latency to answer, or
+// failed if err isn't nil.
+func (b *backendPool) done(a *backendAddr, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a.outstanding--
+	switch {
+	case err != nil:
+	case a.latency == 0:
+		a.latency = latency
+	default:
+		a.latency = time.Duration(backendLatencyWeight*float64(latency) + (1-backendLatencyWeight)*float64(a.latency))
+	}
+}
+
+// routeBackend returns req sent to one of the resolved backend addresses
+// if it goes to BackendURL, the transport to send it with and the chosen
+// address, whose request is ended with backendDone, or else req itself and
+// nils.  The Host header and the TLS server name remain the ones of
+// BackendURL (or BackendHost).
+func (p *proxyHandler) routeBackend(req *http.Request) (*http.Request, http.RoundTripper, *backendAddr) {
+	b := p.backends
+	if b == nil || req.URL.Scheme != b.backend.Scheme || req.URL.Host != b.backend.Host {
+		return req, nil, nil
+	}
+	addr := b.pick()
+	if addr == nil {
+		return req, nil, nil
+	}
+	if rc := RequestContextFrom(req.Context()); rc != nil {
+		rc.Backend = addr.address
+	}
+	routed := req.WithContext(req.Context())
+	if routed.Host == "" {
+		routed.Host = req.URL.Host
+	}
+	u := *req.URL
+	u.Host = addr.address
+	routed.URL = &u
+	return routed, b.transport, addr
+}
+
+// backendDone ends a request to addr, sent at start, which got a response
+// unless err isn't nil.
+func (p *proxyHandler) backendDone(addr *backendAddr, start time.Time, err error) {
+	if addr == nil {
+		return
+	}
+	latency := time.Since(start)
+	p.backends.done(addr, latency, err)
+	labels := Labels{"backend": addr.address}
+	metrics := p.metrics()
+	metrics.Counter(metricBackendRequests, 1, labels)
+	if err == nil {
+		metrics.Histogram(metricBackendLatency, latency.Seconds(), labels)
+	}
+}
+
+// checkedBackendURL returns the backend URL whose server the readiness
+// check connects to: BackendURL, or its first resolved address.
+func (p *proxyHandler) checkedBackendURL() string {
+	b := p.backends
+	if b == nil {
+		return p.BackendURL
+	}
+	addrs := b.current()
+	if len(addrs) == 0 {
+		return p.BackendURL
+	}
+	u := *b.backend
+	u.Host = addrs[0]
+	return u.String()
+}
+
+// maintainBackends resolves the backend again every interval until done is
+// closed.
+func (p *proxyHandler) maintainBackends(done <-chan struct{}) {
+	b := p.backends
+	if b == nil {
+		return
+	}
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.resolveBackend(b)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package crosscoap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+type fakeResolver struct {
+	mu    sync.Mutex
+	addrs []string
+	err   error
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addrs, r.err
+}
+
+func (r *fakeResolver) set(addrs []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+func TestBackendResolver(t *testing.T) {
+	var mu sync.Mutex
+	served := map[string]int{}
+	var hosts []string
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			served[name]++
+			hosts = append(hosts, r.Host)
+			mu.Unlock()
+			w.Write([]byte(name))
+		}))
+	}
+	one, two := newBackend("one"), newBackend("two")
+	defer one.Close()
+	defer two.Close()
+	resolver := &fakeResolver{addrs: []string{one.Listener.Addr().String(), two.Listener.Addr().String()}}
+	format, _ := ParseAccessLogFormat("%backend %code")
+	var accessLog bytes.Buffer
+	p := newProxyHandler(&Proxy{
+		BackendURL:      "http://backend.example/api/",
+		BackendResolver: resolver,
+		AccessLog:       log.New(&accessLog, "", 0),
+		AccessLogFormat: format,
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	get := func() string {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString("/sensors")
+		return string(p.handleRequest(a, m, nil).Payload)
+	}
+
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if served["one"] != 2 || served["two"] != 2 {
+		t.Errorf("requests served are %v", served)
+	}
+	for _, host := range hosts {
+		if host != "backend.example" {
+			t.Errorf("Host header is '%v'", host)
+		}
+	}
+
+	if !strings.Contains(accessLog.String(), "\n"+one.Listener.Addr().String()+" 2.05\n") || !strings.Contains(accessLog.String(), "\n"+two.Listener.Addr().String()+" 2.05\n") {
+		t.Errorf("access log is '%v'", accessLog.String())
+	}
+
+	resolver.set([]string{two.Listener.Addr().String()}, nil)
+	p.resolveBackend(p.backends)
+	if body := get() + get(); body != "twotwo" {
+		t.Errorf("responses after resolution are '%v'", body)
+	}
+	resolver.set(nil, errors.New("unreachable"))
+	p.resolveBackend(p.backends)
+	if body := get(); body != "two" {
+		t.Errorf("response after failed resolution is '%v'", body)
+	}
+	if addrs := p.adminConfig().BackendAddresses; !reflect.DeepEqual(addrs, []string{two.Listener.Addr().String()}) {
+		t.Errorf("admin backend addresses are %v", addrs)
+	}
+}
+
+func TestBackendReresolution(t *testing.T) {
+	p := newProxyHandler(&Proxy{BackendURL: "https://127.0.0.1/api", BackendResolveInterval: time.Minute})
+	if p.backends == nil {
+		t.Fatal("backend host isn't resolved")
+	}
+	if addrs := p.backends.current(); !reflect.DeepEqual(addrs, []string{"127.0.0.1:443"}) {
+		t.Errorf("addresses are %v", addrs)
+	}
+	if name := p.backends.transport.(*http.Transport).TLSClientConfig.ServerName; name != "127.0.0.1" {
+		t.Errorf("TLS server name is '%v'", name)
+	}
+	req, _ := http.NewRequest("GET", "https://127.0.0.1/api/sensors", nil)
+	if routed, transport, _ := p.routeBackend(req); routed.URL.Host != "127.0.0.1:443" || routed.Host != "127.0.0.1" || transport != p.backends.transport {
+		t.Errorf("request routed to %v with Host '%v'", routed.URL, routed.Host)
+	}
+	other, _ := http.NewRequest("GET", "https://10.0.0.1/api/sensors", nil)
+	if routed, transport, addr := p.routeBackend(other); routed != other || transport != nil || addr != nil {
+		t.Errorf("request to another backend routed to %v", routed.URL)
+	}
+	if p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1/"}); p.backends != nil {
+		t.Errorf("backend host resolved without BackendResolveInterval")
+	}
+}
+
+func TestConsulResolver(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/api" || r.URL.Query().Get("passing") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8080}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.1.0.2", "Port": 8081}}
+		]`))
+	}))
+	defer consul.Close()
+
+	addrs, err := (&ConsulResolver{Address: consul.URL, Service: "api"}).Resolve(context.Background())
+	if err != nil || !reflect.DeepEqual(addrs, []string{"10.0.0.1:8080", "10.1.0.2:8081"}) {
+		t.Errorf("addresses are %v (error %v)", addrs, err)
+	}
+	if _, err := (&ConsulResolver{Address: consul.URL, Service: "other"}).Resolve(context.Background()); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("error for an unknown service is %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package crosscoap
+
+import (
+	"net"
+)
+
+// packetBatchSize is the maximum number of packets read or written by a
+// single system call where batched UDP I/O is supported.
+const packetBatchSize = 32
+
+// packet is a UDP packet held in a buffer of packetBuffers.
+type packet struct {
+	buf  *[]byte
+	n    int
+	addr *net.UDPAddr
+}
+
+func (pk *packet) data() []byte {
+	return (*pk.buf)[:pk.n]
+}
+
+// packetWriter sends the packets queued by concurrent goroutines to its
+// socket from a single goroutine, writing those queued meanwhile in one
+// batch.
+type packetWriter struct {
+	l        *net.UDPConn
+	conn     *batchConn
+	queue    chan packet
+	done     chan struct{}
+	logError func(format string, args ...interface{})
+}
+
+func newPacketWriter(l *net.UDPConn, logError func(format string, args ...interface{})) (*packetWriter, error) {
+	conn, err := newBatchConn(l, packetBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	return &packetWriter{
+		l:        l,
+		conn:     conn,
+		queue:    make(chan packet, packetBatchSize),
+		done:     make(chan struct{}),
+		logError: logError,
+	}, nil
+}
+
+// write queues pk, whose buffer is handed back to the pool once it's sent.
+// It returns false if the writer is stopped.
+func (w *packetWriter) write(pk packet) bool {
+	select {
+	case w.queue <- pk:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *packetWriter) run() {
+	packets := make([]packet, 0, packetBatchSize)
+	for {
+		select {
+		case pk := <-w.queue:
+			packets = append(packets[:0], pk)
+		case <-w.done:
+			return
+		}
+	queued:
+		for len(packets) < packetBatchSize {
+			select {
+			case pk := <-w.queue:
+				packets = append(packets, pk)
+			default:
+				break queued
+			}
+		}
+		for sent := 0; sent < len(packets); {
+			n, err := w.conn.writeBatch(packets[sent:])
+			if err != nil {
+				w.logError("Error sending CoAP response to %v: %v", packets[sent].addr, err)
+				n = 1
+			}
+			sent += n
+		}
+		for _, pk := range packets {
+			putPacketBuffer(pk.buf)
+		}
+	}
+}
+
+func (w *packetWriter) stop() {
+	close(w.done)
+}
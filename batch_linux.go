@@ -0,0 +1,214 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package crosscoap
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// batchedIO reports whether packets are read and written in batches, with
+// recvmmsg(2) and sendmmsg(2).
+const batchedIO = true
+
+// mmsghdr is struct mmsghdr of recvmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// batchConn reads and writes batches of packets on a UDP socket.  It isn't
+// safe for concurrent use.
+type batchConn struct {
+	l     *net.UDPConn
+	conn  syscall.RawConn
+	inet6 bool
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+func newBatchConn(l *net.UDPConn, size int) (*batchConn, error) {
+	conn, err := l.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	c := &batchConn{
+		l:     l,
+		conn:  conn,
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrAny, size),
+	}
+	var sockErr error
+	err = conn.Control(func(fd uintptr) {
+		var sa syscall.Sockaddr
+		sa, sockErr = syscall.Getsockname(int(fd))
+		_, c.inet6 = sa.(*syscall.SockaddrInet6)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// prepare sets up the headers of the packets; if withAddrs, the packets'
+// addresses are their destinations.
+func (c *batchConn) prepare(packets []packet, withAddrs bool) (int, error) {
+	n := len(packets)
+	if n > len(c.hdrs) {
+		n = len(c.hdrs)
+	}
+	for i := 0; i < n; i++ {
+		buf := *packets[i].buf
+		length := len(buf)
+		namelen := uint32(syscall.SizeofSockaddrAny)
+		if withAddrs {
+			length = packets[i].n
+			var err error
+			if namelen, err = c.putSockaddr(&c.names[i], packets[i].addr); err != nil {
+				if i == 0 {
+					return 0, err
+				}
+				// Send the packets before it first
+				return i, nil
+			}
+		}
+		c.iovs[i].Base = &buf[0]
+		c.iovs[i].SetLen(length)
+		c.hdrs[i] = mmsghdr{hdr: syscall.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&c.names[i])),
+			Namelen: namelen,
+			Iov:     &c.iovs[i],
+			Iovlen:  1,
+		}}
+	}
+	return n, nil
+}
+
+// readBatch reads up to len(packets) packets into their buffers.
+func (c *batchConn) readBatch(packets []packet) (int, error) {
+	n, _ := c.prepare(packets, false)
+	received, err := c.mmsg(syscall.SYS_RECVMMSG, n, c.conn.Read)
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: "udp", Source: c.l.LocalAddr(), Err: err}
+	}
+	for i := 0; i < received; i++ {
+		packets[i].n = int(c.hdrs[i].len)
+		packets[i].addr = udpAddr(&c.names[i])
+	}
+	return received, nil
+}
+
+// writeBatch writes the first packets, returning how many were sent.  It
+// fails only if none was.
+func (c *batchConn) writeBatch(packets []packet) (int, error) {
+	n, err := c.prepare(packets, true)
+	if err != nil {
+		return 0, err
+	}
+	sent, err := c.mmsg(sysSendmmsg, n, c.conn.Write)
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.l.LocalAddr(), Addr: packets[0].addr, Err: err}
+	}
+	return sent, nil
+}
+
+// mmsg makes the recvmmsg or sendmmsg system call trap on n headers, waiting
+// with wait until the socket is ready.
+func (c *batchConn) mmsg(trap uintptr, n int, wait func(func(fd uintptr) bool) error) (int, error) {
+	var done int
+	var errno syscall.Errno
+	err := wait(func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(trap, fd, uintptr(unsafe.Pointer(&c.hdrs[0])), uintptr(n), 0, 0, 0)
+			switch e {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			}
+			done, errno = int(r), e
+			return true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		name := "recvmmsg"
+		if trap == sysSendmmsg {
+			name = "sendmmsg"
+		}
+		return 0, os.NewSyscallError(name, errno)
+	}
+	return done, nil
+}
+
+func (c *batchConn) putSockaddr(sa *syscall.RawSockaddrAny, addr *net.UDPAddr) (uint32, error) {
+	if !c.inet6 {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, syscall.EAFNOSUPPORT
+		}
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		copy(sa4.Addr[:], ip)
+		putPort(&sa4.Port, addr.Port)
+		return syscall.SizeofSockaddrInet4, nil
+	}
+	ip := addr.IP.To16()
+	if ip == nil {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+	*sa6 = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(sa6.Addr[:], ip)
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa6.Scope_id = uint32(ifi.Index)
+		} else if index, err := strconv.Atoi(addr.Zone); err == nil {
+			sa6.Scope_id = uint32(index)
+		}
+	}
+	putPort(&sa6.Port, addr.Port)
+	return syscall.SizeofSockaddrInet6, nil
+}
+
+// putPort stores port in network byte order.
+func putPort(dst *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(dst))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
+
+func getPort(src *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(src))
+	return int(b[0])<<8 | int(b[1])
+}
+
+func udpAddr(sa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return &net.UDPAddr{IP: append(net.IP(nil), sa4.Addr[:]...), Port: getPort(&sa4.Port)}
+	case syscall.AF_INET6:
+		sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		addr := &net.UDPAddr{IP: append(net.IP(nil), sa6.Addr[:]...), Port: getPort(&sa6.Port)}
+		if sa6.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa6.Scope_id))
+			if ifi, err := net.InterfaceByIndex(int(sa6.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return &net.UDPAddr{}
+}
@@ -0,0 +1,5 @@
+package crosscoap
+
+// sysSendmmsg is the number of the sendmmsg system call, which package
+// syscall lacks on amd64.
+const sysSendmmsg = 307
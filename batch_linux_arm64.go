@@ -0,0 +1,5 @@
+package crosscoap
+
+import "syscall"
+
+const sysSendmmsg = syscall.SYS_SENDMMSG
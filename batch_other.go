@@ -0,0 +1,37 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package crosscoap
+
+import (
+	"net"
+)
+
+// batchedIO reports whether packets are read and written in batches; they
+// aren't on this platform.
+const batchedIO = false
+
+// batchConn reads and writes packets on a UDP socket one at a time.
+type batchConn struct {
+	l *net.UDPConn
+}
+
+func newBatchConn(l *net.UDPConn, size int) (*batchConn, error) {
+	return &batchConn{l: l}, nil
+}
+
+func (c *batchConn) readBatch(packets []packet) (int, error) {
+	n, addr, err := c.l.ReadFromUDP(*packets[0].buf)
+	if err != nil {
+		return 0, err
+	}
+	packets[0].n, packets[0].addr = n, addr
+	return 1, nil
+}
+
+func (c *batchConn) writeBatch(packets []packet) (int, error) {
+	if _, err := c.l.WriteToUDP(packets[0].data(), packets[0].addr); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
@@ -0,0 +1,83 @@
+package crosscoap
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+const batchTestPackets = 50
+
+func TestReadPackets(t *testing.T) {
+	udpListener, listenerAddr := createLocalUDPListener(t)
+	client, clientAddr := createLocalUDPListener(t)
+	defer client.Close()
+
+	received := make(chan string, batchTestPackets)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- readPackets(udpListener, nil, func(addr *net.UDPAddr, packet []byte) {
+			received <- fmt.Sprintf("%v %s", addr, packet)
+		})
+	}()
+	for i := 0; i < batchTestPackets; i++ {
+		if _, err := client.WriteToUDP([]byte(fmt.Sprint(i)), udpListener.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatalf("Error sending to %v: %v", listenerAddr, err)
+		}
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < batchTestPackets; i++ {
+		select {
+		case packet := <-received:
+			seen[packet] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %v packets", i)
+		}
+	}
+	for i := 0; i < batchTestPackets; i++ {
+		if packet := fmt.Sprintf("%v %v", clientAddr, i); !seen[packet] {
+			t.Errorf("packet '%v' wasn't received", packet)
+		}
+	}
+
+	udpListener.Close()
+	if err := <-errs; err == nil {
+		t.Errorf("readPackets returned no error")
+	}
+}
+
+func TestPacketWriter(t *testing.T) {
+	udpListener, _ := createLocalUDPListener(t)
+	defer udpListener.Close()
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	writer, err := newPacketWriter(udpListener, t.Errorf)
+	if err != nil {
+		t.Fatalf("Error creating writer: %v", err)
+	}
+	go writer.run()
+	defer writer.stop()
+
+	for i := 0; i < batchTestPackets; i++ {
+		buf := getPacketBuffer()
+		n := copy(*buf, fmt.Sprint(i))
+		writer.write(packet{buf: buf, n: n, addr: client.LocalAddr().(*net.UDPAddr)})
+	}
+	seen := make(map[string]bool)
+	buf := make([]byte, maxCOAPPacketLen)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < batchTestPackets; i++ {
+		n, addr, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Error after %v packets: %v", i, err)
+		}
+		if addr.String() != udpListener.LocalAddr().String() {
+			t.Errorf("packet comes from '%v'", addr)
+		}
+		seen[string(buf[:n])] = true
+	}
+	if len(seen) != batchTestPackets {
+		t.Errorf("received %v different packets", len(seen))
+	}
+}
@@ -0,0 +1,218 @@
+package crosscoap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/dustin/go-coap"
+)
+
+var errUploadIncomplete = errors.New("Block1 upload incomplete")
+
+// upload is a Block1 upload (RFC 7959 section 2.5) in progress.  Its blocks
+// are either buffered until the last one arrives, or streamed to the backend
+// through body as they arrive.
+type upload struct {
+	mu         sync.Mutex
+	received   int    // bytes received so far
+	lastOffset int    // offset of the latest block
+	last       []byte // payload of the latest block
+	szx        uint8  // block size exponent of the latest block
+	size1      int    // size announced by the client in Size1, or -1
+	payload    []byte
+	body       *io.PipeWriter
+	result     chan *translatedCOAPMessage // response to a streamed upload
+}
+
+func (u *upload) close() {
+	if u.body != nil {
+		u.body.CloseWithError(errUploadIncomplete)
+	}
+}
+
+// response waits for the response to a streamed upload, and addresses it
+// to the request m carrying the latest block.
+func (u *upload) response(m *coap.Message) *translatedCOAPMessage {
+	coapResp := <-u.result
+	if coapResp != nil {
+		coapResp.MessageID = m.MessageID
+		coapResp.Token = m.Token
+	}
+	return coapResp
+}
+
+// streamsUpload returns whether the Block1 upload started by m is streamed
+// to the backend.  Payloads which the proxy converts, transforms or signs
+// are always reassembled first.
+func (p *proxyHandler) streamsUpload(m *coap.Message) bool {
+	return p.StreamBlock1 && !p.signsRequests() && !p.translator.convertsRequestPayload(m) && !p.transformsRequest(m)
+}
+
+// startUpload starts the Block1 upload whose first block is m; a streamed
+// upload opens the backend request right away.
+func (p *proxyHandler) startUpload(a *net.UDPAddr, identity string, m *coap.Message, options []rawOption) *upload {
+	u := &upload{size1: -1}
+	if size1, found := m.Option(coap.Size1).(uint32); found {
+		u.size1 = int(size1)
+	}
+	if p.streamsUpload(m) {
+		reader, writer := io.Pipe()
+		u.body = writer
+		u.result = make(chan *translatedCOAPMessage, 1)
+		first := *m
+		// The request outlives the packet it was parsed from
+		options = cloneOptions(options)
+		go func() {
+			coapResp := p.handle(a, identity, &first, options, reader)
+			// Fail the writes of the remaining blocks if the request was
+			// answered without reading the whole body
+			reader.Close()
+			u.result <- coapResp
+		}()
+	}
+	return u
+}
+
+// incompleteUpload answers the block m of a Block1 upload which can't be
+// reassembled with 4.08 Request Entity Incomplete, whose diagnostic payload
+// tells the client why, even without DiagnosticPayloads: it's about the
+// client's own upload.
+func (p *proxyHandler) incompleteUpload(a *net.UDPAddr, m *coap.Message, format string, args ...interface{}) *translatedCOAPMessage {
+	diagnostic := fmt.Sprintf(format, args...)
+	p.logError("CoAP Block1 upload from %v rejected: %v", a, diagnostic)
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	return generateErrorCOAPResponse(m, codeRequestEntityIncomplete, diagnostic)
+}
+
+func (p *proxyHandler) requestTooLarge(m *coap.Message) *translatedCOAPMessage {
+	max := p.maxRequestBodyBytes(m)
+	coapResp := p.errorResponse(m, coap.RequestEntityTooLarge,
+		fmt.Sprintf("request payload exceeds %v bytes", max))
+	if coapResp != nil {
+		coapResp.SetOption(coap.Size1, uint32(max))
+	}
+	return coapResp
+}
+
+// handleUpload handles the request m carrying the Block1 option value,
+// reassembling the payload before the request is proxied (or streaming it to
+// the backend with StreamBlock1).  Each block but the last is answered with
+// 2.31 Continue.  An upload whose blocks are missing, out of order, of a
+// larger size than earlier ones or in conflict with a block received before,
+// or whose size doesn't match the Size1 option of its first block, is
+// answered with 4.08 Request Entity Incomplete rather than forwarded.
+func (p *proxyHandler) handleUpload(a *net.UDPAddr, identity string, m *coap.Message, options []rawOption, value []byte) *translatedCOAPMessage {
+	block, err := parseBlockOption(value)
+	if err != nil {
+		return p.errorResponse(m, coap.BadOption, "invalid Block1 option")
+	}
+	options = removeOption(options, optionBlock1)
+	if block.Num == 0 && !block.More {
+		// The whole payload fits in a single block
+		if size1, found := m.Option(coap.Size1).(uint32); found && int(size1) != len(m.Payload) {
+			return p.incompleteUpload(a, m, "Block1 upload of %v bytes doesn't match its Size1 of %v bytes", len(m.Payload), size1)
+		}
+		return withBlockOption(p.handle(a, identity, m, options, nil), optionBlock1, block)
+	}
+
+	key := transferKey(a, m, options)
+	offset := block.offset()
+	max := p.maxRequestBodyBytes(m)
+	u, _ := p.uploads.get(key).(*upload)
+	if u != nil {
+		u.mu.Lock()
+		if block.More && u.lastOffset == offset && u.received == offset+len(m.Payload) {
+			if bytes.Equal(u.last, m.Payload) {
+				// Retransmitted block
+				u.mu.Unlock()
+				return withBlockOption(p.continueResponse(m), optionBlock1, block)
+			}
+			if block.Num != 0 {
+				u.mu.Unlock()
+				p.uploads.abort(key, u)
+				return p.incompleteUpload(a, m, "Block1 block %v differs from the one received before", block.Num)
+			}
+		}
+		if block.Num == 0 {
+			// The client restarts the upload
+			u.mu.Unlock()
+			u = nil
+		}
+	}
+	if u == nil {
+		if block.Num != 0 {
+			return p.incompleteUpload(a, m, "Block1 block %v without an upload in progress, expected block 0", block.Num)
+		}
+		if size1, _ := m.Option(coap.Size1).(uint32); max > 0 && int(size1) > max {
+			p.logError("CoAP Block1 upload of %v bytes from %v exceeds the limit of %v bytes", size1, a, max)
+			return p.requestTooLarge(m)
+		}
+		u = p.startUpload(a, identity, m, options)
+		u.szx = block.SZX
+		u.mu.Lock()
+		p.uploads.add(key, u)
+	}
+	defer u.mu.Unlock()
+	switch {
+	case block.SZX > u.szx:
+		// Clients may only switch to smaller blocks (RFC 7959 section 2.5)
+		p.uploads.abort(key, u)
+		return p.incompleteUpload(a, m, "Block1 block %v of %v bytes is larger than the earlier blocks of %v bytes", block.Num, block.size(), 1<<(u.szx+4))
+	case offset != u.received:
+		p.uploads.abort(key, u)
+		if u.received%block.size() != 0 {
+			return p.incompleteUpload(a, m, "Block1 block %v is out of sequence, expected offset %v", block.Num, u.received)
+		}
+		return p.incompleteUpload(a, m, "Block1 block %v is out of sequence, expected block %v", block.Num, u.received/block.size())
+	case block.More && len(m.Payload) != block.size():
+		p.uploads.abort(key, u)
+		return p.errorResponse(m, coap.BadRequest, "Block1 payload doesn't match the block size")
+	case max > 0 && offset+len(m.Payload) > max:
+		p.logError("CoAP Block1 upload from %v exceeds the limit of %v bytes", a, max)
+		p.uploads.abort(key, u)
+		return p.requestTooLarge(m)
+	case u.size1 >= 0 && (offset+len(m.Payload) > u.size1 || !block.More && offset+len(m.Payload) != u.size1):
+		p.uploads.abort(key, u)
+		return p.incompleteUpload(a, m, "Block1 upload doesn't match its Size1 of %v bytes", u.size1)
+	}
+
+	if u.body != nil {
+		if _, err := u.body.Write(m.Payload); err != nil {
+			// The request was answered before the upload completed
+			p.uploads.remove(key, u)
+			return withBlockOption(u.response(m), optionBlock1, block)
+		}
+	} else {
+		u.payload = append(u.payload, m.Payload...)
+	}
+	u.received += len(m.Payload)
+	u.lastOffset = offset
+	u.last = append(u.last[:0], m.Payload...)
+	u.szx = block.SZX
+	if block.More {
+		p.uploads.touch(key, u)
+		return withBlockOption(p.continueResponse(m), optionBlock1, block)
+	}
+	p.uploads.remove(key, u)
+	if u.body != nil {
+		u.body.Close()
+		return withBlockOption(u.response(m), optionBlock1, block)
+	}
+	reassembled := *m
+	reassembled.Payload = u.payload
+	return withBlockOption(p.handle(a, identity, &reassembled, options, nil), optionBlock1, block)
+}
+
+// continueResponse acknowledges a block of a Block1 upload.
+func (p *proxyHandler) continueResponse(m *coap.Message) *translatedCOAPMessage {
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	return generateErrorCOAPResponse(m, codeContinue, "")
+}
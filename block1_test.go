@@ -0,0 +1,283 @@
+package crosscoap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func block1Request(mid uint16, block blockOption, payload []byte) (*coap.Message, []rawOption) {
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: mid, Token: []byte{byte(mid)}, Payload: payload}
+	m.SetPathString("/upload")
+	return m, []rawOption{{ID: uint16(coap.URIPath), Value: []byte("upload")}, block.option(optionBlock1)}
+}
+
+func testBlock1Upload(t *testing.T, stream bool) {
+	var body []byte
+	var contentLength int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		contentLength = r.ContentLength
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, StreamBlock1: stream})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 5)
+	blocks := []blockOption{{Num: 0, More: true, SZX: 1}, {Num: 1, More: true, SZX: 1}, {Num: 2, SZX: 1}}
+	for i, block := range blocks {
+		end := block.offset() + block.size()
+		if end > len(payload) {
+			end = len(payload)
+		}
+		m, options := block1Request(uint16(i+1), block, payload[block.offset():end])
+		coapResp := p.handleRequest(a, m, options)
+		if i == 1 {
+			// Retransmitted block
+			coapResp = p.handleRequest(a, m, options)
+		}
+		expectedCode := codeContinue
+		if !block.More {
+			expectedCode = coap.Created
+		}
+		if coapResp == nil || coapResp.Code != expectedCode || coapResp.MessageID != m.MessageID {
+			t.Fatalf("response to block %v is '%v'", block.Num, coapResp)
+		}
+		value, found := findOption(coapResp.ExtraOptions, optionBlock1)
+		if echoed, _ := parseBlockOption(value); !found || echoed != block {
+			t.Errorf("response to block %v has Block1 '%v'", block.Num, echoed)
+		}
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("backend got body '%s'", body)
+	}
+	if stream && contentLength != -1 {
+		t.Errorf("streamed body has Content-Length %v", contentLength)
+	}
+	if len(p.uploads.pending) != 0 {
+		t.Errorf("uploads are '%v'", p.uploads.pending)
+	}
+}
+
+func TestBlock1Upload(t *testing.T) {
+	testBlock1Upload(t, false)
+}
+
+func TestBlock1UploadStreamed(t *testing.T) {
+	testBlock1Upload(t, true)
+}
+
+func TestBlock1UploadOutOfSequence(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer backend.Close()
+
+	for _, stream := range []bool{false, true} {
+		p := newProxyHandler(&Proxy{BackendURL: backend.URL, StreamBlock1: stream})
+		a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+		m, options := block1Request(1, blockOption{Num: 2, More: true}, make([]byte, 16))
+		if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != codeRequestEntityIncomplete {
+			t.Errorf("response to block without upload is '%v'", coapResp)
+		}
+		m, options = block1Request(2, blockOption{Num: 0, More: true}, make([]byte, 16))
+		if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != codeContinue {
+			t.Errorf("response to first block is '%v'", coapResp)
+		}
+		m, options = block1Request(3, blockOption{Num: 2}, make([]byte, 4))
+		if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != codeRequestEntityIncomplete {
+			t.Errorf("response to skipping block is '%v'", coapResp)
+		}
+		if len(p.uploads.pending) != 0 {
+			t.Errorf("uploads are '%v'", p.uploads.pending)
+		}
+	}
+}
+
+func TestBlock1UploadInconsistent(t *testing.T) {
+	var uploads int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err == nil {
+			atomic.AddInt32(&uploads, 1)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	for _, stream := range []bool{false, true} {
+		p := newProxyHandler(&Proxy{BackendURL: backend.URL, StreamBlock1: stream})
+		a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+		send := func(mid uint16, block blockOption, payload []byte) *translatedCOAPMessage {
+			m, options := block1Request(mid, block, payload)
+			return p.handleRequest(a, m, options)
+		}
+
+		if coapResp := send(1, blockOption{Num: 0, More: true, SZX: 0}, bytes.Repeat([]byte("a"), 16)); coapResp == nil || coapResp.Code != codeContinue {
+			t.Fatalf("response to first block is '%v'", coapResp)
+		}
+		coapResp := send(2, blockOption{Num: 1, More: true, SZX: 1}, bytes.Repeat([]byte("b"), 32))
+		if coapResp == nil || coapResp.Code != codeRequestEntityIncomplete || len(coapResp.Payload) == 0 {
+			t.Errorf("response to a larger block is '%v'", coapResp)
+		}
+
+		send(3, blockOption{Num: 0, More: true, SZX: 0}, bytes.Repeat([]byte("a"), 16))
+		coapResp = send(4, blockOption{Num: 0, More: true, SZX: 0}, bytes.Repeat([]byte("x"), 16))
+		if coapResp == nil || coapResp.Code != codeContinue {
+			t.Errorf("response to a restarted upload is '%v'", coapResp)
+		}
+		send(5, blockOption{Num: 1, More: true, SZX: 0}, bytes.Repeat([]byte("b"), 16))
+		coapResp = send(6, blockOption{Num: 1, More: true, SZX: 0}, bytes.Repeat([]byte("c"), 16))
+		if coapResp == nil || coapResp.Code != codeRequestEntityIncomplete || string(coapResp.Payload) != "Block1 block 1 differs from the one received before" {
+			t.Errorf("response to a conflicting block is '%v'", coapResp)
+		}
+
+		send(7, blockOption{Num: 0, More: true, SZX: 1}, bytes.Repeat([]byte("a"), 32))
+		coapResp = send(8, blockOption{Num: 3, SZX: 1}, []byte("d"))
+		if coapResp == nil || coapResp.Code != codeRequestEntityIncomplete || string(coapResp.Payload) != "Block1 block 3 is out of sequence, expected block 1" {
+			t.Errorf("response to a missing block is '%v'", coapResp)
+		}
+		if n := atomic.LoadInt32(&uploads); n != 0 {
+			t.Errorf("backend got %v inconsistent uploads", n)
+		}
+		if len(p.uploads.pending) != 0 {
+			t.Errorf("uploads are '%v'", p.uploads.pending)
+		}
+	}
+}
+
+func TestBlock1UploadTooLarge(t *testing.T) {
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1", MaxRequestBodyBytes: 20})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m, options := block1Request(1, blockOption{Num: 0, More: true}, make([]byte, 16))
+	if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != codeContinue {
+		t.Errorf("response to first block is '%v'", coapResp)
+	}
+	m, options = block1Request(2, blockOption{Num: 1, More: true}, make([]byte, 16))
+	if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != coap.RequestEntityTooLarge {
+		t.Errorf("response to second block is '%v'", coapResp)
+	}
+}
+
+func TestBlock1UploadDenied(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	for _, tt := range []struct {
+		proxy        *Proxy
+		expectedCode coap.COAPCode
+	}{
+		{&Proxy{DeniedClients: []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")}}, 0},
+		{&Proxy{DeniedClients: []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")}, RejectDeniedClients: true}, coap.Forbidden},
+		{&Proxy{AccessPolicy: &AccessPolicy{Rules: []AccessRule{{Action: Deny, PathPrefix: "/upload"}}}}, coap.Forbidden},
+	} {
+		tt.proxy.BackendURL = "http://127.0.0.1:1"
+		p := newProxyHandler(tt.proxy)
+		m, options := block1Request(1, blockOption{Num: 0, More: true, SZX: 1}, make([]byte, 32))
+		coapResp := p.handleRequest(a, m, options)
+		if tt.expectedCode == 0 && coapResp != nil || tt.expectedCode != 0 && (coapResp == nil || coapResp.Code != tt.expectedCode) {
+			t.Errorf("response to first block is '%v'", coapResp)
+		}
+		if len(p.uploads.pending) != 0 {
+			t.Errorf("uploads are '%v'", p.uploads.pending)
+		}
+	}
+}
+
+func TestBlock1UploadSize1(t *testing.T) {
+	var uploads int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err == nil {
+			atomic.AddInt32(&uploads, 1)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	for _, stream := range []bool{false, true} {
+		atomic.StoreInt32(&uploads, 0)
+		p := newProxyHandler(&Proxy{BackendURL: backend.URL, StreamBlock1: stream, MaxRequestBodyBytes: 100})
+		a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+		upload := func(size1 uint32, sizes ...int) *translatedCOAPMessage {
+			var coapResp *translatedCOAPMessage
+			for i, size := range sizes {
+				m, options := block1Request(uint16(i+1), blockOption{Num: uint32(i), More: i < len(sizes)-1}, make([]byte, size))
+				if i == 0 {
+					m.SetOption(coap.Size1, size1)
+				}
+				if coapResp = p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != codeContinue {
+					break
+				}
+			}
+			return coapResp
+		}
+		if coapResp := upload(200, 16, 16); coapResp == nil || coapResp.Code != coap.RequestEntityTooLarge {
+			t.Errorf("response to an upload announcing too many bytes is '%v'", coapResp)
+		}
+		if coapResp := upload(40, 16, 16, 4); coapResp == nil || coapResp.Code != codeRequestEntityIncomplete {
+			t.Errorf("response to an upload shorter than Size1 is '%v'", coapResp)
+		}
+		if coapResp := upload(20, 16, 16, 4); coapResp == nil || coapResp.Code != codeRequestEntityIncomplete {
+			t.Errorf("response to an upload longer than Size1 is '%v'", coapResp)
+		}
+		if coapResp := upload(10, 4); coapResp == nil || coapResp.Code != codeRequestEntityIncomplete {
+			t.Errorf("response to a single block not matching Size1 is '%v'", coapResp)
+		}
+		if n := atomic.LoadInt32(&uploads); n != 0 {
+			t.Errorf("backend got %v uploads not matching Size1", n)
+		}
+		if coapResp := upload(36, 16, 16, 4); coapResp == nil || coapResp.Code != coap.Created {
+			t.Errorf("response to an upload matching Size1 is '%v'", coapResp)
+		}
+		if len(p.uploads.pending) != 0 {
+			t.Errorf("uploads are '%v'", p.uploads.pending)
+		}
+	}
+}
+
+func TestBlock1UploadsWithRequestTags(t *testing.T) {
+	bodies := make(chan string, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	send := func(mid uint16, tag string, block blockOption, payload string) *translatedCOAPMessage {
+		m, options := block1Request(mid, block, []byte(payload))
+		if tag != "" {
+			options = append(options, rawOption{ID: optionRequestTag, Value: []byte(tag)})
+		}
+		return p.handleRequest(a, m, options)
+	}
+	first := blockOption{Num: 0, More: true}
+	last := blockOption{Num: 1}
+	if coapResp := send(1, "a", first, "aaaaaaaaaaaaaaaa"); coapResp.Code != codeContinue {
+		t.Errorf("response to first block of upload a is '%v'", coapResp)
+	}
+	if coapResp := send(2, "b", first, "bbbbbbbbbbbbbbbb"); coapResp.Code != codeContinue {
+		t.Errorf("response to first block of upload b is '%v'", coapResp)
+	}
+	if coapResp := send(3, "", last, "?"); coapResp.Code != codeRequestEntityIncomplete {
+		t.Errorf("response to untagged block is '%v'", coapResp)
+	}
+	if coapResp := send(4, "a", last, "A"); coapResp.Code != coap.Created {
+		t.Errorf("response to last block of upload a is '%v'", coapResp)
+	}
+	if body := <-bodies; body != "aaaaaaaaaaaaaaaaA" {
+		t.Errorf("backend got body '%s' for upload a", body)
+	}
+	if coapResp := send(5, "b", last, "B"); coapResp.Code != coap.Created {
+		t.Errorf("response to last block of upload b is '%v'", coapResp)
+	}
+	if body := <-bodies; body != "bbbbbbbbbbbbbbbbB" {
+		t.Errorf("backend got body '%s' for upload b", body)
+	}
+}
@@ -0,0 +1,188 @@
+package crosscoap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// defaultBlock2SZX is the block size exponent of Block2 responses, unless
+// the client asks for smaller blocks or the packet size is too small
+// (1024-byte blocks).
+const defaultBlock2SZX = 6
+
+var errBlockOutOfRange = errors.New("block beyond the end of the body")
+
+// backendBody is the unread rest of a backend response body; closing it
+// ends the backend request.
+type backendBody struct {
+	io.Reader
+	closers []io.Closer
+	cancel  context.CancelFunc
+}
+
+func (b *backendBody) Close() error {
+	for _, c := range b.closers {
+		c.Close()
+	}
+	b.cancel()
+	return nil
+}
+
+// download is a response served with Block2 (RFC 7959 section 2.4).  Its
+// payload is read from the backend as the client fetches the blocks; only
+// the latest block and the next one are kept in memory.
+type download struct {
+	mu       sync.Mutex
+	response translatedCOAPMessage // the response without its payload
+	body     io.Reader
+	closer   io.Closer // the backend body, if it isn't read yet
+	szx      uint8
+	size     int64  // of the body, or -1 if unknown
+	start    int    // offset of buf in the body
+	buf      []byte // read-ahead
+	eof      bool
+
+	revalidation *downloadRevalidation // if the response came from the cache
+}
+
+func (d *download) close() {
+	if d.closer != nil {
+		d.closer.Close()
+	}
+}
+
+// read returns the block at offset and whether more blocks follow.
+func (d *download) read(offset int) ([]byte, bool, error) {
+	size := 1 << (d.szx + 4)
+	if skip := offset - d.start; skip > len(d.buf) {
+		if _, err := io.CopyN(ioutil.Discard, d.body, int64(skip-len(d.buf))); err != nil {
+			if err == io.EOF {
+				err = errBlockOutOfRange
+			}
+			return nil, false, err
+		}
+		d.buf = nil
+	} else {
+		d.buf = append([]byte(nil), d.buf[skip:]...)
+	}
+	d.start = offset
+	// Read ahead the next block
+	if want := 2 * size; len(d.buf) < want && !d.eof {
+		chunk := make([]byte, want-len(d.buf))
+		n, err := io.ReadFull(d.body, chunk)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			d.eof = true
+		default:
+			return nil, false, err
+		}
+		d.buf = append(d.buf, chunk[:n]...)
+	}
+	if len(d.buf) == 0 && offset > 0 {
+		return nil, false, errBlockOutOfRange
+	}
+	if len(d.buf) <= size {
+		return d.buf, !d.eof, nil
+	}
+	return d.buf[:size], true, nil
+}
+
+// handleDownload answers the request m for a block of a response served
+// with Block2, or returns false if there's no such response in progress.
+func (p *proxyHandler) handleDownload(a *net.UDPAddr, m *coap.Message, options []rawOption, value []byte) (*translatedCOAPMessage, bool) {
+	block, err := parseBlockOption(value)
+	if err != nil {
+		return p.errorResponse(m, coap.BadOption, "invalid Block2 option"), true
+	}
+	key := transferKey(a, m, options)
+	d, _ := p.downloads.get(key).(*download)
+	if d == nil {
+		return nil, false
+	}
+	return p.serveBlock(key, d, m, options, block)
+}
+
+// serveBlock answers the request m with options for a block of d, or
+// returns false if the block isn't available any more and the response has
+// to be fetched again.  The first block, and the blocks of requests
+// carrying a Size2 option, carry the size of the body in Size2 when it's
+// known (RFC 7959 section 4).
+func (p *proxyHandler) serveBlock(key string, d *download, m *coap.Message, options []rawOption, requested blockOption) (*translatedCOAPMessage, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	offset := requested.offset()
+	if offset < d.start {
+		return nil, false
+	}
+	if !p.revalidate(d.revalidation, time.Now()) {
+		p.downloads.abort(key, d)
+		return p.errorResponse(m, codeRequestEntityIncomplete, "representation changed, restart the transfer"), true
+	}
+	block := blockOption{Num: uint32(offset >> (d.szx + 4)), SZX: d.szx}
+	payload, more, err := d.read(block.offset())
+	if err != nil {
+		p.downloads.abort(key, d)
+		if err == errBlockOutOfRange {
+			return p.errorResponse(m, coap.BadOption, "Block2 beyond the end of the response"), true
+		}
+		p.logError("Error reading HTTP response body: %v", err)
+		return p.errorResponse(m, coap.BadGateway, "backend body incomplete"), true
+	}
+	block.More = more
+	if more {
+		p.downloads.touch(key, d)
+	} else {
+		p.downloads.abort(key, d)
+	}
+	coapResp := d.response
+	coapResp.MessageID = m.MessageID
+	coapResp.Token = m.Token
+	coapResp.Payload = append([]byte(nil), payload...)
+	coapResp.ExtraOptions = append(append([]rawOption(nil), d.response.ExtraOptions...), block.option(optionBlock2))
+	if _, asked := findOption(options, optionSize2); d.size >= 0 && (block.Num == 0 || asked) {
+		coapResp.ExtraOptions = append(coapResp.ExtraOptions, uintOption(optionSize2, uint32(d.size)))
+	}
+	return &coapResp, true
+}
+
+// startDownload serves the response coapResp to the request m, whose
+// payload doesn't fit in a packet, with Block2.  The payload is followed by
+// rest, if it isn't nil, and is size bytes long in all (-1 if unknown).
+func (p *proxyHandler) startDownload(a *net.UDPAddr, m *coap.Message, options []rawOption, coapResp *translatedCOAPMessage, rest io.ReadCloser, size int64) *translatedCOAPMessage {
+	d := &download{response: *coapResp, body: bytes.NewReader(coapResp.untruncated), szx: defaultBlock2SZX, size: size, revalidation: coapResp.revalidation}
+	d.response.Payload = nil
+	d.response.IsTruncated = false
+	d.response.untruncated = nil
+	d.response.revalidation = nil
+	if rest != nil {
+		d.body = io.MultiReader(d.body, rest)
+		d.closer = rest
+	}
+	requested := blockOption{SZX: defaultBlock2SZX}
+	if value, found := findOption(options, optionBlock2); found {
+		requested, _ = parseBlockOption(value)
+	}
+	if requested.SZX < d.szx {
+		d.szx = requested.SZX
+	}
+	// The block must fit in a packet along with the options
+	extra := append(append([]rawOption(nil), d.response.ExtraOptions...), blockOption{Num: 1 << 19, More: true}.option(optionBlock2), uintOption(optionSize2, 1<<31))
+	if header, err := marshalMessage(&d.response.Message, extra); err == nil {
+		for d.szx > 0 && 1<<(d.szx+4) > p.translator.maxPacketSize()-len(header)-1 {
+			d.szx--
+		}
+	}
+	key := transferKey(a, m, options)
+	p.downloads.add(key, d)
+	coapResp, _ = p.serveBlock(key, d, m, options, requested)
+	return coapResp
+}
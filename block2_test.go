@@ -0,0 +1,154 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func block2Request(mid uint16, block *blockOption) (*coap.Message, []rawOption) {
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: mid, Token: []byte{byte(mid)}}
+	m.SetPathString("/firmware")
+	options := []rawOption{{ID: uint16(coap.URIPath), Value: []byte("firmware")}}
+	if block != nil {
+		options = append(options, block.option(optionBlock2))
+	}
+	return m, options
+}
+
+// fetchBlocks fetches the response to GET /firmware block by block, starting
+// with the first block requested.
+func fetchBlocks(t *testing.T, p *proxyHandler, first *blockOption) []byte {
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	var payload []byte
+	requested := first
+	for mid := uint16(1); mid < 100; mid++ {
+		m, options := block2Request(mid, requested)
+		coapResp := p.handleRequest(a, m, options)
+		if coapResp == nil || coapResp.Code != coap.Content || coapResp.MessageID != mid {
+			t.Fatalf("response to block request %v is '%v'", mid, coapResp)
+		}
+		value, found := findOption(coapResp.ExtraOptions, optionBlock2)
+		block, err := parseBlockOption(value)
+		if !found || err != nil || block.offset() != len(payload) {
+			t.Fatalf("response to block request %v has Block2 '%v'", mid, block)
+		}
+		payload = append(payload, coapResp.Payload...)
+		if !block.More {
+			return payload
+		}
+		requested = &blockOption{Num: block.Num + 1, SZX: block.SZX}
+	}
+	t.Fatalf("too many blocks")
+	return nil
+}
+
+func TestBlock2Download(t *testing.T) {
+	firmware := bytes.Repeat([]byte("0123456789abcdef"), 300)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(firmware)
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, StreamBlock2: true})
+	if payload := fetchBlocks(t, p, nil); !bytes.Equal(payload, firmware) {
+		t.Errorf("payload is %v bytes long", len(payload))
+	}
+	// Early negotiation of smaller blocks
+	if payload := fetchBlocks(t, p, &blockOption{SZX: 2}); !bytes.Equal(payload, firmware) {
+		t.Errorf("payload with 64-byte blocks is %v bytes long", len(payload))
+	}
+	if len(p.downloads.pending) != 0 {
+		t.Errorf("downloads are '%v'", p.downloads.pending)
+	}
+}
+
+func TestBlock2DownloadIsStreamed(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(make([]byte, 4096))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(make([]byte, 4096))
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, StreamBlock2: true})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	responseChan := make(chan *translatedCOAPMessage, 1)
+	go func() {
+		m, options := block2Request(1, nil)
+		responseChan <- p.handleRequest(a, m, options)
+	}()
+	select {
+	case coapResp := <-responseChan:
+		if coapResp == nil || len(coapResp.Payload) != 1024 {
+			t.Errorf("first block is '%v'", coapResp)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("first block waits for the whole body")
+	}
+	close(release)
+	m, options := block2Request(2, &blockOption{Num: 7, SZX: 6})
+	coapResp := p.handleRequest(a, m, options)
+	value, _ := findOption(coapResp.ExtraOptions, optionBlock2)
+	if block, _ := parseBlockOption(value); block.Num != 7 || block.More {
+		t.Errorf("last block has Block2 '%v'", block)
+	}
+}
+
+func TestBlock2Size2(t *testing.T) {
+	firmware := bytes.Repeat([]byte("0123456789abcdef"), 300)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(firmware)))
+		}
+		w.Write(firmware[:1024])
+		w.(http.Flusher).Flush()
+		w.Write(firmware[1024:])
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, StreamBlock2: true})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	size2 := func(coapResp *translatedCOAPMessage) string {
+		value, found := findOption(coapResp.ExtraOptions, optionSize2)
+		if !found {
+			return "none"
+		}
+		n := 0
+		for _, b := range value {
+			n = n<<8 | int(b)
+		}
+		return strconv.Itoa(n)
+	}
+	m, options := block2Request(1, nil)
+	if coapResp := p.handleRequest(a, m, options); size2(coapResp) != "4800" {
+		t.Errorf("first block has Size2 %v", size2(coapResp))
+	}
+	m, options = block2Request(2, &blockOption{Num: 1, SZX: 6})
+	if coapResp := p.handleRequest(a, m, options); size2(coapResp) != "none" {
+		t.Errorf("second block has Size2 %v", size2(coapResp))
+	}
+	m, options = block2Request(3, &blockOption{Num: 2, SZX: 6})
+	options = append(options, rawOption{ID: optionSize2})
+	if coapResp := p.handleRequest(a, m, options); size2(coapResp) != "4800" {
+		t.Errorf("block requested with Size2 has Size2 %v", size2(coapResp))
+	}
+
+	m, options = block2Request(4, nil)
+	m.SetOption(coap.URIQuery, "chunked=1")
+	options = append(options, rawOption{ID: uint16(coap.URIQuery), Value: []byte("chunked=1")})
+	if coapResp := p.handleRequest(a, m, options); size2(coapResp) != "none" {
+		t.Errorf("first block of a chunked response has Size2 %v", size2(coapResp))
+	}
+}
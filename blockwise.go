@@ -0,0 +1,242 @@
+package crosscoap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// Block-wise transfer options (RFC 7959) and response codes which go-coap
+// doesn't know.
+const (
+	optionBlock2 uint16 = 23
+	optionBlock1 uint16 = 27
+	optionSize2  uint16 = 28
+
+	// optionRequestTag (RFC 9175 section 3) tells apart concurrent
+	// transfers to the same resource from the same client.
+	optionRequestTag uint16 = 292
+
+	codeContinue                coap.COAPCode = 95  // 2.31
+	codeRequestEntityIncomplete coap.COAPCode = 136 // 4.08
+)
+
+// defaultExchangeLifetime is how long an incomplete block-wise transfer is
+// kept after its latest block if UploadLifetime or DownloadLifetime is zero
+// (EXCHANGE_LIFETIME, RFC 7252 section 4.8.2).
+const defaultExchangeLifetime = 247 * time.Second
+
+var errInvalidBlock = errors.New("invalid block option")
+
+// blockOption is the value of a Block1 or Block2 option (RFC 7959 section
+// 2.2).
+type blockOption struct {
+	Num  uint32
+	More bool
+	SZX  uint8
+}
+
+func parseBlockOption(value []byte) (blockOption, error) {
+	if len(value) > 3 {
+		return blockOption{}, errInvalidBlock
+	}
+	var n uint32
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+	block := blockOption{Num: n >> 4, More: n&0x8 != 0, SZX: uint8(n & 0x7)}
+	if block.SZX == 7 {
+		// Reserved (BERT is only defined over reliable transports)
+		return blockOption{}, errInvalidBlock
+	}
+	return block, nil
+}
+
+// size returns the block size in bytes.
+func (b blockOption) size() int {
+	return 1 << (b.SZX + 4)
+}
+
+// offset returns the position of the first byte of the block in the body.
+func (b blockOption) offset() int {
+	return int(b.Num) * b.size()
+}
+
+func (b blockOption) option(id uint16) rawOption {
+	n := b.Num<<4 | uint32(b.SZX)
+	if b.More {
+		n |= 0x8
+	}
+	return uintOption(id, n)
+}
+
+// uintOption returns the option id with the value n, in the shortest
+// encoding (RFC 7252 section 3.2).
+func uintOption(id uint16, n uint32) rawOption {
+	var value []byte
+	for ; n > 0; n >>= 8 {
+		value = append([]byte{byte(n)}, value...)
+	}
+	return rawOption{ID: id, Value: value}
+}
+
+func findOption(options []rawOption, id uint16) ([]byte, bool) {
+	for _, o := range options {
+		if o.ID == id {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+func removeOption(options []rawOption, id uint16) []rawOption {
+	var kept []rawOption
+	for _, o := range options {
+		if o.ID != id {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+func withBlockOption(coapResp *translatedCOAPMessage, id uint16, block blockOption) *translatedCOAPMessage {
+	if coapResp != nil {
+		coapResp.ExtraOptions = append(coapResp.ExtraOptions, block.option(id))
+	}
+	return coapResp
+}
+
+// handleRequest handles the CoAP request m, taking care of OSCORE and of
+// block-wise transfers: the blocks of Block1 uploads are gathered before the request is
+// proxied, and the blocks of responses served with Block2 are read from the
+// backend response as the client asks for them.
+func (p *proxyHandler) handleRequest(a *net.UDPAddr, m *coap.Message, options []rawOption) *translatedCOAPMessage {
+	return p.handleRequestAs(a, "", m, options)
+}
+
+// handleRequestAs handles the CoAP request m from the client with the
+// authenticated identity (if any).
+func (p *proxyHandler) handleRequestAs(a *net.UDPAddr, identity string, m *coap.Message, options []rawOption) *translatedCOAPMessage {
+	if value, found := findOption(options, optionOSCORE); found {
+		return p.handleOSCORE(a, m, options, value)
+	}
+	if value, found := findOption(options, optionBlock2); found && p.servesBlock2() {
+		if coapResp, ok := p.handleDownload(a, m, options, value); ok {
+			return coapResp
+		}
+	}
+	if value, found := findOption(options, optionBlock1); found {
+		if denied, ok := p.admitUpload(a, m, p.translator.requestID(m.Token, options)); !ok {
+			return denied
+		}
+		return p.handleUpload(a, identity, m, options, value)
+	}
+	return p.handle(a, identity, m, options, nil)
+}
+
+// transfer is a block-wise transfer in progress.
+type transfer interface {
+	// close releases the backend request of the transfer, if any.
+	close()
+}
+
+type transferEntry struct {
+	transfer transfer
+	expires  time.Time
+}
+
+// transfers tracks the block-wise transfers in progress, by client and
+// request.  Transfers whose next block doesn't come within lifetime are
+// aborted by the janitor.
+type transfers struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	pending  map[string]*transferEntry
+}
+
+func newTransfers(lifetime time.Duration) *transfers {
+	if lifetime <= 0 {
+		lifetime = defaultExchangeLifetime
+	}
+	return &transfers{lifetime: lifetime, pending: make(map[string]*transferEntry)}
+}
+
+// transferKey identifies the transfer of the request m from the client at a;
+// the requests carrying its successive blocks have the same key, including
+// the same Request-Tag options.
+func transferKey(a *net.UDPAddr, m *coap.Message, options []rawOption) string {
+	key := fmt.Sprintf("%v %v %v?%v", a, m.Code, m.PathString(), m.Options(coap.URIQuery))
+	for _, o := range options {
+		if o.ID == optionRequestTag {
+			key += fmt.Sprintf(" tag=%x", o.Value)
+		}
+	}
+	return key
+}
+
+func (ts *transfers) get(key string) transfer {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if entry, found := ts.pending[key]; found {
+		return entry.transfer
+	}
+	return nil
+}
+
+// add registers t, aborting any transfer it replaces.
+func (ts *transfers) add(key string, t transfer) {
+	entry := &transferEntry{transfer: t, expires: time.Now().Add(ts.lifetime)}
+	ts.mu.Lock()
+	replaced := ts.pending[key]
+	ts.pending[key] = entry
+	ts.mu.Unlock()
+	if replaced != nil {
+		replaced.transfer.close()
+	}
+}
+
+// touch restarts the lifetime of t when one of its blocks is transferred.
+func (ts *transfers) touch(key string, t transfer) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if entry, found := ts.pending[key]; found && entry.transfer == t {
+		entry.expires = time.Now().Add(ts.lifetime)
+	}
+}
+
+// remove forgets t once it's complete.
+func (ts *transfers) remove(key string, t transfer) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if entry, found := ts.pending[key]; found && entry.transfer == t {
+		delete(ts.pending, key)
+	}
+}
+
+// abort forgets t and releases its backend request.
+func (ts *transfers) abort(key string, t transfer) {
+	ts.remove(key, t)
+	t.close()
+}
+
+// expire aborts the transfers whose lifetime ended before now, and returns
+// their number.
+func (ts *transfers) expire(now time.Time) int {
+	var expired []transfer
+	ts.mu.Lock()
+	for key, entry := range ts.pending {
+		if now.After(entry.expires) {
+			delete(ts.pending, key)
+			expired = append(expired, entry.transfer)
+		}
+	}
+	ts.mu.Unlock()
+	for _, t := range expired {
+		t.close()
+	}
+	return len(expired)
+}
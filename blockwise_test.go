@@ -0,0 +1,19 @@
+package crosscoap
+
+import "testing"
+
+func TestBlockOption(t *testing.T) {
+	for _, block := range []blockOption{{}, {Num: 1, More: true, SZX: 2}, {Num: 4095, SZX: 6}, {Num: 1 << 19, More: true}} {
+		o := block.option(optionBlock1)
+		parsed, err := parseBlockOption(o.Value)
+		if err != nil || parsed != block {
+			t.Errorf("block '%v' is parsed as '%v', '%v'", block, parsed, err)
+		}
+	}
+	if _, err := parseBlockOption([]byte{0x0f}); err == nil {
+		t.Errorf("SZX 7 is accepted")
+	}
+	if _, err := parseBlockOption([]byte{1, 2, 3, 4}); err == nil {
+		t.Errorf("4-byte option is accepted")
+	}
+}
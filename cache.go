@@ -0,0 +1,430 @@
+package crosscoap
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedResponse is a backend response kept in the cache.
+type cachedResponse struct {
+	resource   string // the cacheKey of the request
+	key        string // the variantKey of the request
+	url        string
+	requestURI string
+	statusCode int
+	status     string
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+	element    *list.Element
+}
+
+func (e *cachedResponse) size() int {
+	return len(e.key) + len(e.body)
+}
+
+// The measurements of the cache.
+const (
+	// metricCacheHits and metricCacheMisses count the lookups of cacheable
+	// backend requests.
+	metricCacheHits   = "cache_hits"
+	metricCacheMisses = "cache_misses"
+	// metricCacheEvictions counts the responses evicted to make room for
+	// others, before they expired.
+	metricCacheEvictions = "cache_evictions"
+	// metricCacheEntries and metricCacheBytes are the number and the size
+	// of the cached responses.
+	metricCacheEntries = "cache_entries"
+	metricCacheBytes   = "cache_bytes"
+)
+
+// CacheStats are the statistics of the response cache.
+type CacheStats struct {
+	Entries   int     `json:"entries"`
+	Bytes     int     `json:"bytes"`
+	MaxBytes  int     `json:"maxBytes"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRatio  float64 `json:"hitRatio"`
+	Evictions uint64  `json:"evictions"`
+}
+
+// cachedResource are the request headers by which the responses cached
+// for a resource vary.
+type cachedResource struct {
+	vary    []string
+	entries int
+}
+
+// responseCache keeps the responses of the backend to GET requests, by
+// method, URL and the request headers named by their Vary header, up to a
+// total size, evicting the least recently used ones first.
+type responseCache struct {
+	mu          sync.Mutex
+	entries     map[string]*cachedResponse
+	resources   map[string]*cachedResource
+	lru         *list.List // of *cachedResponse, most recently used first
+	size        int
+	maxSize     int
+	negativeTTL time.Duration
+	staleTTL    time.Duration
+	metrics     Metrics
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+}
+
+// newResponseCache returns the response cache of p, or nil if CacheMaxSize
+// isn't positive.
+func (p *Proxy) newResponseCache() *responseCache {
+	if p.CacheMaxSize <= 0 {
+		return nil
+	}
+	return &responseCache{
+		entries:     make(map[string]*cachedResponse),
+		resources:   make(map[string]*cachedResource),
+		lru:         list.New(),
+		maxSize:     p.CacheMaxSize,
+		negativeTTL: p.NegativeCacheTTL,
+		staleTTL:    p.ServeStale,
+		metrics:     p.metrics(),
+	}
+}
+
+// cacheKey returns the key of the backend request req in the cache.
+func cacheKey(req *http.Request) string {
+	u := *req.URL
+	if req.Host != "" {
+		u.Host = req.Host
+	}
+	return req.Method + " " + u.String()
+}
+
+// defaultVary are the request headers by which responses always vary: the
+// Accept header carries the Accept option of CoAP requests.
+var defaultVary = []string{"Accept"}
+
+// responseVary returns the request headers named by the Vary header of
+// httpResp, with defaultVary, in canonical form, or false if the response
+// varies on something else than request headers (Vary: *).
+func responseVary(httpResp *http.Response) ([]string, bool) {
+	vary := append([]string(nil), defaultVary...)
+	for _, value := range httpResp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	unique := vary[:0]
+	for i, name := range vary {
+		if i == 0 || name != vary[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique, true
+}
+
+// variantKey returns the key of the response to req, of the resource with
+// the key resource, whose responses vary by the request headers vary.
+func variantKey(resource string, req *http.Request, vary []string) string {
+	key := resource
+	for _, name := range vary {
+		key += "\n" + name + ": " + strings.Join(req.Header.Values(name), ", ")
+	}
+	return key
+}
+
+type privateRequestKey struct{}
+
+// withPrivateRequest returns req marked as made on behalf of a single
+// device or principal, such as with its own backend credentials or by an
+// authenticated client, so that its response isn't shared with the other
+// clients.
+func withPrivateRequest(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), privateRequestKey{}, true))
+}
+
+// cacheable reports whether req may be answered from, and its response
+// stored in, the cache shared by the clients: requests with credentials or
+// session cookies are not, nor private requests, nor GET requests with a
+// body, translated from FETCH, whose key would ignore the body, nor those
+// whose cache policy bypasses the cache.
+func cacheable(req *http.Request) bool {
+	if policy := requestCachePolicy(req); policy != nil && policy.Bypass {
+		return false
+	}
+	if private, _ := req.Context().Value(privateRequestKey{}).(bool); private {
+		return false
+	}
+	return req.Method == http.MethodGet && req.ContentLength == 0 && req.Header.Get("Authorization") == "" &&
+		req.Header.Get("Cookie") == "" && requestCookieJar(req) == nil
+}
+
+// hasCacheDirective reports whether the Cache-Control header of header has
+// the directive.
+func hasCacheDirective(header http.Header, directive string) bool {
+	for _, d := range strings.Split(header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(d), directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// freshness returns how long the response to a GET request stays in the
+// cache: successful responses for their max-age (or until they expire),
+// errors for the negative TTL (but no longer than their own max-age).
+func (c *responseCache) freshness(httpResp *http.Response) time.Duration {
+	if hasCacheDirective(httpResp.Header, "private") {
+		return 0
+	}
+	maxAge, hasMaxAge := responseMaxAge(httpResp.Header)
+	ttl := time.Duration(maxAge) * time.Second
+	switch code := httpResp.StatusCode; {
+	case code == http.StatusOK || code == http.StatusNonAuthoritativeInfo || code == http.StatusNoContent:
+		return ttl
+	case code >= 400:
+		if hasMaxAge && ttl < c.negativeTTL {
+			return ttl
+		}
+		return c.negativeTTL
+	}
+	return 0
+}
+
+// lookup returns the fresh cached response to req at now, or nil.  Expired
+// successful responses are kept for staleTTL as last known good ones.
+func (c *responseCache) lookup(req *http.Request, now time.Time) *cachedResponse {
+	if c == nil || !cacheable(req) || refreshesCache(req) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resource := cacheKey(req)
+	vary := defaultVary
+	if r := c.resources[resource]; r != nil {
+		vary = r.vary
+	}
+	e := c.entries[variantKey(resource, req, vary)]
+	if e != nil && !now.Before(e.expires) {
+		if e.statusCode >= 400 || !now.Before(e.expires.Add(c.staleTTL)) {
+			c.remove(e)
+			c.measureSize()
+		}
+		e = nil
+	}
+	if e == nil {
+		c.misses++
+		c.metrics.Counter(metricCacheMisses, 1, nil)
+		return nil
+	}
+	c.hits++
+	c.metrics.Counter(metricCacheHits, 1, nil)
+	c.lru.MoveToFront(e.element)
+	return e
+}
+
+// outcome describes the lookup of req for the access log: hit, miss,
+// bypass (by its cache policy) or "" if req can't be cached.
+func (c *responseCache) outcome(req *http.Request, hit bool) string {
+	switch {
+	case c == nil:
+		return ""
+	case hit:
+		return "hit"
+	case cacheable(req):
+		return "miss"
+	}
+	if policy := requestCachePolicy(req); policy != nil && policy.Bypass {
+		return "bypass"
+	}
+	return ""
+}
+
+type cacheOutcomeKey struct{}
+
+// withCacheOutcome returns req whose cache outcome is written to outcome.
+func withCacheOutcome(req *http.Request, outcome *string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheOutcomeKey{}, outcome))
+}
+
+func setCacheOutcome(req *http.Request, outcome string) {
+	if o, ok := req.Context().Value(cacheOutcomeKey{}).(*string); ok {
+		*o = outcome
+	}
+}
+
+// store keeps the backend response to req, with its whole body, if it's
+// cacheable.
+func (c *responseCache) store(req *http.Request, httpResp *http.Response, httpBody []byte, now time.Time) {
+	if c == nil || !cacheable(req) {
+		return
+	}
+	ttl := c.routeFreshness(req, httpResp)
+	if ttl <= 0 {
+		return
+	}
+	vary, ok := responseVary(httpResp)
+	if !ok {
+		return
+	}
+	resource := cacheKey(req)
+	e := &cachedResponse{
+		resource:   resource,
+		key:        variantKey(resource, req, vary),
+		url:        req.URL.String(),
+		requestURI: req.URL.RequestURI(),
+		statusCode: httpResp.StatusCode,
+		status:     httpResp.Status,
+		header:     httpResp.Header.Clone(),
+		body:       append([]byte(nil), httpBody...),
+		stored:     now,
+		expires:    now.Add(ttl),
+	}
+	if e.size() > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.entries[e.key]; old != nil {
+		c.remove(old)
+	}
+	for c.size+e.size() > c.maxSize {
+		c.remove(c.lru.Back().Value.(*cachedResponse))
+		c.evictions++
+		c.metrics.Counter(metricCacheEvictions, 1, nil)
+	}
+	r := c.resources[resource]
+	if r == nil {
+		r = &cachedResource{}
+		c.resources[resource] = r
+	}
+	r.vary = vary
+	r.entries++
+	e.element = c.lru.PushFront(e)
+	c.entries[e.key] = e
+	c.size += e.size()
+	c.measureSize()
+}
+
+func (c *responseCache) measureSize() {
+	c.metrics.Gauge(metricCacheEntries, float64(len(c.entries)), nil)
+	c.metrics.Gauge(metricCacheBytes, float64(c.size), nil)
+}
+
+// purge removes the cached responses whose backend URL matches pattern,
+// returning their number.  A pattern starting with a slash is matched
+// against the path and query of the URLs, else against the whole URLs, as
+// a prefix in which an asterisk stands for any characters.
+func (c *responseCache) purge(pattern string) int {
+	if c == nil {
+		return 0
+	}
+	quoted := strings.Split(pattern, "*")
+	for i := range quoted {
+		quoted[i] = regexp.QuoteMeta(quoted[i])
+	}
+	re := regexp.MustCompile("^" + strings.Join(quoted, ".*"))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for _, e := range c.entries {
+		target := e.url
+		if strings.HasPrefix(pattern, "/") {
+			target = e.requestURI
+		}
+		if re.MatchString(target) {
+			c.remove(e)
+			purged++
+		}
+	}
+	if purged > 0 {
+		c.measureSize()
+	}
+	return purged
+}
+
+// PurgeCache removes the cached backend responses whose URL matches
+// pattern, when backend data has been updated out-of-band, returning their
+// number.  A pattern starting with a slash is matched against the path and
+// query of the backend URLs (such as "/devices/42/"), else against the
+// whole URLs; it is a prefix, in which an asterisk stands for any
+// characters (such as "/devices/*/config").  The cache is that of the proxy
+// being served.
+func (p *Proxy) PurgeCache(pattern string) int {
+	return p.cache.purge(pattern)
+}
+
+// stats returns the statistics of the cache, or nil if there's none.
+func (c *responseCache) stats() *CacheStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := &CacheStats{
+		Entries:   len(c.entries),
+		Bytes:     c.size,
+		MaxBytes:  c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		stats.HitRatio = float64(c.hits) / float64(lookups)
+	}
+	return stats
+}
+
+func (c *responseCache) remove(e *cachedResponse) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+	if r := c.resources[e.resource]; r != nil {
+		if r.entries--; r.entries == 0 {
+			delete(c.resources, e.resource)
+		}
+	}
+}
+
+// response returns the cached response to req as sendHTTPRequest does with
+// limit.  Its Max-Age is the remaining freshness at now.
+func (e *cachedResponse) response(req *http.Request, limit int, now time.Time) (*http.Response, []byte, io.ReadCloser) {
+	header := e.header.Clone()
+	header.Del("Expires")
+	header.Del("Date")
+	header.Set("Cache-Control", "max-age="+strconv.Itoa(int(e.expires.Sub(now)/time.Second)))
+	httpResp := &http.Response{
+		StatusCode:    e.statusCode,
+		Status:        e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+	body := append([]byte(nil), e.body...) // translations may modify it
+	if limit >= 0 && len(body) > limit {
+		return httpResp, body[:limit+1], ioutil.NopCloser(bytes.NewReader(body[limit+1:]))
+	}
+	return httpResp, body, nil
+}
@@ -0,0 +1,249 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestProxyWithCache(t *testing.T) {
+	requests := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("fresh"))
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/missing":
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		negativeTTL      time.Duration
+		path             string
+		method           coap.COAPCode
+		expectedCode     coap.COAPCode
+		expectedRequests int
+	}{
+		{0, "/fresh", coap.GET, coap.Content, 1},
+		{0, "/fresh", coap.POST, coap.Changed, 3},
+		{0, "/private", coap.GET, coap.Content, 3},
+		{0, "/uncached", coap.GET, coap.Content, 3},
+		{0, "/missing", coap.GET, coap.NotFound, 3},
+		{time.Minute, "/missing", coap.GET, coap.NotFound, 1},
+	} {
+		requests = make(map[string]int)
+		p := newProxyHandler(&Proxy{BackendURL: backend.URL, CacheMaxSize: 1 << 20, NegativeCacheTTL: tt.negativeTTL})
+		for i := 0; i < 3; i++ {
+			req := coap.Message{Type: coap.Confirmable, Code: tt.method, MessageID: 1}
+			req.SetPathString(tt.path)
+			coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+			if coapResp == nil || coapResp.Code != tt.expectedCode {
+				t.Fatalf("%v %v: response is %v", tt.method, tt.path, coapResp)
+			}
+			if i > 0 && tt.expectedRequests == 1 {
+				if maxAge, _ := coapResp.Option(coap.MaxAge).(uint32); maxAge == 0 || maxAge > 60 {
+					t.Errorf("%v %v: Max-Age of a cached response is %v", tt.method, tt.path, maxAge)
+				}
+			}
+		}
+		if requests[tt.path] != tt.expectedRequests {
+			t.Errorf("%v %v: backend got %v requests", tt.method, tt.path, requests[tt.path])
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := (&proxyHandler{Proxy: Proxy{CacheMaxSize: 150}}).newResponseCache()
+	now := time.Now()
+	store := func(path string, size int) *http.Request {
+		req, _ := http.NewRequest("GET", "http://backend"+path, nil)
+		httpResp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=60"}}}
+		c.store(req, httpResp, []byte(strings.Repeat("x", size)), now)
+		return req
+	}
+	a := store("/a", 30)
+	b := store("/b", 30)
+	c.lookup(a, now) // /a is now more recently used than /b
+	store("/c", 30)
+	if c.lookup(a, now) == nil {
+		t.Errorf("/a evicted")
+	}
+	if c.lookup(b, now) != nil {
+		t.Errorf("/b not evicted")
+	}
+	if c.size > c.maxSize {
+		t.Errorf("cache size is %v", c.size)
+	}
+	store("/huge", 200)
+	if len(c.entries) != 2 {
+		t.Errorf("cache has %v entries after a response larger than the cache", len(c.entries))
+	}
+	if c.lookup(a, now.Add(time.Minute)) != nil {
+		t.Errorf("expired response returned")
+	}
+	if stats := c.stats(); stats.Evictions != 1 || stats.Entries != 1 {
+		t.Errorf("cache stats are %+v", stats)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	c := &responseCache{negativeTTL: 10 * time.Second}
+	for _, tt := range []struct {
+		status       int
+		cacheControl string
+		expected     time.Duration
+	}{
+		{http.StatusOK, "max-age=60", time.Minute},
+		{http.StatusOK, "", 0},
+		{http.StatusOK, "no-store", 0},
+		{http.StatusOK, "private, max-age=60", 0},
+		{http.StatusNotModified, "max-age=60", 0},
+		{http.StatusNotFound, "", 10 * time.Second},
+		{http.StatusNotFound, "max-age=60", 10 * time.Second},
+		{http.StatusServiceUnavailable, "max-age=5", 5 * time.Second},
+	} {
+		httpResp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.cacheControl != "" {
+			httpResp.Header.Set("Cache-Control", tt.cacheControl)
+		}
+		if freshness := c.freshness(httpResp); freshness != tt.expected {
+			t.Errorf("%v %v: freshness is %v", tt.status, tt.cacheControl, freshness)
+		}
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, CacheMaxSize: 1 << 20, Metrics: metrics})
+	for _, path := range []string{"/a", "/a", "/a", "/b"} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(path)
+		p.handleRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}, m, nil)
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	for _, line := range []string{
+		`crosscoap_cache_hits_total 2`,
+		`crosscoap_cache_misses_total 2`,
+		`crosscoap_cache_entries 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack '%v': %v", line, w.Body)
+		}
+	}
+	stats := p.cache.stats()
+	if stats.Entries != 2 || stats.Hits != 2 || stats.Misses != 2 || stats.HitRatio != 0.5 || stats.Bytes == 0 {
+		t.Errorf("cache stats are %+v", stats)
+	}
+	w = adminRequest(p.adminHandler("secret"), "GET", "/stats", "secret", "")
+	if !strings.Contains(w.Body.String(), `"hitRatio":0.5`) {
+		t.Errorf("admin stats are %v", w.Body)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	c := (&proxyHandler{Proxy: Proxy{CacheMaxSize: 1 << 20}}).newResponseCache()
+	now := time.Now()
+	request := func(accept, language string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://backend/a", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if language != "" {
+			req.Header.Set("Accept-Language", language)
+		}
+		return req
+	}
+	store := func(req *http.Request, vary, body string) {
+		httpResp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=60"}}}
+		if vary != "" {
+			httpResp.Header.Set("Vary", vary)
+		}
+		c.store(req, httpResp, []byte(body), now)
+	}
+	body := func(req *http.Request) string {
+		if e := c.lookup(req, now); e != nil {
+			return string(e.body)
+		}
+		return ""
+	}
+	store(request("application/json", ""), "", "json")
+	store(request("application/cbor", ""), "", "cbor")
+	if b := body(request("application/json", "")); b != "json" {
+		t.Errorf("JSON response is '%v'", b)
+	}
+	if b := body(request("application/cbor", "")); b != "cbor" {
+		t.Errorf("CBOR response is '%v'", b)
+	}
+	if b := body(request("", "")); b != "" {
+		t.Errorf("response without Accept is '%v'", b)
+	}
+
+	store(request("", "en"), "accept-language", "hello")
+	store(request("", "fr"), "Accept-Language", "bonjour")
+	if b := body(request("", "fr")); b != "bonjour" {
+		t.Errorf("French response is '%v'", b)
+	}
+	if b := body(request("", "de")); b != "" {
+		t.Errorf("German response is '%v'", b)
+	}
+	store(request("", "de"), "*", "hallo")
+	if b := body(request("", "de")); b != "" {
+		t.Errorf("response varying on * cached: '%v'", b)
+	}
+
+	c.mu.Lock()
+	for _, e := range c.entries {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	if len(c.resources) != 0 {
+		t.Errorf("resources left without responses: %v", c.resources)
+	}
+}
+
+func TestPurgeCache(t *testing.T) {
+	config := &Proxy{BackendURL: "http://backend/api", CacheMaxSize: 1 << 20}
+	p := newProxyHandler(config)
+	now := time.Now()
+	for _, path := range []string{"/api/devices/1/config", "/api/devices/2/config", "/api/devices/2/state", "/api/other"} {
+		req, _ := http.NewRequest("GET", "http://backend"+path, nil)
+		httpResp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=60"}}}
+		p.cache.store(req, httpResp, []byte("x"), now)
+	}
+	if n := config.PurgeCache("/api/devices/*/config"); n != 2 {
+		t.Errorf("purged %v responses by wildcard", n)
+	}
+	if n := config.PurgeCache("http://elsewhere/"); n != 0 {
+		t.Errorf("purged %v responses of another host", n)
+	}
+	if n := config.PurgeCache("http://backend/api/dev"); n != 1 {
+		t.Errorf("purged %v responses by URL prefix", n)
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "DELETE", "/cache?prefix=/", "secret", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"purged":1}` {
+		t.Errorf("purge response is %v: %v", w.Code, w.Body)
+	}
+	if w := adminRequest(p.adminHandler("secret"), "DELETE", "/cache", "secret", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("purge response without prefix is %v", w.Code)
+	}
+	if stats := p.cache.stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("cache stats are %+v", stats)
+	}
+}
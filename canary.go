@@ -0,0 +1,86 @@
+package crosscoap
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// CanaryRoute sends Percent percent of the requests whose path lies below
+// PathPrefix (matched on whole path segments) to BackendURL instead of the
+// proxy's BackendURL, with the path of the latter replaced.  The choice is
+// sticky per client endpoint, so that the requests of a block-wise
+// transfer don't straddle backends.
+type CanaryRoute struct {
+	PathPrefix string
+	BackendURL string
+	Percent    float64
+}
+
+type canaryRoute struct {
+	CanaryRoute
+	url *url.URL
+}
+
+// canarySplitter splits requests between the backend and CanaryRoutes.
+type canarySplitter struct {
+	backend *url.URL
+	routes  []canaryRoute
+}
+
+// newCanarySplitter returns the canary splitter of p, or nil if it has no
+// valid CanaryRoutes.
+func (p *proxyHandler) newCanarySplitter() *canarySplitter {
+	if len(p.CanaryRoutes) == 0 {
+		return nil
+	}
+	backend, err := url.Parse(p.BackendURL)
+	if err != nil {
+		p.logError("Invalid backend URL, not splitting requests: %v", err)
+		return nil
+	}
+	c := &canarySplitter{backend: backend}
+	for _, route := range p.CanaryRoutes {
+		u, err := url.Parse(route.BackendURL)
+		if err != nil {
+			p.logError("Invalid canary backend URL: %v", err)
+			continue
+		}
+		c.routes = append(c.routes, canaryRoute{route, u})
+	}
+	return c
+}
+
+// canaryBucket maps the client a of a route to a number between 0 and
+// 100.
+func canaryBucket(a *net.UDPAddr, route string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(a.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(route))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// splitCanary sends req, translated from a request of a for path, to a
+// canary backend if its route and the client's share say so.  It returns
+// the canary backend URL, or "".
+func (p *proxyHandler) splitCanary(a *net.UDPAddr, path string, req *http.Request) string {
+	if p.canary == nil {
+		return ""
+	}
+	for _, route := range p.canary.routes {
+		if !hasPathPrefix(path, route.PathPrefix) {
+			continue
+		}
+		if canaryBucket(a, route.PathPrefix) >= route.Percent {
+			return ""
+		}
+		if u := rebaseURL(req.URL, p.canary.backend, route.url); u != nil {
+			req.URL = u
+			return route.BackendURL
+		}
+		return ""
+	}
+	return ""
+}
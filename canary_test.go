@@ -0,0 +1,59 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestProxyWithCanaryRoutes(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+	stable, canary := newBackend("stable"), newBackend("canary")
+	defer stable.Close()
+	defer canary.Close()
+	p := newProxyHandler(&Proxy{
+		BackendURL: stable.URL + "/v1",
+		CanaryRoutes: []CanaryRoute{
+			{PathPrefix: "/sensors", BackendURL: canary.URL + "/v2", Percent: 30},
+			{PathPrefix: "/", BackendURL: canary.URL + "/v2", Percent: 0},
+		},
+	})
+	get := func(a *net.UDPAddr, path string) string {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(path)
+		coapResp := p.handleRequest(a, m, nil)
+		if coapResp == nil {
+			t.Fatalf("no response to %v", path)
+		}
+		return string(coapResp.Payload)
+	}
+
+	canaryClients := 0
+	for port := 1; port <= 200; port++ {
+		a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}
+		response := get(a, "/sensors/temp")
+		switch response {
+		case "canary /v2/sensors/temp":
+			canaryClients++
+		case "stable /v1/sensors/temp":
+		default:
+			t.Fatalf("response is '%v'", response)
+		}
+		if again := get(a, "/sensors/humidity"); again[:6] != response[:6] {
+			t.Errorf("client %v went to '%v' then '%v'", a, response, again)
+		}
+		if other := get(a, "/config"); other != "stable /v1/config" {
+			t.Errorf("response outside the canary route is '%v'", other)
+		}
+	}
+	if canaryClients < 40 || canaryClients > 80 {
+		t.Errorf("%v clients of 200 went to the canary backend", canaryClients)
+	}
+}
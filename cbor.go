@@ -0,0 +1,419 @@
+package crosscoap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// This file implements the subset of CBOR (RFC 8949) needed to transcode
+// between CBOR and JSON payloads: every JSON value can be encoded, and
+// decoded CBOR items are converted following RFC 8949 section 6.1 (byte
+// strings become base64url strings, map keys become strings, tags are
+// dropped).
+
+const maxCBORNesting = 64
+
+var errInvalidCBOR = errors.New("invalid CBOR data")
+
+const (
+	cborUnsigned = 0 << 5
+	cborNegative = 1 << 5
+	cborBytes    = 2 << 5
+	cborText     = 3 << 5
+	cborArray    = 4 << 5
+	cborMap      = 5 << 5
+	cborTag      = 6 << 5
+	cborSimple   = 7 << 5
+
+	cborFalse      = cborSimple | 20
+	cborTrue       = cborSimple | 21
+	cborNull       = cborSimple | 22
+	cborUndefined  = cborSimple | 23
+	cborFloat16    = cborSimple | 25
+	cborFloat32    = cborSimple | 26
+	cborFloat64    = cborSimple | 27
+	cborBreak      = cborSimple | 31
+	cborIndefinite = 31
+)
+
+// cborToJSON converts a CBOR data item to its JSON representation.
+func cborToJSON(data []byte) ([]byte, error) {
+	value, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// decodeCBOR decodes a single CBOR data item to the generic values used by
+// encoding/json.
+func decodeCBOR(data []byte) (interface{}, error) {
+	d := cborDecoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errInvalidCBOR
+	}
+	return value, nil
+}
+
+// jsonToCBOR converts a JSON document to a CBOR data item.
+func jsonToCBOR(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	buf := getScratchBuffer()
+	defer putScratchBuffer(buf)
+	if err := encodeCBOR(buf, value); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errInvalidCBOR
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *cborDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errInvalidCBOR
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// readArgument reads the argument following an initial byte with the given
+// additional information.
+func (d *cborDecoder) readArgument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		b, err := d.readByte()
+		return uint64(b), err
+	case info == 25:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b), nil
+	}
+	return 0, errInvalidCBOR
+}
+
+func (d *cborDecoder) peekBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxCBORNesting {
+		return nil, errInvalidCBOR
+	}
+	initial, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := initial&0xe0, initial&0x1f
+	if major == cborSimple {
+		return d.decodeSimple(info)
+	}
+	if info == cborIndefinite {
+		return d.decodeIndefinite(major, depth)
+	}
+	arg, err := d.readArgument(info)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUnsigned:
+		return arg, nil
+	case cborNegative:
+		if arg > math.MaxInt64 {
+			return -1 - float64(arg), nil
+		}
+		return -1 - int64(arg), nil
+	case cborBytes:
+		b, err := d.readBytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case cborText:
+		b, err := d.readBytes(arg)
+		return string(b), err
+	case cborArray:
+		if arg > uint64(len(d.data)) {
+			return nil, errInvalidCBOR
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case cborMap:
+		if arg > uint64(len(d.data)) {
+			return nil, errInvalidCBOR
+		}
+		m := make(map[string]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			if err := d.decodeMapEntry(m, depth); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		return d.decode(depth + 1)
+	}
+	return nil, errInvalidCBOR
+}
+
+func (d *cborDecoder) decodeIndefinite(major byte, depth int) (interface{}, error) {
+	switch major {
+	case cborBytes, cborText:
+		var chunks bytes.Buffer
+		for !d.peekBreak() {
+			initial, err := d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if initial&0xe0 != major || initial&0x1f == cborIndefinite {
+				return nil, errInvalidCBOR
+			}
+			n, err := d.readArgument(initial & 0x1f)
+			if err != nil {
+				return nil, err
+			}
+			b, err := d.readBytes(n)
+			if err != nil {
+				return nil, err
+			}
+			chunks.Write(b)
+		}
+		if major == cborBytes {
+			return base64.RawURLEncoding.EncodeToString(chunks.Bytes()), nil
+		}
+		return chunks.String(), nil
+	case cborArray:
+		items := []interface{}{}
+		for !d.peekBreak() {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case cborMap:
+		m := map[string]interface{}{}
+		for !d.peekBreak() {
+			if err := d.decodeMapEntry(m, depth); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, errInvalidCBOR
+}
+
+func (d *cborDecoder) decodeMapEntry(m map[string]interface{}, depth int) error {
+	key, err := d.decode(depth + 1)
+	if err != nil {
+		return err
+	}
+	value, err := d.decode(depth + 1)
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case string:
+		m[k] = value
+	case uint64, int64, float64, bool, nil:
+		m[fmt.Sprint(k)] = value
+	default:
+		return errInvalidCBOR
+	}
+	return nil
+}
+
+func (d *cborDecoder) decodeSimple(info byte) (interface{}, error) {
+	switch cborSimple | info {
+	case cborFalse:
+		return false, nil
+	case cborTrue:
+		return true, nil
+	case cborNull, cborUndefined:
+		return nil, nil
+	case cborFloat16:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		return float16ToFloat64(binary.BigEndian.Uint16(b)), nil
+	case cborFloat32:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case cborFloat64:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	return nil, errInvalidCBOR
+}
+
+func float16ToFloat64(h uint16) float64 {
+	exponent := int(h>>10) & 0x1f
+	mantissa := float64(h & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 31:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if h&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(arg))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(arg))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, arg)
+	}
+}
+
+// encodeCBOR encodes a value produced by encoding/json (decoded with
+// UseNumber) or by cborDecoder.
+func encodeCBOR(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(cborNull)
+	case bool:
+		if v {
+			buf.WriteByte(cborTrue)
+		} else {
+			buf.WriteByte(cborFalse)
+		}
+	case string:
+		writeCBORHead(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case json.Number:
+		return encodeCBORNumber(buf, string(v))
+	case uint64:
+		writeCBORHead(buf, cborUnsigned, v)
+	case int64:
+		if v < 0 {
+			writeCBORHead(buf, cborNegative, uint64(-(v + 1)))
+		} else {
+			writeCBORHead(buf, cborUnsigned, uint64(v))
+		}
+	case float64:
+		buf.WriteByte(cborFloat64)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case []interface{}:
+		writeCBORHead(buf, cborArray, uint64(len(v)))
+		for _, item := range v {
+			if err := encodeCBOR(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeCBORHead(buf, cborMap, uint64(len(v)))
+		for _, key := range keys {
+			writeCBORHead(buf, cborText, uint64(len(key)))
+			buf.WriteString(key)
+			if err := encodeCBOR(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("can't encode %T as CBOR", value)
+	}
+	return nil
+}
+
+func encodeCBORNumber(buf *bytes.Buffer, number string) error {
+	if u, err := strconv.ParseUint(number, 10, 64); err == nil {
+		return encodeCBOR(buf, u)
+	}
+	if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return encodeCBOR(buf, i)
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return err
+	}
+	return encodeCBOR(buf, f)
+}
@@ -0,0 +1,82 @@
+package crosscoap
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCBORToJSON(t *testing.T) {
+	// Examples from RFC 8949 appendix A
+	tests := []struct {
+		cbor, json string
+	}{
+		{"00", `0`},
+		{"1903e8", `1000`},
+		{"3903e7", `-1000`},
+		{"f90001", `5.960464477539063e-8`},
+		{"fa47c35000", `100000`},
+		{"fb3ff199999999999a", `1.1`},
+		{"f4", `false`},
+		{"f6", `null`},
+		{"f7", `null`},
+		{"4401020304", `"AQIDBA"`},
+		{"6449455446", `"IETF"`},
+		{"c074323031332d30332d32315432303a30343a30305a", `"2013-03-21T20:04:00Z"`},
+		{"8301820203820405", `[1,[2,3],[4,5]]`},
+		{"a201020304", `{"1":2,"3":4}`},
+		{"a26161016162820203", `{"a":1,"b":[2,3]}`},
+		{"7f657374726561646d696e67ff", `"streaming"`},
+		{"9f018202039f0405ffff", `[1,[2,3],[4,5]]`},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.cbor)
+		json, err := cborToJSON(data)
+		if err != nil {
+			t.Errorf("cborToJSON(%v) failed: %v", test.cbor, err)
+			continue
+		}
+		if string(json) != test.json {
+			t.Errorf("cborToJSON(%v) is '%v'", test.cbor, string(json))
+		}
+	}
+}
+
+func TestCBORToJSONRejectsInvalidData(t *testing.T) {
+	for _, invalid := range []string{"", "18", "62ff", "a1", "0000", "9f01", "f97e00", "ff"} {
+		data, _ := hex.DecodeString(invalid)
+		if _, err := cborToJSON(data); err == nil {
+			t.Errorf("cborToJSON(%v) succeeded", invalid)
+		}
+	}
+}
+
+func TestJSONToCBOR(t *testing.T) {
+	tests := []struct {
+		json, cbor string
+	}{
+		{`0`, "00"},
+		{`1000000`, "1a000f4240"},
+		{`18446744073709551615`, "1bffffffffffffffff"},
+		{`-1000`, "3903e7"},
+		{`1.5`, "fb3ff8000000000000"},
+		{`true`, "f5"},
+		{`null`, "f6"},
+		{`"IETF"`, "6449455446"},
+		{`[1, [2, 3]]`, "8201820203"},
+		{`{"b": [2, 3], "a": 1}`, "a26161016162820203"},
+	}
+	for _, test := range tests {
+		data, err := jsonToCBOR([]byte(test.json))
+		if err != nil {
+			t.Errorf("jsonToCBOR(%v) failed: %v", test.json, err)
+			continue
+		}
+		if hex.EncodeToString(data) != test.cbor {
+			t.Errorf("jsonToCBOR(%v) is '%x'", test.json, data)
+		}
+	}
+	if _, err := jsonToCBOR([]byte(`{"a":`)); err == nil {
+		t.Error("Expected invalid JSON to be rejected")
+	}
+}
@@ -0,0 +1,151 @@
+package crosscoap
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ccm is the CCM mode of a 128-bit block cipher (RFC 3610), which package
+// crypto/cipher lacks, as needed by AES-CCM-16-64-128 in OSCORE.
+type ccm struct {
+	block     cipher.Block
+	nonceSize int
+	tagSize   int
+}
+
+var errCCMOpen = errors.New("CCM message authentication failed")
+
+// newCCM returns the CCM AEAD of block with the given nonce size (7 to 13
+// bytes) and tag size (an even number from 4 to 16 bytes).
+func newCCM(block cipher.Block, nonceSize, tagSize int) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 || nonceSize < 7 || nonceSize > 13 || tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, errors.New("invalid CCM parameters")
+	}
+	return &ccm{block: block, nonceSize: nonceSize, tagSize: tagSize}, nil
+}
+
+func (c *ccm) NonceSize() int {
+	return c.nonceSize
+}
+
+func (c *ccm) Overhead() int {
+	return c.tagSize
+}
+
+// maxLength is the length of the longest message for the nonce size.
+func (c *ccm) maxLength() uint64 {
+	lengthSize := 15 - c.nonceSize
+	if lengthSize >= 8 {
+		return 1<<63 - 1
+	}
+	return 1<<(8*uint(lengthSize)) - 1
+}
+
+// counter returns the counter block A_i.
+func (c *ccm) counter(nonce []byte, i uint64) []byte {
+	a := make([]byte, 16)
+	a[0] = byte(14 - c.nonceSize)
+	copy(a[1:], nonce)
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], i)
+	copy(a[1+c.nonceSize:], n[8-(15-c.nonceSize):])
+	return a
+}
+
+// mac returns the unencrypted authentication tag T of the plaintext and
+// additional data.
+func (c *ccm) mac(nonce, plaintext, additionalData []byte) []byte {
+	b := make([]byte, 16)
+	b[0] = byte((c.tagSize-2)/2<<3 | (14 - c.nonceSize))
+	if len(additionalData) > 0 {
+		b[0] |= 1 << 6
+	}
+	copy(b[1:], nonce)
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(plaintext)))
+	copy(b[1+c.nonceSize:], n[8-(15-c.nonceSize):])
+	x := make([]byte, 16)
+	c.block.Encrypt(x, b)
+
+	var data []byte
+	if len(additionalData) > 0 {
+		switch l := uint64(len(additionalData)); {
+		case l < 1<<16-1<<8:
+			data = append(data, byte(l>>8), byte(l))
+		case l <= 1<<32-1:
+			data = append(data, 0xff, 0xfe, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+		default:
+			data = append(data, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(data[2:], l)
+		}
+		data = append(data, additionalData...)
+		data = append(data, make([]byte, (16-len(data)%16)%16)...)
+	}
+	data = append(data, plaintext...)
+	data = append(data, make([]byte, (16-len(data)%16)%16)...)
+	for len(data) > 0 {
+		xorBytes(x, x, data[:16])
+		c.block.Encrypt(x, x)
+		data = data[16:]
+	}
+	return x[:c.tagSize]
+}
+
+// xorBytes sets dst[i] = x[i] ^ y[i] for the length of the shorter of x and
+// y, which it returns.
+func xorBytes(dst, x, y []byte) int {
+	n := len(x)
+	if len(y) < n {
+		n = len(y)
+	}
+	for i := 0; i < n; i++ {
+		dst[i] = x[i] ^ y[i]
+	}
+	return n
+}
+
+// crypt encrypts or decrypts src into dst with the key stream S_1, S_2, ...
+func (c *ccm) crypt(dst, src, nonce []byte) {
+	s := make([]byte, 16)
+	for i := uint64(1); len(src) > 0; i++ {
+		c.block.Encrypt(s, c.counter(nonce, i))
+		n := xorBytes(dst, src, s)
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// tagMask returns the first tagSize bytes of S_0, which encrypt the tag.
+func (c *ccm) tagMask(nonce []byte) []byte {
+	s := make([]byte, 16)
+	c.block.Encrypt(s, c.counter(nonce, 0))
+	return s[:c.tagSize]
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize || uint64(len(plaintext)) > c.maxLength() {
+		panic("crosscoap: invalid CCM nonce or plaintext length")
+	}
+	tag := c.mac(nonce, plaintext, additionalData)
+	xorBytes(tag, tag, c.tagMask(nonce))
+	out := make([]byte, len(plaintext)+c.tagSize)
+	c.crypt(out, plaintext, nonce)
+	copy(out[len(plaintext):], tag)
+	return append(dst, out...)
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize || len(ciphertext) < c.tagSize || uint64(len(ciphertext)-c.tagSize) > c.maxLength() {
+		return nil, errCCMOpen
+	}
+	sealed, tag := ciphertext[:len(ciphertext)-c.tagSize], ciphertext[len(ciphertext)-c.tagSize:]
+	plaintext := make([]byte, len(sealed))
+	c.crypt(plaintext, sealed, nonce)
+	expected := c.mac(nonce, plaintext, additionalData)
+	xorBytes(expected, expected, c.tagMask(nonce))
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, errCCMOpen
+	}
+	return append(dst, plaintext...), nil
+}
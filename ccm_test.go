@@ -0,0 +1,42 @@
+package crosscoap
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestCCM(t *testing.T) {
+	// Packet vectors #1 and #2 of RFC 3610 section 8
+	key, _ := hex.DecodeString("c0c1c2c3c4c5c6c7c8c9cacbcccdcecf")
+	block, _ := aes.NewCipher(key)
+	aead, err := newCCM(block, 13, 8)
+	if err != nil {
+		t.Fatalf("Error creating CCM: %v", err)
+	}
+	tests := []struct {
+		nonce, aad, plaintext, ciphertext string
+	}{
+		{"00000003020100a0a1a2a3a4a5", "0001020304050607", "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+			"588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0"},
+		{"00000004030201a0a1a2a3a4a5", "0001020304050607", "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3ba091d56e10400916"},
+	}
+	for _, test := range tests {
+		nonce, _ := hex.DecodeString(test.nonce)
+		aad, _ := hex.DecodeString(test.aad)
+		plaintext, _ := hex.DecodeString(test.plaintext)
+		ciphertext, _ := hex.DecodeString(test.ciphertext)
+		if sealed := aead.Seal(nil, nonce, plaintext, aad); !bytes.Equal(sealed, ciphertext) {
+			t.Errorf("sealed is '%x'; expected '%x'", sealed, ciphertext)
+		}
+		if opened, err := aead.Open(nil, nonce, ciphertext, aad); err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("opened is '%x' (error %v)", opened, err)
+		}
+		ciphertext[0]++
+		if _, err := aead.Open(nil, nonce, ciphertext, aad); err == nil {
+			t.Errorf("tampered ciphertext is opened")
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package crosscoap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// defaultClientTimeout is how long a Client waits for a response once its
+// request is acknowledged, or after sending a non-confirmable request.
+const defaultClientTimeout = 5 * time.Second
+
+var (
+	// ErrNoResponse is returned by Client.Do when no response arrived in
+	// time (the request or its response were lost).
+	ErrNoResponse = errors.New("no response")
+	// ErrReset is returned by Client.Do when the server rejected the
+	// request with a Reset message.
+	ErrReset = errors.New("request reset by server")
+)
+
+// ClientOption is a CoAP option of a request sent by a Client, or of its
+// response, by number, as it appears on the wire.
+type ClientOption struct {
+	ID    uint16
+	Value []byte
+}
+
+// ClientResponse is the response to a request sent by a Client.
+type ClientResponse struct {
+	// Message is the last response message, whose payload is the whole
+	// body once the Block2 blocks are gathered.
+	*coap.Message
+	// Options are all the options of the last response message, including
+	// those which go-coap doesn't know.
+	Options []ClientOption
+	// Messages is the number of response messages received: the blocks of
+	// a block-wise transfer, each block of an upload included.
+	Messages int
+	// Retransmissions is the number of confirmable messages sent again for
+	// want of acknowledgement.
+	Retransmissions int
+}
+
+// Client sends CoAP requests to a server over UDP and waits for their
+// responses, retransmitting confirmable messages (RFC 7252 section 4.2) and
+// carrying out block-wise transfers (RFC 7959).  It's meant for tools and
+// tests such as the bench and send commands, and handles one request at a
+// time.
+type Client struct {
+	// AckTimeout and MaxRetransmit are the retransmission parameters of
+	// confirmable messages, as for a Proxy.
+	AckTimeout    time.Duration
+	MaxRetransmit int
+	// Timeout is how long a response is waited for once the request is
+	// acknowledged, or after a non-confirmable request (by default 5
+	// seconds).
+	Timeout time.Duration
+	// Block1Size, if positive, is the block size (16 to 1024 bytes) in
+	// which request payloads larger than it are uploaded with Block1.
+	Block1Size int
+	// Block2Size, if positive, is the block size asked for the response
+	// with Block2.  Block-wise responses are gathered in any case.
+	Block2Size int
+
+	conn      *net.UDPConn
+	messageID uint16
+	buf       []byte
+}
+
+// SetPath sets the Uri-Path options of m to the segments of path, such as
+// /sensors/temp, and its Uri-Query options to the parameters of a query
+// following a "?", such as unit=c&n=5.  The root path, "/" or "", has no
+// segments.  Segments which the proxy would reject, "." and "..", and those
+// longer than an option are an error.
+func SetPath(m *coap.Message, path string) error {
+	query := ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	m.RemoveOption(coap.URIPath)
+	m.RemoveOption(coap.URIQuery)
+	if path = strings.Trim(path, "/"); path != "" {
+		segments := strings.Split(path, "/")
+		for _, segment := range segments {
+			if segment == "." || segment == ".." || len(segment) > 255 {
+				return fmt.Errorf("invalid path segment %q", segment)
+			}
+		}
+		m.SetPath(segments)
+	}
+	for _, q := range strings.Split(query, "&") {
+		if len(q) > 255 {
+			return fmt.Errorf("invalid query parameter %q", q)
+		}
+		if q != "" {
+			m.AddOption(coap.URIQuery, q)
+		}
+	}
+	return nil
+}
+
+// DialClient returns a client of the CoAP server at addr ("host:port").
+// The caller should call Close when finished.
+func DialClient(addr string) (*Client, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, messageID: uint16(mathrand.Intn(1 << 16)), buf: make([]byte, maxCOAPPacketLen)}, nil
+}
+
+// Close closes the socket of the client.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// LocalAddr returns the address of the socket of the client.
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Client) ackTimeout() time.Duration {
+	return (&Proxy{AckTimeout: c.AckTimeout}).ackTimeout()
+}
+
+func (c *Client) maxRetransmit() int {
+	return (&Proxy{MaxRetransmit: c.MaxRetransmit}).maxRetransmit()
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultClientTimeout
+}
+
+// Do sends the request m, along with extra options which go-coap can't
+// represent, and returns its response.  The message ID and token of m are
+// chosen by the client, for each message; m is confirmable unless its Type
+// is NonConfirmable.
+func (c *Client) Do(m coap.Message, extra ...ClientOption) (*ClientResponse, error) {
+	options := make([]rawOption, len(extra))
+	for i, o := range extra {
+		options[i] = rawOption(o)
+	}
+	if m.Type != coap.NonConfirmable {
+		m.Type = coap.Confirmable
+	}
+	resp := &ClientResponse{}
+	payload := m.Payload
+	var respMsg *coap.Message
+	var respOptions []rawOption
+	var err error
+	if c.Block1Size > 0 && len(payload) > c.Block1Size {
+		szx := blockSZX(c.Block1Size)
+		size := 1 << (szx + 4)
+		for num := 0; num*size < len(payload); num++ {
+			end := num*size + size
+			more := end < len(payload)
+			if !more {
+				end = len(payload)
+			}
+			block := blockOption{Num: uint32(num), More: more, SZX: szx}
+			blockOptions := append(append([]rawOption(nil), options...), block.option(optionBlock1))
+			if num == 0 {
+				blockOptions = append(blockOptions, uintOption(uint16(coap.Size1), uint32(len(payload))))
+			}
+			m.Payload = payload[num*size : end]
+			if respMsg, respOptions, err = c.exchange(m, blockOptions, resp); err != nil {
+				return nil, err
+			}
+			if more && respMsg.Code != codeContinue {
+				break // the server answered early, with an error for instance
+			}
+		}
+	} else {
+		if c.Block2Size > 0 {
+			options = append(options, blockOption{SZX: blockSZX(c.Block2Size)}.option(optionBlock2))
+		}
+		if respMsg, respOptions, err = c.exchange(m, options, resp); err != nil {
+			return nil, err
+		}
+	}
+
+	// Gather the blocks of the response
+	body := respMsg.Payload
+	for {
+		value, found := findOption(respOptions, optionBlock2)
+		if !found {
+			break
+		}
+		block, err := parseBlockOption(value)
+		if err != nil {
+			return nil, err
+		}
+		if !block.More {
+			break
+		}
+		next := blockOption{Num: block.Num + 1, SZX: block.SZX}
+		if block.offset()+len(respMsg.Payload) != next.offset() {
+			return nil, errors.New("inconsistent Block2 response")
+		}
+		m.Payload = nil
+		blockOptions := append(removeOption(options, optionBlock2), next.option(optionBlock2))
+		if respMsg, respOptions, err = c.exchange(m, blockOptions, resp); err != nil {
+			return nil, err
+		}
+		body = append(body, respMsg.Payload...)
+	}
+	respMsg.Payload = body
+	resp.Message = respMsg
+	for _, o := range respOptions {
+		resp.Options = append(resp.Options, ClientOption(o))
+	}
+	return resp, nil
+}
+
+// blockSZX returns the SZX of the largest block size up to size.
+func blockSZX(size int) uint8 {
+	szx := uint8(0)
+	for szx < 6 && 1<<(szx+5) <= size {
+		szx++
+	}
+	return szx
+}
+
+// exchange sends a message of the request m with options, a new message
+// ID and token, and waits for its response, counted in resp.
+func (c *Client) exchange(m coap.Message, options []rawOption, resp *ClientResponse) (*coap.Message, []rawOption, error) {
+	c.messageID++
+	m.MessageID = c.messageID
+	m.Token = make([]byte, 4)
+	if _, err := rand.Read(m.Token); err != nil {
+		return nil, nil, err
+	}
+	packet, err := marshalMessage(&m, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := c.conn.Write(packet); err != nil {
+		return nil, nil, err
+	}
+	acknowledged := m.Type != coap.Confirmable
+	timeout := c.timeout()
+	if !acknowledged {
+		timeout = c.ackTimeout() + time.Duration(mathrand.Float64()*(ackRandomFactor-1)*float64(c.ackTimeout()))
+	}
+	deadline := time.Now().Add(timeout)
+	retransmissions := 0
+	for {
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				return nil, nil, err
+			}
+			if acknowledged || retransmissions == c.maxRetransmit() {
+				return nil, nil, ErrNoResponse
+			}
+			retransmissions++
+			resp.Retransmissions++
+			timeout *= 2
+			deadline = time.Now().Add(timeout)
+			if _, err := c.conn.Write(packet); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		respMsg, respOptions, err := parsePacket(c.buf[:n])
+		if err != nil {
+			continue
+		}
+		sameExchange := respMsg.MessageID == m.MessageID && (respMsg.Type == coap.Acknowledgement || respMsg.Type == coap.Reset)
+		switch {
+		case sameExchange && respMsg.Type == coap.Reset:
+			return nil, nil, ErrReset
+		case sameExchange && respMsg.Code == 0:
+			// Empty ACK: the response comes separately
+			if !acknowledged {
+				acknowledged = true
+				deadline = time.Now().Add(c.timeout())
+			}
+			continue
+		case !sameExchange && (respMsg.Type == coap.Acknowledgement || respMsg.Type == coap.Reset):
+			continue // late, for an earlier message
+		case !bytes.Equal(respMsg.Token, m.Token) || respMsg.Code>>5 == 0:
+			continue
+		}
+		if respMsg.Type == coap.Confirmable {
+			ack := coap.Message{Type: coap.Acknowledgement, MessageID: respMsg.MessageID}
+			if data, err := ack.MarshalBinary(); err == nil {
+				c.conn.Write(data)
+			}
+		}
+		resp.Messages++
+		return respMsg, cloneOptions(respOptions), nil
+	}
+}
@@ -0,0 +1,137 @@
+package crosscoap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestClient(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789"), 300)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/large" {
+			w.Write(large)
+			return
+		}
+		w.Write(append([]byte(r.Method+" "), body...))
+	}))
+	defer backend.Close()
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, StreamBlock2: true, RespondToNonConfirmable: true}
+	go proxy.Serve()
+
+	c, err := DialClient(crosscoapAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := coap.Message{Code: coap.GET}
+	req.SetPathString("/small")
+	resp, err := c.Do(req)
+	if err != nil || resp.Code != coap.Content || resp.Type != coap.Acknowledgement || string(resp.Payload) != "GET " || resp.Messages != 1 {
+		t.Fatalf("response is %+v (error %v)", resp, err)
+	}
+	if format, ok := findOption(optionsOf(resp), uint16(coap.ContentFormat)); !ok || len(format) != 0 {
+		t.Errorf("response options are %v", resp.Options)
+	}
+
+	req.Type = coap.NonConfirmable
+	if resp, err := c.Do(req); err != nil || resp.Type != coap.NonConfirmable || string(resp.Payload) != "GET " {
+		t.Errorf("response to a NON request is %+v (error %v)", resp, err)
+	}
+
+	c.Block2Size = 64
+	req = coap.Message{Code: coap.GET}
+	req.SetPathString("/large")
+	if resp, err := c.Do(req); err != nil || !bytes.Equal(resp.Payload, large) || resp.Messages != len(large)/64+1 {
+		t.Errorf("Block2 response has %v messages (error %v)", resp.Messages, err)
+	}
+
+	c.Block1Size = 100
+	req = coap.Message{Code: coap.POST, Payload: large[:250]}
+	req.SetPathString("/upload")
+	if resp, err := c.Do(req); err != nil || string(resp.Payload) != "POST "+string(large[:250]) || resp.Messages != 4 {
+		t.Errorf("Block1 response is %+v (error %v)", resp, err)
+	}
+}
+
+func TestClientNoResponse(t *testing.T) {
+	silent, silentAddr := createLocalUDPListener(t)
+	defer silent.Close()
+	c, err := DialClient(silentAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.AckTimeout = 10 * time.Millisecond
+	c.MaxRetransmit = 2
+	req := coap.Message{Code: coap.GET}
+	req.SetPathString("/nothing")
+	if resp, err := c.Do(req); err != ErrNoResponse {
+		t.Errorf("response from a silent server is %+v (error %v)", resp, err)
+	}
+	packets := 0
+	silent.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		if _, _, err := silent.ReadFromUDP(make([]byte, maxCOAPPacketLen)); err != nil {
+			break
+		}
+		packets++
+	}
+	if packets != 3 {
+		t.Errorf("server got %v packets", packets)
+	}
+}
+
+func optionsOf(resp *ClientResponse) []rawOption {
+	options := make([]rawOption, len(resp.Options))
+	for i, o := range resp.Options {
+		options[i] = rawOption(o)
+	}
+	return options
+}
+
+func TestSetPath(t *testing.T) {
+	for _, tt := range []struct {
+		path          string
+		expectedPath  []string
+		expectedQuery []string
+	}{
+		{"", nil, nil},
+		{"/", nil, nil},
+		{"//sensors/temp/", []string{"sensors", "temp"}, nil},
+		{"sensors?unit=c&&n=5", []string{"sensors"}, []string{"unit=c", "n=5"}},
+		{"/?all", nil, []string{"all"}},
+	} {
+		m := coap.Message{Code: coap.GET}
+		m.SetPathString("/old")
+		if err := SetPath(&m, tt.path); err != nil {
+			t.Errorf("%q: error is %v", tt.path, err)
+		}
+		if path := m.Path(); !reflect.DeepEqual(path, tt.expectedPath) && (len(path) != 0 || len(tt.expectedPath) != 0) {
+			t.Errorf("%q: path is %q", tt.path, path)
+		}
+		var query []string
+		for _, q := range m.Options(coap.URIQuery) {
+			query = append(query, q.(string))
+		}
+		if !reflect.DeepEqual(query, tt.expectedQuery) {
+			t.Errorf("%q: query is %q", tt.path, query)
+		}
+	}
+	for _, path := range []string{"/a/../b", "./a", "/" + strings.Repeat("x", 256)} {
+		if err := SetPath(&coap.Message{}, path); err == nil {
+			t.Errorf("%q: no error", path)
+		}
+	}
+}
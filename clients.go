@@ -0,0 +1,124 @@
+package crosscoap
+
+import (
+	"container/list"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultMaxTrackedClients is the number of client endpoints whose
+// statistics are kept if MaxTrackedClients is zero.
+const defaultMaxTrackedClients = 10000
+
+// ClientStats are the statistics of a client endpoint (IP address and
+// port).
+type ClientStats struct {
+	Address  string    `json:"address"`
+	Requests uint64    `json:"requests"`
+	Errors   uint64    `json:"errors"` // invalid packets and 4.xx/5.xx responses
+	BytesIn  uint64    `json:"bytesIn"`
+	BytesOut uint64    `json:"bytesOut"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// clientStats collects the ClientStats of the most recently seen clients,
+// forgetting the least recently seen ones beyond max.
+type clientStats struct {
+	mu      sync.Mutex
+	max     int
+	clients map[string]*list.Element // of *ClientStats
+	recent  *list.List               // most recently seen first
+}
+
+func newClientStats(max int) *clientStats {
+	if max == 0 {
+		max = defaultMaxTrackedClients
+	}
+	return &clientStats{max: max, clients: make(map[string]*list.Element), recent: list.New()}
+}
+
+// received records a packet of size bytes from a, which is a request or
+// invalid.
+func (s *clientStats) received(a *net.UDPAddr, size int, request, invalid bool) {
+	if s.max < 0 {
+		return
+	}
+	key := a.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.clients[key]
+	if e == nil {
+		if s.recent.Len() >= s.max {
+			oldest := s.recent.Back()
+			delete(s.clients, oldest.Value.(*ClientStats).Address)
+			s.recent.Remove(oldest)
+		}
+		e = s.recent.PushFront(&ClientStats{Address: key})
+		s.clients[key] = e
+	} else {
+		s.recent.MoveToFront(e)
+	}
+	stats := e.Value.(*ClientStats)
+	stats.BytesIn += uint64(size)
+	stats.LastSeen = time.Now()
+	if request {
+		stats.Requests++
+	}
+	if invalid {
+		stats.Errors++
+	}
+}
+
+// update calls f with the statistics of a, if a is tracked.
+func (s *clientStats) update(a *net.UDPAddr, f func(stats *ClientStats)) {
+	if s.max < 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.clients[a.String()]; e != nil {
+		f(e.Value.(*ClientStats))
+	}
+}
+
+// failed records an error response to a.
+func (s *clientStats) failed(a *net.UDPAddr) {
+	s.update(a, func(stats *ClientStats) { stats.Errors++ })
+}
+
+// sent records a message of size bytes sent to a.
+func (s *clientStats) sent(a *net.UDPAddr, size int) {
+	s.update(a, func(stats *ClientStats) { stats.BytesOut += uint64(size) })
+}
+
+// snapshot returns a copy of the statistics of at most limit clients (all if
+// zero), ordered by the descending value of sortBy: "requests", "errors",
+// "bytes" (in and out) or "lastSeen".
+func (s *clientStats) snapshot(sortBy string, limit int) []ClientStats {
+	s.mu.Lock()
+	snapshot := make([]ClientStats, 0, s.recent.Len())
+	for e := s.recent.Front(); e != nil; e = e.Next() {
+		snapshot = append(snapshot, *e.Value.(*ClientStats))
+	}
+	s.mu.Unlock()
+	var less func(a, b *ClientStats) bool
+	switch sortBy {
+	case "errors":
+		less = func(a, b *ClientStats) bool { return a.Errors > b.Errors }
+	case "bytes":
+		less = func(a, b *ClientStats) bool { return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut }
+	case "lastSeen":
+		// Already in this order
+	default:
+		less = func(a, b *ClientStats) bool { return a.Requests > b.Requests }
+	}
+	if less != nil {
+		sort.SliceStable(snapshot, func(i, j int) bool { return less(&snapshot[i], &snapshot[j]) })
+	}
+	if limit > 0 && len(snapshot) > limit {
+		snapshot = snapshot[:limit]
+	}
+	return snapshot
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-coap"
+	"github.com/ibm-security-innovation/crosscoap"
+)
+
+// benchRequest is a kind of request in the mix sent by the bench command.
+type benchRequest struct {
+	name   string // such as CON:GET
+	typ    coap.COAPType
+	code   coap.COAPCode
+	weight int
+}
+
+// parseBenchMix parses a comma-separated list of TYPE:METHOD=WEIGHT.
+func parseBenchMix(s string) ([]benchRequest, error) {
+	var mix []benchRequest
+	for _, item := range splitList(s) {
+		kv := strings.SplitN(item, "=", 2)
+		weight := 1
+		if len(kv) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(kv[1]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in %q", item)
+			}
+		}
+		parts := strings.SplitN(strings.ToUpper(kv[0]), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid request kind %q", item)
+		}
+		r := benchRequest{name: parts[0] + ":" + parts[1], weight: weight}
+		switch parts[0] {
+		case "CON":
+			r.typ = coap.Confirmable
+		case "NON":
+			r.typ = coap.NonConfirmable
+		default:
+			return nil, fmt.Errorf("invalid message type in %q", item)
+		}
+		code, found := coapMethods[parts[1]]
+		if !found {
+			return nil, fmt.Errorf("invalid method in %q", item)
+		}
+		r.code = code
+		if weight > 0 {
+			mix = append(mix, r)
+		}
+	}
+	if len(mix) == 0 {
+		return nil, errors.New("empty request mix")
+	}
+	return mix, nil
+}
+
+// benchResult is the outcome of a request sent by the bench command.
+type benchResult struct {
+	kind            string
+	latency         time.Duration
+	code            coap.COAPCode
+	err             error
+	retransmissions int
+}
+
+// runBench is the bench command: it sends a mix of requests to a CoAP
+// server from concurrent clients and reports their latency and loss.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("crosscoap bench", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:5683", "Address of the CoAP server under test")
+	requests := fs.Int("n", 1000, "Number of requests to send (ignored with -duration)")
+	duration := fs.Duration("duration", 0, "Time during which requests are sent (default is until -n requests)")
+	concurrency := fs.Int("c", 10, "Number of concurrent clients, each with its own UDP socket")
+	rate := fs.Float64("rate", 0, "Maximum number of requests per second across clients (default is no limit)")
+	mixSpec := fs.String("mix", "CON:GET", "Comma-separated mix of requests 'CON|NON:METHOD[=WEIGHT]', e.g. 'CON:GET=80,NON:POST=20'")
+	path := fs.String("path", "", "Path of the requests, with an optional query (default is the root)")
+	payload := fs.String("payload", "", "Payload of POST, PUT, FETCH, PATCH and IPATCH requests")
+	payloadSize := fs.Int("payloadsize", 0, "Size of a generated payload of requests with a payload, instead of -payload")
+	contentFormat := fs.Int("contentformat", -1, "Content-Format of request payloads (default is none)")
+	block1 := fs.Int("block1", 0, "Block size (16 to 1024) in which larger payloads are uploaded with Block1 (default is single messages)")
+	block2 := fs.Int("block2", 0, "Block size (16 to 1024) asked for the responses with Block2 (default is the server's choice)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for a response once a request is acknowledged or after a NON request, after which it's counted as lost")
+	ackTimeout := fs.Duration("acktimeout", 2*time.Second, "Initial retransmission timeout of CON messages")
+	maxRetransmit := fs.Int("maxretransmit", 4, "Maximum number of retransmissions of CON messages")
+	fs.Parse(args)
+
+	mix, err := parseBenchMix(*mixSpec)
+	if err != nil {
+		return err
+	}
+	if err := crosscoap.SetPath(&coap.Message{}, *path); err != nil {
+		return fmt.Errorf("invalid -path %q: %v", *path, err)
+	}
+	body := []byte(*payload)
+	if *payloadSize > 0 {
+		body = bytes.Repeat([]byte("x"), *payloadSize)
+	}
+	totalWeight := 0
+	for _, r := range mix {
+		totalWeight += r.weight
+	}
+
+	// Requests are handed out by a shared counter, or until the deadline
+	var sent int64
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
+	}
+	var throttle <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	next := func() bool {
+		if deadline.IsZero() {
+			if atomic.AddInt64(&sent, 1) > int64(*requests) {
+				return false
+			}
+		} else if time.Now().After(deadline) {
+			return false
+		}
+		if throttle != nil {
+			<-throttle
+		}
+		return deadline.IsZero() || time.Now().Before(deadline)
+	}
+
+	results := make(chan benchResult, 1024)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		c, err := crosscoap.DialClient(*target)
+		if err != nil {
+			return err
+		}
+		c.Timeout, c.AckTimeout, c.MaxRetransmit = *timeout, *ackTimeout, *maxRetransmit
+		if *maxRetransmit == 0 {
+			c.MaxRetransmit = -1
+		}
+		c.Block1Size, c.Block2Size = *block1, *block2
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			defer c.Close()
+			random := rand.New(rand.NewSource(seed))
+			for next() {
+				r := mix[len(mix)-1]
+				for n, i := random.Intn(totalWeight), 0; i < len(mix); i++ {
+					if n < mix[i].weight {
+						r = mix[i]
+						break
+					}
+					n -= mix[i].weight
+				}
+				m := coap.Message{Type: r.typ, Code: r.code}
+				crosscoap.SetPath(&m, *path) // checked above
+				if r.code != coap.GET && r.code != coap.DELETE {
+					m.Payload = body
+					if *contentFormat >= 0 {
+						m.SetOption(coap.ContentFormat, coap.MediaType(*contentFormat))
+					}
+				}
+				start := time.Now()
+				resp, err := c.Do(m)
+				result := benchResult{kind: r.name, latency: time.Since(start), err: err}
+				if resp != nil {
+					result.code, result.retransmissions = resp.Code, resp.Retransmissions
+				}
+				results <- result
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	report := newBenchReport()
+	for result := range results {
+		report.add(result)
+	}
+	report.print(os.Stdout, time.Since(start))
+	return nil
+}
+
+// benchReport accumulates the results of the bench command.
+type benchReport struct {
+	latencies       map[string][]time.Duration // of answered requests, by kind
+	lost            map[string]int
+	failed          map[string]int
+	codes           map[string]int
+	retransmissions int
+}
+
+func newBenchReport() *benchReport {
+	return &benchReport{
+		latencies: make(map[string][]time.Duration),
+		lost:      make(map[string]int),
+		failed:    make(map[string]int),
+		codes:     make(map[string]int),
+	}
+}
+
+func (r *benchReport) add(result benchResult) {
+	switch {
+	case result.err == crosscoap.ErrNoResponse:
+		r.lost[result.kind]++
+	case result.err != nil:
+		r.failed[result.kind]++
+	default:
+		r.latencies[result.kind] = append(r.latencies[result.kind], result.latency)
+		r.codes[fmt.Sprintf("%d.%02d", result.code>>5, result.code&0x1f)]++
+		r.retransmissions += result.retransmissions
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(latencies)) + 0.5)
+	if i > 0 {
+		i--
+	}
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+func (r *benchReport) print(w io.Writer, elapsed time.Duration) {
+	kinds := make(map[string]bool)
+	for _, m := range []map[string]int{r.lost, r.failed} {
+		for kind := range m {
+			kinds[kind] = true
+		}
+	}
+	for kind := range r.latencies {
+		kinds[kind] = true
+	}
+	var names []string
+	for kind := range kinds {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+
+	var all []time.Duration
+	total, totalLost, totalFailed := 0, 0, 0
+	fmt.Fprintf(w, "%-10s %8s %8s %8s %10s %10s %10s %10s %10s\n", "REQUEST", "SENT", "LOST", "ERRORS", "P50", "P90", "P99", "P99.9", "MAX")
+	line := func(name string, latencies []time.Duration, lost, failed int) {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		sent := len(latencies) + lost + failed
+		fmt.Fprintf(w, "%-10s %8d %7.2f%% %8d %10v %10v %10v %10v %10v\n", name, sent, 100*float64(lost)/float64(sent), failed,
+			roundLatency(percentile(latencies, 50)), roundLatency(percentile(latencies, 90)), roundLatency(percentile(latencies, 99)),
+			roundLatency(percentile(latencies, 99.9)), roundLatency(percentile(latencies, 100)))
+	}
+	for _, name := range names {
+		line(name, r.latencies[name], r.lost[name], r.failed[name])
+		all = append(all, r.latencies[name]...)
+		total += len(r.latencies[name]) + r.lost[name] + r.failed[name]
+		totalLost += r.lost[name]
+		totalFailed += r.failed[name]
+	}
+	if len(names) > 1 {
+		line("ALL", all, totalLost, totalFailed)
+	}
+
+	var codes []string
+	for code, n := range r.codes {
+		codes = append(codes, fmt.Sprintf("%v=%v", code, n))
+	}
+	sort.Strings(codes)
+	fmt.Fprintf(w, "\n%v requests in %v (%.1f/s), %v retransmissions\nResponse codes: %v\n",
+		total, roundLatency(elapsed), float64(total)/elapsed.Seconds(), r.retransmissions, strings.Join(codes, " "))
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
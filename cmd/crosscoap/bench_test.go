@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ibm-security-innovation/crosscoap/crosscoaptest"
+)
+
+// captureStdout returns what run writes to the standard output, and its
+// error.
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		output <- b
+	}()
+	err = run()
+	w.Close()
+	return string(<-output), err
+}
+
+func TestRunBench(t *testing.T) {
+	s := crosscoaptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+	for _, tt := range []struct {
+		args         []string
+		expectedPath string
+	}{
+		{nil, "/"},
+		{[]string{"-path", "/telemetry/temp?unit=c", "-mix", "CON:GET,CON:POST"}, "/telemetry/temp"},
+	} {
+		output, err := captureStdout(t, func() error {
+			return runBench(append([]string{"-target", s.Addr, "-n", "10", "-c", "2"}, tt.args...))
+		})
+		if err != nil {
+			t.Fatalf("%q: error is %v", tt.args, err)
+		}
+		if !strings.Contains(output, "10 requests in") || !strings.Contains(output, "Response codes: 2.") {
+			t.Errorf("%q: output is %v", tt.args, output)
+		}
+		if r := s.LastRequest(); r == nil || r.URL.Path != tt.expectedPath {
+			t.Errorf("%q: last backend request is %v", tt.args, r)
+		}
+	}
+	if _, err := captureStdout(t, func() error {
+		return runBench([]string{"-target", s.Addr, "-path", "/a/../b"})
+	}); err == nil {
+		t.Errorf("bench with a dot segment in its path succeeded")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfig sets the flags not given on the command line from the TOML
+// configuration file name, whose keys are flag names; repeatable flags take
+// an array of strings.  The only tables supported are the per-route
+// overrides [route."PATH_PREFIX"], whose keys are those of -route.  Other
+// TOML tables, inline tables and arrays of tables aren't supported.
+func loadConfig(fs *flag.FlagSet, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	values, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, kv := range values {
+		if fs.Lookup(kv.key) == nil || kv.key == "config" {
+			return fmt.Errorf("%v:%v: unknown setting %q", name, kv.line, kv.key)
+		}
+		if set[kv.key] {
+			continue
+		}
+		for _, value := range kv.values {
+			if err := fs.Set(kv.key, value); err != nil {
+				return fmt.Errorf("%v:%v: invalid value %q of %v: %v", name, kv.line, value, kv.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue is a setting of a configuration file.
+type configValue struct {
+	key    string
+	values []string // several for an array
+	line   int
+}
+
+func parseConfig(r io.Reader) ([]configValue, error) {
+	var values []configValue
+	seen := make(map[string]bool)
+	var table *routeTable
+	endTable := func() {
+		if table != nil {
+			values = append(values, table.value())
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			prefix, err := parseRouteTableHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", lineNumber, err)
+			}
+			endTable()
+			table = &routeTable{prefix: prefix, line: lineNumber}
+			seen = make(map[string]bool)
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %v: expected 'key = value'", lineNumber)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			key = unquoted
+		}
+		if key == "" || seen[key] {
+			return nil, fmt.Errorf("line %v: empty or duplicate key %q", lineNumber, key)
+		}
+		seen[key] = true
+		value := strings.TrimSpace(line[eq+1:])
+		start := lineNumber
+		// Arrays may span several lines
+		for strings.HasPrefix(value, "[") && !arrayClosed(value) && scanner.Scan() {
+			lineNumber++
+			value += "\n" + strings.TrimSpace(scanner.Text())
+		}
+		parsed, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", start, err)
+		}
+		if table != nil {
+			if len(parsed) != 1 {
+				return nil, fmt.Errorf("line %v: route settings take a single value", start)
+			}
+			table.settings = append(table.settings, key+":"+parsed[0])
+			continue
+		}
+		values = append(values, configValue{key, parsed, start})
+	}
+	endTable()
+	return values, scanner.Err()
+}
+
+// routeTable is a [route."PATH_PREFIX"] table of a configuration file.
+type routeTable struct {
+	prefix   string
+	settings []string // KEY:VALUE
+	line     int
+}
+
+// value returns the table as a -route setting.
+func (t *routeTable) value() configValue {
+	return configValue{"route", []string{t.prefix + "=" + strings.Join(t.settings, ",")}, t.line}
+}
+
+// parseRouteTableHeader returns the path prefix of the table header
+// [route."PATH_PREFIX"].
+func parseRouteTableHeader(line string) (string, error) {
+	if !strings.HasPrefix(line, "[route.") {
+		return "", fmt.Errorf("unsupported table %v", line)
+	}
+	header := strings.TrimSpace(line[len("[route."):])
+	if !strings.HasPrefix(header, `"`) && !strings.HasPrefix(header, "'") {
+		return "", fmt.Errorf("route path prefix must be quoted")
+	}
+	prefix, rest, err := parseScalar(header)
+	if err != nil {
+		return "", err
+	}
+	rest = strings.TrimSpace(rest)
+	if !strings.HasPrefix(rest, "]") || stripComment(rest[1:]) != "" {
+		return "", fmt.Errorf("invalid table header %v", line)
+	}
+	return prefix, nil
+}
+
+var errUnterminatedArray = errors.New("unterminated array")
+
+// arrayClosed reports whether the array value is complete (or invalid).
+func arrayClosed(value string) bool {
+	_, _, err := parseArray(value)
+	return err != errUnterminatedArray
+}
+
+func parseConfigValue(value string) ([]string, error) {
+	if strings.HasPrefix(value, "[") {
+		values, rest, err := parseArray(value)
+		if err != nil {
+			return nil, err
+		}
+		if rest = stripComment(rest); rest != "" {
+			return nil, fmt.Errorf("unexpected %q after array", rest)
+		}
+		return values, nil
+	}
+	s, rest, err := parseScalar(value)
+	if err != nil {
+		return nil, err
+	}
+	if rest = stripComment(rest); rest != "" {
+		return nil, fmt.Errorf("unexpected %q after value", rest)
+	}
+	return []string{s}, nil
+}
+
+func stripComment(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "#") {
+		return ""
+	}
+	return s
+}
+
+// parseArray parses an array of scalars at the start of s, returning the
+// rest of s.
+func parseArray(s string) ([]string, string, error) {
+	s = s[1:]
+	values := []string{}
+	for {
+		s = skipArraySpace(s)
+		if s == "" {
+			return nil, "", errUnterminatedArray
+		}
+		if s[0] == ']' {
+			return values, s[1:], nil
+		}
+		value, rest, err := parseScalar(s)
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, value)
+		s = skipArraySpace(rest)
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "]") {
+			if s == "" {
+				return nil, "", errUnterminatedArray
+			}
+			return nil, "", fmt.Errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// skipArraySpace skips white space, newlines and comments in an array.
+func skipArraySpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i:]
+		} else {
+			return ""
+		}
+	}
+}
+
+// parseScalar parses a string, number or boolean at the start of s,
+// returning it as flag text and the rest of s.
+func parseScalar(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %v", s[:i+1])
+				}
+				return value, s[i+1:], nil
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		if end := strings.IndexByte(s[1:], '\''); end >= 0 {
+			return s[1 : end+1], s[end+2:], nil
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	}
+	end := strings.IndexAny(s, " \t\r\n,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	value := s[:end]
+	if value == "true" || value == "false" {
+		return value, s[end:], nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(value, "_", "", -1), 64); err == nil {
+		return strings.Replace(value, "_", "", -1), s[end:], nil
+	}
+	return "", "", fmt.Errorf("invalid value %q (strings must be quoted)", value)
+}
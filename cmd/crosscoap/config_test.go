@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	const config = `# crosscoap configuration
+backend = "http://127.0.0.1:8000/api"
+timeout = '10s'   # backend timeout
+nstart = 2
+respondnon = true
+"ratelimit" = 1_000
+header = [
+  "X-Gateway-ID: gw-7",  # the gateway
+  "X-Region: eu",
+]
+allowclients = []
+
+[route."/firmware"]
+timeout = "5m"
+maxbody = 1048576
+
+[route.'/telemetry'] # quiet
+accesslog = false
+`
+	values, err := parseConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("Error parsing configuration: %v", err)
+	}
+	expected := []configValue{
+		{"backend", []string{"http://127.0.0.1:8000/api"}, 2},
+		{"timeout", []string{"10s"}, 3},
+		{"nstart", []string{"2"}, 4},
+		{"respondnon", []string{"true"}, 5},
+		{"ratelimit", []string{"1000"}, 6},
+		{"header", []string{"X-Gateway-ID: gw-7", "X-Region: eu"}, 7},
+		{"allowclients", []string{}, 11},
+		{"route", []string{"/firmware=timeout:5m,maxbody:1048576"}, 13},
+		{"route", []string{"/telemetry=accesslog:false"}, 17},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("values are '%v'", values)
+	}
+}
+
+func TestParseInvalidConfig(t *testing.T) {
+	for _, tt := range []struct {
+		config   string
+		expected string
+	}{
+		{"backend", "line 1: expected 'key = value'"},
+		{"nstart = 1\nnstart = 2", "line 2: empty or duplicate key \"nstart\""},
+		{" = 1", "line 1: empty or duplicate key \"\""},
+		{"header = [\n\"a: b\",\n", "line 1: unterminated array"},
+		{"header = [\"a\" \"b\"]", "line 1: expected ',' or ']' in array"},
+		{"header = [\"a\"] x", "line 1: unexpected \"x\" after array"},
+		{"backend = http://x", "line 1: invalid value \"http://x\" (strings must be quoted)"},
+		{"backend = \"http://x", "line 1: unterminated string"},
+		{"[tenant.\"a\"]", "line 1: unsupported table [tenant.\"a\"]"},
+		{"[route./fw]", "line 1: route path prefix must be quoted"},
+		{"[route.\"/fw\"] x", "line 1: invalid table header [route.\"/fw\"] x"},
+		{"[route.\"/fw\"]\ntimeout = [\"1s\", \"2s\"]", "line 2: route settings take a single value"},
+	} {
+		if _, err := parseConfig(strings.NewReader(tt.config)); err == nil || err.Error() != tt.expected {
+			t.Errorf("%q: error is '%v'", tt.config, err)
+		}
+	}
+	// Keys may repeat in different tables
+	if _, err := parseConfig(strings.NewReader("[route.\"/a\"]\ntimeout = \"1s\"\n[route.\"/b\"]\ntimeout = \"2s\"")); err != nil {
+		t.Errorf("Error parsing route tables: %v", err)
+	}
+}
+
+func TestParseScalar(t *testing.T) {
+	for _, tt := range []struct {
+		s        string
+		expected string
+		rest     string
+	}{
+		{`"a \"b\"\tc" # comment`, "a \"b\"\tc", " # comment"},
+		{`'C:\path' x`, `C:\path`, " x"},
+		{"42, 43]", "42", ", 43]"},
+		{"-1.5", "-1.5", ""},
+		{"1_000_000", "1000000", ""},
+		{"false]", "false", "]"},
+	} {
+		value, rest, err := parseScalar(tt.s)
+		if err != nil || value != tt.expected || rest != tt.rest {
+			t.Errorf("%q: value is '%v', rest '%v' (error %v)", tt.s, value, rest, err)
+		}
+	}
+	for _, s := range []string{`"abc`, "'abc", "abc", `"\q"`, "yes"} {
+		if _, _, err := parseScalar(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestParseArray(t *testing.T) {
+	for _, tt := range []struct {
+		s        string
+		expected []string
+		rest     string
+	}{
+		{`["a", 'b', 3] # x`, []string{"a", "b", "3"}, " # x"},
+		{"[\n  \"a\", # first\n  # none\n  \"b\",\n]", []string{"a", "b"}, ""},
+		{"[ ]", []string{}, ""},
+	} {
+		values, rest, err := parseArray(tt.s)
+		if err != nil || !reflect.DeepEqual(values, tt.expected) || rest != tt.rest {
+			t.Errorf("%q: values are '%v', rest '%v' (error %v)", tt.s, values, rest, err)
+		}
+	}
+	for _, s := range []string{`["a",`, `["a"`, "[ # ]", `["a" "b"]`, `[abc]`} {
+		if _, _, err := parseArray(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	if _, _, err := parseArray(`["a", "b"`); err != errUnterminatedArray {
+		t.Errorf("unterminated array error is '%v'", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "crosscoap.toml")
+	config := `backend = "http://127.0.0.1:8000/api"
+timeout = "10s"
+header = ["X-A: 1", "X-B: 2"]
+
+[route."/firmware"]
+timeout = "5m"
+`
+	if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("crosscoap", flag.ContinueOnError)
+	backend := fs.String("backend", "", "")
+	timeout := fs.Duration("timeout", 5*time.Second, "")
+	var headers, routes stringList
+	fs.Var(&headers, "header", "")
+	fs.Var(&routes, "route", "")
+	fs.String("config", "", "")
+	if err := fs.Parse([]string{"-timeout", "1s", "-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, file); err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	// The command line overrides the file
+	if *backend != "http://127.0.0.1:8000/api" || *timeout != time.Second {
+		t.Errorf("backend is '%v', timeout '%v'", *backend, *timeout)
+	}
+	if !reflect.DeepEqual(headers, stringList{"X-A: 1", "X-B: 2"}) || !reflect.DeepEqual(routes, stringList{"/firmware=timeout:5m"}) {
+		t.Errorf("headers are '%v', routes '%v'", headers, routes)
+	}
+
+	for _, tt := range []struct {
+		config   string
+		expected string
+	}{
+		{"backendurl = \"x\"", ":1: unknown setting \"backendurl\""},
+		{"config = \"other.toml\"", ":1: unknown setting \"config\""},
+		{"\n\ntimeout = \"soon\"", ":3: invalid value \"soon\" of timeout"},
+		{"header = [", ": line 1: unterminated array"},
+	} {
+		if err := ioutil.WriteFile(file, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fs := flag.NewFlagSet("crosscoap", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.Duration("timeout", 0, "")
+		fs.Var(&stringList{}, "header", "")
+		if err := loadConfig(fs, file); err == nil || !strings.HasPrefix(err.Error(), file+tt.expected) {
+			t.Errorf("%q: error is '%v'", tt.config, err)
+		}
+	}
+	if err := loadConfig(flag.NewFlagSet("crosscoap", flag.ContinueOnError), filepath.Join(t.TempDir(), "none.toml")); err == nil {
+		t.Errorf("loading a missing file succeeded")
+	}
+}
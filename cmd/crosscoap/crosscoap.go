@@ -1,70 +1,1569 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/dustin/go-coap"
 	"github.com/ibm-security-innovation/crosscoap"
 )
 
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 var (
-	listenAddr    = flag.String("listen", "0.0.0.0:5683", "CoAP listen address and port")
-	backendURL    = flag.String("backend", "", "Backend HTTP server URL")
-	errorLogName  = flag.String("errorlog", "", "Error log file name (default is stderr)")
-	accessLogName = flag.String("accesslog", "", "Access log file name (default is no log)")
+	showVersion    = flag.Bool("version", false, "Print the version of crosscoap and exit")
+	configFile     = flag.String("config", "", "TOML file setting flags by name, repeatable flags as arrays of strings; command-line flags override it")
+	listenAddr     = flag.String("listen", "0.0.0.0:5683", "Comma-separated CoAP listen addresses and ports, e.g. '0.0.0.0:5683,[::]:5683' or '[::%eth0]:5683' for the IPv6 addresses of an interface, all served by the same proxy")
+	listeners      = flag.Int("listeners", 1, "Number of UDP sockets bound to the listen address with SO_REUSEPORT, each with its own read loop (Linux only)")
+	backendURL     = flag.String("backend", "", "Backend HTTP server URL")
+	errorLogName   = flag.String("errorlog", "", "Error log file name, or syslog sink 'syslog:', 'syslog+udp://HOST:PORT' or 'syslog+tcp://HOST:PORT' (default is stderr)")
+	accessLogName  = flag.String("accesslog", "", "Access log file name, or syslog sink 'syslog:', 'syslog+udp://HOST:PORT' or 'syslog+tcp://HOST:PORT' (default is no log)")
+	auditLogName   = flag.String("auditlog", "", "Audit log file name, or syslog sink, recording the full context of the requests answered with a 4.xx or 5.xx response (default is no log)")
+	accessFormat   = flag.String("accesslogformat", "", "Format of the access log line written once each request is answered, with tokens %client, %method, %path, %code, %status, %bytes, %latency_ms, %truncated and %tenant (default is a line when each request arrives)")
+	awsRegion      = flag.String("awsregion", "", "Sign backend requests with AWS SigV4 for this region (credentials are read from the environment)")
+	awsService     = flag.String("awsservice", "execute-api", "AWS service name used for SigV4 signing")
+	hmacKey        = flag.String("hmackey", "", "Sign backend requests with an HMAC-SHA256 of this key (default is the HMAC_KEY environment variable)")
+	hmacKeyID      = flag.String("hmackeyid", "", "Name of the -hmackey, given as {keyid} in -hmacformat")
+	hmacHeader     = flag.String("hmacheader", "X-Crosscoap-Signature", "Header of the HMAC signature of backend requests")
+	hmacFormat     = flag.String("hmacformat", "t={timestamp},v1={signature}", "Value of -hmacheader, with {signature} (hex), {signature64} (base64), {timestamp} and {keyid}")
+	aclDefault     = flag.String("acldefault", "allow", "Access policy for requests matching no -acl rule (allow or deny)")
+	aclRules       stringList
+	principals     stringList
+	requireAuth    = flag.Bool("requireauth", false, "Answer the requests authenticated by neither -principal nor -jwtparam with 4.01 Unauthorized")
+	principalHdr   = flag.String("principalheader", "", "Header telling the backend the principal of the authenticated requests, e.g. X-Principal (default is none)")
+	jwtParam       = flag.String("jwtparam", "", "Authenticate the clients by a JSON Web Token in this query parameter, e.g. token, which isn't forwarded (default is none)")
+	jwtSecret      = flag.String("jwtsecret", "", "Key of the HS256 -jwtparam tokens (default is the JWT_SECRET environment variable)")
+	jwtKey         = flag.String("jwtkey", "", "PEM file of the RSA or P-256 public key of the RS256 or ES256 -jwtparam tokens")
+	jwtIssuer      = flag.String("jwtissuer", "", "Issuer (iss claim) required of the -jwtparam tokens")
+	jwtAudience    = flag.String("jwtaudience", "", "Audience (aud claim) required of the -jwtparam tokens")
+	formats        stringList
+	optionHeaders  stringList
+	forwardHeaders stringList
+	discoveryLinks stringList
+	staticRoutes   stringList
+	rewriteRules   stringList
+	queryRules     stringList
+	headers        stringList
+	routeTimeouts  stringList
+	routeConfigs   stringList
+	inflatePaths   stringList
+	nonDedups      stringList
+	routeSLOs      stringList
+	routeOversize  stringList
+	routeCache     stringList
+	prefetch       stringList
+	canaryRoutes   stringList
+	backendWeights stringList
+	routeBackends  stringList
+	failovers      stringList
+	tenants        stringList
+	oscoreContexts stringList
+	allowClients   = flag.String("allowclients", "", "Comma-separated CIDR networks of clients allowed to use the proxy (default is all)")
+	denyClients    = flag.String("denyclients", "", "Comma-separated CIDR networks of clients refused by the proxy")
+	rejectDenied   = flag.Bool("rejectdenied", false, "Answer denied clients with 4.03 Forbidden instead of ignoring them")
+	verifyClients  = flag.Bool("verifyclients", false, "Forward requests only once the client echoes an Echo option, against spoofed requests and traffic amplification")
+	amplification  = flag.Int("amplification", 0, "Cap the bytes sent to each unverified client endpoint to N times the bytes received from it, until it echoes an Echo option (default is no cap)")
+	maxBodyBytes   = flag.Int("maxrequestbody", 0, "Maximum CoAP request payload size in bytes (default is no limit)")
+	streamBlock1   = flag.Bool("streamblock1", false, "Stream Block1 uploads to the backend as their blocks arrive instead of reassembling them first")
+	streamBlock2   = flag.Bool("streamblock2", false, "Serve responses larger than a packet with Block2, streaming the backend body, instead of truncating them")
+	oversize       = flag.String("oversize", "truncate", "What to do with responses larger than a packet: 'truncate', 'block2' (serve them with Block2), 'compress' (deflate JSON, then truncate) or 'reject' (4.13 with Size2, unless the request asks for Block2)")
+	oscoreFile     = flag.String("oscorecontextfile", "", "File of OSCORE security contexts, one per line as in -oscorecontext, read again when it changes")
+	oscoreReload   = flag.Duration("oscorereload", 10*time.Second, "Interval at which -oscorecontextfile is checked for changes")
+	oscoreBackend  = flag.String("oscorebackend", "", "URL of a backend terminating OSCORE, to which OSCORE requests are forwarded unchanged (default is to reject them)")
+	diagnostics    = flag.Bool("diagnostics", false, "Include a human-readable reason in 4.xx/5.xx responses generated by the proxy")
+	strictFormat   = flag.Bool("strictcontentformat", false, "Answer requests with an unknown Content-Format with 4.15 Unsupported Content-Format")
+	defaultType    = flag.String("defaultcontenttype", "", "HTTP Content-Type for requests with an unknown Content-Format (default is none)")
+	transcodeCBOR  = flag.Bool("transcodecbor", false, "Convert CBOR request payloads to JSON, and JSON responses to CBOR for clients accepting CBOR")
+	transcode      = flag.Bool("transcode", false, "Convert JSON responses to CBOR or plain text when the request's Accept option asks for them")
+	openAPI        = flag.String("openapi", "", "OpenAPI document (JSON) against which requests are validated before being forwarded, invalid ones being answered with 4.00 Bad Request (default is no validation)")
+	normalizeSenML = flag.Bool("normalizesenml", false, "Resolve SenML base values and relative times before forwarding SenML payloads")
+	linkFormat     = flag.Bool("translatelinkformat", false, "Convert between CoAP link-format and the backend's application/link-format+json")
+	deflateJSON    = flag.Bool("deflatejson", false, "Compress JSON responses which the client accepts deflated or which would be truncated")
+	observe        = flag.Duration("observe", 0, "Let clients observe resources, polling the backend when its last response expires, or else at this interval, and notifying them of changes (default is no Observe support)")
+	observeLife    = flag.Duration("observelifetime", time.Hour, "Time after which an observer which hasn't registered again is removed")
+	observeBackoff = flag.Duration("observebackoff", 0, "Maximum delay to which the polling of an observed resource backs off, with jitter, while it's unchanged or the backend fails (default is no backoff)")
+	queueSize      = flag.Int("queue", 0, "Number of requests queued per sleepy device by the admin API's POST /push, delivered when the device next contacts the proxy (default is no queue mode)")
+	queueTTL       = flag.Duration("queuettl", 24*time.Hour, "Time after which a queued request which couldn't be delivered is dropped")
+	deviceIDs      = flag.String("deviceids", "", "Comma-separated sources of device IDs for the push API: 'urihost', 'oscore' or 'ep:REGISTRATION_PATH' (default is none)")
+	deviceFile     = flag.String("devicefile", "", "JSON file keeping the device registry across restarts (default is none)")
+	cacheMaxSize   = flag.Int("cachemaxsize", 0, "Bytes of fresh backend responses to GET requests kept in a cache (default is no cache)")
+	negativeTTL    = flag.Duration("negativecachettl", 0, "Time for which 4xx and 5xx backend responses are cached, with -cachemaxsize (default is not to cache them)")
+	revalidate     = flag.Bool("revalidateblock2", false, "Revalidate cached responses served with Block2 which go stale during the download, aborting it with 4.08 if they changed, with -cachemaxsize")
+	serveStale     = flag.Duration("servestale", 0, "Time for which expired cached responses are kept and served, with Max-Age 0, when the backend fails, with -cachemaxsize (default is not to serve them)")
+	nstart         = flag.Int("nstart", 0, "Number of exchanges a client endpoint may have in progress, beyond which confirmable requests get 5.03 (default is no limit)")
+	pacingRate     = flag.Float64("pacing", 0, "Maximum number of messages per second sent to each client endpoint, queued beyond it, for constrained radio links (default is no limit)")
+	pacingQueue    = flag.Int("pacingqueue", 16, "Number of messages queued for a client endpoint under -pacing, beyond which they're dropped")
+	dropExcess     = flag.Bool("dropexcess", false, "Drop the confirmable requests beyond -nstart instead of answering them with 5.03")
+	exchangeLife   = flag.Duration("exchangelifetime", 247*time.Second, "Time for which the response to a confirmable request answers its retransmissions (0 disables deduplication)")
+	uploadLife     = flag.Duration("uploadlifetime", 247*time.Second, "Time for which an incomplete Block1 upload is kept after its latest block")
+	downloadLife   = flag.Duration("downloadlifetime", 247*time.Second, "Time for which the backend response of a Block2 download is kept after its latest block")
+	maxConcurrent  = flag.Int("maxconcurrent", 0, "Number of requests handled at once, beyond which they wait in a queue of -queuesize (default is no limit)")
+	requestQueue   = flag.Int("queuesize", 0, "Number of requests waiting for -maxconcurrent, beyond which confirmable requests get 5.03 with a Max-Age")
+	drainTimeout   = flag.Duration("draintimeout", 30*time.Second, "On SIGTERM or SIGINT, time for which the requests in progress are still served before exiting")
+	sessionTTL     = flag.Duration("sessionttl", 0, "Keep the backend's cookies per device, forgetting the session after this idle time (default is no cookies kept)")
+	separateDelay  = flag.Duration("separatedelay", 0, "Acknowledge confirmable requests and send a separate response when the backend takes longer than this (default is to always piggyback)")
+	ackTimeout     = flag.Duration("acktimeout", 2*time.Second, "Initial acknowledgement timeout of confirmable messages sent by the proxy")
+	maxRetransmit  = flag.Int("maxretransmit", 4, "Maximum number of retransmissions of confirmable messages sent by the proxy")
+	exchDeadline   = flag.Bool("exchdeadline", false, "Cancel the backend request of a confirmable request once the client would have given up retransmitting it, per -acktimeout and -maxretransmit")
+	respondNON     = flag.Bool("respondnon", false, "Send the backend response to non-confirmable requests as a non-confirmable message")
+	multicastGroup = flag.String("multicast", "", "Also accept requests sent to this multicast group, e.g. 224.0.1.187 or ff02::fd (default is none)")
+	multicastIf    = flag.String("multicastif", "", "Network interface on which to join the multicast group (default is the zone of the group, as in ff02::fd%eth0, else the system default)")
+	timeout        = flag.Duration("timeout", 5*time.Second, "Overall timeout of backend requests")
+	dialTimeout    = flag.Duration("dialtimeout", 0, "Timeout of connections to the backend (default is 30s)")
+	tlsTimeout     = flag.Duration("tlstimeout", 0, "Timeout of TLS handshakes with the backend (default is 10s)")
+	headerTimeout  = flag.Duration("headertimeout", 0, "Timeout for the backend response headers (default is only -timeout)")
+	expectCont     = flag.Bool("expectcontinue", false, "Send backend requests with a payload with 'Expect: 100-continue', so that the backend can reject them before their body is sent")
+	authChallenge  = flag.String("authchallenge", "", "Surface the WWW-Authenticate challenges of backend 401 responses, with the parameters 'PARAM,...' or '*' for all, as the CoAP option '=OPTION' if given, or else in the 4.01 diagnostic payload (default is none)")
+	forwardMeta    = flag.Bool("forwardmetadata", false, "Add X-CoAP-Message-Type, X-CoAP-Token and X-CoAP-Message-ID headers to backend requests")
+	forwardClient  = flag.Bool("forwardclient", false, "Add X-Forwarded-For and Forwarded headers with the client address to backend requests")
+	mapTrailers    = flag.Bool("maptrailers", false, "Add the trailers of backend responses to their headers, for the option mappings and forwarded headers")
+	userAgent      = flag.String("useragent", "", "User-Agent header of backend requests (default is crosscoap/VERSION)")
+	dryRun         = flag.Bool("dryrun", false, "Log translated backend requests instead of sending them, and answer 2.05 (to validate mapping rules)")
+	shadowBackend  = flag.String("shadowbackend", "", "URL of a shadow backend which receives a copy of every backend request, its responses discarded (default is none)")
+	backendSRV     = flag.String("backendsrv", "", "DNS SRV record locating the backend servers, e.g. _http._tcp.api.example.com, to which backend requests are spread (default is the backend URL host)")
+	consulService  = flag.String("consulservice", "", "Consul service whose healthy instances serve the backend requests (default is the backend URL host)")
+	consulAddr     = flag.String("consuladdr", "http://127.0.0.1:8500", "URL of the Consul agent queried for -consulservice")
+	resolveEvery   = flag.Duration("resolveinterval", 0, "Interval at which -backendsrv or -consulservice (default 30s), or else the backend URL host, is resolved again (default is to leave the backend URL host to the system resolver)")
+	backendChoice  = flag.String("backendstrategy", "roundrobin", "Choice of the resolved backend address of each request: 'roundrobin', 'weighted' (by -backendweight), 'latency' (lowest average response time) or 'outstanding' (fewest pending requests)")
+	credentialFile = flag.String("credentialsfile", "", "File of backend credentials of devices, lines 'IDENTITY NAME: VALUE' of headers replacing the shared ones in the requests of the device, read again when it changes")
+	credentialHost = flag.Bool("credentialsbyurihost", false, "Identify devices without an OSCORE identity by the Uri-Host of their requests for -credentialsfile (unauthenticated)")
+	requireCreds   = flag.Bool("requirecredentials", false, "Answer the requests of devices without -credentialsfile credentials with 4.01 Unauthorized")
+	backendHost    = flag.String("backendhost", "", "Host header and TLS server name of backend requests, regardless of the client's Uri-Host (default is the backend URL host or Uri-Host)")
+	uriTemplate    = flag.String("uritemplate", "", "RFC 6570 template of backend URIs, e.g. 'https://api.example.com/devices/{uri-host}/{+uri-path}{?uri-query*}' (default is BACKEND_URL/PATH?QUERY)")
+	forwardProxy   = flag.Bool("forwardproxy", false, "Forward requests with a Proxy-Uri or Proxy-Scheme option to the URI they carry")
+	proxySchemes   = flag.String("forwardproxyschemes", "http,https", "Comma-separated URI schemes allowed with -forwardproxy")
+	proxyHosts     = flag.String("forwardproxyhosts", "", "Comma-separated host names allowed with -forwardproxy (required)")
+	maxRedirects   = flag.Int("redirects", 10, "Number of backend redirects followed per request, beyond which or on a loop the request fails with 5.02")
+	fetchMethod    = flag.String("fetchmethod", "GET", "HTTP method of backend requests translated from FETCH requests: GET, with a body, or POST")
+	translateRedir = flag.Bool("translateredirects", false, "Send backend redirects to the client as 2.05 responses with Location-Path and Location-Query options instead of following them")
+	discovery      = flag.Bool("discovery", false, "Answer GET /.well-known/core with the -discoverylink resources instead of forwarding it")
+	health         = flag.Bool("health", false, "Answer GET /health with 2.05 if the listeners are served and the backend is reachable, else 5.03")
+	mergeDiscovery = flag.Bool("mergediscovery", false, "Add the links of the backend's /.well-known/core to the -discovery listing")
+	rdAddr         = flag.String("rd", "", "Register with the CoRE Resource Directory at this UDP address (default is no registration)")
+	rdEndpoint     = flag.String("rdendpoint", "", "Endpoint name registered with -rd (default is the host name)")
+	rdLifetime     = flag.Duration("rdlifetime", 25*time.Hour, "Lifetime of the -rd registration, which is refreshed before it expires")
+	leisure        = flag.Duration("leisure", 5*time.Second, "Maximum random delay before responding to a multicast request")
+	adminAddr      = flag.String("admin", "", "Serve the admin HTTP API on this TCP address, e.g. 127.0.0.1:8080 (default is none)")
+	trackClients   = flag.Int("trackclients", 10000, "Number of client endpoints whose statistics the admin API shows, least recently seen forgotten first (0 for none)")
+	record         = flag.Int("record", 0, "Number of most recent backend exchanges shown by the admin API at /exchanges (default is none)")
+	recordFile     = flag.String("recordfile", "", "File to which every backend exchange is appended as a line of JSON (default is none)")
+	recordFileSize = flag.Int64("recordfilesize", 100, "Size in MB over which -recordfile is rotated to a .1 file")
+	adminDebug     = flag.Bool("admindebug", false, "Also serve pprof profiles and expvar variables on the admin API, under /debug/")
+	metricsSink    = flag.String("metrics", "", "Metrics sink: 'prometheus' (served at /metrics on the admin API), 'statsd://HOST:PORT' or 'dogstatsd://HOST:PORT' (default is none)")
+	metricLabels   = flag.String("metriclabels", "", "Comma-separated labels added to the request metrics: route, tenant, backend and code_class (default is none)")
+	metricValues   = flag.Int("metriclabelvalues", 100, "Number of values of each -metriclabels label, new ones being reported as 'other'")
+	sloWindow      = flag.Duration("slowindow", 0, "Rolling window over which the latency percentiles, error rate and payload sizes of each route are kept, served at /slo on the admin API (default is none, or 5m with -slo)")
+	adminToken     = flag.String("admintoken", "", "Bearer token required by the admin API (default is the ADMIN_TOKEN environment variable)")
 )
 
+func init() {
+	flag.Var(&aclRules, "acl", "Access rule 'allow|deny [METHOD,...|*] [PATH_PREFIX] [PRINCIPAL,...|*]' (may be repeated; first match wins)")
+	flag.Var(&principals, "principal", "Principal 'IDENTITY=PRINCIPAL' of the clients with an OSCORE context, e.g. 'oscore:0a=sensor-1', others being forbidden (may be repeated)")
+	flag.Var(&formats, "contentformat", "Custom content format 'ID=CONTENT_TYPE[:ENCODING]' (may be repeated)")
+	flag.Var(&optionHeaders, "optionheader", "CoAP option to HTTP header mapping 'NUMBER=HEADER[:string|uint|opaque]' (may be repeated)")
+	flag.Var(&rewriteRules, "rewrite", "Path rewrite rule 'strip PREFIX' or 'replace PATTERN REPLACEMENT' (may be repeated; applied in order)")
+	flag.Var(&queryRules, "queryrule", "Query rule 'add NAME=VALUE|rename NAME=NEW_NAME|remove NAME|header NAME=HEADER [PATH_PREFIX]' (may be repeated; applied in order)")
+	flag.Var(&routeBackends, "routebackend", "Backend 'PATH_PREFIX=URL' of the requests below a path, instead of -backend (may be repeated; first match wins)")
+	flag.Var(&tenants, "tenant", "Tenant 'NAME [host=HOST] [prefix=PATH_PREFIX] [backend=URL] [rate=N] [burst=N]' of the requests to a Uri-Host below a path, with its own backend and rate limit (may be repeated; first match wins)")
+	flag.Var(&canaryRoutes, "canary", "Canary route 'PATH_PREFIX=PERCENT:URL' sending a sticky share of clients' requests below a path to another backend (may be repeated; first match wins)")
+	flag.Var(&failovers, "failoverbackend", "Backend URL tried after -backend, and after the previous ones, when it can't be reached or answers with a 5xx status, for idempotent requests (may be repeated; tried in order)")
+	flag.Var(&backendWeights, "backendweight", "Weight 'ADDRESS=WEIGHT' of a resolved backend address, 1 if not given (may be repeated)")
+	flag.Var(&nonDedups, "nondedup", "Window 'PATH_PREFIX=DURATION' within which duplicated NON requests below a path are forwarded once (may be repeated; first match wins)")
+	flag.Var(&routeSLOs, "slo", "Objective 'PATH_PREFIX=p99:DURATION[,errors:RATE]' of the requests below a path over -slowindow, logged when breached (may be repeated; first match wins)")
+	flag.Var(&inflatePaths, "inflaterequests", "Forward deflated JSON request payloads below this path prefix as plain JSON (may be repeated; '/' for all paths)")
+	flag.Var(&routeConfigs, "route", "Overrides 'PATH_PREFIX=KEY:VALUE,...' of the defaults for requests below a path, with keys timeout, maxbody, oversize, cache (TTL|bypass), nondedup, ratelimit, burst and accesslog (true|false), or [route.\"PATH_PREFIX\"] tables in -config (may be repeated; first match wins)")
+	flag.Var(&routeTimeouts, "routetimeout", "Backend timeout 'PATH_PREFIX=DURATION' for requests below a path (may be repeated; first match wins)")
+	flag.Var(&prefetch, "prefetch", "Resource 'PATH[?QUERY]' whose backend response is fetched into the cache at startup and refreshed before it expires, with -cachemaxsize (may be repeated)")
+	flag.Var(&routeCache, "routecache", "Cache policy '[METHOD,...:]PATH_PREFIX=TTL|bypass' for responses to requests below a path, with -cachemaxsize (may be repeated; first match wins)")
+	flag.Var(&routeOversize, "routeoversize", "Policy 'PATH_PREFIX=POLICY' for responses larger than a packet to requests below a path, instead of -oversize (may be repeated; first match wins)")
+	flag.Var(&oscoreContexts, "oscorecontext", "OSCORE security context 'RECIPIENT_ID:SENDER_ID:MASTER_SECRET[:MASTER_SALT[:ID_CONTEXT]]' in hex, terminated by the proxy (may be repeated)")
+	flag.Var(&headers, "header", "Header 'NAME: VALUE' added to every backend request (may be repeated)")
+	flag.Var(&staticRoutes, "static", "Resource 'PATH=FILE[;ct=N][;maxage=DURATION][;template]' answered by crosscoap from a file, or a Go text/template, without a backend request (may be repeated)")
+	flag.Var(&discoveryLinks, "discoverylink", "Resource 'PATH[;PARAM[=VALUE]...]' listed in /.well-known/core with -discovery (may be repeated)")
+	flag.Var(&forwardHeaders, "forwardheader", "Backend response header 'HEADER[=OPTION]' surfaced to clients as a CoAP option, or in error diagnostics (may be repeated)")
+}
+
+func registerContentFormats(p *crosscoap.Proxy) error {
+	for _, s := range formats {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid content format %q", s)
+		}
+		id, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid content format ID in %q", s)
+		}
+		typeEncoding := strings.SplitN(kv[1], ":", 2)
+		encoding := ""
+		if len(typeEncoding) == 2 {
+			encoding = typeEncoding[1]
+		}
+		p.RegisterContentFormat(coap.MediaType(id), typeEncoding[0], encoding)
+	}
+	return nil
+}
+
+var optionFormats = map[string]crosscoap.OptionFormat{
+	"string": crosscoap.StringOption,
+	"uint":   crosscoap.UintOption,
+	"opaque": crosscoap.OpaqueOption,
+}
+
+func parseOptionMappings() ([]crosscoap.OptionMapping, error) {
+	var mappings []crosscoap.OptionMapping
+	for _, s := range optionHeaders {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option mapping %q", s)
+		}
+		id, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid option number in %q", s)
+		}
+		headerFormat := strings.SplitN(kv[1], ":", 2)
+		mapping := crosscoap.OptionMapping{Option: uint16(id), Header: headerFormat[0]}
+		if len(headerFormat) == 2 {
+			format, found := optionFormats[headerFormat[1]]
+			if !found {
+				return nil, fmt.Errorf("invalid option format in %q", s)
+			}
+			mapping.Format = format
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+func parseForwardedHeaders() ([]crosscoap.ForwardedHeader, error) {
+	var forwarded []crosscoap.ForwardedHeader
+	for _, s := range forwardHeaders {
+		kv := strings.SplitN(s, "=", 2)
+		header := crosscoap.ForwardedHeader{Header: kv[0]}
+		if len(kv) == 2 {
+			id, err := strconv.ParseUint(kv[1], 10, 16)
+			if err != nil || id == 0 {
+				return nil, fmt.Errorf("invalid option number in %q", s)
+			}
+			header.Option = uint16(id)
+		}
+		forwarded = append(forwarded, header)
+	}
+	return forwarded, nil
+}
+
+// parseAuthChallenges returns the -authchallenge policy, or nil.
+func parseAuthChallenges() (*crosscoap.AuthChallengePolicy, error) {
+	if *authChallenge == "" {
+		return nil, nil
+	}
+	kv := strings.SplitN(*authChallenge, "=", 2)
+	policy := &crosscoap.AuthChallengePolicy{}
+	if kv[0] != "*" {
+		for _, param := range strings.Split(kv[0], ",") {
+			if param = strings.TrimSpace(param); param == "" {
+				return nil, fmt.Errorf("invalid challenge parameters in %q", *authChallenge)
+			}
+			policy.Params = append(policy.Params, param)
+		}
+	}
+	if len(kv) == 2 {
+		id, err := strconv.ParseUint(kv[1], 10, 16)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid option number in %q", *authChallenge)
+		}
+		policy.Option = uint16(id)
+	}
+	return policy, nil
+}
+
+func parseDiscoveryLinks() ([]crosscoap.Link, error) {
+	var links []crosscoap.Link
+	for _, s := range discoveryLinks {
+		fields := strings.Split(s, ";")
+		if fields[0] == "" {
+			return nil, fmt.Errorf("invalid discovery link %q", s)
+		}
+		link := crosscoap.Link{Target: fields[0], Params: make(map[string]string)}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if kv[0] == "" {
+				return nil, fmt.Errorf("invalid discovery link %q", s)
+			}
+			if len(kv) == 2 {
+				link.Params[kv[0]] = strings.Trim(kv[1], `"`)
+			} else {
+				link.Params[kv[0]] = ""
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// parseStaticRoutes parses the -static resources
+// 'PATH=FILE[;ct=N][;maxage=DURATION][;template]'.
+func parseStaticRoutes() ([]crosscoap.StaticRoute, error) {
+	var routes []crosscoap.StaticRoute
+	for _, s := range staticRoutes {
+		fields := strings.Split(s, ";")
+		kv := strings.SplitN(fields[0], "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid static route %q", s)
+		}
+		payload, err := ioutil.ReadFile(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		route := crosscoap.StaticRoute{Path: kv[0], Payload: payload}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			switch {
+			case kv[0] == "template" && len(kv) == 1:
+				if route.Template, err = template.New(route.Path).Parse(string(payload)); err != nil {
+					return nil, fmt.Errorf("invalid template in %q: %v", s, err)
+				}
+			case kv[0] == "ct" && len(kv) == 2:
+				ct, err := strconv.ParseUint(kv[1], 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("invalid content format in %q", s)
+				}
+				route.ContentFormat = coap.MediaType(ct)
+			case kv[0] == "maxage" && len(kv) == 2:
+				if route.MaxAge, err = time.ParseDuration(kv[1]); err != nil || route.MaxAge < 0 {
+					return nil, fmt.Errorf("invalid max age in %q", s)
+				}
+			default:
+				return nil, fmt.Errorf("invalid parameter %q in static route %q", param, s)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func parseHeaders() (http.Header, error) {
+	header := make(http.Header)
+	for _, s := range headers {
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q", s)
+		}
+		header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return header, nil
+}
+
+func parseOSCOREContexts() ([]crosscoap.OSCOREContext, error) {
+	var contexts []crosscoap.OSCOREContext
+	for _, s := range oscoreContexts {
+		context, err := parseOSCOREContext(s)
+		if err != nil {
+			return nil, err
+		}
+		contexts = append(contexts, context)
+	}
+	return contexts, nil
+}
+
+// parseOSCOREContext parses an OSCORE context
+// 'RECIPIENT_ID:SENDER_ID:MASTER_SECRET[:MASTER_SALT[:ID_CONTEXT]]' in hex.
+func parseOSCOREContext(s string) (crosscoap.OSCOREContext, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) < 3 || len(fields) > 5 {
+		return crosscoap.OSCOREContext{}, fmt.Errorf("invalid OSCORE context %q", s)
+	}
+	values := make([][]byte, 5)
+	for i, field := range fields {
+		value, err := hex.DecodeString(field)
+		if err != nil {
+			return crosscoap.OSCOREContext{}, fmt.Errorf("invalid hex in OSCORE context %q", s)
+		}
+		values[i] = value
+	}
+	return crosscoap.OSCOREContext{
+		RecipientID:  values[0],
+		SenderID:     values[1],
+		MasterSecret: values[2],
+		MasterSalt:   values[3],
+		IDContext:    values[4],
+	}, nil
+}
+
+// oscoreContextFile is the -oscorecontextfile source of OSCORE contexts,
+// which is only parsed again once it's modified.
+type oscoreContextFile struct {
+	name     string
+	modified time.Time
+	contexts []crosscoap.OSCOREContext
+}
+
+// load returns the contexts of the file, one per line as in -oscorecontext;
+// blank lines and lines starting with # are ignored.
+func (f *oscoreContextFile) load() ([]crosscoap.OSCOREContext, error) {
+	info, err := os.Stat(f.name)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(f.modified) {
+		return f.contexts, nil
+	}
+	data, err := ioutil.ReadFile(f.name)
+	if err != nil {
+		return nil, err
+	}
+	var contexts []crosscoap.OSCOREContext
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		context, err := parseOSCOREContext(line)
+		if err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", f.name, i+1, err)
+		}
+		contexts = append(contexts, context)
+	}
+	f.modified, f.contexts = info.ModTime(), contexts
+	return contexts, nil
+}
+
+// credentialsFile is the -credentialsfile store of backend credentials,
+// checked for changes at most once per credentialsCheckInterval.
+type credentialsFile struct {
+	name     string
+	errorLog *log.Logger
+
+	mu          sync.Mutex
+	checked     time.Time
+	modified    time.Time
+	credentials map[string]http.Header
+}
+
+const credentialsCheckInterval = time.Second
+
+// reload parses the file again if it was modified: one header per line
+// 'IDENTITY NAME: VALUE', where IDENTITY is oscore:RECIPIENT_ID (in hex) or
+// a Uri-Host; blank lines and lines starting with # are ignored.
+func (f *credentialsFile) reload() error {
+	info, err := os.Stat(f.name)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modified) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.name)
+	if err != nil {
+		return err
+	}
+	credentials := make(map[string]http.Header)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		var kv []string
+		if len(fields) == 2 {
+			kv = strings.SplitN(fields[1], ":", 2)
+		}
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("%v line %v: invalid credentials", f.name, i+1)
+		}
+		if credentials[fields[0]] == nil {
+			credentials[fields[0]] = make(http.Header)
+		}
+		credentials[fields[0]].Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	f.modified, f.credentials = info.ModTime(), credentials
+	return nil
+}
+
+// lookup returns the credentials of the device with the identity.  The
+// previous credentials are kept if the file can't be read again.
+func (f *credentialsFile) lookup(identity string) (http.Header, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= credentialsCheckInterval {
+		f.checked = now
+		if err := f.reload(); err != nil {
+			f.errorLog.Printf("Error reading backend credentials: %v", err)
+		}
+	}
+	header, found := f.credentials[identity]
+	return header, found
+}
+
+// parseBackendStrategy returns the -backendstrategy strategy and the
+// -backendweight weights.
+func parseBackendStrategy() (crosscoap.BackendStrategy, map[string]float64, error) {
+	var strategy crosscoap.BackendStrategy
+	switch *backendChoice {
+	case "roundrobin":
+		strategy = crosscoap.NewRoundRobinStrategy()
+	case "weighted":
+		strategy = crosscoap.NewWeightedStrategy()
+	case "latency":
+		strategy = crosscoap.NewLeastLatencyStrategy()
+	case "outstanding":
+		strategy = crosscoap.NewLeastOutstandingStrategy()
+	default:
+		return nil, nil, fmt.Errorf("invalid backend strategy %q", *backendChoice)
+	}
+	var weights map[string]float64
+	for _, s := range backendWeights {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, fmt.Errorf("invalid backend weight %q", s)
+		}
+		weight, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || weight < 0 {
+			return nil, nil, fmt.Errorf("invalid weight in %q", s)
+		}
+		if weights == nil {
+			weights = map[string]float64{}
+		}
+		weights[kv[0]] = weight
+	}
+	return strategy, weights, nil
+}
+
+// parseCanaryRoutes returns the -routebackend routes, as canary routes
+// taking all requests, followed by the -canary routes.
+func parseCanaryRoutes() ([]crosscoap.CanaryRoute, error) {
+	var routes []crosscoap.CanaryRoute
+	for _, s := range routeBackends {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid route backend %q", s)
+		}
+		if _, err := url.Parse(kv[1]); err != nil {
+			return nil, fmt.Errorf("invalid URL in %q: %v", s, err)
+		}
+		routes = append(routes, crosscoap.CanaryRoute{PathPrefix: kv[0], Percent: 100, BackendURL: kv[1]})
+	}
+	for _, s := range canaryRoutes {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid canary route %q", s)
+		}
+		split := strings.SplitN(kv[1], ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid canary route %q", s)
+		}
+		percent, err := strconv.ParseFloat(split[0], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percentage in %q", s)
+		}
+		if _, err := url.Parse(split[1]); err != nil {
+			return nil, fmt.Errorf("invalid URL in %q: %v", s, err)
+		}
+		routes = append(routes, crosscoap.CanaryRoute{PathPrefix: kv[0], Percent: percent, BackendURL: split[1]})
+	}
+	return routes, nil
+}
+
+// parseDeviceRegistry returns the device registry of -deviceids and
+// -devicefile, or nil.
+func parseDeviceRegistry() (*crosscoap.DeviceRegistry, error) {
+	if *deviceIDs == "" && *deviceFile == "" {
+		return nil, nil
+	}
+	registry := &crosscoap.DeviceRegistry{File: *deviceFile}
+	for _, source := range splitList(*deviceIDs) {
+		switch {
+		case source == "urihost":
+			registry.URIHost = true
+		case source == "oscore":
+			registry.OSCORE = true
+		case strings.HasPrefix(source, "ep:"):
+			registry.RegistrationPath = strings.TrimPrefix(source, "ep:")
+		default:
+			return nil, fmt.Errorf("invalid device ID source %q", source)
+		}
+	}
+	return registry, nil
+}
+
+func parseTenants() ([]crosscoap.Tenant, error) {
+	var result []crosscoap.Tenant
+	for _, s := range tenants {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid tenant %q", s)
+		}
+		tenant := crosscoap.Tenant{Name: fields[0]}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid setting %q of tenant %v", field, tenant.Name)
+			}
+			var err error
+			switch kv[0] {
+			case "host":
+				tenant.Host = kv[1]
+			case "prefix":
+				tenant.PathPrefix = kv[1]
+			case "backend":
+				tenant.BackendURL = kv[1]
+				_, err = url.Parse(kv[1])
+			case "rate":
+				tenant.RateLimit, err = strconv.ParseFloat(kv[1], 64)
+				if err == nil && tenant.RateLimit < 0 {
+					err = fmt.Errorf("negative rate")
+				}
+			case "burst":
+				tenant.Burst, err = strconv.Atoi(kv[1])
+			default:
+				err = fmt.Errorf("unknown setting")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid setting %q of tenant %v: %v", field, tenant.Name, err)
+			}
+		}
+		result = append(result, tenant)
+	}
+	return result, nil
+}
+
+// parseRouteOversizePolicies parses the -routeoversize policies
+// 'PATH_PREFIX=POLICY'.
+func parseRouteOversizePolicies() ([]crosscoap.RouteConfig, error) {
+	var routes []crosscoap.RouteConfig
+	for _, s := range routeOversize {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid route oversize policy %q", s)
+		}
+		policy, err := crosscoap.ParseOversizePolicy(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, crosscoap.RouteConfig{PathPrefix: kv[0], Oversize: &policy})
+	}
+	return routes, nil
+}
+
+// parseRouteCachePolicies parses the -routecache policies
+// '[METHOD,...:]PATH_PREFIX=TTL|bypass'.
+func parseRouteCachePolicies() ([]crosscoap.RouteConfig, error) {
+	var routes []crosscoap.RouteConfig
+	for _, s := range routeCache {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid route cache policy %q", s)
+		}
+		var route crosscoap.RouteConfig
+		route.PathPrefix = kv[0]
+		if i := strings.Index(kv[0], ":"); i >= 0 {
+			route.CacheMethods = splitList(kv[0][:i])
+			route.PathPrefix = kv[0][i+1:]
+		}
+		if kv[1] == "bypass" {
+			route.CacheBypass = true
+		} else {
+			ttl, err := time.ParseDuration(kv[1])
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid TTL in %q", s)
+			}
+			route.CacheTTL = ttl
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// parseRouteTimeouts parses the -routetimeout timeouts
+// 'PATH_PREFIX=DURATION'.
+func parseRouteTimeouts() ([]crosscoap.RouteConfig, error) {
+	var routes []crosscoap.RouteConfig
+	for _, s := range routeTimeouts {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid route timeout %q", s)
+		}
+		timeout, err := time.ParseDuration(kv[1])
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout in %q", s)
+		}
+		routes = append(routes, crosscoap.RouteConfig{PathPrefix: kv[0], Timeout: timeout})
+	}
+	return routes, nil
+}
+
+// parseNonDeduplication parses the -nondedup windows
+// 'PATH_PREFIX=DURATION', a zero window exempting the requests below the
+// path.
+func parseNonDeduplication() ([]crosscoap.RouteConfig, error) {
+	var routes []crosscoap.RouteConfig
+	for _, s := range nonDedups {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid NON deduplication %q", s)
+		}
+		window, err := time.ParseDuration(kv[1])
+		if err != nil || window < 0 {
+			return nil, fmt.Errorf("invalid window in %q", s)
+		}
+		if window == 0 {
+			window = -1
+		}
+		routes = append(routes, crosscoap.RouteConfig{PathPrefix: kv[0], NonDeduplication: window})
+	}
+	return routes, nil
+}
+
+// parseRoutes parses the -route overrides 'PATH_PREFIX=KEY:VALUE,...'.
+func parseRoutes() ([]crosscoap.RouteConfig, error) {
+	var routes []crosscoap.RouteConfig
+	for _, s := range routeConfigs {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid route %q", s)
+		}
+		route := crosscoap.RouteConfig{PathPrefix: kv[0]}
+		for _, setting := range strings.Split(kv[1], ",") {
+			kv := strings.SplitN(setting, ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid setting %q in %q", setting, s)
+			}
+			var err error
+			switch kv[0] {
+			case "timeout":
+				if route.Timeout, err = time.ParseDuration(kv[1]); err == nil && route.Timeout <= 0 {
+					err = errors.New("not positive")
+				}
+			case "maxbody":
+				if route.MaxRequestBodyBytes, err = strconv.Atoi(kv[1]); err == nil && route.MaxRequestBodyBytes <= 0 {
+					err = errors.New("not positive")
+				}
+			case "oversize":
+				var policy crosscoap.OversizePolicy
+				if policy, err = crosscoap.ParseOversizePolicy(kv[1]); err == nil {
+					route.Oversize = &policy
+				}
+			case "cache":
+				if kv[1] == "bypass" {
+					route.CacheBypass = true
+				} else if route.CacheTTL, err = time.ParseDuration(kv[1]); err == nil && route.CacheTTL <= 0 {
+					err = errors.New("not positive")
+				}
+			case "nondedup":
+				if route.NonDeduplication, err = time.ParseDuration(kv[1]); err == nil && route.NonDeduplication <= 0 {
+					err = errors.New("not positive")
+				}
+			case "ratelimit":
+				if route.RateLimit, err = strconv.ParseFloat(kv[1], 64); err == nil && route.RateLimit <= 0 {
+					err = errors.New("not positive")
+				}
+			case "burst":
+				if route.Burst, err = strconv.Atoi(kv[1]); err == nil && route.Burst <= 0 {
+					err = errors.New("not positive")
+				}
+			case "accesslog":
+				var accessLog bool
+				accessLog, err = strconv.ParseBool(kv[1])
+				route.Quiet = !accessLog
+			default:
+				return nil, fmt.Errorf("unknown setting %q in %q", kv[0], s)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v in %q: %v", kv[0], s, err)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// parseRouteSLOs parses the -slo objectives
+// 'PATH_PREFIX=p99:DURATION[,errors:RATE]' (either objective being
+// optional).
+func parseRouteSLOs() ([]crosscoap.RouteSLO, error) {
+	var slos []crosscoap.RouteSLO
+	for _, s := range routeSLOs {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid SLO %q", s)
+		}
+		slo := crosscoap.RouteSLO{PathPrefix: kv[0]}
+		for _, objective := range strings.Split(kv[1], ",") {
+			kv := strings.SplitN(objective, ":", 2)
+			var err error
+			switch {
+			case len(kv) != 2:
+				err = fmt.Errorf("invalid objective %q in %q", objective, s)
+			case kv[0] == "p99":
+				if slo.P99Latency, err = time.ParseDuration(kv[1]); err != nil || slo.P99Latency <= 0 {
+					err = fmt.Errorf("invalid latency in %q", s)
+				}
+			case kv[0] == "errors":
+				if slo.ErrorRate, err = strconv.ParseFloat(kv[1], 64); err != nil || slo.ErrorRate <= 0 || slo.ErrorRate > 1 {
+					err = fmt.Errorf("invalid error rate in %q", s)
+				}
+			default:
+				err = fmt.Errorf("unknown objective %q in %q", kv[0], s)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		slos = append(slos, slo)
+	}
+	return slos, nil
+}
+
+// openMetrics returns the metrics of the -metrics sink.
+func openMetrics(sink string) (crosscoap.Metrics, error) {
+	switch {
+	case sink == "prometheus":
+		if *adminAddr == "" {
+			return nil, fmt.Errorf("-metrics prometheus requires -admin")
+		}
+		return crosscoap.NewPrometheusMetrics("crosscoap"), nil
+	case strings.HasPrefix(sink, "statsd://"):
+		return crosscoap.NewStatsDMetrics(strings.TrimPrefix(sink, "statsd://"), "crosscoap", false)
+	case strings.HasPrefix(sink, "dogstatsd://"):
+		return crosscoap.NewStatsDMetrics(strings.TrimPrefix(sink, "dogstatsd://"), "crosscoap", true)
+	}
+	return nil, fmt.Errorf("invalid metrics sink %q", sink)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseAccessAction(s string) (crosscoap.AccessAction, error) {
+	switch s {
+	case "allow":
+		return crosscoap.Allow, nil
+	case "deny":
+		return crosscoap.Deny, nil
+	}
+	return 0, fmt.Errorf("invalid access action %q", s)
+}
+
+var coapMethods = map[string]coap.COAPCode{
+	"GET":    coap.GET,
+	"POST":   coap.POST,
+	"PUT":    coap.PUT,
+	"DELETE": coap.DELETE,
+	"FETCH":  crosscoap.FETCH,
+	"PATCH":  crosscoap.PATCH,
+	"IPATCH": crosscoap.IPATCH,
+}
+
+func parseAccessRule(s string) (crosscoap.AccessRule, error) {
+	var rule crosscoap.AccessRule
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 4 {
+		return rule, fmt.Errorf("invalid access rule %q", s)
+	}
+	action, err := parseAccessAction(fields[0])
+	if err != nil {
+		return rule, err
+	}
+	rule.Action = action
+	if len(fields) > 1 && fields[1] != "*" {
+		for _, name := range strings.Split(fields[1], ",") {
+			code, found := coapMethods[strings.ToUpper(name)]
+			if !found {
+				return rule, fmt.Errorf("invalid method %q in access rule %q", name, s)
+			}
+			rule.Methods = append(rule.Methods, code)
+		}
+	}
+	if len(fields) > 2 {
+		rule.PathPrefix = fields[2]
+	}
+	if len(fields) > 3 {
+		rule.Principals = strings.Split(fields[3], ",")
+	}
+	return rule, nil
+}
+
+// parseAuthenticators returns the authenticators of the -principal and
+// -jwtparam flags.
+func parseAuthenticators() ([]crosscoap.Authenticator, error) {
+	var authenticators []crosscoap.Authenticator
+	if len(principals) > 0 {
+		psk := &crosscoap.PSKAuthenticator{Principals: make(map[string]string)}
+		for _, s := range principals {
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("invalid principal %q", s)
+			}
+			psk.Principals[kv[0]] = kv[1]
+		}
+		authenticators = append(authenticators, psk)
+	}
+	if *jwtParam == "" {
+		return authenticators, nil
+	}
+	jwt := &crosscoap.JWTQueryAuthenticator{
+		Param:    *jwtParam,
+		Secret:   []byte(*jwtSecret),
+		Issuer:   *jwtIssuer,
+		Audience: *jwtAudience,
+	}
+	if *jwtSecret == "" {
+		jwt.Secret = []byte(os.Getenv("JWT_SECRET"))
+	}
+	if *jwtKey != "" {
+		data, err := ioutil.ReadFile(*jwtKey)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM key in %v", *jwtKey)
+		}
+		if jwt.PublicKey, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid key in %v: %v", *jwtKey, err)
+		}
+	}
+	if len(jwt.Secret) == 0 && jwt.PublicKey == nil {
+		return nil, fmt.Errorf("-jwtparam requires -jwtsecret or -jwtkey")
+	}
+	return append(authenticators, jwt), nil
+}
+
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func parseAccessPolicy() (*crosscoap.AccessPolicy, error) {
+	defaultAction, err := parseAccessAction(*aclDefault)
+	if err != nil {
+		return nil, err
+	}
+	if len(aclRules) == 0 && defaultAction == crosscoap.Allow {
+		return nil, nil
+	}
+	policy := &crosscoap.AccessPolicy{DefaultAction: defaultAction}
+	for _, s := range aclRules {
+		rule, err := parseAccessRule(s)
+		if err != nil {
+			return nil, err
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// listenNetwork returns the network of a listen address: an IP literal
+// binds only its own family, so that both 0.0.0.0 and [::] can be listened on.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "udp"
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// interfaceAddresses returns the listen addresses of a listen address
+// whose host is an unspecified address with a zone, such as [::%eth0]:5683:
+// the addresses of that family of the interface, link-local ones with the
+// zone.  Other listen addresses are returned as they are.
+func interfaceAddresses(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	i := strings.IndexByte(host, '%')
+	if err != nil || i < 0 {
+		return []string{addr}, nil
+	}
+	ip := net.ParseIP(host[:i])
+	if ip == nil || !ip.IsUnspecified() {
+		return []string{addr}, nil
+	}
+	ifi, err := net.InterfaceByName(host[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	ifiAddrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, a := range ifiAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != (ip.To4() != nil) {
+			continue
+		}
+		ifiHost := ipNet.IP.String()
+		if ipNet.IP.IsLinkLocalUnicast() {
+			ifiHost += "%" + ifi.Name
+		}
+		addrs = append(addrs, net.JoinHostPort(ifiHost, port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address of %v on interface %v", host[:i], ifi.Name)
+	}
+	return addrs, nil
+}
+
+// listen returns the -listeners UDP listeners of a listen address, or
+// those handed over by the crosscoap process which exec'd this one.
+func listen(addr string) ([]*net.UDPConn, error) {
+	if conns, err := inheritedUDP("udp " + addr); len(conns) > 0 || err != nil {
+		return conns, err
+	}
+	addrs, err := interfaceAddresses(addr)
+	if err != nil {
+		return nil, err
+	}
+	var conns []*net.UDPConn
+	for _, addr := range addrs {
+		addrConns, err := listenAddress(addr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, addrConns...)
+	}
+	return conns, nil
+}
+
+func listenAddress(addr string) ([]*net.UDPConn, error) {
+	network := listenNetwork(addr)
+	if *listeners > 1 {
+		return crosscoap.ListenReusePort(network, addr, *listeners)
+	}
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	udpListener, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{udpListener}, nil
+}
+
+func listenMulticast() (*net.UDPConn, error) {
+	if conns, err := inheritedUDP("multicast " + *multicastGroup); len(conns) > 0 || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return conns[0], nil
+	}
+	// A link-local group may name its interface, as in ff02::fd%eth0
+	groupAddr, zone := *multicastGroup, *multicastIf
+	if i := strings.IndexByte(groupAddr, '%'); i >= 0 {
+		groupAddr, zone = groupAddr[:i], groupAddr[i+1:]
+	}
+	group := net.ParseIP(groupAddr)
+	if group == nil || !group.IsMulticast() {
+		return nil, fmt.Errorf("invalid multicast group %q", *multicastGroup)
+	}
+	_, portString, err := net.SplitHostPort(splitList(*listenAddr)[0])
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	var ifi *net.Interface
+	if zone != "" {
+		if ifi, err = net.InterfaceByName(zone); err != nil {
+			return nil, err
+		}
+	}
+	return crosscoap.ListenMulticast(ifi, group, port)
+}
+
+// subcommands are run by "crosscoap NAME [FLAGS]" instead of the proxy.
+var subcommands = map[string]func(args []string) error{
+	"bench": runBench,
+	"send":  runSend,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, found := subcommands[os.Args[1]]; found {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+	}
 	flag.Parse()
+	if *showVersion {
+		fmt.Printf("crosscoap %v (%v)\n", crosscoap.Version(), runtime.Version())
+		return
+	}
+	if *configFile != "" {
+		if err := loadConfig(flag.CommandLine, *configFile); err != nil {
+			log.Fatalf("Error loading the configuration: %v", err)
+		}
+	}
 	if *backendURL == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	accessPolicy, err := parseAccessPolicy()
+	if err != nil {
+		log.Fatalf("Error parsing access rules: %v", err)
+	}
+	allowedClients, err := parseNetworks(*allowClients)
+	if err != nil {
+		log.Fatalf("Error parsing -allowclients: %v", err)
+	}
+	deniedClients, err := parseNetworks(*denyClients)
+	if err != nil {
+		log.Fatalf("Error parsing -denyclients: %v", err)
+	}
+	var validator *crosscoap.RequestValidator
+	if *openAPI != "" {
+		document, err := ioutil.ReadFile(*openAPI)
+		if err != nil {
+			log.Fatalf("Error reading the OpenAPI document: %v", err)
+		}
+		if validator, err = crosscoap.NewOpenAPIValidator(document); err != nil {
+			log.Fatalf("Error loading the OpenAPI document: %v", err)
+		}
+	}
+
+	var logFiles []*rotatingFile
 	var errorLog *log.Logger
 	if *errorLogName == "" {
 		errorLog = log.New(os.Stderr, "", log.LstdFlags)
 	} else {
-		errorLogFile, err := os.OpenFile(*errorLogName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatalf("Error opening error log file: %v", err)
+		var errorLogFile io.Closer
+		if errorLog, errorLogFile, err = openLog(*errorLogName, true); err != nil {
+			log.Fatalf("Error opening error log: %v", err)
 		}
 		defer errorLogFile.Close()
-		errorLog = log.New(errorLogFile, "", log.LstdFlags)
+		if f, ok := errorLogFile.(*rotatingFile); ok {
+			logFiles = append(logFiles, f)
+		}
 	}
 
 	var accessLog *log.Logger
 	if *accessLogName != "" {
-		accessLogFile, err := os.OpenFile(*accessLogName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatalf("Error opening access log file: %v", err)
+		var accessLogFile io.Closer
+		if accessLog, accessLogFile, err = openLog(*accessLogName, false); err != nil {
+			log.Fatalf("Error opening access log: %v", err)
 		}
 		defer accessLogFile.Close()
-		accessLog = log.New(accessLogFile, "", log.LstdFlags)
+		if f, ok := accessLogFile.(*rotatingFile); ok {
+			logFiles = append(logFiles, f)
+		}
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", *listenAddr)
-	if err != nil {
-		errorLog.Fatalln("Can't resolve UDP addr")
+	var auditLog *log.Logger
+	if *auditLogName != "" {
+		var auditLogFile io.Closer
+		if auditLog, auditLogFile, err = openLog(*auditLogName, true); err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer auditLogFile.Close()
+		if f, ok := auditLogFile.(*rotatingFile); ok {
+			logFiles = append(logFiles, f)
+		}
 	}
-	udpListener, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		errorLog.Fatalln("Can't listen on UDP")
+
+	var exchangeLog *rotatingFile
+	if *recordFile != "" {
+		if exchangeLog, err = openRotatingFile(*recordFile, *recordFileSize<<20); err != nil {
+			log.Fatalf("Error opening exchange record file: %v", err)
+		}
+		defer exchangeLog.Close()
+		logFiles = append(logFiles, exchangeLog)
+	}
+	reopenOnSignal(logFiles, errorLog)
+
+	inheritSockets()
+	var udpListeners []*net.UDPConn
+	var sockets []handedOverSocket
+	for _, addr := range splitList(*listenAddr) {
+		addrListeners, err := listen(addr)
+		if err != nil {
+			errorLog.Fatalf("Can't listen on UDP %v: %v", addr, err)
+		}
+		udpListeners = append(udpListeners, addrListeners...)
+		for _, l := range addrListeners {
+			sockets = append(sockets, handedOverSocket{"udp " + addr, l})
+		}
+	}
+	if len(udpListeners) == 0 {
+		errorLog.Fatalln("No -listen address")
+	}
+	for _, l := range udpListeners {
+		defer l.Close()
 	}
-	defer udpListener.Close()
 
 	errorLog.Printf("crosscoap started: Listening for CoAP on UDP %v ...", *listenAddr)
 
 	p := crosscoap.Proxy{
-		Listener:   udpListener,
+		Listener:   udpListeners[0],
+		Listeners:  udpListeners[1:],
 		BackendURL: *backendURL,
 		ErrorLog:   errorLog,
 		AccessLog:  accessLog,
 	}
+	p.AuditLog = auditLog
+	p.AccessPolicy = accessPolicy
+	if p.Authenticators, err = parseAuthenticators(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	p.RequireAuthentication = *requireAuth
+	p.PrincipalHeader = *principalHdr
+	p.AllowedClients = allowedClients
+	p.DeniedClients = deniedClients
+	p.RejectDeniedClients = *rejectDenied
+	p.VerifyClientAddresses = *verifyClients
+	p.AmplificationLimit = *amplification
+	p.MaxRequestBodyBytes = *maxBodyBytes
+	p.StreamBlock1 = *streamBlock1
+	p.StreamBlock2 = *streamBlock2
+	if p.OversizePolicy, err = crosscoap.ParseOversizePolicy(*oversize); err != nil {
+		errorLog.Fatalln(err)
+	}
+	p.DiagnosticPayloads = *diagnostics
+	p.StrictContentFormat = *strictFormat
+	p.DefaultContentType = *defaultType
+	p.TranscodeCBOR = *transcodeCBOR
+	p.TranscodeResponses = *transcode
+	p.RequestValidator = validator
+	p.NormalizeSenML = *normalizeSenML
+	p.TranslateLinkFormat = *linkFormat
+	p.DeflateJSON = *deflateJSON
+	p.InflateRequests = inflatePaths
+	p.SeparateResponseDelay = *separateDelay
+	p.ExchangeDeadlines = *exchDeadline
+	p.ObserveInterval = *observe
+	p.ObserveLifetime = *observeLife
+	p.ObserveMaxBackoff = *observeBackoff
+	p.QueueSize = *queueSize
+	p.QueueTTL = *queueTTL
+	p.SessionTTL = *sessionTTL
+	p.DrainTimeout = *drainTimeout
+	p.MaxOutstanding = *nstart
+	p.DropExcessRequests = *dropExcess
+	p.PacingRate = *pacingRate
+	p.PacingQueueSize = *pacingQueue
+	p.ExchangeLifetime = *exchangeLife
+	p.SLOWindow = *sloWindow
+	if p.RouteSLOs, err = parseRouteSLOs(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	p.UploadLifetime = *uploadLife
+	p.DownloadLifetime = *downloadLife
+	p.MaxConcurrentRequests = *maxConcurrent
+	p.RequestQueueSize = *requestQueue
+	p.CacheMaxSize = *cacheMaxSize
+	p.NegativeCacheTTL = *negativeTTL
+	for _, resource := range prefetch {
+		if err := crosscoap.SetPath(&coap.Message{}, resource); err != nil {
+			errorLog.Fatalf("Invalid -prefetch %q: %v", resource, err)
+		}
+	}
+	p.Prefetch = prefetch
+	p.ServeStale = *serveStale
+	p.RevalidateDownloads = *revalidate
+	p.AckTimeout = *ackTimeout
+	p.MaxRetransmit = *maxRetransmit
+	if *maxRetransmit == 0 {
+		p.MaxRetransmit = -1
+	}
+	p.RespondToNonConfirmable = *respondNON
+	p.Leisure = *leisure
+	if *rdAddr != "" {
+		endpoint := *rdEndpoint
+		if endpoint == "" {
+			if endpoint, err = os.Hostname(); err != nil {
+				errorLog.Fatalf("Can't get the host name for -rdendpoint: %v", err)
+			}
+		}
+		p.ResourceDirectory = &crosscoap.ResourceDirectory{
+			Addr:     *rdAddr,
+			Endpoint: endpoint,
+			Lifetime: *rdLifetime,
+		}
+	}
+	if *multicastGroup != "" {
+		if p.MulticastListener, err = listenMulticast(); err != nil {
+			errorLog.Fatalf("Can't join multicast group: %v", err)
+		}
+		defer p.MulticastListener.Close()
+		sockets = append(sockets, handedOverSocket{"multicast " + *multicastGroup, p.MulticastListener})
+	}
+	if err := registerContentFormats(&p); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if p.OptionMappings, err = parseOptionMappings(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if p.ForwardedResponseHeaders, err = parseForwardedHeaders(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if p.AuthChallenges, err = parseAuthChallenges(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	p.BackendHost = *backendHost
+	switch {
+	case *backendSRV != "" && *consulService != "":
+		errorLog.Fatalln("-backendsrv and -consulservice are mutually exclusive")
+	case *backendSRV != "":
+		p.BackendResolver = &crosscoap.SRVResolver{Name: *backendSRV}
+	case *consulService != "":
+		p.BackendResolver = &crosscoap.ConsulResolver{Address: *consulAddr, Service: *consulService}
+	}
+	p.BackendResolveInterval = *resolveEvery
+	if p.BackendStrategy, p.BackendWeights, err = parseBackendStrategy(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	p.ShadowBackendURL = *shadowBackend
+	p.FailoverBackendURLs = failovers
+	p.DryRun = *dryRun
+	if p.CanaryRoutes, err = parseCanaryRoutes(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if p.Tenants, err = parseTenants(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if p.Devices, err = parseDeviceRegistry(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	p.Timeout = timeout
+	p.DialTimeout = *dialTimeout
+	p.TLSHandshakeTimeout = *tlsTimeout
+	p.ResponseHeaderTimeout = *headerTimeout
+	p.UserAgent = *userAgent
+	p.ExpectContinue = *expectCont
+	p.MapTrailers = *mapTrailers
+	p.ForwardMessageMetadata = *forwardMeta
+	p.ForwardClientAddress = *forwardClient
+	if p.Routes, err = parseRoutes(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	// The per-setting flags apply after -route
+	for _, parse := range []func() ([]crosscoap.RouteConfig, error){parseRouteTimeouts, parseRouteOversizePolicies, parseRouteCachePolicies, parseNonDeduplication} {
+		routes, err := parse()
+		if err != nil {
+			errorLog.Fatalln(err)
+		}
+		p.Routes = append(p.Routes, routes...)
+	}
+	p.OSCOREBackendURL = *oscoreBackend
+	if p.OSCOREContexts, err = parseOSCOREContexts(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if *oscoreFile != "" {
+		source := &oscoreContextFile{name: *oscoreFile}
+		if _, err := source.load(); err != nil {
+			errorLog.Fatalln(err)
+		}
+		p.OSCOREContextSource = source.load
+		p.OSCOREReloadInterval = *oscoreReload
+	}
+	if p.DefaultHeaders, err = parseHeaders(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if *credentialFile != "" {
+		credentials := &credentialsFile{name: *credentialFile, errorLog: errorLog}
+		if err := credentials.reload(); err != nil {
+			errorLog.Fatalln(err)
+		}
+		p.BackendCredentials = credentials.lookup
+		p.CredentialsByURIHost = *credentialHost
+		p.RequireCredentials = *requireCreds
+	}
+	if *accessFormat != "" {
+		if p.AccessLogFormat, err = crosscoap.ParseAccessLogFormat(*accessFormat); err != nil {
+			errorLog.Fatalln(err)
+		}
+	}
+	for _, s := range rewriteRules {
+		rule, err := crosscoap.ParseRewriteRule(s)
+		if err != nil {
+			errorLog.Fatalln(err)
+		}
+		p.RewriteRules = append(p.RewriteRules, rule)
+	}
+	for _, s := range queryRules {
+		rule, err := crosscoap.ParseQueryRule(s)
+		if err != nil {
+			errorLog.Fatalln(err)
+		}
+		p.QueryRules = append(p.QueryRules, rule)
+	}
+	if *jwtParam != "" {
+		// The token is the proxy's business only
+		p.QueryRules = append(p.QueryRules, crosscoap.QueryRule{Action: crosscoap.RemoveQuery, Name: *jwtParam})
+	}
+	if *uriTemplate != "" {
+		if p.URITemplate, err = crosscoap.ParseURITemplate(*uriTemplate); err != nil {
+			errorLog.Fatalln(err)
+		}
+	}
+	if *forwardProxy {
+		if *proxyHosts == "" {
+			errorLog.Fatalln("-forwardproxy requires -forwardproxyhosts")
+		}
+		p.ForwardProxy = &crosscoap.ForwardProxyPolicy{
+			Schemes: splitList(*proxySchemes),
+			Hosts:   splitList(*proxyHosts),
+		}
+	}
+	p.MaxRedirects = *maxRedirects
+	p.TranslateRedirects = *translateRedir
+	switch strings.ToUpper(*fetchMethod) {
+	case "GET", "POST":
+		p.FetchMethod = strings.ToUpper(*fetchMethod)
+	default:
+		errorLog.Fatalf("Invalid -fetchmethod %q: only GET and POST are supported", *fetchMethod)
+	}
+	p.ServeDiscovery = *discovery
+	p.ServeHealth = *health
+	p.RecordExchanges = *record
+	if exchangeLog != nil {
+		p.ExchangeLog = exchangeLog
+	}
+	p.MergeBackendDiscovery = *mergeDiscovery
+	if p.DiscoveryLinks, err = parseDiscoveryLinks(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if p.StaticRoutes, err = parseStaticRoutes(); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if *awsRegion != "" {
+		p.SigV4 = &crosscoap.SigV4Signer{
+			Region:      *awsRegion,
+			Service:     *awsService,
+			Credentials: crosscoap.EnvCredentials{},
+		}
+	}
+	key := *hmacKey
+	if key == "" {
+		key = os.Getenv("HMAC_KEY")
+	}
+	if key != "" {
+		p.HMAC = &crosscoap.HMACSigner{
+			Key:    []byte(key),
+			KeyID:  *hmacKeyID,
+			Header: *hmacHeader,
+			Format: *hmacFormat,
+		}
+	}
+	if *metricsSink != "" {
+		if p.Metrics, err = openMetrics(*metricsSink); err != nil {
+			errorLog.Fatalln(err)
+		}
+	}
+	if *metricLabels != "" {
+		for _, label := range strings.Split(*metricLabels, ",") {
+			switch label {
+			case "route", "tenant", "backend", "code_class":
+				p.MetricLabels = append(p.MetricLabels, label)
+			default:
+				errorLog.Fatalln("Unknown metric label:", label)
+			}
+		}
+		p.MetricLabelValues = *metricValues
+	}
+	if *adminAddr != "" {
+		p.AdminToken = *adminToken
+		p.AdminDebug = *adminDebug
+		p.MaxTrackedClients = *trackClients
+		if *trackClients == 0 {
+			p.MaxTrackedClients = -1
+		}
+		if p.AdminToken == "" {
+			p.AdminToken = os.Getenv("ADMIN_TOKEN")
+		}
+		if p.AdminListener, err = inheritedListener("admin " + *adminAddr); err != nil {
+			errorLog.Fatalln(err)
+		}
+		if p.AdminListener == nil {
+			if p.AdminListener, err = net.Listen("tcp", *adminAddr); err != nil {
+				errorLog.Fatalln(err)
+			}
+		}
+		if l, ok := p.AdminListener.(*net.TCPListener); ok {
+			sockets = append(sockets, handedOverSocket{"admin " + *adminAddr, l})
+		}
+	}
+	shutdownOnSignal(&p, errorLog)
+	upgradeOnSignal(&p, sockets, errorLog)
+	signalReady()
 	err = p.Serve()
-	if err != nil {
+	if err != nil && !errors.Is(err, crosscoap.ErrProxyClosed) {
 		errorLog.Fatalln(err)
 	}
 }
+
+// shutdownOnSignal shuts p down gracefully on SIGTERM or SIGINT.
+func shutdownOnSignal(p *crosscoap.Proxy, errorLog *log.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-c
+		errorLog.Printf("Received %v, draining the requests in progress", sig)
+		if err := p.Shutdown(context.Background()); err != nil {
+			errorLog.Printf("Error shutting down: %v", err)
+		}
+	}()
+}
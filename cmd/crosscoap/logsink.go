@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// syslogPrefix starts the -errorlog, -accesslog and -auditlog values naming
+// a syslog sink rather than a file: "syslog:" for the local syslog daemon,
+// or "syslog+udp://HOST:PORT" and "syslog+tcp://HOST:PORT" for a remote one.
+const syslogPrefix = "syslog"
+
+// openLog opens the log sink name, of errors if isError (logged with the
+// error severity to syslog), else of requests.  The returned closer is a
+// *rotatingFile if the sink is a file.
+func openLog(name string, isError bool) (*log.Logger, io.Closer, error) {
+	if !strings.HasPrefix(name, syslogPrefix+":") && !strings.HasPrefix(name, syslogPrefix+"+") {
+		f, err := openRotatingFile(name, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return log.New(f, "", log.LstdFlags), f, nil
+	}
+	var network, address string
+	switch rest := strings.TrimPrefix(name, syslogPrefix); {
+	case rest == ":" || rest == "://":
+	case strings.HasPrefix(rest, "+udp://"):
+		network, address = "udp", strings.TrimPrefix(rest, "+udp://")
+	case strings.HasPrefix(rest, "+tcp://"):
+		network, address = "tcp", strings.TrimPrefix(rest, "+tcp://")
+	default:
+		return nil, nil, fmt.Errorf("invalid syslog sink %q", name)
+	}
+	w, err := dialSyslog(network, address, isError)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Syslog timestamps the messages itself
+	return log.New(w, "", 0), w, nil
+}
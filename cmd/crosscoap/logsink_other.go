@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(network, address string, isError bool) (io.WriteCloser, error) {
+	return nil, errors.New("syslog isn't supported on this system")
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to the syslog daemon at address over network (the
+// local one if network is empty).
+func dialSyslog(network, address string, isError bool) (io.WriteCloser, error) {
+	priority := syslog.LOG_DAEMON | syslog.LOG_INFO
+	if isError {
+		priority = syslog.LOG_DAEMON | syslog.LOG_ERR
+	}
+	return syslog.Dial(network, address, priority, "crosscoap")
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "log"
+
+// reopenOnSignal does nothing, as there's no SIGUSR1.
+func reopenOnSignal(files []*rotatingFile, errorLog *log.Logger) {}
@@ -0,0 +1,32 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenOnSignal reopens files on SIGUSR1, so that logrotate can rotate
+// them without restarting the proxy.
+func reopenOnSignal(files []*rotatingFile, errorLog *log.Logger) {
+	if len(files) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			for _, f := range files {
+				if err := f.Reopen(); err != nil {
+					// Logging to stderr, as the error log may be the file
+					log.Printf("Error reopening %v: %v", f.name, err)
+				}
+			}
+			errorLog.Printf("Reopened the log files")
+		}
+	}()
+}
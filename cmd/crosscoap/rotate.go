@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file which is renamed with a ".1" suffix, replacing
+// the previous one, when it would grow over maxSize bytes (if positive).  It
+// can also be reopened after being rotated by another program, such as
+// logrotate.
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(name string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.file.Close()
+		err := os.Rename(f.name, f.name+".1")
+		if openErr := f.open(); openErr != nil {
+			return 0, openErr
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes the file and opens it again by name.
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.file.Close()
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-coap"
+	"github.com/ibm-security-innovation/crosscoap"
+)
+
+// optionFormat is how the send command reads and prints an option value.
+type optionFormat int
+
+const (
+	opaqueFormat optionFormat = iota
+	uintFormat
+	stringFormat
+	blockFormat
+)
+
+// knownOptions are the options whose name and format the send command
+// knows.
+var knownOptions = map[uint16]struct {
+	name   string
+	format optionFormat
+}{
+	1:     {"If-Match", opaqueFormat},
+	3:     {"Uri-Host", stringFormat},
+	4:     {"ETag", opaqueFormat},
+	5:     {"If-None-Match", opaqueFormat},
+	6:     {"Observe", uintFormat},
+	7:     {"Uri-Port", uintFormat},
+	8:     {"Location-Path", stringFormat},
+	9:     {"OSCORE", opaqueFormat},
+	11:    {"Uri-Path", stringFormat},
+	12:    {"Content-Format", uintFormat},
+	14:    {"Max-Age", uintFormat},
+	15:    {"Uri-Query", stringFormat},
+	17:    {"Accept", uintFormat},
+	20:    {"Location-Query", stringFormat},
+	23:    {"Block2", blockFormat},
+	27:    {"Block1", blockFormat},
+	28:    {"Size2", uintFormat},
+	35:    {"Proxy-Uri", stringFormat},
+	39:    {"Proxy-Scheme", stringFormat},
+	60:    {"Size1", uintFormat},
+	252:   {"Echo", opaqueFormat},
+	258:   {"No-Response", uintFormat},
+	292:   {"Request-Tag", opaqueFormat},
+	65000: {"Stale", opaqueFormat},
+}
+
+// sendOptions are the -option values of the send command.
+var sendOptions stringList
+
+// parseSendOption parses an -option 'NUMBER|NAME=VALUE', whose value is
+// read in the format of the option, or as hex with a 0x prefix.
+func parseSendOption(s string) (crosscoap.ClientOption, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return crosscoap.ClientOption{}, fmt.Errorf("invalid option %q", s)
+	}
+	id, format := uint16(0), opaqueFormat
+	if n, err := strconv.ParseUint(kv[0], 10, 16); err == nil {
+		id = uint16(n)
+		format = knownOptions[id].format
+	} else {
+		for number, known := range knownOptions {
+			if strings.EqualFold(known.name, kv[0]) {
+				id, format = number, known.format
+			}
+		}
+		if id == 0 {
+			return crosscoap.ClientOption{}, fmt.Errorf("unknown option in %q", s)
+		}
+	}
+	value := kv[1]
+	switch {
+	case strings.HasPrefix(value, "0x"):
+		b, err := hex.DecodeString(value[2:])
+		if err != nil {
+			return crosscoap.ClientOption{}, fmt.Errorf("invalid hex value in %q", s)
+		}
+		return crosscoap.ClientOption{ID: id, Value: b}, nil
+	case format == uintFormat:
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return crosscoap.ClientOption{}, fmt.Errorf("invalid value in %q", s)
+		}
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		return crosscoap.ClientOption{ID: id, Value: b}, nil
+	case format == opaqueFormat && value != "":
+		return crosscoap.ClientOption{}, fmt.Errorf("value of %q must be hex, prefixed by 0x", s)
+	}
+	return crosscoap.ClientOption{ID: id, Value: []byte(value)}, nil
+}
+
+// runSend is the send command: it sends a CoAP request to the server of a
+// coap:// URI and prints the response.
+func runSend(args []string) error {
+	fs := flag.NewFlagSet("crosscoap send", flag.ExitOnError)
+	method := fs.String("method", "GET", "Request method: GET, POST, PUT, DELETE, FETCH, PATCH or IPATCH")
+	non := fs.Bool("non", false, "Send a non-confirmable request")
+	payload := fs.String("payload", "", "Request payload, or @FILE to read it from a file (- for stdin)")
+	contentFormat := fs.Int("contentformat", -1, "Content-Format of the payload (default is none)")
+	accept := fs.Int("accept", -1, "Accept option (default is none)")
+	block1 := fs.Int("block1", 0, "Block size (16 to 1024) in which a larger payload is uploaded with Block1 (default is a single message)")
+	block2 := fs.Int("block2", 0, "Block size (16 to 1024) asked for the response with Block2 (default is the server's choice)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for the response once the request is acknowledged, or after a NON request")
+	verbose := fs.Bool("v", false, "Also print the request, and the response payload in hex")
+	fs.Var(&sendOptions, "option", "Option 'NUMBER|NAME=VALUE', the value being a number or string as the option requires, or hex prefixed by 0x (may be repeated)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: crosscoap send [FLAGS] coap://HOST[:PORT]/PATH[?QUERY]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil || u.Scheme != "coap" || u.Host == "" {
+		return fmt.Errorf("invalid URI %q: only coap://HOST[:PORT]/PATH[?QUERY] is supported", fs.Arg(0))
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "5683")
+	}
+	m := coap.Message{Type: coap.Confirmable}
+	if *non {
+		m.Type = coap.NonConfirmable
+	}
+	code, found := coapMethods[strings.ToUpper(*method)]
+	if !found {
+		return fmt.Errorf("invalid method %q", *method)
+	}
+	m.Code = code
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		m.SetPathString(path)
+	}
+	if u.RawQuery != "" {
+		for _, q := range strings.Split(u.RawQuery, "&") {
+			if unescaped, err := url.QueryUnescape(q); err == nil {
+				q = unescaped
+			}
+			m.AddOption(coap.URIQuery, q)
+		}
+	}
+	if *contentFormat >= 0 {
+		m.SetOption(coap.ContentFormat, coap.MediaType(*contentFormat))
+	}
+	if *accept >= 0 {
+		m.SetOption(coap.Accept, coap.MediaType(*accept))
+	}
+	if m.Payload, err = readPayload(*payload); err != nil {
+		return err
+	}
+	var options []crosscoap.ClientOption
+	for _, s := range sendOptions {
+		o, err := parseSendOption(s)
+		if err != nil {
+			return err
+		}
+		options = append(options, o)
+	}
+
+	c, err := crosscoap.DialClient(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.Timeout, c.Block1Size, c.Block2Size = *timeout, *block1, *block2
+	if *verbose {
+		fmt.Printf("> %v %v %v from %v (%v bytes)\n", m.Type, m.Code, fs.Arg(0), c.LocalAddr(), len(m.Payload))
+	}
+	start := time.Now()
+	resp, err := c.Do(m, options...)
+	if err != nil {
+		if errors.Is(err, crosscoap.ErrNoResponse) {
+			return fmt.Errorf("no response from %v after %v", addr, time.Since(start).Round(time.Millisecond))
+		}
+		return err
+	}
+	printResponse(os.Stdout, resp, time.Since(start), *verbose)
+	return nil
+}
+
+// readPayload returns the payload given as -payload.
+func readPayload(s string) ([]byte, error) {
+	switch {
+	case s == "@-":
+		return ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(s, "@"):
+		return ioutil.ReadFile(s[1:])
+	}
+	return []byte(s), nil
+}
+
+// printResponse prints the code, options and payload of resp.
+func printResponse(w io.Writer, resp *crosscoap.ClientResponse, elapsed time.Duration, verbose bool) {
+	code := fmt.Sprintf("%d.%02d", resp.Code>>5, resp.Code&0x1f)
+	if name := resp.Code.String(); !strings.HasPrefix(name, "Unknown") {
+		code += " " + name
+	}
+	fmt.Fprintf(w, "%v (%v, %v in %v message(s), %v retransmission(s))\n", code, resp.Type, elapsed.Round(time.Microsecond), resp.Messages, resp.Retransmissions)
+	formats := crosscoap.DefaultContentFormats()
+	var contentFormat int64 = -1
+	for _, o := range resp.Options {
+		known, found := knownOptions[o.ID]
+		name := known.name
+		if !found {
+			name = fmt.Sprintf("Option %v", o.ID)
+		}
+		var value string
+		switch known.format {
+		case uintFormat:
+			n := optionUint(o.Value)
+			value = strconv.FormatUint(uint64(n), 10)
+			if o.ID == uint16(coap.ContentFormat) {
+				contentFormat = int64(n)
+				if content, found := formats[coap.MediaType(n)]; found {
+					value += " (" + content.Type + ")"
+				}
+			}
+		case blockFormat:
+			n := optionUint(o.Value)
+			value = fmt.Sprintf("%v/%v/%v", n>>4, n>>3&1, 1<<(n&7+4))
+		case stringFormat:
+			value = strconv.Quote(string(o.Value))
+		default:
+			value = "0x" + hex.EncodeToString(o.Value)
+		}
+		fmt.Fprintf(w, "%v: %v\n", name, value)
+	}
+	if len(resp.Payload) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	var indented bytes.Buffer
+	switch {
+	case contentFormat == int64(coap.AppJSON) && json.Indent(&indented, resp.Payload, "", "  ") == nil:
+		fmt.Fprintln(w, indented.String())
+	case utf8.Valid(resp.Payload) && contentFormat != int64(coap.AppOctets) && contentFormat != 60:
+		fmt.Fprintln(w, strings.TrimRight(string(resp.Payload), "\n"))
+	default:
+		verbose = true
+	}
+	if verbose {
+		fmt.Fprint(w, hex.Dump(resp.Payload))
+	}
+}
+
+func optionUint(value []byte) uint32 {
+	var n uint32
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+	return n
+}
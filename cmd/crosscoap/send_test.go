@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ibm-security-innovation/crosscoap/crosscoaptest"
+)
+
+func TestRunSend(t *testing.T) {
+	s := crosscoaptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"temp":21}`))
+	}))
+	defer s.Close()
+	for _, uri := range []string{"coap://" + s.Addr + "/", "coap://" + s.Addr + "/sensors/temp?unit=c"} {
+		output, err := captureStdout(t, func() error {
+			return runSend([]string{"-method", "GET", uri})
+		})
+		if err != nil {
+			t.Fatalf("%v: error is %v", uri, err)
+		}
+		if !strings.HasPrefix(output, "2.05 Content") || !strings.Contains(output, `"temp": 21`) {
+			t.Errorf("%v: output is %v", uri, output)
+		}
+	}
+	if r := s.LastRequest(); r == nil || r.URL.Path != "/sensors/temp" || r.URL.RawQuery != "unit=c" {
+		t.Errorf("last backend request is %v", r)
+	}
+	if err := runSend([]string{"http://" + s.Addr + "/"}); err == nil {
+		t.Errorf("sending to an http URI succeeded")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listenFDsEnv names the sockets which a crosscoap process upgrading on
+// SIGUSR2 hands over to the one it execs, such as "udp :5683,admin
+// 127.0.0.1:8080,ready", in the order of their file descriptors from 3.
+// "ready" is the pipe written to by the new process once it serves.
+const listenFDsEnv = "CROSSCOAP_LISTEN_FDS"
+
+// handedOverSocket is a socket which a crosscoap process upgrading on
+// SIGUSR2 hands over to the one it execs.
+type handedOverSocket struct {
+	name string
+	conn interface {
+		File() (*os.File, error)
+	}
+}
+
+// inheritedFiles are the sockets handed over by the crosscoap process which
+// exec'd this one, by name.
+var inheritedFiles = make(map[string][]*os.File)
+
+// readyPipe is written to once this process serves, if it was exec'd by an
+// upgrading crosscoap.
+var readyPipe *os.File
+
+// inheritSockets reads the sockets handed over by the crosscoap process
+// which exec'd this one, if any.
+func inheritSockets() {
+	names := os.Getenv(listenFDsEnv)
+	if names == "" {
+		return
+	}
+	// Not handed over to the processes exec'd in turn
+	os.Unsetenv(listenFDsEnv)
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		if name == "ready" {
+			readyPipe = f
+			continue
+		}
+		inheritedFiles[name] = append(inheritedFiles[name], f)
+	}
+}
+
+// inheritedUDP returns the UDP listeners named name handed over to this
+// process.
+func inheritedUDP(name string) ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+	for _, f := range inheritedFiles[name] {
+		conn, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting %v: %v", name, err)
+		}
+		udpConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			return nil, fmt.Errorf("inheriting %v: not a UDP socket", name)
+		}
+		conns = append(conns, udpConn)
+	}
+	delete(inheritedFiles, name)
+	return conns, nil
+}
+
+// inheritedListener returns the TCP listener named name handed over to this
+// process, or nil.
+func inheritedListener(name string) (net.Listener, error) {
+	files := inheritedFiles[name]
+	if len(files) == 0 {
+		return nil, nil
+	}
+	delete(inheritedFiles, name)
+	for _, f := range files[1:] {
+		f.Close()
+	}
+	l, err := net.FileListener(files[0])
+	files[0].Close()
+	if err != nil {
+		return nil, fmt.Errorf("inheriting %v: %v", name, err)
+	}
+	return l, nil
+}
+
+// signalReady closes the sockets handed over to this process which it
+// doesn't use, as its flags changed, and tells the upgrading crosscoap
+// which exec'd it that it serves.
+func signalReady() {
+	for _, files := range inheritedFiles {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	inheritedFiles = nil
+	if readyPipe != nil {
+		readyPipe.Write([]byte{1})
+		readyPipe.Close()
+		readyPipe = nil
+	}
+}
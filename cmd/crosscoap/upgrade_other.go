@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"log"
+
+	"github.com/ibm-security-innovation/crosscoap"
+)
+
+// upgradeOnSignal does nothing, as there's no SIGUSR2.
+func upgradeOnSignal(p *crosscoap.Proxy, sockets []handedOverSocket, errorLog *log.Logger) {}
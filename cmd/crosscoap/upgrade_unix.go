@@ -0,0 +1,100 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ibm-security-innovation/crosscoap"
+)
+
+// upgradeTimeout is how long an upgrading crosscoap waits for the process
+// it exec'd to serve, before killing it and serving on.
+const upgradeTimeout = 30 * time.Second
+
+// upgradeOnSignal execs the crosscoap binary anew on SIGUSR2, handing the
+// sockets over to it, and once it serves hands p over to it, so that
+// crosscoap is upgraded without dropping the requests in progress.
+func upgradeOnSignal(p *crosscoap.Proxy, sockets []handedOverSocket, errorLog *log.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for range c {
+			pid, err := upgrade(sockets)
+			if err != nil {
+				errorLog.Printf("Error upgrading, serving on: %v", err)
+				continue
+			}
+			signal.Stop(c)
+			errorLog.Printf("Upgraded to process %v, draining the requests in progress", pid)
+			if err := p.Handover(context.Background()); err != nil {
+				errorLog.Printf("Error handing over: %v", err)
+			}
+			return
+		}
+	}()
+}
+
+// upgrade execs the crosscoap binary with the same arguments and the
+// sockets, and returns its process ID once it serves.
+func upgrade(sockets []handedOverSocket) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	var names []string
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		files = nil
+	}
+	defer closeFiles()
+	for _, s := range sockets {
+		f, err := s.conn.File()
+		if err != nil {
+			readyWriter.Close()
+			return 0, fmt.Errorf("handing %v over: %v", s.name, err)
+		}
+		names = append(names, s.name)
+		files = append(files, f)
+	}
+	names = append(names, "ready")
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	// Reaps the new process if it fails
+	go cmd.Wait()
+	closeFiles()
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		if err == io.EOF {
+			return 0, fmt.Errorf("process %v exited", cmd.Process.Pid)
+		}
+		return 0, fmt.Errorf("process %v not serving: %v", cmd.Process.Pid, err)
+	}
+	return cmd.Process.Pid, nil
+}
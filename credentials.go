@@ -0,0 +1,53 @@
+package crosscoap
+
+import (
+	"net/http"
+
+	"github.com/dustin/go-coap"
+)
+
+// metricCredentialLookups counts the backend requests of devices, labeled by
+// outcome of the lookup of their own credentials: found, missing (sent
+// with the shared credentials) or rejected.
+const metricCredentialLookups = "credential_lookups"
+
+// credentialIdentity returns the identity under which the credentials of
+// the request m in the exchange rc are looked up: the authenticated
+// identity of the client, else the Uri-Host option of m if
+// CredentialsByURIHost is set, else "".
+func (p *proxyHandler) credentialIdentity(rc *RequestContext, m *coap.Message) string {
+	if rc.Identity != "" {
+		return rc.Identity
+	}
+	if p.CredentialsByURIHost {
+		if host, ok := uriHost(m); ok {
+			return host
+		}
+	}
+	return ""
+}
+
+// credentials returns the headers of the credentials of the device sending
+// the request m in the exchange rc, which replace those of its backend
+// request, and whether the request may be sent: always, unless
+// RequireCredentials is set and the device has no credentials.
+func (p *proxyHandler) credentials(rc *RequestContext, m *coap.Message) (http.Header, bool) {
+	if p.BackendCredentials == nil {
+		return nil, true
+	}
+	var header http.Header
+	found := false
+	if identity := p.credentialIdentity(rc, m); identity != "" {
+		header, found = p.BackendCredentials(identity)
+	}
+	switch {
+	case found:
+		p.metrics().Counter(metricCredentialLookups, 1, Labels{"outcome": "found"})
+	case p.RequireCredentials:
+		p.metrics().Counter(metricCredentialLookups, 1, Labels{"outcome": "rejected"})
+		return nil, false
+	default:
+		p.metrics().Counter(metricCredentialLookups, 1, Labels{"outcome": "missing"})
+	}
+	return header, true
+}
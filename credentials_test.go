@@ -0,0 +1,114 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestBackendCredentials(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	credentials := map[string]http.Header{
+		"sensor-1": {"Authorization": {"Bearer sensor-1"}},
+	}
+	proxy := Proxy{
+		Listener:             udpListener,
+		BackendURL:           backend.URL,
+		DefaultHeaders:       http.Header{"Authorization": {"Bearer gateway"}},
+		CredentialsByURIHost: true,
+		BackendCredentials: func(identity string) (http.Header, bool) {
+			header, found := credentials[identity]
+			return header, found
+		},
+	}
+	go proxy.Serve()
+
+	c, err := DialClient(crosscoapAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := coap.Message{Code: coap.GET}
+	req.SetPathString("/telemetry")
+	req.SetOption(coap.URIHost, "sensor-1")
+	if resp, err := c.Do(req); err != nil || string(resp.Payload) != "Bearer sensor-1" {
+		t.Errorf("response with device credentials is %+v (error %v)", resp, err)
+	}
+	req.SetOption(coap.URIHost, "sensor-2")
+	if resp, err := c.Do(req); err != nil || string(resp.Payload) != "Bearer gateway" {
+		t.Errorf("response with shared credentials is %+v (error %v)", resp, err)
+	}
+}
+
+func TestRequireCredentials(t *testing.T) {
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{
+		Listener:           udpListener,
+		BackendURL:         "http://127.0.0.1:1",
+		RequireCredentials: true,
+		BackendCredentials: func(identity string) (http.Header, bool) { return nil, false },
+	}
+	go proxy.Serve()
+
+	c, err := DialClient(crosscoapAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := coap.Message{Code: coap.GET}
+	req.SetPathString("/telemetry")
+	if resp, err := c.Do(req); err != nil || resp.Code != coap.Unauthorized {
+		t.Errorf("response without credentials is %+v (error %v)", resp, err)
+	}
+}
+
+func TestCredentialIdentity(t *testing.T) {
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1"})
+	m := &coap.Message{Code: coap.GET}
+	m.SetOption(coap.URIHost, "sensor-1")
+	if identity := p.credentialIdentity(&RequestContext{}, m); identity != "" {
+		t.Errorf("identity without CredentialsByURIHost is '%v'", identity)
+	}
+	p.CredentialsByURIHost = true
+	if identity := p.credentialIdentity(&RequestContext{}, m); identity != "sensor-1" {
+		t.Errorf("Uri-Host identity is '%v'", identity)
+	}
+	if identity := p.credentialIdentity(&RequestContext{Identity: "oscore:01"}, m); identity != "oscore:01" {
+		t.Errorf("OSCORE identity is '%v'", identity)
+	}
+}
+
+func TestBackendCredentialsUncached(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("data of " + r.Header.Get("X-Api-Key")))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{
+		BackendURL:           backend.URL,
+		BackendHost:          "backend.example",
+		CacheMaxSize:         1 << 20,
+		CredentialsByURIHost: true,
+		BackendCredentials: func(identity string) (http.Header, bool) {
+			return http.Header{"X-Api-Key": {"key-" + identity}}, true
+		},
+	})
+	for _, device := range []string{"dev-a", "dev-b", "dev-a"} {
+		m := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString("/telemetry")
+		m.SetOption(coap.URIHost, device)
+		coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}, &m, nil, nil)
+		if coapResp == nil || string(coapResp.Payload) != "data of key-"+device {
+			t.Errorf("%v: response is %v", device, coapResp)
+		}
+	}
+}
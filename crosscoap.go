@@ -41,6 +41,11 @@
 package crosscoap
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -57,84 +62,1354 @@ type Proxy struct {
 	// A UDP listener that will accept the incoming CoAP requests.
 	Listener *net.UDPConn
 
+	// Listeners are optional additional UDP listeners, each served by its
+	// own read loop: listeners on other addresses (e.g. [::]:5683 besides
+	// 0.0.0.0:5683), or bound to the same address as Listener with
+	// SO_REUSEPORT (see ListenReusePort) to spread the load across cores.
+	// All of them share the proxy's state, and responses are sent from the
+	// listener the request was received on.
+	Listeners []*net.UDPConn
+
 	// URL of the HTTP (or HTTPS) backend server to which requests will be
 	// proxied.
 	BackendURL string
 
-	// Timeout for requests to the HTTP backend.  If nil, a default of 5
-	// seconds is used.
+	// BackendResolver optionally locates the servers behind BackendURL, for
+	// instance from DNS SRV records (SRVResolver) or a Consul service
+	// (ConsulResolver): requests to BackendURL are then sent to the
+	// resolved addresses in turn, with the Host header of BackendURL.  The
+	// addresses are resolved again every BackendResolveInterval (by default
+	// 30 seconds), keeping the previous ones if that fails, and the idle
+	// connections are closed when they change.  Without BackendResolver, a
+	// positive BackendResolveInterval makes the proxy resolve the host of
+	// BackendURL with DNS likewise, so that it follows the pods of a
+	// headless Kubernetes service instead of pinning terminated ones.
+	BackendResolver        BackendResolver
+	BackendResolveInterval time.Duration
+
+	// BackendStrategy chooses the resolved backend address of each request
+	// (by default NewRoundRobinStrategy), and BackendWeights are the static
+	// weights of addresses (1 if not listed) given to it.
+	BackendStrategy BackendStrategy
+	BackendWeights  map[string]float64
+
+	// Timeout for requests to the HTTP backend, from connection to the end
+	// of the response body.  If nil, a default of 5 seconds is used.
 	Timeout *time.Duration
 
+	// DialTimeout limits the time taken to connect to the backend, within
+	// the overall Timeout.  If zero, the default of 30 seconds is used.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout limits the time taken by TLS handshakes with the
+	// backend.  If zero, the default of 10 seconds is used.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout limits the time between sending a request and
+	// receiving the response headers from the backend, so that a backend
+	// which accepts connections but doesn't answer fails fast, while a
+	// large response body may still use the rest of Timeout.  If zero,
+	// only Timeout applies.
+	ResponseHeaderTimeout time.Duration
+
 	// AccessLog specifies an optional logger which records each incoming
 	// request received by the proxy.  If nil, requests are not logged.
 	AccessLog *log.Logger
 
+	// AccessLogFormat optionally replaces the line logged to AccessLog
+	// when a request arrives by a line in this format logged once it has
+	// been answered (see ParseAccessLogFormat).
+	AccessLogFormat *AccessLogFormat
+
+	// AuditLog specifies an optional logger which records the full context
+	// of each request answered with a 4.xx or 5.xx response: the client,
+	// the CoAP request, the backend URL, the backend status or error, and
+	// the latency.
+	AuditLog *log.Logger
+
 	// ErrorLog specifies an optional logger for errors that occur when
 	// attempting to proxy the request.  If nil, error logging goes to
 	// os.Stderr via the log package's standard logger.
 	ErrorLog *log.Logger
+
+	// SigV4 specifies an optional AWS Signature Version 4 signer which is
+	// applied to each translated HTTP request before it is sent to the
+	// backend.  If nil, requests are not signed.
+	SigV4 *SigV4Signer
+
+	// HMAC specifies an optional signer which adds an HMAC signature of
+	// the method, path, timestamp and body of the backend requests, so
+	// that the backend can verify that they came from the proxy.  It's
+	// applied after SigV4.
+	HMAC *HMACSigner
+
+	// AccessPolicy specifies optional allow/deny rules over the CoAP method
+	// and path which are checked before a request is translated.  If nil,
+	// all requests are proxied.
+	AccessPolicy *AccessPolicy
+
+	// Authenticators optionally authenticate the CoAP clients before their
+	// requests are translated, in order: the first one which finds
+	// credentials in a request denies it, or tells its principal, which
+	// AccessPolicy rules can match, PrincipalHeader forwards and the logs
+	// show.  Requests without credentials go on anonymously, unless
+	// RequireAuthentication is set.  The responses to authenticated
+	// requests aren't cached.
+	Authenticators []Authenticator
+
+	// RequireAuthentication answers the requests which no Authenticator
+	// authenticates with 4.01 Unauthorized.
+	RequireAuthentication bool
+
+	// PrincipalHeader, if set, is the header telling the backend the
+	// principal of the authenticated requests, such as X-Principal.  It's
+	// removed from the other requests.
+	PrincipalHeader string
+
+	// AllowedClients optionally restricts the proxy to clients whose UDP
+	// address lies in one of the given networks.  If empty, all clients
+	// which are not denied are allowed.
+	AllowedClients []*net.IPNet
+
+	// DeniedClients lists networks whose clients are refused; it takes
+	// precedence over AllowedClients.
+	DeniedClients []*net.IPNet
+
+	// RejectDeniedClients makes the proxy answer confirmable requests from
+	// denied clients with 4.03 Forbidden.  By default denied clients get no
+	// response at all, so that spoofed requests can't be used for traffic
+	// amplification.
+	RejectDeniedClients bool
+
+	// VerifyClientAddresses makes the proxy forward only the requests of
+	// clients which have proven that they receive packets at their source
+	// address: the others get a 4.01 Unauthorized with an Echo option (RFC
+	// 9175) without the backend being contacted, and are proxied once they
+	// repeat the request with it.  Echo values are valid for a minute.  This
+	// keeps spoofed requests from using the proxy for traffic amplification
+	// (RFC 7252 section 11.3) or reaching the backend.
+	VerifyClientAddresses bool
+
+	// AmplificationLimit caps the bytes sent to each client endpoint which
+	// hasn't verified its address to that many times the bytes received
+	// from it, with a token bucket credited by each packet received, so
+	// that separate responses, notifications and repeated requests can't
+	// amplify traffic either.  A response beyond the budget is replaced by
+	// a 4.01 Unauthorized with an Echo option, which verifies the endpoint
+	// once repeated (RFC 9175 section 2.4), and other messages are dropped.
+	// Zero (the default) disables the guard.
+	AmplificationLimit int
+
+	// MaxRequestBodyBytes limits the size of CoAP request payloads accepted
+	// by the proxy.  Larger requests are answered with 4.13 Request Entity
+	// Too Large carrying a Size1 option which advertises the limit.  If zero,
+	// the payload size is not limited.
+	MaxRequestBodyBytes int
+
+	// StreamBlock1 makes the proxy stream the payload of Block1 uploads (RFC
+	// 7959) to the backend as the blocks arrive, in a chunked HTTP request
+	// opened on the first block, instead of reassembling the whole payload
+	// in memory before proxying the request.  Middleware and the Director
+	// only see the first block, and the upload must complete within the
+	// backend timeout.  Payloads which the proxy converts or signs are
+	// always reassembled.
+	StreamBlock1 bool
+
+	// StreamBlock2 makes the proxy serve responses which don't fit in a
+	// CoAP packet with Block2 (RFC 7959) instead of truncating them.  The
+	// backend body is read as the client fetches the blocks, keeping at
+	// most two blocks in memory per response; the timeout then only applies
+	// until the first block is read.  Bodies which the proxy converts are
+	// still read whole.
+	StreamBlock2 bool
+
+	// OversizePolicy is what the proxy does with responses which don't fit
+	// in a CoAP packet: truncate them (the default, or Block2Oversize with
+	// StreamBlock2), serve them with Block2 (reading the whole body unless
+	// StreamBlock2 is set), compress them, or reject them.  Routes may
+	// override it.
+	OversizePolicy OversizePolicy
+
+	// RouteOversizePolicies override OversizePolicy for requests whose path
+	// lies below a prefix, after Routes.
+	//
+	// Deprecated: use the Oversize of Routes.
+	RouteOversizePolicies []RouteOversizePolicy
+
+	// OSCOREBackendURL is the URL of a backend which terminates OSCORE (RFC
+	// 8613).  Requests protected with OSCORE which don't match one of
+	// OSCOREContexts are forwarded to it unchanged, mapped to HTTP as
+	// specified in RFC 8613 section 11, and its protected responses are
+	// returned as they are.  If empty, such requests are rejected.
+	OSCOREBackendURL string
+
+	// OSCOREContexts makes the proxy terminate OSCORE for the clients
+	// sharing these security contexts: their requests are decrypted and
+	// proxied like unprotected ones, and the responses are protected.  Only
+	// AES-CCM-16-64-128 is supported, without outer block-wise transfers or
+	// Observe.  The replay window of a context starts with a request
+	// echoing an Echo option (RFC 8613 appendix B.1.2), so each client's
+	// first request after the proxy starts gets a protected 4.01
+	// Unauthorized challenge.
+	OSCOREContexts []OSCOREContext
+
+	// OSCOREContextSource, if set, supplies security contexts in addition
+	// to OSCOREContexts, for example from a file or a device database.  It's
+	// called when the proxy starts and then every OSCOREReloadInterval (10
+	// seconds if zero), so that devices are onboarded and their secrets
+	// rotated without a restart: the contexts which didn't change keep
+	// their replay window, and new or changed ones start with an Echo
+	// challenge.  If it fails, the previous contexts are kept.
+	OSCOREContextSource  func() ([]OSCOREContext, error)
+	OSCOREReloadInterval time.Duration
+
+	// DiagnosticPayloads makes the proxy include a short human-readable
+	// reason (for example "backend timeout after 5s") as the payload of
+	// the 4.xx and 5.xx responses it generates, as allowed by RFC 7252
+	// section 5.5.2.  Off by default.
+	DiagnosticPayloads bool
+
+	// StrictContentFormat makes the proxy answer requests whose
+	// Content-Format has no known HTTP Content-Type with 4.15 Unsupported
+	// Content-Format.  By default such requests are forwarded with
+	// DefaultContentType.
+	StrictContentFormat bool
+
+	// DefaultContentType is the HTTP Content-Type used for requests whose
+	// Content-Format is unknown (unless StrictContentFormat is set).  If
+	// empty, these requests are forwarded without a Content-Type.
+	DefaultContentType string
+
+	// TranscodeCBOR makes the proxy serve CBOR clients from a JSON-only
+	// backend: CBOR request payloads are converted to JSON, and JSON
+	// responses are converted to CBOR when the request's Accept option asks
+	// for CBOR (Content-Format 60).
+	TranscodeCBOR bool
+
+	// PayloadTransformers reshape the payloads of the requests to some
+	// paths and of their responses; the first one matching the request
+	// path applies.
+	PayloadTransformers []PayloadTransformer
+
+	// RequestValidator optionally checks requests, once translated to HTTP,
+	// against an OpenAPI document or JSON Schemas, and answers the invalid
+	// ones with 4.00 (Bad Request) without forwarding them.
+	RequestValidator *RequestValidator
+
+	// TranscodeResponses makes the proxy convert backend responses to the
+	// representation asked for by the request's Accept option when the
+	// backend doesn't provide it, with the built-in converters (JSON to
+	// CBOR and to plain text, see DefaultConverters) and the ones added by
+	// RegisterConverter.  The backend is asked for the requested
+	// representation or any convertible one.
+	TranscodeResponses bool
+
+	// NormalizeSenML makes the proxy resolve SenML request payloads
+	// (senml+json or senml+cbor) before forwarding them: base names, times,
+	// units and values are applied to every record and relative times are
+	// made absolute, so that each record is a self-contained measurement.
+	// Normalized payloads are sent as application/senml+json.
+	NormalizeSenML bool
+
+	// TranslateLinkFormat lets a backend serve discovery in JSON: responses
+	// in application/link-format+json (or plain JSON responses to
+	// /.well-known/core) are converted to RFC 6690 application/link-format
+	// for clients which don't ask for another format, and link-format
+	// request payloads are forwarded as application/link-format+json.
+	TranslateLinkFormat bool
+
+	// DeflateJSON makes the proxy compress application/json response bodies
+	// to Content-Format 11050 (JSON with deflate coding) when the request's
+	// Accept option asks for it, or when the request has no Accept option
+	// and the uncompressed body would be truncated.
+	DeflateJSON bool
+
+	// InflateRequests lists the path prefixes below which deflated JSON
+	// request payloads (Content-Format 11050) are inflated and forwarded as
+	// plain application/json, for backends which don't support
+	// Content-Encoding: deflate ("/" selects every path).  Inflated
+	// payloads over 1 MiB are rejected with 4.13 Request Entity Too Large.
+	InflateRequests []string
+
+	// OptionMappings lists CoAP options, typically proprietary ones, which
+	// are carried to the backend as HTTP headers and back.  Without a
+	// mapping, options unknown to the proxy are dropped.
+	OptionMappings []OptionMapping
+
+	// ForwardedResponseHeaders lists backend response headers (for example
+	// X-RateLimit-Remaining) which are surfaced to CoAP clients, either as
+	// a custom option or as metadata appended to the diagnostic payload of
+	// error responses.  Other response headers are not forwarded.
+	ForwardedResponseHeaders []ForwardedHeader
+
+	// AuthChallenges, if set, surfaces the WWW-Authenticate challenges of
+	// backend 401 Unauthorized responses (or selected parameters of them)
+	// to CoAP clients in a custom option or in the diagnostic payload of
+	// the 4.01 response, so that devices can refresh their credentials.
+	AuthChallenges *AuthChallengePolicy
+
+	// RouteTimeouts override Timeout for requests whose path lies below a
+	// prefix, after Routes.
+	//
+	// Deprecated: use the Timeout of Routes.
+	RouteTimeouts []RouteTimeout
+
+	// Routes override the proxy-wide defaults (timeout, payload size limit,
+	// oversize and cache policies, NON deduplication, rate limit and
+	// access logging) for requests whose path lies below a prefix, for
+	// example to give firmware downloads minutes while telemetry gets
+	// seconds.  For each setting the first matching route setting it
+	// applies; the Routes of the Tenant of a request come first.  The
+	// deprecated RouteTimeouts, RouteOversizePolicies, RouteCachePolicies
+	// and NonDeduplication are folded in after Routes when the proxy
+	// starts, and the admin API replaces them all at runtime.
+	Routes []RouteConfig
+
+	// UserAgent is the User-Agent header of backend requests.  If empty,
+	// "crosscoap/" followed by the Version is used.
+	UserAgent string
+
+	// DefaultHeaders are added to every backend request (for example an
+	// X-Gateway-ID header), unless the translated request already has them.
+	DefaultHeaders http.Header
+
+	// ExpectContinue sends the backend requests with a payload with an
+	// "Expect: 100-continue" header, so that a backend rejecting a request
+	// (for example an upload which is too large) answers before its body
+	// is sent, which matters for the uploads streamed with StreamBlock1.
+	// The 100 Continue interim response is consumed by the proxy.  Other
+	// 1xx interim responses are always skipped, and a final 1xx response
+	// is answered with 5.02 Bad Gateway.
+	ExpectContinue bool
+
+	// MapTrailers adds the trailers of backend responses (sent after a
+	// chunked body) to their headers, unless the headers already have
+	// them, so that OptionMappings, ForwardedHeaders and the other header
+	// translations apply to them.  Responses streamed with Block2 are
+	// translated before their trailers arrive, and go without them.
+	MapTrailers bool
+
+	// ForwardMessageMetadata adds the X-CoAP-Message-Type (CON or NON),
+	// X-CoAP-Token (in hex, if the token isn't empty) and X-CoAP-Message-ID
+	// headers to backend requests, so that the backend can correlate the
+	// retries of a device and tell confirmable from fire-and-forget
+	// traffic.  For a Block1 upload, they are the ones of its last block.
+	ForwardMessageMetadata bool
+
+	// ForwardClientAddress adds the X-Forwarded-For and Forwarded (RFC
+	// 7239) headers with the address of the client to backend requests,
+	// IPv6 addresses bracketed in the latter as it requires.
+	ForwardClientAddress bool
+
+	// Director is an optional function called with each translated HTTP
+	// request and the CoAP request it was translated from, just before the
+	// request is signed and sent to the backend.  It may change the URL,
+	// headers or body of the HTTP request; a replaced body should come with
+	// a matching GetBody and ContentLength.
+	Director func(*http.Request, *coap.Message)
+
+	// BackendCredentials, if set, returns the headers (such as an
+	// Authorization or API key header) authorizing at the backend the
+	// requests of the device with the identity, and whether the device has
+	// any, so that each device is authorized with its own credentials
+	// rather than the gateway's.  They replace the headers of the same name
+	// in the translated request and in DefaultHeaders.  The identity is the
+	// authenticated identity of the client (see RequestContext), else the
+	// Uri-Host option if CredentialsByURIHost is set.  The responses to the
+	// requests sent with device credentials aren't cached.
+	BackendCredentials func(identity string) (http.Header, bool)
+
+	// CredentialsByURIHost looks up the BackendCredentials of clients
+	// without an authenticated identity by the Uri-Host option of their
+	// requests.  Any client can send any Uri-Host, so this is only safe when
+	// the clients are otherwise trusted, for example by AllowedClients.
+	CredentialsByURIHost bool
+
+	// RequireCredentials rejects with 4.01 Unauthorized the requests of
+	// devices without BackendCredentials, instead of sending them with the
+	// shared DefaultHeaders.
+	RequireCredentials bool
+
+	// ModifyResponse is an optional function called with each backend
+	// response before it is translated to CoAP.  It may change the status,
+	// headers or body of the response.  If it returns an error, the client
+	// gets a ModifyResponseErrorCode response instead.
+	ModifyResponse func(*http.Response) error
+
+	// ModifyResponseErrorCode is the CoAP response code used when
+	// ModifyResponse fails.  If zero, 5.02 Bad Gateway is used.
+	ModifyResponseErrorCode coap.COAPCode
+
+	// SeparateResponseDelay is how long the proxy waits for the backend
+	// before acknowledging a confirmable request with an empty ACK; the
+	// response is then sent later as a separate confirmable message (RFC
+	// 7252 section 5.2.2), so that the client stops retransmitting its
+	// request.  If zero, responses are always piggybacked on the ACK.
+	SeparateResponseDelay time.Duration
+
+	// AckTimeout is the initial time the proxy waits for the client to
+	// acknowledge a confirmable message before retransmitting it; the
+	// timeout is doubled after each retransmission.  If zero, the RFC 7252
+	// default of 2 seconds is used.
+	AckTimeout time.Duration
+
+	// MaxRetransmit is the number of times a confirmable message is
+	// retransmitted before the proxy gives up.  If zero, the RFC 7252
+	// default of 4 is used; a negative value disables retransmission.
+	MaxRetransmit int
+
+	// ExchangeDeadlines cancels the backend request of a confirmable
+	// request answered with a piggybacked response once the client, which
+	// is assumed to use AckTimeout and MaxRetransmit too, would have given
+	// up retransmitting it (MAX_TRANSMIT_WAIT, RFC 7252 section 4.8.2),
+	// even if the backend timeout isn't over.  The abandoned exchange gets
+	// no response.
+	ExchangeDeadlines bool
+
+	// RespondToNonConfirmable makes the proxy wait for the backend response
+	// to non-confirmable requests and send it back to the client as a
+	// non-confirmable message with the request's token.  By default
+	// non-confirmable requests are forwarded without any response.  In
+	// any case, the response classes suppressed by a request's No-Response
+	// option (RFC 7967) aren't sent, but for an empty ACK to confirmable
+	// requests.
+	RespondToNonConfirmable bool
+
+	// CanaryRoutes send a share of the requests below some paths to other
+	// backends, to try a new backend version on some devices; the first
+	// matching route applies.
+	CanaryRoutes []CanaryRoute
+
+	// ObserveInterval, if positive, makes GET requests with the Observe
+	// option register the client as an observer of the resource (RFC
+	// 7641): the proxy polls the backend for it after the Max-Age of the
+	// last response (derived from the backend's Cache-Control or Expires
+	// headers), or else at this interval, asking for the representation
+	// only if its ETag has changed, and sends the client a confirmable
+	// notification whenever the ETag (or else the content) changes.
+	// An observer is removed when it deregisters (GET with Observe=1),
+	// rejects a notification with RST or doesn't acknowledge it, gets an
+	// error notification, or doesn't register again within
+	// ObserveLifetime (one hour if zero).
+	ObserveInterval time.Duration
+	ObserveLifetime time.Duration
+
+	// ObserveMaxBackoff, if positive, makes the polling of an observed
+	// resource back off: the delay until the next poll doubles after each
+	// poll which finds the representation unchanged or gets a 5.02, 5.03
+	// or 5.04 error (which is then retried rather than notified), up to
+	// this maximum, and is reset on a change.  Each delay is also moved
+	// randomly by up to 20%, so that the polls of many resources registered
+	// at once spread out.
+	ObserveMaxBackoff time.Duration
+
+	// QueueSize, if positive, enables queue mode for sleepy devices: the
+	// admin API's POST /push queues requests to a device, up to QueueSize
+	// per device, which are delivered when the device next contacts the
+	// proxy.  Requests not delivered within QueueTTL (one day if zero) are
+	// dropped.
+	QueueSize int
+	QueueTTL  time.Duration
+
+	// Devices, if set, keeps track of the endpoints of devices by ID, for
+	// the push API.
+	Devices *DeviceRegistry
+
+	// SessionTTL, if positive, keeps a cookie jar per client (by device ID
+	// if Devices knows the client, else by UDP endpoint), so that
+	// consecutive requests of a device reuse the session cookies set by the
+	// backend.  A session idle for SessionTTL is forgotten.
+	SessionTTL time.Duration
+
+	// CacheMaxSize, if positive, keeps the backend responses to GET
+	// requests without credentials or cookies, up to this many bytes, while
+	// they are fresh according to their Cache-Control or Expires headers,
+	// separately for each Accept option and for the values of the request
+	// headers named by their Vary header; the least recently used ones are
+	// evicted first.  Error responses (4xx
+	// and 5xx) are only kept for NegativeCacheTTL (at most their own
+	// max-age), so that devices retrying a missing resource don't hammer
+	// the backend; with zero, they're not cached.
+	CacheMaxSize     int
+	NegativeCacheTTL time.Duration
+
+	// Prefetch lists resources, as paths with an optional query (such as
+	// /config?model=a), whose backend responses are fetched into the cache
+	// when the proxy starts serving and refreshed shortly before they
+	// expire, so that the devices polling them after a restart are served
+	// from the cache.  A resource whose response can't be cached is tried
+	// again after a minute.  It needs CacheMaxSize.
+	Prefetch []string
+
+	// RouteCachePolicies override the caching of the responses to requests
+	// below a path prefix, after Routes.
+	//
+	// Deprecated: use the CacheTTL, CacheBypass and CacheMethods of Routes.
+	RouteCachePolicies []RouteCachePolicy
+
+	// ServeStale, if positive, keeps the successful cached responses for
+	// this long after they expire, and serves them when the backend can't
+	// be reached or answers with a 5xx error, so that devices keep working
+	// on slightly old data.  Such a response has a Max-Age of 0 and the
+	// elective option 65000 without value (its backend response has a
+	// Warning: 110 header, as in the access log).  It needs CacheMaxSize.
+	ServeStale time.Duration
+
+	// RevalidateDownloads revalidates the cached responses with an ETag
+	// served with Block2 once they go stale in the middle of the download,
+	// with an If-None-Match backend request before each of the following
+	// blocks until it's fresh again.  If the representation changed, the
+	// download is aborted with 4.08 Request Entity Incomplete and the
+	// client has to restart it, so that a device never assembles blocks of
+	// two versions of, say, a firmware image.
+	RevalidateDownloads bool
+
+	// DrainTimeout is the time for which Shutdown keeps serving the
+	// requests in progress (30 seconds if zero).
+	DrainTimeout time.Duration
+
+	// Tenants share the proxy, each with its own requests, backend and
+	// rate limit, and tagged in the logs.
+	Tenants []Tenant
+
+	// DryRun makes the proxy translate requests fully but log the backend
+	// requests (method, URL, headers without credentials, and body length
+	// and SHA-256 digest) to AccessLog, or else ErrorLog, instead of sending
+	// them, and answer 2.05 Content with the method and URL, to validate
+	// mapping rules before going live.
+	DryRun bool
+
+	// ShadowBackendURL optionally receives a copy of every request sent to
+	// the backend, in the background and with its response discarded, to
+	// validate a new backend version with real device traffic.  The path
+	// of BackendURL in the request URL is replaced with the one of
+	// ShadowBackendURL.  Requests with a streamed body aren't mirrored, nor
+	// any while 64 mirrored requests are in flight.
+	ShadowBackendURL string
+
+	// FailoverBackendURLs are tried in order after BackendURL when it can't
+	// be reached or answers with a 5xx status, for requests with an
+	// idempotent method (not POST or PATCH) whose body isn't streamed.  The
+	// path of BackendURL in the request URL is replaced with the one of the
+	// failover backend.
+	FailoverBackendURLs []string
+
+	// BackendHost, if set, is the Host header of backend requests regardless
+	// of the Uri-Host option sent by the client, and the TLS server name
+	// (SNI) of HTTPS backends; it's needed for name-based virtual hosts and
+	// some API gateways.
+	BackendHost string
+
+	// RewriteRules are applied in order to the path of CoAP requests (for
+	// example to strip a "/v1" prefix) before the backend URI is built.
+	RewriteRules []RewriteRule
+
+	// QueryRules add, rename or remove query parameters of CoAP requests,
+	// or move them to headers, before they are forwarded to the backend.
+	QueryRules []QueryRule
+
+	// URITemplate optionally maps CoAP request URIs to backend URIs (see
+	// ParseURITemplate), instead of appending the request path and query to
+	// BackendURL.  The Uri-Host option is then available to the template
+	// rather than sent as the Host header.
+	URITemplate *URITemplate
+
+	// ForwardProxy optionally enables the forward-proxy mode: requests with
+	// a Proxy-Uri or Proxy-Scheme option are sent to the absolute URI they
+	// carry, if the policy allows its scheme and host, instead of to
+	// BackendURL, without the backend credentials, DefaultHeaders,
+	// principal, Director or signatures.  If nil, such requests are
+	// answered with 5.05 Proxying Not Supported.
+	ForwardProxy *ForwardProxyPolicy
+
+	// MaxRedirects is the number of backend redirects followed for a
+	// request (10 if zero); beyond it, or when a redirect leads back to an
+	// earlier URL with the same method, the request fails with 5.02 Bad
+	// Gateway.  TranslateRedirects instead sends redirects to the client as
+	// 2.05 Content responses carrying the target in Location-Path and
+	// Location-Query options, for the device to decide.
+	MaxRedirects       int
+	TranslateRedirects bool
+
+	// FetchMethod is the HTTP method of backend requests translated from
+	// FETCH requests (RFC 8132), whose payload is sent as the body: GET if
+	// empty, or POST for backends which ignore the body of GET requests.
+	FetchMethod string
+
+	// ServeDiscovery makes the proxy answer GET /.well-known/core itself
+	// (RFC 6690), with a link-format listing of DiscoveryLinks, instead of
+	// forwarding the request to the backend.
+	ServeDiscovery bool
+
+	// DiscoveryLinks lists the resources advertised by the proxy in
+	// /.well-known/core when ServeDiscovery is set.
+	DiscoveryLinks []Link
+
+	// MergeBackendDiscovery makes the proxy also fetch /.well-known/core
+	// from the backend (in link-format, or link-format+json) and add the
+	// links it lists to DiscoveryLinks.  If the backend fails, only
+	// DiscoveryLinks are listed.
+	MergeBackendDiscovery bool
+
+	// ServeHealth makes the proxy answer GET /health itself, with 2.05
+	// Content if it is serving all its listeners and can connect to the
+	// backend, else with 5.03 Service Unavailable, for load balancers
+	// probing it over CoAP.  Backend reachability is checked at most every
+	// 5 seconds.
+	ServeHealth bool
+
+	// StaticRoutes are resources answered by the proxy itself from static
+	// content or templates, without forwarding the requests to the
+	// backend.
+	StaticRoutes []StaticRoute
+
+	// ResourceDirectory optionally makes the proxy register itself and its
+	// DiscoveryLinks with a CoRE Resource Directory when it starts serving,
+	// and keep the registration fresh.
+	ResourceDirectory *ResourceDirectory
+
+	// MulticastListener is an optional UDP listener joined to a multicast
+	// group, typically All-CoAP-Nodes (see ListenMulticast), so that
+	// discovery requests sent to the group reach the proxy.  Requests
+	// received on it are answered from Listener with non-confirmable
+	// responses after a random delay of up to Leisure, and error responses
+	// are suppressed.
+	MulticastListener *net.UDPConn
+
+	// Leisure is the maximum random delay before responding to a multicast
+	// request.  If zero, the RFC 7252 default of 5 seconds is used.
+	Leisure time.Duration
+
+	// MaxTrackedClients is the number of client endpoints whose statistics
+	// (requests, errors, bytes and last seen time) are kept for the admin
+	// API; the least recently seen clients are forgotten first.  If zero,
+	// 10000 clients are tracked; if negative, none.
+	MaxTrackedClients int
+
+	// MaxOutstanding is the number of exchanges a client endpoint may have
+	// in progress at once, like the NSTART of RFC 7252 section 4.7, so that
+	// a misbehaving device can't monopolize the proxy: beyond it, requests
+	// are answered with 5.03 (Service Unavailable) if they're confirmable
+	// and dropped otherwise, and retransmissions of the requests in
+	// progress are ignored.  If zero, there's no limit.
+	MaxOutstanding int
+
+	// DropExcessRequests drops the confirmable requests beyond
+	// MaxOutstanding too, so that the client retransmits them later.
+	DropExcessRequests bool
+
+	// PacingRate, if positive, is the number of messages per second sent to
+	// each client endpoint at most, including acknowledgements and
+	// notifications, so that a device behind a constrained radio link
+	// (such as LoRaWAN or NB-IoT) isn't flooded with bursts.  The messages
+	// wait in a queue of the endpoint, of PacingQueueSize messages (16 if
+	// zero), beyond which they're dropped.  It applies to Serve.
+	PacingRate      float64
+	PacingQueueSize int
+
+	// ExchangeLifetime is how long the acknowledgement of a confirmable
+	// request is kept to answer its retransmissions again, instead of
+	// forwarding them to the backend twice (EXCHANGE_LIFETIME, RFC 7252
+	// section 4.8.2, is 247 seconds).  If zero, requests aren't
+	// deduplicated.
+	ExchangeLifetime time.Duration
+
+	// NonDeduplication collapses the duplicates of non-confirmable
+	// requests into a single backend request for requests below a path
+	// prefix, after Routes.
+	//
+	// Deprecated: use the NonDeduplication of Routes.
+	NonDeduplication []RouteNonDeduplication
+
+	// UploadLifetime is how long an incomplete Block1 upload is kept after
+	// its latest block, and DownloadLifetime how long the backend response
+	// of a Block2 download is; 247 seconds if zero.
+	UploadLifetime   time.Duration
+	DownloadLifetime time.Duration
+
+	// MaxConcurrentRequests is the number of requests handled at once,
+	// beyond which up to RequestQueueSize requests wait for their turn.
+	// When the queue is full too, confirmable requests are answered with
+	// 5.03 (Service Unavailable) and a Max-Age estimated from the queue
+	// depth and the recent latency, and non-confirmable ones are dropped.
+	// If zero, there's no limit.
+	MaxConcurrentRequests int
+	RequestQueueSize      int
+
+	// RecordExchanges is the number of most recent exchanges with the
+	// backend kept in memory, with their CoAP request and response in hex,
+	// and shown as a HAR log by the admin API, to debug interoperability
+	// issues with devices.  Credentials in headers are redacted.  If zero,
+	// exchanges are only recorded to ExchangeLog.
+	RecordExchanges int
+
+	// ExchangeLog optionally receives every exchange with the backend, as a
+	// line of JSON (a HAR entry).
+	ExchangeLog io.Writer
+
+	// AdminListener is an optional listener for the admin HTTP API, which
+	// shows the proxy configuration (without secrets) and per-route
+	// statistics, and replaces the Routes at runtime.  Requests to
+	// it must carry AdminToken as a bearer token.
+	AdminListener net.Listener
+
+	// AdminToken is the bearer token of the admin API; it is required if
+	// AdminListener is set.
+	AdminToken string
+
+	// AdminDebug makes the admin API also serve the runtime profiles of
+	// net/http/pprof under /debug/pprof/ and the expvar variables under
+	// /debug/vars, to diagnose a proxy under load.  Profiles can reveal
+	// memory contents, hence the separate switch.
+	AdminDebug bool
+
+	// Metrics optionally receives the measurements of the requests: see
+	// NopMetrics, PrometheusMetrics (served at /metrics on the admin API)
+	// and StatsDMetrics.
+	Metrics Metrics
+
+	// MetricLabels lists the dimensions added as labels to the request
+	// metrics (requests, request_duration_seconds, responses and
+	// backend_errors): "route" (the prefix of the first matching route),
+	// "tenant", "backend" (the host which served the request) and
+	// "code_class" (such as "2.xx").  Each label multiplies the number of
+	// series, hence MetricLabelValues.
+	MetricLabels []string
+
+	// MetricLabelValues caps the number of values of each of MetricLabels:
+	// once reached, new values are reported as "other" and counted by the
+	// metric_label_overflows metric.  If zero, 100 values.
+	MetricLabelValues int
+
+	// SLOWindow, if set, is the rolling window over which the latency
+	// percentiles, error rate and payload sizes of the requests to each
+	// route are kept in the proxy, served at /slo on the admin API and
+	// measured as the route_latency_seconds and route_error_rate metrics.
+	SLOWindow time.Duration
+
+	// RouteSLOs are the objectives of the requests whose path lies below a
+	// prefix, the first matching one applying, checked over the SLOWindow
+	// (5 minutes if zero): each breach is logged and counted by the
+	// slo_breaches metric.  The statistics of these requests are kept
+	// under the prefix rather than the route.
+	RouteSLOs []RouteSLO
+
+	contentFormats map[coap.MediaType]Content
+	converters     map[Conversion]Converter
+	middleware     []ContextMiddleware
+	cache          *responseCache // if CacheMaxSize, shared by the copies
+	life           *lifecycle
+}
+
+// RegisterContentFormat maps the CoAP Content-Format mediaType to the HTTP
+// content type (and optional content encoding), in addition to the built-in
+// formats; registering a known Content-Format replaces its mapping.  It must
+// be called before Serve.
+func (p *Proxy) RegisterContentFormat(mediaType coap.MediaType, contentType, encoding string) {
+	if p.contentFormats == nil {
+		p.contentFormats = DefaultContentFormats()
+	}
+	p.contentFormats[mediaType] = Content{Type: contentType, Encoding: encoding}
 }
 
 type proxyHandler struct {
 	Proxy
+	translator    *Translator
+	transactions  *transactions
+	uploads       *transfers
+	downloads     *transfers
+	transport     http.RoundTripper
+	hostTransport http.RoundTripper          // for requests to BackendHost
+	transports    map[*net.UDPConn]transport // of the listeners
+	echo          *echoVerifier              // if VerifyClientAddresses
+	oscore        *oscoreServer              // if OSCOREContexts or OSCOREContextSource
+	routes        *routeTable                // Routes and the deprecated route lists
+	compressor    *Translator                // for CompressOversize
+	stats         *routeStats
+	health        *health
+	clients       *clientStats
+	recorder      *exchangeRecorder     // if RecordExchanges or ExchangeLog
+	shadow        *shadowBackend        // if ShadowBackendURL
+	canary        *canarySplitter       // if CanaryRoutes
+	tenants       *tenants              // if Tenants
+	observers     *observers            // if ObserveInterval
+	queues        *deviceQueues         // if QueueSize
+	devices       *deviceRegistry       // if Devices
+	sessions      *sessions             // if SessionTTL
+	outstanding   *outstandingExchanges // if MaxOutstanding
+	workers       *workerPool           // if MaxConcurrentRequests
+	exchanges     *exchangeCache        // if ExchangeLifetime
+	backends      *backendPool          // if BackendResolver
+	pacer         *pacer                // if PacingRate
+	failovers     *failoverBackends     // if FailoverBackendURLs
+	metricLabels  *metricLabels         // if MetricLabels
+	amplification *amplificationGuard   // if AmplificationLimit
+	nonDedup      *nonDeduplicator      // of the NonDeduplication of routes
+	slo           *sloWindow            // if SLOWindow or RouteSLOs
+	observations  *pushObservations     // of the push API
+	inFlight      int32                 // requests being handled
 }
 
-const (
-	defaultHTTPTimeout = 5 * time.Second
-	userAgent          = "crosscoap/1.0"
-)
+// backendTransports returns the HTTP transport of backend requests (nil
+// for the default transport), and the one of requests to BackendHost.
+func (p *Proxy) backendTransports() (http.RoundTripper, http.RoundTripper) {
+	var transport, hostTransport http.RoundTripper
+	base := http.DefaultTransport.(*http.Transport)
+	if p.DialTimeout > 0 || p.TLSHandshakeTimeout > 0 || p.ResponseHeaderTimeout > 0 || p.BackendResolver != nil || p.BackendResolveInterval > 0 {
+		base = base.Clone()
+		if p.DialTimeout > 0 {
+			dialer := &net.Dialer{Timeout: p.DialTimeout, KeepAlive: 30 * time.Second}
+			base.DialContext = dialer.DialContext
+		}
+		if p.TLSHandshakeTimeout > 0 {
+			base.TLSHandshakeTimeout = p.TLSHandshakeTimeout
+		}
+		base.ResponseHeaderTimeout = p.ResponseHeaderTimeout
+		transport = base
+	}
+	if p.BackendHost != "" {
+		// Present the overridden host name in TLS handshakes too
+		tlsTransport := base.Clone()
+		host := p.BackendHost
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		tlsTransport.TLSClientConfig = &tls.Config{ServerName: host}
+		hostTransport = tlsTransport
+	}
+	return transport, hostTransport
+}
 
-func (p *proxyHandler) doHTTPRequest(req *http.Request) (*http.Response, []byte, error) {
-	timeout := defaultHTTPTimeout
+func newProxyHandler(p *Proxy) *proxyHandler {
+	if p.cache == nil {
+		p.cache = p.newResponseCache()
+	}
+	p.lifecycle()
+	transport, hostTransport := p.backendTransports()
+	handler := &proxyHandler{
+		Proxy: *p,
+		translator: &Translator{
+			BackendURL:          p.BackendURL,
+			StrictContentFormat: p.StrictContentFormat,
+			DefaultContentType:  p.DefaultContentType,
+			ContentFormats:      p.contentFormats,
+			TranscodeCBOR:       p.TranscodeCBOR,
+			Converters:          p.responseConverters(),
+			NormalizeSenML:      p.NormalizeSenML,
+			TranslateLinkFormat: p.TranslateLinkFormat,
+			DeflateJSON:         p.DeflateJSON,
+			InflateRequests:     p.InflateRequests,
+			OptionMappings:      p.OptionMappings,
+			ForwardedHeaders:    p.ForwardedResponseHeaders,
+			AuthChallenges:      p.AuthChallenges,
+			Host:                p.BackendHost,
+			RewriteRules:        p.RewriteRules,
+			QueryRules:          p.QueryRules,
+			URITemplate:         p.URITemplate,
+			ForwardProxy:        p.ForwardProxy,
+			TranslateRedirects:  p.TranslateRedirects,
+			FetchMethod:         p.FetchMethod,
+		},
+		transactions:  newTransactions(),
+		uploads:       newTransfers(p.UploadLifetime),
+		downloads:     newTransfers(p.DownloadLifetime),
+		transport:     transport,
+		hostTransport: hostTransport,
+		routes:        &routeTable{routes: newRouteOverrides(p.routeConfigs())},
+		stats:         newRouteStats(),
+		observations:  newPushObservations(),
+	}
+	if p.VerifyClientAddresses {
+		handler.echo = newEchoVerifier()
+	}
+	handler.amplification = handler.newAmplificationGuard()
+	handler.oscore = p.newOSCOREServer()
+	handler.health = handler.newHealth()
+	handler.clients = newClientStats(p.MaxTrackedClients)
+	handler.outstanding = handler.newOutstandingExchanges()
+	handler.workers = handler.newWorkerPool()
+	handler.exchanges = handler.newExchangeCache()
+	handler.nonDedup = handler.newNonDeduplicator()
+	handler.recorder = handler.newExchangeRecorder()
+	handler.shadow = handler.newShadowBackend()
+	handler.canary = handler.newCanarySplitter()
+	handler.backends = handler.newBackendPool()
+	handler.tenants = handler.newTenants()
+	handler.observers = handler.newObservers()
+	handler.queues = handler.newDeviceQueues()
+	handler.devices = handler.newDeviceRegistry()
+	handler.sessions = handler.newSessions()
+	handler.compressor = handler.newCompressor()
+	handler.pacer = handler.newPacer()
+	handler.failovers = handler.newFailoverBackends()
+	handler.metricLabels = handler.newMetricLabels()
+	handler.slo = p.newSLOWindow()
+	handler.exportBuildInfo()
+	return handler
+}
+
+const defaultHTTPTimeout = 5 * time.Second
+
+func (p *Proxy) userAgent() string {
+	if p.UserAgent != "" {
+		return p.UserAgent
+	}
+	return "crosscoap/" + Version()
+}
+
+func (p *Proxy) timeout() time.Duration {
 	if p.Timeout != nil {
-		timeout = *p.Timeout
+		return *p.Timeout
+	}
+	return defaultHTTPTimeout
+}
+
+// RouteTimeout is the backend timeout of requests whose path lies below
+// PathPrefix (matched on whole path segments).
+type RouteTimeout struct {
+	PathPrefix string
+	Timeout    time.Duration
+}
+
+// requestTimeout returns the backend timeout of the CoAP request m.
+func (p *proxyHandler) requestTimeout(m *coap.Message) time.Duration {
+	if r := p.routeOverride(m, func(r *routeOverride) bool { return r.Timeout > 0 }); r != nil {
+		return r.Timeout
+	}
+	return p.timeout()
+}
+
+func (p *proxyHandler) doHTTPRequest(req *http.Request, timeout time.Duration) (*http.Response, []byte, error) {
+	httpResp, httpBody, _, err := p.sendHTTPRequest(req, timeout, -1)
+	return httpResp, httpBody, err
+}
+
+const defaultMaxRedirects = 10
+
+// checkRedirect is the redirect policy of the backend requests.
+func (p *Proxy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if p.TranslateRedirects {
+		return http.ErrUseLastResponse
 	}
-	httpClient := &http.Client{Timeout: timeout}
-	httpResp, err := httpClient.Do(req)
+	max := p.MaxRedirects
+	if max <= 0 {
+		max = defaultMaxRedirects
+	}
+	if len(via) > max {
+		return errTooManyRedirects
+	}
+	for _, earlier := range via {
+		if earlier.Method == req.Method && earlier.URL.String() == req.URL.String() {
+			return errRedirectLoop
+		}
+	}
+	return nil
+}
+
+// sendHTTPRequest sends req to the backend and reads the response body.
+// With a non-negative limit, a longer body is only read up to limit bytes,
+// and its unread rest is returned, to be closed by the caller; timeout then
+// doesn't apply to the rest.
+func (p *proxyHandler) sendHTTPRequest(req *http.Request, timeout time.Duration, limit int) (*http.Response, []byte, io.ReadCloser, error) {
+	cached := p.cache.lookup(req, time.Now())
+	setCacheOutcome(req, p.cache.outcome(req, cached != nil))
+	if cached != nil {
+		httpResp, httpBody, rest := cached.response(req, limit, time.Now())
+		return httpResp, httpBody, rest, nil
+	}
+	httpClient := &http.Client{Timeout: timeout, Transport: p.transport, Jar: requestCookieJar(req), CheckRedirect: p.checkRedirect}
+	if p.BackendHost != "" && req.Host == p.BackendHost {
+		httpClient.Transport = p.hostTransport
+	}
+	cancel := func() {}
+	var deadline *time.Timer
+	if limit >= 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(req.Context())
+		deadline = time.AfterFunc(timeout, cancel)
+		defer func() {
+			if deadline != nil {
+				deadline.Stop()
+				cancel()
+			}
+		}()
+		req = req.WithContext(ctx)
+		httpClient.Timeout = 0
+	}
+	timeoutError := func(err error) error {
+		if deadline != nil && !deadline.Stop() {
+			return fmt.Errorf("%v: %w", err, context.DeadlineExceeded)
+		}
+		return err
+	}
+	routed, transport, backend := p.routeBackend(req)
+	if transport != nil {
+		httpClient.Transport = transport
+	}
+	start := time.Now()
+	httpResp, err := httpClient.Do(routed)
+	p.backendDone(backend, start, err)
+	httpResp, err = p.failover(httpClient, req, httpResp, err)
 	if err != nil {
-		return nil, nil, err
+		err = timeoutError(err)
+		if httpResp, httpBody, rest, ok := p.serveStale(req, limit, err); ok {
+			return httpResp, httpBody, rest, nil
+		}
+		return nil, nil, nil, err
+	}
+	if httpResp.StatusCode >= 500 {
+		if staleResp, httpBody, rest, ok := p.serveStale(req, limit, httpResp.Status); ok {
+			httpResp.Body.Close()
+			return staleResp, httpBody, rest, nil
+		}
+	}
+	closers := []io.Closer{httpResp.Body}
+	if p.ModifyResponse != nil {
+		body := httpResp.Body
+		if err := p.ModifyResponse(httpResp); err != nil {
+			httpResp.Body.Close()
+			return nil, nil, nil, &modifyResponseError{err}
+		}
+		if httpResp.Body != body {
+			closers = append(closers, httpResp.Body)
+		}
+	}
+	closeBody := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	var reader io.Reader = httpResp.Body
+	if limit >= 0 {
+		reader = io.LimitReader(httpResp.Body, int64(limit)+1)
 	}
-	defer httpResp.Body.Close()
-	httpBody, err := ioutil.ReadAll(httpResp.Body)
+	httpBody, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return nil, nil, err
+		closeBody()
+		return nil, nil, nil, timeoutError(err)
+	}
+	if limit >= 0 && len(httpBody) > limit {
+		deadline.Stop()
+		deadline = nil
+		return httpResp, httpBody, &backendBody{Reader: httpResp.Body, closers: closers, cancel: cancel}, nil
+	}
+	closeBody()
+	if p.MapTrailers {
+		mergeTrailers(httpResp)
+	}
+	p.cache.store(req, httpResp, httpBody, time.Now())
+	return httpResp, httpBody, nil, nil
+}
+
+// expectsResponse returns whether the CoAP request m gets a response.
+func (p *Proxy) expectsResponse(m *coap.Message) bool {
+	return m.IsConfirmable() || p.RespondToNonConfirmable
+}
+
+// errorResponse builds an error response to the CoAP request m, or returns
+// nil if m gets no response.
+func (p *proxyHandler) errorResponse(m *coap.Message, code coap.COAPCode, diagnostic string) *translatedCOAPMessage {
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	if !p.DiagnosticPayloads {
+		diagnostic = ""
+	}
+	return generateErrorCOAPResponse(m, code, diagnostic)
+}
+
+// modifyResponseError is returned by doHTTPRequest when ModifyResponse
+// fails.
+type modifyResponseError struct {
+	err error
+}
+
+func (e *modifyResponseError) Error() string {
+	return "modifying response: " + e.err.Error()
+}
+
+func (e *modifyResponseError) Unwrap() error {
+	return e.err
+}
+
+func (p *proxyHandler) backendErrorDiagnostic(code coap.COAPCode, timeout time.Duration) string {
+	switch code {
+	case coap.GatewayTimeout:
+		return fmt.Sprintf("backend timeout after %v", timeout)
+	case coap.BadGateway:
+		return "backend unreachable"
 	}
-	return httpResp, httpBody, nil
+	return "backend unavailable"
 }
 
-func (p *proxyHandler) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
-	p.logAccess("%v: CoAP %v URI-Path=%v URI-Query=%v", a, m.Code, m.PathString(), m.Options(coap.URIQuery))
-	waitForResponse := m.IsConfirmable()
-	req := translateCOAPRequestToHTTPRequest(m, p.BackendURL)
-	if req == nil {
-		if waitForResponse {
-			return &generateBadRequestCOAPResponse(m).Message
+// prepareBackendRequest adds the proxy's headers and the device's
+// credentials, if any, to the HTTP request req translated from the CoAP
+// request m, runs the Director and signs req.
+func (p *proxyHandler) prepareBackendRequest(req *http.Request, m *coap.Message, options []rawOption, requestID string, credentials http.Header) error {
+	p.translator.mapRequestOptions(req, options)
+	forward := forwardProxied(req)
+	if forward {
+		// The backend's secrets stay with the backend
+		credentials = nil
+	}
+	for name, values := range credentials {
+		req.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+	req.Header.Set(requestIDHeader, requestID)
+	if p.ForwardMessageMetadata {
+		setMessageMetadata(req, m)
+	}
+	req.Header.Set("User-Agent", p.userAgent())
+	for name, values := range p.DefaultHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if _, found := req.Header[name]; !found && !forward {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+	if p.ForwardClientAddress {
+		if rc := RequestContextFrom(req.Context()); rc != nil {
+			setForwardedHeaders(req, rc.Client)
+		}
+	}
+	if p.PrincipalHeader != "" {
+		// Clients can't claim a principal through OptionMappings
+		req.Header.Del(p.PrincipalHeader)
+		if rc := RequestContextFrom(req.Context()); rc != nil && rc.Principal != "" && !forward {
+			req.Header.Set(p.PrincipalHeader, rc.Principal)
+		}
+	}
+	if p.ExpectContinue {
+		expectContinue(req)
+	}
+	if p.Director != nil && !forward {
+		p.Director(req, m)
+	}
+	return p.signRequest(req, time.Now())
+}
+
+// serveCOAP proxies the CoAP request m, whose options (including those which
+// go-coap doesn't know) are given in options, and whose payload is streamed
+// from body if it isn't nil.  It returns the response to send, if any.
+func (p *proxyHandler) serveCOAP(a *net.UDPAddr, m *coap.Message, options []rawOption, body io.ReadCloser) *translatedCOAPMessage {
+	rc := &RequestContext{Client: a, Received: time.Now(), RequestID: p.translator.requestID(m.Token, options)}
+	return p.serveCOAPIn(rc, m, options, body)
+}
+
+// serveCOAPIn proxies the CoAP request m in the exchange rc, which the
+// backend request carries in its context.
+func (p *proxyHandler) serveCOAPIn(rc *RequestContext, m *coap.Message, options []rawOption, body io.ReadCloser) (coapResp *translatedCOAPMessage) {
+	a, requestID := rc.Client, rc.RequestID
+	defer func() {
+		if coapResp != nil {
+			coapResp.requestID = requestID
+		}
+	}()
+	if denied, ok := p.admitClient(a, m, requestID); !ok {
+		return denied
+	}
+	if !validPath(m) {
+		p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v invalid path", a, methodName(m.Code), m.PathString(), requestID)
+		return p.errorResponse(m, coap.BadRequest, "invalid Uri-Path segment")
+	}
+	tenant := p.tenants.match(m)
+	if p.AccessLogFormat == nil && !p.quiet(m) {
+		if tenant != nil {
+			p.logAccess("%v: CoAP %v URI-Path=%v URI-Query=%v Request-ID=%v Tenant=%v", a, methodName(m.Code), m.PathString(), m.Options(coap.URIQuery), requestID, tenant.Name)
 		} else {
-			return nil
+			p.logAccess("%v: CoAP %v URI-Path=%v URI-Query=%v Request-ID=%v", a, methodName(m.Code), m.PathString(), m.Options(coap.URIQuery), requestID)
+		}
+	}
+	if tenant != nil && tenant.limiter != nil {
+		if ok, retryAfter := tenant.limiter.allow(time.Now()); !ok {
+			p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied by rate limit of tenant %v", a, methodName(m.Code), m.PathString(), requestID, tenant.Name)
+			return p.tooManyRequests(m, retryAfter)
+		}
+	}
+	if override := p.routeLimiter(m); override != nil {
+		if ok, retryAfter := override.limiter.allow(time.Now()); !ok {
+			p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied by rate limit of route %v", a, methodName(m.Code), m.PathString(), requestID, override.PathPrefix)
+			return p.tooManyRequests(m, retryAfter)
+		}
+	}
+	if denied := p.authenticate(rc, m); denied != nil {
+		return denied
+	}
+	waitForResponse := p.expectsResponse(m)
+	if p.AccessPolicy != nil {
+		if allowed, code := p.AccessPolicy.check(m, rc.Principal); !allowed {
+			p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied by access policy", a, methodName(m.Code), m.PathString(), requestID)
+			return p.errorResponse(m, code, "denied by access policy")
+		}
+	}
+	if p.ServeDiscovery && m.Code == coap.GET && isDiscovery(m) {
+		return p.serveDiscovery(m, options, requestID)
+	}
+	if p.ServeHealth && m.Code == coap.GET && isHealthCheck(m) {
+		return p.serveHealth(m)
+	}
+	if route := p.staticRoute(m); route != nil {
+		return p.serveStatic(rc, m, options, route)
+	}
+	if max := p.maxRequestBodyBytes(m); max > 0 && len(m.Payload) > max {
+		p.logError("CoAP request payload of %v bytes exceeds the limit of %v bytes (Request-ID=%v)", len(m.Payload), max, requestID)
+		return p.requestTooLarge(m)
+	}
+	if body == nil {
+		transformed, err := p.transformRequest(rc, m)
+		if err != nil {
+			p.logError("Error transforming CoAP request payload: %v (Request-ID=%v)", err, requestID)
+			return p.errorResponse(m, coap.BadRequest, "request payload rejected")
+		}
+		m = transformed
+	}
+	req, err := p.translator.translateCOAPRequestToHTTPRequest(m)
+	if err != nil {
+		code := coap.BadRequest
+		var translateErr *TranslationError
+		if errors.As(err, &translateErr) {
+			code = translateErr.Code
+		}
+		return p.errorResponse(m, code, err.Error())
+	}
+	if p.RequestValidator != nil {
+		if err := p.RequestValidator.validate(req, p.BackendURL, body != nil); err != nil {
+			p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v invalid: %v", a, methodName(m.Code), m.PathString(), requestID, err)
+			return p.invalidRequest(m, err)
+		}
+	}
+	if body != nil {
+		req.Body = body
+		req.GetBody = nil
+		req.ContentLength = -1 // chunked
+		if size, ok := m.Option(coap.Size1).(uint32); ok {
+			req.ContentLength = int64(size)
 		}
 	}
-	req.Header.Set("User-Agent", userAgent)
-	responseChan := make(chan *coap.Message, 1)
+	if tenant != nil && tenant.url != nil {
+		if u := rebaseURL(req.URL, p.tenants.backend, tenant.url); u != nil {
+			req.URL = u
+		}
+	} else if canary := p.splitCanary(a, m.PathString(), req); canary != "" {
+		p.logAccess("%v: Request-ID=%v sent to canary backend %v", a, requestID, canary)
+	}
+	credentials, ok := p.credentials(rc, m)
+	if !ok {
+		p.logAccess("%v: CoAP %v URI-Path=%v Request-ID=%v denied: no backend credentials", a, methodName(m.Code), m.PathString(), requestID)
+		return p.errorResponse(m, coap.Unauthorized, "no backend credentials")
+	}
+	req = req.WithContext(context.WithValue(req.Context(), requestContextKey{}, rc))
+	if len(credentials) > 0 || rc.Principal != "" {
+		// The backend answers the device or principal, not the clients
+		// sharing the cache
+		req = withPrivateRequest(req)
+	}
+	if err := p.prepareBackendRequest(req, m, options, requestID, credentials); err != nil {
+		p.logError("Error signing HTTP request: %v (Request-ID=%v)", err, requestID)
+		return p.errorResponse(m, coap.InternalServerError, "request signing failed")
+	}
+	if p.DryRun {
+		return p.dryRun(a, m, req, requestID)
+	}
+	timeout := p.requestTimeout(m)
+	p.mirror(req, timeout, requestID)
+	if p.sessions != nil {
+		req = withCookieJar(req, p.sessions.jar(p.sessionKey(a), time.Now()))
+	}
+	req = withCachePolicy(req, p.cachePolicy(m))
+	req, stopDeadline := withExchangeDeadline(req, rc)
+	policy := p.oversizePolicy(m)
+	responseChan := make(chan *translatedCOAPMessage, 1)
 	go func() {
-		httpResp, httpBody, err := p.doHTTPRequest(req)
+		defer stopDeadline()
+		limit := -1
+		if p.StreamBlock2 && policy == Block2Oversize && waitForResponse {
+			limit = p.translator.maxPacketSize()
+		}
+		exchange := p.recorder.start(a, m, options, req, requestID)
+		var cacheOutcome string
+		httpResp, httpBody, rest, err := p.sendHTTPRequest(withCacheOutcome(req, &cacheOutcome), timeout, limit)
+		if rest != nil && (p.translator.needsWholeBody(httpResp, m) || p.transformsResponse(m, httpResp)) {
+			var more []byte
+			more, err = ioutil.ReadAll(rest)
+			rest.Close()
+			httpBody, rest = append(httpBody, more...), nil
+		}
 		if err != nil {
-			p.logError("Error on HTTP request: %v", err)
+			p.logError("Error on HTTP request: %v (Request-ID=%v)", err, requestID)
 		}
-		if waitForResponse {
-			coapResp, err := translateHTTPResponseToCOAPResponse(httpResp, httpBody, err, m)
-			if err != nil {
-				p.logError("Error translating HTTP to CoAP: %v", err)
+		respond := func(coapResp *translatedCOAPMessage) {
+			if coapResp != nil {
+				coapResp.backendURL = req.URL.String()
+				coapResp.backendErr = err
+				coapResp.cache = cacheOutcome
+				if httpResp != nil {
+					coapResp.httpStatus = httpResp.StatusCode
+					coapResp.contentType = httpResp.Header.Get("Content-Type")
+				}
+			}
+			responseChan <- p.recorder.finish(exchange, httpResp, httpBody, err, coapResp)
+		}
+		if !waitForResponse {
+			p.recorder.finish(exchange, httpResp, httpBody, err, nil)
+		} else {
+			if isCanceled(err) {
+				p.abandoned(rc, err)
+				respond(nil)
+				return
+			}
+			var modifyErr *modifyResponseError
+			if errors.As(err, &modifyErr) {
+				code := p.ModifyResponseErrorCode
+				if code == 0 {
+					code = coap.BadGateway
+				}
+				respond(p.errorResponse(m, code, "backend response rejected"))
+				return
+			}
+			payload := httpBody
+			if err == nil {
+				var transformErr error
+				if payload, transformErr = p.transformResponse(rc, m, httpResp, httpBody); transformErr != nil {
+					p.logError("Error transforming HTTP response body: %v (Request-ID=%v)", transformErr, requestID)
+					respond(p.errorResponse(m, coap.BadGateway, "backend response rejected"))
+					return
+				}
+			}
+			coapResp, translateErr := p.responseTranslator(policy).translateHTTPResponseToCOAPResponse(httpResp, payload, err, m)
+			if translateErr != nil {
+				p.logError("Error translating HTTP to CoAP: %v (Request-ID=%v)", translateErr, requestID)
+			}
+			if err != nil && p.DiagnosticPayloads {
+				coapResp.Payload = []byte(p.backendErrorDiagnostic(coapResp.Code, timeout))
 			}
 			if coapResp.IsTruncated {
-				p.logError("CoAP payload truncated from %v bytes to %v bytes", len(httpBody), len(coapResp.Payload))
+				size := int64(len(coapResp.untruncated))
+				if rest != nil {
+					size = httpResp.ContentLength
+				}
+				coapResp.revalidation = p.newDownloadRevalidation(req, httpResp, cacheOutcome, time.Now())
+				respond(p.handleOversize(rc, m, options, coapResp, rest, size, policy))
+				return
+			}
+			if rest != nil {
+				rest.Close()
 			}
-			responseChan <- &coapResp.Message
+			if coapResp.deflated {
+				p.metrics().Counter(metricOversizeResponses, 1, Labels{"outcome": "compressed"})
+				coapResp.oversize = "compressed"
+			}
+			respond(coapResp)
 		}
 	}()
 
 	if waitForResponse {
-		coapResp := <-responseChan
-		return coapResp
+		select {
+		case coapResp := <-responseChan:
+			return coapResp
+		case <-p.life.aborted:
+			p.logError("Backend request abandoned on shutdown (Request-ID=%v)", requestID)
+			return p.errorResponse(m, coap.ServiceUnavailable, "shutting down")
+		}
 	} else {
 		return nil
 	}
@@ -155,17 +1430,283 @@ func (p *Proxy) logError(format string, args ...interface{}) {
 	}
 }
 
-// Serve starts accepting CoAP requests on the proxy's UDP listener
-// (p.Listener); it never returns (unless there's an error accepting UDP
-// packets or reading them).  The server starts a new goroutine to for each
+func (p *proxyHandler) handlePacket(l transport, a *net.UDPAddr, packet []byte) {
+	m, options, err := parsePacket(packet)
+	if err != nil {
+		p.clients.received(a, len(packet), false, true)
+		p.logError("Error parsing CoAP packet from %v: %v", a, err)
+		return
+	}
+	isRequest := m.Code != 0 && m.Code>>5 == 0 && (m.Type == coap.Confirmable || m.Type == coap.NonConfirmable)
+	p.clients.received(a, len(packet), isRequest, false)
+	p.amplification.received(a, options, len(packet), time.Now())
+	// Deliver the queued requests once the client has been answered
+	defer p.deliverQueued(l, a)
+	if m.Type == coap.Acknowledgement || m.Type == coap.Reset {
+		p.transactions.complete(a, m)
+		return
+	}
+	if m.Code>>5 >= 2 {
+		// Separate response (class 2.xx to 5.xx) to a request sent by the
+		// proxy
+		if p.transactions.respond(a, m) {
+			if m.IsConfirmable() {
+				ack := coap.Message{Type: coap.Acknowledgement, MessageID: m.MessageID}
+				p.sendResponse(l, a, &translatedCOAPMessage{Message: ack})
+			}
+		} else if m.IsConfirmable() {
+			rst := coap.Message{Type: coap.Reset, MessageID: m.MessageID}
+			p.sendResponse(l, a, &translatedCOAPMessage{Message: rst})
+		}
+		return
+	}
+	if m.Code == 0 {
+		// Empty message: answer a CoAP ping with RST (RFC 7252 section 4.3)
+		if m.IsConfirmable() {
+			p.logAccess("%v: CoAP ping", a)
+			rst := coap.Message{Type: coap.Reset, MessageID: m.MessageID}
+			p.sendResponse(l, a, &translatedCOAPMessage{Message: rst})
+		}
+		return
+	}
+	if m.IsConfirmable() {
+		if ack, duplicate := p.exchanges.begin(a, m.MessageID, time.Now()); duplicate {
+			p.answerDuplicate(l, a, ack)
+			return
+		}
+	} else if p.nonDedup.duplicate(a, m, p.nonDedupWindow(m), time.Now()) {
+		p.metrics().Counter(metricDuplicateNonRequests, 1, nil)
+		p.logAccess("%v: Duplicate CoAP NON %v URI-Path=%v ignored", a, methodName(m.Code), m.PathString())
+		return
+	}
+	switch started, duplicate := p.outstanding.start(a, m.MessageID); {
+	case duplicate:
+		return
+	case !started:
+		p.refuseExcess(l, a, m)
+		return
+	}
+	defer p.outstanding.done(a, m.MessageID)
+	if !p.workers.acquire() {
+		p.refuseOverload(l, a, m)
+		return
+	}
+	defer p.workers.release(time.Now())
+	p.life.exchangeStarted()
+	defer p.life.exchangeDone()
+	handleRequest := func() *translatedCOAPMessage {
+		if coapResp := p.shuttingDown(m, options); coapResp != nil {
+			return coapResp
+		}
+		coapResp, challenged := p.challengeAddress(a, m, options)
+		if !challenged {
+			coapResp = p.handleRequest(a, m, options)
+		}
+		coapResp = p.observe(l, a, m, options, coapResp)
+		if coapResp != nil && coapResp.Code >= coap.BadRequest {
+			p.clients.failed(a)
+		}
+		return p.suppressResponse(m, options, coapResp)
+	}
+	if !m.IsConfirmable() {
+		coapResp := handleRequest()
+		if coapResp != nil {
+			coapResp.Type = coap.NonConfirmable
+			coapResp.MessageID = p.transactions.nextMessageID()
+		}
+		p.sendResponse(l, a, coapResp)
+		return
+	}
+	if p.SeparateResponseDelay <= 0 {
+		p.sendResponse(l, a, handleRequest())
+		return
+	}
+	responseChan := make(chan *translatedCOAPMessage, 1)
+	go func() {
+		responseChan <- handleRequest()
+	}()
+	timer := time.NewTimer(p.SeparateResponseDelay)
+	select {
+	case coapResp := <-responseChan:
+		timer.Stop()
+		p.sendResponse(l, a, coapResp)
+		return
+	case <-timer.C:
+	}
+	emptyAck := coap.Message{Type: coap.Acknowledgement, MessageID: m.MessageID}
+	p.sendResponse(l, a, &translatedCOAPMessage{Message: emptyAck})
+	coapResp := <-responseChan
+	if coapResp == nil || coapResp.Code == 0 {
+		// No response, or only the empty ACK already sent
+		return
+	}
+	if p.exceedsAmplification(a, &coapResp.Message, coapResp.ExtraOptions) {
+		return
+	}
+	switch _, err := p.sendConfirmable(l, a, &coapResp.Message, coapResp.ExtraOptions); err {
+	case nil:
+	case errMessageRejected:
+		p.logAccess("%v: separate CoAP response rejected by client", a)
+	default:
+		p.logError("Error sending separate CoAP response to %v: %v", a, err)
+	}
+}
+
+func (p *proxyHandler) sendResponse(l transport, a *net.UDPAddr, coapResp *translatedCOAPMessage) {
+	if coapResp == nil {
+		return
+	}
+	buf := getPacketBuffer()
+	data, err := appendMessage((*buf)[:0], &coapResp.Message, coapResp.ExtraOptions)
+	if err != nil {
+		putPacketBuffer(buf)
+		p.logError("Error encoding CoAP response: %v", err)
+		return
+	}
+	if data = p.guardAmplification(a, coapResp, data); data == nil {
+		putPacketBuffer(buf)
+		return
+	}
+	if coapResp.Type == coap.Acknowledgement {
+		p.exchanges.answered(a, coapResp.MessageID, data)
+	}
+	p.clients.sent(a, len(data))
+	err = l.SendMessage(a, data)
+	*buf = data[:cap(data)]
+	putPacketBuffer(buf)
+	if err != nil {
+		p.logError("Error sending CoAP response to %v: %v", a, err)
+	}
+}
+
+// Serve starts accepting CoAP requests on the proxy's UDP listeners
+// (p.Listener and p.Listeners); it never returns (unless there's an error
+// accepting UDP packets or reading them, or Shutdown is called, when it
+// returns ErrProxyClosed; an error wrapping ErrListenerClosed means a
+// listener was closed without Shutdown).  The server starts a new goroutine to for each
 // incoming UDP CoAP request.
 func (p *Proxy) Serve() error {
-	return coap.Serve(p.Listener, &proxyHandler{*p})
+	if p.AdminListener != nil && p.AdminToken == "" {
+		return ErrAdminTokenRequired
+	}
+	handler := newProxyHandler(p)
+	if !p.life.serving(handler) {
+		return ErrProxyClosed
+	}
+	defer handler.stopObservers()
+	listeners := append([]*net.UDPConn{p.Listener}, p.Listeners...)
+	handler.transports = make(map[*net.UDPConn]transport)
+	for _, l := range listeners {
+		t := &udpTransport{l: l, stop: p.life.handedOver}
+		if batchedIO {
+			writer, err := newPacketWriter(l, p.logError)
+			if err != nil {
+				return err
+			}
+			t.writer = writer
+			go writer.run()
+			defer writer.stop()
+		}
+		handler.transports[l] = handler.paced(t)
+	}
+	if p.MulticastListener != nil {
+		go func() {
+			err := readPackets(p.MulticastListener, p.life.handedOver, func(addr *net.UDPAddr, packet []byte) {
+				handler.handleMulticastPacket(handler.transportOf(p.Listener), addr, packet)
+			})
+			p.logError("Error reading multicast CoAP requests: %v", err)
+		}()
+	}
+	janitorDone := make(chan struct{})
+	defer close(janitorDone)
+	go handler.runJanitor(janitorDone)
+	go handler.maintainBackends(janitorDone)
+	go handler.checkSLOs(janitorDone)
+	go handler.prefetch(janitorDone)
+	go handler.reloadOSCOREContexts(janitorDone)
+	if p.ResourceDirectory != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go handler.maintainRegistration(handler.transportOf(p.Listener), done)
+	}
+	if p.AdminListener != nil {
+		go handler.serveAdmin()
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		t := handler.transportOf(l)
+		handler.health.serving(1)
+		go func() {
+			err := t.ReceiveMessages(func(addr *net.UDPAddr, packet []byte) {
+				handler.handlePacket(t, addr, packet)
+			})
+			handler.health.serving(-1)
+			errs <- err
+		}()
+	}
+	err := <-errs
+	if errors.Is(err, errHandedOver) {
+		<-p.life.closed
+	}
+	if p.life.isDraining() {
+		return ErrProxyClosed
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("%w: %v", ErrListenerClosed, err)
+	}
+	return err
+}
+
+// readPackets reads packets from l, handling each of them in a new
+// goroutine, until reading fails, or until stop is closed and a read times
+// out.  The packet buffers are reused once handle returns.
+func readPackets(l *net.UDPConn, stop <-chan struct{}, handle func(addr *net.UDPAddr, packet []byte)) error {
+	conn, err := newBatchConn(l, packetBatchSize)
+	if err != nil {
+		return err
+	}
+	packets := make([]packet, packetBatchSize)
+	for {
+		for i := range packets {
+			if packets[i].buf == nil {
+				packets[i].buf = getPacketBuffer()
+			}
+		}
+		n, err := conn.readBatch(packets)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				select {
+				case <-stop:
+					return errHandedOver
+				default:
+				}
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		for i := range packets[:n] {
+			pk := packets[i]
+			packets[i].buf = nil
+			go func() {
+				handle(pk.addr, pk.data())
+				putPacketBuffer(pk.buf)
+			}()
+		}
+	}
 }
 
 // ListenAndServe listens for incoming CoAP requests on the given protocol and
 // address and proxy them to the HTTP server backendURL.
 func ListenAndServe(protocol, addr, backendURL string) error {
-	p := Proxy{BackendURL: backendURL}
-	return coap.ListenAndServe(protocol, addr, &proxyHandler{p})
+	udpAddr, err := net.ResolveUDPAddr(protocol, addr)
+	if err != nil {
+		return fmt.Errorf("crosscoap: resolving %v: %w", addr, err)
+	}
+	listener, err := net.ListenUDP(protocol, udpAddr)
+	if err != nil {
+		return fmt.Errorf("crosscoap: listening on %v: %w", addr, err)
+	}
+	p := Proxy{Listener: listener, BackendURL: backendURL}
+	return p.Serve()
 }
@@ -1,11 +1,16 @@
 package crosscoap
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dustin/go-coap"
 )
@@ -24,7 +29,7 @@ func TestProxyWithConfirmableRequest(t *testing.T) {
 		if len(r.TransferEncoding) > 0 {
 			t.Errorf("backend got unexpected Transfer-Encoding: %v", r.TransferEncoding)
 		}
-		if r.UserAgent() != "crosscoap/1.0" {
+		if r.UserAgent() != "crosscoap/"+Version() {
 			t.Errorf("backend got unexpected User-Agent: %v", r.UserAgent())
 		}
 		if r.Host != customUriHost {
@@ -142,7 +147,119 @@ func TestProxyWithBadCOAPPacket(t *testing.T) {
 	}
 }
 
-func createLocalUDPListener(t *testing.T) (*net.UDPConn, string) {
+func TestProxyWithAccessPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("backend got unexpected request %v %v", r.Method, r.URL)
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	policy := &AccessPolicy{Rules: []AccessRule{{Action: Deny, Methods: []coap.COAPCode{coap.DELETE}}}}
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, AccessPolicy: policy}
+	go proxy.Serve()
+
+	req := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.DELETE,
+		MessageID: 4321,
+	}
+	req.SetPathString("/some/path")
+
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv == nil {
+		t.Fatalf("Didn't receive CoAP response")
+	}
+	if rv.Code != coap.MethodNotAllowed {
+		t.Errorf("got CoAP code %v; expected %v", rv.Code, coap.MethodNotAllowed)
+	}
+}
+
+func TestProxyWithTooLargeRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("backend got unexpected request %v %v", r.Method, r.URL)
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, MaxRequestBodyBytes: 16}
+	go proxy.Serve()
+
+	req := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.POST,
+		MessageID: 4321,
+		Payload:   []byte("This payload is longer than 16 bytes"),
+	}
+	req.SetPathString("/some/path")
+
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv == nil {
+		t.Fatalf("Didn't receive CoAP response")
+	}
+	if rv.Code != coap.RequestEntityTooLarge {
+		t.Errorf("got CoAP code %v; expected %v", rv.Code, coap.RequestEntityTooLarge)
+	}
+	if rv.Option(coap.Size1) != uint32(16) {
+		t.Errorf("got Size1 %v; expected %v", rv.Option(coap.Size1), 16)
+	}
+}
+
+func TestProxyWithUnreachableBackendAndDiagnostics(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backendURL := backend.URL
+	backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backendURL, DiagnosticPayloads: true}
+	go proxy.Serve()
+
+	req := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.GET,
+		MessageID: 4321,
+	}
+	req.SetPathString("/some/path")
+
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv == nil {
+		t.Fatalf("Didn't receive CoAP response")
+	}
+	if rv.Code != coap.BadGateway {
+		t.Errorf("got CoAP code %v; expected %v", rv.Code, coap.BadGateway)
+	}
+	if string(rv.Payload) != "backend unreachable" {
+		t.Errorf("got body %q; expected %q", string(rv.Payload), "backend unreachable")
+	}
+	if rv.Option(coap.ContentFormat) != nil {
+		t.Errorf("got content format %v; expected none", rv.Option(coap.ContentFormat))
+	}
+}
+
+func createLocalUDPListener(t testing.TB) (*net.UDPConn, string) {
 	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal("Can't resolve UDP addr")
@@ -154,3 +271,618 @@ func createLocalUDPListener(t *testing.T) (*net.UDPConn, string) {
 	listenerAddr := udpListener.LocalAddr().String()
 	return udpListener, listenerAddr
 }
+
+func TestProxyWithOptionMapping(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Device-Class") != "class-a" {
+			t.Errorf("backend got X-Device-Class '%v'", r.Header.Get("X-Device-Class"))
+		}
+		if r.Header.Get("X-Request-ID") == "" {
+			t.Error("backend got no X-Request-ID")
+		}
+		w.Header().Set("X-Device-Class", "class-b")
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{
+		Listener:       udpListener,
+		BackendURL:     backend.URL,
+		OptionMappings: []OptionMapping{{Option: 2049, Header: "X-Device-Class"}},
+	}
+	go proxy.Serve()
+
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 4321}
+	req.SetPathString("/some/path")
+	data, err := marshalMessage(&req, []rawOption{{ID: 2049, Value: []byte("class-a")}})
+	if err != nil {
+		t.Fatalf("Error marshalling request: %v", err)
+	}
+	conn, err := net.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(coap.ResponseTimeout))
+	buf := make([]byte, maxCOAPPacketLen)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Error receiving response: %v", err)
+	}
+	rv, options, err := parsePacket(buf[:n])
+	if err != nil {
+		t.Fatalf("Error parsing response: %v", err)
+	}
+	if rv.Code != coap.Content || string(rv.Payload) != "OK" {
+		t.Errorf("got CoAP code %v payload '%s'", rv.Code, rv.Payload)
+	}
+	var deviceClass string
+	for _, o := range options {
+		if o.ID == 2049 {
+			deviceClass = string(o.Value)
+		}
+	}
+	if deviceClass != "class-b" {
+		t.Errorf("got options %v", options)
+	}
+}
+
+func TestProxyWithMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/some/path" {
+			t.Errorf("backend got path '%v'", r.URL.Path)
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL}
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	proxy.Use(func(next CoAPHandlerFunc) CoAPHandlerFunc {
+		return func(addr *net.UDPAddr, m *coap.Message) *coap.Message {
+			record("auth")
+			if m.PathString() == "secret" {
+				return &coap.Message{Type: coap.Acknowledgement, Code: coap.Unauthorized, MessageID: m.MessageID}
+			}
+			return next(addr, m)
+		}
+	}, func(next CoAPHandlerFunc) CoAPHandlerFunc {
+		return func(addr *net.UDPAddr, m *coap.Message) *coap.Message {
+			record("rewrite")
+			m.SetPathString("/v2/" + m.PathString())
+			resp := next(addr, m)
+			resp.Payload = append(resp.Payload, '!')
+			return resp
+		}
+	})
+	go proxy.Serve()
+
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 4321}
+	req.SetPathString("/some/path")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != coap.Content || string(rv.Payload) != "OK!" {
+		t.Errorf("got CoAP code %v payload '%s'", rv.Code, rv.Payload)
+	}
+	mu.Lock()
+	if strings.Join(calls, ",") != "auth,rewrite" {
+		t.Errorf("middleware calls are %v", calls)
+	}
+	mu.Unlock()
+
+	req.MessageID++
+	req.SetPathString("/secret")
+	rv, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != coap.Unauthorized {
+		t.Errorf("got CoAP code %v; expected %v", rv.Code, coap.Unauthorized)
+	}
+}
+
+func TestProxyWithRequestContext(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Identity", r.Header.Get("X-Identity"))
+	}))
+	defer backend.Close()
+
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	proxy := &Proxy{BackendURL: backend.URL}
+	var contexts []*RequestContext
+	proxy.UseContext(func(next ContextHandlerFunc) ContextHandlerFunc {
+		return func(rc *RequestContext, m *coap.Message) *coap.Message {
+			contexts = append(contexts, rc)
+			if rc.Identity == "" && m.PathString() == "private" {
+				return &coap.Message{Type: coap.Acknowledgement, Code: coap.Unauthorized, MessageID: m.MessageID}
+			}
+			return next(rc, m)
+		}
+	})
+	proxy.Use(func(next CoAPHandlerFunc) CoAPHandlerFunc {
+		return func(addr *net.UDPAddr, m *coap.Message) *coap.Message {
+			if !addr.IP.Equal(a.IP) {
+				t.Errorf("middleware got client %v", addr)
+			}
+			return next(addr, m)
+		}
+	})
+	proxy.Director = func(req *http.Request, m *coap.Message) {
+		rc := RequestContextFrom(req.Context())
+		contexts = append(contexts, rc)
+		req.Header.Set("X-Identity", rc.Identity)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if rc := RequestContextFrom(resp.Request.Context()); rc == nil || rc.Identity != resp.Header.Get("X-Identity") {
+			t.Errorf("ModifyResponse got context %v", rc)
+		}
+		return nil
+	}
+	p := newProxyHandler(proxy)
+
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte{1}}
+	m.SetPathString("/private")
+	if coapResp := p.handleRequest(a, m, nil); coapResp == nil || coapResp.Code != coap.Unauthorized {
+		t.Errorf("response without identity is %v", coapResp)
+	}
+	if coapResp := p.handleRequestAs(a, "oscore:01", m, nil); coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("response with identity is %v", coapResp)
+	}
+	if len(contexts) != 3 || contexts[1] != contexts[2] {
+		t.Fatalf("contexts are %v", contexts)
+	}
+	rc := contexts[2]
+	if rc.Client != a || rc.Identity != "oscore:01" || rc.RequestID == "" || time.Since(rc.Received) > time.Minute {
+		t.Errorf("request context is %+v", rc)
+	}
+}
+
+func TestProxyWithDirector(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/devices/some/path" {
+			t.Errorf("backend got path '%v'", r.URL.Path)
+		}
+		if r.Header.Get("X-Message-ID") != "4321" {
+			t.Errorf("backend got X-Message-ID '%v'", r.Header.Get("X-Message-ID"))
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL}
+	proxy.Director = func(req *http.Request, m *coap.Message) {
+		req.URL.Path = "/devices" + req.URL.Path
+		req.Header.Set("X-Message-ID", strconv.Itoa(int(m.MessageID)))
+	}
+	go proxy.Serve()
+
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 4321}
+	req.SetPathString("/some/path")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != coap.Content || string(rv.Payload) != "OK" {
+		t.Errorf("got CoAP code %v payload '%s'", rv.Code, rv.Payload)
+	}
+}
+
+func TestProxyWithModifyResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"temp": 21, "secret": "s3cr3t"}`))
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, ModifyResponseErrorCode: coap.InternalServerError}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.Request.URL.Path == "/fail" {
+			return fmt.Errorf("rejected")
+		}
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"temp": 21}`))
+		return nil
+	}
+	go proxy.Serve()
+
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 4321}
+	req.SetPathString("/some/path")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != coap.Content || string(rv.Payload) != `{"temp": 21}` {
+		t.Errorf("got CoAP code %v payload '%s'", rv.Code, rv.Payload)
+	}
+
+	req.MessageID++
+	req.SetPathString("/fail")
+	rv, err = c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv.Code != coap.InternalServerError {
+		t.Errorf("got CoAP code %v; expected %v", rv.Code, coap.InternalServerError)
+	}
+}
+
+func TestProxyWithSeparateResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("Slow"))
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{
+		Listener:              udpListener,
+		BackendURL:            backend.URL,
+		SeparateResponseDelay: 50 * time.Millisecond,
+		AckTimeout:            100 * time.Millisecond,
+	}
+	go proxy.Serve()
+
+	conn, err := net.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer conn.Close()
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 777, Token: []byte("tok")}
+	req.SetPathString("/slow")
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error marshalling request: %v", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	receive := func() *coap.Message {
+		conn.SetReadDeadline(time.Now().Add(coap.ResponseTimeout))
+		buf := make([]byte, maxCOAPPacketLen)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Error receiving message: %v", err)
+		}
+		m, err := coap.ParseMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("Error parsing message: %v", err)
+		}
+		return &m
+	}
+
+	ack := receive()
+	if ack.Type != coap.Acknowledgement || ack.Code != 0 || ack.MessageID != 777 {
+		t.Errorf("got type %v code %v message ID %v; expected empty ACK", ack.Type, ack.Code, ack.MessageID)
+	}
+	resp := receive()
+	if resp.Type != coap.Confirmable || resp.Code != coap.Content || string(resp.Token) != "tok" || string(resp.Payload) != "Slow" {
+		t.Errorf("got type %v code %v token '%s' payload '%s'", resp.Type, resp.Code, resp.Token, resp.Payload)
+	}
+	// Not acknowledged, so it must be retransmitted
+	retransmitted := receive()
+	if retransmitted.MessageID != resp.MessageID || string(retransmitted.Payload) != "Slow" {
+		t.Errorf("got message ID %v payload '%s'", retransmitted.MessageID, retransmitted.Payload)
+	}
+	data, _ = (&coap.Message{Type: coap.Acknowledgement, MessageID: resp.MessageID}).MarshalBinary()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Error sending ACK: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, maxCOAPPacketLen)); err == nil {
+		t.Errorf("got %v bytes after the ACK", n)
+	}
+}
+
+func TestProxyWithNonConfirmableResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Stored"))
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, RespondToNonConfirmable: true}
+	go proxy.Serve()
+
+	conn, err := net.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer conn.Close()
+	req := coap.Message{Type: coap.NonConfirmable, Code: coap.POST, MessageID: 31, Token: []byte("meter")}
+	req.SetPathString("/readings")
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error marshalling request: %v", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(coap.ResponseTimeout))
+	buf := make([]byte, maxCOAPPacketLen)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Error receiving response: %v", err)
+	}
+	rv, err := coap.ParseMessage(buf[:n])
+	if err != nil {
+		t.Fatalf("Error parsing response: %v", err)
+	}
+	if rv.Type != coap.NonConfirmable {
+		t.Errorf("rv.Type is '%v'", rv.Type)
+	}
+	if rv.Code != coap.Created || string(rv.Payload) != "Stored" {
+		t.Errorf("got CoAP code %v payload '%s'", rv.Code, rv.Payload)
+	}
+	if string(rv.Token) != "meter" {
+		t.Errorf("rv.Token is '%s'", rv.Token)
+	}
+}
+
+func TestProxyWithPing(t *testing.T) {
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: "http://127.0.0.1:1/"}
+	go proxy.Serve()
+
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	rv, err := c.Send(coap.Message{Type: coap.Confirmable, MessageID: 999})
+	if err != nil {
+		t.Fatalf("Error sending ping: %v", err)
+	}
+	if rv.Type != coap.Reset || rv.Code != 0 || rv.MessageID != 999 {
+		t.Errorf("got type %v code %v message ID %v; expected RST", rv.Type, rv.Code, rv.MessageID)
+	}
+}
+
+func TestProxyWithBackendHost(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "api.example.com" {
+			t.Errorf("backend got Host '%v'", r.Host)
+		}
+		if r.TLS == nil || r.TLS.ServerName != "api.example.com" {
+			t.Errorf("backend got TLS state '%v'", r.TLS)
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, BackendHost: "api.example.com"})
+	// The test server's certificate isn't issued for api.example.com
+	p.hostTransport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	req.SetPathString("/status")
+	req.SetOption(coap.URIHost, "device.local")
+	coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+	if coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("coapResp is '%v'", coapResp)
+	}
+}
+
+func TestProxyWithUserAgentAndDefaultHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != "gateway/2.0" {
+			t.Errorf("backend got User-Agent '%v'", r.UserAgent())
+		}
+		if r.Header.Get("X-Gateway-ID") != "gw-7" {
+			t.Errorf("backend got X-Gateway-ID '%v'", r.Header.Get("X-Gateway-ID"))
+		}
+		if r.Header.Get("Accept") != "application/json" {
+			t.Errorf("backend got Accept '%v'", r.Header.Get("Accept"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{
+		BackendURL:     backend.URL,
+		UserAgent:      "gateway/2.0",
+		DefaultHeaders: http.Header{"X-Gateway-Id": {"gw-7"}, "Accept": {"text/plain"}},
+	})
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	req.SetPathString("/status")
+	req.SetOption(coap.Accept, coap.AppJSON)
+	coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+	if coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("coapResp is '%v'", coapResp)
+	}
+}
+
+func TestProxyWithRouteTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{
+		BackendURL:         backend.URL,
+		DiagnosticPayloads: true,
+		RouteTimeouts: []RouteTimeout{
+			{PathPrefix: "/telemetry", Timeout: 50 * time.Millisecond},
+			{PathPrefix: "/firmware", Timeout: time.Minute},
+		},
+	})
+	for _, tt := range []struct {
+		path            string
+		expectedCode    coap.COAPCode
+		expectedPayload string
+	}{
+		{"/telemetry/temp", coap.GatewayTimeout, "backend timeout after 50ms"},
+		{"/firmware/image", coap.Content, "OK"},
+	} {
+		req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		req.SetPathString(tt.path)
+		coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+		if coapResp == nil {
+			t.Fatalf("%v: expected a response", tt.path)
+		}
+		if coapResp.Code != tt.expectedCode || string(coapResp.Payload) != tt.expectedPayload {
+			t.Errorf("%v: got CoAP code %v payload '%s'", tt.path, coapResp.Code, coapResp.Payload)
+		}
+	}
+}
+
+func TestProxyWithRedirects(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new?x=1", http.StatusMovedPermanently)
+		case "/loop":
+			http.Redirect(w, r, "/loop2", http.StatusFound)
+		case "/loop2":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/hops/1", "/hops/2":
+			hop, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+			http.Redirect(w, r, "/hops/"+strconv.Itoa(hop+1), http.StatusFound)
+		default:
+			w.Write([]byte("OK"))
+		}
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		proxy        Proxy
+		path         string
+		expectedCode coap.COAPCode
+		expectedPath []interface{}
+	}{
+		{Proxy{}, "/old", coap.Content, nil},
+		{Proxy{}, "/loop", coap.BadGateway, nil},
+		{Proxy{MaxRedirects: 1}, "/hops/1", coap.BadGateway, nil},
+		{Proxy{MaxRedirects: 2}, "/hops/1", coap.Content, nil},
+		{Proxy{TranslateRedirects: true}, "/old", coap.Content, []interface{}{"new"}},
+	} {
+		tt.proxy.BackendURL = backend.URL
+		p := newProxyHandler(&tt.proxy)
+		req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		req.SetPathString(tt.path)
+		coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+		if coapResp == nil {
+			t.Fatalf("%v: expected a response", tt.path)
+		}
+		if coapResp.Code != tt.expectedCode {
+			t.Errorf("%v: got CoAP code %v", tt.path, coapResp.Code)
+		}
+		if path := coapResp.Options(coap.LocationPath); fmt.Sprint(path) != fmt.Sprint(tt.expectedPath) {
+			t.Errorf("%v: Location-Path is %v", tt.path, path)
+		}
+		if tt.expectedPath == nil && tt.expectedCode == coap.Content && string(coapResp.Payload) != "OK" {
+			t.Errorf("%v: redirect not followed: '%s'", tt.path, coapResp.Payload)
+		}
+	}
+}
+
+func TestProxyWithResponseHeaderTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	timeout := 10 * time.Second
+	p := newProxyHandler(&Proxy{
+		BackendURL:            backend.URL,
+		Timeout:               &timeout,
+		ResponseHeaderTimeout: 50 * time.Millisecond,
+	})
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	req.SetPathString("/status")
+	start := time.Now()
+	coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+	if coapResp == nil || coapResp.Code != coap.GatewayTimeout {
+		t.Errorf("coapResp is '%v'", coapResp)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("elapsed is '%v'", elapsed)
+	}
+}
+
+func BenchmarkSendResponse(b *testing.B) {
+	udpListener, _ := createLocalUDPListener(b)
+	defer udpListener.Close()
+	client, _ := createLocalUDPListener(b)
+	defer client.Close()
+	p := newProxyHandler(&Proxy{})
+	coapResp := &translatedCOAPMessage{
+		Message:      coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: 1, Token: []byte("tok"), Payload: []byte(`{"temperature":21.5}`)},
+		ExtraOptions: []rawOption{{ID: 2049, Value: []byte("region-1")}},
+	}
+	coapResp.SetOption(coap.ContentFormat, coap.AppJSON)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.sendResponse(p.transportOf(udpListener), clientAddr, coapResp)
+	}
+}
+
+func TestProxyWithSeveralListeners(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	addrs := []string{crosscoapAddr}
+	var listeners []*net.UDPConn
+	if l, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err == nil {
+		defer l.Close()
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.LocalAddr().String())
+	}
+	other, otherAddr := createLocalUDPListener(t)
+	defer other.Close()
+	listeners = append(listeners, other)
+	addrs = append(addrs, otherAddr)
+	proxy := Proxy{Listener: udpListener, Listeners: listeners, BackendURL: backend.URL}
+	go proxy.Serve()
+
+	for i, addr := range addrs {
+		c, err := coap.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Error dialing %v: %v", addr, err)
+		}
+		req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: uint16(i)}
+		req.SetPathString("/status")
+		rv, err := c.Send(req)
+		if err != nil || rv == nil || string(rv.Payload) != "ok" {
+			t.Errorf("response from %v is '%v' (error %v)", addr, rv, err)
+		}
+	}
+}
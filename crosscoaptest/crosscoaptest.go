@@ -0,0 +1,165 @@
+// Package crosscoaptest provides utilities for testing code which uses
+// crosscoap, in the spirit of net/http/httptest: a Server runs a crosscoap
+// proxy on a loopback UDP port in front of an httptest backend, records the
+// HTTP requests the backend receives, and sends CoAP requests to the proxy.
+//
+// Example:
+//
+//	s := crosscoaptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//		w.Write([]byte("OK"))
+//	}))
+//	defer s.Close()
+//	resp, err := s.Send(crosscoaptest.NewRequest(coap.GET, "/some/path"))
+//	...
+//	req := s.LastRequest() // the translated HTTP request
+package crosscoaptest
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dustin/go-coap"
+	"github.com/ibm-security-innovation/crosscoap"
+)
+
+// RecordedRequest is an HTTP request received by the backend.
+type RecordedRequest struct {
+	Method string
+	URL    *url.URL
+	Header http.Header
+	Body   []byte
+}
+
+// Server is a crosscoap proxy in front of an httptest backend.
+type Server struct {
+	// Proxy is the proxy under test.  Its fields may be set between
+	// NewUnstartedServer and Start.
+	Proxy *crosscoap.Proxy
+
+	// Backend is the HTTP backend, which runs the handler given to
+	// NewServer.
+	Backend *httptest.Server
+
+	// Addr is the UDP address of the proxy, in the form "127.0.0.1:port".
+	Addr string
+
+	mu       sync.Mutex
+	requests []RecordedRequest
+	started  bool
+}
+
+// NewServer starts a backend running handler and a proxy in front of it.
+// The caller should call Close when finished.
+func NewServer(handler http.Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer starts a backend running handler and prepares a proxy
+// in front of it, without starting the proxy; the caller may configure
+// s.Proxy before calling Start.
+func NewUnstartedServer(handler http.Handler) *Server {
+	s := &Server{}
+	s.Backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, RecordedRequest{
+			Method: r.Method,
+			URL:    r.URL,
+			Header: r.Header,
+			Body:   body,
+		})
+		s.mu.Unlock()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	}))
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic("crosscoaptest: can't listen on UDP: " + err.Error())
+	}
+	s.Addr = udpListener.LocalAddr().String()
+	s.Proxy = &crosscoap.Proxy{Listener: udpListener, BackendURL: s.Backend.URL}
+	return s
+}
+
+// Start starts the proxy.
+func (s *Server) Start() {
+	if s.started {
+		panic("crosscoaptest: server already started")
+	}
+	s.started = true
+	go s.Proxy.Serve()
+}
+
+// Close stops the proxy and the backend.
+func (s *Server) Close() {
+	s.Proxy.Listener.Close()
+	s.Backend.Close()
+}
+
+// Requests returns the HTTP requests received by the backend so far.
+func (s *Server) Requests() []RecordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RecordedRequest(nil), s.requests...)
+}
+
+// LastRequest returns the last HTTP request received by the backend, or nil
+// if there was none.
+func (s *Server) LastRequest() *RecordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return nil
+	}
+	req := s.requests[len(s.requests)-1]
+	return &req
+}
+
+// ErrNoResponse is returned by Send when a confirmable request gets no
+// response.
+var ErrNoResponse = errors.New("crosscoaptest: no response")
+
+// Send sends the CoAP request m to the proxy and returns its response.  A
+// non-confirmable request returns a nil response.
+func (s *Server) Send(m coap.Message) (*coap.Message, error) {
+	c, err := coap.Dial("udp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Send(m)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil && m.IsConfirmable() {
+		return nil, ErrNoResponse
+	}
+	return resp, nil
+}
+
+var messageID uint32
+
+// NewRequest returns a confirmable CoAP request with the given method and
+// path (with an optional query, as for crosscoap.SetPath), a fresh message
+// ID and a token.
+func NewRequest(method coap.COAPCode, path string) coap.Message {
+	id := uint16(atomic.AddUint32(&messageID, 1))
+	m := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      method,
+		MessageID: id,
+		Token:     []byte{byte(id >> 8), byte(id)},
+	}
+	if err := crosscoap.SetPath(&m, path); err != nil {
+		panic("crosscoaptest: " + err.Error())
+	}
+	return m
+}
@@ -0,0 +1,46 @@
+package crosscoaptest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestServer(t *testing.T) {
+	s := NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Created"))
+	}))
+	s.Proxy.MaxRequestBodyBytes = 1024
+	s.Start()
+	defer s.Close()
+
+	if s.LastRequest() != nil {
+		t.Error("Expected no recorded request")
+	}
+	req := NewRequest(coap.POST, "/things")
+	req.SetOption(coap.ContentFormat, coap.TextPlain)
+	req.Payload = []byte("thing")
+	resp, err := s.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.Code != coap.Created || string(resp.Payload) != "Created" {
+		t.Errorf("got CoAP code %v payload '%s'", resp.Code, resp.Payload)
+	}
+	if string(resp.Token) != string(req.Token) {
+		t.Errorf("got token %x; expected %x", resp.Token, req.Token)
+	}
+	httpReq := s.LastRequest()
+	if httpReq == nil {
+		t.Fatal("Expected a recorded request")
+	}
+	if httpReq.Method != "POST" || httpReq.URL.Path != "/things" || string(httpReq.Body) != "thing" {
+		t.Errorf("backend got %v %v '%s'", httpReq.Method, httpReq.URL, httpReq.Body)
+	}
+	if len(s.Requests()) != 1 {
+		t.Errorf("got %v recorded requests", len(s.Requests()))
+	}
+}
@@ -0,0 +1,54 @@
+package crosscoap
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// metricAbandonedExchanges counts the confirmable exchanges whose backend
+// request was cancelled at their deadline, the client having given up.
+const metricAbandonedExchanges = "abandoned_exchanges"
+
+// maxTransmitWait is the time from the first transmission of a confirmable
+// message to when its sender gives up waiting for an acknowledgement
+// (MAX_TRANSMIT_WAIT, RFC 7252 section 4.8.2, is 93 seconds).
+func (p *Proxy) maxTransmitWait() time.Duration {
+	return time.Duration(float64(p.ackTimeout()) * float64(int(1)<<uint(p.maxRetransmit()+1)-1) * ackRandomFactor)
+}
+
+// exchangeDeadline returns the deadline of the exchange of the request m
+// received at start, or the zero time if it has none: only confirmable
+// requests answered with a piggybacked response have one, as an empty ACK
+// stops the client's retransmissions.
+func (p *proxyHandler) exchangeDeadline(m *coap.Message, start time.Time) time.Time {
+	if !p.ExchangeDeadlines || !m.IsConfirmable() || p.SeparateResponseDelay > 0 {
+		return time.Time{}
+	}
+	return start.Add(p.maxTransmitWait())
+}
+
+// withExchangeDeadline returns req cancelled at the deadline of the exchange
+// rc, if it has one, with the function which stops the deadline once the
+// exchange is answered.
+func withExchangeDeadline(req *http.Request, rc *RequestContext) (*http.Request, func()) {
+	if rc.Deadline.IsZero() {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	deadline := time.AfterFunc(time.Until(rc.Deadline), cancel)
+	return req.WithContext(ctx), func() { deadline.Stop() }
+}
+
+// abandoned reports whether the backend request of the exchange rc failed
+// with err because the exchange's deadline passed, and counts it if so.
+func (p *proxyHandler) abandoned(rc *RequestContext, err error) bool {
+	if rc.Deadline.IsZero() || !isCanceled(err) || time.Now().Before(rc.Deadline) {
+		return false
+	}
+	p.metrics().Counter(metricAbandonedExchanges, 1, nil)
+	p.logError("Backend request abandoned: the client gave up after %v (Request-ID=%v)", p.maxTransmitWait(), rc.RequestID)
+	return true
+}
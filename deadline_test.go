@@ -0,0 +1,70 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestExchangeDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer backend.Close()
+	timeout := 100 * time.Millisecond
+	metrics := NewPrometheusMetrics("crosscoap")
+	for _, tt := range []struct {
+		deadlines    bool
+		expectedCode coap.COAPCode
+	}{
+		{true, 0},
+		{false, coap.GatewayTimeout},
+	} {
+		p := newProxyHandler(&Proxy{
+			BackendURL:        backend.URL,
+			Timeout:           &timeout,
+			AckTimeout:        20 * time.Millisecond,
+			MaxRetransmit:     -1,
+			ExchangeDeadlines: tt.deadlines,
+			Metrics:           metrics,
+		})
+		m := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString("/slow")
+		start := time.Now()
+		coapResp := p.handle(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}, "", &m, nil, nil)
+		if tt.expectedCode == 0 {
+			if coapResp != nil || time.Since(start) >= timeout {
+				t.Errorf("abandoned exchange response is %v after %v", coapResp, time.Since(start))
+			}
+		} else if coapResp == nil || coapResp.Code != tt.expectedCode {
+			t.Errorf("exchange without deadline response is %v", coapResp)
+		}
+	}
+	w := adminRequest(newProxyHandler(&Proxy{Metrics: metrics}).adminHandler("secret"), "GET", "/metrics", "secret", "")
+	if body := w.Body.String(); !strings.Contains(body, "crosscoap_abandoned_exchanges_total 1") {
+		t.Errorf("metrics are %v", body)
+	}
+}
+
+func TestMaxTransmitWait(t *testing.T) {
+	for _, tt := range []struct {
+		p        *Proxy
+		expected time.Duration
+	}{
+		{&Proxy{}, 93 * time.Second},
+		{&Proxy{AckTimeout: time.Second, MaxRetransmit: 2}, 10500 * time.Millisecond},
+		{&Proxy{AckTimeout: time.Second, MaxRetransmit: -1}, 1500 * time.Millisecond},
+	} {
+		if wait := tt.p.maxTransmitWait(); wait != tt.expected {
+			t.Errorf("%v/%v: MAX_TRANSMIT_WAIT is %v", tt.p.AckTimeout, tt.p.MaxRetransmit, wait)
+		}
+	}
+}
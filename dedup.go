@@ -0,0 +1,185 @@
+package crosscoap
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// maxDeduplicatedExchanges is the number of exchanges remembered for
+// deduplication, beyond which new requests aren't.
+const maxDeduplicatedExchanges = 100000
+
+// metricDuplicateRequests counts the retransmitted requests answered from
+// the exchange cache.
+const metricDuplicateRequests = "duplicate_requests"
+
+// exchangeCache remembers the acknowledgement sent to each confirmable
+// request for ExchangeLifetime, so that retransmissions of the request are
+// answered again instead of being forwarded twice (RFC 7252 section 4.5).
+type exchangeCache struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	entries  map[transactionKey]*exchangeEntry
+}
+
+type exchangeEntry struct {
+	expires time.Time
+	ack     []byte // nil while the request is being handled
+}
+
+// newExchangeCache returns the exchange cache of p, or nil if
+// ExchangeLifetime is zero.
+func (p *proxyHandler) newExchangeCache() *exchangeCache {
+	if p.ExchangeLifetime <= 0 {
+		return nil
+	}
+	return &exchangeCache{lifetime: p.ExchangeLifetime, entries: make(map[transactionKey]*exchangeEntry)}
+}
+
+// begin records the request with message ID mid from a at now, unless it's
+// a duplicate of a request seen within the exchange lifetime: then it
+// returns its acknowledgement, if it was already sent.
+func (c *exchangeCache) begin(a *net.UDPAddr, mid uint16, now time.Time) (ack []byte, duplicate bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := messageKey(a, mid)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, found := c.entries[key]; found && !now.After(entry.expires) {
+		return entry.ack, true
+	}
+	if len(c.entries) < maxDeduplicatedExchanges {
+		c.entries[key] = &exchangeEntry{expires: now.Add(c.lifetime)}
+	}
+	return nil, false
+}
+
+// answered records data, the acknowledgement of the request with message
+// ID mid from a.
+func (c *exchangeCache) answered(a *net.UDPAddr, mid uint16, data []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, found := c.entries[messageKey(a, mid)]; found {
+		entry.ack = append([]byte(nil), data...)
+	}
+}
+
+// expire forgets the exchanges whose lifetime ended before now, and returns
+// their number.
+func (c *exchangeCache) expire(now time.Time) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expired := 0
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			expired++
+		}
+	}
+	return expired
+}
+
+// answerDuplicate sends ack again to a, which retransmitted the request it
+// acknowledges; if the request is still being handled, the retransmission
+// is ignored.
+func (p *proxyHandler) answerDuplicate(l transport, a *net.UDPAddr, ack []byte) {
+	p.metrics().Counter(metricDuplicateRequests, 1, nil)
+	if ack == nil {
+		return
+	}
+	if !p.amplification.spend(a, len(ack)) {
+		p.amplificationDropped(a, len(ack))
+		return
+	}
+	p.clients.sent(a, len(ack))
+	if err := l.SendMessage(a, ack); err != nil {
+		p.logError("Error sending CoAP response to %v: %v", a, err)
+	}
+}
+
+// metricDuplicateNonRequests counts the duplicated non-confirmable requests
+// collapsed into their first copy.
+const metricDuplicateNonRequests = "duplicate_non_requests"
+
+// RouteNonDeduplication collapses the non-confirmable requests whose path
+// lies below PathPrefix (matched on whole path segments), received again
+// from the same client endpoint with the same message ID within Window,
+// into the first one: it alone is forwarded to the backend, and the
+// duplicates are ignored (RFC 7252 section 4.5).  A zero Window exempts the
+// requests of the route.
+type RouteNonDeduplication struct {
+	PathPrefix string
+	Window     time.Duration
+}
+
+// nonDeduplicator remembers the non-confirmable requests within the window
+// of their route.
+type nonDeduplicator struct {
+	mu      sync.Mutex
+	expires map[transactionKey]time.Time
+}
+
+// newNonDeduplicator returns the deduplicator of p.  It exists even without
+// NonDeduplication routes, which the admin API may add at runtime.
+func (p *proxyHandler) newNonDeduplicator() *nonDeduplicator {
+	return &nonDeduplicator{expires: make(map[transactionKey]time.Time)}
+}
+
+// nonDedupWindow returns the deduplication window of the non-confirmable
+// request m: that of the first matching route setting one, or zero.
+func (p *proxyHandler) nonDedupWindow(m *coap.Message) time.Duration {
+	r := p.routeOverride(m, func(r *routeOverride) bool { return r.NonDeduplication != 0 })
+	if r == nil || r.NonDeduplication < 0 {
+		return 0
+	}
+	return r.NonDeduplication
+}
+
+// duplicate records the non-confirmable request m from a at now, and
+// reports whether it's a duplicate of one received within window.
+func (d *nonDeduplicator) duplicate(a *net.UDPAddr, m *coap.Message, window time.Duration, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	if window <= 0 {
+		return false
+	}
+	key := messageKey(a, m.MessageID)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if expires, found := d.expires[key]; found && now.Before(expires) {
+		return true
+	}
+	if len(d.expires) < maxDeduplicatedExchanges {
+		d.expires[key] = now.Add(window)
+	}
+	return false
+}
+
+// expire forgets the requests whose window ended before now, and returns
+// their number.
+func (d *nonDeduplicator) expire(now time.Time) int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expired := 0
+	for key, expires := range d.expires {
+		if !now.Before(expires) {
+			delete(d.expires, key)
+			expired++
+		}
+	}
+	return expired
+}
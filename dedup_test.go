@@ -0,0 +1,97 @@
+package crosscoap
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestDeduplication(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hit %v", atomic.AddInt32(&hits, 1))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, ExchangeLifetime: time.Minute})
+	tr := &fakeTransport{}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	send := func(typ coap.COAPType, mid uint16) *coap.Message {
+		m := coap.Message{Type: typ, Code: coap.POST, MessageID: mid, Token: []byte{byte(mid)}}
+		m.SetPathString("/counter")
+		packet, _ := m.MarshalBinary()
+		p.handlePacket(tr, client, packet)
+		return tr.sent[len(tr.sent)-1]
+	}
+
+	first := send(coap.Confirmable, 1)
+	if resp := send(coap.Confirmable, 1); resp.MessageID != 1 || string(resp.Payload) != "hit 1" || len(tr.sent) != 2 {
+		t.Errorf("response to a retransmission is '%s'", resp.Payload)
+	}
+	if string(first.Payload) != "hit 1" || hits != 1 {
+		t.Errorf("response is '%s' after %v backend requests", first.Payload, hits)
+	}
+	if resp := send(coap.Confirmable, 2); string(resp.Payload) != "hit 2" {
+		t.Errorf("response to another request is '%s'", resp.Payload)
+	}
+
+	p.sweep(time.Now().Add(2 * time.Minute))
+	if resp := send(coap.Confirmable, 1); string(resp.Payload) != "hit 3" {
+		t.Errorf("response to a request after the exchange lifetime is '%s'", resp.Payload)
+	}
+}
+
+func TestNonDeduplication(t *testing.T) {
+	// NON requests are forwarded asynchronously
+	forwarded := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.URL.Path
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, NonDeduplication: []RouteNonDeduplication{
+		{PathPrefix: "/telemetry/raw", Window: 0},
+		{PathPrefix: "/telemetry", Window: time.Minute},
+	}})
+	tr := &fakeTransport{}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	send := func(path string, mid uint16) bool {
+		m := coap.Message{Type: coap.NonConfirmable, Code: coap.POST, MessageID: mid, Token: []byte{byte(mid)}}
+		m.SetPathString(path)
+		packet, _ := m.MarshalBinary()
+		p.handlePacket(tr, client, packet)
+		select {
+		case <-forwarded:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	for _, tt := range []struct {
+		path              string
+		mid               uint16
+		expectedForwarded bool
+	}{
+		{"/telemetry/temp", 1, true},
+		{"/telemetry/temp", 1, false},
+		{"/telemetry/temp", 2, true},
+		{"/telemetry/raw", 3, true},
+		{"/telemetry/raw", 3, true},
+		{"/other", 4, true},
+		{"/other", 4, true},
+	} {
+		if forwarded := send(tt.path, tt.mid); forwarded != tt.expectedForwarded {
+			t.Errorf("%v MID %v: forwarded is %v", tt.path, tt.mid, forwarded)
+		}
+	}
+
+	p.sweep(time.Now().Add(2 * time.Minute))
+	if !send("/telemetry/temp", 1) {
+		t.Errorf("request after the window isn't forwarded")
+	}
+}
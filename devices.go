@@ -0,0 +1,228 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// maxDevices is the number of devices in the registry, beyond which the
+// least recently seen one is forgotten.
+const maxDevices = 100000
+
+// DeviceRegistry configures the registry of the UDP endpoints from which
+// devices last contacted the proxy, by device ID, so that the push API can
+// reach devices by ID even as NATs change their endpoints.  Only the OSCORE
+// IDs are authenticated: a client can claim any Uri-Host or ep.
+type DeviceRegistry struct {
+	// URIHost registers the Uri-Host option of requests as device ID (IPv6
+	// literals without brackets).
+	URIHost bool
+
+	// RegistrationPath, if set, registers the ep query parameter of the
+	// requests to this path as device ID, as in the registration
+	// interfaces of LwM2M and of the CoRE Resource Directory.  The
+	// requests are still sent to the backend.
+	RegistrationPath string
+
+	// OSCORE registers the Recipient ID (in hex, prefixed by "oscore:") of
+	// the OSCORE context of requests as device ID.
+	OSCORE bool
+
+	// File, if set, is a JSON file in which the registry is kept across
+	// restarts.
+	File string
+}
+
+// DeviceEndpoint is the endpoint from which a device last contacted the
+// proxy.
+type DeviceEndpoint struct {
+	Device   string    `json:"device"`
+	Endpoint string    `json:"endpoint"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// deviceRegistry is the runtime state of a DeviceRegistry.
+type deviceRegistry struct {
+	DeviceRegistry
+	mu      sync.Mutex
+	devices map[string]*DeviceEndpoint
+	saveMu  sync.Mutex // serializes the saves of File
+}
+
+// newDeviceRegistry returns the device registry of p, loaded from its file,
+// or nil if p has none.
+func (p *proxyHandler) newDeviceRegistry() *deviceRegistry {
+	if p.Devices == nil {
+		return nil
+	}
+	r := &deviceRegistry{DeviceRegistry: *p.Devices, devices: make(map[string]*DeviceEndpoint)}
+	if r.File != "" {
+		data, err := ioutil.ReadFile(r.File)
+		if err == nil {
+			var devices []DeviceEndpoint
+			if err = json.Unmarshal(data, &devices); err == nil {
+				for i := range devices {
+					r.devices[devices[i].Device] = &devices[i]
+				}
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			p.logError("Error loading the device registry: %v", err)
+		}
+	}
+	return r
+}
+
+// deviceSeen records that device contacted the proxy from a, saving the registry
+// if the endpoint of the device changed.
+func (p *proxyHandler) deviceSeen(device string, a *net.UDPAddr) {
+	r := p.devices
+	if r == nil || device == "" {
+		return
+	}
+	endpoint := a.String()
+	r.mu.Lock()
+	d := r.devices[device]
+	changed := d == nil || d.Endpoint != endpoint
+	if d == nil {
+		if len(r.devices) >= maxDevices {
+			r.forgetOldest()
+		}
+		d = &DeviceEndpoint{Device: device}
+		r.devices[device] = d
+	}
+	d.Endpoint, d.LastSeen = endpoint, time.Now()
+	r.mu.Unlock()
+	if changed {
+		p.logAccess("%v: Device %v registered", a, device)
+		if err := r.save(); err != nil {
+			p.logError("Error saving the device registry: %v", err)
+		}
+	}
+}
+
+func (r *deviceRegistry) forgetOldest() {
+	var oldest *DeviceEndpoint
+	for _, d := range r.devices {
+		if oldest == nil || d.LastSeen.Before(oldest.LastSeen) {
+			oldest = d
+		}
+	}
+	if oldest != nil {
+		delete(r.devices, oldest.Device)
+	}
+}
+
+// registerDevice records the device IDs of the request m from a.
+func (p *proxyHandler) registerDevice(a *net.UDPAddr, m *coap.Message) {
+	r := p.devices
+	if r == nil {
+		return
+	}
+	if r.URIHost {
+		if host, ok := uriHost(m); ok {
+			p.deviceSeen(host, a)
+		}
+	}
+	if r.RegistrationPath != "" && strings.Trim(r.RegistrationPath, "/") == m.PathString() {
+		for _, q := range m.Options(coap.URIQuery) {
+			if s, ok := q.(string); ok && strings.HasPrefix(s, "ep=") {
+				p.deviceSeen(s[len("ep="):], a)
+			}
+		}
+	}
+}
+
+// registerOSCOREDevice records the OSCORE Recipient ID kid of a request from
+// a which has been verified.
+func (p *proxyHandler) registerOSCOREDevice(a *net.UDPAddr, kid []byte) {
+	if p.devices != nil && p.devices.OSCORE {
+		p.deviceSeen(oscoreIdentity(kid), a)
+	}
+}
+
+// endpoint returns the endpoint of device, or nil if it isn't registered.
+func (r *deviceRegistry) endpoint(device string) *net.UDPAddr {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	d := r.devices[device]
+	r.mu.Unlock()
+	if d == nil {
+		return nil
+	}
+	a, err := net.ResolveUDPAddr("udp", d.Endpoint)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// devicesAt returns the devices registered at the endpoint a.
+func (r *deviceRegistry) devicesAt(a *net.UDPAddr) []string {
+	if r == nil {
+		return nil
+	}
+	endpoint := a.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var devices []string
+	for _, d := range r.devices {
+		if d.Endpoint == endpoint {
+			devices = append(devices, d.Device)
+		}
+	}
+	return devices
+}
+
+// snapshot returns the registered devices, sorted by ID.
+func (r *deviceRegistry) snapshot() []DeviceEndpoint {
+	devices := []DeviceEndpoint{}
+	if r == nil {
+		return devices
+	}
+	r.mu.Lock()
+	for _, d := range r.devices {
+		devices = append(devices, *d)
+	}
+	r.mu.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+	return devices
+}
+
+// save writes the registry to File, if set, replacing it atomically.
+func (r *deviceRegistry) save() error {
+	if r.File == "" {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	data, err := json.MarshalIndent(r.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(r.File), filepath.Base(r.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), r.File)
+}
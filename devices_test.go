@@ -0,0 +1,75 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestDeviceRegistry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	file := filepath.Join(t.TempDir(), "devices.json")
+	config := &Proxy{BackendURL: backend.URL, Devices: &DeviceRegistry{URIHost: true, RegistrationPath: "/rd", File: file}}
+	p := newProxyHandler(config)
+	request := func(a *net.UDPAddr, host, path string, queries ...string) {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1}
+		if host != "" {
+			m.SetOption(coap.URIHost, host)
+		}
+		m.SetPathString(path)
+		for _, q := range queries {
+			m.AddOption(coap.URIQuery, q)
+		}
+		p.handleRequest(a, m, nil)
+	}
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	request(first, "", "/rd", "lt=300", "ep=sensor-1")
+	request(first, "", "/other", "ep=ignored")
+	request(first, "gateway.example.com", "/a")
+	if a := p.devices.endpoint("sensor-1"); a == nil || a.String() != first.String() {
+		t.Errorf("endpoint of the registered device is '%v'", a)
+	}
+	if a := p.devices.endpoint("ignored"); a != nil {
+		t.Errorf("endpoint of a device not registered is '%v'", a)
+	}
+	if a := p.devices.endpoint("gateway.example.com"); a == nil {
+		t.Errorf("no endpoint of the Uri-Host device")
+	}
+
+	// The device moves behind its NAT
+	request(second, "", "/rd", "ep=sensor-1")
+	if a := p.devices.endpoint("sensor-1"); a == nil || a.String() != second.String() {
+		t.Errorf("endpoint of the device is '%v' after moving", a)
+	}
+	if devices := p.devices.devicesAt(second); len(devices) != 1 || devices[0] != "sensor-1" {
+		t.Errorf("devices at the new endpoint are '%v'", devices)
+	}
+
+	// The registry is kept across restarts
+	reloaded := newProxyHandler(config)
+	if devices := reloaded.devices.snapshot(); len(devices) != 2 || devices[1].Device != "sensor-1" || devices[1].Endpoint != second.String() {
+		t.Errorf("reloaded devices are '%v'", devices)
+	}
+}
+
+func TestPushToDeviceID(t *testing.T) {
+	p := newProxyHandler(&Proxy{QueueSize: 2, Devices: &DeviceRegistry{RegistrationPath: "/rd"}})
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	p.deviceSeen("sensor-1", a)
+	w := adminRequest(p.adminHandler("secret"), "POST", "/push", "secret", `{"device": "sensor-1", "method": "GET", "path": "/temp", "queue": true}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("push response is %v: %v", w.Code, w.Body)
+	}
+	if queue := p.queues.snapshot(); len(queue) != 1 || queue[0].Device != "sensor-1" {
+		t.Errorf("queue is '%v'", queue)
+	}
+	if w := adminRequest(p.adminHandler("secret"), "GET", "/devices", "secret", ""); w.Code != http.StatusOK {
+		t.Errorf("devices response is %v", w.Code)
+	}
+}
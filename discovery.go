@@ -0,0 +1,152 @@
+package crosscoap
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// Link is a resource advertised by the proxy in /.well-known/core.
+type Link struct {
+	// Target is the URI of the resource, for example "/sensors/temp".
+	Target string
+
+	// Params holds the link parameters, for example {"rt": "temperature",
+	// "ct": "0"}.  A parameter with an empty value (such as "obs") is
+	// written without a value.
+	Params map[string]string
+}
+
+func (l *Link) linkFormatJSON() map[string]interface{} {
+	link := map[string]interface{}{"href": l.Target}
+	for name, value := range l.Params {
+		if value == "" {
+			link[name] = true
+		} else {
+			link[name] = value
+		}
+	}
+	return link
+}
+
+// serveDiscovery answers a GET /.well-known/core request with the proxy's
+// DiscoveryLinks, and those of the backend if MergeBackendDiscovery is set.
+func (p *proxyHandler) serveDiscovery(m *coap.Message, options []rawOption, requestID string) *translatedCOAPMessage {
+	var links []map[string]interface{}
+	targets := make(map[string]bool)
+	for i := range p.DiscoveryLinks {
+		links = append(links, p.DiscoveryLinks[i].linkFormatJSON())
+		targets[p.DiscoveryLinks[i].Target] = true
+	}
+	if p.MergeBackendDiscovery {
+		backendLinks, err := p.fetchBackendDiscovery(m, options, requestID)
+		if err != nil {
+			p.logError("Error fetching backend discovery: %v (Request-ID=%v)", err, requestID)
+		}
+		for _, link := range backendLinks {
+			if href, _ := link["href"].(string); !targets[href] {
+				links = append(links, link)
+			}
+		}
+	}
+	links, err := filterLinks(links, m.Options(coap.URIQuery))
+	if err != nil {
+		return p.errorResponse(m, coap.BadRequest, err.Error())
+	}
+	payload, err := writeLinkFormat(links)
+	if err != nil {
+		p.logError("Error writing discovery links: %v (Request-ID=%v)", err, requestID)
+		return p.errorResponse(m, coap.InternalServerError, "invalid discovery links")
+	}
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	coapResp := &translatedCOAPMessage{
+		Message: coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   payload,
+		},
+	}
+	coapResp.SetOption(coap.ContentFormat, coap.AppLinkFormat)
+	return coapResp
+}
+
+// fetchBackendDiscovery returns the links listed by the backend's
+// /.well-known/core.
+func (p *proxyHandler) fetchBackendDiscovery(m *coap.Message, options []rawOption, requestID string) ([]map[string]interface{}, error) {
+	req, err := p.translator.TranslateRequest(m)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/link-format, application/link-format+json, application/json")
+	if err := p.prepareBackendRequest(req, m, options, requestID, nil); err != nil {
+		return nil, err
+	}
+	httpResp, httpBody, err := p.doHTTPRequest(req, p.requestTimeout(m))
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backend returned %v", httpResp.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/link-format":
+		return parseLinkFormat(httpBody)
+	case "application/link-format+json", "application/json":
+		return parseLinkFormatJSON(httpBody)
+	}
+	return nil, fmt.Errorf("unexpected Content-Type %q", contentType)
+}
+
+// filterLinks applies the query filters of a discovery request (RFC 6690
+// section 4.1): each "name=value" query keeps the links whose parameter (or
+// target, for "href") is value, or starts with it if value ends with "*".
+func filterLinks(links []map[string]interface{}, queries []interface{}) ([]map[string]interface{}, error) {
+	for _, query := range queries {
+		kv := strings.SplitN(query.(string), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid discovery filter %q", query)
+		}
+		var filtered []map[string]interface{}
+		for _, link := range links {
+			if linkMatches(link[kv[0]], kv[1]) {
+				filtered = append(filtered, link)
+			}
+		}
+		links = filtered
+	}
+	return links, nil
+}
+
+func linkMatches(param interface{}, pattern string) bool {
+	var values []string
+	switch v := param.(type) {
+	case []interface{}:
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+	case nil:
+		return false
+	default:
+		values = []string{fmt.Sprint(v)}
+	}
+	for _, value := range values {
+		// Parameters such as rt hold space-separated values
+		for _, word := range append(strings.Fields(value), value) {
+			if strings.HasSuffix(pattern, "*") && strings.HasPrefix(word, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			if word == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func discoveryRequest(queries ...string) *coap.Message {
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte("d")}
+	m.SetPathString("/.well-known/core")
+	for _, query := range queries {
+		m.AddOption(coap.URIQuery, query)
+	}
+	return m
+}
+
+func TestServeDiscovery(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/core" {
+			t.Errorf("backend got path '%v'", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/link-format")
+		w.Write([]byte(`</sensors/temp>;rt="temperature";obs,</sensors/light>;rt="light-lux"`))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{
+		BackendURL:     backend.URL,
+		ServeDiscovery: true,
+		DiscoveryLinks: []Link{
+			{Target: "/sensors/temp", Params: map[string]string{"rt": "temperature", "ct": "0"}},
+			{Target: "/status"},
+		},
+		MergeBackendDiscovery: true,
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	for _, tt := range []struct {
+		queries  []string
+		expected string
+	}{
+		{nil, `</sensors/temp>;ct=0;rt="temperature",</status>,</sensors/light>;rt="light-lux"`},
+		{[]string{"rt=light*"}, `</sensors/light>;rt="light-lux"`},
+		{[]string{"href=/status"}, `</status>`},
+	} {
+		coapResp := p.serveCOAP(a, discoveryRequest(tt.queries...), nil, nil)
+		if coapResp == nil {
+			t.Fatal("Expected a response")
+		}
+		if coapResp.Code != coap.Content {
+			t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+		}
+		if coapResp.Option(coap.ContentFormat) != coap.AppLinkFormat {
+			t.Errorf("Content-Format is '%v'", coapResp.Option(coap.ContentFormat))
+		}
+		if string(coapResp.Payload) != tt.expected {
+			t.Errorf("%v: payload is '%s'", tt.queries, coapResp.Payload)
+		}
+	}
+}
+
+func TestServeDiscoveryWithoutBackend(t *testing.T) {
+	p := newProxyHandler(&Proxy{
+		BackendURL:     "http://127.0.0.1:1/",
+		ServeDiscovery: true,
+		DiscoveryLinks: []Link{{Target: "/status", Params: map[string]string{"obs": ""}}},
+	})
+	coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, discoveryRequest(), nil, nil)
+	if coapResp == nil || string(coapResp.Payload) != "</status>;obs" {
+		t.Errorf("coapResp is '%v'", coapResp)
+	}
+}
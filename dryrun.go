@@ -0,0 +1,68 @@
+package crosscoap
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// maxDryRunPayload is the size of the payload of dry run responses beyond
+// which the backend request URL is truncated.
+const maxDryRunPayload = 256
+
+// dryRun logs the backend request req, translated from the CoAP request m
+// of a, instead of sending it, and returns a synthetic 2.05 Content
+// response naming it.
+func (p *proxyHandler) dryRun(a *net.UDPAddr, m *coap.Message, req *http.Request, requestID string) *translatedCOAPMessage {
+	digest := sha256.New()
+	var size int64
+	if req.Body != nil {
+		// Also completes streamed uploads
+		size, _ = io.Copy(digest, req.Body)
+		req.Body.Close()
+	}
+	redacted := p.redactedHeaders()
+	var headers []string
+	for name, values := range req.Header {
+		for _, value := range values {
+			if redacted[http.CanonicalHeaderKey(name)] {
+				value = "[redacted]"
+			}
+			headers = append(headers, name+": "+value)
+		}
+	}
+	if req.Host != "" {
+		headers = append(headers, "Host: "+req.Host)
+	}
+	sort.Strings(headers)
+	line := fmt.Sprintf("%v: dry run HTTP %v %v Headers=[%v] Body-Length=%v Body-SHA256=%x Request-ID=%v",
+		a, req.Method, req.URL, strings.Join(headers, "; "), size, digest.Sum(nil), requestID)
+	if p.AccessLog != nil {
+		p.AccessLog.Print(line)
+	} else {
+		p.logError("%v", line)
+	}
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	coapResp := &translatedCOAPMessage{
+		Message: coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte(req.Method + " " + req.URL.String()),
+		},
+	}
+	coapResp.SetOption(coap.ContentFormat, coap.TextPlain)
+	if len(coapResp.Payload) > maxDryRunPayload {
+		coapResp.Payload = coapResp.Payload[:maxDryRunPayload]
+	}
+	return coapResp
+}
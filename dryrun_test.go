@@ -0,0 +1,46 @@
+package crosscoap
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestProxyWithDryRun(t *testing.T) {
+	var accessLog bytes.Buffer
+	p := newProxyHandler(&Proxy{
+		BackendURL:     "http://127.0.0.1:1/api",
+		DryRun:         true,
+		AccessLog:      log.New(&accessLog, "", 0),
+		DefaultHeaders: http.Header{"Authorization": {"Bearer secret"}},
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1, Payload: []byte("abc")}
+	m.SetPathString("/sensors/temp")
+	m.SetOption(coap.ContentFormat, coap.TextPlain)
+	coapResp := p.handleRequest(a, m, nil)
+	if coapResp == nil || coapResp.Code != coap.Content || string(coapResp.Payload) != "POST http://127.0.0.1:1/api/sensors/temp" {
+		t.Errorf("response is '%v'", coapResp)
+	}
+
+	line := accessLog.String()
+	for _, expected := range []string{
+		"dry run HTTP POST http://127.0.0.1:1/api/sensors/temp",
+		"Authorization: [redacted]",
+		"Content-Type: text/plain",
+		"Body-Length=3",
+		"Body-SHA256=ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("access log '%v' lacks '%v'", line, expected)
+		}
+	}
+	if strings.Contains(line, "secret") {
+		t.Errorf("access log shows a secret: %v", line)
+	}
+}
@@ -0,0 +1,78 @@
+package crosscoap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// optionEcho is the Echo option (RFC 9175 section 2), which go-coap doesn't
+// know.
+const optionEcho uint16 = 252
+
+// echoLifetime is how long an Echo value verifies its client's address.
+const echoLifetime = time.Minute
+
+// echoVerifier issues and checks stateless Echo values: a timestamp and a MAC
+// of the timestamp and the client address.
+type echoVerifier struct {
+	key []byte
+	now func() time.Time
+}
+
+func newEchoVerifier() *echoVerifier {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &echoVerifier{key: key, now: time.Now}
+}
+
+func (v *echoVerifier) mac(a *net.UDPAddr, timestamp []byte) []byte {
+	h := hmac.New(sha256.New, v.key)
+	h.Write(timestamp)
+	h.Write([]byte(a.String()))
+	return h.Sum(nil)[:8]
+}
+
+// value returns a fresh Echo value for the client address a.
+func (v *echoVerifier) value(a *net.UDPAddr) []byte {
+	timestamp := make([]byte, 8, 16)
+	binary.BigEndian.PutUint64(timestamp, uint64(v.now().Unix()))
+	return append(timestamp, v.mac(a, timestamp)...)
+}
+
+// verify returns whether value is a fresh Echo value issued to a.
+func (v *echoVerifier) verify(a *net.UDPAddr, value []byte) bool {
+	if len(value) != 16 || !hmac.Equal(value[8:], v.mac(a, value[:8])) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+	age := v.now().Sub(issued)
+	return age >= -time.Second && age < echoLifetime
+}
+
+// challengeAddress returns a 4.01 Unauthorized with a fresh Echo option
+// (RFC 9175 section 2.4) to the request m, and true, if m carries no fresh
+// Echo value proving that the client receives packets at its address a:
+// the request is then answered without contacting the backend, and the
+// client repeats it with the Echo value.
+func (p *proxyHandler) challengeAddress(a *net.UDPAddr, m *coap.Message, options []rawOption) (*translatedCOAPMessage, bool) {
+	if p.echo == nil {
+		return nil, false
+	}
+	if value, found := findOption(options, optionEcho); found && p.echo.verify(a, value) {
+		return nil, false
+	}
+	p.logAccess("%v: CoAP %v URI-Path=%v challenged until the client address is verified", a, methodName(m.Code), m.PathString())
+	challenge := p.errorResponse(m, coap.Unauthorized, "")
+	if challenge != nil {
+		challenge.ExtraOptions = []rawOption{{ID: optionEcho, Value: p.echo.value(a)}}
+	}
+	return challenge, true
+}
@@ -0,0 +1,95 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestEchoVerifier(t *testing.T) {
+	v := newEchoVerifier()
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	value := v.value(a)
+	if !v.verify(a, value) {
+		t.Errorf("fresh Echo value isn't verified")
+	}
+	if v.verify(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5684}, value) {
+		t.Errorf("Echo value is verified for another address")
+	}
+	forged := append([]byte(nil), value...)
+	forged[7]++
+	if v.verify(a, forged) {
+		t.Errorf("forged Echo value is verified")
+	}
+	now = now.Add(echoLifetime)
+	if v.verify(a, value) {
+		t.Errorf("expired Echo value is verified")
+	}
+}
+
+// packetTransport records the packets sent by the proxy.
+type packetTransport struct {
+	transport
+	sent [][]byte
+}
+
+func (t *packetTransport) SendMessage(a *net.UDPAddr, message []byte) error {
+	t.sent = append(t.sent, append([]byte(nil), message...))
+	return nil
+}
+
+func TestProxyWithClientVerification(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 200)
+	var requests int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(body)
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, VerifyClientAddresses: true})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	send := func(echo []byte) *translatedCOAPMessage {
+		m := coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1, Token: []byte{1}}
+		m.SetPathString("/lamp")
+		var options []rawOption
+		if echo != nil {
+			options = append(options, rawOption{ID: optionEcho, Value: echo})
+		}
+		data, _ := appendMessage(nil, &m, options)
+		l := &packetTransport{}
+		p.handlePacket(l, a, data)
+		if len(l.sent) != 1 {
+			t.Fatalf("sent %v packets", len(l.sent))
+		}
+		coapResp, options, err := parsePacket(l.sent[0])
+		if err != nil {
+			t.Fatalf("Error parsing response: %v", err)
+		}
+		return &translatedCOAPMessage{Message: *coapResp, ExtraOptions: options}
+	}
+
+	coapResp := send(nil)
+	echo, found := findOption(coapResp.ExtraOptions, optionEcho)
+	if coapResp.Code != coap.Unauthorized || !found || len(coapResp.Payload) != 0 {
+		t.Fatalf("response to unverified client is '%v'", coapResp)
+	}
+	if requests != 0 {
+		t.Errorf("backend got %v requests of the unverified client", requests)
+	}
+	if coapResp = send([]byte("bogus")); coapResp.Code != coap.Unauthorized {
+		t.Errorf("response with bogus Echo is '%v'", coapResp)
+	}
+	if coapResp = send(echo); coapResp.Code != coap.Changed || !bytes.Equal(coapResp.Payload, body) {
+		t.Errorf("response to verified client is '%v'", coapResp)
+	}
+	if requests != 1 {
+		t.Errorf("backend got %v requests", requests)
+	}
+}
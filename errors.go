@@ -0,0 +1,42 @@
+package crosscoap
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dustin/go-coap"
+)
+
+// ErrListenerClosed is wrapped by the error Serve returns when one of its
+// listeners is closed other than by Shutdown.
+var ErrListenerClosed = errors.New("crosscoap: listener closed")
+
+// ErrAdminTokenRequired is returned by Serve when AdminListener is set
+// without AdminToken.
+var ErrAdminTokenRequired = errors.New("crosscoap: the admin API requires a bearer token")
+
+// ErrForbidden is wrapped by the errors of an Authenticator which denies a
+// request with 4.03 Forbidden, the client being known but not allowed.
+var ErrForbidden = errors.New("crosscoap: forbidden")
+
+// BackendError is returned by TranslateResponse when the backend couldn't
+// be reached, or its response couldn't be used: StatusCode is the status of
+// the backend response, or zero if there was none, Code is the CoAP
+// response code translated instead, and Err the underlying error, such as
+// a *net.OpError or context.DeadlineExceeded.
+type BackendError struct {
+	StatusCode int
+	Code       coap.COAPCode
+	Err        error
+}
+
+func (e *BackendError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("backend response %v: %v", e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("backend request: %v", e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,65 @@
+package crosscoap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestServeErrors(t *testing.T) {
+	admin, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer admin.Close()
+	listener, _ := createLocalUDPListener(t)
+	p := &Proxy{Listener: listener, AdminListener: admin}
+	if err := p.Serve(); err != ErrAdminTokenRequired {
+		t.Errorf("Serve without admin token returned '%v'", err)
+	}
+
+	p = &Proxy{Listener: listener}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Serve()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	listener.Close()
+	if err := <-errs; !errors.Is(err, ErrListenerClosed) {
+		t.Errorf("Serve with a closed listener returned '%v'", err)
+	}
+}
+
+func TestTranslateResponseBackendError(t *testing.T) {
+	coapReq := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	coapResp, _, err := (&Translator{}).TranslateResponse(nil, nil, context.DeadlineExceeded, &coapReq)
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) || backendErr.Code != coap.GatewayTimeout || backendErr.StatusCode != 0 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error is '%v'", err)
+	}
+	if coapResp.Code != coap.GatewayTimeout {
+		t.Errorf("response is '%v'", coapResp)
+	}
+
+	httpResp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}}
+	coapReq.SetOption(coap.Accept, appCBOR)
+	_, _, err = (&Translator{TranscodeCBOR: true}).TranslateResponse(httpResp, []byte("{"), nil, &coapReq)
+	if !errors.As(err, &backendErr) || backendErr.Code != coap.BadGateway || backendErr.StatusCode != http.StatusOK {
+		t.Errorf("error of an invalid backend body is '%v'", err)
+	}
+}
+
+func TestTranslationErrorCause(t *testing.T) {
+	coapReq := coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1, Payload: []byte{0xff}}
+	coapReq.SetOption(coap.ContentFormat, appCBOR)
+	_, err := (&Translator{BackendURL: "http://localhost/", TranscodeCBOR: true}).TranslateRequest(&coapReq)
+	var translateErr *TranslationError
+	if !errors.As(err, &translateErr) || translateErr.Code != coap.BadRequest || translateErr.Err == nil {
+		t.Errorf("error is '%v'", err)
+	}
+	if err.Error() != "invalid CBOR payload" {
+		t.Errorf("reason is '%v'", err)
+	}
+}
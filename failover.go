@@ -0,0 +1,124 @@
+package crosscoap
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// metricBackendFailovers counts the backend requests sent again to a
+// failover backend, labeled by the backend which failed and the next one.
+const metricBackendFailovers = "backend_failovers"
+
+// failoverMethods are the idempotent methods of the backend requests which
+// are sent again to a failover backend.
+var failoverMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	"FETCH":            true,
+}
+
+// failoverBackends are the backends tried in turn after BackendURL.
+type failoverBackends struct {
+	backend   *url.URL
+	failovers []*url.URL
+}
+
+// newFailoverBackends returns the failover backends of p, or nil if it has
+// none.
+func (p *proxyHandler) newFailoverBackends() *failoverBackends {
+	if len(p.FailoverBackendURLs) == 0 {
+		return nil
+	}
+	backend, err := url.Parse(p.BackendURL)
+	if err != nil {
+		p.logError("Invalid backend URL, not failing over: %v", err)
+		return nil
+	}
+	f := &failoverBackends{backend: backend}
+	for _, s := range p.FailoverBackendURLs {
+		u, err := url.Parse(s)
+		if err != nil {
+			p.logError("Invalid failover backend URL %q: %v", s, err)
+			continue
+		}
+		f.failovers = append(f.failovers, u)
+	}
+	return f
+}
+
+// backendFailed reports whether a backend request which got httpResp, or
+// else failed with err, should be sent to another backend: the backend
+// couldn't be reached or answered with a 5xx status.  Timeouts aren't
+// retried, as the request has no time left.
+func backendFailed(httpResp *http.Response, err error) bool {
+	if err == nil {
+		return httpResp.StatusCode >= 500
+	}
+	if isCanceled(err) || errors.Is(err, errTooManyRedirects) || errors.Is(err, errRedirectLoop) {
+		return false
+	}
+	return translateBackendError(err) != coap.GatewayTimeout
+}
+
+// failover sends req to each of the failover backends in turn while the
+// previous one failed, starting with httpResp or err from BackendURL, and
+// returns the last response or error.  Requests whose method isn't
+// idempotent or whose body is streamed, or which don't go to BackendURL,
+// aren't sent again.
+func (p *proxyHandler) failover(httpClient *http.Client, req *http.Request, httpResp *http.Response, err error) (*http.Response, error) {
+	f := p.failovers
+	if f == nil || !failoverMethods[req.Method] || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return httpResp, err
+	}
+	client := *httpClient
+	client.Transport = p.transport
+	if p.BackendHost != "" && req.Host == p.BackendHost {
+		client.Transport = p.hostTransport
+	}
+	from := req.URL.Host
+	if rc := RequestContextFrom(req.Context()); rc != nil && rc.Backend != "" {
+		from = rc.Backend
+	}
+	for _, to := range f.failovers {
+		if !backendFailed(httpResp, err) {
+			break
+		}
+		failoverURL := rebaseURL(req.URL, f.backend, to)
+		if failoverURL == nil {
+			break
+		}
+		failoverReq := req.Clone(req.Context())
+		failoverReq.URL = failoverURL
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				break
+			}
+			failoverReq.Body = body
+		}
+		if signErr := p.signRequest(failoverReq, time.Now()); signErr != nil {
+			p.logError("Error signing failover HTTP request: %v (Request-ID=%v)", signErr, req.Header.Get(requestIDHeader))
+			break
+		}
+		var failure interface{} = err
+		if err == nil {
+			failure = httpResp.Status
+			httpResp.Body.Close()
+		}
+		p.metrics().Counter(metricBackendFailovers, 1, Labels{"from": from, "to": failoverURL.Host})
+		p.logError("Backend %v failed (%v), failing over to %v (Request-ID=%v)", from, failure, failoverURL.Host, req.Header.Get(requestIDHeader))
+		if rc := RequestContextFrom(req.Context()); rc != nil {
+			rc.Backend = failoverURL.Host
+		}
+		httpResp, err = client.Do(failoverReq)
+		from = failoverURL.Host
+	}
+	return httpResp, err
+}
@@ -0,0 +1,94 @@
+package crosscoap
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestFailoverBackends(t *testing.T) {
+	var primaryRequests int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryRequests++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	var failoverPath, failoverBody string
+	failover := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failoverPath = r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		failoverBody = string(body)
+		w.Write([]byte("ok"))
+	}))
+	defer failover.Close()
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{
+		BackendURL:          primary.URL + "/api",
+		FailoverBackendURLs: []string{unreachable.URL + "/api", failover.URL + "/v1"},
+		Metrics:             metrics,
+	})
+
+	for _, tt := range []struct {
+		code                    coap.COAPCode
+		payload                 string
+		expectedCode            coap.COAPCode
+		expectedPrimaryRequests int
+		expectedFailoverBody    string
+	}{
+		{coap.GET, "", coap.Content, 1, ""},
+		{coap.PUT, "on", coap.Changed, 2, "on"},
+		{coap.POST, "on", coap.ServiceUnavailable, 3, ""},
+	} {
+		failoverPath, failoverBody = "", ""
+		req := coap.Message{Type: coap.Confirmable, Code: tt.code, MessageID: 1, Payload: []byte(tt.payload)}
+		req.SetPathString("/lamp")
+		coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+		if coapResp == nil || coapResp.Code != tt.expectedCode {
+			t.Errorf("%v: response is %v", tt.code, coapResp)
+		}
+		if primaryRequests != tt.expectedPrimaryRequests {
+			t.Errorf("%v: primary backend got %v requests", tt.code, primaryRequests)
+		}
+		if tt.expectedCode == coap.ServiceUnavailable {
+			if failoverPath != "" {
+				t.Errorf("%v: failover backend got %v", tt.code, failoverPath)
+			}
+			continue
+		}
+		if failoverPath != "/v1/lamp" || failoverBody != tt.expectedFailoverBody {
+			t.Errorf("%v: failover backend got %v '%v'", tt.code, failoverPath, failoverBody)
+		}
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	if n := strings.Count(w.Body.String(), "crosscoap_backend_failovers_total{"); n != 2 {
+		t.Errorf("failover metrics are %v: %v", n, w.Body)
+	}
+}
+
+func TestBackendFailed(t *testing.T) {
+	for _, tt := range []struct {
+		httpResp *http.Response
+		err      error
+		expected bool
+	}{
+		{&http.Response{StatusCode: http.StatusOK}, nil, false},
+		{&http.Response{StatusCode: http.StatusNotFound}, nil, false},
+		{&http.Response{StatusCode: http.StatusBadGateway}, nil, true},
+		{nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{nil, errTooManyRedirects, false},
+		{nil, timeoutError{}, false},
+	} {
+		if failed := backendFailed(tt.httpResp, tt.err); failed != tt.expected {
+			t.Errorf("%v %v: failed is %v", tt.httpResp, tt.err, failed)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package crosscoap
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// ForwardProxyPolicy enables the forward-proxy mode, in which requests with
+// a Proxy-Uri or Proxy-Scheme option (RFC 7252 section 5.10.2) are sent to
+// the absolute URI they carry rather than to the backend.  Such requests
+// don't carry the backend credentials, DefaultHeaders or principal, nor
+// are they passed to the Director or signed, since they leave for hosts
+// other than the backend.
+type ForwardProxyPolicy struct {
+	// Schemes lists the URI schemes which may be proxied.  If empty, http
+	// and https are allowed.
+	Schemes []string
+
+	// Hosts lists the host names which may be proxied.  If empty, no host
+	// is allowed.
+	Hosts []string
+}
+
+var defaultForwardProxySchemes = []string{"http", "https"}
+
+func (fp *ForwardProxyPolicy) allowsScheme(scheme string) bool {
+	schemes := fp.Schemes
+	if len(schemes) == 0 {
+		schemes = defaultForwardProxySchemes
+	}
+	for _, allowed := range schemes {
+		if strings.EqualFold(allowed, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fp *ForwardProxyPolicy) allowsHost(host string) bool {
+	for _, allowed := range fp.Hosts {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func isForwardProxyRequest(coapMsg *coap.Message) bool {
+	return coapMsg.Option(coap.ProxyURI) != nil || coapMsg.Option(coap.ProxyScheme) != nil
+}
+
+type forwardProxyKey struct{}
+
+// withForwardProxy returns req marked as sent to the URI of a Proxy-Uri or
+// Proxy-Scheme option rather than to the backend.
+func withForwardProxy(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), forwardProxyKey{}, true))
+}
+
+// forwardProxied reports whether req is sent to the URI of a Proxy-Uri or
+// Proxy-Scheme option, which must not get the backend's secrets.
+func forwardProxied(req *http.Request) bool {
+	forward, _ := req.Context().Value(forwardProxyKey{}).(bool)
+	return forward
+}
+
+// forwardProxyURL returns the URL of a request with a Proxy-Uri or
+// Proxy-Scheme option.
+func (t *Translator) forwardProxyURL(coapMsg *coap.Message) (string, error) {
+	if t.ForwardProxy == nil {
+		return "", &TranslationError{Code: coap.ProxyingNotSupported, Reason: "forward proxying is disabled"}
+	}
+	var u *url.URL
+	if proxyURI, ok := coapMsg.Option(coap.ProxyURI).(string); ok {
+		var err error
+		if u, err = url.Parse(proxyURI); err != nil || !u.IsAbs() || u.Host == "" {
+			return "", &TranslationError{Code: coap.BadOption, Reason: "invalid Proxy-Uri", Err: err}
+		}
+	} else {
+		// The URI is composed from the Uri-* options (RFC 7252 section 6.5)
+		host, ok := uriHost(coapMsg)
+		if !ok {
+			return "", &TranslationError{Code: coap.BadRequest, Reason: "Proxy-Scheme without Uri-Host"}
+		}
+		var port string
+		if n, ok := coapMsg.Option(coap.URIPort).(uint32); ok {
+			port = strconv.Itoa(int(n))
+		}
+		u = &url.URL{
+			Scheme:   coapMsg.Option(coap.ProxyScheme).(string),
+			Host:     urlHost(host, port),
+			Path:     "/" + coapMsg.PathString(),
+			RawQuery: strings.TrimPrefix(queryString(coapMsg), "?"),
+		}
+	}
+	if !t.ForwardProxy.allowsScheme(u.Scheme) {
+		return "", &TranslationError{Code: coap.ProxyingNotSupported, Reason: "unsupported proxy scheme " + u.Scheme}
+	}
+	if !t.ForwardProxy.allowsHost(u.Hostname()) {
+		return "", &TranslationError{Code: coap.Forbidden, Reason: "proxy host not allowed"}
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,109 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestTranslateForwardProxyRequest(t *testing.T) {
+	translator := Translator{
+		BackendURL:   "http://localhost:9876/backend/",
+		ForwardProxy: &ForwardProxyPolicy{Hosts: []string{"api.example.com"}},
+	}
+	proxyURIMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	proxyURIMsg.SetOption(coap.ProxyURI, "https://api.example.com:8443/v1/status?verbose")
+	proxySchemeMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 2}
+	proxySchemeMsg.SetOption(coap.ProxyScheme, "http")
+	proxySchemeMsg.SetOption(coap.URIHost, "api.example.com")
+	proxySchemeMsg.SetOption(coap.URIPort, uint32(8080))
+	proxySchemeMsg.SetPathString("/v1/readings")
+	proxySchemeMsg.SetOption(coap.URIQuery, "limit=5")
+
+	for _, tt := range []struct {
+		coapMsg     *coap.Message
+		expectedURL string
+	}{
+		{&proxyURIMsg, "https://api.example.com:8443/v1/status?verbose"},
+		{&proxySchemeMsg, "http://api.example.com:8080/v1/readings?limit=5"},
+	} {
+		httpReq, err := translator.TranslateRequest(tt.coapMsg)
+		if err != nil {
+			t.Fatalf("Error translating request: %v", err)
+		}
+		if httpReq.URL.String() != tt.expectedURL {
+			t.Errorf("httpReq.URL is '%v'", httpReq.URL)
+		}
+		if httpReq.Host != "" && httpReq.Host != httpReq.URL.Host {
+			t.Errorf("httpReq.Host is '%v'", httpReq.Host)
+		}
+	}
+}
+
+func TestTranslateForwardProxyRequestErrors(t *testing.T) {
+	policy := &ForwardProxyPolicy{Hosts: []string{"api.example.com"}}
+	for _, tt := range []struct {
+		policy       *ForwardProxyPolicy
+		proxyURI     string
+		expectedCode coap.COAPCode
+	}{
+		{nil, "http://api.example.com/", coap.ProxyingNotSupported},
+		{policy, "coap://api.example.com/", coap.ProxyingNotSupported},
+		{policy, "http://internal.example.com/", coap.Forbidden},
+		{&ForwardProxyPolicy{}, "http://api.example.com/", coap.Forbidden},
+		{policy, "/relative", coap.BadOption},
+	} {
+		coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		coapMsg.SetOption(coap.ProxyURI, tt.proxyURI)
+		translator := Translator{BackendURL: "http://localhost:9876/", ForwardProxy: tt.policy}
+		_, err := translator.TranslateRequest(&coapMsg)
+		translateErr, ok := err.(*TranslationError)
+		if !ok || translateErr.Code != tt.expectedCode {
+			t.Errorf("%v: err is '%v'", tt.proxyURI, err)
+		}
+	}
+}
+
+func TestForwardProxyWithoutBackendSecrets(t *testing.T) {
+	var header http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+	var directed bool
+	p := newProxyHandler(&Proxy{
+		BackendURL:           "http://127.0.0.1:1/api",
+		ForwardProxy:         &ForwardProxyPolicy{Hosts: []string{originURL.Hostname()}},
+		DefaultHeaders:       http.Header{"X-Api-Key": {"secret"}},
+		PrincipalHeader:      "X-Principal",
+		CredentialsByURIHost: true,
+		HMAC:                 &HMACSigner{Key: []byte("secret")},
+		BackendCredentials: func(identity string) (http.Header, bool) {
+			return http.Header{"Authorization": {"Bearer device"}}, true
+		},
+		Director: func(req *http.Request, m *coap.Message) {
+			directed = true
+		},
+	})
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	m.SetOption(coap.ProxyURI, origin.URL+"/status")
+	m.SetOption(coap.URIHost, "device-1")
+	coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, m, nil, nil)
+	if coapResp == nil || coapResp.Code != coap.Content {
+		t.Fatalf("response is %v", coapResp)
+	}
+	for _, name := range []string{"Authorization", "X-Api-Key", "X-Principal", defaultHMACHeader} {
+		if value := header.Get(name); value != "" {
+			t.Errorf("%v header is '%v'", name, value)
+		}
+	}
+	if directed {
+		t.Errorf("forward proxied request passed to the Director")
+	}
+}
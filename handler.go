@@ -0,0 +1,93 @@
+package crosscoap
+
+import (
+	"math"
+	"net"
+
+	"github.com/dustin/go-coap"
+)
+
+// NewHandler returns a CoAP handler proxying the requests it's given to the
+// backend of p, for applications running their own go-coap server: mounted
+// on some paths (with coap.ServeMux, for instance), it translates them
+// alongside the application's native CoAP resources.  The listeners of p
+// aren't used, and since the handler returns its response to the server,
+// responses are always piggybacked and Observe registrations aren't
+// supported.  The server drops the request options which go-coap doesn't
+// know, so block-wise uploads, requests for further Block2 blocks and OSCORE
+// aren't supported either; the responses keep their options (such as the
+// Block2 and Size2 options of the first block of a large response).
+//
+// The handler runs the background tasks of p (expiring transfers, resolving
+// backends, prefetching and reloading OSCORE contexts) until p.Shutdown is
+// called, which also drains the requests in progress; afterwards the
+// handler answers 5.03 Service Unavailable.
+func NewHandler(p *Proxy) coap.Handler {
+	handler := newProxyHandler(p)
+	done := handler.life.closed
+	go handler.runJanitor(done)
+	go handler.maintainBackends(done)
+	go handler.prefetch(done)
+	go handler.reloadOSCOREContexts(done)
+	return coap.FuncHandler(handler.serveEmbedded)
+}
+
+// serveEmbedded answers the request m from a, received by another go-coap
+// server.  The messages go through the wire format, for the options that
+// go-coap doesn't know of.
+func (p *proxyHandler) serveEmbedded(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		p.logError("Error encoding CoAP request from %v: %v", a, err)
+		return nil
+	}
+	m, options, err := parsePacket(data)
+	if err != nil {
+		p.logError("Error parsing CoAP request from %v: %v", a, err)
+		return nil
+	}
+	isRequest := m.Code != 0 && m.Code>>5 == 0 && (m.Type == coap.Confirmable || m.Type == coap.NonConfirmable)
+	p.clients.received(a, len(data), isRequest, false)
+	if !isRequest {
+		return nil
+	}
+	p.life.exchangeStarted()
+	defer p.life.exchangeDone()
+	coapResp := p.shuttingDown(m, options)
+	if coapResp == nil {
+		coapResp = p.handleRequest(a, m, options)
+	}
+	if coapResp == nil {
+		return nil
+	}
+	if coapResp.Code >= coap.BadRequest {
+		p.clients.failed(a)
+	}
+	if !m.IsConfirmable() {
+		coapResp.Type = coap.NonConfirmable
+		coapResp.MessageID = p.transactions.nextMessageID()
+	}
+	resp := embeddedResponse(coapResp)
+	data, err = resp.MarshalBinary()
+	if err != nil {
+		p.logError("Error encoding CoAP response: %v", err)
+		return nil
+	}
+	p.clients.sent(a, len(data))
+	return resp
+}
+
+// embeddedResponse returns coapResp with its extra options added as opaque
+// values, which go-coap encodes whatever their number, so that they reach
+// the client through the server of NewHandler.
+func embeddedResponse(coapResp *translatedCOAPMessage) *coap.Message {
+	resp := coapResp.Message
+	for _, o := range coapResp.ExtraOptions {
+		if o.ID > math.MaxUint8 {
+			// Numbers above 255 would wrap around in go-coap
+			continue
+		}
+		resp.AddOption(coap.OptionID(o.ID), o.Value)
+	}
+	return &resp
+}
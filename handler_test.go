@@ -0,0 +1,98 @@
+package crosscoap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestNewHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("path " + r.URL.Path))
+	}))
+	defer backend.Close()
+	h := NewHandler(&Proxy{BackendURL: backend.URL, RespondToNonConfirmable: true})
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 7, Token: []byte{1}}
+	m.SetPathString("/api/temp")
+	resp := h.ServeCOAP(nil, a, m)
+	if resp == nil {
+		t.Fatal("no response")
+	}
+	if resp.Type != coap.Acknowledgement || resp.MessageID != 7 || resp.Code != coap.Content || string(resp.Payload) != "path /api/temp" {
+		t.Errorf("response is %v %v '%s'", resp.Type, resp.Code, resp.Payload)
+	}
+
+	m = &coap.Message{Type: coap.NonConfirmable, Code: coap.GET, MessageID: 8}
+	m.SetPathString("/api/temp")
+	if resp := h.ServeCOAP(nil, a, m); resp == nil || resp.Type != coap.NonConfirmable || resp.MessageID == 8 {
+		t.Errorf("response to a non-confirmable request is %v", resp)
+	}
+
+	ack := &coap.Message{Type: coap.Acknowledgement, MessageID: 9}
+	if resp := h.ServeCOAP(nil, a, ack); resp != nil {
+		t.Errorf("response to an acknowledgement is %v", resp)
+	}
+}
+
+func TestNewHandlerBlock2(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	h := NewHandler(&Proxy{BackendURL: backend.URL, OversizePolicy: Block2Oversize})
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 7, Token: []byte{1}}
+	m.SetPathString("/firmware")
+	resp := h.ServeCOAP(nil, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}, m)
+	if resp == nil || resp.Code != coap.Content {
+		t.Fatalf("response is %v", resp)
+	}
+	// The options reach the client as the server sends them
+	data, err := resp.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding response: %v", err)
+	}
+	_, options, err := parsePacket(data)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v", err)
+	}
+	value, found := findOption(options, optionBlock2)
+	block, _ := parseBlockOption(value)
+	if !found || block.Num != 0 || !block.More || !bytes.Equal(resp.Payload, body[:block.size()]) {
+		t.Errorf("response has Block2 %v (found %v) and %v bytes", block, found, len(resp.Payload))
+	}
+	if value, found := findOption(options, optionSize2); !found || !bytes.Equal(value, uintOption(optionSize2, uint32(len(body))).Value) {
+		t.Errorf("response has Size2 %x (found %v)", value, found)
+	}
+}
+
+func TestNewHandlerShutdown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	p := &Proxy{BackendURL: "http://127.0.0.1:1/"}
+	h := NewHandler(p)
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Errorf("Error shutting down: %v", err)
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%v goroutines are left running", n-goroutines)
+	}
+
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 7}
+	m.SetPathString("/api/temp")
+	if resp := h.ServeCOAP(nil, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}, m); resp == nil || resp.Code != coap.ServiceUnavailable {
+		t.Errorf("response after shutdown is %v", resp)
+	}
+}
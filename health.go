@@ -0,0 +1,142 @@
+package crosscoap
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+const (
+	// healthPath is the CoAP resource answered when ServeHealth is set.
+	healthPath = "health"
+
+	// backendCheckInterval is how long the result of a backend reachability
+	// check is reused, so that frequent probes don't flood the backend
+	// with connections.
+	backendCheckInterval = 5 * time.Second
+
+	defaultBackendCheckTimeout = 2 * time.Second
+)
+
+// health tracks whether a proxy is serving its listeners and can reach its
+// backend.
+type health struct {
+	mu         sync.Mutex
+	listeners  int // being served
+	total      int
+	checked    time.Time
+	backendErr error
+	dial       func(network, address string) (net.Conn, error)
+}
+
+func (p *proxyHandler) newHealth() *health {
+	timeout := p.DialTimeout
+	if timeout == 0 || timeout > defaultBackendCheckTimeout {
+		timeout = defaultBackendCheckTimeout
+	}
+	return &health{dial: (&net.Dialer{Timeout: timeout}).Dial}
+}
+
+// serving records that a listener started (delta 1) or stopped (delta -1)
+// being served.
+func (h *health) serving(delta int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners += delta
+	if delta > 0 {
+		h.total += delta
+	}
+}
+
+// live reports whether all the listeners are being served.
+func (h *health) live() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.total == 0 || h.listeners < h.total {
+		return errors.New("listeners not serving")
+	}
+	return nil
+}
+
+// ready reports whether the proxy is live and its backend reachable.
+func (h *health) ready(backendURL string) error {
+	if err := h.live(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.checked) >= backendCheckInterval {
+		h.backendErr = h.checkBackend(backendURL)
+		h.checked = time.Now()
+	}
+	return h.backendErr
+}
+
+// checkBackend opens and closes a TCP connection to the backend.
+func (h *health) checkBackend(backendURL string) error {
+	u, err := url.Parse(backendURL)
+	if err != nil || u.Host == "" {
+		// Requests go to their own URIs (URITemplate or ForwardProxy)
+		return nil
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(strings.Trim(u.Host, "[]"), port)
+	}
+	conn, err := h.dial("tcp", address)
+	if err != nil {
+		return errors.New("backend unreachable")
+	}
+	conn.Close()
+	return nil
+}
+
+func isHealthCheck(m *coap.Message) bool {
+	path := m.Path()
+	return len(path) == 1 && path[0] == healthPath
+}
+
+// serveHealth answers a CoAP health check with 2.05 Content if the proxy is
+// ready, else with 5.03 Service Unavailable.
+func (p *proxyHandler) serveHealth(m *coap.Message) *translatedCOAPMessage {
+	if err := p.health.ready(p.checkedBackendURL()); err != nil {
+		return p.errorResponse(m, coap.ServiceUnavailable, err.Error())
+	}
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	coapResp := &translatedCOAPMessage{
+		Message: coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte("ok"),
+		},
+	}
+	coapResp.SetOption(coap.ContentFormat, coap.TextPlain)
+	coapResp.SetOption(coap.MaxAge, uint32(0))
+	return coapResp
+}
+
+// serveHTTPHealth answers an HTTP probe with the result of check.
+func serveHTTPHealth(w http.ResponseWriter, check func() error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := check(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,84 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestProxyWithHealthResource(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("backend got %v %v", r.Method, r.URL)
+	}))
+	defer backend.Close()
+
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, ServeHealth: true}
+	go proxy.Serve()
+
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	req.SetPathString("/health")
+	c, err := coap.Dial("udp", crosscoapAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv == nil || rv.Code != coap.Content || string(rv.Payload) != "ok" {
+		t.Errorf("response is '%v'", rv)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, ServeHealth: true, DiagnosticPayloads: true})
+	handler := p.adminHandler("secret")
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	m.SetPathString("/health")
+
+	if w := adminRequest(handler, "GET", "/healthz", "", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("liveness before serving is %v", w.Code)
+	}
+	if coapResp := p.handleRequest(a, m, nil); coapResp == nil || coapResp.Code != coap.ServiceUnavailable {
+		t.Errorf("CoAP health before serving is '%v'", coapResp)
+	}
+
+	p.health.serving(1)
+	if w := adminRequest(handler, "GET", "/healthz", "", ""); w.Code != http.StatusOK {
+		t.Errorf("liveness is %v", w.Code)
+	}
+	if w := adminRequest(handler, "GET", "/readyz", "", ""); w.Code != http.StatusOK {
+		t.Errorf("readiness is %v: %v", w.Code, w.Body)
+	}
+	if coapResp := p.handleRequest(a, m, nil); coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("CoAP health is '%v'", coapResp)
+	}
+
+	backend.Close()
+	if w := adminRequest(handler, "GET", "/readyz", "", ""); w.Code != http.StatusOK {
+		t.Errorf("readiness within the check interval is %v", w.Code)
+	}
+	p.health.checked = time.Time{}
+	if w := adminRequest(handler, "GET", "/readyz", "", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness with the backend down is %v", w.Code)
+	}
+	if coapResp := p.handleRequest(a, m, nil); coapResp == nil || coapResp.Code != coap.ServiceUnavailable || string(coapResp.Payload) != "backend unreachable" {
+		t.Errorf("CoAP health with the backend down is '%v'", coapResp)
+	}
+	if w := adminRequest(handler, "GET", "/healthz", "", ""); w.Code != http.StatusOK {
+		t.Errorf("liveness with the backend down is %v", w.Code)
+	}
+
+	p.health.serving(-1)
+	if w := adminRequest(handler, "GET", "/healthz", "", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("liveness with a listener down is %v", w.Code)
+	}
+}
@@ -0,0 +1,84 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// Headers set by ForwardClientAddress.
+const (
+	forwardedForHeader = "X-Forwarded-For"
+	forwardedHeader    = "Forwarded"
+)
+
+// uriHost returns the Uri-Host option of m, if it has one, without the
+// brackets of an IPv6 literal and with its zone ID decoded (RFC 6874), so
+// that "[fe80::1%25eth0]" and "fe80::1%eth0" are the same host.
+func uriHost(m *coap.Message) (string, bool) {
+	host, ok := m.Option(coap.URIHost).(string)
+	if !ok {
+		return "", false
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = strings.Replace(host[1:len(host)-1], "%25", "%", 1)
+	}
+	return host, true
+}
+
+// isIPv6Literal reports whether host is an IPv6 address, with or without
+// a zone ID.
+func isIPv6Literal(host string) bool {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// httpHost returns host as the host of an HTTP Host header: IPv6 literals
+// are bracketed and lose their zone ID, which only means something on the
+// proxy (RFC 6874 section 4).
+func httpHost(host string) string {
+	if !isIPv6Literal(host) {
+		return host
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return "[" + host + "]"
+}
+
+// urlHost returns host, with port if it isn't empty, as the host of a URL,
+// bracketing IPv6 literals.
+func urlHost(host, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if isIPv6Literal(host) {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// setForwardedHeaders sets the X-Forwarded-For and Forwarded (RFC 7239)
+// headers of req to the address of the client a, replacing any mapped from
+// the options of the client's request.  IPv4-mapped IPv6 addresses are
+// given as IPv4 ones, and zone IDs are left out.
+func setForwardedHeaders(req *http.Request, a *net.UDPAddr) {
+	req.Header.Del(forwardedForHeader)
+	req.Header.Del(forwardedHeader)
+	if a == nil || a.IP == nil {
+		return
+	}
+	ip := a.IP.String()
+	node := ip
+	if a.IP.To4() == nil {
+		node = "[" + ip + "]"
+	}
+	req.Header.Set(forwardedForHeader, ip)
+	req.Header.Set(forwardedHeader, `for="`+node+":"+strconv.Itoa(a.Port)+`";proto=coap`)
+}
@@ -0,0 +1,111 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestURIHost(t *testing.T) {
+	for _, tt := range []struct {
+		option           string
+		expectedHost     string
+		expectedHTTPHost string
+		expectedURLHost  string
+	}{
+		{"sensor.example.com", "sensor.example.com", "sensor.example.com", "sensor.example.com:5683"},
+		{"192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.1:5683"},
+		{"2001:db8::1", "2001:db8::1", "[2001:db8::1]", "[2001:db8::1]:5683"},
+		{"[2001:db8::1]", "2001:db8::1", "[2001:db8::1]", "[2001:db8::1]:5683"},
+		{"[fe80::1%25eth0]", "fe80::1%eth0", "[fe80::1]", "[fe80::1%eth0]:5683"},
+	} {
+		m := coap.Message{}
+		m.SetOption(coap.URIHost, tt.option)
+		host, ok := uriHost(&m)
+		if !ok || host != tt.expectedHost {
+			t.Errorf("%v: host is '%v'", tt.option, host)
+		}
+		if h := httpHost(host); h != tt.expectedHTTPHost {
+			t.Errorf("%v: HTTP host is '%v'", tt.option, h)
+		}
+		if h := urlHost(host, "5683"); h != tt.expectedURLHost {
+			t.Errorf("%v: URL host is '%v'", tt.option, h)
+		}
+	}
+	if h := urlHost("2001:db8::1", ""); h != "[2001:db8::1]" {
+		t.Errorf("URL host without port is '%v'", h)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		addr                 *net.UDPAddr
+		expectedForwardedFor string
+		expectedForwarded    string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5683}, "192.0.2.1", `for="192.0.2.1:5683";proto=coap`},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5683}, "192.0.2.1", `for="192.0.2.1:5683";proto=coap`},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5683}, "2001:db8::1", `for="[2001:db8::1]:5683";proto=coap`},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 40000, Zone: "eth0"}, "fe80::1", `for="[fe80::1]:40000";proto=coap`},
+	} {
+		req, _ := http.NewRequest("GET", "http://backend/", nil)
+		req.Header.Set(forwardedForHeader, "203.0.113.9")
+		setForwardedHeaders(req, tt.addr)
+		if h := req.Header.Get(forwardedForHeader); h != tt.expectedForwardedFor {
+			t.Errorf("%v: X-Forwarded-For is '%v'", tt.addr, h)
+		}
+		if h := req.Header.Get(forwardedHeader); h != tt.expectedForwarded {
+			t.Errorf("%v: Forwarded is '%v'", tt.addr, h)
+		}
+	}
+}
+
+func TestIPv6Clients(t *testing.T) {
+	var host, forwardedFor string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, forwardedFor = r.Host, r.Header.Get(forwardedForHeader)
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{
+		BackendURL:           backend.URL,
+		ForwardClientAddress: true,
+		Devices:              &DeviceRegistry{URIHost: true},
+		Tenants:              []Tenant{{Name: "lab", Host: "2001:db8::1"}},
+	})
+	a := &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 5683, Zone: "eth0"}
+	m := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	m.SetPathString("/lamp")
+	m.SetOption(coap.URIHost, "[2001:db8::1]")
+	coapResp := p.handle(a, "", &m, nil, nil)
+	if coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("response is %v", coapResp)
+	}
+	if host != "[2001:db8::1]" || forwardedFor != "fe80::2" {
+		t.Errorf("backend request Host is '%v', X-Forwarded-For '%v'", host, forwardedFor)
+	}
+	if name := p.tenantName(&m); name != "lab" {
+		t.Errorf("tenant is '%v'", name)
+	}
+	if endpoint := p.devices.endpoint("2001:db8::1"); endpoint == nil || endpoint.String() != a.String() {
+		t.Errorf("device endpoint is %v", endpoint)
+	}
+	if device, endpoint := p.pushEndpoint("[fe80::2%eth0]:5683"); endpoint == nil || device != a.String() || endpoint.Zone != "eth0" {
+		t.Errorf("push endpoint is %v %v", device, endpoint)
+	}
+}
+
+func TestForwardProxyIPv6(t *testing.T) {
+	tr := &Translator{ForwardProxy: &ForwardProxyPolicy{Hosts: []string{"2001:db8::1"}}}
+	m := coap.Message{Code: coap.GET}
+	m.SetOption(coap.ProxyScheme, "http")
+	m.SetOption(coap.URIHost, "[2001:db8::1]")
+	m.SetOption(coap.URIPort, uint32(8080))
+	m.SetPathString("/lamp")
+	if u, err := tr.forwardProxyURL(&m); err != nil || u != "http://[2001:db8::1]:8080/lamp" {
+		t.Errorf("URL is %v (error %v)", u, err)
+	}
+}
@@ -0,0 +1,42 @@
+package crosscoap
+
+import "time"
+
+// janitorInterval is how often the expired exchanges and block-wise
+// transfers are evicted.
+const janitorInterval = time.Second
+
+// metricExpiredState counts the exchanges, deduplicated NON requests,
+// uploads, downloads and client endpoint amplification budgets evicted once
+// their lifetime ended, labeled by kind.
+const metricExpiredState = "expired_state"
+
+// runJanitor evicts the expired state of the proxy until done is closed.
+func (p *proxyHandler) runJanitor(done <-chan struct{}) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.sweep(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// sweep evicts the state which expired before now.
+func (p *proxyHandler) sweep(now time.Time) {
+	metrics := p.metrics()
+	for kind, expired := range map[string]int{
+		"exchange": p.exchanges.expire(now),
+		"non":      p.nonDedup.expire(now),
+		"upload":   p.uploads.expire(now),
+		"download": p.downloads.expire(now),
+		"endpoint": p.amplification.expire(now),
+	} {
+		if expired > 0 {
+			metrics.Counter(metricExpiredState, float64(expired), Labels{"kind": kind})
+		}
+	}
+}
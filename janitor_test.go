@@ -0,0 +1,39 @@
+package crosscoap
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeTransfer struct {
+	closed bool
+}
+
+func (t *fakeTransfer) close() {
+	t.closed = true
+}
+
+func TestSweep(t *testing.T) {
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{UploadLifetime: time.Minute, Metrics: metrics})
+	if p.downloads.lifetime != defaultExchangeLifetime {
+		t.Errorf("default download lifetime is %v", p.downloads.lifetime)
+	}
+	old, touched, recent := &fakeTransfer{}, &fakeTransfer{}, &fakeTransfer{}
+	p.uploads.add("old", old)
+	p.uploads.add("touched", touched)
+	p.downloads.add("recent", recent)
+	p.uploads.pending["old"].expires = time.Now().Add(-time.Second)
+	p.uploads.pending["touched"].expires = time.Now().Add(-time.Second)
+	p.uploads.touch("touched", touched)
+
+	p.sweep(time.Now())
+	if !old.closed || touched.closed || recent.closed || p.uploads.count() != 1 || p.downloads.count() != 1 {
+		t.Errorf("transfers closed are %v %v %v", old.closed, touched.closed, recent.closed)
+	}
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	if line := `crosscoap_expired_state_total{kind="upload"} 1`; !strings.Contains(w.Body.String(), line+"\n") {
+		t.Errorf("metrics lack '%v': %v", line, w.Body)
+	}
+}
@@ -0,0 +1,200 @@
+package crosscoap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// appLinkFormatJSON is the JSON representation of RFC 6690 links: an array
+// of objects holding the target in "href" and the link parameters as
+// members.  Parameters without a value are true, and repeated parameters
+// are arrays.
+const appLinkFormatJSON coap.MediaType = 504
+
+var errInvalidLinkFormat = errors.New("invalid link-format document")
+
+// linkFormatToJSON converts an RFC 6690 link-format document to
+// application/link-format+json.
+func linkFormatToJSON(data []byte) ([]byte, error) {
+	links, err := parseLinkFormat(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(links)
+}
+
+// parseLinkFormat parses an RFC 6690 link-format document to links in the
+// shape of application/link-format+json.
+func parseLinkFormat(data []byte) ([]map[string]interface{}, error) {
+	links := []map[string]interface{}{}
+	s := string(data)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			break
+		}
+		link, rest, err := parseLinkValue(s)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+		rest = strings.TrimLeft(rest, " \t\r\n")
+		if rest != "" && rest[0] != ',' {
+			return nil, errInvalidLinkFormat
+		}
+		s = strings.TrimPrefix(rest, ",")
+	}
+	return links, nil
+}
+
+// parseLinkValue parses one "<URI>;param=value;..." link value, returning
+// the remainder of s.
+func parseLinkValue(s string) (map[string]interface{}, string, error) {
+	if s[0] != '<' {
+		return nil, "", errInvalidLinkFormat
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 0 {
+		return nil, "", errInvalidLinkFormat
+	}
+	link := map[string]interface{}{"href": s[1:end]}
+	s = s[end+1:]
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" || s[0] != ';' {
+			return link, s, nil
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+		nameLen := strings.IndexAny(s, "=;, \t")
+		if nameLen < 0 {
+			nameLen = len(s)
+		}
+		name := strings.ToLower(s[:nameLen])
+		if name == "" || name == "href" {
+			return nil, "", errInvalidLinkFormat
+		}
+		s = strings.TrimLeft(s[nameLen:], " \t")
+		var value interface{} = true
+		if s != "" && s[0] == '=' {
+			var err error
+			value, s, err = parseLinkParamValue(strings.TrimLeft(s[1:], " \t"))
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		switch existing := link[name].(type) {
+		case nil:
+			link[name] = value
+		case []interface{}:
+			link[name] = append(existing, value)
+		default:
+			link[name] = []interface{}{existing, value}
+		}
+	}
+}
+
+func parseLinkParamValue(s string) (string, string, error) {
+	if s == "" || s[0] != '"' {
+		end := strings.IndexAny(s, ";, \t")
+		if end < 0 {
+			end = len(s)
+		}
+		return s[:end], s[end:], nil
+	}
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", errInvalidLinkFormat
+			}
+			value.WriteByte(s[i])
+		case '"':
+			return value.String(), s[i+1:], nil
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return "", "", errInvalidLinkFormat
+}
+
+// linkFormatFromJSON converts application/link-format+json (or an equivalent
+// plain JSON array of links) to an RFC 6690 link-format document.
+func linkFormatFromJSON(data []byte) ([]byte, error) {
+	links, err := parseLinkFormatJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return writeLinkFormat(links)
+}
+
+func parseLinkFormatJSON(data []byte) ([]map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var links []map[string]interface{}
+	if err := decoder.Decode(&links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// writeLinkFormat writes links in the shape of application/link-format+json
+// as an RFC 6690 link-format document.
+func writeLinkFormat(links []map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, link := range links {
+		href, ok := link["href"].(string)
+		if !ok {
+			return nil, errInvalidLinkFormat
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString("<" + href + ">")
+		names := make([]string, 0, len(link))
+		for name := range link {
+			if name != "href" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			values, ok := link[name].([]interface{})
+			if !ok {
+				values = []interface{}{link[name]}
+			}
+			for _, value := range values {
+				if err := writeLinkParam(&buf, name, value); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writeLinkParam(buf *bytes.Buffer, name string, value interface{}) error {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			buf.WriteString(";" + name)
+		}
+	case json.Number:
+		buf.WriteString(";" + name + "=" + v.String())
+	case string:
+		if v != "" && strings.Trim(v, "0123456789") == "" {
+			buf.WriteString(";" + name + "=" + v)
+		} else {
+			buf.WriteString(";" + name + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`)
+		}
+	default:
+		return errInvalidLinkFormat
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package crosscoap
+
+import "testing"
+
+func TestLinkFormatToJSON(t *testing.T) {
+	tests := []struct {
+		linkFormat, json string
+	}{
+		{``, `[]`},
+		{`</sensors/temp>;rt="temperature-c";if="sensor";obs, </sensors/light>;ct=41`,
+			`[{"href":"/sensors/temp","if":"sensor","obs":true,"rt":"temperature-c"},{"ct":"41","href":"/sensors/light"}]`},
+		{`</t>;rt="a b";rt=c;title="x, \"y\"; z"`, `[{"href":"/t","rt":["a b","c"],"title":"x, \"y\"; z"}]`},
+	}
+	for _, test := range tests {
+		json, err := linkFormatToJSON([]byte(test.linkFormat))
+		if err != nil {
+			t.Errorf("linkFormatToJSON(%v) failed: %v", test.linkFormat, err)
+			continue
+		}
+		if string(json) != test.json {
+			t.Errorf("linkFormatToJSON(%v) is '%v'", test.linkFormat, string(json))
+		}
+	}
+	for _, invalid := range []string{`/sensors`, `</sensors`, `</a>;rt="x`, `</a> </b>`} {
+		if _, err := linkFormatToJSON([]byte(invalid)); err == nil {
+			t.Errorf("linkFormatToJSON(%v) succeeded", invalid)
+		}
+	}
+}
+
+func TestLinkFormatFromJSON(t *testing.T) {
+	json := `[{"href":"/sensors/temp","rt":"temperature-c","obs":true,"sz":12},` +
+		`{"href":"/t","rt":["a b","c"],"ct":"41","title":"x \"y\""}]`
+	expected := `</sensors/temp>;obs;rt="temperature-c";sz=12,</t>;ct=41;rt="a b";rt="c";title="x \"y\""`
+	linkFormat, err := linkFormatFromJSON([]byte(json))
+	if err != nil {
+		t.Fatalf("linkFormatFromJSON failed: %v", err)
+	}
+	if string(linkFormat) != expected {
+		t.Errorf("linkFormatFromJSON is '%v'", string(linkFormat))
+	}
+	if _, err := linkFormatFromJSON([]byte(`[{"rt":"x"}]`)); err == nil {
+		t.Error("Expected link without href to be rejected")
+	}
+}
@@ -0,0 +1,39 @@
+package crosscoap
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/dustin/go-coap"
+)
+
+// The headers carrying the CoAP message metadata of backend requests, with
+// ForwardMessageMetadata.
+const (
+	messageTypeHeader  = "X-CoAP-Message-Type"
+	messageTokenHeader = "X-CoAP-Token"
+	messageIDHeader    = "X-CoAP-Message-ID"
+)
+
+// messageTypeNames are the short names of the CoAP message types (RFC 7252
+// section 3).
+var messageTypeNames = map[coap.COAPType]string{
+	coap.Confirmable:     "CON",
+	coap.NonConfirmable:  "NON",
+	coap.Acknowledgement: "ACK",
+	coap.Reset:           "RST",
+}
+
+// setMessageMetadata sets the headers of req carrying the type, token (in
+// hex) and message ID of the CoAP request m, replacing any mapped from
+// options.
+func setMessageMetadata(req *http.Request, m *coap.Message) {
+	req.Header.Set(messageTypeHeader, messageTypeNames[m.Type])
+	if len(m.Token) > 0 {
+		req.Header.Set(messageTokenHeader, hex.EncodeToString(m.Token))
+	} else {
+		req.Header.Del(messageTokenHeader)
+	}
+	req.Header.Set(messageIDHeader, strconv.Itoa(int(m.MessageID)))
+}
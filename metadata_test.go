@@ -0,0 +1,51 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestForwardMessageMetadata(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer backend.Close()
+
+	for _, forward := range []bool{false, true} {
+		p := newProxyHandler(&Proxy{BackendURL: backend.URL, ForwardMessageMetadata: forward})
+		for _, tt := range []struct {
+			msgType       coap.COAPType
+			token         []byte
+			expectedType  string
+			expectedToken string
+		}{
+			{coap.Confirmable, []byte{0xca, 0xfe}, "CON", "cafe"},
+			{coap.NonConfirmable, nil, "NON", ""},
+		} {
+			req := coap.Message{Type: tt.msgType, Code: coap.POST, MessageID: 4242, Token: tt.token, Payload: []byte("21.5")}
+			req.SetPathString("/telemetry")
+			p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+			header := <-headers
+			if !forward {
+				if header.Get(messageTypeHeader) != "" || header.Get(messageIDHeader) != "" {
+					t.Errorf("backend request without ForwardMessageMetadata has %v", header)
+				}
+				continue
+			}
+			if header.Get(messageTypeHeader) != tt.expectedType {
+				t.Errorf("%v: X-CoAP-Message-Type is '%v'", tt.msgType, header.Get(messageTypeHeader))
+			}
+			if header.Get(messageTokenHeader) != tt.expectedToken {
+				t.Errorf("%v: X-CoAP-Token is '%v'", tt.msgType, header.Get(messageTokenHeader))
+			}
+			if header.Get(messageIDHeader) != "4242" {
+				t.Errorf("%v: X-CoAP-Message-ID is '%v'", tt.msgType, header.Get(messageIDHeader))
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package crosscoap
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/dustin/go-coap"
+)
+
+// The dimensions which MetricLabels may add to the request metrics.
+const (
+	metricLabelRoute     = "route"
+	metricLabelTenant    = "tenant"
+	metricLabelBackend   = "backend"
+	metricLabelCodeClass = "code_class"
+)
+
+// defaultMetricLabelValues is the number of values taken by each label of
+// MetricLabels, if MetricLabelValues is zero.
+const defaultMetricLabelValues = 100
+
+// metricLabelOverflowValue replaces the values of a label beyond its limit.
+const metricLabelOverflowValue = "other"
+
+// metricLabelOverflows counts the measurements whose label value was
+// replaced because the label took too many values, labeled by label.
+const metricLabelOverflows = "metric_label_overflows"
+
+// requestDimensions are the dimensions of a request labeled by
+// MetricLabels, empty if unknown or not labeled.
+type requestDimensions struct {
+	route     string
+	tenant    string
+	backend   string
+	codeClass string
+}
+
+// metricLabels adds the dimensions of MetricLabels to the request metrics,
+// guarding against the cardinality explosion of, say, a route per device:
+// once a label has taken maxValues values, the new ones are replaced by
+// "other".
+type metricLabels struct {
+	names     []string
+	maxValues int
+	metrics   Metrics
+
+	mu     sync.Mutex
+	values map[string]map[string]bool // by label
+}
+
+// newMetricLabels returns the labels of the request metrics, or nil if
+// MetricLabels is empty.
+func (p *proxyHandler) newMetricLabels() *metricLabels {
+	var names []string
+	for _, name := range p.MetricLabels {
+		switch name {
+		case metricLabelRoute, metricLabelTenant, metricLabelBackend, metricLabelCodeClass:
+			names = append(names, name)
+		default:
+			p.logError("Unknown metric label %q ignored", name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	maxValues := p.MetricLabelValues
+	if maxValues <= 0 {
+		maxValues = defaultMetricLabelValues
+	}
+	return &metricLabels{names: names, maxValues: maxValues, metrics: p.metrics(), values: make(map[string]map[string]bool)}
+}
+
+// labels returns base with the known dimensions d added.
+func (ml *metricLabels) labels(d *requestDimensions, base Labels) Labels {
+	if ml == nil {
+		return base
+	}
+	labels := make(Labels, len(base)+len(ml.names))
+	for name, value := range base {
+		labels[name] = value
+	}
+	for name, value := range map[string]string{
+		metricLabelRoute:     d.route,
+		metricLabelTenant:    d.tenant,
+		metricLabelBackend:   d.backend,
+		metricLabelCodeClass: d.codeClass,
+	} {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// guard returns value, or "other" if the label name already took
+// maxValues other values.
+func (ml *metricLabels) guard(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	values := ml.values[name]
+	if values == nil {
+		values = make(map[string]bool)
+		ml.values[name] = values
+	}
+	if !values[value] {
+		if len(values) >= ml.maxValues {
+			ml.metrics.Counter(metricLabelOverflows, 1, Labels{"label": name})
+			return metricLabelOverflowValue
+		}
+		values[value] = true
+	}
+	return value
+}
+
+// codeClass returns the class of code, such as 2.xx.
+func codeClass(code coap.COAPCode) string {
+	return fmt.Sprintf("%d.xx", code>>5)
+}
+
+// requestDimensions returns the dimensions of the request m to route, as
+// labeled by MetricLabels.
+func (p *proxyHandler) requestDimensions(m *coap.Message, route string) *requestDimensions {
+	ml := p.metricLabels
+	d := &requestDimensions{}
+	if ml.has(metricLabelRoute) {
+		d.route = ml.guard(metricLabelRoute, route)
+	}
+	if ml.has(metricLabelTenant) {
+		if t := p.tenants.match(m); t != nil {
+			d.tenant = ml.guard(metricLabelTenant, t.Name)
+		}
+	}
+	return d
+}
+
+// responseDimensions adds to d the dimensions of coapResp, the response of
+// the exchange rc, as labeled by MetricLabels.
+func (p *proxyHandler) responseDimensions(d *requestDimensions, rc *RequestContext, coapResp *translatedCOAPMessage) {
+	ml := p.metricLabels
+	if ml == nil || coapResp == nil {
+		return
+	}
+	if ml.has(metricLabelCodeClass) {
+		d.codeClass = ml.guard(metricLabelCodeClass, codeClass(coapResp.Code))
+	}
+	if ml.has(metricLabelBackend) {
+		backend := rc.Backend
+		if backend == "" && coapResp.backendURL != "" {
+			if u, err := url.Parse(coapResp.backendURL); err == nil {
+				backend = u.Host
+			}
+		}
+		d.backend = ml.guard(metricLabelBackend, backend)
+	}
+}
+
+// has reports whether name is one of MetricLabels.
+func (ml *metricLabels) has(name string) bool {
+	if ml == nil {
+		return false
+	}
+	for _, n := range ml.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestMetricLabels(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{
+		BackendURL:        backend.URL,
+		Tenants:           []Tenant{{Name: "acme", PathPrefix: "/a"}},
+		MetricLabels:      []string{"route", "tenant", "backend", "code_class", "unknown"},
+		MetricLabelValues: 2,
+		Metrics:           metrics,
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	for i, path := range []string{"/a", "/a", "/missing", "/b"} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: uint16(i)}
+		m.SetPathString(path)
+		p.handleRequest(a, m, nil)
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	for _, line := range []string{
+		`crosscoap_requests_total{route="/a",tenant="acme"} 2`,
+		`crosscoap_requests_total{route="/missing"} 1`,
+		`crosscoap_requests_total{route="other"} 1`,
+		`crosscoap_responses_total{backend="` + u.Host + `",code="2.05",code_class="2.xx",route="/a",tenant="acme"} 2`,
+		`crosscoap_responses_total{backend="` + u.Host + `",code="4.04",code_class="4.xx",route="/missing"} 1`,
+		`crosscoap_metric_label_overflows_total{label="route"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack '%v': %v", line, w.Body)
+		}
+	}
+	if labels := p.adminConfig().MetricLabels; len(labels) != 4 {
+		t.Errorf("metric labels are %v", labels)
+	}
+}
+
+func TestCodeClass(t *testing.T) {
+	for code, expected := range map[coap.COAPCode]string{
+		coap.Content:            "2.xx",
+		coap.NotFound:           "4.xx",
+		coap.ServiceUnavailable: "5.xx",
+	} {
+		if class := codeClass(code); class != expected {
+			t.Errorf("class of %v is '%v'", code, class)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package crosscoap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Labels are the dimensions of a measurement, by name.
+type Labels map[string]string
+
+// Metrics receives the measurements of the proxy.  Names are made of lower
+// case words separated by underscores, without a namespace, and counters
+// don't carry the _total suffix: each implementation adapts them to its
+// telemetry system.  The methods are called concurrently.
+type Metrics interface {
+	// Counter adds delta to a counter.
+	Counter(name string, delta float64, labels Labels)
+	// Gauge sets a gauge to value.
+	Gauge(name string, value float64, labels Labels)
+	// Histogram adds an observation of value to a histogram (or timer).
+	Histogram(name string, value float64, labels Labels)
+}
+
+// NopMetrics discards the measurements.
+type NopMetrics struct{}
+
+func (NopMetrics) Counter(name string, delta float64, labels Labels)   {}
+func (NopMetrics) Gauge(name string, value float64, labels Labels)     {}
+func (NopMetrics) Histogram(name string, value float64, labels Labels) {}
+
+// The measurements of the proxy.
+const (
+	// metricRequests counts the CoAP requests handled.
+	metricRequests = "requests"
+	// metricResponses counts the responses sent, labeled by CoAP code.
+	metricResponses = "responses"
+	// metricBackendErrors counts the backend requests which failed without
+	// an HTTP response.
+	metricBackendErrors = "backend_errors"
+	// metricRequestDuration is the time taken to answer a request.
+	metricRequestDuration = "request_duration_seconds"
+	// metricRequestsInFlight is the number of requests being handled.
+	metricRequestsInFlight = "requests_in_flight"
+)
+
+// metrics returns p.Metrics, or NopMetrics if unset.
+func (p *Proxy) metrics() Metrics {
+	if p.Metrics == nil {
+		return NopMetrics{}
+	}
+	return p.Metrics
+}
+
+// requestStarted measures a request with the dimensions d which starts
+// being handled.
+func (p *proxyHandler) requestStarted(d *requestDimensions) {
+	metrics := p.metrics()
+	metrics.Counter(metricRequests, 1, p.metricLabels.labels(d, nil))
+	metrics.Gauge(metricRequestsInFlight, float64(atomic.AddInt32(&p.inFlight, 1)), nil)
+}
+
+// requestDone measures a request with the dimensions d answered by
+// coapResp (nil if none was sent) after latency.
+func (p *proxyHandler) requestDone(d *requestDimensions, coapResp *translatedCOAPMessage, latency time.Duration) {
+	metrics := p.metrics()
+	metrics.Gauge(metricRequestsInFlight, float64(atomic.AddInt32(&p.inFlight, -1)), nil)
+	metrics.Histogram(metricRequestDuration, latency.Seconds(), p.metricLabels.labels(d, nil))
+	if coapResp == nil {
+		return
+	}
+	metrics.Counter(metricResponses, 1, p.metricLabels.labels(d, Labels{"code": codeString(coapResp.Code)}))
+	if coapResp.backendErr != nil {
+		metrics.Counter(metricBackendErrors, 1, p.metricLabels.labels(d, nil))
+	}
+}
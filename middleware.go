@@ -0,0 +1,150 @@
+package crosscoap
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// RequestContext describes the exchange in which a CoAP request is handled,
+// so that middleware and hooks can decide on who is asking, not just what.
+type RequestContext struct {
+	// Client is the endpoint of the client.
+	Client *net.UDPAddr
+	// Identity is the authenticated identity of the client, if any: the
+	// Recipient ID of its OSCORE context, in hex prefixed by "oscore:".
+	Identity string
+	// Principal is on whose behalf the request is made, as told by the
+	// Authenticators, if any.
+	Principal string
+	// Received is when the proxy started handling the request.
+	Received time.Time
+	// RequestID is the correlation ID of the request, sent to the backend
+	// as X-Request-ID and logged.
+	RequestID string
+	// Backend is the resolved backend address (see BackendResolver) to
+	// which the request was sent, once chosen, or empty.
+	Backend string
+	// Deadline is when the client gives up on the exchange, after which
+	// the backend request is cancelled (see ExchangeDeadlines), or zero.
+	Deadline time.Time
+}
+
+type requestContextKey struct{}
+
+// RequestContextFrom returns the RequestContext of the backend request
+// whose context is ctx, as given to Director (req.Context()) and
+// ModifyResponse (resp.Request.Context()), or nil.
+func RequestContextFrom(ctx context.Context) *RequestContext {
+	rc, _ := ctx.Value(requestContextKey{}).(*RequestContext)
+	return rc
+}
+
+// oscoreIdentity returns the identity of the clients of the OSCORE context
+// whose Recipient ID is kid.
+func oscoreIdentity(kid []byte) string {
+	return "oscore:" + hex.EncodeToString(kid)
+}
+
+// CoAPHandlerFunc handles a CoAP request m from the client at addr, and
+// returns the response to send to the client (or nil to send none).
+type CoAPHandlerFunc func(addr *net.UDPAddr, m *coap.Message) *coap.Message
+
+// Middleware wraps the handling of CoAP requests.  It can inspect or rewrite
+// the request before calling next, inspect or rewrite the response returned
+// by next, or answer the request itself without calling next at all.
+type Middleware func(next CoAPHandlerFunc) CoAPHandlerFunc
+
+// ContextHandlerFunc handles a CoAP request m in the exchange rc, and
+// returns the response to send to the client (or nil to send none).
+type ContextHandlerFunc func(rc *RequestContext, m *coap.Message) *coap.Message
+
+// ContextMiddleware is Middleware given the RequestContext of the requests.
+type ContextMiddleware func(next ContextHandlerFunc) ContextHandlerFunc
+
+// Use adds middleware to the chain which wraps every request handled by the
+// proxy; the first middleware added is the outermost one.  It must be called
+// before Serve.
+func (p *Proxy) Use(middleware ...Middleware) {
+	for _, m := range middleware {
+		p.middleware = append(p.middleware, withoutContext(m))
+	}
+}
+
+// UseContext adds middleware given the RequestContext of the requests to
+// the same chain as Use.  It must be called before Serve.
+func (p *Proxy) UseContext(middleware ...ContextMiddleware) {
+	p.middleware = append(p.middleware, middleware...)
+}
+
+// withoutContext adapts middleware to the chain of ContextMiddleware; the
+// client address it passes to next replaces that of the context.
+func withoutContext(middleware Middleware) ContextMiddleware {
+	return func(next ContextHandlerFunc) ContextHandlerFunc {
+		return func(rc *RequestContext, m *coap.Message) *coap.Message {
+			return middleware(func(addr *net.UDPAddr, m *coap.Message) *coap.Message {
+				if addr != rc.Client {
+					changed := *rc
+					changed.Client = addr
+					return next(&changed, m)
+				}
+				return next(rc, m)
+			})(rc.Client, m)
+		}
+	}
+}
+
+// handle runs a request from the client with the authenticated identity (if
+// any) through the middleware chain, at the end of which it is proxied to
+// the backend.  A non-nil body streams the payload of a Block1 upload to
+// the backend in place of the payload of m.
+func (p *proxyHandler) handle(a *net.UDPAddr, identity string, m *coap.Message, options []rawOption, body io.ReadCloser) *translatedCOAPMessage {
+	start := time.Now()
+	rc := &RequestContext{
+		Client:    a,
+		Identity:  identity,
+		Received:  start,
+		RequestID: p.translator.requestID(m.Token, options),
+		Deadline:  p.exchangeDeadline(m, start),
+	}
+	route := p.routes.routeName(m.PathString())
+	dimensions := p.requestDimensions(m, route)
+	p.requestStarted(dimensions)
+	p.registerDevice(a, m)
+	coapResp := p.runMiddleware(rc, m, options, body)
+	latency := time.Since(start)
+	p.stats.record(route, coapResp, latency)
+	p.slo.record(route, m, coapResp, latency, start.Add(latency))
+	p.logRequest(rc, m, coapResp, latency)
+	p.audit(rc, m, coapResp, latency)
+	p.responseDimensions(dimensions, rc, coapResp)
+	p.requestDone(dimensions, coapResp, latency)
+	return coapResp
+}
+
+func (p *proxyHandler) runMiddleware(rc *RequestContext, m *coap.Message, options []rawOption, body io.ReadCloser) *translatedCOAPMessage {
+	var proxied *translatedCOAPMessage
+	var handler ContextHandlerFunc = func(rc *RequestContext, m *coap.Message) *coap.Message {
+		proxied = p.serveCOAPIn(rc, m, options, body)
+		if proxied == nil {
+			return nil
+		}
+		return &proxied.Message
+	}
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		handler = p.middleware[i](handler)
+	}
+	coapResp := handler(rc, m)
+	if coapResp == nil {
+		return nil
+	}
+	if proxied != nil && coapResp == &proxied.Message {
+		// Keep the options which go-coap can't represent
+		return proxied
+	}
+	return &translatedCOAPMessage{Message: *coapResp}
+}
@@ -0,0 +1,63 @@
+package crosscoap
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// All-CoAP-Nodes multicast addresses (RFC 7252 section 12.8).
+var (
+	AllCoAPNodesIPv4          = net.IPv4(224, 0, 1, 187)
+	AllCoAPNodesIPv6LinkLocal = net.ParseIP("ff02::fd")
+	AllCoAPNodesIPv6SiteLocal = net.ParseIP("ff05::fd")
+)
+
+// defaultLeisure is DEFAULT_LEISURE (RFC 7252 section 8.2).
+const defaultLeisure = 5 * time.Second
+
+// ListenMulticast returns a UDP listener joined to the multicast group on
+// the given port (5683 for CoAP) of the network interface ifi (or the system
+// default interface if nil), to be used as a Proxy's MulticastListener.
+func ListenMulticast(ifi *net.Interface, group net.IP, port int) (*net.UDPConn, error) {
+	network := "udp6"
+	if group.To4() != nil {
+		network = "udp4"
+	}
+	return net.ListenMulticastUDP(network, ifi, &net.UDPAddr{IP: group, Port: port})
+}
+
+func (p *Proxy) leisure() time.Duration {
+	if p.Leisure > 0 {
+		return p.Leisure
+	}
+	return defaultLeisure
+}
+
+// handleMulticastPacket handles a request received on the multicast
+// listener.  Following RFC 7252 section 8, the response is non-confirmable,
+// sent from the unicast listener l after a random leisure delay, and error
+// responses are suppressed so that only servers with something useful to
+// say answer the group.
+func (p *proxyHandler) handleMulticastPacket(l transport, a *net.UDPAddr, packet []byte) {
+	m, options, err := parsePacket(packet)
+	if err != nil {
+		p.logError("Error parsing multicast CoAP packet from %v: %v", a, err)
+		return
+	}
+	if m.Code == 0 || m.Type == coap.Acknowledgement || m.Type == coap.Reset {
+		return
+	}
+	group := *p
+	group.RespondToNonConfirmable = true
+	coapResp := group.handle(a, "", m, options, nil)
+	if coapResp == nil || coapResp.Code >= coap.BadRequest {
+		return
+	}
+	coapResp.Type = coap.NonConfirmable
+	coapResp.MessageID = p.transactions.nextMessageID()
+	time.Sleep(time.Duration(rand.Int63n(int64(p.leisure()))))
+	p.sendResponse(l, a, coapResp)
+}
@@ -0,0 +1,60 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestMulticastRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/core" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/link-format")
+		w.Write([]byte("</sensors>"))
+	}))
+	defer backend.Close()
+	unicast, _ := createLocalUDPListener(t)
+	defer unicast.Close()
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, Leisure: 10 * time.Millisecond})
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	for _, path := range []string{"/missing", "/.well-known/core"} {
+		req := coap.Message{Type: coap.NonConfirmable, Code: coap.GET, MessageID: 5, Token: []byte("mc")}
+		req.SetPathString(path)
+		data, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Error marshalling request: %v", err)
+		}
+		p.handleMulticastPacket(p.transportOf(unicast), clientAddr, data)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxCOAPPacketLen)
+	n, from, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Error receiving response: %v", err)
+	}
+	if from.String() != unicast.LocalAddr().String() {
+		t.Errorf("response sent from '%v'", from)
+	}
+	rv, err := coap.ParseMessage(buf[:n])
+	if err != nil {
+		t.Fatalf("Error parsing response: %v", err)
+	}
+	if rv.Type != coap.NonConfirmable || rv.Code != coap.Content || string(rv.Payload) != "</sensors>" {
+		t.Errorf("got type %v code %v payload '%s'", rv.Type, rv.Code, rv.Payload)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(buf); err == nil {
+		t.Error("Expected no response to the failed request")
+	}
+}
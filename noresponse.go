@@ -0,0 +1,68 @@
+package crosscoap
+
+import (
+	"github.com/dustin/go-coap"
+)
+
+// optionNoResponse is the No-Response option (RFC 7967), which go-coap
+// doesn't know.
+const optionNoResponse uint16 = 258
+
+// Bits of the No-Response option suppressing a class of responses
+const (
+	noResponseSuccess     = 2  // 2.xx
+	noResponseClientError = 8  // 4.xx
+	noResponseServerError = 16 // 5.xx
+)
+
+// metricSuppressedResponses counts the responses not sent because the
+// request's No-Response option suppressed their class.
+const metricSuppressedResponses = "suppressed_responses"
+
+// noResponse returns the value of the No-Response option of a request, 0
+// (interested in all responses) if it has none.
+func noResponse(options []rawOption) uint32 {
+	value, found := findOption(options, optionNoResponse)
+	if !found {
+		return 0
+	}
+	var n uint32
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+	return n
+}
+
+// suppressesResponse reports whether the No-Response value suppresses a
+// response with the code.  2.31 Continue is never suppressed, since the
+// client needs it to carry on a block-wise upload.
+func suppressesResponse(value uint32, code coap.COAPCode) bool {
+	switch {
+	case code == codeContinue:
+		return false
+	case code>>5 == 2:
+		return value&noResponseSuccess != 0
+	case code>>5 == 4:
+		return value&noResponseClientError != 0
+	case code>>5 == 5:
+		return value&noResponseServerError != 0
+	}
+	return false
+}
+
+// suppressResponse applies the No-Response option of the request m to its
+// response coapResp: if the option suppresses its class, a confirmable
+// request is only acknowledged with an empty ACK, and a non-confirmable
+// one gets no response.  The request has been forwarded to the backend
+// regardless.
+func (p *proxyHandler) suppressResponse(m *coap.Message, options []rawOption, coapResp *translatedCOAPMessage) *translatedCOAPMessage {
+	if coapResp == nil || coapResp.Code == 0 || !suppressesResponse(noResponse(options), coapResp.Code) {
+		return coapResp
+	}
+	p.metrics().Counter(metricSuppressedResponses, 1, nil)
+	if !m.IsConfirmable() {
+		return nil
+	}
+	emptyAck := coap.Message{Type: coap.Acknowledgement, MessageID: m.MessageID}
+	return &translatedCOAPMessage{Message: emptyAck, requestID: coapResp.requestID}
+}
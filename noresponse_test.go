@@ -0,0 +1,80 @@
+package crosscoap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestSuppressesResponse(t *testing.T) {
+	tests := []struct {
+		value    uint32
+		code     coap.COAPCode
+		expected bool
+	}{
+		{0, coap.Content, false},
+		{noResponseSuccess, coap.Content, true},
+		{noResponseSuccess, codeContinue, false},
+		{noResponseSuccess, coap.NotFound, false},
+		{noResponseClientError, coap.NotFound, true},
+		{noResponseClientError | noResponseServerError, coap.BadGateway, true},
+		{noResponseServerError, coap.Changed, false},
+	}
+	for _, test := range tests {
+		if suppressed := suppressesResponse(test.value, test.code); suppressed != test.expected {
+			t.Errorf("suppressesResponse(%v, %v) is %v", test.value, test.code, suppressed)
+		}
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, RespondToNonConfirmable: true}
+	go proxy.Serve()
+
+	c, err := DialClient(crosscoapAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Timeout = 100 * time.Millisecond
+	suppressSuccess := ClientOption{ID: optionNoResponse, Value: []byte{noResponseSuccess}}
+
+	req := coap.Message{Code: coap.POST, Payload: []byte("telemetry")}
+	req.SetPathString("/telemetry")
+	if resp, err := c.Do(req, suppressSuccess); err != ErrNoResponse {
+		t.Errorf("suppressed response is %+v (error %v)", resp, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("backend got %v requests", n)
+	}
+
+	req.SetPathString("/missing")
+	if resp, err := c.Do(req, suppressSuccess); err != nil || resp.Code != coap.NotFound {
+		t.Errorf("unsuppressed error response is %+v (error %v)", resp, err)
+	}
+
+	req.Type = coap.NonConfirmable
+	suppressAll := ClientOption{ID: optionNoResponse, Value: []byte{noResponseSuccess | noResponseClientError | noResponseServerError}}
+	if resp, err := c.Do(req, suppressAll); err != ErrNoResponse {
+		t.Errorf("suppressed NON response is %+v (error %v)", resp, err)
+	}
+	if resp, err := c.Do(req); err != nil || resp.Code != coap.NotFound {
+		t.Errorf("NON response is %+v (error %v)", resp, err)
+	}
+}
@@ -0,0 +1,338 @@
+package crosscoap
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// Values of the Observe option in requests (RFC 7641 section 2)
+const (
+	observeRegister   = 0
+	observeDeregister = 1
+)
+
+// defaultObserveLifetime is the time after which an observer which hasn't
+// registered again is removed.
+const defaultObserveLifetime = time.Hour
+
+// metricObservers is the number of registered observers.
+const metricObservers = "observers"
+
+// observeJitter is the fraction by which the polls of an observed resource
+// are randomly moved earlier or later under ObserveMaxBackoff.
+const observeJitter = 0.2
+
+func (p *Proxy) observeLifetime() time.Duration {
+	if p.ObserveLifetime > 0 {
+		return p.ObserveLifetime
+	}
+	return defaultObserveLifetime
+}
+
+// observer is a client observing a resource, by polling the backend.
+type observer struct {
+	key     transactionKey
+	l       transport
+	a       *net.UDPAddr
+	request *coap.Message // the registration, without its Observe option
+	options []rawOption
+	stop    chan struct{}
+
+	// Guarded by observers.mu
+	hash    [sha256.Size]byte // of the last notification
+	etag    []byte            // of the last notification, if any
+	seq     uint32
+	expires time.Time
+	backoff uint // polls since the last change, under ObserveMaxBackoff
+}
+
+// observers tracks the observers of the proxy, by client and token.
+type observers struct {
+	mu        sync.Mutex
+	observers map[transactionKey]*observer
+}
+
+// newObservers returns the observers of p, or nil if it doesn't support
+// Observe.
+func (p *proxyHandler) newObservers() *observers {
+	if p.ObserveInterval <= 0 {
+		return nil
+	}
+	return &observers{observers: make(map[transactionKey]*observer)}
+}
+
+func (obs *observers) count() int {
+	if obs == nil {
+		return 0
+	}
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return len(obs.observers)
+}
+
+// notificationHash identifies the representation of a notification: by
+// its ETag if it has one, else by its content.
+func notificationHash(coapResp *translatedCOAPMessage) [sha256.Size]byte {
+	h := sha256.New()
+	if etag := optionBytes(coapResp.Option(coap.ETag)); etag != nil {
+		fmt.Fprintf(h, "%v etag %x", coapResp.Code, etag)
+	} else {
+		fmt.Fprintf(h, "%v %v\n", coapResp.Code, coapResp.Option(coap.ContentFormat))
+		h.Write(coapResp.Payload)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// nextSequence returns the Observe option of the next notification of o.
+func (obs *observers) nextSequence(o *observer) uint32 {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	o.seq = (o.seq + 1) & 0xffffff
+	return o.seq
+}
+
+// changed records the notification coapResp of o, reporting whether it
+// differs from the previous one.  A 2.03 Valid response, to a poll with the
+// ETag of the previous notification, means it doesn't.
+func (obs *observers) changed(o *observer, coapResp *translatedCOAPMessage) bool {
+	etag := optionBytes(coapResp.Option(coap.ETag))
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if coapResp.Code == coap.Valid {
+		if etag != nil {
+			o.etag = etag
+		}
+		return false
+	}
+	hash := notificationHash(coapResp)
+	if hash == o.hash {
+		return false
+	}
+	o.hash, o.etag = hash, etag
+	return true
+}
+
+// pollRequest returns the request polling the backend for the resource of
+// o, asking for the representation only if it has changed since the last
+// notification with an ETag.
+func (obs *observers) pollRequest(o *observer) *coap.Message {
+	request := *o.request
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if o.etag != nil {
+		request.SetOption(coap.ETag, o.etag)
+	}
+	return &request
+}
+
+// pollDelay returns the time until the next poll after coapResp: its
+// Max-Age, derived from the Cache-Control or Expires headers of the backend
+// (or the Retry-After header of a 5.03 response), or else ObserveInterval.
+func (p *proxyHandler) pollDelay(coapResp *translatedCOAPMessage) time.Duration {
+	if coapResp != nil {
+		if maxAge, ok := coapResp.Option(coap.MaxAge).(uint32); ok && maxAge > 0 {
+			return time.Duration(maxAge) * time.Second
+		}
+	}
+	return p.ObserveInterval
+}
+
+// retriesPoll reports whether the poll answered by coapResp, a gateway
+// error, is retried under ObserveMaxBackoff rather than notified.
+func (p *proxyHandler) retriesPoll(coapResp *translatedCOAPMessage) bool {
+	if p.ObserveMaxBackoff <= 0 {
+		return false
+	}
+	switch coapResp.Code {
+	case coap.BadGateway, coap.ServiceUnavailable, coap.GatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// nextPoll returns the time until the next poll of o after coapResp: the
+// pollDelay, which ObserveMaxBackoff doubles after each poll since the last
+// change up to the maximum, with some jitter.
+func (p *proxyHandler) nextPoll(o *observer, coapResp *translatedCOAPMessage, changed bool) time.Duration {
+	delay := p.pollDelay(coapResp)
+	max := p.ObserveMaxBackoff
+	if max <= 0 {
+		return delay
+	}
+	obs := p.observers
+	obs.mu.Lock()
+	if changed {
+		o.backoff = 0
+	} else if delay<<o.backoff < max {
+		o.backoff++
+	}
+	backoff := o.backoff
+	obs.mu.Unlock()
+	base := delay
+	for i := uint(0); i < backoff && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay < base {
+		delay = base
+	}
+	return time.Duration(float64(delay) * (1 - observeJitter + 2*observeJitter*rand.Float64()))
+}
+
+func (obs *observers) expired(o *observer, now time.Time) bool {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return now.After(o.expires)
+}
+
+// removeObserver removes the observer of key if it is still o (or any
+// observer if o is nil), stopping its polling; it returns false if there
+// was none to remove.
+func (p *proxyHandler) removeObserver(key transactionKey, o *observer) bool {
+	obs := p.observers
+	obs.mu.Lock()
+	current, found := obs.observers[key]
+	if found && (o == nil || current == o) {
+		delete(obs.observers, key)
+		close(current.stop)
+	}
+	count := len(obs.observers)
+	obs.mu.Unlock()
+	if !found || (o != nil && current != o) {
+		return false
+	}
+	p.metrics().Gauge(metricObservers, float64(count), nil)
+	return true
+}
+
+// stopObservers removes all the observers.
+func (p *proxyHandler) stopObservers() {
+	if p.observers == nil {
+		return
+	}
+	p.observers.mu.Lock()
+	defer p.observers.mu.Unlock()
+	for key, o := range p.observers.observers {
+		delete(p.observers.observers, key)
+		close(o.stop)
+	}
+}
+
+// observe handles the Observe option of the request m from a, answered by
+// coapResp: a successful registration (or a new one with the same token)
+// starts (or extends) the observation, which the response then announces,
+// and a deregistration or a failed registration ends it.
+func (p *proxyHandler) observe(l transport, a *net.UDPAddr, m *coap.Message, options []rawOption, coapResp *translatedCOAPMessage) *translatedCOAPMessage {
+	if p.observers == nil || m.Code != coap.GET {
+		return coapResp
+	}
+	value, ok := m.Option(coap.Observe).(uint32)
+	if !ok {
+		return coapResp
+	}
+	key := tokenKey(a, m.Token)
+	_, isOSCORE := findOption(options, optionOSCORE)
+	if value != observeRegister || coapResp == nil || coapResp.Code>>5 != 2 || isOSCORE {
+		if p.removeObserver(key, nil) {
+			p.logAccess("%v: Observer of /%v deregistered", a, m.PathString())
+		}
+		return coapResp
+	}
+
+	obs := p.observers
+	obs.mu.Lock()
+	o, found := obs.observers[key]
+	if !found {
+		request := *m
+		request.RemoveOption(coap.Observe)
+		o = &observer{key: key, l: l, a: a, request: &request, options: options, stop: make(chan struct{})}
+		obs.observers[key] = o
+	}
+	o.expires = time.Now().Add(p.observeLifetime())
+	count := len(obs.observers)
+	obs.mu.Unlock()
+	obs.changed(o, coapResp)
+	coapResp.SetOption(coap.Observe, obs.nextSequence(o))
+	if !found {
+		p.logAccess("%v: Observer of /%v registered", a, m.PathString())
+		p.metrics().Gauge(metricObservers, float64(count), nil)
+		go p.pollObserver(o, p.pollDelay(coapResp))
+	}
+	return coapResp
+}
+
+// pollObserver polls the backend for the resource of o, first after delay
+// then as told by nextPoll, and notifies o when the response changes, until
+// o is removed: when it rejects a notification with RST or doesn't
+// acknowledge it, when its registration expires, or after an error
+// notification (which ends the observation).
+func (p *proxyHandler) pollObserver(o *observer, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	path := o.request.PathString()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-timer.C:
+		}
+		if p.observers.expired(o, time.Now()) {
+			if p.removeObserver(o.key, o) {
+				p.logAccess("%v: Observer of /%v expired", o.a, path)
+			}
+			return
+		}
+		coapResp := p.serveCOAP(o.a, p.observers.pollRequest(o), o.options, nil)
+		changed := coapResp != nil && !p.retriesPoll(coapResp) && p.observers.changed(o, coapResp)
+		timer.Reset(p.nextPoll(o, coapResp, changed))
+		if !changed {
+			continue
+		}
+		select {
+		case <-o.stop:
+			return
+		default:
+		}
+		final := coapResp.Code>>5 != 2
+		if suppressesResponse(noResponse(o.options), coapResp.Code) {
+			// Not sent, as the registration's No-Response option asks
+			p.metrics().Counter(metricSuppressedResponses, 1, nil)
+			if !final {
+				continue
+			}
+			p.logAccess("%v: Observer of /%v deregistered after a suppressed %v notification", o.a, path, codeString(coapResp.Code))
+			p.removeObserver(o.key, o)
+			return
+		}
+		if !final {
+			coapResp.SetOption(coap.Observe, p.observers.nextSequence(o))
+		}
+		coapResp.Token = o.request.Token
+		if !final && p.exceedsAmplification(o.a, &coapResp.Message, coapResp.ExtraOptions) {
+			continue
+		}
+		_, err := p.sendConfirmable(o.l, o.a, &coapResp.Message, coapResp.ExtraOptions)
+		switch {
+		case err == errMessageRejected:
+			p.logAccess("%v: Notification of /%v rejected, observer deregistered", o.a, path)
+		case err != nil:
+			p.logError("Error sending notification of /%v to %v, observer deregistered: %v", path, o.a, err)
+		case final:
+			p.logAccess("%v: Observer of /%v deregistered after a %v notification", o.a, path, codeString(coapResp.Code))
+		default:
+			continue
+		}
+		p.removeObserver(o.key, o)
+		return
+	}
+}
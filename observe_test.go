@@ -0,0 +1,237 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestObserve(t *testing.T) {
+	var mu sync.Mutex
+	value := "1"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(value))
+	}))
+	defer backend.Close()
+	setValue := func(v string) {
+		mu.Lock()
+		value = v
+		mu.Unlock()
+	}
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, ObserveInterval: 10 * time.Millisecond, AckTimeout: time.Second})
+	defer p.stopObservers()
+
+	send := func(m *coap.Message) {
+		packet, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.handlePacket(p.transportOf(server), clientAddr, packet)
+	}
+	receive := func() *coap.Message {
+		buf := make([]byte, maxCOAPPacketLen)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := coap.ParseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &m
+	}
+	register := func(token string, observe uint32) *coap.Message {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte(token)}
+		m.SetOption(coap.Observe, observe)
+		m.SetPathString("/sensor")
+		send(m)
+		return receive()
+	}
+
+	resp := register("a", observeRegister)
+	firstSeq, ok := resp.Option(coap.Observe).(uint32)
+	if resp.Code != coap.Content || !ok || string(resp.Payload) != "1" || p.observers.count() != 1 {
+		t.Fatalf("registration response is '%v' with %v observers", resp, p.observers.count())
+	}
+	setValue("2")
+	n := receive()
+	if seq, _ := n.Option(coap.Observe).(uint32); n.Type != coap.Confirmable || string(n.Token) != "a" || string(n.Payload) != "2" || seq <= firstSeq {
+		t.Errorf("notification is '%v'", n)
+	}
+	send(&coap.Message{Type: coap.Acknowledgement, MessageID: n.MessageID})
+
+	// A reset notification removes the observer
+	setValue("3")
+	n = receive()
+	send(&coap.Message{Type: coap.Reset, MessageID: n.MessageID})
+	for i := 0; i < 100 && p.observers.count() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := p.observers.count(); count != 0 {
+		t.Errorf("%v observers after a reset", count)
+	}
+
+	// So does a deregistration
+	register("b", observeRegister)
+	resp = register("b", observeDeregister)
+	if _, ok := resp.Option(coap.Observe).(uint32); ok || string(resp.Payload) != "3" || p.observers.count() != 0 {
+		t.Errorf("deregistration response is '%v' with %v observers", resp, p.observers.count())
+	}
+}
+
+func TestObserveExpiry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, ObserveInterval: 10 * time.Millisecond, ObserveLifetime: 30 * time.Millisecond})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte("t")}
+	m.SetOption(coap.Observe, uint32(observeRegister))
+	p.observe(p.transportOf(server), a, m, nil, p.handleRequest(a, m, nil))
+	if count := p.observers.count(); count != 1 {
+		t.Fatalf("%v observers", count)
+	}
+	for i := 0; i < 100 && p.observers.count() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := p.observers.count(); count != 0 {
+		t.Errorf("%v observers after the lifetime", count)
+	}
+}
+
+func TestObserveConditionalPolling(t *testing.T) {
+	var mu sync.Mutex
+	etag, conditional := `"1"`, 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(etag))
+	}))
+	defer backend.Close()
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, ObserveInterval: 10 * time.Millisecond, AckTimeout: time.Second})
+	defer p.stopObservers()
+
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte("t")}
+	m.SetOption(coap.Observe, uint32(observeRegister))
+	p.observe(p.transportOf(server), clientAddr, m, nil, p.handleRequest(clientAddr, m, nil))
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if conditional == 0 {
+		t.Errorf("no conditional poll")
+	}
+	etag = `"2"`
+	mu.Unlock()
+
+	buf := make([]byte, maxCOAPPacketLen)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification, err := coap.ParseMessage(buf[:n])
+	if err != nil || string(notification.Payload) != `"2"` {
+		t.Errorf("first notification is '%v' (error %v)", notification, err)
+	}
+}
+
+func TestPollDelay(t *testing.T) {
+	p := newProxyHandler(&Proxy{ObserveInterval: time.Minute})
+	coapResp := &translatedCOAPMessage{}
+	if delay := p.pollDelay(coapResp); delay != time.Minute {
+		t.Errorf("delay without Max-Age is '%v'", delay)
+	}
+	coapResp.SetOption(coap.MaxAge, uint32(5))
+	if delay := p.pollDelay(coapResp); delay != 5*time.Second {
+		t.Errorf("delay with Max-Age is '%v'", delay)
+	}
+	coapResp.SetOption(coap.MaxAge, uint32(0))
+	if delay := p.pollDelay(coapResp); delay != time.Minute {
+		t.Errorf("delay with Max-Age 0 is '%v'", delay)
+	}
+}
+
+func TestObserveBackoff(t *testing.T) {
+	var mu sync.Mutex
+	polls, status := 0, http.StatusOK
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls++
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		}
+		w.Write([]byte("1"))
+	}))
+	defer backend.Close()
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, ObserveInterval: 10 * time.Millisecond, ObserveMaxBackoff: 80 * time.Millisecond, AckTimeout: time.Second})
+	defer p.stopObservers()
+
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte("t")}
+	m.SetOption(coap.Observe, uint32(observeRegister))
+	p.observe(p.transportOf(server), clientAddr, m, nil, p.handleRequest(clientAddr, m, nil))
+	time.Sleep(400 * time.Millisecond)
+	mu.Lock()
+	if polls > 12 {
+		t.Errorf("%v polls of an unchanged resource", polls)
+	}
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	if count := p.observers.count(); count != 1 {
+		t.Errorf("%v observers after backend errors", count)
+	}
+}
+
+func TestNextPoll(t *testing.T) {
+	p := newProxyHandler(&Proxy{ObserveInterval: 10 * time.Second, ObserveMaxBackoff: time.Minute})
+	o := &observer{}
+	within := func(delay, expected time.Duration) bool {
+		return delay >= expected*8/10 && delay <= expected*12/10
+	}
+	for i, expected := range []time.Duration{20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		if delay := p.nextPoll(o, nil, false); !within(delay, expected) {
+			t.Errorf("delay after %v unchanged polls is %v", i+1, delay)
+		}
+	}
+	if delay := p.nextPoll(o, nil, true); !within(delay, 10*time.Second) {
+		t.Errorf("delay after a change is %v", delay)
+	}
+	coapResp := &translatedCOAPMessage{}
+	coapResp.SetOption(coap.MaxAge, uint32(300))
+	if delay := p.nextPoll(o, coapResp, false); !within(delay, 5*time.Minute) {
+		t.Errorf("delay after a Max-Age longer than the backoff is %v", delay)
+	}
+	if !p.retriesPoll(&translatedCOAPMessage{Message: coap.Message{Code: coap.GatewayTimeout}}) || p.retriesPoll(&translatedCOAPMessage{Message: coap.Message{Code: coap.NotFound}}) {
+		t.Errorf("retried polls are wrong")
+	}
+}
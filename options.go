@@ -0,0 +1,318 @@
+package crosscoap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/dustin/go-coap"
+)
+
+// rawOption is a CoAP option as it appears on the wire.  go-coap keeps only
+// the options it knows and can't represent option numbers above 255, so the
+// proxy parses the options of each packet itself as well.
+type rawOption struct {
+	ID    uint16
+	Value []byte
+}
+
+var errInvalidPacket = errors.New("invalid CoAP packet")
+
+// Option header nibbles (RFC 7252 section 3.1)
+const (
+	optionExtByte     = 13
+	optionExtWord     = 14
+	optionExtReserved = 15
+	payloadMarker     = 0xff
+)
+
+// splitPacket splits a CoAP packet into its fixed header (including the
+// token), its options and its payload.
+func splitPacket(data []byte) ([]byte, []rawOption, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, nil, errInvalidPacket
+	}
+	headerLen := 4 + int(data[0]&0xf)
+	if data[0]&0xf > 8 || len(data) < headerLen {
+		return nil, nil, nil, errInvalidPacket
+	}
+	var options []rawOption
+	b := data[headerLen:]
+	id := 0
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			return data[:headerLen], options, b[1:], nil
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		var err error
+		if delta, b, err = readOptionExt(delta, b); err != nil {
+			return nil, nil, nil, err
+		}
+		if length, b, err = readOptionExt(length, b); err != nil {
+			return nil, nil, nil, err
+		}
+		id += delta
+		if id > math.MaxUint16 || len(b) < length {
+			return nil, nil, nil, errInvalidPacket
+		}
+		options = append(options, rawOption{ID: uint16(id), Value: b[:length]})
+		b = b[length:]
+	}
+	return data[:headerLen], options, nil, nil
+}
+
+func readOptionExt(n int, b []byte) (int, []byte, error) {
+	switch n {
+	case optionExtByte:
+		if len(b) < 1 {
+			return 0, nil, errInvalidPacket
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case optionExtWord:
+		if len(b) < 2 {
+			return 0, nil, errInvalidPacket
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case optionExtReserved:
+		return 0, nil, errInvalidPacket
+	}
+	return n, b, nil
+}
+
+// encodePacket builds a CoAP packet from the parts returned by splitPacket;
+// the options are sorted by number.
+func encodePacket(header []byte, options []rawOption, payload []byte) []byte {
+	return appendPacket(nil, header, options, payload)
+}
+
+// appendPacket is like encodePacket, but appends the packet to dst.
+func appendPacket(dst []byte, header []byte, options []rawOption, payload []byte) []byte {
+	sort.SliceStable(options, func(i, j int) bool { return options[i].ID < options[j].ID })
+	dst = append(dst, header...)
+	prev := 0
+	for _, o := range options {
+		delta, deltaExt := optionNibble(int(o.ID) - prev)
+		length, lengthExt := optionNibble(len(o.Value))
+		dst = append(dst, byte(delta<<4|length))
+		dst = append(dst, deltaExt...)
+		dst = append(dst, lengthExt...)
+		dst = append(dst, o.Value...)
+		prev = int(o.ID)
+	}
+	if len(payload) > 0 {
+		dst = append(dst, payloadMarker)
+		dst = append(dst, payload...)
+	}
+	return dst
+}
+
+func optionNibble(n int) (int, []byte) {
+	switch {
+	case n < 13:
+		return n, nil
+	case n < 269:
+		return optionExtByte, []byte{byte(n - 13)}
+	}
+	ext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ext, uint16(n-269))
+	return optionExtWord, ext
+}
+
+// parsePacket parses an incoming CoAP packet.  The message holds the options
+// known to go-coap, while all the options of the packet are returned as raw
+// options, whose values point into data.
+func parsePacket(data []byte) (*coap.Message, []rawOption, error) {
+	header, options, payload, err := splitPacket(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Numbers above 255 would wrap around in go-coap
+	var representable []rawOption
+	for _, o := range options {
+		if o.ID <= math.MaxUint8 {
+			representable = append(representable, o)
+		}
+	}
+	msg, err := coap.ParseMessage(encodePacket(header, representable, payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &msg, options, nil
+}
+
+// cloneOptions returns a copy of options which doesn't share the values'
+// memory, for options kept after the packet they were parsed from is
+// reused.
+func cloneOptions(options []rawOption) []rawOption {
+	cloned := make([]rawOption, len(options))
+	for i, o := range options {
+		cloned[i] = rawOption{ID: o.ID, Value: append([]byte(nil), o.Value...)}
+	}
+	return cloned
+}
+
+// marshalMessage encodes m along with extra options which go-coap can't
+// represent.
+func marshalMessage(m *coap.Message, extra []rawOption) ([]byte, error) {
+	if len(extra) == 0 {
+		return m.MarshalBinary()
+	}
+	return appendMessage(nil, m, extra)
+}
+
+// appendMessage is like marshalMessage, but appends the packet to dst.
+func appendMessage(dst []byte, m *coap.Message, extra []rawOption) ([]byte, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(extra) == 0 {
+		return append(dst, data...), nil
+	}
+	header, options, payload, err := splitPacket(data)
+	if err != nil {
+		return nil, err
+	}
+	return appendPacket(dst, header, append(options, extra...), payload), nil
+}
+
+// OptionFormat is the value format of a mapped CoAP option.
+type OptionFormat int
+
+const (
+	// StringOption values are copied verbatim to and from the header.
+	StringOption OptionFormat = iota
+	// UintOption values are unsigned integers, written in decimal in the
+	// header.
+	UintOption
+	// OpaqueOption values are arbitrary bytes, hex-encoded in the header.
+	OpaqueOption
+)
+
+// OptionMapping carries a CoAP option, typically a proprietary one, across
+// the proxy: the option of a CoAP request is sent to the backend as the HTTP
+// header, and the header of the backend response is returned to the client
+// as the option.  Repeated options map to repeated headers.
+type OptionMapping struct {
+	// Option is the CoAP option number.
+	Option uint16
+
+	// Header is the HTTP header name.
+	Header string
+
+	// Format is the format of the option value.
+	Format OptionFormat
+}
+
+func (om *OptionMapping) headerValue(value []byte) string {
+	switch om.Format {
+	case UintOption:
+		var n uint64
+		for _, b := range value {
+			n = n<<8 | uint64(b)
+		}
+		return strconv.FormatUint(n, 10)
+	case OpaqueOption:
+		return hex.EncodeToString(value)
+	}
+	return string(value)
+}
+
+func (om *OptionMapping) optionValue(header string) ([]byte, bool) {
+	switch om.Format {
+	case UintOption:
+		n, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, n)
+		return bytes.TrimLeft(value, "\x00"), true
+	case OpaqueOption:
+		value, err := hex.DecodeString(header)
+		return value, err == nil
+	}
+	return []byte(header), true
+}
+
+// mapRequestOptions sets the HTTP headers of the mapped options of a CoAP
+// request.
+func (t *Translator) mapRequestOptions(req *http.Request, options []rawOption) {
+	for i := range t.OptionMappings {
+		mapping := &t.OptionMappings[i]
+		for _, o := range options {
+			if o.ID == mapping.Option {
+				req.Header.Add(mapping.Header, mapping.headerValue(o.Value))
+			}
+		}
+	}
+}
+
+// mapResponseHeaders returns the options for the mapped headers of a backend
+// response.  Header values which don't fit the option format are skipped.
+func (t *Translator) mapResponseHeaders(header http.Header) []rawOption {
+	var options []rawOption
+	for i := range t.OptionMappings {
+		mapping := &t.OptionMappings[i]
+		for _, headerValue := range header.Values(mapping.Header) {
+			if value, ok := mapping.optionValue(headerValue); ok {
+				options = append(options, rawOption{ID: mapping.Option, Value: value})
+			}
+		}
+	}
+	return options
+}
+
+// ForwardedHeader selects a backend response header (such as
+// X-RateLimit-Remaining or Warning) which is surfaced to CoAP clients.
+type ForwardedHeader struct {
+	// Header is the HTTP header name.
+	Header string
+
+	// Option is the CoAP option number which carries the header value as a
+	// string.  If zero, the header is instead appended as a "Header: value"
+	// line to the diagnostic payload of error responses (responses whose
+	// payload has a Content-Format are left alone).
+	Option uint16
+}
+
+func (t *Translator) forwardedHeaderOptions(header http.Header) []rawOption {
+	var options []rawOption
+	for _, forwarded := range t.ForwardedHeaders {
+		if forwarded.Option == 0 {
+			continue
+		}
+		for _, value := range header.Values(forwarded.Header) {
+			options = append(options, rawOption{ID: forwarded.Option, Value: []byte(value)})
+		}
+	}
+	return options
+}
+
+// appendForwardedHeaders appends the forwarded headers which aren't carried
+// in options to a diagnostic payload.
+func (t *Translator) appendForwardedHeaders(payload []byte, header http.Header) []byte {
+	var buf bytes.Buffer
+	buf.Write(payload)
+	for _, forwarded := range t.ForwardedHeaders {
+		if forwarded.Option != 0 {
+			continue
+		}
+		for _, value := range header.Values(forwarded.Header) {
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(http.CanonicalHeaderKey(forwarded.Header) + ": " + value)
+		}
+	}
+	if buf.Len() == len(payload) {
+		return payload
+	}
+	return buf.Bytes()
+}
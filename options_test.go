@@ -0,0 +1,95 @@
+package crosscoap
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestParsePacketKeepsUnknownOptions(t *testing.T) {
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1234, Token: []byte("TOKEN")}
+	req.SetPathString("/some/path")
+	data, err := marshalMessage(&req, []rawOption{
+		{ID: 2049, Value: []byte("class-a")},
+		{ID: 65000, Value: []byte{1, 2}},
+		{ID: 200, Value: []byte{3}},
+	})
+	if err != nil {
+		t.Fatalf("Error marshalling: %v", err)
+	}
+	m, options, err := parsePacket(data)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if m.PathString() != "some/path" || string(m.Token) != "TOKEN" || m.MessageID != 1234 {
+		t.Errorf("parsed message is %+v", m)
+	}
+	if m.Option(coap.IfMatch) != nil {
+		t.Errorf("option 2049 was parsed as If-Match")
+	}
+	expected := []rawOption{
+		{ID: 11, Value: []byte("some")},
+		{ID: 11, Value: []byte("path")},
+		{ID: 200, Value: []byte{3}},
+		{ID: 2049, Value: []byte("class-a")},
+		{ID: 65000, Value: []byte{1, 2}},
+	}
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("options are %v", options)
+	}
+}
+
+func TestParsePacketRejectsInvalidPackets(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x40, 0x01},
+		{0x49, 0x01, 0x00, 0x01},
+		{0x40, 0x01, 0x00, 0x01, 0xf0},
+		{0x40, 0x01, 0x00, 0x01, 0x13, 'a'},
+		{0x40, 0x01, 0x00, 0x01, 0xe0, 0xff},
+	} {
+		if _, _, err := parsePacket(data); err == nil {
+			t.Errorf("parsePacket(%x) succeeded", data)
+		}
+	}
+}
+
+func TestOptionMappings(t *testing.T) {
+	tr := Translator{OptionMappings: []OptionMapping{
+		{Option: 2049, Header: "X-Device-Class"},
+		{Option: 2051, Header: "X-Battery", Format: UintOption},
+		{Option: 2053, Header: "X-Device-Key", Format: OpaqueOption},
+	}}
+	req, _ := http.NewRequest("GET", "http://backend/", nil)
+	tr.mapRequestOptions(req, []rawOption{
+		{ID: 11, Value: []byte("path")},
+		{ID: 2049, Value: []byte("class-a")},
+		{ID: 2049, Value: []byte("class-b")},
+		{ID: 2051, Value: []byte{0x01, 0x00}},
+		{ID: 2053, Value: []byte{0xca, 0xfe}},
+	})
+	if classes := req.Header.Values("X-Device-Class"); !reflect.DeepEqual(classes, []string{"class-a", "class-b"}) {
+		t.Errorf("X-Device-Class is %v", classes)
+	}
+	if req.Header.Get("X-Battery") != "256" {
+		t.Errorf("X-Battery is '%v'", req.Header.Get("X-Battery"))
+	}
+	if req.Header.Get("X-Device-Key") != "cafe" {
+		t.Errorf("X-Device-Key is '%v'", req.Header.Get("X-Device-Key"))
+	}
+
+	options := tr.mapResponseHeaders(http.Header{
+		"X-Device-Class": {"class-c"},
+		"X-Battery":      {"0", "not a number"},
+		"X-Device-Key":   {"beef"},
+	})
+	expected := []rawOption{
+		{ID: 2049, Value: []byte("class-c")},
+		{ID: 2051, Value: nil},
+		{ID: 2053, Value: []byte{0xbe, 0xef}},
+	}
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("response options are %v", options)
+	}
+}
@@ -0,0 +1,558 @@
+package crosscoap
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// optionOSCORE is the OSCORE option (RFC 8613 section 2), which go-coap
+// doesn't know.
+const optionOSCORE uint16 = 9
+
+// HTTP mapping of OSCORE messages (RFC 8613 section 11)
+const (
+	oscoreHeader      = "OSCORE"
+	oscoreContentType = "application/oscore"
+)
+
+// AES-CCM-16-64-128, the mandatory OSCORE algorithm (RFC 8613 section 3.2)
+const (
+	oscoreAlgorithm = 10 // COSE algorithm identifier
+	oscoreKeySize   = 16
+	oscoreNonceSize = 13
+	oscoreTagSize   = 8
+	oscoreMaxIDSize = oscoreNonceSize - 6
+)
+
+var errInvalidOSCORE = errors.New("invalid OSCORE option")
+
+// OSCOREContext is the input of an OSCORE security context (RFC 8613 section
+// 3.2) shared by the proxy with a client.
+type OSCOREContext struct {
+	// MasterSecret and MasterSalt are the input keying material.
+	MasterSecret []byte
+	MasterSalt   []byte
+
+	// IDContext is the optional ID Context; nil if there's none.
+	IDContext []byte
+
+	// SenderID is the proxy's Sender ID, and RecipientID the client's
+	// (used as the kid of its requests); at most 7 bytes each.
+	SenderID    []byte
+	RecipientID []byte
+}
+
+// hkdf derives the key or IV (typ "Key" or "IV") of the given length for
+// the sender or recipient id (RFC 8613 section 3.2.1).
+func (c *OSCOREContext) hkdf(id []byte, typ string, length int) []byte {
+	var info bytes.Buffer
+	writeCBORHead(&info, cborArray, 5)
+	writeCBORHead(&info, cborBytes, uint64(len(id)))
+	info.Write(id)
+	if c.IDContext == nil {
+		info.WriteByte(cborNull)
+	} else {
+		writeCBORHead(&info, cborBytes, uint64(len(c.IDContext)))
+		info.Write(c.IDContext)
+	}
+	writeCBORHead(&info, cborUnsigned, oscoreAlgorithm)
+	writeCBORHead(&info, cborText, uint64(len(typ)))
+	info.WriteString(typ)
+	writeCBORHead(&info, cborUnsigned, uint64(length))
+
+	// HKDF-SHA256 (RFC 5869)
+	extract := hmac.New(sha256.New, c.MasterSalt)
+	extract.Write(c.MasterSecret)
+	prk := extract.Sum(nil)
+	var okm, t []byte
+	for i := byte(1); len(okm) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(t)
+		expand.Write(info.Bytes())
+		expand.Write([]byte{i})
+		t = expand.Sum(nil)
+		okm = append(okm, t...)
+	}
+	return okm[:length]
+}
+
+// key identifies the input of the context, to tell whether a reloaded
+// context changed.
+func (c *OSCOREContext) key() string {
+	return fmt.Sprintf("%x:%x:%x:%x:%x:%v", c.RecipientID, c.SenderID, c.MasterSecret, c.MasterSalt, c.IDContext, c.IDContext == nil)
+}
+
+// oscoreContext is a derived security context.
+type oscoreContext struct {
+	key         string
+	idContext   []byte
+	recipientID []byte
+	sender      cipher.AEAD
+	recipient   cipher.AEAD
+	commonIV    []byte
+
+	mu     sync.Mutex
+	replay replayWindow
+}
+
+func (c *OSCOREContext) derive() (*oscoreContext, error) {
+	if len(c.SenderID) > oscoreMaxIDSize || len(c.RecipientID) > oscoreMaxIDSize {
+		return nil, fmt.Errorf("OSCORE IDs are at most %v bytes long", oscoreMaxIDSize)
+	}
+	if bytes.Equal(c.SenderID, c.RecipientID) {
+		return nil, errors.New("OSCORE sender and recipient IDs are the same")
+	}
+	newAEAD := func(id []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(c.hkdf(id, "Key", oscoreKeySize))
+		if err != nil {
+			return nil, err
+		}
+		return newCCM(block, oscoreNonceSize, oscoreTagSize)
+	}
+	sender, err := newAEAD(c.SenderID)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := newAEAD(c.RecipientID)
+	if err != nil {
+		return nil, err
+	}
+	return &oscoreContext{
+		key:         c.key(),
+		idContext:   c.IDContext,
+		recipientID: c.RecipientID,
+		sender:      sender,
+		recipient:   recipient,
+		commonIV:    c.hkdf(nil, "IV", oscoreNonceSize),
+	}, nil
+}
+
+// nonce returns the AEAD nonce of the partial IV piv generated by the
+// endpoint with Sender ID id (RFC 8613 section 5.2).
+func (c *oscoreContext) nonce(id, piv []byte) []byte {
+	nonce := make([]byte, oscoreNonceSize)
+	nonce[0] = byte(len(id))
+	copy(nonce[1+oscoreMaxIDSize-len(id):], id)
+	copy(nonce[oscoreNonceSize-len(piv):], piv)
+	xorBytes(nonce, nonce, c.commonIV)
+	return nonce
+}
+
+// oscoreAAD returns the additional authenticated data of the request with
+// kid and piv, and of its response (RFC 8613 section 5.4).
+func oscoreAAD(kid, piv []byte) []byte {
+	var aad bytes.Buffer
+	writeCBORHead(&aad, cborArray, 5)
+	writeCBORHead(&aad, cborUnsigned, 1) // oscore_version
+	writeCBORHead(&aad, cborArray, 1)
+	writeCBORHead(&aad, cborUnsigned, oscoreAlgorithm)
+	writeCBORHead(&aad, cborBytes, uint64(len(kid)))
+	aad.Write(kid)
+	writeCBORHead(&aad, cborBytes, uint64(len(piv)))
+	aad.Write(piv)
+	writeCBORHead(&aad, cborBytes, 0) // no class I options
+
+	var enc bytes.Buffer
+	writeCBORHead(&enc, cborArray, 3)
+	writeCBORHead(&enc, cborText, uint64(len("Encrypt0")))
+	enc.WriteString("Encrypt0")
+	writeCBORHead(&enc, cborBytes, 0)
+	writeCBORHead(&enc, cborBytes, uint64(aad.Len()))
+	enc.Write(aad.Bytes())
+	return enc.Bytes()
+}
+
+// replayWindow is the sliding window of the sequence numbers received from a
+// client (RFC 8613 section 7.4), like DTLS's.
+type replayWindow struct {
+	initialized bool
+	highest     uint64
+	seen        uint32 // bit i is set if highest-i was received
+}
+
+// accept records seq, returning false if it was already received or is too
+// old to tell.
+func (w *replayWindow) accept(seq uint64) bool {
+	switch {
+	case !w.initialized:
+		w.initialized, w.highest, w.seen = true, seq, 1
+		return true
+	case seq > w.highest:
+		if shift := seq - w.highest; shift < 32 {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.highest = seq
+		return true
+	case w.highest-seq >= 32:
+		return false
+	}
+	bit := uint32(1) << (w.highest - seq)
+	if w.seen&bit != 0 {
+		return false
+	}
+	w.seen |= bit
+	return true
+}
+
+// oscoreOption is the value of the OSCORE option (RFC 8613 section 6.1).
+type oscoreOption struct {
+	piv        []byte
+	kidContext []byte // nil if absent
+	kid        []byte // nil if absent
+}
+
+func parseOSCOREOption(value []byte) (oscoreOption, error) {
+	var o oscoreOption
+	if len(value) == 0 {
+		return o, nil
+	}
+	flags, b := value[0], value[1:]
+	n := int(flags & 0x7)
+	if flags&0xe0 != 0 || n > 5 || len(b) < n {
+		return o, errInvalidOSCORE
+	}
+	o.piv, b = b[:n], b[n:]
+	if flags&0x10 != 0 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return o, errInvalidOSCORE
+		}
+		o.kidContext, b = b[1:1+int(b[0])], b[1+int(b[0]):]
+	}
+	if flags&0x08 != 0 {
+		o.kid = b
+	} else if len(b) > 0 {
+		return o, errInvalidOSCORE
+	}
+	return o, nil
+}
+
+// defaultOSCOREReloadInterval is how often OSCOREContextSource is called if
+// OSCOREReloadInterval is zero.
+const defaultOSCOREReloadInterval = 10 * time.Second
+
+// oscoreServer terminates OSCORE with the proxy's security contexts.
+type oscoreServer struct {
+	mu       sync.RWMutex
+	contexts []*oscoreContext
+	echo     *echoVerifier
+}
+
+func (p *Proxy) newOSCOREServer() *oscoreServer {
+	if len(p.OSCOREContexts) == 0 && p.OSCOREContextSource == nil {
+		return nil
+	}
+	s := &oscoreServer{echo: newEchoVerifier()}
+	contexts := p.OSCOREContexts
+	if p.OSCOREContextSource != nil {
+		loaded, err := p.OSCOREContextSource()
+		if err != nil {
+			p.logError("Error loading OSCORE contexts: %v", err)
+		}
+		contexts = append(append([]OSCOREContext(nil), contexts...), loaded...)
+	}
+	s.update(contexts, p.logError)
+	return s
+}
+
+// update replaces the security contexts of s by those derived from inputs,
+// returning the number of contexts added and removed (a changed context
+// counts as both).  The contexts whose input didn't change are kept along
+// with their replay window.
+func (s *oscoreServer) update(inputs []OSCOREContext, logError func(format string, args ...interface{})) (added, removed int) {
+	s.mu.RLock()
+	current := make(map[string]*oscoreContext, len(s.contexts))
+	for _, c := range s.contexts {
+		current[c.key] = c
+	}
+	s.mu.RUnlock()
+	contexts := make([]*oscoreContext, 0, len(inputs))
+	kept := make(map[string]bool)
+	for i := range inputs {
+		key := inputs[i].key()
+		if c := current[key]; c != nil {
+			if !kept[key] {
+				contexts = append(contexts, c)
+				kept[key] = true
+			}
+			continue
+		}
+		c, err := inputs[i].derive()
+		if err != nil {
+			logError("Ignoring OSCORE context with recipient ID %x: %v", inputs[i].RecipientID, err)
+			continue
+		}
+		contexts = append(contexts, c)
+		added++
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed = len(s.contexts) - len(kept)
+	s.contexts = contexts
+	return added, removed
+}
+
+func (p *Proxy) oscoreReloadInterval() time.Duration {
+	if p.OSCOREReloadInterval > 0 {
+		return p.OSCOREReloadInterval
+	}
+	return defaultOSCOREReloadInterval
+}
+
+// reloadOSCOREContexts calls OSCOREContextSource periodically, until done
+// is closed, to replace the contexts it supplied.  The contexts are kept if
+// it fails.
+func (p *proxyHandler) reloadOSCOREContexts(done <-chan struct{}) {
+	if p.OSCOREContextSource == nil || p.oscore == nil {
+		return
+	}
+	ticker := time.NewTicker(p.oscoreReloadInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		loaded, err := p.OSCOREContextSource()
+		if err != nil {
+			p.logError("Error reloading OSCORE contexts, keeping the current ones: %v", err)
+			continue
+		}
+		contexts := append(append([]OSCOREContext(nil), p.OSCOREContexts...), loaded...)
+		if added, removed := p.oscore.update(contexts, p.logError); added > 0 || removed > 0 {
+			p.logAccess("OSCORE contexts reloaded: %v added, %v removed", added, removed)
+		}
+	}
+}
+
+func (s *oscoreServer) context(o *oscoreOption) *oscoreContext {
+	if s == nil || o.kid == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.contexts {
+		if bytes.Equal(c.recipientID, o.kid) && (o.kidContext == nil || bytes.Equal(c.idContext, o.kidContext)) {
+			return c
+		}
+	}
+	return nil
+}
+
+// oscoreErrorResponse builds an unprotected error response to the OSCORE
+// request m, which isn't to be cached (RFC 8613 section 8.2).
+func (p *proxyHandler) oscoreErrorResponse(m *coap.Message, code coap.COAPCode, diagnostic string) *translatedCOAPMessage {
+	coapResp := p.errorResponse(m, code, diagnostic)
+	if coapResp != nil {
+		coapResp.SetOption(coap.MaxAge, uint32(0))
+	}
+	return coapResp
+}
+
+// handleOSCORE answers the request m protected with OSCORE, whose option has
+// the given value: it's decrypted and proxied if it matches one of the
+// proxy's security contexts, or else forwarded to OSCOREBackendURL.
+func (p *proxyHandler) handleOSCORE(a *net.UDPAddr, m *coap.Message, options []rawOption, value []byte) *translatedCOAPMessage {
+	o, err := parseOSCOREOption(value)
+	if err != nil {
+		return p.oscoreErrorResponse(m, coap.BadOption, err.Error())
+	}
+	if c := p.oscore.context(&o); c != nil {
+		return p.terminateOSCORE(a, m, options, c, &o)
+	}
+	if p.OSCOREBackendURL != "" {
+		return p.forwardOSCORE(a, m, options, value)
+	}
+	if p.oscore != nil {
+		return p.oscoreErrorResponse(m, coap.Unauthorized, "Security context not found")
+	}
+	return p.errorResponse(m, coap.BadOption, "OSCORE not supported")
+}
+
+// forwardOSCORE sends the OSCORE request m unchanged to OSCOREBackendURL, and
+// returns the protected response, following the HTTP mapping of RFC 8613
+// section 11.
+func (p *proxyHandler) forwardOSCORE(a *net.UDPAddr, m *coap.Message, options []rawOption, value []byte) *translatedCOAPMessage {
+	requestID := p.translator.requestID(m.Token, options)
+	if !p.clientAllowed(a.IP) {
+		p.logAccess("%v: CoAP %v OSCORE Request-ID=%v denied client", a, methodName(m.Code), requestID)
+		if p.RejectDeniedClients {
+			return p.errorResponse(m, coap.Forbidden, "client not allowed")
+		}
+		return nil
+	}
+	p.logAccess("%v: CoAP %v OSCORE Request-ID=%v", a, methodName(m.Code), requestID)
+	method := "POST"
+	switch m.Code {
+	case coap.POST:
+	case FETCH:
+		method = "FETCH"
+	default:
+		return p.oscoreErrorResponse(m, coap.BadRequest, "invalid OSCORE request code")
+	}
+	req, err := http.NewRequest(method, p.OSCOREBackendURL, bytes.NewReader(m.Payload))
+	if err != nil {
+		p.logError("Error creating OSCORE HTTP request: %v (Request-ID=%v)", err, requestID)
+		return p.errorResponse(m, coap.InternalServerError, "invalid OSCORE backend URL")
+	}
+	req.Header.Set("Content-Type", oscoreContentType)
+	req.Header.Set(oscoreHeader, base64.RawURLEncoding.EncodeToString(value))
+	if err := p.prepareBackendRequest(req, m, options, requestID, nil); err != nil {
+		p.logError("Error signing HTTP request: %v (Request-ID=%v)", err, requestID)
+		return p.errorResponse(m, coap.InternalServerError, "request signing failed")
+	}
+	timeout := p.requestTimeout(m)
+	httpResp, httpBody, err := p.doHTTPRequest(req, timeout)
+	if err != nil {
+		p.logError("Error on HTTP request: %v (Request-ID=%v)", err, requestID)
+		code := translateBackendError(err)
+		return p.errorResponse(m, code, p.backendErrorDiagnostic(code, timeout))
+	}
+	coapResp := &translatedCOAPMessage{Message: coap.Message{
+		Type:      coap.Acknowledgement,
+		Code:      translateStatusCode(m.Code, httpResp.StatusCode),
+		MessageID: m.MessageID,
+		Token:     m.Token,
+		Payload:   httpBody,
+	}}
+	_, protected := httpResp.Header[http.CanonicalHeaderKey(oscoreHeader)]
+	if protected || httpResp.Header.Get("Content-Type") == oscoreContentType {
+		header := httpResp.Header.Get(oscoreHeader)
+		responseValue, err := base64.RawURLEncoding.DecodeString(header)
+		if err != nil {
+			p.logError("Invalid OSCORE header %q in HTTP response (Request-ID=%v)", header, requestID)
+			return p.errorResponse(m, coap.BadGateway, "invalid OSCORE response")
+		}
+		coapResp.ExtraOptions = []rawOption{{ID: optionOSCORE, Value: responseValue}}
+	}
+	// A truncated protected payload would be useless
+	if data, err := marshalMessage(&coapResp.Message, coapResp.ExtraOptions); err != nil || len(data) > p.translator.maxPacketSize() {
+		p.logError("OSCORE response of %v bytes is too large (Request-ID=%v)", len(httpBody), requestID)
+		return p.errorResponse(m, coap.BadGateway, "OSCORE response too large")
+	}
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	return coapResp
+}
+
+// terminateOSCORE decrypts the request m with the security context c,
+// proxies it and protects its response (RFC 8613 section 8).
+func (p *proxyHandler) terminateOSCORE(a *net.UDPAddr, m *coap.Message, options []rawOption, c *oscoreContext, o *oscoreOption) *translatedCOAPMessage {
+	if len(o.piv) == 0 {
+		return p.oscoreErrorResponse(m, coap.BadOption, "OSCORE request without partial IV")
+	}
+	nonce := c.nonce(o.kid, o.piv)
+	aad := oscoreAAD(o.kid, o.piv)
+	plaintext, err := c.recipient.Open(nil, nonce, m.Payload, aad)
+	if err != nil {
+		p.logAccess("%v: CoAP OSCORE kid=%x decryption failed", a, o.kid)
+		return p.oscoreErrorResponse(m, coap.BadRequest, "Decryption failed")
+	}
+	inner, innerOptions, err := oscoreInnerRequest(m, options, plaintext)
+	if err != nil {
+		return p.oscoreErrorResponse(m, coap.BadRequest, "invalid OSCORE plaintext")
+	}
+
+	var seq uint64
+	for _, b := range o.piv {
+		seq = seq<<8 | uint64(b)
+	}
+	c.mu.Lock()
+	initialized := c.replay.initialized
+	fresh := initialized && c.replay.accept(seq)
+	c.mu.Unlock()
+	if !initialized {
+		// The replay window is only initialized by a request echoing a fresh
+		// Echo option (RFC 8613 appendix B.1.2), so that requests received
+		// before the proxy started can't be replayed
+		value, found := findOption(innerOptions, optionEcho)
+		if !found || !p.oscore.echo.verify(a, value) {
+			challenge := p.errorResponse(inner, coap.Unauthorized, "")
+			if challenge == nil {
+				return nil
+			}
+			challenge.ExtraOptions = []rawOption{{ID: optionEcho, Value: p.oscore.echo.value(a)}}
+			return p.protectOSCORE(c, m, challenge, nonce, aad)
+		}
+		c.mu.Lock()
+		fresh = c.replay.accept(seq)
+		c.mu.Unlock()
+	}
+	if !fresh {
+		p.logAccess("%v: CoAP OSCORE kid=%x replayed sequence number %v", a, o.kid, seq)
+		return p.oscoreErrorResponse(m, coap.Unauthorized, "Replay detected")
+	}
+	p.registerOSCOREDevice(a, o.kid)
+	innerOptions = removeOption(innerOptions, optionEcho)
+	return p.protectOSCORE(c, m, p.handleRequestAs(a, oscoreIdentity(o.kid), inner, innerOptions), nonce, aad)
+}
+
+// oscoreInnerRequest rebuilds the request protected by the OSCORE request m
+// from the decrypted plaintext and the outer options of m which aren't
+// encrypted (RFC 8613 section 4.1).
+func oscoreInnerRequest(m *coap.Message, options []rawOption, plaintext []byte) (*coap.Message, []rawOption, error) {
+	if len(plaintext) == 0 {
+		return nil, nil, errInvalidOSCORE
+	}
+	header := []byte{0x40 | byte(m.Type)<<4 | byte(len(m.Token)), plaintext[0], byte(m.MessageID >> 8), byte(m.MessageID)}
+	header = append(header, m.Token...)
+	_, inner, payload, err := splitPacket(append(append([]byte(nil), header...), plaintext[1:]...))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, o := range inner {
+		if o.ID == optionOSCORE {
+			return nil, nil, errInvalidOSCORE
+		}
+	}
+	for _, o := range options {
+		switch coap.OptionID(o.ID) {
+		case coap.URIHost, coap.URIPort, coap.ProxyURI, coap.ProxyScheme:
+			inner = append(inner, o)
+		}
+	}
+	return parsePacket(appendPacket(nil, header, inner, payload))
+}
+
+// protectOSCORE encrypts coapResp, the response to the OSCORE request m,
+// with the request's nonce (RFC 8613 section 8.3).
+func (p *proxyHandler) protectOSCORE(c *oscoreContext, m *coap.Message, coapResp *translatedCOAPMessage, nonce, aad []byte) *translatedCOAPMessage {
+	if coapResp == nil {
+		return nil
+	}
+	data, err := marshalMessage(&coapResp.Message, coapResp.ExtraOptions)
+	if err != nil {
+		p.logError("Error encoding CoAP response: %v", err)
+		return p.oscoreErrorResponse(m, coap.InternalServerError, "")
+	}
+	_, innerOptions, payload, err := splitPacket(data)
+	if err != nil {
+		return p.oscoreErrorResponse(m, coap.InternalServerError, "")
+	}
+	plaintext := appendPacket(nil, []byte{byte(coapResp.Code)}, innerOptions, payload)
+	return &translatedCOAPMessage{
+		Message: coap.Message{
+			Type:      coapResp.Type,
+			Code:      coap.Changed,
+			MessageID: coapResp.MessageID,
+			Token:     coapResp.Token,
+			Payload:   c.sender.Seal(nil, nonce, plaintext, aad),
+		},
+		ExtraOptions: []rawOption{{ID: optionOSCORE}},
+	}
+}
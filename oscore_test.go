@@ -0,0 +1,241 @@
+package crosscoap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// Security contexts of the test vectors of RFC 8613 appendix C.1.1
+var (
+	oscoreTestClient = OSCOREContext{
+		MasterSecret: mustDecodeHex("0102030405060708090a0b0c0d0e0f10"),
+		MasterSalt:   mustDecodeHex("9e7ca92223786340"),
+		SenderID:     []byte{},
+		RecipientID:  []byte{0x01},
+	}
+	oscoreTestServer = OSCOREContext{
+		MasterSecret: oscoreTestClient.MasterSecret,
+		MasterSalt:   oscoreTestClient.MasterSalt,
+		SenderID:     []byte{0x01},
+		RecipientID:  []byte{},
+	}
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestOSCOREContextDerivation(t *testing.T) {
+	tests := []struct {
+		id, typ, expected string
+		length            int
+	}{
+		{"", "Key", "f0910ed7295e6ad4b54fc793154302ff", oscoreKeySize},
+		{"01", "Key", "ffb14e093c94c9cac9471648b4f98710", oscoreKeySize},
+		{"", "IV", "4622d4dd6d944168eefb54987c", oscoreNonceSize},
+	}
+	for _, test := range tests {
+		id := mustDecodeHex(test.id)
+		if test.typ == "IV" {
+			id = nil
+		}
+		if derived := oscoreTestClient.hkdf(id, test.typ, test.length); hex.EncodeToString(derived) != test.expected {
+			t.Errorf("%v of ID '%v' is '%x'; expected '%v'", test.typ, test.id, derived, test.expected)
+		}
+	}
+}
+
+func TestParseOSCOREOption(t *testing.T) {
+	o, err := parseOSCOREOption(mustDecodeHex("19140100"))
+	if err != nil || !bytes.Equal(o.piv, []byte{0x14}) || !bytes.Equal(o.kidContext, []byte{0x00}) || o.kid == nil || len(o.kid) != 0 {
+		t.Errorf("option is '%+v' (error %v)", o, err)
+	}
+	for _, invalid := range []string{"06", "0a14", "1914", "2014", "02"} {
+		if _, err := parseOSCOREOption(mustDecodeHex(invalid)); err == nil {
+			t.Errorf("invalid option '%v' is parsed", invalid)
+		}
+	}
+}
+
+// protectTestRequest protects an inner request packet as the client of
+// oscoreTestClient with sequence number seq.
+func protectTestRequest(t *testing.T, inner []byte, seq byte) (*coap.Message, []rawOption, []byte, []byte) {
+	c, err := oscoreTestClient.derive()
+	if err != nil {
+		t.Fatalf("Error deriving client context: %v", err)
+	}
+	header, options, payload, err := splitPacket(inner)
+	if err != nil {
+		t.Fatalf("Error splitting request: %v", err)
+	}
+	piv := []byte{seq}
+	nonce := c.nonce(oscoreTestClient.SenderID, piv)
+	aad := oscoreAAD(oscoreTestClient.SenderID, piv)
+	ciphertext := c.sender.Seal(nil, nonce, appendPacket(nil, header[1:2], options, payload), aad)
+	outer := append([]byte(nil), header...)
+	outer[1] = byte(coap.POST)
+	m, outerOptions, err := parsePacket(appendPacket(nil, outer, []rawOption{{ID: optionOSCORE, Value: []byte{0x09, seq}}}, ciphertext))
+	if err != nil {
+		t.Fatalf("Error parsing protected request: %v", err)
+	}
+	return m, outerOptions, nonce, aad
+}
+
+// openTestResponse decrypts a protected response as the client of
+// oscoreTestClient.
+func openTestResponse(t *testing.T, coapResp *translatedCOAPMessage, nonce, aad []byte) (*coap.Message, []rawOption) {
+	c, _ := oscoreTestClient.derive()
+	if coapResp == nil || coapResp.Code != coap.Changed || len(coapResp.ExtraOptions) != 1 || coapResp.ExtraOptions[0].ID != optionOSCORE {
+		t.Fatalf("protected response is '%v'", coapResp)
+	}
+	plaintext, err := c.recipient.Open(nil, nonce, coapResp.Payload, aad)
+	if err != nil {
+		t.Fatalf("Error decrypting response: %v", err)
+	}
+	header := []byte{0x40, plaintext[0], 0, 0}
+	m, options, err := parsePacket(append(header, plaintext[1:]...))
+	if err != nil {
+		t.Fatalf("Error parsing response plaintext: %v", err)
+	}
+	return m, options
+}
+
+func TestProtectOSCORE(t *testing.T) {
+	// RFC 8613 appendix C.7
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1", OSCOREContexts: []OSCOREContext{oscoreTestServer}})
+	c := p.oscore.contexts[0]
+	m, _, _ := parsePacket(mustDecodeHex("44025d1f00003974396c6f63616c686f7374620914ff612f1092f1776f1c1668b3825e"))
+	response, _, _ := parsePacket(mustDecodeHex("64455d1f00003974ff48656c6c6f20576f726c6421"))
+	piv := []byte{0x14}
+	protected := p.protectOSCORE(c, m, &translatedCOAPMessage{Message: *response}, c.nonce(nil, piv), oscoreAAD(nil, piv))
+	data, err := marshalMessage(&protected.Message, protected.ExtraOptions)
+	if expected := "64445d1f0000397490ffdbaad1e9a7e7b2a813d3c31524378303cdafae119106"; err != nil || hex.EncodeToString(data) != expected {
+		t.Errorf("protected response is '%x'; expected '%v'", data, expected)
+	}
+}
+
+func TestProxyTerminatingOSCORE(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/tv1" {
+			t.Errorf("backend got %v %v", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Hello World!"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, OSCOREContexts: []OSCOREContext{oscoreTestServer}})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+
+	// RFC 8613 appendix C.4: the first request gets an Echo challenge
+	m, options, _ := parsePacket(mustDecodeHex("44025d1f00003974396c6f63616c686f7374620914ff612f1092f1776f1c1668b3825e"))
+	piv := []byte{0x14}
+	nonce, aad := p.oscore.contexts[0].nonce(nil, piv), oscoreAAD(nil, piv)
+	inner, innerOptions := openTestResponse(t, p.handleRequest(a, m, options), nonce, aad)
+	echo, found := findOption(innerOptions, optionEcho)
+	if inner.Code != coap.Unauthorized || !found {
+		t.Fatalf("response to first request is '%v'", inner)
+	}
+
+	request := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 2, Token: []byte{2}}
+	request.SetPathString("/tv1")
+	packet, _ := marshalMessage(request, []rawOption{{ID: optionEcho, Value: echo}})
+	m, options, nonce, aad = protectTestRequest(t, packet, 0x15)
+	inner, _ = openTestResponse(t, p.handleRequest(a, m, options), nonce, aad)
+	if inner.Code != coap.Content || string(inner.Payload) != "Hello World!" {
+		t.Errorf("response to request with Echo is '%v'", inner)
+	}
+
+	packet, _ = marshalMessage(request, nil)
+	m, options, nonce, aad = protectTestRequest(t, packet, 0x16)
+	inner, _ = openTestResponse(t, p.handleRequest(a, m, options), nonce, aad)
+	if inner.Code != coap.Content {
+		t.Errorf("response to next request is '%v'", inner)
+	}
+	if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != coap.Unauthorized {
+		t.Errorf("response to replayed request is '%v'", coapResp)
+	}
+
+	m.Payload[0]++
+	if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != coap.BadRequest {
+		t.Errorf("response to tampered request is '%v'", coapResp)
+	}
+}
+
+func TestOSCOREContextReload(t *testing.T) {
+	other := OSCOREContext{MasterSecret: []byte("secret"), SenderID: []byte{0x01}, RecipientID: []byte{0x42}}
+	loaded := []OSCOREContext{oscoreTestServer}
+	var loadErr error
+	p := newProxyHandler(&Proxy{OSCOREContextSource: func() ([]OSCOREContext, error) { return loaded, loadErr }})
+	if p.oscore == nil || len(p.oscore.contexts) != 1 {
+		t.Fatalf("OSCORE server is %+v", p.oscore)
+	}
+	kept := p.oscore.contexts[0]
+
+	if added, removed := p.oscore.update([]OSCOREContext{oscoreTestServer, other}, p.logError); added != 1 || removed != 0 {
+		t.Errorf("adding a context added %v and removed %v", added, removed)
+	}
+	if c := p.oscore.context(&oscoreOption{kid: []byte{}}); c != kept {
+		t.Errorf("unchanged context was derived again")
+	}
+	changed := other
+	changed.MasterSecret = []byte("rotated")
+	if added, removed := p.oscore.update([]OSCOREContext{changed}, p.logError); added != 1 || removed != 2 {
+		t.Errorf("rotating a secret added %v and removed %v", added, removed)
+	}
+	if p.oscore.context(&oscoreOption{kid: []byte{}}) != nil || p.oscore.context(&oscoreOption{kid: []byte{0x42}}) == nil {
+		t.Errorf("contexts after rotation are %v", len(p.oscore.contexts))
+	}
+
+	loadErr = errors.New("unreadable")
+	done := make(chan struct{})
+	p.OSCOREReloadInterval = time.Millisecond
+	go p.reloadOSCOREContexts(done)
+	time.Sleep(20 * time.Millisecond)
+	close(done)
+	if p.oscore.context(&oscoreOption{kid: []byte{0x42}}) == nil {
+		t.Errorf("contexts were dropped after an error")
+	}
+}
+
+func TestProxyForwardingOSCORE(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.Header.Get("Content-Type") != oscoreContentType || r.Header.Get(oscoreHeader) != "CRQ" || string(body) != "sealed" {
+			t.Errorf("backend got %v %v %v '%s'", r.Method, r.Header.Get("Content-Type"), r.Header.Get(oscoreHeader), body)
+		}
+		w.Header().Set("Content-Type", oscoreContentType)
+		w.Header().Set(oscoreHeader, "")
+		w.Write([]byte("sealed response"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1", OSCOREBackendURL: backend.URL + "/oscore"})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1, Payload: []byte("sealed")}
+	value, _ := base64.RawURLEncoding.DecodeString("CRQ")
+	coapResp := p.handleRequest(a, m, []rawOption{{ID: optionOSCORE, Value: value}})
+	if coapResp == nil || coapResp.Code != coap.Changed || string(coapResp.Payload) != "sealed response" {
+		t.Fatalf("response is '%v'", coapResp)
+	}
+	if value, found := findOption(coapResp.ExtraOptions, optionOSCORE); !found || len(value) != 0 {
+		t.Errorf("response OSCORE option is '%x' (found %v)", value, found)
+	}
+
+	p = newProxyHandler(&Proxy{BackendURL: backend.URL})
+	if coapResp := p.handleRequest(a, m, []rawOption{{ID: optionOSCORE, Value: value}}); coapResp == nil || coapResp.Code != coap.BadOption {
+		t.Errorf("response without OSCORE support is '%v'", coapResp)
+	}
+}
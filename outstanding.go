@@ -0,0 +1,82 @@
+package crosscoap
+
+import (
+	"net"
+	"sync"
+
+	"github.com/dustin/go-coap"
+)
+
+// metricExcessRequests counts the requests refused because their client had
+// MaxOutstanding exchanges in progress.
+const metricExcessRequests = "excess_requests"
+
+// outstandingExchanges tracks the message IDs of the requests being handled
+// for each client endpoint, to enforce MaxOutstanding.
+type outstandingExchanges struct {
+	mu      sync.Mutex
+	max     int
+	clients map[string]map[uint16]struct{}
+}
+
+// newOutstandingExchanges returns the tracker of p's outstanding exchanges,
+// or nil if MaxOutstanding is zero.
+func (p *proxyHandler) newOutstandingExchanges() *outstandingExchanges {
+	if p.MaxOutstanding <= 0 {
+		return nil
+	}
+	return &outstandingExchanges{max: p.MaxOutstanding, clients: make(map[string]map[uint16]struct{})}
+}
+
+// start records the exchange of the request with message ID mid from a,
+// unless a already has max exchanges in progress.  duplicate reports a
+// retransmission of an exchange in progress, which isn't started again.
+func (o *outstandingExchanges) start(a *net.UDPAddr, mid uint16) (started, duplicate bool) {
+	if o == nil {
+		return true, false
+	}
+	key := a.String()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	exchanges := o.clients[key]
+	if _, found := exchanges[mid]; found {
+		return false, true
+	}
+	if len(exchanges) >= o.max {
+		return false, false
+	}
+	if exchanges == nil {
+		exchanges = make(map[uint16]struct{})
+		o.clients[key] = exchanges
+	}
+	exchanges[mid] = struct{}{}
+	return true, false
+}
+
+// done records the end of an exchange started by start.
+func (o *outstandingExchanges) done(a *net.UDPAddr, mid uint16) {
+	if o == nil {
+		return
+	}
+	key := a.String()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	exchanges := o.clients[key]
+	delete(exchanges, mid)
+	if len(exchanges) == 0 {
+		delete(o.clients, key)
+	}
+}
+
+// refuseExcess answers the request m from a, which exceeds MaxOutstanding,
+// with 5.03 Service Unavailable if it's confirmable and DropExcessRequests
+// isn't set; other requests are dropped.
+func (p *proxyHandler) refuseExcess(l transport, a *net.UDPAddr, m *coap.Message) {
+	p.metrics().Counter(metricExcessRequests, 1, nil)
+	p.logAccess("%v: too many outstanding exchanges, request %v refused", a, m.MessageID)
+	if !m.IsConfirmable() || p.DropExcessRequests {
+		return
+	}
+	p.clients.failed(a)
+	p.sendResponse(l, a, p.errorResponse(m, coap.ServiceUnavailable, "too many outstanding requests"))
+}
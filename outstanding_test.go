@@ -0,0 +1,72 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestMaxOutstanding(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, MaxOutstanding: 1})
+	tr := &fakeTransport{}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	send := func(a *net.UDPAddr, typ coap.COAPType, mid uint16, path string) {
+		m := coap.Message{Type: typ, Code: coap.GET, MessageID: mid, Token: []byte{byte(mid)}}
+		m.SetPathString(path)
+		packet, _ := m.MarshalBinary()
+		p.handlePacket(tr, a, packet)
+	}
+	sent := func() []*coap.Message {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		return append([]*coap.Message(nil), tr.sent...)
+	}
+
+	done := make(chan bool)
+	go func() {
+		send(client, coap.Confirmable, 1, "/slow")
+		done <- true
+	}()
+	<-started
+	send(client, coap.Confirmable, 1, "/slow")
+	if len(sent()) != 0 {
+		t.Errorf("response to a retransmission of the request in progress is %v", sent()[0].Code)
+	}
+	send(client, coap.NonConfirmable, 2, "/fast")
+	if len(sent()) != 0 {
+		t.Errorf("response to an excess non-confirmable request is %v", sent()[0].Code)
+	}
+	send(client, coap.Confirmable, 3, "/fast")
+	if s := sent(); len(s) != 1 || s[0].Code != coap.ServiceUnavailable || s[0].MessageID != 3 {
+		t.Errorf("responses to an excess confirmable request are %v", s)
+	}
+	p.DropExcessRequests = true
+	send(client, coap.Confirmable, 4, "/fast")
+	if s := sent(); len(s) != 1 {
+		t.Errorf("responses to a dropped confirmable request are %v", s)
+	}
+	send(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}, coap.Confirmable, 5, "/fast")
+	if s := sent(); len(s) != 2 || s[1].Code != coap.Content {
+		t.Errorf("responses to another client are %v", s)
+	}
+
+	release <- true
+	<-done
+	send(client, coap.Confirmable, 6, "/fast")
+	if s := sent(); len(s) != 4 || s[2].Code != coap.Content || s[3].Code != coap.Content || s[3].MessageID != 6 {
+		t.Errorf("responses after the request in progress are %v", s)
+	}
+}
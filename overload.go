@@ -0,0 +1,102 @@
+package crosscoap
+
+import (
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// metricOverloadedRequests counts the requests refused because
+// MaxConcurrentRequests requests were being handled and RequestQueueSize
+// were waiting.
+const metricOverloadedRequests = "overloaded_requests"
+
+// workerPool bounds the requests handled at once, the others waiting in a
+// bounded queue.
+type workerPool struct {
+	slots     chan struct{}
+	queueSize int32
+	waiting   int32
+	latency   int64 // moving average of the time requests hold a slot, in nanoseconds
+}
+
+// newWorkerPool returns the worker pool of p, or nil if
+// MaxConcurrentRequests is zero.
+func (p *proxyHandler) newWorkerPool() *workerPool {
+	if p.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	return &workerPool{slots: make(chan struct{}, p.MaxConcurrentRequests), queueSize: int32(p.RequestQueueSize)}
+}
+
+// acquire takes a slot, waiting in the queue for one if none is free, or
+// returns false if the queue is full.
+func (w *workerPool) acquire() bool {
+	if w == nil {
+		return true
+	}
+	select {
+	case w.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if atomic.AddInt32(&w.waiting, 1) > w.queueSize {
+		atomic.AddInt32(&w.waiting, -1)
+		return false
+	}
+	w.slots <- struct{}{}
+	atomic.AddInt32(&w.waiting, -1)
+	return true
+}
+
+// release frees the slot taken at start.
+func (w *workerPool) release(start time.Time) {
+	if w == nil {
+		return
+	}
+	<-w.slots
+	held := int64(time.Since(start))
+	for {
+		old := atomic.LoadInt64(&w.latency)
+		average := held
+		if old != 0 {
+			average = old + (held-old)/5
+		}
+		if atomic.CompareAndSwapInt64(&w.latency, old, average) {
+			return
+		}
+	}
+}
+
+// retryAfter estimates how long the requests queued now take to be handled.
+func (w *workerPool) retryAfter() time.Duration {
+	latency := time.Duration(atomic.LoadInt64(&w.latency))
+	if latency <= 0 {
+		latency = time.Second
+	}
+	depth := float64(atomic.LoadInt32(&w.waiting)) + float64(cap(w.slots))
+	return time.Duration(depth / float64(cap(w.slots)) * float64(latency))
+}
+
+// refuseOverload answers the request m from a, which found the worker pool
+// saturated, with 5.03 Service Unavailable and a Max-Age of the seconds
+// after which the queue should have drained, so that devices back off
+// instead of retransmitting into a saturated proxy.  Non-confirmable
+// requests are dropped.
+func (p *proxyHandler) refuseOverload(l transport, a *net.UDPAddr, m *coap.Message) {
+	p.metrics().Counter(metricOverloadedRequests, 1, nil)
+	p.logAccess("%v: proxy overloaded, request %v refused", a, m.MessageID)
+	if !m.IsConfirmable() {
+		return
+	}
+	coapResp := p.errorResponse(m, coap.ServiceUnavailable, "overloaded")
+	if coapResp == nil {
+		return
+	}
+	coapResp.SetOption(coap.MaxAge, uint32(math.Max(1, math.Ceil(p.workers.retryAfter().Seconds()))))
+	p.clients.failed(a)
+	p.sendResponse(l, a, coapResp)
+}
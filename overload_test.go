@@ -0,0 +1,72 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, MaxConcurrentRequests: 1, RequestQueueSize: 1})
+	tr := &fakeTransport{}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	send := func(typ coap.COAPType, mid uint16) {
+		m := coap.Message{Type: typ, Code: coap.GET, MessageID: mid, Token: []byte{byte(mid)}}
+		m.SetPathString("/slow")
+		packet, _ := m.MarshalBinary()
+		p.handlePacket(tr, client, packet)
+	}
+	sent := func() []*coap.Message {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		return append([]*coap.Message(nil), tr.sent...)
+	}
+
+	done := make(chan bool)
+	for mid := uint16(1); mid <= 2; mid++ {
+		mid := mid
+		go func() {
+			send(coap.Confirmable, mid)
+			done <- true
+		}()
+	}
+	for atomic.LoadInt32(&p.workers.waiting) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	send(coap.NonConfirmable, 3)
+	if s := sent(); len(s) != 0 {
+		t.Errorf("responses to an overloading non-confirmable request are %v", s)
+	}
+	send(coap.Confirmable, 4)
+	if s := sent(); len(s) != 1 || s[0].Code != coap.ServiceUnavailable || s[0].MessageID != 4 || s[0].Option(coap.MaxAge) != uint32(2) {
+		t.Errorf("responses to an overloading confirmable request are %v", s)
+	}
+
+	close(release)
+	<-done
+	<-done
+	if s := sent(); len(s) != 3 || s[1].Code != coap.Content || s[2].Code != coap.Content {
+		t.Errorf("responses to the requests handled and queued are %v", s)
+	}
+}
+
+func TestWorkerPoolRetryAfter(t *testing.T) {
+	w := (&proxyHandler{Proxy: Proxy{MaxConcurrentRequests: 2, RequestQueueSize: 10}}).newWorkerPool()
+	w.acquire()
+	w.release(time.Now().Add(-3 * time.Second))
+	w.waiting = 4
+	if d := w.retryAfter(); d < 8*time.Second || d > 10*time.Second {
+		t.Errorf("retry after is %v", d)
+	}
+}
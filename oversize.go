@@ -0,0 +1,138 @@
+package crosscoap
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-coap"
+)
+
+// OversizePolicy is what the proxy does with a response whose payload
+// doesn't fit in a CoAP packet.
+type OversizePolicy int
+
+const (
+	// TruncateOversize truncates the payload to fit in the packet.
+	TruncateOversize OversizePolicy = iota
+	// Block2Oversize serves the response with Block2 (RFC 7959).
+	Block2Oversize
+	// CompressOversize compresses JSON payloads to Content-Format 11050
+	// (JSON with deflate coding) if the request has no Accept option, and
+	// truncates payloads which still don't fit.
+	CompressOversize
+	// RejectOversize answers with 4.13 Request Entity Too Large carrying
+	// the size of the payload in a Size2 option, so that the client asks
+	// again with Block2; requests which already carry a Block2 option are
+	// served with Block2.
+	RejectOversize
+)
+
+var oversizePolicyNames = []string{"truncate", "block2", "compress", "reject"}
+
+func (o OversizePolicy) String() string {
+	if o >= 0 && int(o) < len(oversizePolicyNames) {
+		return oversizePolicyNames[o]
+	}
+	return fmt.Sprintf("OversizePolicy(%d)", int(o))
+}
+
+// ParseOversizePolicy returns the policy named s: truncate, block2,
+// compress or reject.
+func ParseOversizePolicy(s string) (OversizePolicy, error) {
+	for i, name := range oversizePolicyNames {
+		if s == name {
+			return OversizePolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid oversize policy %q", s)
+}
+
+// RouteOversizePolicy is the oversize policy of responses to requests whose
+// path lies below PathPrefix (matched on whole path segments).
+type RouteOversizePolicy struct {
+	PathPrefix string
+	Policy     OversizePolicy
+}
+
+// metricOversizeResponses counts the responses which don't fit in a packet,
+// labeled by outcome: truncated, block2, compressed (to fit in the packet)
+// or rejected.
+const metricOversizeResponses = "oversize_responses"
+
+// oversizePolicy returns the policy of the responses to m: that of the
+// first matching route setting one, else OversizePolicy, which StreamBlock2
+// turns to Block2Oversize.
+func (p *proxyHandler) oversizePolicy(m *coap.Message) OversizePolicy {
+	if r := p.routeOverride(m, func(r *routeOverride) bool { return r.Oversize != nil }); r != nil {
+		return *r.Oversize
+	}
+	if p.OversizePolicy == TruncateOversize && p.StreamBlock2 {
+		return Block2Oversize
+	}
+	return p.OversizePolicy
+}
+
+// servesBlock2 reports whether some responses may be served with Block2.
+func (p *proxyHandler) servesBlock2() bool {
+	usesBlock2 := func(policy OversizePolicy) bool {
+		return policy == Block2Oversize || policy == RejectOversize
+	}
+	if p.StreamBlock2 || usesBlock2(p.OversizePolicy) {
+		return true
+	}
+	for _, route := range p.allRoutes() {
+		if route.Oversize != nil && usesBlock2(*route.Oversize) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCompressor returns the translator of the responses under
+// CompressOversize, which the admin API may give to a route at runtime.
+func (p *proxyHandler) newCompressor() *Translator {
+	compressor := *p.translator
+	compressor.DeflateJSON = true
+	return &compressor
+}
+
+// responseTranslator returns the translator of the responses under the
+// policy.
+func (p *proxyHandler) responseTranslator(policy OversizePolicy) *Translator {
+	if policy == CompressOversize {
+		return p.compressor
+	}
+	return p.translator
+}
+
+// handleOversize applies the policy to coapResp, the response to the
+// request m with options in the exchange rc, whose payload doesn't fit in a
+// packet.  The payload is followed by rest, if it isn't nil, and is size
+// bytes long in all (-1 if unknown).
+func (p *proxyHandler) handleOversize(rc *RequestContext, m *coap.Message, options []rawOption, coapResp *translatedCOAPMessage, rest io.ReadCloser, size int64, policy OversizePolicy) *translatedCOAPMessage {
+	_, asked := findOption(options, optionBlock2)
+	if policy == Block2Oversize || (policy == RejectOversize && asked) {
+		p.metrics().Counter(metricOversizeResponses, 1, Labels{"outcome": "block2"})
+		coapResp.oversize = "block2"
+		return p.startDownload(rc.Client, m, options, coapResp, rest, size)
+	}
+	if rest != nil {
+		rest.Close()
+	}
+	if policy == RejectOversize {
+		p.metrics().Counter(metricOversizeResponses, 1, Labels{"outcome": "rejected"})
+		p.logError("CoAP response of %v bytes rejected as too large (Request-ID=%v)", len(coapResp.untruncated), rc.RequestID)
+		rejected := p.errorResponse(m, coap.RequestEntityTooLarge, "response too large, use Block2")
+		if rejected != nil {
+			rejected.oversize = "rejected"
+			if size >= 0 {
+				rejected.ExtraOptions = append(rejected.ExtraOptions, uintOption(optionSize2, uint32(size)))
+			}
+		}
+		return rejected
+	}
+	p.metrics().Counter(metricOversizeResponses, 1, Labels{"outcome": "truncated"})
+	coapResp.oversize = "truncated"
+	p.logError("CoAP payload truncated from %v bytes to %v bytes (Request-ID=%v)", len(coapResp.untruncated), len(coapResp.Payload), rc.RequestID)
+	return coapResp
+}
@@ -0,0 +1,89 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestOversizePolicies(t *testing.T) {
+	large := append(append([]byte("["), bytes.Repeat([]byte(`{"reading":12.5},`), 200)...), "{}]"...)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(large)
+	}))
+	defer backend.Close()
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{
+		BackendURL:     backend.URL,
+		OversizePolicy: RejectOversize,
+		RouteOversizePolicies: []RouteOversizePolicy{
+			{PathPrefix: "/truncated", Policy: TruncateOversize},
+			{PathPrefix: "/blocks", Policy: Block2Oversize},
+			{PathPrefix: "/compressed", Policy: CompressOversize},
+		},
+		Metrics: metrics,
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	request := func(path string, options ...rawOption) *translatedCOAPMessage {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte{1, 2}}
+		m.SetPathString(path)
+		return p.handleRequest(a, m, options)
+	}
+
+	if coapResp := request("/truncated"); !coapResp.IsTruncated || coapResp.Code != coap.Content {
+		t.Errorf("truncated response is %v (truncated %v)", coapResp.Code, coapResp.IsTruncated)
+	}
+	coapResp := request("/blocks")
+	if value, found := findOption(coapResp.ExtraOptions, optionBlock2); !found || coapResp.IsTruncated {
+		t.Errorf("Block2 response has no Block2 option")
+	} else if block, _ := parseBlockOption(value); block.Num != 0 || !block.More {
+		t.Errorf("Block2 option is %+v", block)
+	}
+	coapResp = request("/compressed")
+	if coapResp.IsTruncated || coapResp.Option(coap.ContentFormat) != appJSONDeflate {
+		t.Errorf("compressed response has Content-Format %v (truncated %v)", coapResp.Option(coap.ContentFormat), coapResp.IsTruncated)
+	}
+	coapResp = request("/rejected")
+	if size, found := findOption(coapResp.ExtraOptions, optionSize2); coapResp.Code != coap.RequestEntityTooLarge || !found || !bytes.Equal(size, uintOption(optionSize2, uint32(len(large))).Value) {
+		t.Errorf("rejected response is %v with options %v", coapResp.Code, coapResp.ExtraOptions)
+	}
+	coapResp = request("/rejected", blockOption{SZX: 4}.option(optionBlock2))
+	if value, found := findOption(coapResp.ExtraOptions, optionBlock2); coapResp.Code != coap.Content || !found {
+		t.Errorf("response asked with Block2 is %v with options %v", coapResp.Code, coapResp.ExtraOptions)
+	} else if block, _ := parseBlockOption(value); len(coapResp.Payload) != 256 || !block.More {
+		t.Errorf("first block is %+v of %v bytes", block, len(coapResp.Payload))
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	for _, line := range []string{
+		`crosscoap_oversize_responses_total{outcome="truncated"} 1`,
+		`crosscoap_oversize_responses_total{outcome="block2"} 2`,
+		`crosscoap_oversize_responses_total{outcome="compressed"} 1`,
+		`crosscoap_oversize_responses_total{outcome="rejected"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack '%v': %v", line, w.Body)
+		}
+	}
+}
+
+func TestStreamBlock2IsBlock2Oversize(t *testing.T) {
+	m := &coap.Message{}
+	m.SetPathString("/a")
+	if policy := newProxyHandler(&Proxy{StreamBlock2: true}).oversizePolicy(m); policy != Block2Oversize {
+		t.Errorf("policy with StreamBlock2 is %v", policy)
+	}
+	p := newProxyHandler(&Proxy{StreamBlock2: true, RouteOversizePolicies: []RouteOversizePolicy{{PathPrefix: "/a", Policy: TruncateOversize}}})
+	if policy := p.oversizePolicy(m); policy != TruncateOversize {
+		t.Errorf("policy of a route with StreamBlock2 is %v", policy)
+	}
+	if policy, err := ParseOversizePolicy("compress"); err != nil || policy != CompressOversize || policy.String() != "compress" {
+		t.Errorf("parsed policy is %v (error %v)", policy, err)
+	}
+}
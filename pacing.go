@@ -0,0 +1,118 @@
+package crosscoap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultPacingQueueSize is the number of messages queued for a client
+// endpoint under pacing, if PacingQueueSize is zero.
+const defaultPacingQueueSize = 16
+
+// metricPacingDrops counts the messages dropped because the pacing queue of
+// their client endpoint was full.
+const metricPacingDrops = "pacing_drops"
+
+var errPacingQueueFull = errors.New("pacing queue full")
+
+// pacedMessage is a message waiting in a pacing queue.
+type pacedMessage struct {
+	t       transport
+	a       *net.UDPAddr
+	message []byte
+}
+
+// pacer sends the messages to each client endpoint from a queue, at most
+// one per interval.  The goroutine draining the queue of an endpoint ends
+// once the queue is empty.
+type pacer struct {
+	interval  time.Duration
+	queueSize int
+	metrics   Metrics
+	logError  func(format string, args ...interface{})
+
+	mu     sync.Mutex
+	queues map[string]chan pacedMessage
+}
+
+// newPacer returns the pacer of the responses, or nil if PacingRate isn't
+// positive.
+func (p *proxyHandler) newPacer() *pacer {
+	if p.PacingRate <= 0 {
+		return nil
+	}
+	queueSize := p.PacingQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultPacingQueueSize
+	}
+	return &pacer{
+		interval:  time.Duration(float64(time.Second) / p.PacingRate),
+		queueSize: queueSize,
+		metrics:   p.metrics(),
+		logError:  p.logError,
+		queues:    make(map[string]chan pacedMessage),
+	}
+}
+
+// send queues a copy of message to be sent to a through t, reporting
+// whether there was room for it.
+func (pc *pacer) send(t transport, a *net.UDPAddr, message []byte) bool {
+	key := a.String()
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	queue := pc.queues[key]
+	if queue == nil {
+		queue = make(chan pacedMessage, pc.queueSize)
+		pc.queues[key] = queue
+		go pc.drain(key, queue)
+	}
+	select {
+	case queue <- pacedMessage{t, a, append([]byte(nil), message...)}:
+		return true
+	default:
+		pc.metrics.Counter(metricPacingDrops, 1, nil)
+		return false
+	}
+}
+
+// drain sends the messages of the queue of the endpoint key, waiting for
+// the interval after each of them.
+func (pc *pacer) drain(key string, queue chan pacedMessage) {
+	for {
+		pm := <-queue
+		if err := pm.t.SendMessage(pm.a, pm.message); err != nil {
+			pc.logError("Error sending CoAP message to %v: %v", pm.a, err)
+		}
+		time.Sleep(pc.interval)
+		pc.mu.Lock()
+		if len(queue) == 0 {
+			delete(pc.queues, key)
+			pc.mu.Unlock()
+			return
+		}
+		pc.mu.Unlock()
+	}
+}
+
+// pacedTransport sends the messages of its transport through a pacer.
+type pacedTransport struct {
+	transport
+	pacer *pacer
+}
+
+func (t *pacedTransport) SendMessage(a *net.UDPAddr, message []byte) error {
+	if !t.pacer.send(t.transport, a, message) {
+		return errPacingQueueFull
+	}
+	return nil
+}
+
+// paced returns t, paced if PacingRate is set.
+func (p *proxyHandler) paced(t transport) transport {
+	if p.pacer == nil {
+		return t
+	}
+	return &pacedTransport{transport: t, pacer: p.pacer}
+}
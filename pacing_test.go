@@ -0,0 +1,55 @@
+package crosscoap
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTransport records when messages are sent.
+type recordingTransport struct {
+	transport
+	mu   sync.Mutex
+	sent []time.Time
+}
+
+func (t *recordingTransport) SendMessage(a *net.UDPAddr, message []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, time.Now())
+	return nil
+}
+
+func TestPacing(t *testing.T) {
+	p := newProxyHandler(&Proxy{BackendURL: "http://127.0.0.1:1", PacingRate: 20, PacingQueueSize: 3})
+	recorder := &recordingTransport{}
+	paced := p.paced(recorder)
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5683}
+	queued := 0
+	for i := 0; i < 6; i++ {
+		if err := paced.SendMessage(a, []byte{byte(i)}); err == nil {
+			queued++
+		} else if err != errPacingQueueFull {
+			t.Errorf("message %v: error %v", i, err)
+		}
+	}
+	// The first message may have left the queue before the others came
+	if queued != 3 && queued != 4 {
+		t.Errorf("%v messages queued", queued)
+	}
+	if err := paced.SendMessage(other, []byte{0}); err != nil {
+		t.Errorf("message to another endpoint: error %v", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.sent) != queued+1 {
+		t.Fatalf("%v messages sent", len(recorder.sent))
+	}
+	if spread := recorder.sent[len(recorder.sent)-1].Sub(recorder.sent[0]); spread < 100*time.Millisecond {
+		t.Errorf("messages sent within %v", spread)
+	}
+}
@@ -0,0 +1,45 @@
+package crosscoap
+
+import (
+	"bytes"
+	"compress/zlib"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity beyond which buffers aren't returned to
+// their pool, so that an occasional large payload doesn't stay allocated.
+const maxPooledBufferSize = 64 * 1024
+
+// Buffers reused across requests to reduce the garbage produced by the hot
+// path.
+var (
+	// packetBuffers holds *[]byte of maxCOAPPacketLen bytes, in which
+	// packets are read and encoded.
+	packetBuffers = sync.Pool{New: func() interface{} {
+		b := make([]byte, maxCOAPPacketLen)
+		return &b
+	}}
+	scratchBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	zlibWriters    = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+func getPacketBuffer() *[]byte {
+	return packetBuffers.Get().(*[]byte)
+}
+
+func putPacketBuffer(b *[]byte) {
+	packetBuffers.Put(b)
+}
+
+// getScratchBuffer returns an empty buffer from the pool.
+func getScratchBuffer() *bytes.Buffer {
+	buf := scratchBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putScratchBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		scratchBuffers.Put(buf)
+	}
+}
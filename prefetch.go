@@ -0,0 +1,137 @@
+package crosscoap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// metricPrefetches counts the backend requests prefetching the Prefetch
+// resources into the cache, labeled by outcome: cached or error.
+const metricPrefetches = "prefetches"
+
+// prefetchRetry is how long until a prefetch is tried again after it
+// failed or its response couldn't be cached.
+const prefetchRetry = time.Minute
+
+// prefetchRefresh is the share of the freshness of a prefetched response
+// after which it's refreshed, ahead of its expiry.
+const prefetchRefresh = 0.9
+
+// minPrefetchDelay is the shortest time between two prefetches of a
+// resource.
+const minPrefetchDelay = time.Second
+
+type cacheRefreshKey struct{}
+
+// withCacheRefresh returns req, which is sent to the backend even if a
+// fresh response to it is cached, and whose response is then cached.
+func withCacheRefresh(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheRefreshKey{}, true))
+}
+
+// refreshesCache reports whether req refreshes the cache.
+func refreshesCache(req *http.Request) bool {
+	refresh, _ := req.Context().Value(cacheRefreshKey{}).(bool)
+	return refresh
+}
+
+// prefetchRequest returns the GET request of a Prefetch resource, a path
+// with an optional query such as /config?model=a.
+func prefetchRequest(resource string) (*coap.Message, error) {
+	m := &coap.Message{Type: coap.NonConfirmable, Code: coap.GET}
+	if err := SetPath(m, resource); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// prefetch keeps the Prefetch resources in the cache until done is closed.
+func (p *proxyHandler) prefetch(done <-chan struct{}) {
+	if p.cache == nil || len(p.Prefetch) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, resource := range p.Prefetch {
+		wg.Add(1)
+		go func(resource string) {
+			defer wg.Done()
+			p.prefetchResource(resource, done)
+		}(resource)
+	}
+	wg.Wait()
+}
+
+// prefetchResource fetches resource into the cache right away, then again
+// shortly before it expires, until done is closed or it can't be cached.
+func (p *proxyHandler) prefetchResource(resource string, done <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+		delay, err := p.refreshResource(resource)
+		if err != nil {
+			p.logError("Error prefetching %v, giving up: %v", resource, err)
+			return
+		}
+		timer.Reset(delay)
+	}
+}
+
+// refreshResource fetches the response to resource from the backend into
+// the cache, and returns the time until it should be fetched again, or an
+// error if its requests can't be cached.
+func (p *proxyHandler) refreshResource(resource string) (time.Duration, error) {
+	m, err := prefetchRequest(resource)
+	if err != nil {
+		return 0, err
+	}
+	req, err := p.translator.translateCOAPRequestToHTTPRequest(m)
+	if err != nil {
+		return 0, err
+	}
+	requestID := p.translator.requestID(nil, nil)
+	rc := &RequestContext{Received: time.Now(), RequestID: requestID}
+	req = req.WithContext(context.WithValue(req.Context(), requestContextKey{}, rc))
+	if err := p.prepareBackendRequest(req, m, nil, requestID, nil); err != nil {
+		return 0, err
+	}
+	req = withCacheRefresh(withCachePolicy(req, p.cachePolicy(m)))
+	if !cacheable(req) {
+		return 0, fmt.Errorf("its backend request can't be cached")
+	}
+	metrics := p.metrics()
+	httpResp, _, _, err := p.sendHTTPRequest(req, p.requestTimeout(m), -1)
+	var failure interface{}
+	var ttl time.Duration
+	switch {
+	case err != nil:
+		failure = err
+	case httpResp.StatusCode >= 400 || isStale(httpResp.Header):
+		failure = httpResp.Status
+	default:
+		if ttl = p.cache.routeFreshness(req, httpResp); ttl <= 0 {
+			failure = "response not cacheable"
+		}
+	}
+	if failure != nil {
+		metrics.Counter(metricPrefetches, 1, Labels{"outcome": "error"})
+		p.logError("Error prefetching %v, retrying in %v: %v (Request-ID=%v)", resource, prefetchRetry, failure, requestID)
+		return prefetchRetry, nil
+	}
+	metrics.Counter(metricPrefetches, 1, Labels{"outcome": "cached"})
+	p.logAccess("Prefetched %v (%v, fresh for %v, Request-ID=%v)", resource, httpResp.Status, ttl, requestID)
+	delay := time.Duration(float64(ttl) * prefetchRefresh)
+	if delay < minPrefetchDelay {
+		delay = minPrefetchDelay
+	}
+	return delay, nil
+}
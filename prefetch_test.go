@@ -0,0 +1,84 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestPrefetch(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.RequestURI()]++
+		mu.Unlock()
+		if r.URL.Path == "/api/broken" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=100")
+		w.Write([]byte("config"))
+	}))
+	defer backend.Close()
+	count := func(uri string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[uri]
+	}
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{
+		BackendURL:   backend.URL + "/api",
+		CacheMaxSize: 1 << 20,
+		Prefetch:     []string{"/config?model=a"},
+		Metrics:      metrics,
+	})
+
+	done := make(chan struct{})
+	go p.prefetch(done)
+	for i := 0; i < 100 && count("/api/config?model=a") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	time.Sleep(10 * time.Millisecond)
+	m, _ := prefetchRequest("/config?model=a")
+	m.Type, m.MessageID = coap.Confirmable, 1
+	coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}, m, nil, nil)
+	if coapResp == nil || string(coapResp.Payload) != "config" || count("/api/config?model=a") != 1 {
+		t.Errorf("response is %v after %v backend requests", coapResp, count("/api/config?model=a"))
+	}
+
+	// A refresh goes to the backend although the response is fresh
+	delay, err := p.refreshResource("/config?model=a")
+	if err != nil || delay != 90*time.Second || count("/api/config?model=a") != 2 {
+		t.Errorf("refresh delay is %v (error %v) after %v backend requests", delay, err, count("/api/config?model=a"))
+	}
+	if delay, err := p.refreshResource("/broken"); err != nil || delay != prefetchRetry {
+		t.Errorf("failed prefetch delay is %v (error %v)", delay, err)
+	}
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	if body := w.Body.String(); !strings.Contains(body, `crosscoap_prefetches_total{outcome="cached"} 2`) || !strings.Contains(body, `crosscoap_prefetches_total{outcome="error"} 1`) {
+		t.Errorf("metrics are %v", body)
+	}
+
+	p = newProxyHandler(&Proxy{
+		BackendURL:     backend.URL + "/api",
+		CacheMaxSize:   1 << 20,
+		DefaultHeaders: http.Header{"Authorization": {"Bearer x"}},
+	})
+	if _, err := p.refreshResource("/config"); err == nil {
+		t.Errorf("prefetch of an uncacheable request succeeded")
+	}
+	if _, err := p.refreshResource("/config/../admin"); err == nil {
+		t.Errorf("prefetch of a path with a dot segment succeeded")
+	}
+	if m, err := prefetchRequest("/"); err != nil || m.PathString() != "" {
+		t.Errorf("root prefetch request is %v (error %v)", m, err)
+	}
+}
@@ -0,0 +1,168 @@
+package crosscoap
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultPrometheusBuckets are the upper bounds of the histogram buckets,
+// those of the Prometheus client libraries (suited to durations in
+// seconds).
+var defaultPrometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics keeps the measurements in memory and serves them to
+// Prometheus in its text exposition format, with metric names prefixed by
+// the namespace and counter names suffixed by _total.  The admin API serves
+// it at /metrics when it is the proxy's Metrics.
+type PrometheusMetrics struct {
+	namespace string
+	mu        sync.Mutex
+	families  map[string]*prometheusFamily
+}
+
+type prometheusFamily struct {
+	kind   string // counter, gauge or histogram
+	series map[string]*prometheusSeries
+}
+
+// prometheusSeries is a series, by its formatted labels; a histogram keeps
+// the count of each bucket (not cumulated), the sum in value, and the count
+// of observations.
+type prometheusSeries struct {
+	labels  Labels
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// NewPrometheusMetrics returns Prometheus metrics in namespace (e.g.
+// "crosscoap"), or without namespace if empty.
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{namespace: namespace, families: make(map[string]*prometheusFamily)}
+}
+
+func (m *PrometheusMetrics) Counter(name string, delta float64, labels Labels) {
+	m.update(name+"_total", "counter", labels, func(s *prometheusSeries) { s.value += delta })
+}
+
+func (m *PrometheusMetrics) Gauge(name string, value float64, labels Labels) {
+	m.update(name, "gauge", labels, func(s *prometheusSeries) { s.value = value })
+}
+
+func (m *PrometheusMetrics) Histogram(name string, value float64, labels Labels) {
+	m.update(name, "histogram", labels, func(s *prometheusSeries) {
+		if s.buckets == nil {
+			s.buckets = make([]uint64, len(defaultPrometheusBuckets))
+		}
+		if i := sort.SearchFloat64s(defaultPrometheusBuckets, value); i < len(s.buckets) {
+			s.buckets[i]++
+		}
+		s.value += value
+		s.count++
+	})
+}
+
+func (m *PrometheusMetrics) update(name, kind string, labels Labels, update func(s *prometheusSeries)) {
+	if m.namespace != "" {
+		name = m.namespace + "_" + name
+	}
+	key := formatPrometheusLabels(labels, "")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family := m.families[name]
+	if family == nil {
+		family = &prometheusFamily{kind: kind, series: make(map[string]*prometheusSeries)}
+		m.families[name] = family
+	} else if family.kind != kind {
+		// A name can only be used by one kind of metric
+		return
+	}
+	series := family.series[key]
+	if series == nil {
+		copied := make(Labels, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		series = &prometheusSeries{labels: copied}
+		family.series[key] = series
+	}
+	update(series)
+}
+
+// formatPrometheusLabels formats labels, sorted by name, and the le label
+// of a histogram bucket if not empty, as {name="value",...}.
+func formatPrometheusLabels(labels Labels, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		pairs = append(pairs, name+`="`+escapePrometheusLabel(labels[name])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePrometheusLabel(value string) string {
+	return prometheusLabelEscaper.Replace(value)
+}
+
+func formatPrometheusValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(out, "# TYPE %v %v\n", name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(out, "%v%v %v\n", name, key, formatPrometheusValue(series.value))
+				continue
+			}
+			var cumulated uint64
+			for i, bound := range defaultPrometheusBuckets {
+				cumulated += series.buckets[i]
+				fmt.Fprintf(out, "%v_bucket%v %v\n", name, formatPrometheusLabels(series.labels, formatPrometheusValue(bound)), cumulated)
+			}
+			fmt.Fprintf(out, "%v_bucket%v %v\n", name, formatPrometheusLabels(series.labels, "+Inf"), series.count)
+			fmt.Fprintf(out, "%v_sum%v %v\n", name, key, formatPrometheusValue(series.value))
+			fmt.Fprintf(out, "%v_count%v %v\n", name, key, series.count)
+		}
+	}
+}
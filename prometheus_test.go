@@ -0,0 +1,68 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics("test")
+	m.Counter("hits", 1, Labels{"code": "2.05", "path": `a"b`})
+	m.Counter("hits", 2, Labels{"path": `a"b`, "code": "2.05"})
+	m.Gauge("level", 3, nil)
+	m.Gauge("level", 1.5, nil)
+	m.Histogram("duration_seconds", 0.02, nil)
+	m.Histogram("duration_seconds", 20, nil)
+	m.Gauge("duration_seconds", 1, nil) // another kind, dropped
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`# TYPE test_hits_total counter`,
+		`test_hits_total{code="2.05",path="a\"b"} 3`,
+		`# TYPE test_level gauge`,
+		`test_level 1.5`,
+		`# TYPE test_duration_seconds histogram`,
+		`test_duration_seconds_bucket{le="0.01"} 0`,
+		`test_duration_seconds_bucket{le="0.025"} 1`,
+		`test_duration_seconds_bucket{le="10"} 1`,
+		`test_duration_seconds_bucket{le="+Inf"} 2`,
+		`test_duration_seconds_sum 20.02`,
+		`test_duration_seconds_count 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack '%v': %v", line, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), "test_duration_seconds 1") {
+		t.Errorf("metrics have a gauge of a histogram's name: %v", w.Body)
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, Metrics: metrics})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	m.SetPathString("/a")
+	p.handleRequest(a, m, nil)
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	for _, line := range []string{
+		`crosscoap_requests_total 1`,
+		`crosscoap_responses_total{code="2.05"} 1`,
+		`crosscoap_requests_in_flight 0`,
+		`crosscoap_request_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack '%v': %v", line, w.Body)
+		}
+	}
+}
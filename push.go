@@ -0,0 +1,161 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-coap"
+)
+
+// pushRequest is a request to a device in the push API.  Payload is text,
+// and PayloadBase64 binary.
+type pushRequest struct {
+	Device        string `json:"device"`
+	Method        string `json:"method"`
+	Path          string `json:"path"` // with an optional ?query
+	Payload       string `json:"payload,omitempty"`
+	PayloadBase64 []byte `json:"payloadBase64,omitempty"`
+	ContentFormat *int   `json:"contentFormat,omitempty"`
+	Queue         bool   `json:"queue,omitempty"` // without trying to send it first
+}
+
+var pushMethods = map[string]coap.COAPCode{
+	"GET":    coap.GET,
+	"POST":   coap.POST,
+	"PUT":    coap.PUT,
+	"DELETE": coap.DELETE,
+}
+
+// message returns the CoAP request of r, without message ID and token.
+func (r *pushRequest) message() (*coap.Message, error) {
+	code, ok := pushMethods[strings.ToUpper(r.Method)]
+	if !ok {
+		return nil, fmt.Errorf("invalid method %q", r.Method)
+	}
+	m := &coap.Message{Code: code, Payload: []byte(r.Payload)}
+	if r.PayloadBase64 != nil {
+		m.Payload = r.PayloadBase64
+	}
+	if path := strings.SplitN(r.Path, "?", 2)[0]; strings.Trim(path, "/") == "" {
+		return nil, fmt.Errorf("empty path %q", r.Path)
+	}
+	if err := SetPath(m, r.Path); err != nil {
+		return nil, err
+	}
+	if r.ContentFormat != nil {
+		if *r.ContentFormat < 0 || *r.ContentFormat > 0xffff {
+			return nil, fmt.Errorf("invalid content format %v", *r.ContentFormat)
+		}
+		m.SetOption(coap.ContentFormat, coap.MediaType(*r.ContentFormat))
+	}
+	return m, nil
+}
+
+// pushResponse is the response of a device in the push API, with a text
+// Payload or else a binary PayloadBase64.
+type pushResponse struct {
+	Code          string `json:"code"`
+	Payload       string `json:"payload,omitempty"`
+	PayloadBase64 []byte `json:"payloadBase64,omitempty"`
+	ContentFormat *int   `json:"contentFormat,omitempty"`
+}
+
+func newPushResponse(m *coap.Message) *pushResponse {
+	resp := &pushResponse{Code: codeString(m.Code)}
+	if utf8.Valid(m.Payload) {
+		resp.Payload = string(m.Payload)
+	} else {
+		resp.PayloadBase64 = m.Payload
+	}
+	if format, ok := m.Option(coap.ContentFormat).(coap.MediaType); ok {
+		value := int(format)
+		resp.ContentFormat = &value
+	}
+	return resp
+}
+
+// servePush sends the CoAP request in the body of r to a device, given by
+// its ID in the device registry or by its endpoint, and answers with the
+// device's response; if the device doesn't acknowledge the request, and
+// QueueSize is set, the request is queued until the device next contacts
+// the proxy.
+func (p *proxyHandler) servePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var push pushRequest
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	device, a := p.pushEndpoint(push.Device)
+	if a == nil {
+		writeJSONError(w, http.StatusNotFound, "unknown device "+push.Device)
+		return
+	}
+	m, err := push.message()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if push.Queue {
+		if p.queues == nil {
+			writeJSONError(w, http.StatusBadRequest, "queue mode is disabled")
+			return
+		}
+		p.queuePush(w, device, m)
+		return
+	}
+	l := p.transportFor(a)
+	if l == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no CoAP listener")
+		return
+	}
+	request := *m
+	resp, err := p.sendRequest(l, a, &request)
+	switch {
+	case err == errNoAcknowledgement && p.queues != nil:
+		p.queuePush(w, device, m)
+		return
+	case err == errNoAcknowledgement || err == errNoResponse:
+		writeJSONError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	p.logAccess("Admin API: CoAP %v /%v pushed to %v: %v", m.Code, m.PathString(), a, codeString(resp.Code))
+	writeJSON(w, http.StatusOK, newPushResponse(resp))
+}
+
+// pushEndpoint returns the endpoint of device, given by its ID in the
+// device registry or by its endpoint, and the key of its queue, or nil if
+// it's unknown.  The queue of a device known by ID follows it across
+// endpoints.
+func (p *proxyHandler) pushEndpoint(device string) (string, *net.UDPAddr) {
+	if a := p.devices.endpoint(device); a != nil {
+		return device, a
+	}
+	a, err := net.ResolveUDPAddr("udp", device)
+	if err != nil || a.IP == nil {
+		return "", nil
+	}
+	return a.String(), a
+}
+
+// queuePush queues m for device, answering 202 Accepted.
+func (p *proxyHandler) queuePush(w http.ResponseWriter, device string, m *coap.Message) {
+	queued, err := p.queues.enqueue(device, m, time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	p.logAccess("Admin API: CoAP %v /%v queued for %v", m.Code, m.PathString(), device)
+	writeJSON(w, http.StatusAccepted, map[string]int{"queued": queued})
+}
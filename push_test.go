@@ -0,0 +1,62 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestPushAPI(t *testing.T) {
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	p := newProxyHandler(&Proxy{Listener: server, AckTimeout: 50 * time.Millisecond, MaxRetransmit: -1})
+	admin := p.adminHandler("secret")
+
+	// The device answers the first request
+	go func() {
+		buf := make([]byte, maxCOAPPacketLen)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			return
+		}
+		m, err := coap.ParseMessage(buf[:n])
+		if err != nil || m.Code != coap.GET || m.PathString() != "sensors/temp" || len(m.Options(coap.URIQuery)) != 1 {
+			return
+		}
+		ack := coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: m.MessageID, Token: m.Token, Payload: []byte("21.5")}
+		ack.SetOption(coap.ContentFormat, coap.TextPlain)
+		packet, _ := ack.MarshalBinary()
+		p.handlePacket(p.transportOf(server), clientAddr, packet)
+	}()
+	body := `{"device": "` + clientAddr.String() + `", "method": "GET", "path": "/sensors/temp?unit=C"}`
+	w := adminRequest(admin, "POST", "/push", "secret", body)
+	var resp pushResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || resp.Code != "2.05" || resp.Payload != "21.5" || resp.ContentFormat == nil || *resp.ContentFormat != 0 {
+		t.Errorf("push response is %v: %v", w.Code, w.Body)
+	}
+
+	// But not the second one
+	if w := adminRequest(admin, "POST", "/push", "secret", body); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("push to an unreachable device response is %v: %v", w.Code, w.Body)
+	}
+
+	if w := adminRequest(admin, "POST", "/push", "secret", `{"device": "nowhere", "method": "GET", "path": "/"}`); w.Code != http.StatusNotFound {
+		t.Errorf("push to an unknown device response is %v", w.Code)
+	}
+	if w := adminRequest(admin, "POST", "/push", "secret", `{"device": "`+clientAddr.String()+`", "method": "PATCH", "path": "/"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("push with an invalid method response is %v", w.Code)
+	}
+	for _, path := range []string{"/", "", "//?a=1", "/a/../b"} {
+		if w := adminRequest(admin, "POST", "/push", "secret", `{"device": "`+clientAddr.String()+`", "method": "GET", "path": "`+path+`"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("push to path %q response is %v", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package crosscoap
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// pushObserveLinger is how long the observation of a device resource is
+// kept once its last HTTP subscriber is gone, so that a long-poll client
+// polling again finds it, before it's cancelled.
+const pushObserveLinger = 30 * time.Second
+
+// defaultLongPollWait is how long a long-poll request waits for a
+// notification, unless it gives ?wait=DURATION.
+const defaultLongPollWait = 30 * time.Second
+
+// pushNotificationQueue is the number of notifications from a device kept
+// until they are handled.
+const pushNotificationQueue = 16
+
+// metricPushObservations is the number of device resources observed for
+// the HTTP subscribers of the push API.
+const metricPushObservations = "push_observations"
+
+// pushObservation is a CoAP Observe registration (RFC 7641) of the proxy
+// with a device resource, shared by the HTTP clients subscribed to it.
+type pushObservation struct {
+	key   string // of the device and the request
+	token transactionKey
+	stop  chan struct{}
+
+	// Guarded by pushObservations.mu
+	last        *coap.Message // the latest notification
+	seq         uint64        // of the latest notification, from 1
+	observe     uint32        // Observe option of the latest notification
+	received    time.Time
+	updated     chan struct{} // closed on the next notification
+	done        bool          // no more notifications will come
+	err         error         // why the registration failed
+	subscribers int
+	idle        *time.Timer
+}
+
+// pushObservations tracks the observations of the push API, by device and
+// request.
+type pushObservations struct {
+	mu           sync.Mutex
+	observations map[string]*pushObservation
+}
+
+func newPushObservations() *pushObservations {
+	return &pushObservations{observations: make(map[string]*pushObservation)}
+}
+
+func (po *pushObservations) count() int {
+	po.mu.Lock()
+	defer po.mu.Unlock()
+	return len(po.observations)
+}
+
+// newerNotification reports whether a notification with the Observe value
+// v2 received at t2 is newer than the one with v1 received at t1 (RFC 7641
+// section 3.4).
+func newerNotification(v1 uint32, t1 time.Time, v2 uint32, t2 time.Time) bool {
+	return (v1 < v2 && v2-v1 < 1<<23) || (v1 > v2 && v1-v2 > 1<<23) || t2.After(t1.Add(128*time.Second))
+}
+
+// subscribeObservation returns the observation of the request m by the
+// device at a, registering it with the device if there's none in progress.
+// It's ended with unsubscribeObservation.
+func (p *proxyHandler) subscribeObservation(l transport, a *net.UDPAddr, m *coap.Message) *pushObservation {
+	po := p.observations
+	key := fmt.Sprintf("%v /%v", a, m.PathString())
+	for _, q := range m.Options(coap.URIQuery) {
+		key += fmt.Sprintf("&%v", q)
+	}
+	po.mu.Lock()
+	defer po.mu.Unlock()
+	if o := po.observations[key]; o != nil && !o.done {
+		o.subscribers++
+		if o.idle != nil {
+			o.idle.Stop()
+			o.idle = nil
+		}
+		return o
+	}
+	token := make([]byte, 4)
+	rand.Read(token)
+	o := &pushObservation{
+		key:         key,
+		token:       tokenKey(a, token),
+		stop:        make(chan struct{}),
+		updated:     make(chan struct{}),
+		subscribers: 1,
+	}
+	po.observations[key] = o
+	p.metrics().Gauge(metricPushObservations, float64(len(po.observations)), nil)
+	request := *m
+	request.Token = token
+	request.SetOption(coap.Observe, uint32(observeRegister))
+	notifications := p.transactions.addQueue(p.transactions.responses, o.token, pushNotificationQueue)
+	go p.runObservation(l, a, o, &request, notifications)
+	return o
+}
+
+// unsubscribeObservation ends a subscription to o, cancelling o after
+// pushObserveLinger if it was the last one.
+func (p *proxyHandler) unsubscribeObservation(o *pushObservation) {
+	po := p.observations
+	po.mu.Lock()
+	defer po.mu.Unlock()
+	o.subscribers--
+	if o.subscribers > 0 || o.done {
+		return
+	}
+	o.idle = time.AfterFunc(pushObserveLinger, func() {
+		po.mu.Lock()
+		defer po.mu.Unlock()
+		if o.subscribers == 0 && !o.done {
+			p.endObservation(o, nil)
+		}
+	})
+}
+
+// endObservation marks o as done, failed with err if it isn't nil, and
+// forgets its token so that the device's next notification is rejected
+// with a Reset message, which cancels its registration (RFC 7641 section
+// 3.6).  The caller holds pushObservations.mu.
+func (p *proxyHandler) endObservation(o *pushObservation, err error) {
+	po := p.observations
+	o.done = true
+	o.err = err
+	close(o.updated)
+	close(o.stop)
+	if po.observations[o.key] == o {
+		delete(po.observations, o.key)
+		p.metrics().Gauge(metricPushObservations, float64(len(po.observations)), nil)
+	}
+	p.transactions.remove(p.transactions.responses, o.token)
+}
+
+// runObservation registers the request m with the device at a and hands
+// its notifications to o until o ends.
+func (p *proxyHandler) runObservation(l transport, a *net.UDPAddr, o *pushObservation, m *coap.Message, notifications chan *coap.Message) {
+	ack, err := p.sendConfirmable(l, a, m, nil)
+	if err == nil && ack.Code == 0 {
+		timer := time.NewTimer(p.timeout())
+		select {
+		case ack = <-notifications:
+		case <-timer.C:
+			err = errNoResponse
+		case <-o.stop:
+		}
+		timer.Stop()
+	}
+	po := p.observations
+	if err != nil {
+		p.logError("Error observing /%v on %v: %v", m.PathString(), a, err)
+		po.mu.Lock()
+		if !o.done {
+			p.endObservation(o, err)
+		}
+		po.mu.Unlock()
+		return
+	}
+	for n := ack; ; {
+		if n != nil && !p.notify(o, n) {
+			return
+		}
+		select {
+		case n = <-notifications:
+		case <-o.stop:
+			return
+		case <-p.life.aborted:
+			po.mu.Lock()
+			if !o.done {
+				p.endObservation(o, ErrProxyClosed)
+			}
+			po.mu.Unlock()
+			return
+		}
+	}
+}
+
+// notify hands the notification n to the subscribers of o, unless a newer
+// one came first, and reports whether more notifications follow: they
+// don't after an error response or a response without Observe option.
+func (p *proxyHandler) notify(o *pushObservation, n *coap.Message) bool {
+	po := p.observations
+	po.mu.Lock()
+	defer po.mu.Unlock()
+	if o.done {
+		return false
+	}
+	now := time.Now()
+	value, observing := n.Option(coap.Observe).(uint32)
+	if observing && o.last != nil && !newerNotification(o.observe, o.received, value, now) {
+		return true
+	}
+	o.last, o.observe, o.received = n, value, now
+	o.seq++
+	if !observing || !isSuccess(n.Code) {
+		p.endObservation(o, nil)
+		return false
+	}
+	close(o.updated)
+	o.updated = make(chan struct{})
+	return true
+}
+
+// next returns the first notification of o after the sequence number seq,
+// with its own, or else the channel closed on the next notification; done
+// tells whether no more notifications will come.
+func (po *pushObservations) next(o *pushObservation, seq uint64) (*coap.Message, uint64, <-chan struct{}, bool) {
+	po.mu.Lock()
+	defer po.mu.Unlock()
+	if o.seq > seq {
+		return o.last, o.seq, nil, o.done
+	}
+	return nil, o.seq, o.updated, o.done
+}
+
+// observeNotification is a notification of a device in the push API,
+// Observing telling whether more of them will follow.
+type observeNotification struct {
+	Seq       uint64 `json:"seq"`
+	Observing bool   `json:"observing"`
+	*pushResponse
+}
+
+// serveObserve subscribes the HTTP client to the resource ?path=/a?b=c of
+// the device ?device=ID (or HOST:PORT), with a CoAP Observe registration
+// shared by all its subscribers.  If the client accepts text/event-stream,
+// the notifications are sent as server-sent events until either side ends
+// the observation; otherwise the request long-polls for the first
+// notification after ?since=SEQ, answering 204 No Content after ?wait
+// (default 30s).
+func (p *proxyHandler) serveObserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	_, a := p.pushEndpoint(query.Get("device"))
+	if a == nil {
+		writeJSONError(w, http.StatusNotFound, "unknown device "+query.Get("device"))
+		return
+	}
+	m, err := (&pushRequest{Method: "GET", Path: query.Get("path")}).message()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var since uint64
+	if s := query.Get("since"); s != "" {
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid since "+s)
+			return
+		}
+	}
+	wait := defaultLongPollWait
+	if s := query.Get("wait"); s != "" {
+		if wait, err = time.ParseDuration(s); err != nil || wait < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid wait "+s)
+			return
+		}
+	}
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	flusher, canFlush := w.(http.Flusher)
+	if stream && !canFlush {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	l := p.transportFor(a)
+	if l == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no CoAP listener")
+		return
+	}
+	o := p.subscribeObservation(l, a, m)
+	defer p.unsubscribeObservation(o)
+	p.logAccess("Admin API: observing /%v on %v", m.PathString(), a)
+
+	po := p.observations
+	var timeout <-chan time.Time
+	if !stream {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	streaming := false
+	for {
+		n, seq, updated, done := po.next(o, since)
+		if n != nil {
+			notification := &observeNotification{Seq: seq, Observing: !done, pushResponse: newPushResponse(n)}
+			if !stream {
+				writeJSON(w, http.StatusOK, notification)
+				return
+			}
+			if !streaming {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Header().Set("Cache-Control", "no-cache")
+				streaming = true
+			}
+			data, _ := json.Marshal(notification)
+			fmt.Fprintf(w, "id: %v\ndata: %s\n\n", seq, data)
+			flusher.Flush()
+			since = seq
+			continue
+		}
+		if done {
+			switch {
+			case streaming:
+			case o.err == nil:
+				writeJSONError(w, http.StatusGone, "observation ended")
+			case o.err == errNoAcknowledgement || o.err == errNoResponse:
+				writeJSONError(w, http.StatusGatewayTimeout, o.err.Error())
+			default:
+				writeJSONError(w, http.StatusBadGateway, o.err.Error())
+			}
+			return
+		}
+		select {
+		case <-updated:
+		case <-timeout:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// observedDevice plays a device answering Observe registrations on client:
+// /sse notifies twice and then ends the observation, /poll notifies once
+// more on each value sent on next.
+func observedDevice(p *proxyHandler, server, client *net.UDPConn, next chan string) {
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	notify := func(msgType coap.COAPType, mid uint16, token []byte, observe uint32, payload string) {
+		n := coap.Message{Type: msgType, Code: coap.Content, MessageID: mid, Token: token, Payload: []byte(payload)}
+		if observe > 0 {
+			n.SetOption(coap.Observe, observe)
+		}
+		packet, _ := n.MarshalBinary()
+		p.handlePacket(p.transportOf(server), clientAddr, packet)
+	}
+	buf := make([]byte, maxCOAPPacketLen)
+	for {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			return
+		}
+		m, err := coap.ParseMessage(buf[:n])
+		if err != nil || m.Code != coap.GET || m.Option(coap.Observe) != uint32(observeRegister) {
+			continue
+		}
+		notify(coap.Acknowledgement, m.MessageID, m.Token, 1, "21.5")
+		switch m.PathString() {
+		case "sse":
+			notify(coap.Confirmable, 1000, m.Token, 2, "22.0")
+			notify(coap.NonConfirmable, 1001, m.Token, 0, "bye")
+		case "poll":
+			go func(token []byte) {
+				observe := uint32(2)
+				for payload := range next {
+					notify(coap.Confirmable, 2000+uint16(observe), token, observe, payload)
+					observe++
+				}
+			}(m.Token)
+		}
+	}
+}
+
+func TestPushObserve(t *testing.T) {
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	device := client.LocalAddr().String()
+	p := newProxyHandler(&Proxy{Listener: server, AckTimeout: 50 * time.Millisecond, MaxRetransmit: -1})
+	admin := p.adminHandler("secret")
+	next := make(chan string)
+	defer close(next)
+	go observedDevice(p, server, client, next)
+
+	// Server-sent events until the device ends the observation
+	r := httptest.NewRequest("GET", "/observe?device="+device+"&path=/sse", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("event stream response is %v: %v", w.Code, w.Header())
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "id: ") || !strings.Contains(body, `"observing":false,"code":"2.05","payload":"bye"`) {
+		t.Errorf("event stream is %v", body)
+	}
+
+	// Long polls
+	type notification struct {
+		Seq       uint64
+		Observing bool
+		Payload   string
+	}
+	poll := func(query string) (*httptest.ResponseRecorder, *notification) {
+		w := adminRequest(admin, "GET", "/observe?device="+device+"&path=/poll"+query, "secret", "")
+		var n notification
+		if w.Code == http.StatusOK {
+			json.Unmarshal(w.Body.Bytes(), &n)
+		}
+		return w, &n
+	}
+	if w, n := poll(""); w.Code != http.StatusOK || n.Seq != 1 || !n.Observing || n.Payload != "21.5" {
+		t.Errorf("first poll response is %v: %v", w.Code, w.Body)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		next <- "22.5"
+	}()
+	if w, n := poll("&since=1"); w.Code != http.StatusOK || n.Seq != 2 || n.Payload != "22.5" {
+		t.Errorf("second poll response is %v: %v", w.Code, w.Body)
+	}
+	if w, _ := poll("&since=2&wait=50ms"); w.Code != http.StatusNoContent {
+		t.Errorf("idle poll response is %v: %v", w.Code, w.Body)
+	}
+	if count := p.observations.count(); count != 1 {
+		t.Errorf("%v observations are kept", count)
+	}
+
+	if w := adminRequest(admin, "GET", "/observe?device=nowhere&path=/", "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("observe of an unknown device response is %v", w.Code)
+	}
+}
+
+func TestNewerNotification(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		v1, v2   uint32
+		t2       time.Time
+		expected bool
+	}{
+		{1, 2, now, true},
+		{2, 1, now, false},
+		{1<<24 - 1, 0, now, true},
+		{0, 1<<24 - 1, now, false},
+		{2, 1, now.Add(129 * time.Second), true},
+	} {
+		if newer := newerNotification(tt.v1, now, tt.v2, tt.t2); newer != tt.expected {
+			t.Errorf("%v then %v: newer is %v", tt.v1, tt.v2, newer)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package crosscoap
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// QueryAction is the change made by a query rule.
+type QueryAction int
+
+const (
+	// AddQuery adds the parameter Name=Value.
+	AddQuery QueryAction = iota
+	// RenameQuery renames the parameter Name to Value.
+	RenameQuery
+	// RemoveQuery removes the parameter Name.
+	RemoveQuery
+	// HeaderQuery moves the value of the parameter Name to the request
+	// header Value, for devices whose options can't afford the header.
+	HeaderQuery
+)
+
+// QueryRule changes the query parameters of requests before they are
+// forwarded to the backend, for example to add api_version=2, to rename a
+// device-side parameter to the backend's name, to drop a sensitive
+// parameter, or to pass fw=1.2.3 as the header X-Firmware-Version: 1.2.3.
+type QueryRule struct {
+	Action QueryAction
+
+	// Name is the parameter added, renamed or removed.
+	Name string
+
+	// Value is the value of an added parameter, the new name of a renamed
+	// parameter, or the header to which a parameter is moved.
+	Value string
+
+	// PathPrefix restricts the rule to the given path and everything below
+	// it, matched on whole path segments.  If empty, the rule applies to
+	// every path.
+	PathPrefix string
+}
+
+var queryActions = map[string]QueryAction{
+	"add":    AddQuery,
+	"rename": RenameQuery,
+	"remove": RemoveQuery,
+	"header": HeaderQuery,
+}
+
+// ParseQueryRule parses a query rule written as "add NAME=VALUE",
+// "rename NAME=NEW_NAME", "remove NAME" or "header NAME=HEADER", optionally
+// followed by a path prefix.
+func ParseQueryRule(s string) (QueryRule, error) {
+	var rule QueryRule
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("invalid query rule %q", s)
+	}
+	action, found := queryActions[fields[0]]
+	if !found {
+		return rule, fmt.Errorf("invalid query rule action in %q", s)
+	}
+	rule.Action = action
+	kv := strings.SplitN(fields[1], "=", 2)
+	rule.Name = kv[0]
+	if len(kv) == 2 {
+		rule.Value = kv[1]
+	}
+	if rule.Name == "" || (action == RemoveQuery) != (len(kv) == 1) || ((action == RenameQuery || action == HeaderQuery) && rule.Value == "") {
+		return rule, fmt.Errorf("invalid query rule %q", s)
+	}
+	if len(fields) == 3 {
+		rule.PathPrefix = fields[2]
+	}
+	return rule, nil
+}
+
+// apply returns the queries ("name=value" or "name") changed by the rule,
+// adding the values of the parameters moved to a header to header.
+func (r *QueryRule) apply(queries []string, header http.Header) []string {
+	if r.Action == AddQuery {
+		return append(queries, r.Name+"="+r.Value)
+	}
+	var changed []string
+	for _, query := range queries {
+		kv := strings.SplitN(query, "=", 2)
+		switch {
+		case kv[0] != r.Name:
+			changed = append(changed, query)
+		case r.Action == RenameQuery:
+			kv[0] = r.Value
+			changed = append(changed, strings.Join(kv, "="))
+		case r.Action == HeaderQuery:
+			kv = append(kv, "")
+			header.Add(r.Value, kv[1])
+		}
+	}
+	return changed
+}
+
+// requestQueries returns the Uri-Query options of a CoAP request after
+// applying the query rules.
+func (t *Translator) requestQueries(coapMsg *coap.Message) []string {
+	queries, _ := t.applyQueryRules(coapMsg)
+	return queries
+}
+
+// applyQueryRules returns the Uri-Query options of a CoAP request after
+// applying the query rules, and the headers to which parameters were moved.
+func (t *Translator) applyQueryRules(coapMsg *coap.Message) ([]string, http.Header) {
+	var queries []string
+	header := http.Header{}
+	for _, option := range coapMsg.Options(coap.URIQuery) {
+		if query, ok := option.(string); ok {
+			queries = append(queries, query)
+		}
+	}
+	for i := range t.QueryRules {
+		rule := &t.QueryRules[i]
+		if hasPathPrefix(coapMsg.PathString(), rule.PathPrefix) {
+			queries = rule.apply(queries, header)
+		}
+	}
+	return queries, header
+}
+
+// validHeaderValue reports whether s may be sent as a header value: CoAP
+// strings may hold control characters which HTTP forbids.
+func validHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package crosscoap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestRequestQueries(t *testing.T) {
+	var rules []QueryRule
+	for _, s := range []string{"add api_version=2", "rename dev=device_id /sensors", "remove key"} {
+		rule, err := ParseQueryRule(s)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", s, err)
+		}
+		rules = append(rules, rule)
+	}
+	translator := Translator{QueryRules: rules}
+	for _, tt := range []struct {
+		path     string
+		queries  []string
+		expected []string
+	}{
+		{"/sensors/temp", []string{"dev=42", "key=secret", "raw"}, []string{"device_id=42", "raw", "api_version=2"}},
+		{"/status", []string{"dev=42", "key"}, []string{"dev=42", "api_version=2"}},
+	} {
+		coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		coapMsg.SetPathString(tt.path)
+		coapMsg.SetOption(coap.URIQuery, tt.queries)
+		if queries := translator.requestQueries(&coapMsg); !reflect.DeepEqual(queries, tt.expected) {
+			t.Errorf("%v: queries is '%v'", tt.path, queries)
+		}
+	}
+}
+
+func TestParseInvalidQueryRule(t *testing.T) {
+	for _, s := range []string{"add api_version", "rename dev", "rename dev=", "remove key=x", "drop key", "add", "header fw", "header fw="} {
+		if _, err := ParseQueryRule(s); err == nil {
+			t.Errorf("%v: expected an error", s)
+		}
+	}
+}
+
+func TestQueryHeaders(t *testing.T) {
+	var rules []QueryRule
+	for _, s := range []string{"header fw=X-Firmware-Version", "rename m=model", "header model=X-Model /sensors"} {
+		rule, err := ParseQueryRule(s)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", s, err)
+		}
+		rules = append(rules, rule)
+	}
+	translator := Translator{BackendURL: "http://backend/", QueryRules: rules}
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	coapMsg.SetPathString("/sensors/temp")
+	coapMsg.SetOption(coap.URIQuery, []string{"fw=1.2.3", "m=t1000", "unit=c"})
+	req, err := translator.TranslateRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating request: %v", err)
+	}
+	if req.URL.String() != "http://backend/sensors/temp?unit=c" {
+		t.Errorf("URL is '%v'", req.URL)
+	}
+	if req.Header.Get("X-Firmware-Version") != "1.2.3" || req.Header.Get("X-Model") != "t1000" {
+		t.Errorf("headers are '%v'", req.Header)
+	}
+
+	coapMsg.SetOption(coap.URIQuery, []string{"fw=1.2\r\nX-Admin: 1"})
+	if _, err := translator.TranslateRequest(&coapMsg); err == nil || err.(*TranslationError).Code != coap.BadRequest {
+		t.Errorf("error is '%v'", err)
+	}
+}
@@ -0,0 +1,187 @@
+package crosscoap
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// defaultQueueTTL is the time after which a queued request which couldn't
+// be delivered is dropped.
+const defaultQueueTTL = 24 * time.Hour
+
+var errQueueFull = errors.New("queue of the device is full")
+
+func (p *Proxy) queueTTL() time.Duration {
+	if p.QueueTTL > 0 {
+		return p.QueueTTL
+	}
+	return defaultQueueTTL
+}
+
+type queuedRequest struct {
+	request *coap.Message
+	expires time.Time
+}
+
+type deviceQueue struct {
+	requests   []queuedRequest
+	delivering bool
+}
+
+// deviceQueues are the mailboxes of sleepy devices, by UDP endpoint, whose
+// requests are delivered when the device next contacts the proxy.
+type deviceQueues struct {
+	mu     sync.Mutex
+	queues map[string]*deviceQueue
+	size   int
+	ttl    time.Duration
+}
+
+// newDeviceQueues returns the device queues of p, or nil if queue mode is
+// disabled.
+func (p *proxyHandler) newDeviceQueues() *deviceQueues {
+	if p.QueueSize <= 0 {
+		return nil
+	}
+	return &deviceQueues{queues: make(map[string]*deviceQueue), size: p.QueueSize, ttl: p.queueTTL()}
+}
+
+// expire drops the expired requests, and the empty queues, at now.
+func (qs *deviceQueues) expire(now time.Time) {
+	for device, q := range qs.queues {
+		kept := q.requests[:0]
+		for _, r := range q.requests {
+			if now.Before(r.expires) {
+				kept = append(kept, r)
+			}
+		}
+		q.requests = kept
+		if len(kept) == 0 && !q.delivering {
+			delete(qs.queues, device)
+		}
+	}
+}
+
+// enqueue queues m for device, returning the number of requests queued for
+// it.
+func (qs *deviceQueues) enqueue(device string, m *coap.Message, now time.Time) (int, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.expire(now)
+	q := qs.queues[device]
+	if q == nil {
+		q = &deviceQueue{}
+		qs.queues[device] = q
+	}
+	if len(q.requests) >= qs.size {
+		return len(q.requests), errQueueFull
+	}
+	q.requests = append(q.requests, queuedRequest{m, now.Add(qs.ttl)})
+	return len(q.requests), nil
+}
+
+// startDelivery marks the queue of device as being delivered, returning
+// false if it is empty or already being delivered.
+func (qs *deviceQueues) startDelivery(device string) bool {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q := qs.queues[device]
+	if q == nil || q.delivering || len(q.requests) == 0 {
+		return false
+	}
+	q.delivering = true
+	return true
+}
+
+// next removes the next unexpired request of device, or ends the delivery
+// and returns nil.
+func (qs *deviceQueues) next(device string, now time.Time) *queuedRequest {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q := qs.queues[device]
+	for len(q.requests) > 0 {
+		r := q.requests[0]
+		q.requests = q.requests[1:]
+		if now.Before(r.expires) {
+			return &r
+		}
+	}
+	q.delivering = false
+	delete(qs.queues, device)
+	return nil
+}
+
+// requeue puts back r at the head of the queue of device, and ends the
+// delivery.
+func (qs *deviceQueues) requeue(device string, r *queuedRequest) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q := qs.queues[device]
+	q.requests = append([]queuedRequest{*r}, q.requests...)
+	q.delivering = false
+}
+
+// queuedDevice is the queue of a device in the admin API.
+type queuedDevice struct {
+	Device   string `json:"device"`
+	Requests int    `json:"requests"`
+}
+
+func (qs *deviceQueues) snapshot() []queuedDevice {
+	devices := []queuedDevice{}
+	if qs == nil {
+		return devices
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.expire(time.Now())
+	for device, q := range qs.queues {
+		if len(q.requests) > 0 {
+			devices = append(devices, queuedDevice{device, len(q.requests)})
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+	return devices
+}
+
+// deliverQueued sends the requests queued for the client at a, by endpoint
+// or by the IDs registered for it, which has just contacted the proxy on l,
+// one at a time in the background.  A request which the client doesn't
+// acknowledge is queued again, for its next contact.
+func (p *proxyHandler) deliverQueued(l transport, a *net.UDPAddr) {
+	if p.queues == nil {
+		return
+	}
+	for _, device := range append([]string{a.String()}, p.devices.devicesAt(a)...) {
+		if p.queues.startDelivery(device) {
+			go p.deliverQueue(l, a, device)
+		}
+	}
+}
+
+func (p *proxyHandler) deliverQueue(l transport, a *net.UDPAddr, device string) {
+	for {
+		r := p.queues.next(device, time.Now())
+		if r == nil {
+			return
+		}
+		m := r.request
+		request := *m
+		resp, err := p.sendRequest(l, a, &request)
+		switch {
+		case err == errNoAcknowledgement:
+			p.logAccess("%v: Queued CoAP %v /%v not acknowledged, queued again", a, m.Code, m.PathString())
+			p.queues.requeue(device, r)
+			return
+		case err != nil:
+			p.logError("Error delivering queued CoAP %v /%v to %v: %v", m.Code, m.PathString(), a, err)
+		default:
+			p.logAccess("%v: Queued CoAP %v /%v delivered: %v", a, m.Code, m.PathString(), codeString(resp.Code))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestQueueMode(t *testing.T) {
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	p := newProxyHandler(&Proxy{QueueSize: 1, AckTimeout: 20 * time.Millisecond, MaxRetransmit: -1})
+	admin := p.adminHandler("secret")
+
+	body := `{"device": "` + clientAddr.String() + `", "method": "PUT", "path": "/config?a=b", "payload": "x", "contentFormat": 0, "queue": true}`
+	if w := adminRequest(admin, "POST", "/push", "secret", body); w.Code != http.StatusAccepted {
+		t.Fatalf("push response is %v: %v", w.Code, w.Body)
+	}
+	if w := adminRequest(admin, "POST", "/push", "secret", body); w.Code != http.StatusTooManyRequests {
+		t.Errorf("push to a full queue response is %v: %v", w.Code, w.Body)
+	}
+	if w := adminRequest(admin, "GET", "/queue", "secret", ""); w.Body.String() != `[{"device":"`+clientAddr.String()+`","requests":1}]`+"\n" {
+		t.Errorf("queue is %v", w.Body)
+	}
+
+	receive := func() *coap.Message {
+		buf := make([]byte, maxCOAPPacketLen)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := coap.ParseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &m
+	}
+	send := func(m *coap.Message) {
+		packet, _ := m.MarshalBinary()
+		p.handlePacket(p.transportOf(server), clientAddr, packet)
+	}
+
+	// The device doesn't acknowledge the request the first time
+	send(&coap.Message{Type: coap.Confirmable, MessageID: 1})
+	if m := receive(); m.Type != coap.Reset {
+		t.Errorf("ping response is '%v'", m)
+	}
+	if m := receive(); m.Code != coap.PUT || m.PathString() != "config" || string(m.Payload) != "x" {
+		t.Errorf("queued request is '%v'", m)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if queue := p.queues.snapshot(); len(queue) != 1 || queue[0].Requests != 1 {
+		t.Fatalf("queue after no acknowledgement is '%v'", queue)
+	}
+
+	send(&coap.Message{Type: coap.Confirmable, MessageID: 2})
+	receive()
+	m := receive()
+	send(&coap.Message{Type: coap.Acknowledgement, Code: coap.Changed, MessageID: m.MessageID, Token: m.Token})
+	for i := 0; i < 100 && len(p.queues.snapshot()) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queue := p.queues.snapshot(); len(queue) != 0 {
+		t.Errorf("queue after delivery is '%v'", queue)
+	}
+}
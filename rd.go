@@ -0,0 +1,164 @@
+package crosscoap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// ResourceDirectory configures the registration of the proxy with a CoRE
+// Resource Directory (RFC 9176), so that devices can find the gateway and
+// the resources it exposes (the proxy's DiscoveryLinks).
+type ResourceDirectory struct {
+	// Addr is the UDP address of the resource directory (example:
+	// "rd.example.com:5683").
+	Addr string
+
+	// Path is the path of the registration interface.  If empty, "rd" is
+	// used.
+	Path string
+
+	// Endpoint is the endpoint name under which the proxy registers.
+	Endpoint string
+
+	// Sector is the optional sector of the endpoint.
+	Sector string
+
+	// BaseURI is the optional base URI of the registered links.  If empty,
+	// the resource directory uses the source address of the registration,
+	// which is the proxy's listener.
+	BaseURI string
+
+	// Lifetime of the registration, which the proxy refreshes shortly
+	// before it expires.  If zero, the RFC 9176 default of 25 hours is
+	// used.
+	Lifetime time.Duration
+}
+
+const (
+	defaultRDPath     = "rd"
+	defaultRDLifetime = 90000 * time.Second
+	rdRetryDelay      = time.Minute
+)
+
+var errRegistrationNotFound = errors.New("registration not found")
+
+func (rd *ResourceDirectory) path() string {
+	if rd.Path != "" {
+		return rd.Path
+	}
+	return defaultRDPath
+}
+
+func (rd *ResourceDirectory) lifetime() time.Duration {
+	if rd.Lifetime > 0 {
+		return rd.Lifetime
+	}
+	return defaultRDLifetime
+}
+
+// lifetimeQuery returns the lt query of the lifetime in seconds.
+func (rd *ResourceDirectory) lifetimeQuery() string {
+	seconds := int(rd.lifetime() / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return fmt.Sprintf("lt=%d", seconds)
+}
+
+// maintainRegistration registers the proxy with its resource directory and
+// keeps the registration fresh, until done is closed.
+func (p *proxyHandler) maintainRegistration(l transport, done <-chan struct{}) {
+	rd := p.ResourceDirectory
+	addr, err := net.ResolveUDPAddr("udp", rd.Addr)
+	if err != nil {
+		p.logError("Error resolving resource directory address: %v", err)
+		return
+	}
+	location := ""
+	for {
+		if location == "" {
+			location, err = p.register(l, addr)
+		} else if err = p.updateRegistration(l, addr, location); err == errRegistrationNotFound {
+			// The registration expired or was removed; register again
+			location, err = p.register(l, addr)
+		}
+		wait := rd.lifetime() - rd.lifetime()/10
+		if err != nil {
+			p.logError("Error registering with resource directory %v: %v", rd.Addr, err)
+			if wait > rdRetryDelay {
+				wait = rdRetryDelay
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// register registers the proxy's DiscoveryLinks, and returns the location
+// of the registration resource.
+func (p *proxyHandler) register(l transport, addr *net.UDPAddr) (string, error) {
+	rd := p.ResourceDirectory
+	links := make([]map[string]interface{}, len(p.DiscoveryLinks))
+	for i := range p.DiscoveryLinks {
+		links[i] = p.DiscoveryLinks[i].linkFormatJSON()
+	}
+	payload, err := writeLinkFormat(links)
+	if err != nil {
+		return "", err
+	}
+	req := coap.Message{Code: coap.POST, Payload: payload}
+	req.SetPathString(rd.path())
+	req.AddOption(coap.URIQuery, "ep="+rd.Endpoint)
+	if rd.Sector != "" {
+		req.AddOption(coap.URIQuery, "d="+rd.Sector)
+	}
+	if rd.BaseURI != "" {
+		req.AddOption(coap.URIQuery, "base="+rd.BaseURI)
+	}
+	req.AddOption(coap.URIQuery, rd.lifetimeQuery())
+	req.SetOption(coap.ContentFormat, coap.AppLinkFormat)
+	resp, err := p.sendRequest(l, addr, &req)
+	if err != nil {
+		return "", err
+	}
+	if resp.Code != coap.Created {
+		return "", fmt.Errorf("registration failed with %v", resp.Code)
+	}
+	var location []string
+	for _, segment := range resp.Options(coap.LocationPath) {
+		location = append(location, segment.(string))
+	}
+	if len(location) == 0 {
+		return "", errors.New("registration response without Location-Path")
+	}
+	p.logAccess("Registered with resource directory %v at /%v", rd.Addr, strings.Join(location, "/"))
+	return strings.Join(location, "/"), nil
+}
+
+// updateRegistration refreshes the registration resource at location.
+func (p *proxyHandler) updateRegistration(l transport, addr *net.UDPAddr, location string) error {
+	req := coap.Message{Code: coap.POST}
+	req.SetPathString(location)
+	req.AddOption(coap.URIQuery, p.ResourceDirectory.lifetimeQuery())
+	resp, err := p.sendRequest(l, addr, &req)
+	if err != nil {
+		return err
+	}
+	switch resp.Code {
+	case coap.Changed:
+		return nil
+	case coap.NotFound:
+		return errRegistrationNotFound
+	}
+	return fmt.Errorf("registration update failed with %v", resp.Code)
+}
@@ -0,0 +1,82 @@
+package crosscoap
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestResourceDirectoryRegistration(t *testing.T) {
+	rdListener, rdAddr := createLocalUDPListener(t)
+	defer rdListener.Close()
+	udpListener, _ := createLocalUDPListener(t)
+	defer udpListener.Close()
+	proxy := Proxy{
+		Listener:       udpListener,
+		BackendURL:     "http://127.0.0.1:1/",
+		DiscoveryLinks: []Link{{Target: "/sensors/temp", Params: map[string]string{"rt": "temperature"}}},
+		ResourceDirectory: &ResourceDirectory{
+			Addr:     rdAddr,
+			Endpoint: "gateway1",
+			Lifetime: time.Second,
+		},
+	}
+	go proxy.Serve()
+
+	receive := func() (*coap.Message, *net.UDPAddr) {
+		rdListener.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, maxCOAPPacketLen)
+		n, from, err := rdListener.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Error receiving request: %v", err)
+		}
+		m, err := coap.ParseMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("Error parsing request: %v", err)
+		}
+		return &m, from
+	}
+	respond := func(req *coap.Message, from *net.UDPAddr, code coap.COAPCode, location string) {
+		resp := coap.Message{Type: coap.Acknowledgement, Code: code, MessageID: req.MessageID, Token: req.Token}
+		if location != "" {
+			resp.SetOption(coap.LocationPath, []string{"rd", location})
+		}
+		data, err := resp.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Error marshalling response: %v", err)
+		}
+		if _, err := rdListener.WriteToUDP(data, from); err != nil {
+			t.Fatalf("Error sending response: %v", err)
+		}
+	}
+
+	req, from := receive()
+	if from.String() != udpListener.LocalAddr().String() {
+		t.Errorf("registration sent from '%v'", from)
+	}
+	if req.Code != coap.POST || req.PathString() != "rd" {
+		t.Errorf("got %v %v", req.Code, req.PathString())
+	}
+	if queries := req.Options(coap.URIQuery); !reflect.DeepEqual(queries, []interface{}{"ep=gateway1", "lt=1"}) {
+		t.Errorf("queries is '%v'", queries)
+	}
+	if string(req.Payload) != `</sensors/temp>;rt="temperature"` {
+		t.Errorf("req.Payload is '%s'", req.Payload)
+	}
+	respond(req, from, coap.Created, "42")
+
+	req, from = receive()
+	if req.Code != coap.POST || req.PathString() != "rd/42" || len(req.Payload) != 0 {
+		t.Errorf("got %v %v '%s'", req.Code, req.PathString(), req.Payload)
+	}
+	respond(req, from, coap.NotFound, "")
+
+	req, from = receive()
+	if req.Code != coap.POST || req.PathString() != "rd" {
+		t.Errorf("got %v %v after the registration was lost", req.Code, req.PathString())
+	}
+	respond(req, from, coap.Created, "43")
+}
@@ -0,0 +1,275 @@
+package crosscoap
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-coap"
+)
+
+// harNameValue is a header or query parameter of a HAR entry.
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harEntry is a recorded exchange: an entry of a HAR 1.2 log, with the CoAP
+// messages in hex as custom fields.
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // in milliseconds
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Client          string      `json:"_client"`
+	RequestID       string      `json:"_requestID"`
+	COAPRequest     string      `json:"_coapRequest"`
+	COAPResponse    string      `json:"_coapResponse,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+// harLog is the HAR document served by the admin API.
+type harLog struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []*harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// redactedHeaders are the headers whose values aren't recorded or logged.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Amz-Security-Token"}
+
+// exchangeRecorder keeps the most recent exchanges with the backend in a
+// ring buffer, and writes them to a log.
+type exchangeRecorder struct {
+	mu       sync.Mutex
+	entries  []*harEntry
+	next     int
+	full     bool
+	log      io.Writer
+	redacted map[string]bool
+	logError func(format string, args ...interface{})
+}
+
+// newExchangeRecorder returns the recorder of p, or nil if p doesn't record
+// exchanges.
+func (p *proxyHandler) newExchangeRecorder() *exchangeRecorder {
+	if p.RecordExchanges <= 0 && p.ExchangeLog == nil {
+		return nil
+	}
+	r := &exchangeRecorder{
+		log:      p.ExchangeLog,
+		redacted: p.redactedHeaders(),
+		logError: p.logError,
+	}
+	if p.RecordExchanges > 0 {
+		r.entries = make([]*harEntry, p.RecordExchanges)
+	}
+	return r
+}
+
+// redactedHeaders returns the canonical names of the headers whose values
+// aren't recorded or logged: credentials, and DefaultHeaders.
+func (p *Proxy) redactedHeaders() map[string]bool {
+	redacted := make(map[string]bool)
+	for _, name := range redactedHeaders {
+		redacted[name] = true
+	}
+	for name := range p.DefaultHeaders {
+		redacted[http.CanonicalHeaderKey(name)] = true
+	}
+	return redacted
+}
+
+func (r *exchangeRecorder) headers(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if r.redacted[http.CanonicalHeaderKey(name)] {
+				value = "[redacted]"
+			}
+			headers = append(headers, harNameValue{name, value})
+		}
+	}
+	return headers
+}
+
+// harText returns the text of body in a HAR entry, and its encoding.
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// start returns the entry of the exchange of req, sent to the backend for
+// the CoAP request m from a.
+func (r *exchangeRecorder) start(a *net.UDPAddr, m *coap.Message, options []rawOption, req *http.Request, requestID string) *harEntry {
+	if r == nil {
+		return nil
+	}
+	e := &harEntry{
+		StartedDateTime: time.Now(),
+		Client:          a.String(),
+		RequestID:       requestID,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     r.headers(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	if req.Host != "" {
+		e.Request.Headers = append(e.Request.Headers, harNameValue{"Host", req.Host})
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{name, value})
+		}
+	}
+	if packet, err := marshalMessage(m, options); err == nil {
+		e.COAPRequest = hex.EncodeToString(packet)
+	}
+	// Streamed request bodies can't be read twice
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			body.Close()
+			e.Request.BodySize = len(data)
+			if len(data) > 0 {
+				e.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type")}
+				e.Request.PostData.Text, e.Request.PostData.Encoding = harText(data)
+			}
+		}
+	}
+	return e
+}
+
+// finish records e with the backend response (or err) and the CoAP response
+// to the client, and returns coapResp.
+func (r *exchangeRecorder) finish(e *harEntry, httpResp *http.Response, httpBody []byte, err error, coapResp *translatedCOAPMessage) *translatedCOAPMessage {
+	if r == nil {
+		return coapResp
+	}
+	e.Time = float64(time.Since(e.StartedDateTime)) / float64(time.Millisecond)
+	e.Timings.Wait = e.Time
+	e.Response = harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+	if httpResp != nil {
+		e.Response.Status = httpResp.StatusCode
+		e.Response.StatusText = http.StatusText(httpResp.StatusCode)
+		e.Response.HTTPVersion = httpResp.Proto
+		e.Response.Headers = r.headers(httpResp.Header)
+		e.Response.RedirectURL = httpResp.Header.Get("Location")
+		e.Response.BodySize = len(httpBody)
+		e.Response.Content = harContent{Size: len(httpBody), MimeType: httpResp.Header.Get("Content-Type")}
+		e.Response.Content.Text, e.Response.Content.Encoding = harText(httpBody)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if coapResp != nil {
+		if packet, err := marshalMessage(&coapResp.Message, coapResp.ExtraOptions); err == nil {
+			e.COAPResponse = hex.EncodeToString(packet)
+		}
+	}
+	r.record(e)
+	return coapResp
+}
+
+func (r *exchangeRecorder) record(e *harEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) > 0 {
+		r.entries[r.next] = e
+		r.next = (r.next + 1) % len(r.entries)
+		r.full = r.full || r.next == 0
+	}
+	if r.log != nil {
+		line, err := json.Marshal(e)
+		if err == nil {
+			_, err = r.log.Write(append(line, '\n'))
+		}
+		if err != nil {
+			r.logError("Error writing exchange log: %v (Request-ID=%v)", err, e.RequestID)
+		}
+	}
+}
+
+// harLog returns the recorded exchanges, oldest first.
+func (r *exchangeRecorder) harLog() *harLog {
+	l := &harLog{}
+	l.Log.Version = "1.2"
+	l.Log.Creator.Name = "crosscoap"
+	l.Log.Creator.Version = "1.0"
+	l.Log.Entries = []*harEntry{}
+	if r == nil {
+		return l
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		l.Log.Entries = append(l.Log.Entries, r.entries[r.next:]...)
+	}
+	l.Log.Entries = append(l.Log.Entries, r.entries[:r.next]...)
+	return l
+}
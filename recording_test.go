@@ -0,0 +1,73 @@
+package crosscoap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestExchangeRecording(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte{0xff, 0x00})
+	}))
+	defer backend.Close()
+	var exchangeLog bytes.Buffer
+	p := newProxyHandler(&Proxy{
+		BackendURL:      backend.URL,
+		RecordExchanges: 2,
+		ExchangeLog:     &exchangeLog,
+		DefaultHeaders:  http.Header{"X-Api-Key": {"secret"}},
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	for i, path := range []string{"/first", "/second", "/third"} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: uint16(i), Payload: []byte("payload")}
+		m.SetPathString(path)
+		m.SetOption(coap.URIQuery, "a=b")
+		p.handleRequest(a, m, nil)
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/exchanges", "secret", "")
+	if strings.Contains(w.Body.String(), `"secret"`) {
+		t.Errorf("exchanges show a secret: %v", w.Body)
+	}
+	var har harLog
+	if err := json.Unmarshal(w.Body.Bytes(), &har); err != nil || har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatalf("exchanges are '%v' (error %v)", w.Body, err)
+	}
+	e := har.Log.Entries[1]
+	if e.Request.Method != "POST" || e.Request.URL != backend.URL+"/third?a=b" || e.Request.PostData == nil || e.Request.PostData.Text != "payload" {
+		t.Errorf("request is '%+v'", e.Request)
+	}
+	if len(e.Request.QueryString) != 1 || e.Request.QueryString[0] != (harNameValue{"a", "b"}) {
+		t.Errorf("query string is '%v'", e.Request.QueryString)
+	}
+	if c := e.Response.Content; e.Response.Status != 200 || c.Size != 2 || c.Encoding != "base64" || c.Text != "/wA=" {
+		t.Errorf("response is '%+v'", e.Response)
+	}
+	if e.Client != a.String() || e.RequestID == "" {
+		t.Errorf("client is '%v' and request ID '%v'", e.Client, e.RequestID)
+	}
+	coapRequest, _ := hex.DecodeString(e.COAPRequest)
+	coapResponse, _ := hex.DecodeString(e.COAPResponse)
+	if m, _, err := parsePacket(coapRequest); err != nil || m.PathString() != "third" {
+		t.Errorf("CoAP request is '%v' (error %v)", e.COAPRequest, err)
+	}
+	if m, _, err := parsePacket(coapResponse); err != nil || m.Code != coap.Changed || !bytes.Equal(m.Payload, []byte{0xff, 0x00}) {
+		t.Errorf("CoAP response is '%v' (error %v)", e.COAPResponse, err)
+	}
+	if har.Log.Entries[0].Request.URL != backend.URL+"/second?a=b" {
+		t.Errorf("first exchange is of '%v'", har.Log.Entries[0].Request.URL)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(exchangeLog.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[0], "/first?a=b") {
+		t.Errorf("exchange log is '%v'", exchangeLog.String())
+	}
+}
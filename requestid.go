@@ -0,0 +1,45 @@
+package crosscoap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// requestIDHeader carries the ID of each exchange to the backend, so that a
+// device exchange can be traced across systems.
+const requestIDHeader = "X-Request-ID"
+
+// newRequestID returns an ID for the exchange with the given token: the token
+// in hex followed by a random (version 4) UUID.
+func newRequestID(token []byte) string {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		panic(err)
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+	if len(token) == 0 {
+		return id
+	}
+	return hex.EncodeToString(token) + "-" + id
+}
+
+// requestID reuses the request ID sent by the client in an option mapped to
+// the X-Request-ID header, or generates a new one.
+func (t *Translator) requestID(token []byte, options []rawOption) string {
+	for i := range t.OptionMappings {
+		mapping := &t.OptionMappings[i]
+		if http.CanonicalHeaderKey(mapping.Header) != http.CanonicalHeaderKey(requestIDHeader) {
+			continue
+		}
+		for _, o := range options {
+			if o.ID == mapping.Option && len(o.Value) > 0 {
+				return mapping.headerValue(o.Value)
+			}
+		}
+	}
+	return newRequestID(token)
+}
@@ -0,0 +1,29 @@
+package crosscoap
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewRequestID(t *testing.T) {
+	uuid := "[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}"
+	if id := newRequestID([]byte{0xca, 0xfe}); !regexp.MustCompile("^cafe-" + uuid + "$").MatchString(id) {
+		t.Errorf("newRequestID is '%v'", id)
+	}
+	if id := newRequestID(nil); !regexp.MustCompile("^" + uuid + "$").MatchString(id) {
+		t.Errorf("newRequestID without token is '%v'", id)
+	}
+	if newRequestID(nil) == newRequestID(nil) {
+		t.Error("Expected request IDs to be unique")
+	}
+}
+
+func TestRequestIDFromMappedOption(t *testing.T) {
+	tr := Translator{OptionMappings: []OptionMapping{{Option: 2049, Header: "x-request-id"}}}
+	if id := tr.requestID(nil, []rawOption{{ID: 2049, Value: []byte("device-42")}}); id != "device-42" {
+		t.Errorf("requestID is '%v'", id)
+	}
+	if id := tr.requestID(nil, nil); id == "" {
+		t.Error("Expected a generated request ID")
+	}
+}
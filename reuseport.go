@@ -0,0 +1,29 @@
+package crosscoap
+
+import (
+	"context"
+	"net"
+)
+
+// ListenReusePort returns n UDP listeners bound to the same address with
+// SO_REUSEPORT, so that the kernel spreads the incoming packets among them;
+// the first is to be used as a Proxy's Listener and the others as its
+// Listeners, each served by its own read loop.  If address has no port (or
+// port 0), all the listeners share the port chosen for the first one.
+func ListenReusePort(network, address string, n int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	var listeners []*net.UDPConn
+	for i := 0; i < n; i++ {
+		conn, err := lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		l := conn.(*net.UDPConn)
+		listeners = append(listeners, l)
+		address = l.LocalAddr().String()
+	}
+	return listeners, nil
+}
@@ -0,0 +1,23 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package crosscoap
+
+import (
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which package syscall lacks on some
+// architectures.
+const soReusePort = 0xf
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,43 @@
+package crosscoap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestListenReusePort(t *testing.T) {
+	listeners, err := ListenReusePort("udp4", "127.0.0.1:0", 3)
+	if err != nil {
+		t.Skipf("SO_REUSEPORT is unavailable: %v", err)
+	}
+	for _, l := range listeners {
+		defer l.Close()
+		if l.LocalAddr().String() != listeners[0].LocalAddr().String() {
+			t.Errorf("listener address is '%v'; expected '%v'", l.LocalAddr(), listeners[0].LocalAddr())
+		}
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	proxy := Proxy{Listener: listeners[0], Listeners: listeners[1:], BackendURL: backend.URL}
+	go proxy.Serve()
+
+	// Clients with different source ports are spread among the listeners
+	for i := 0; i < 10; i++ {
+		c, err := coap.Dial("udp", listeners[0].LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Error dialing: %v", err)
+		}
+		req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: uint16(i)}
+		req.SetPathString("/status")
+		rv, err := c.Send(req)
+		if err != nil || rv == nil || string(rv.Payload) != "ok" {
+			t.Errorf("response %v is '%v' (error %v)", i, rv, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package crosscoap
+
+import (
+	"net/http"
+	"time"
+)
+
+// metricDownloadRevalidations counts the revalidations of the cached
+// responses served with Block2, labeled by outcome: unchanged, changed or
+// error.
+const metricDownloadRevalidations = "download_revalidations"
+
+// revalidationPolicy makes the revalidation requests bypass the cache.
+var revalidationPolicy = &RouteCachePolicy{Bypass: true}
+
+// downloadRevalidation revalidates the cached response of a Block2
+// download with the backend once it goes stale, so that a device doesn't
+// fetch the rest of a representation which has changed.
+type downloadRevalidation struct {
+	req     *http.Request // the backend request of the download
+	etag    string
+	expires time.Time
+}
+
+// newDownloadRevalidation returns the revalidation of the download of
+// httpResp, the response to req, if it came from the cache with an ETag
+// and RevalidateDownloads is set, or nil.
+func (p *proxyHandler) newDownloadRevalidation(req *http.Request, httpResp *http.Response, cacheOutcome string, now time.Time) *downloadRevalidation {
+	if !p.RevalidateDownloads || cacheOutcome != "hit" || httpResp == nil {
+		return nil
+	}
+	etag := httpResp.Header.Get("ETag")
+	if etag == "" {
+		return nil
+	}
+	maxAge, _ := responseMaxAge(httpResp.Header)
+	return &downloadRevalidation{req: req, etag: etag, expires: now.Add(time.Duration(maxAge) * time.Second)}
+}
+
+// revalidate asks the backend whether the representation of the download
+// is still current once it's stale at now, with If-None-Match, freshening
+// the cached response if it is.  It reports false if the representation
+// changed; if the backend can't tell, the download goes on.
+func (p *proxyHandler) revalidate(rv *downloadRevalidation, now time.Time) bool {
+	if rv == nil || now.Before(rv.expires) {
+		return true
+	}
+	requestID := rv.req.Header.Get(requestIDHeader)
+	req := rv.req.Clone(rv.req.Context())
+	req.Header.Set("If-None-Match", rv.etag)
+	if err := p.signRequest(req, now); err != nil {
+		p.logError("Error signing revalidation HTTP request: %v (Request-ID=%v)", err, requestID)
+		return true
+	}
+	httpResp, _, rest, err := p.sendHTTPRequest(withCachePolicy(req, revalidationPolicy), p.timeout(), 0)
+	if rest != nil {
+		rest.Close()
+	}
+	metrics := p.metrics()
+	switch {
+	case err != nil || httpResp.StatusCode >= 500:
+		failure := interface{}(err)
+		if err == nil {
+			failure = httpResp.Status
+		}
+		metrics.Counter(metricDownloadRevalidations, 1, Labels{"outcome": "error"})
+		p.logError("Error revalidating Block2 download, serving it as cached: %v (Request-ID=%v)", failure, requestID)
+		return true
+	case httpResp.StatusCode == http.StatusNotModified || (httpResp.StatusCode/100 == 2 && httpResp.Header.Get("ETag") == rv.etag):
+		ttl := p.cache.freshen(rv.req, rv.etag, httpResp.Header, now)
+		rv.expires = now.Add(ttl)
+		metrics.Counter(metricDownloadRevalidations, 1, Labels{"outcome": "unchanged"})
+		return true
+	}
+	metrics.Counter(metricDownloadRevalidations, 1, Labels{"outcome": "changed"})
+	p.logError("Representation of Block2 download changed (%v), aborting it (Request-ID=%v)", httpResp.Status, requestID)
+	return false
+}
+
+// freshen extends the freshness of the cached response to req with the
+// etag, according to the headers of the backend response which validated
+// it at now (RFC 7234 section 4.3.4), and returns that freshness.
+func (c *responseCache) freshen(req *http.Request, etag string, header http.Header, now time.Time) time.Duration {
+	if c == nil {
+		return 0
+	}
+	ttl := c.routeFreshness(req, &http.Response{StatusCode: http.StatusOK, Header: header})
+	if ttl <= 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resource := cacheKey(req)
+	vary := defaultVary
+	if r := c.resources[resource]; r != nil {
+		vary = r.vary
+	}
+	if e := c.entries[variantKey(resource, req, vary)]; e != nil && e.header.Get("ETag") == etag {
+		e.expires = now.Add(ttl)
+	}
+	return ttl
+}
@@ -0,0 +1,71 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestRevalidateDownloads(t *testing.T) {
+	firmware := bytes.Repeat([]byte("0123456789abcdef"), 300)
+	etag := `"v1"`
+	var revalidations int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") != "" {
+			revalidations++
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write(firmware)
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, CacheMaxSize: 1 << 20, OversizePolicy: Block2Oversize, RevalidateDownloads: true})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	// The first download fills the cache
+	if payload := fetchBlocks(t, p, nil); !bytes.Equal(payload, firmware) {
+		t.Fatalf("payload is %v bytes long", len(payload))
+	}
+	// startStaleDownload starts a download from the cache, which goes stale
+	startStaleDownload := func() {
+		m, options := block2Request(1, nil)
+		if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != coap.Content || coapResp.cache != "hit" {
+			t.Fatalf("first block is '%v'", coapResp)
+		}
+		for _, e := range p.downloads.pending {
+			e.transfer.(*download).revalidation.expires = time.Now().Add(-time.Second)
+		}
+	}
+
+	startStaleDownload()
+	m, options := block2Request(2, &blockOption{Num: 1, SZX: 6})
+	if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("block of the unchanged download is '%v'", coapResp)
+	}
+	m, options = block2Request(3, &blockOption{Num: 2, SZX: 6})
+	if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != coap.Content {
+		t.Errorf("next block of the unchanged download is '%v'", coapResp)
+	}
+	if revalidations != 1 {
+		t.Errorf("backend got %v revalidations", revalidations)
+	}
+
+	startStaleDownload()
+	etag = `"v2"`
+	m, options = block2Request(4, &blockOption{Num: 1, SZX: 6})
+	if coapResp := p.handleRequest(a, m, options); coapResp == nil || coapResp.Code != codeRequestEntityIncomplete {
+		t.Errorf("block of the changed download is '%v'", coapResp)
+	}
+	if len(p.downloads.pending) != 0 {
+		t.Errorf("downloads are '%v'", p.downloads.pending)
+	}
+}
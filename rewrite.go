@@ -0,0 +1,65 @@
+package crosscoap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule rewrites the path of CoAP requests before the backend URL is
+// built.  The path starts with "/".  A rule either strips a prefix, or
+// replaces the matches of a regular expression.
+type RewriteRule struct {
+	// StripPrefix is a path prefix removed from matching paths (example:
+	// "/v1").  It only matches whole path segments.
+	StripPrefix string
+
+	// Pattern is a regular expression whose matches are replaced with
+	// Replacement, which may refer to submatches as $1 (see
+	// regexp.Regexp.ReplaceAllString).
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseRewriteRule parses a rewrite rule written as "strip PREFIX" or
+// "replace PATTERN REPLACEMENT".
+func ParseRewriteRule(s string) (RewriteRule, error) {
+	fields := strings.Fields(s)
+	switch {
+	case len(fields) == 2 && fields[0] == "strip":
+		return RewriteRule{StripPrefix: fields[1]}, nil
+	case len(fields) == 3 && fields[0] == "replace":
+		pattern, err := regexp.Compile(fields[1])
+		if err != nil {
+			return RewriteRule{}, fmt.Errorf("invalid pattern in rewrite rule %q: %v", s, err)
+		}
+		return RewriteRule{Pattern: pattern, Replacement: fields[2]}, nil
+	}
+	return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q", s)
+}
+
+func (r *RewriteRule) rewrite(path string) string {
+	if r.StripPrefix != "" {
+		prefix := strings.TrimSuffix(r.StripPrefix, "/")
+		if path == prefix {
+			return "/"
+		}
+		if strings.HasPrefix(path, prefix+"/") {
+			return strings.TrimPrefix(path, prefix)
+		}
+		return path
+	}
+	if r.Pattern != nil {
+		return r.Pattern.ReplaceAllString(path, r.Replacement)
+	}
+	return path
+}
+
+// rewritePath returns the request path (starting with "/") after applying
+// the rewrite rules in order, each to the result of the previous one.
+func (t *Translator) rewritePath(path string) string {
+	for i := range t.RewriteRules {
+		path = t.RewriteRules[i].rewrite(path)
+	}
+	return path
+}
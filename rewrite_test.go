@@ -0,0 +1,55 @@
+package crosscoap
+
+import (
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestRewritePath(t *testing.T) {
+	var rules []RewriteRule
+	for _, s := range []string{`strip /v1`, `replace ^/s/(\d+)/data$ /sensors/$1/measurements`} {
+		rule, err := ParseRewriteRule(s)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", s, err)
+		}
+		rules = append(rules, rule)
+	}
+	translator := Translator{RewriteRules: rules}
+	for _, tt := range []struct {
+		path     string
+		expected string
+	}{
+		{"/v1/s/12/data", "/sensors/12/measurements"},
+		{"/v1", "/"},
+		{"/v10/status", "/v10/status"},
+		{"/s/x/data", "/s/x/data"},
+	} {
+		if rewritten := translator.rewritePath(tt.path); rewritten != tt.expected {
+			t.Errorf("%v: rewritten is '%v'", tt.path, rewritten)
+		}
+	}
+}
+
+func TestParseInvalidRewriteRule(t *testing.T) {
+	for _, s := range []string{"strip", "replace ( /x", "move /a /b"} {
+		if _, err := ParseRewriteRule(s); err == nil {
+			t.Errorf("%v: expected an error", s)
+		}
+	}
+}
+
+func TestTranslateCOAPRequestWithRewriteRules(t *testing.T) {
+	rule, _ := ParseRewriteRule("strip /v1")
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	coapMsg.SetPathString("/v1/status")
+	coapMsg.SetOption(coap.URIQuery, "full")
+	translator := Translator{BackendURL: "http://localhost:9876/api", RewriteRules: []RewriteRule{rule}}
+	httpReq, err := translator.TranslateRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating request: %v", err)
+	}
+	if httpReq.URL.String() != "http://localhost:9876/api/status?full" {
+		t.Errorf("httpReq.URL is '%v'", httpReq.URL)
+	}
+}
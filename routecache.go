@@ -0,0 +1,86 @@
+package crosscoap
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// RouteCachePolicy overrides the caching of the backend responses to the
+// requests whose path lies below PathPrefix (matched on whole path
+// segments) and whose method is one of Methods (such as GET), or any
+// method if Methods is empty.  Only the responses to GET requests are ever
+// cached.
+type RouteCachePolicy struct {
+	PathPrefix string
+	Methods    []string
+
+	// TTL, if positive, is the time for which successful responses are
+	// cached, whatever their Cache-Control or Expires headers say (private
+	// responses are still not cached).
+	TTL time.Duration
+
+	// Bypass neither answers the requests from the cache nor caches their
+	// responses, for resources which must always be fresh (such as
+	// commands).
+	Bypass bool
+}
+
+// matchesMethod reports whether the method of the request m is one of
+// methods, or methods is empty.
+func matchesMethod(methods []string, m *coap.Message) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, method := range methods {
+		if strings.EqualFold(method, methodName(m.Code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachePolicy returns the cache policy of the first route matching the
+// request m which sets one, or nil.
+func (p *proxyHandler) cachePolicy(m *coap.Message) *RouteCachePolicy {
+	r := p.routeOverride(m, func(r *routeOverride) bool {
+		return (r.CacheTTL > 0 || r.CacheBypass) && matchesMethod(r.CacheMethods, m)
+	})
+	if r == nil {
+		return nil
+	}
+	return &RouteCachePolicy{PathPrefix: r.PathPrefix, Methods: r.CacheMethods, TTL: r.CacheTTL, Bypass: r.CacheBypass}
+}
+
+type cachePolicyKey struct{}
+
+// withCachePolicy returns req cached according to policy.
+func withCachePolicy(req *http.Request, policy *RouteCachePolicy) *http.Request {
+	if policy == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), cachePolicyKey{}, policy))
+}
+
+// requestCachePolicy returns the cache policy of req, or nil.
+func requestCachePolicy(req *http.Request) *RouteCachePolicy {
+	policy, _ := req.Context().Value(cachePolicyKey{}).(*RouteCachePolicy)
+	return policy
+}
+
+// routeFreshness returns how long the response to req stays in the cache,
+// according to the cache policy of req, else to freshness.
+func (c *responseCache) routeFreshness(req *http.Request, httpResp *http.Response) time.Duration {
+	policy := requestCachePolicy(req)
+	if policy == nil || policy.TTL <= 0 || hasCacheDirective(httpResp.Header, "private") {
+		return c.freshness(httpResp)
+	}
+	switch httpResp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent:
+		return policy.TTL
+	}
+	return c.freshness(httpResp)
+}
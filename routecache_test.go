@@ -0,0 +1,71 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestRouteCachePolicies(t *testing.T) {
+	requests := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if r.URL.Path != "/config" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{
+		BackendURL:   backend.URL,
+		CacheMaxSize: 1 << 20,
+		RouteCachePolicies: []RouteCachePolicy{
+			{PathPrefix: "/commands", Bypass: true},
+			{PathPrefix: "/config", Methods: []string{"GET"}, TTL: 10 * time.Minute},
+		},
+	})
+
+	for _, tt := range []struct {
+		path             string
+		expectedRequests int
+		expectedMaxAge   uint32
+	}{
+		{"/commands/reboot", 3, 60},
+		{"/config", 1, 600},
+		{"/telemetry", 1, 60},
+	} {
+		var maxAge uint32
+		for i := 0; i < 3; i++ {
+			req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+			req.SetPathString(tt.path)
+			coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+			if coapResp == nil || coapResp.Code != coap.Content {
+				t.Fatalf("%v: response is %v", tt.path, coapResp)
+			}
+			maxAge, _ = coapResp.Option(coap.MaxAge).(uint32)
+		}
+		if requests[tt.path] != tt.expectedRequests {
+			t.Errorf("%v: backend got %v requests", tt.path, requests[tt.path])
+		}
+		if maxAge == 0 || maxAge > tt.expectedMaxAge {
+			t.Errorf("%v: Max-Age is %v", tt.path, maxAge)
+		}
+	}
+}
+
+func TestCachePolicyMethods(t *testing.T) {
+	p := newProxyHandler(&Proxy{RouteCachePolicies: []RouteCachePolicy{{PathPrefix: "/config", Methods: []string{"fetch"}, Bypass: true}}})
+	m := &coap.Message{Code: coap.GET}
+	m.SetPathString("/config/network")
+	if policy := p.cachePolicy(m); policy != nil {
+		t.Errorf("policy of GET is %+v", policy)
+	}
+	m.Code = FETCH
+	if policy := p.cachePolicy(m); policy == nil || !policy.Bypass {
+		t.Errorf("policy of FETCH is %+v", policy)
+	}
+}
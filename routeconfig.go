@@ -0,0 +1,180 @@
+package crosscoap
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// RouteConfig holds the settings of the requests whose path lies below
+// PathPrefix (matched on whole path segments), overriding the proxy-wide
+// defaults of the Proxy fields.  For each setting the first matching route
+// setting it applies; a zero field leaves the setting to the next matching
+// routes and then to the default.  The first matching route also names the
+// statistics and the "route" metric label of its requests.
+type RouteConfig struct {
+	PathPrefix string
+
+	// Timeout overrides Timeout.
+	Timeout time.Duration
+
+	// MaxRequestBodyBytes overrides MaxRequestBodyBytes.
+	MaxRequestBodyBytes int
+
+	// Oversize, if set, overrides OversizePolicy.
+	Oversize *OversizePolicy
+
+	// CacheTTL and CacheBypass override the cache policy of the responses
+	// to the requests whose method is one of CacheMethods (such as GET), or
+	// any method if it's empty, with CacheMaxSize (see RouteCachePolicy).
+	CacheTTL     time.Duration
+	CacheBypass  bool
+	CacheMethods []string
+
+	// NonDeduplication is the window within which duplicated NON requests
+	// are forwarded once (see RouteNonDeduplication).  If negative, the
+	// requests of the route aren't deduplicated.
+	NonDeduplication time.Duration
+
+	// RateLimit is the number of requests per second allowed to the route,
+	// with bursts of up to Burst requests, as for a Tenant; others get
+	// 4.29 Too Many Requests.
+	RateLimit float64
+	Burst     int
+
+	// Quiet leaves the requests out of the access log, such as frequent
+	// telemetry; they're still audited.
+	Quiet bool
+}
+
+// routeOverride is the runtime state of a RouteConfig.
+type routeOverride struct {
+	RouteConfig
+	limiter *rateLimiter // if RateLimit
+}
+
+// routeConfigs returns Routes followed by the routes of the deprecated
+// per-setting lists, which thus apply to the settings Routes leave zero.
+func (p *Proxy) routeConfigs() []RouteConfig {
+	routes := append([]RouteConfig(nil), p.Routes...)
+	for _, r := range p.RouteTimeouts {
+		routes = append(routes, RouteConfig{PathPrefix: r.PathPrefix, Timeout: r.Timeout})
+	}
+	for _, r := range p.RouteOversizePolicies {
+		policy := r.Policy
+		routes = append(routes, RouteConfig{PathPrefix: r.PathPrefix, Oversize: &policy})
+	}
+	for _, r := range p.RouteCachePolicies {
+		routes = append(routes, RouteConfig{PathPrefix: r.PathPrefix, CacheTTL: r.TTL, CacheBypass: r.Bypass, CacheMethods: r.Methods})
+	}
+	for _, r := range p.NonDeduplication {
+		window := r.Window
+		if window == 0 {
+			window = -1 // exempt
+		}
+		routes = append(routes, RouteConfig{PathPrefix: r.PathPrefix, NonDeduplication: window})
+	}
+	return routes
+}
+
+// newRouteOverrides returns the runtime state of routes.
+func newRouteOverrides(routes []RouteConfig) []*routeOverride {
+	var overrides []*routeOverride
+	for _, config := range routes {
+		r := &routeOverride{RouteConfig: config}
+		if config.RateLimit > 0 {
+			r.limiter = newRateLimiter(config.RateLimit, config.Burst)
+		}
+		overrides = append(overrides, r)
+	}
+	return overrides
+}
+
+// matchRoute returns the first of routes matching path for which set
+// reports true, or nil.
+func matchRoute(routes []*routeOverride, path string, set func(r *routeOverride) bool) *routeOverride {
+	for _, r := range routes {
+		if hasPathPrefix(path, r.PathPrefix) && set(r) {
+			return r
+		}
+	}
+	return nil
+}
+
+// routeTable holds the routes of a proxy, which the admin API can replace
+// while it's serving.
+type routeTable struct {
+	mu     sync.RWMutex
+	routes []*routeOverride
+}
+
+func (t *routeTable) get() []*routeOverride {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routes
+}
+
+func (t *routeTable) set(routes []*routeOverride) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = routes
+}
+
+// routeName returns the route which the statistics of path are recorded
+// under.
+func (t *routeTable) routeName(path string) string {
+	if r := matchRoute(t.get(), path, func(*routeOverride) bool { return true }); r != nil {
+		return "/" + strings.Trim(r.PathPrefix, "/")
+	}
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[:i]
+	}
+	return "/" + path
+}
+
+// routeOverride returns the first route matching the path of m for which
+// set reports true, or nil: those of its tenant come before those of the
+// proxy.
+func (p *proxyHandler) routeOverride(m *coap.Message, set func(r *routeOverride) bool) *routeOverride {
+	path := m.PathString()
+	if t := p.tenants.match(m); t != nil {
+		if r := matchRoute(t.routes, path, set); r != nil {
+			return r
+		}
+	}
+	return matchRoute(p.routes.get(), path, set)
+}
+
+// allRoutes returns the routes of the proxy and of its tenants.
+func (p *proxyHandler) allRoutes() []*routeOverride {
+	routes := p.routes.get()
+	if p.tenants == nil {
+		return routes
+	}
+	all := append([]*routeOverride(nil), routes...)
+	for _, t := range p.tenants.tenants {
+		all = append(all, t.routes...)
+	}
+	return all
+}
+
+// maxRequestBodyBytes returns the limit of the payload size of m.
+func (p *proxyHandler) maxRequestBodyBytes(m *coap.Message) int {
+	if r := p.routeOverride(m, func(r *routeOverride) bool { return r.MaxRequestBodyBytes > 0 }); r != nil {
+		return r.MaxRequestBodyBytes
+	}
+	return p.MaxRequestBodyBytes
+}
+
+// routeLimiter returns the rate limiter of the route of m, or nil.
+func (p *proxyHandler) routeLimiter(m *coap.Message) *routeOverride {
+	return p.routeOverride(m, func(r *routeOverride) bool { return r.limiter != nil })
+}
+
+// quiet reports whether m is left out of the access log.
+func (p *proxyHandler) quiet(m *coap.Message) bool {
+	return p.routeOverride(m, func(r *routeOverride) bool { return r.Quiet }) != nil
+}
@@ -0,0 +1,154 @@
+package crosscoap
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestRouteConfig(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	var accessLog bytes.Buffer
+	block2 := Block2Oversize
+	proxy := &Proxy{
+		BackendURL:          backend.URL,
+		AccessLog:           log.New(&accessLog, "", 0),
+		MaxRequestBodyBytes: 10,
+		RouteTimeouts:       []RouteTimeout{{PathPrefix: "/telemetry", Timeout: 2 * time.Second}},
+		Routes: []RouteConfig{
+			{PathPrefix: "/firmware", Timeout: 5 * time.Minute, MaxRequestBodyBytes: 100, Oversize: &block2, CacheBypass: true},
+			{PathPrefix: "/telemetry", RateLimit: 0.001, Burst: 1, Quiet: true},
+		},
+	}
+	p := newProxyHandler(proxy)
+	if len(proxy.RouteTimeouts) != 1 || len(proxy.RouteOversizePolicies) != 0 {
+		t.Errorf("proxy routes are modified: %v %v", proxy.RouteTimeouts, proxy.RouteOversizePolicies)
+	}
+
+	request := func(path, payload string) *coap.Message {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1, Payload: []byte(payload)}
+		m.SetPathString(path)
+		return m
+	}
+	for _, tt := range []struct {
+		path            string
+		expectedTimeout time.Duration
+		expectedPolicy  OversizePolicy
+		expectedBypass  bool
+	}{
+		{"/firmware/v2", 5 * time.Minute, Block2Oversize, true},
+		{"/telemetry", 2 * time.Second, TruncateOversize, false},
+		{"/lamp", defaultHTTPTimeout, TruncateOversize, false},
+	} {
+		m := request(tt.path, "")
+		if timeout := p.requestTimeout(m); timeout != tt.expectedTimeout {
+			t.Errorf("%v: timeout is %v", tt.path, timeout)
+		}
+		if policy := p.oversizePolicy(m); policy != tt.expectedPolicy {
+			t.Errorf("%v: oversize policy is %v", tt.path, policy)
+		}
+		if policy := p.cachePolicy(m); (policy != nil && policy.Bypass) != tt.expectedBypass {
+			t.Errorf("%v: cache policy is %v", tt.path, policy)
+		}
+	}
+
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	payload := strings.Repeat("x", 50)
+	if coapResp := p.serveCOAP(a, request("/firmware", payload), nil, nil); coapResp == nil || coapResp.Code != coap.Changed {
+		t.Errorf("firmware response is %v", coapResp)
+	}
+	if coapResp := p.serveCOAP(a, request("/lamp", payload), nil, nil); coapResp == nil || coapResp.Code != coap.RequestEntityTooLarge {
+		t.Errorf("oversize request response is %v", coapResp)
+	} else if size1, _ := coapResp.Option(coap.Size1).(uint32); size1 != 10 {
+		t.Errorf("Size1 is %v", size1)
+	}
+
+	if coapResp := p.serveCOAP(a, request("/telemetry", "1"), nil, nil); coapResp == nil || coapResp.Code != coap.Changed {
+		t.Errorf("first telemetry response is %v", coapResp)
+	}
+	if coapResp := p.serveCOAP(a, request("/telemetry", "2"), nil, nil); coapResp == nil || coapResp.Code != codeTooManyRequests {
+		t.Errorf("rate limited telemetry response is %v", coapResp)
+	}
+	if log := accessLog.String(); !strings.Contains(log, "URI-Path=firmware") || strings.Contains(log, "URI-Path=telemetry URI-Query") {
+		t.Errorf("access log is %v", log)
+	}
+}
+
+func TestTenantRoutes(t *testing.T) {
+	p := newProxyHandler(&Proxy{
+		BackendURL: "http://127.0.0.1:1",
+		Tenants: []Tenant{{Name: "acme", Host: "acme.example", Routes: []RouteConfig{
+			{PathPrefix: "/fw", Timeout: time.Minute, Quiet: true},
+		}}},
+		Routes: []RouteConfig{{PathPrefix: "/fw", Timeout: 5 * time.Minute, MaxRequestBodyBytes: 100}},
+	})
+	for _, tt := range []struct {
+		host            string
+		expectedTimeout time.Duration
+		expectedQuiet   bool
+	}{
+		{"acme.example", time.Minute, true},
+		{"other.example", 5 * time.Minute, false},
+	} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetOption(coap.URIHost, tt.host)
+		m.SetPathString("/fw/image")
+		if timeout := p.requestTimeout(m); timeout != tt.expectedTimeout {
+			t.Errorf("%v: timeout is %v", tt.host, timeout)
+		}
+		if quiet := p.quiet(m); quiet != tt.expectedQuiet {
+			t.Errorf("%v: quiet is %v", tt.host, quiet)
+		}
+		// The proxy routes apply to the settings the tenant's leave zero
+		if max := p.maxRequestBodyBytes(m); max != 100 {
+			t.Errorf("%v: maximum payload size is %v", tt.host, max)
+		}
+	}
+}
+
+func TestRouteConfigPrecedence(t *testing.T) {
+	p := newProxyHandler(&Proxy{
+		BackendURL:          "http://127.0.0.1:1",
+		MaxRequestBodyBytes: 10,
+		RouteTimeouts:       []RouteTimeout{{PathPrefix: "/fw/image", Timeout: 10 * time.Minute}},
+		Routes: []RouteConfig{
+			{PathPrefix: "/fw", RateLimit: 10},
+			{PathPrefix: "/fw/image", MaxRequestBodyBytes: 100, Quiet: true},
+		},
+	})
+	for _, tt := range []struct {
+		path            string
+		expectedTimeout time.Duration
+		expectedMax     int
+		expectedQuiet   bool
+	}{
+		{"/fw/image", 10 * time.Minute, 100, true},
+		{"/fw/manifest", defaultHTTPTimeout, 10, false},
+	} {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(tt.path)
+		// A route leaving a setting zero doesn't shadow a more specific one
+		if timeout := p.requestTimeout(m); timeout != tt.expectedTimeout {
+			t.Errorf("%v: timeout is %v", tt.path, timeout)
+		}
+		if max := p.maxRequestBodyBytes(m); max != tt.expectedMax {
+			t.Errorf("%v: maximum payload size is %v", tt.path, max)
+		}
+		if quiet := p.quiet(m); quiet != tt.expectedQuiet {
+			t.Errorf("%v: quiet is %v", tt.path, quiet)
+		}
+		if r := p.routeLimiter(m); r == nil || r.PathPrefix != "/fw" {
+			t.Errorf("%v: rate limited route is %v", tt.path, r)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package crosscoap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// SenML (RFC 8428) Content-Formats.
+const (
+	appSenMLJSON coap.MediaType = 110
+	appSenMLCBOR coap.MediaType = 112
+)
+
+// senmlRelativeTimeLimit is the value below which SenML times are relative
+// to the current time (RFC 8428 section 4.5.3).
+const senmlRelativeTimeLimit = 1 << 28
+
+var errInvalidSenML = errors.New("invalid SenML pack")
+
+// senmlCBORLabels maps the integer labels of senml+cbor (RFC 8428 section
+// 6) to the labels of senml+json.
+var senmlCBORLabels = map[string]string{
+	"-1": "bver",
+	"-2": "bn",
+	"-3": "bt",
+	"-4": "bu",
+	"-5": "bv",
+	"-6": "bs",
+	"0":  "n",
+	"1":  "u",
+	"2":  "v",
+	"3":  "vs",
+	"4":  "vb",
+	"5":  "s",
+	"6":  "t",
+	"7":  "ut",
+	"8":  "vd",
+}
+
+func isSenML(mediaType interface{}) bool {
+	return mediaType == appSenMLJSON || mediaType == appSenMLCBOR
+}
+
+// normalizeSenML converts a SenML pack to resolved records (RFC 8428 section
+// 4.6) in senml+json: base values are applied to each record and dropped,
+// and relative times are converted to absolute times using now.
+func normalizeSenML(payload []byte, mediaType coap.MediaType, now time.Time) ([]byte, error) {
+	records, err := parseSenML(payload, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	var base struct {
+		name, unit   string
+		time, value  float64
+		sum          float64
+		hasV, hasSum bool
+	}
+	nowSeconds := float64(now.UnixNano()) / float64(time.Second)
+	resolved := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		out := make(map[string]interface{}, len(record))
+		for label, value := range record {
+			var ok bool
+			switch label {
+			case "bver":
+				_, ok = senmlNumber(value)
+			case "bn":
+				base.name, ok = value.(string)
+			case "bu":
+				base.unit, ok = value.(string)
+			case "bt":
+				base.time, ok = senmlNumber(value)
+			case "bv":
+				base.value, ok = senmlNumber(value)
+				base.hasV = true
+			case "bs":
+				base.sum, ok = senmlNumber(value)
+				base.hasSum = true
+			default:
+				if strings.HasSuffix(label, "_") {
+					// Unknown labels which must be understood
+					return nil, errInvalidSenML
+				}
+				out[label], ok = value, true
+			}
+			if !ok {
+				return nil, errInvalidSenML
+			}
+		}
+
+		name, ok := out["n"].(string)
+		if _, found := out["n"]; found && !ok {
+			return nil, errInvalidSenML
+		}
+		name = base.name + name
+		if name == "" {
+			return nil, errInvalidSenML
+		}
+		out["n"] = name
+		if _, found := out["u"]; !found && base.unit != "" {
+			out["u"] = base.unit
+		}
+		t, err := senmlField(out, "t")
+		if err != nil {
+			return nil, err
+		}
+		t += base.time
+		if t < senmlRelativeTimeLimit {
+			t += nowSeconds
+		}
+		out["t"] = t
+		if err := resolveSenMLValue(out, "v", base.value, base.hasV); err != nil {
+			return nil, err
+		}
+		if err := resolveSenMLValue(out, "s", base.sum, base.hasSum); err != nil {
+			return nil, err
+		}
+		if !hasSenMLValue(out) {
+			return nil, errInvalidSenML
+		}
+		resolved = append(resolved, out)
+	}
+	return json.Marshal(resolved)
+}
+
+func parseSenML(payload []byte, mediaType coap.MediaType) ([]map[string]interface{}, error) {
+	var pack interface{}
+	if mediaType == appSenMLCBOR {
+		var err error
+		if pack, err = decodeCBOR(payload); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&pack); err != nil {
+			return nil, err
+		}
+	}
+	items, ok := pack.([]interface{})
+	if !ok {
+		return nil, errInvalidSenML
+	}
+	records := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		record, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidSenML
+		}
+		if mediaType == appSenMLCBOR {
+			labeled := make(map[string]interface{}, len(record))
+			for key, value := range record {
+				if label, found := senmlCBORLabels[key]; found {
+					key = label
+				}
+				labeled[key] = value
+			}
+			record = labeled
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// senmlField returns the numeric field label of a record, or 0 if it's
+// absent.
+func senmlField(record map[string]interface{}, label string) (float64, error) {
+	value, found := record[label]
+	if !found {
+		return 0, nil
+	}
+	number, ok := senmlNumber(value)
+	if !ok {
+		return 0, errInvalidSenML
+	}
+	return number, nil
+}
+
+// resolveSenMLValue adds the base value to the numeric field label; a
+// record without any value gets the base value itself.
+func resolveSenMLValue(record map[string]interface{}, label string, base float64, hasBase bool) error {
+	value, err := senmlField(record, label)
+	if err != nil {
+		return err
+	}
+	_, found := record[label]
+	if found || (hasBase && !hasSenMLValue(record)) {
+		record[label] = base + value
+	}
+	return nil
+}
+
+func hasSenMLValue(record map[string]interface{}) bool {
+	for _, label := range []string{"v", "vs", "vb", "vd", "s"} {
+		if _, found := record[label]; found {
+			return true
+		}
+	}
+	return false
+}
+
+func senmlNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	case uint64:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
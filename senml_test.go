@@ -0,0 +1,66 @@
+package crosscoap
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSenML(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		pack     string
+		expected string
+	}{
+		{
+			`[{"bn":"urn:dev:ow:10e2073a01080063:","bt":1.320067464e+09,"bu":"%RH","v":20},
+			  {"u":"lon","v":24.30621},
+			  {"n":"temp","t":60,"u":"Cel","v":23.1}]`,
+			`[{"n":"urn:dev:ow:10e2073a01080063:","t":1320067464,"u":"%RH","v":20},` +
+				`{"n":"urn:dev:ow:10e2073a01080063:","t":1320067464,"u":"lon","v":24.30621},` +
+				`{"n":"urn:dev:ow:10e2073a01080063:temp","t":1320067524,"u":"Cel","v":23.1}]`,
+		},
+		{
+			`[{"bn":"dev/","bv":10,"n":"a","v":1},{"n":"b"},{"n":"c","vs":"on","t":-5}]`,
+			`[{"n":"dev/a","t":1500000000,"v":11},{"n":"dev/b","t":1500000000,"v":10},` +
+				`{"n":"dev/c","t":1499999995,"vs":"on"}]`,
+		},
+	}
+	for _, test := range tests {
+		normalized, err := normalizeSenML([]byte(test.pack), appSenMLJSON, now)
+		if err != nil {
+			t.Errorf("normalizeSenML(%v) failed: %v", test.pack, err)
+			continue
+		}
+		if string(normalized) != test.expected {
+			t.Errorf("normalizeSenML(%v) is '%v'", test.pack, string(normalized))
+		}
+	}
+}
+
+func TestNormalizeSenMLCBOR(t *testing.T) {
+	// [{-2: "dev/", 0: "temp", 2: 21}]
+	pack, _ := hex.DecodeString("81a321646465762f006474656d700215")
+	normalized, err := normalizeSenML(pack, appSenMLCBOR, time.Unix(1500000000, 0))
+	if err != nil {
+		t.Fatalf("normalizeSenML failed: %v", err)
+	}
+	if expected := `[{"n":"dev/temp","t":1500000000,"v":21}]`; string(normalized) != expected {
+		t.Errorf("normalizeSenML is '%v'", string(normalized))
+	}
+}
+
+func TestNormalizeSenMLRejectsInvalidPacks(t *testing.T) {
+	for _, pack := range []string{
+		`{"n":"a","v":1}`,
+		`[{"v":1}]`,
+		`[{"n":"a"}]`,
+		`[{"n":"a","v":"1"}]`,
+		`[{"n":1,"v":1}]`,
+		`[{"n":"a","v":1,"foo_":2}]`,
+	} {
+		if _, err := normalizeSenML([]byte(pack), appSenMLJSON, time.Now()); err == nil {
+			t.Errorf("normalizeSenML(%v) succeeded", pack)
+		}
+	}
+}
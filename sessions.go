@@ -0,0 +1,124 @@
+package crosscoap
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSessions is the number of client sessions kept, beyond which the least
+// recently used one is forgotten.
+const maxSessions = 100000
+
+type session struct {
+	jar      http.CookieJar
+	lastUsed time.Time
+}
+
+// sessions are the cookie jars of the clients, by device ID or else by UDP
+// endpoint, so that consecutive requests of a device reuse its backend
+// session.
+type sessions struct {
+	mu        sync.Mutex
+	jars      map[string]*session
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+// newSessions returns the client sessions of p, or nil if SessionTTL isn't
+// positive.
+func (p *proxyHandler) newSessions() *sessions {
+	if p.SessionTTL <= 0 {
+		return nil
+	}
+	return &sessions{jars: make(map[string]*session), ttl: p.SessionTTL}
+}
+
+// sessionKey returns the key of the session of the client at a: its device
+// ID if the device registry knows it, else its endpoint.
+func (p *proxyHandler) sessionKey(a *net.UDPAddr) string {
+	if devices := p.devices.devicesAt(a); len(devices) > 0 {
+		sort.Strings(devices)
+		return "device:" + devices[0]
+	}
+	return a.String()
+}
+
+// jar returns the cookie jar of the session key at now, starting a new
+// session if there is none or it has been idle for longer than the TTL.
+func (s *sessions) jar(key string, now time.Time) http.CookieJar {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= time.Minute {
+		s.expire(now)
+		s.lastSweep = now
+	}
+	ss := s.jars[key]
+	if ss != nil && now.Sub(ss.lastUsed) >= s.ttl {
+		ss = nil
+	}
+	if ss == nil {
+		if len(s.jars) >= maxSessions {
+			s.forgetOldest()
+		}
+		jar, _ := cookiejar.New(nil) // never fails without options
+		ss = &session{jar: jar}
+		s.jars[key] = ss
+	}
+	ss.lastUsed = now
+	return ss.jar
+}
+
+// expire forgets the sessions idle for longer than the TTL at now.
+func (s *sessions) expire(now time.Time) {
+	for key, ss := range s.jars {
+		if now.Sub(ss.lastUsed) >= s.ttl {
+			delete(s.jars, key)
+		}
+	}
+}
+
+func (s *sessions) forgetOldest() {
+	var oldest string
+	var lastUsed time.Time
+	for key, ss := range s.jars {
+		if oldest == "" || ss.lastUsed.Before(lastUsed) {
+			oldest, lastUsed = key, ss.lastUsed
+		}
+	}
+	delete(s.jars, oldest)
+}
+
+// size returns the number of sessions.
+func (s *sessions) size() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jars)
+}
+
+type cookieJarKey struct{}
+
+// withCookieJar returns req sent with the cookies of jar, which keeps the
+// cookies set by the backend, including on redirects.
+func withCookieJar(req *http.Request, jar http.CookieJar) *http.Request {
+	if jar == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), cookieJarKey{}, jar))
+}
+
+// requestCookieJar returns the cookie jar of req, or nil.
+func requestCookieJar(req *http.Request) http.CookieJar {
+	jar, _ := req.Context().Value(cookieJarKey{}).(http.CookieJar)
+	return jar
+}
@@ -0,0 +1,66 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestSessionCookies(t *testing.T) {
+	var cookies []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: r.URL.Query().Get("user"), Path: "/"})
+		}
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, SessionTTL: time.Hour})
+	request := func(a *net.UDPAddr, path string, queries ...string) {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(path)
+		for _, q := range queries {
+			m.AddOption(coap.URIQuery, q)
+		}
+		p.handleRequest(a, m, nil)
+	}
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5683}
+	request(first, "/login", "user=alice")
+	request(second, "/login", "user=bob")
+	request(first, "/data")
+	request(second, "/data")
+	expected := []string{"", "", "session=alice", "session=bob"}
+	if len(cookies) != len(expected) {
+		t.Fatalf("cookies are '%v'", cookies)
+	}
+	for i := range expected {
+		if cookies[i] != expected[i] {
+			t.Errorf("cookies of request %v are '%v'", i, cookies[i])
+		}
+	}
+	if n := p.sessions.size(); n != 2 {
+		t.Errorf("sessions are %v", n)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := (&proxyHandler{Proxy: Proxy{SessionTTL: time.Minute}}).newSessions()
+	now := time.Now()
+	jar := s.jar("a", now)
+	if s.jar("a", now.Add(30*time.Second)) != jar {
+		t.Errorf("session not reused")
+	}
+	if s.jar("a", now.Add(2*time.Minute)) == jar {
+		t.Errorf("idle session reused")
+	}
+	s.jar("b", now.Add(2*time.Minute))
+	s.jar("c", now.Add(4*time.Minute))
+	if n := s.size(); n != 1 {
+		t.Errorf("sessions are %v after expiry", n)
+	}
+}
@@ -0,0 +1,107 @@
+package crosscoap
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxShadowRequests is the number of requests to the shadow backend in
+// flight, beyond which requests aren't mirrored, so that a slow shadow
+// backend doesn't pile up goroutines.
+const maxShadowRequests = 64
+
+// shadowBackend mirrors backend requests to ShadowBackendURL.
+type shadowBackend struct {
+	backend *url.URL
+	shadow  *url.URL
+	slots   chan struct{}
+}
+
+// newShadowBackend returns the shadow backend of p, or nil if it has none.
+func (p *proxyHandler) newShadowBackend() *shadowBackend {
+	if p.ShadowBackendURL == "" {
+		return nil
+	}
+	backend, err := url.Parse(p.BackendURL)
+	if err != nil {
+		p.logError("Invalid backend URL, not mirroring requests: %v", err)
+		return nil
+	}
+	shadow, err := url.Parse(p.ShadowBackendURL)
+	if err != nil {
+		p.logError("Invalid shadow backend URL: %v", err)
+		return nil
+	}
+	return &shadowBackend{backend: backend, shadow: shadow, slots: make(chan struct{}, maxShadowRequests)}
+}
+
+// rebaseURL returns the URL below to corresponding to u, or nil if u isn't
+// below from.
+func rebaseURL(u, from, to *url.URL) *url.URL {
+	if u.Scheme != from.Scheme || u.Host != from.Host || !strings.HasPrefix(u.Path, from.Path) {
+		return nil
+	}
+	rebased := *u
+	rebased.Scheme = to.Scheme
+	rebased.Host = to.Host
+	rebased.Path = to.Path + strings.TrimPrefix(u.Path, from.Path)
+	rebased.RawPath = ""
+	return &rebased
+}
+
+// mirror sends a copy of req to the shadow backend in the background,
+// discarding the response.  Requests whose body is streamed, or which don't
+// go to the backend, aren't mirrored.
+func (p *proxyHandler) mirror(req *http.Request, timeout time.Duration, requestID string) {
+	s := p.shadow
+	if s == nil || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return
+	}
+	shadowURL := rebaseURL(req.URL, s.backend, s.shadow)
+	if shadowURL == nil {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		p.logError("Too many requests to the shadow backend, not mirroring (Request-ID=%v)", requestID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	shadowReq := req.Clone(ctx)
+	shadowReq.URL = shadowURL
+	shadowReq.Host = ""
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			<-s.slots
+			return
+		}
+		shadowReq.Body = body
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		defer cancel()
+		if err := p.signRequest(shadowReq, time.Now()); err != nil {
+			p.logError("Error signing shadow HTTP request: %v (Request-ID=%v)", err, requestID)
+			return
+		}
+		transport := p.transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		resp, err := transport.RoundTrip(shadowReq)
+		if err != nil {
+			p.logError("Error on shadow HTTP request: %v (Request-ID=%v)", err, requestID)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,63 @@
+package crosscoap
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestProxyWithShadowBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer backend.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.String() + " " + string(body)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL + "/v1", ShadowBackendURL: shadow.URL + "/v2"})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	m := &coap.Message{Type: coap.Confirmable, Code: coap.PUT, MessageID: 1, Payload: []byte("21.5")}
+	m.SetPathString("/sensors/temp")
+	m.SetOption(coap.URIQuery, "unit=C")
+	if coapResp := p.handleRequest(a, m, nil); coapResp == nil || string(coapResp.Payload) != "primary" {
+		t.Errorf("response is '%v'", coapResp)
+	}
+	select {
+	case request := <-mirrored:
+		if expected := "PUT /v2/sensors/temp?unit=C 21.5"; request != expected {
+			t.Errorf("shadow backend got '%v'; expected '%v'", request, expected)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("shadow backend got no request")
+	}
+}
+
+func TestRebaseURL(t *testing.T) {
+	p := newProxyHandler(&Proxy{BackendURL: "http://backend:8080/api", ShadowBackendURL: "https://shadow"})
+	tests := []struct{ url, expected string }{
+		{"http://backend:8080/api/a/b?c=d", "https://shadow/a/b?c=d"},
+		{"http://other:8080/api/a", ""},
+		{"https://backend:8080/api/a", ""},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		shadowURL := ""
+		if u := rebaseURL(u, p.shadow.backend, p.shadow.shadow); u != nil {
+			shadowURL = u.String()
+		}
+		if shadowURL != test.expected {
+			t.Errorf("rebased URL of '%v' is '%v'; expected '%v'", test.url, shadowURL, test.expected)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package crosscoap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// defaultDrainTimeout is the time for which a proxy shutting down keeps
+// serving the requests in progress.
+const defaultDrainTimeout = 30 * time.Second
+
+// ErrProxyClosed is returned by Serve after a call to Shutdown.
+var ErrProxyClosed = errors.New("crosscoap: proxy closed")
+
+// errHandedOver is returned by readPackets once the proxy is handed over.
+var errHandedOver = errors.New("crosscoap: listener handed over")
+
+// lifecycle is the shutdown state of a proxy, shared by the copies of its
+// Proxy.
+type lifecycle struct {
+	draining   chan struct{} // closed when Shutdown is called
+	aborted    chan struct{} // closed at the drain deadline
+	handedOver chan struct{} // closed when Handover is called
+	closed     chan struct{} // closed once Shutdown closed the listeners
+	once       sync.Once
+	handover   sync.Once
+	close      sync.Once
+
+	exchanges int32 // requests being handled or answered
+
+	mu      sync.Mutex
+	handler *proxyHandler // being served
+}
+
+var lifecycleMu sync.Mutex
+
+// lifecycle returns the shutdown state of p.
+func (p *Proxy) lifecycle() *lifecycle {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	if p.life == nil {
+		p.life = &lifecycle{
+			draining:   make(chan struct{}),
+			aborted:    make(chan struct{}),
+			handedOver: make(chan struct{}),
+			closed:     make(chan struct{}),
+		}
+	}
+	return p.life
+}
+
+func (l *lifecycle) isDraining() bool {
+	select {
+	case <-l.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *lifecycle) isHandedOver() bool {
+	select {
+	case <-l.handedOver:
+		return true
+	default:
+		return false
+	}
+}
+
+// serving records the handler serving the proxy, or returns false if the
+// proxy has been shut down.
+func (l *lifecycle) serving(handler *proxyHandler) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isDraining() {
+		return false
+	}
+	l.handler = handler
+	return true
+}
+
+// exchangeStarted records a request received, until exchangeDone is
+// called once it's been answered.
+func (l *lifecycle) exchangeStarted() {
+	atomic.AddInt32(&l.exchanges, 1)
+}
+
+func (l *lifecycle) exchangeDone() {
+	atomic.AddInt32(&l.exchanges, -1)
+}
+
+// idle reports whether no request or block-wise transfer is in progress;
+// once the proxy is handed over, the transfers are left to the other
+// process.
+func (l *lifecycle) idle() bool {
+	if atomic.LoadInt32(&l.exchanges) != 0 {
+		return false
+	}
+	l.mu.Lock()
+	handler := l.handler
+	l.mu.Unlock()
+	return handler == nil || l.isHandedOver() || (handler.uploads.count() == 0 && handler.downloads.count() == 0)
+}
+
+// Shutdown gracefully shuts down a proxy being served: new requests are
+// answered with 5.03 Service Unavailable, while the requests already
+// forwarded to the backend and the block-wise transfers in progress are
+// still served, until they're all done or DrainTimeout (30 seconds if zero)
+// has elapsed or ctx is done.  The requests still waiting for the backend
+// are then answered with 5.03 too, and once the responses are sent the
+// listeners are closed, so that Serve returns ErrProxyClosed.  Shutdown
+// returns the error of ctx if it was done before the requests were.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	l := p.lifecycle()
+	l.mu.Lock()
+	l.once.Do(func() { close(l.draining) })
+	l.mu.Unlock()
+	timeout := p.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+drain:
+	for !l.idle() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break drain
+		case <-deadline.C:
+			break drain
+		case <-ticker.C:
+		}
+	}
+	close(l.aborted)
+	for atomic.LoadInt32(&l.exchanges) != 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	for _, conn := range append([]*net.UDPConn{p.Listener, p.MulticastListener}, p.Listeners...) {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	l.close.Do(func() { close(l.closed) })
+	return err
+}
+
+// Handover gracefully hands a proxy being served over to another process
+// sharing its listeners, such as a newer crosscoap which inherited their
+// file descriptors, for upgrades without downtime: the proxy stops
+// receiving on the listeners, so that the other process gets the new
+// requests, and its AdminListener is closed, but the responses to the
+// requests already forwarded to the backend are still sent, as with
+// Shutdown.  The block-wise transfers and Observe relays in progress are
+// continued by the other process, which the clients' next requests reach.
+func (p *Proxy) Handover(ctx context.Context) error {
+	l := p.lifecycle()
+	l.handover.Do(func() { close(l.handedOver) })
+	for _, conn := range append([]*net.UDPConn{p.Listener, p.MulticastListener}, p.Listeners...) {
+		if conn != nil {
+			// Wakes the reads up, which then stop
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	if p.AdminListener != nil {
+		p.AdminListener.Close()
+	}
+	return p.Shutdown(ctx)
+}
+
+// continuesTransfer reports whether the request with options asks for a
+// block after the first one of a block-wise transfer.
+func continuesTransfer(options []rawOption) bool {
+	for _, id := range []uint16{optionBlock1, optionBlock2} {
+		if value, found := findOption(options, id); found {
+			if block, err := parseBlockOption(value); err == nil && block.Num > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shuttingDown returns the 5.03 response to the request m with options if
+// the proxy is shutting down and m doesn't continue a block-wise transfer
+// (or the drain deadline has passed), else nil.
+func (p *proxyHandler) shuttingDown(m *coap.Message, options []rawOption) *translatedCOAPMessage {
+	if !p.life.isDraining() {
+		return nil
+	}
+	select {
+	case <-p.life.aborted:
+	default:
+		if continuesTransfer(options) {
+			return nil
+		}
+	}
+	return p.errorResponse(m, coap.ServiceUnavailable, "shutting down")
+}
@@ -0,0 +1,186 @@
+package crosscoap
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// shutdownClient sends CoAP requests to addr, each from its own port, and
+// returns the responses, skipping the empty ACKs of separate responses.
+func shutdownClient(t *testing.T, addr string) func(mid uint16, path string) *coap.Message {
+	return func(mid uint16, path string) *coap.Message {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Error dialing: %v", err)
+		}
+		defer conn.Close()
+		req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: mid, Token: []byte{byte(mid)}}
+		req.SetPathString(path)
+		data, _ := req.MarshalBinary()
+		if _, err := conn.Write(data); err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		for {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, maxCOAPPacketLen)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Error receiving response to %v: %v", path, err)
+			}
+			m, err := coap.ParseMessage(buf[:n])
+			if err != nil {
+				t.Fatalf("Error parsing message: %v", err)
+			}
+			if m.Type == coap.Confirmable {
+				ack, _ := (&coap.Message{Type: coap.Acknowledgement, MessageID: m.MessageID}).MarshalBinary()
+				conn.Write(ack)
+			}
+			if m.Code != 0 {
+				return &m
+			}
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, deadline := range []bool{false, true} {
+		started := make(chan bool, 1)
+		release := make(chan bool)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				started <- true
+				<-release
+			}
+			w.Write([]byte("ok"))
+		}))
+		udpListener, crosscoapAddr := createLocalUDPListener(t)
+		proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, DrainTimeout: 5 * time.Second}
+		if deadline {
+			proxy.DrainTimeout = 100 * time.Millisecond
+		}
+		served := make(chan error, 1)
+		go func() { served <- proxy.Serve() }()
+		send := shutdownClient(t, crosscoapAddr)
+
+		slow := make(chan *coap.Message, 1)
+		go func() { slow <- send(1, "/slow") }()
+		<-started
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- proxy.Shutdown(context.Background()) }()
+		for !proxy.lifecycle().isDraining() {
+			time.Sleep(time.Millisecond)
+		}
+
+		if deadline {
+			if resp := <-slow; resp.Code != coap.ServiceUnavailable {
+				t.Errorf("response to the request in progress at the deadline is %v", resp.Code)
+			}
+		} else {
+			if resp := send(2, "/fast"); resp.Code != coap.ServiceUnavailable {
+				t.Errorf("response to a new request is %v", resp.Code)
+			}
+			release <- true
+			if resp := <-slow; resp.Code != coap.Content || string(resp.Payload) != "ok" {
+				t.Errorf("response to the request in progress is %v '%s'", resp.Code, resp.Payload)
+			}
+		}
+		if err := <-shutdown; err != nil {
+			t.Errorf("Shutdown returned %v", err)
+		}
+		if err := <-served; err != ErrProxyClosed {
+			t.Errorf("Serve returned %v", err)
+		}
+		close(release)
+		backend.Close()
+	}
+}
+
+func TestShutdownWithBlockwiseTransfer(t *testing.T) {
+	p := newProxyHandler(&Proxy{})
+	m, options := block2Request(1, &blockOption{Num: 1, SZX: 2})
+	if resp := p.shuttingDown(m, options); resp != nil {
+		t.Errorf("response before shutdown is %v", resp.Code)
+	}
+	close(p.life.draining)
+	if resp := p.shuttingDown(m, options); resp != nil {
+		t.Errorf("response to the next block while draining is %v", resp.Code)
+	}
+	first, firstOptions := block2Request(2, &blockOption{SZX: 2})
+	if resp := p.shuttingDown(first, firstOptions); resp == nil || resp.Code != coap.ServiceUnavailable {
+		t.Errorf("response to the first block while draining is %v", resp)
+	}
+	close(p.life.aborted)
+	if resp := p.shuttingDown(m, options); resp == nil || resp.Code != coap.ServiceUnavailable {
+		t.Errorf("response to the next block after the deadline is %v", resp)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-release
+		}
+		w.Write([]byte("old"))
+	}))
+	defer backend.Close()
+	newBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer newBackend.Close()
+	udpListener, crosscoapAddr := createLocalUDPListener(t)
+	proxy := Proxy{Listener: udpListener, BackendURL: backend.URL, DrainTimeout: 5 * time.Second}
+	served := make(chan error, 1)
+	go func() { served <- proxy.Serve() }()
+	send := shutdownClient(t, crosscoapAddr)
+
+	slow := make(chan *coap.Message, 1)
+	go func() { slow <- send(1, "/slow") }()
+	<-started
+
+	// The new process shares the socket through its own file descriptor
+	f, err := udpListener.File()
+	if err != nil {
+		t.Fatalf("Error duplicating the listener: %v", err)
+	}
+	inherited, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error inheriting the listener: %v", err)
+	}
+	newProxy := Proxy{Listener: inherited.(*net.UDPConn), BackendURL: newBackend.URL}
+	go newProxy.Serve()
+	defer newProxy.Shutdown(context.Background())
+
+	handover := make(chan error, 1)
+	go func() { handover <- proxy.Handover(context.Background()) }()
+	for !proxy.lifecycle().isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := uint16(2); i < 5; i++ {
+		if resp := send(i, "/fast"); resp.Code != coap.Content || string(resp.Payload) != "new" {
+			t.Errorf("response to a new request is %v '%s'", resp.Code, resp.Payload)
+		}
+	}
+	release <- true
+	if resp := <-slow; resp.Code != coap.Content || string(resp.Payload) != "old" {
+		t.Errorf("response to the request in progress is %v '%s'", resp.Code, resp.Payload)
+	}
+	if err := <-handover; err != nil {
+		t.Errorf("Handover returned %v", err)
+	}
+	if err := <-served; err != ErrProxyClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	if resp := send(5, "/fast"); resp.Code != coap.Content || string(resp.Payload) != "new" {
+		t.Errorf("response once handed over is %v '%s'", resp.Code, resp.Payload)
+	}
+}
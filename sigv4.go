@@ -0,0 +1,223 @@
+package crosscoap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Credentials holds the AWS access key pair (and optional session token) used
+// to sign backend requests.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// CredentialsProvider supplies the credentials for signing.  Retrieve is
+// called for every signed request, so implementations which fetch temporary
+// credentials should cache them.
+type CredentialsProvider interface {
+	Retrieve() (Credentials, error)
+}
+
+// StaticCredentials is a CredentialsProvider which always returns the same
+// credentials.
+type StaticCredentials Credentials
+
+// Retrieve returns the static credentials.
+func (c StaticCredentials) Retrieve() (Credentials, error) {
+	return Credentials(c), nil
+}
+
+// EnvCredentials is a CredentialsProvider which reads the credentials from
+// the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables.
+type EnvCredentials struct{}
+
+// Retrieve returns the credentials found in the environment.
+func (EnvCredentials) Retrieve() (Credentials, error) {
+	c := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return Credentials{}, errors.New("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return c, nil
+}
+
+// SigV4Signer signs backend requests with AWS Signature Version 4, allowing
+// BackendURL to point at API Gateway, S3 and other AWS style endpoints.
+type SigV4Signer struct {
+	// AWS region of the backend, for example "us-east-1".
+	Region string
+
+	// AWS service name of the backend, for example "execute-api" or "s3".
+	Service string
+
+	// Credentials provides the access keys used for signing.
+	Credentials CredentialsProvider
+}
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+)
+
+// Sign adds the X-Amz-Date and Authorization headers (and X-Amz-Security-Token
+// for temporary credentials) to req.  The signature covers the Host and
+// Content-Type headers, all X-Amz-* headers and the request body.
+func (s *SigV4Signer) Sign(req *http.Request, t time.Time) error {
+	creds, err := s.Credentials.Retrieve()
+	if err != nil {
+		return err
+	}
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+	t = t.UTC()
+	payloadHash := hashHex(body)
+	req.Header.Set("X-Amz-Date", t.Format(sigV4TimeFormat))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signedHeaders, headers := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s.canonicalURI(req),
+		canonicalQueryString(req),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{t.Format(sigV4DateFormat), s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4TimeFormat),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), t.Format(sigV4DateFormat))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, nil
+	}
+	r, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (s *SigV4Signer) canonicalURI(req *http.Request) string {
+	path := req.URL.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	if s.Service == "s3" {
+		return path
+	}
+	// All services except S3 expect each path segment to be encoded twice
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = sigV4Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQueryString(req *http.Request) string {
+	query := req.URL.Query()
+	parts := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			parts = append(parts, sigV4Escape(key)+"="+sigV4Escape(value))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name != "content-type" && !strings.HasPrefix(name, "x-amz-") {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), canonical.String()
+}
+
+// sigV4Escape percent-encodes every byte except the RFC 3986 unreserved
+// characters, as required for the canonical request.
+func sigV4Escape(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
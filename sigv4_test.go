@@ -0,0 +1,56 @@
+package crosscoap
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCredentials = StaticCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSigV4SignMatchesAWSExample(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatalf("Error creating test HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signer := SigV4Signer{Region: "us-east-1", Service: "iam", Credentials: testCredentials}
+	if err := signer.Sign(req, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Authorization is '%v'", auth)
+	}
+	if req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+		t.Errorf("X-Amz-Date is '%v'", req.Header.Get("X-Amz-Date"))
+	}
+}
+
+func TestSigV4SignS3WithSessionToken(t *testing.T) {
+	req, err := http.NewRequest("PUT", "https://bucket.s3.amazonaws.com/some/key", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("Error creating test HTTP request: %v", err)
+	}
+	creds := testCredentials
+	creds.SessionToken = "SESSION"
+	signer := SigV4Signer{Region: "us-east-1", Service: "s3", Credentials: creds}
+	if err := signer.Sign(req, time.Now()); err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") != hashHex([]byte("payload")) {
+		t.Errorf("X-Amz-Content-Sha256 is '%v'", req.Header.Get("X-Amz-Content-Sha256"))
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "SESSION" {
+		t.Errorf("X-Amz-Security-Token is '%v'", req.Header.Get("X-Amz-Security-Token"))
+	}
+	if !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Authorization is '%v'", req.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,318 @@
+package crosscoap
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// defaultSLOWindow is the SLOWindow of a proxy with RouteSLOs.
+const defaultSLOWindow = 5 * time.Minute
+
+// sloBuckets is the number of slices of the SLO window, the oldest of which
+// is dropped as the window rolls.
+const sloBuckets = 10
+
+// sloSamples is the number of latencies sampled in each slice of the SLO
+// window.
+const sloSamples = 256
+
+// sloMinRequests is the number of requests to a route within the SLO window
+// below which its objectives aren't checked.
+const sloMinRequests = 20
+
+// The measurements of the SLO window, labeled by route.
+const (
+	// metricRouteLatency is the latency of the requests within the window,
+	// labeled by quantile too ("0.5", "0.95" and "0.99").
+	metricRouteLatency = "route_latency_seconds"
+	// metricRouteErrorRate is the fraction of 5.xx responses.
+	metricRouteErrorRate = "route_error_rate"
+	// metricSLOBreaches counts the objectives found breached, labeled by
+	// objective too: latency or error_rate.
+	metricSLOBreaches = "slo_breaches"
+)
+
+// RouteSLO is a service level objective of the requests whose path lies
+// below PathPrefix, checked over the SLOWindow.
+type RouteSLO struct {
+	PathPrefix string
+
+	// P99Latency is the maximum 99th percentile of the time taken to
+	// answer the requests.  If zero, latency isn't checked.
+	P99Latency time.Duration
+
+	// ErrorRate is the maximum fraction of requests answered with a 5.xx
+	// code, such as 0.01.  If zero, errors aren't checked.
+	ErrorRate float64
+}
+
+// RouteSLOStats are the statistics of the requests to a route over the
+// SLOWindow.
+type RouteSLOStats struct {
+	Route     string  `json:"route"`
+	Requests  uint64  `json:"requests"`
+	ErrorRate float64 `json:"errorRate"` // of 5.xx responses
+	// Latency percentiles, estimated from a sample of the requests
+	P50Latency time.Duration `json:"p50LatencyNanos"`
+	P95Latency time.Duration `json:"p95LatencyNanos"`
+	P99Latency time.Duration `json:"p99LatencyNanos"`
+	// Payload sizes, in bytes
+	MeanRequestSize  float64 `json:"meanRequestSize"`
+	MaxRequestSize   int     `json:"maxRequestSize"`
+	MeanResponseSize float64 `json:"meanResponseSize"`
+	MaxResponseSize  int     `json:"maxResponseSize"`
+	// Breached lists the objectives of the route not met: "latency" or
+	// "error_rate".
+	Breached []string `json:"breached,omitempty"`
+}
+
+// sloBucket is the statistics of the requests to a route within a slice of
+// the SLO window.
+type sloBucket struct {
+	start         time.Time
+	requests      uint64
+	errors        uint64
+	latencies     []time.Duration // a uniform sample
+	requestBytes  uint64
+	responseBytes uint64
+	maxRequest    int
+	maxResponse   int
+}
+
+// sloWindow keeps the rolling statistics of the requests to each route and
+// checks their RouteSLOs.
+type sloWindow struct {
+	window time.Duration
+	slos   []RouteSLO
+
+	mu       sync.Mutex
+	routes   map[string]*[sloBuckets]sloBucket
+	breached map[string]bool // by route and objective
+}
+
+// newSLOWindow returns the SLO window of the proxy, or nil if it has
+// neither SLOWindow nor RouteSLOs.
+func (p *Proxy) newSLOWindow() *sloWindow {
+	window := p.SLOWindow
+	if window <= 0 {
+		if len(p.RouteSLOs) == 0 {
+			return nil
+		}
+		window = defaultSLOWindow
+	}
+	return &sloWindow{
+		window:   window,
+		slos:     p.RouteSLOs,
+		routes:   make(map[string]*[sloBuckets]sloBucket),
+		breached: make(map[string]bool),
+	}
+}
+
+// route returns the route which the statistics of path are kept under: the
+// PathPrefix of its RouteSLO, or else route.
+func (w *sloWindow) route(path, route string) (string, *RouteSLO) {
+	for i := range w.slos {
+		if hasPathPrefix(path, w.slos[i].PathPrefix) {
+			return "/" + strings.Trim(w.slos[i].PathPrefix, "/"), &w.slos[i]
+		}
+	}
+	return route, nil
+}
+
+// record adds the request m to route, answered by coapResp (nil if none was
+// sent) after latency at now.
+func (w *sloWindow) record(route string, m *coap.Message, coapResp *translatedCOAPMessage, latency time.Duration, now time.Time) {
+	if w == nil {
+		return
+	}
+	route, _ = w.route(m.PathString(), route)
+	width := w.window / sloBuckets
+	start := now.Truncate(width)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	buckets := w.routes[route]
+	if buckets == nil {
+		buckets = new([sloBuckets]sloBucket)
+		w.routes[route] = buckets
+	}
+	b := &buckets[int(now.UnixNano()/int64(width))%sloBuckets]
+	if !b.start.Equal(start) {
+		*b = sloBucket{start: start, latencies: b.latencies[:0]}
+	}
+	b.requests++
+	if len(b.latencies) < sloSamples {
+		b.latencies = append(b.latencies, latency)
+	} else if i := rand.Int63n(int64(b.requests)); i < sloSamples {
+		b.latencies[i] = latency
+	}
+	b.requestBytes += uint64(len(m.Payload))
+	if len(m.Payload) > b.maxRequest {
+		b.maxRequest = len(m.Payload)
+	}
+	if coapResp == nil {
+		return
+	}
+	if coapResp.Code >= coap.InternalServerError {
+		b.errors++
+	}
+	b.responseBytes += uint64(len(coapResp.Payload))
+	if len(coapResp.Payload) > b.maxResponse {
+		b.maxResponse = len(coapResp.Payload)
+	}
+}
+
+// stats returns the statistics of route over the window ending at now,
+// with the objectives of slo it breaches.  The caller holds w.mu.
+func (w *sloWindow) stats(route string, buckets *[sloBuckets]sloBucket, slo *RouteSLO, now time.Time) RouteSLOStats {
+	stats := RouteSLOStats{Route: route}
+	var errors, requestBytes, responseBytes uint64
+	var latencies []time.Duration
+	// Each latency stands for the requests of its bucket in proportion
+	var weights []float64
+	for i := range buckets {
+		b := &buckets[i]
+		if b.requests == 0 || !b.start.After(now.Add(-w.window)) {
+			continue
+		}
+		stats.Requests += b.requests
+		errors += b.errors
+		requestBytes += b.requestBytes
+		responseBytes += b.responseBytes
+		if b.maxRequest > stats.MaxRequestSize {
+			stats.MaxRequestSize = b.maxRequest
+		}
+		if b.maxResponse > stats.MaxResponseSize {
+			stats.MaxResponseSize = b.maxResponse
+		}
+		for _, latency := range b.latencies {
+			latencies = append(latencies, latency)
+			weights = append(weights, float64(b.requests)/float64(len(b.latencies)))
+		}
+	}
+	if stats.Requests == 0 {
+		return stats
+	}
+	stats.ErrorRate = float64(errors) / float64(stats.Requests)
+	stats.MeanRequestSize = float64(requestBytes) / float64(stats.Requests)
+	stats.MeanResponseSize = float64(responseBytes) / float64(stats.Requests)
+	percentiles := weightedPercentiles(latencies, weights, 0.5, 0.95, 0.99)
+	stats.P50Latency, stats.P95Latency, stats.P99Latency = percentiles[0], percentiles[1], percentiles[2]
+	if slo != nil && stats.Requests >= sloMinRequests {
+		if slo.P99Latency > 0 && stats.P99Latency > slo.P99Latency {
+			stats.Breached = append(stats.Breached, "latency")
+		}
+		if slo.ErrorRate > 0 && stats.ErrorRate > slo.ErrorRate {
+			stats.Breached = append(stats.Breached, "error_rate")
+		}
+	}
+	return stats
+}
+
+// weightedPercentiles returns the quantiles of latencies, each counting for
+// its weight.
+func weightedPercentiles(latencies []time.Duration, weights []float64, quantiles ...float64) []time.Duration {
+	indexes := make([]int, len(latencies))
+	var total float64
+	for i := range indexes {
+		indexes[i] = i
+		total += weights[i]
+	}
+	sort.Slice(indexes, func(i, j int) bool { return latencies[indexes[i]] < latencies[indexes[j]] })
+	results := make([]time.Duration, len(quantiles))
+	var cumulated float64
+	q := 0
+	for _, i := range indexes {
+		cumulated += weights[i]
+		for q < len(quantiles) && cumulated >= quantiles[q]*total {
+			results[q] = latencies[i]
+			q++
+		}
+	}
+	for ; q < len(quantiles); q++ {
+		results[q] = latencies[indexes[len(indexes)-1]]
+	}
+	return results
+}
+
+// snapshot returns the statistics of the routes over the window ending at
+// now, sorted by route.
+func (w *sloWindow) snapshot(now time.Time) []RouteSLOStats {
+	snapshot := []RouteSLOStats{}
+	if w == nil {
+		return snapshot
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for route, buckets := range w.routes {
+		_, slo := w.route(route, route)
+		stats := w.stats(route, buckets, slo, now)
+		if stats.Requests == 0 {
+			// Idle for the whole window
+			delete(w.routes, route)
+			continue
+		}
+		snapshot = append(snapshot, stats)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Route < snapshot[j].Route })
+	return snapshot
+}
+
+// checkSLOs measures the statistics of the routes and checks their
+// objectives every slice of the SLO window until done is closed.
+func (p *proxyHandler) checkSLOs(done <-chan struct{}) {
+	w := p.slo
+	if w == nil {
+		return
+	}
+	ticker := time.NewTicker(w.window / sloBuckets)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.checkSLOWindow(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkSLOWindow measures the statistics of the routes at now, and logs
+// the objectives which get breached or met again.
+func (p *proxyHandler) checkSLOWindow(now time.Time) {
+	w := p.slo
+	metrics := p.metrics()
+	for _, stats := range w.snapshot(now) {
+		route := Labels{"route": stats.Route}
+		for quantile, latency := range map[string]time.Duration{"0.5": stats.P50Latency, "0.95": stats.P95Latency, "0.99": stats.P99Latency} {
+			metrics.Gauge(metricRouteLatency, latency.Seconds(), Labels{"route": stats.Route, "quantile": quantile})
+		}
+		metrics.Gauge(metricRouteErrorRate, stats.ErrorRate, route)
+		_, slo := w.route(stats.Route, stats.Route)
+		if slo == nil {
+			continue
+		}
+		breaches := map[string]bool{"latency": false, "error_rate": false}
+		for _, objective := range stats.Breached {
+			breaches[objective] = true
+		}
+		for objective, breached := range breaches {
+			key := stats.Route + " " + objective
+			w.mu.Lock()
+			changed := w.breached[key] != breached
+			w.breached[key] = breached
+			w.mu.Unlock()
+			switch {
+			case changed && breached:
+				metrics.Counter(metricSLOBreaches, 1, Labels{"route": stats.Route, "objective": objective})
+				p.logError("SLO breached on %v: p99 latency %v (objective %v), error rate %.4f (objective %v) over %v requests", stats.Route, stats.P99Latency, slo.P99Latency, stats.ErrorRate, slo.ErrorRate, stats.Requests)
+			case changed:
+				p.logError("SLO met again on %v: %v", stats.Route, strings.Replace(objective, "_", " ", -1))
+			}
+		}
+	}
+}
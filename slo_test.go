@@ -0,0 +1,79 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestSLOWindow(t *testing.T) {
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{
+		SLOWindow: time.Minute,
+		RouteSLOs: []RouteSLO{{PathPrefix: "/telemetry/", P99Latency: 50 * time.Millisecond, ErrorRate: 0.1}},
+		Metrics:   metrics,
+	})
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: uint16(i), Payload: make([]byte, i)}
+		m.SetPathString("/telemetry/temp")
+		coapResp := &translatedCOAPMessage{Message: coap.Message{Code: coap.Changed, Payload: []byte("ok")}}
+		if i%5 == 0 {
+			coapResp.Code = coap.ServiceUnavailable
+		}
+		p.slo.record("/telemetry", m, coapResp, time.Duration(i)*time.Millisecond, now.Add(-time.Duration(i)*100*time.Millisecond))
+	}
+	m := &coap.Message{Type: coap.NonConfirmable, Code: coap.GET, MessageID: 1000}
+	m.SetPathString("/other")
+	p.slo.record("/other", m, nil, time.Millisecond, now)
+
+	snapshot := p.slo.snapshot(now)
+	if len(snapshot) != 2 || snapshot[0].Route != "/other" || snapshot[1].Route != "/telemetry" {
+		t.Fatalf("snapshot is %+v", snapshot)
+	}
+	stats := snapshot[1]
+	if stats.Requests != 100 || stats.ErrorRate != 0.2 || stats.P50Latency != 50*time.Millisecond || stats.P99Latency != 99*time.Millisecond {
+		t.Errorf("statistics are %+v", stats)
+	}
+	if stats.MeanRequestSize != 50.5 || stats.MaxRequestSize != 100 || stats.MeanResponseSize != 2 || stats.MaxResponseSize != 2 {
+		t.Errorf("payload sizes are %+v", stats)
+	}
+	if strings.Join(stats.Breached, ",") != "latency,error_rate" {
+		t.Errorf("breached objectives are %v", stats.Breached)
+	}
+	if len(snapshot[0].Breached) != 0 {
+		t.Errorf("breached objectives of a route without SLO are %v", snapshot[0].Breached)
+	}
+
+	w := adminRequest(p.adminHandler("secret"), "GET", "/slo", "secret", "")
+	var served []RouteSLOStats
+	if err := json.Unmarshal(w.Body.Bytes(), &served); w.Code != http.StatusOK || err != nil || len(served) != 2 {
+		t.Errorf("/slo response is %v: %v", w.Code, w.Body)
+	}
+
+	p.checkSLOWindow(now)
+	p.checkSLOWindow(now)
+	w = adminRequest(p.adminHandler("secret"), "GET", "/metrics", "secret", "")
+	if n := strings.Count(w.Body.String(), `crosscoap_slo_breaches_total{`); n != 2 {
+		t.Errorf("%v breach metrics: %v", n, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `crosscoap_route_latency_seconds{quantile="0.99",route="/telemetry"} 0.099`) {
+		t.Errorf("latency metrics are missing: %v", w.Body)
+	}
+
+	if snapshot := p.slo.snapshot(now.Add(2 * time.Minute)); len(snapshot) != 0 {
+		t.Errorf("snapshot after the window is %+v", snapshot)
+	}
+}
+
+func TestWeightedPercentiles(t *testing.T) {
+	latencies := []time.Duration{3, 1, 2, 4}
+	weights := []float64{1, 1, 1, 7}
+	if percentiles := weightedPercentiles(latencies, weights, 0.2, 0.3, 0.99); percentiles[0] != 2 || percentiles[1] != 3 || percentiles[2] != 4 {
+		t.Errorf("percentiles are %v", percentiles)
+	}
+}
@@ -0,0 +1,70 @@
+package crosscoap
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// optionStale is the experimental, elective option (RFC 7252 section
+// 12.2) marking the responses served from the cache while the backend
+// fails, whose Max-Age is 0.  It has no value.
+const optionStale uint16 = 65000
+
+// staleWarning is the Warning header of the backend responses served stale
+// (RFC 7234 section 5.5.1), which the translator turns to the Stale option.
+const staleWarning = `110 crosscoap "Response is Stale"`
+
+// metricStaleResponses counts the stale responses served because the
+// backend failed.
+const metricStaleResponses = "stale_responses"
+
+// isStale reports whether the backend response with header is stale.
+func isStale(header http.Header) bool {
+	for _, warning := range header.Values("Warning") {
+		if strings.HasPrefix(warning, "110 ") {
+			return true
+		}
+	}
+	return false
+}
+
+// lastKnownGood returns the successful cached response to req which has
+// expired at now but is still kept for ServeStale, or nil.
+func (c *responseCache) lastKnownGood(req *http.Request, now time.Time) *cachedResponse {
+	if c == nil || c.staleTTL <= 0 || !cacheable(req) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resource := cacheKey(req)
+	vary := defaultVary
+	if r := c.resources[resource]; r != nil {
+		vary = r.vary
+	}
+	e := c.entries[variantKey(resource, req, vary)]
+	if e == nil || e.statusCode >= 400 || !now.Before(e.expires.Add(c.staleTTL)) {
+		return nil
+	}
+	c.lru.MoveToFront(e.element)
+	return e
+}
+
+// serveStale returns the last known good response to req, marked stale,
+// in place of the failed backend response, as sendHTTPRequest does with
+// limit, and false if there's none.
+func (p *proxyHandler) serveStale(req *http.Request, limit int, failure interface{}) (*http.Response, []byte, io.ReadCloser, bool) {
+	now := time.Now()
+	e := p.cache.lastKnownGood(req, now)
+	if e == nil {
+		return nil, nil, nil, false
+	}
+	httpResp, httpBody, rest := e.response(req, limit, now)
+	httpResp.Header.Set("Cache-Control", "max-age=0")
+	httpResp.Header.Add("Warning", staleWarning)
+	p.metrics().Counter(metricStaleResponses, 1, nil)
+	setCacheOutcome(req, "stale")
+	p.logError("Backend failed (%v), serving a response cached %v ago (Request-ID=%v)", failure, now.Sub(e.stored).Round(time.Second), req.Header.Get(requestIDHeader))
+	return httpResp, httpBody, rest, true
+}
@@ -0,0 +1,74 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestServeStale(t *testing.T) {
+	failing := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("config"))
+	}))
+	defer backend.Close()
+
+	for _, serveStale := range []time.Duration{0, time.Hour} {
+		failing = false
+		p := newProxyHandler(&Proxy{BackendURL: backend.URL, CacheMaxSize: 1 << 20, ServeStale: serveStale})
+		get := func() *translatedCOAPMessage {
+			req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+			req.SetPathString("/config")
+			return p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+		}
+		if coapResp := get(); coapResp == nil || coapResp.Code != coap.Content {
+			t.Fatalf("response is %v", coapResp)
+		}
+		for _, e := range p.cache.entries {
+			e.expires = time.Now().Add(-time.Minute)
+		}
+
+		failing = true
+		coapResp := get()
+		if serveStale == 0 {
+			if coapResp == nil || coapResp.Code != coap.ServiceUnavailable {
+				t.Errorf("response without ServeStale is %v", coapResp)
+			}
+			continue
+		}
+		if coapResp == nil || coapResp.Code != coap.Content || string(coapResp.Payload) != "config" {
+			t.Fatalf("stale response is %v", coapResp)
+		}
+		if maxAge, ok := coapResp.Option(coap.MaxAge).(uint32); !ok || maxAge != 0 {
+			t.Errorf("Max-Age of the stale response is %v", coapResp.Option(coap.MaxAge))
+		}
+		if _, found := findOption(coapResp.ExtraOptions, optionStale); !found {
+			t.Errorf("stale response options are %v", coapResp.ExtraOptions)
+		}
+
+		for _, e := range p.cache.entries {
+			e.expires = time.Now().Add(-2 * time.Hour)
+		}
+		if coapResp := get(); coapResp == nil || coapResp.Code != coap.ServiceUnavailable {
+			t.Errorf("response once too stale is %v", coapResp)
+		}
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	if isStale(http.Header{"Warning": {`199 - "Miscellaneous"`}}) {
+		t.Errorf("Warning 199 is stale")
+	}
+	if !isStale(http.Header{"Warning": {staleWarning}}) {
+		t.Errorf("Warning 110 isn't stale")
+	}
+}
@@ -0,0 +1,138 @@
+package crosscoap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// StaticRoute is a resource answered by the proxy itself, without a
+// backend round-trip, such as gateway information or a provisioning
+// bootstrap blob, which stays available when the backend is offline.
+type StaticRoute struct {
+	// Path is the path of the resource, for example "/gateway/info".
+	Path string
+
+	// Payload is the representation of the resource.
+	Payload []byte
+
+	// Template, if set, renders the representation of each request
+	// instead of Payload, given a StaticRequest: for example
+	// "{{.Time.Unix}}" for a /time resource.
+	Template *template.Template
+
+	// ContentFormat is the Content-Format of the representation (0 being
+	// text/plain).
+	ContentFormat coap.MediaType
+
+	// MaxAge is the freshness of the representation.  If zero, responses
+	// have the default Max-Age of 60 seconds, or 0 with a Template.
+	MaxAge time.Duration
+}
+
+// StaticRequest is the data given to the Template of a StaticRoute.
+type StaticRequest struct {
+	Time      time.Time
+	Path      string
+	Query     url.Values
+	Client    string
+	RequestID string
+	Hostname  string
+}
+
+// staticRoute returns the StaticRoutes entry of the path of m, or nil.
+func (p *Proxy) staticRoute(m *coap.Message) *StaticRoute {
+	path := strings.Trim(m.PathString(), "/")
+	for i := range p.StaticRoutes {
+		if strings.Trim(p.StaticRoutes[i].Path, "/") == path {
+			return &p.StaticRoutes[i]
+		}
+	}
+	return nil
+}
+
+// staticRoutePaths returns the paths of StaticRoutes.
+func (p *Proxy) staticRoutePaths() []string {
+	var paths []string
+	for _, route := range p.StaticRoutes {
+		paths = append(paths, route.Path)
+	}
+	return paths
+}
+
+// serveStatic answers the request m with options in the exchange rc with
+// the representation of route: GET and FETCH are answered with 2.05
+// Content, or 2.03 Valid if m carries its ETag, and other methods with 4.05
+// Method Not Allowed.
+func (p *proxyHandler) serveStatic(rc *RequestContext, m *coap.Message, options []rawOption, route *StaticRoute) *translatedCOAPMessage {
+	if m.Code != coap.GET && m.Code != FETCH {
+		return p.errorResponse(m, coap.MethodNotAllowed, "read-only resource")
+	}
+	payload := route.Payload
+	if route.Template != nil {
+		hostname, _ := os.Hostname()
+		query := make(url.Values)
+		for _, q := range m.Options(coap.URIQuery) {
+			if values, err := url.ParseQuery(q.(string)); err == nil {
+				for name, v := range values {
+					query[name] = append(query[name], v...)
+				}
+			}
+		}
+		var buf bytes.Buffer
+		err := route.Template.Execute(&buf, &StaticRequest{
+			Time:      rc.Received,
+			Path:      route.Path,
+			Query:     query,
+			Client:    rc.Client.String(),
+			RequestID: rc.RequestID,
+			Hostname:  hostname,
+		})
+		if err != nil {
+			p.logError("Error rendering static route %v: %v (Request-ID=%v)", route.Path, err, rc.RequestID)
+			return p.errorResponse(m, coap.InternalServerError, "static resource unavailable")
+		}
+		payload = buf.Bytes()
+	}
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	coapResp := &translatedCOAPMessage{
+		Message: coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+		},
+	}
+	sum := sha256.Sum256(payload)
+	etag := sum[:maxCOAPETagLen]
+	coapResp.SetOption(coap.ETag, etag)
+	if requestHasETag(m, etag) {
+		coapResp.Code = coap.Valid
+		payload = nil
+	} else {
+		coapResp.SetOption(coap.ContentFormat, route.ContentFormat)
+	}
+	switch {
+	case route.MaxAge > 0:
+		coapResp.SetOption(coap.MaxAge, uint32(route.MaxAge/time.Second))
+	case route.Template != nil:
+		coapResp.SetOption(coap.MaxAge, uint32(0))
+	}
+	headers, err := marshalMessage(&coapResp.Message, nil)
+	if err != nil {
+		return p.errorResponse(m, coap.InternalServerError, "static resource unavailable")
+	}
+	p.translator.setPayload(coapResp, payload, len(headers))
+	if coapResp.IsTruncated {
+		return p.handleOversize(rc, m, options, coapResp, nil, int64(len(payload)), p.oversizePolicy(m))
+	}
+	return coapResp
+}
@@ -0,0 +1,64 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestStaticRoutes(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	p := newProxyHandler(&Proxy{
+		BackendURL:     "http://127.0.0.1:1",
+		OversizePolicy: Block2Oversize,
+		StaticRoutes: []StaticRoute{
+			{Path: "/gateway/info", Payload: []byte(`{"model":"gw1"}`), ContentFormat: coap.AppJSON, MaxAge: time.Hour},
+			{Path: "echo", Template: template.Must(template.New("echo").Parse(`{{.Path}} {{.Query.Get "x"}}`))},
+			{Path: "/bootstrap", Payload: large, ContentFormat: coap.AppOctets},
+		},
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	request := func(code coap.COAPCode, path string, etag []byte) *translatedCOAPMessage {
+		m := &coap.Message{Type: coap.Confirmable, Code: code, MessageID: 1, Token: []byte{1, 2}}
+		m.SetPathString(path)
+		m.AddOption(coap.URIQuery, "x=42")
+		if etag != nil {
+			m.AddOption(coap.ETag, etag)
+		}
+		return p.handleRequest(a, m, nil)
+	}
+
+	coapResp := request(coap.GET, "/gateway/info", nil)
+	if coapResp == nil || coapResp.Code != coap.Content || string(coapResp.Payload) != `{"model":"gw1"}` {
+		t.Fatalf("static response is '%v'", coapResp)
+	}
+	if coapResp.Option(coap.ContentFormat) != coap.AppJSON || coapResp.Option(coap.MaxAge) != uint32(3600) {
+		t.Errorf("static response options are %v and %v", coapResp.Option(coap.ContentFormat), coapResp.Option(coap.MaxAge))
+	}
+	etag, _ := coapResp.Option(coap.ETag).([]byte)
+	if coapResp := request(coap.GET, "/gateway/info", etag); coapResp == nil || coapResp.Code != coap.Valid || len(coapResp.Payload) != 0 {
+		t.Errorf("static response with its ETag is '%v'", coapResp)
+	}
+	if coapResp := request(coap.POST, "/gateway/info", nil); coapResp == nil || coapResp.Code != coap.MethodNotAllowed {
+		t.Errorf("static response to POST is '%v'", coapResp)
+	}
+
+	coapResp = request(coap.GET, "/echo", nil)
+	if coapResp == nil || coapResp.Code != coap.Content || string(coapResp.Payload) != "echo 42" {
+		t.Errorf("templated response is '%v'", coapResp)
+	} else if coapResp.Option(coap.MaxAge) != uint32(0) {
+		t.Errorf("templated response Max-Age is %v", coapResp.Option(coap.MaxAge))
+	}
+
+	coapResp = request(coap.GET, "/bootstrap", nil)
+	if value, found := findOption(coapResp.ExtraOptions, optionBlock2); !found || coapResp.IsTruncated {
+		t.Errorf("large static response has no Block2 option")
+	} else if block, _ := parseBlockOption(value); block.Num != 0 || !block.More || !strings.HasPrefix(string(large), string(coapResp.Payload)) {
+		t.Errorf("first block is %+v: '%s'", block, coapResp.Payload)
+	}
+}
@@ -0,0 +1,76 @@
+package crosscoap
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// RouteStats are the statistics of the requests to a route: the path prefix
+// of the first matching of Routes, or else the first segment of the request
+// path.
+type RouteStats struct {
+	Route      string            `json:"route"`
+	Requests   uint64            `json:"requests"`
+	Responses  map[string]uint64 `json:"responses"` // by CoAP code, e.g. "2.05"
+	NoResponse uint64            `json:"noResponse"`
+	// Total and maximum time spent handling the requests
+	TotalLatency time.Duration `json:"totalLatencyNanos"`
+	MaxLatency   time.Duration `json:"maxLatencyNanos"`
+}
+
+// routeStats collects the RouteStats of a proxy.
+type routeStats struct {
+	mu     sync.Mutex
+	routes map[string]*RouteStats
+}
+
+func newRouteStats() *routeStats {
+	return &routeStats{routes: make(map[string]*RouteStats)}
+}
+
+func (s *routeStats) record(route string, coapResp *translatedCOAPMessage, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.routes[route]
+	if stats == nil {
+		stats = &RouteStats{Route: route, Responses: make(map[string]uint64)}
+		s.routes[route] = stats
+	}
+	stats.Requests++
+	if coapResp == nil {
+		stats.NoResponse++
+	} else {
+		stats.Responses[codeString(coapResp.Code)]++
+	}
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+}
+
+// codeString returns a CoAP response code as written in RFC 7252, such as
+// "2.05".
+func codeString(code coap.COAPCode) string {
+	return fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+}
+
+// snapshot returns a copy of the statistics, sorted by route.
+func (s *routeStats) snapshot() []RouteStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make([]RouteStats, 0, len(s.routes))
+	for _, stats := range s.routes {
+		copied := *stats
+		copied.Responses = make(map[string]uint64, len(stats.Responses))
+		for code, n := range stats.Responses {
+			copied.Responses[code] = n
+		}
+		snapshot = append(snapshot, copied)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Route < snapshot[j].Route })
+	return snapshot
+}
@@ -0,0 +1,78 @@
+package crosscoap
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsDMetrics sends the measurements to a StatsD server over UDP, one
+// datagram per measurement, with metric names prefixed by the prefix and a
+// dot.  Plain StatsD has no labels, so they are dropped, and histograms are
+// sent as timers; with DogStatsD, labels are sent as tags and histograms as
+// such.  Measurements which can't be sent are lost.
+type StatsDMetrics struct {
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+}
+
+// NewStatsDMetrics returns metrics sent to the StatsD (or, if dogStatsD,
+// DogStatsD) server at the UDP address (e.g. "127.0.0.1:8125"), prefixed by
+// prefix (e.g. "crosscoap") if not empty.
+func NewStatsDMetrics(address, prefix string, dogStatsD bool) (*StatsDMetrics, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDMetrics{conn: conn, prefix: prefix, dogStatsD: dogStatsD}, nil
+}
+
+// Close closes the connection to the StatsD server.
+func (m *StatsDMetrics) Close() error {
+	return m.conn.Close()
+}
+
+func (m *StatsDMetrics) Counter(name string, delta float64, labels Labels) {
+	m.send(name, delta, "c", labels)
+}
+
+func (m *StatsDMetrics) Gauge(name string, value float64, labels Labels) {
+	m.send(name, value, "g", labels)
+}
+
+func (m *StatsDMetrics) Histogram(name string, value float64, labels Labels) {
+	if m.dogStatsD {
+		m.send(name, value, "h", labels)
+		return
+	}
+	// Timers are in milliseconds
+	if strings.HasSuffix(name, "_seconds") {
+		name = strings.TrimSuffix(name, "_seconds")
+		value *= 1000
+	}
+	m.send(name, value, "ms", labels)
+}
+
+func (m *StatsDMetrics) send(name string, value float64, kind string, labels Labels) {
+	m.conn.Write([]byte(m.format(name, value, kind, labels)))
+}
+
+// format formats a measurement as a StatsD line, e.g.
+// "crosscoap.responses:1|c|#code:2.05".
+func (m *StatsDMetrics) format(name string, value float64, kind string, labels Labels) string {
+	if m.prefix != "" {
+		name = m.prefix + "." + name
+	}
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if !m.dogStatsD || len(labels) == 0 {
+		return line
+	}
+	tags := make([]string, 0, len(labels))
+	for name, value := range labels {
+		tags = append(tags, name+":"+value)
+	}
+	sort.Strings(tags)
+	return line + "|#" + strings.Join(tags, ",")
+}
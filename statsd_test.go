@@ -0,0 +1,52 @@
+package crosscoap
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsDMetrics(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	receive := func() string {
+		buf := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	m, err := NewStatsDMetrics(conn.LocalAddr().String(), "crosscoap", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.Counter("responses", 1, Labels{"code": "2.05"})
+	if line := receive(); line != "crosscoap.responses:1|c" {
+		t.Errorf("counter is '%v'", line)
+	}
+	m.Histogram("request_duration_seconds", 0.25, nil)
+	if line := receive(); line != "crosscoap.request_duration:250|ms" {
+		t.Errorf("timer is '%v'", line)
+	}
+
+	d, err := NewStatsDMetrics(conn.LocalAddr().String(), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.Gauge("requests_in_flight", 2, Labels{"route": "/a", "code": "2.05"})
+	if line := receive(); line != "requests_in_flight:2|g|#code:2.05,route:/a" {
+		t.Errorf("gauge is '%v'", line)
+	}
+	d.Histogram("request_duration_seconds", 0.25, nil)
+	if line := receive(); line != "request_duration_seconds:0.25|h" {
+		t.Errorf("histogram is '%v'", line)
+	}
+}
@@ -0,0 +1,122 @@
+package crosscoap
+
+import "time"
+
+// BackendState is what a BackendStrategy knows of a resolved backend
+// address.
+type BackendState struct {
+	Address string
+	// Weight is the static weight of the address in BackendWeights, or 1.
+	Weight float64
+	// Outstanding is the number of requests sent to the address and not
+	// answered yet.
+	Outstanding int
+	// Latency is the moving average of the time the address took to answer
+	// requests, or zero until it answered one.
+	Latency time.Duration
+}
+
+// BackendStrategy chooses the resolved backend address of each request.
+type BackendStrategy interface {
+	// Choose returns the index in backends, which isn't empty, of the
+	// address of the next request.  It isn't called concurrently by a
+	// proxy, but a strategy mustn't be shared by proxies.
+	Choose(backends []BackendState) int
+}
+
+// BackendStrategyFunc is a BackendStrategy implemented by a function.
+type BackendStrategyFunc func(backends []BackendState) int
+
+// Choose calls f.
+func (f BackendStrategyFunc) Choose(backends []BackendState) int {
+	return f(backends)
+}
+
+// NewRoundRobinStrategy returns a strategy sending requests to each address
+// in turn.
+func NewRoundRobinStrategy() BackendStrategy {
+	next := 0
+	return BackendStrategyFunc(func(backends []BackendState) int {
+		next++
+		return next % len(backends)
+	})
+}
+
+// NewWeightedStrategy returns a strategy sending requests to each address
+// in proportion to its weight, interleaving them (smooth weighted round
+// robin).  Addresses with no positive weight get no requests unless all
+// are such.
+func NewWeightedStrategy() BackendStrategy {
+	current := map[string]float64{}
+	return BackendStrategyFunc(func(backends []BackendState) int {
+		chosen, total := -1, 0.0
+		seen := make(map[string]bool, len(backends))
+		for i, b := range backends {
+			seen[b.Address] = true
+			if b.Weight <= 0 {
+				continue
+			}
+			current[b.Address] += b.Weight
+			total += b.Weight
+			if chosen < 0 || current[b.Address] > current[backends[chosen].Address] {
+				chosen = i
+			}
+		}
+		for address := range current {
+			if !seen[address] {
+				delete(current, address)
+			}
+		}
+		if chosen < 0 {
+			return 0
+		}
+		current[backends[chosen].Address] -= total
+		return chosen
+	})
+}
+
+// NewLeastLatencyStrategy returns a strategy sending requests to the
+// address with the lowest average response time, weighed by its
+// outstanding requests so that a fast address isn't swamped; addresses
+// which haven't answered yet are tried first.
+func NewLeastLatencyStrategy() BackendStrategy {
+	return BackendStrategyFunc(func(backends []BackendState) int {
+		chosen, best := 0, -1.0
+		for i, b := range backends {
+			if b.Latency == 0 && b.Outstanding == 0 {
+				return i
+			}
+			cost := float64(b.Latency) * float64(b.Outstanding+1)
+			if best < 0 || cost < best {
+				chosen, best = i, cost
+			}
+		}
+		return chosen
+	})
+}
+
+// NewLeastOutstandingStrategy returns a strategy sending requests to the
+// address with the fewest outstanding requests relative to its weight,
+// taking turns between equally loaded ones.
+func NewLeastOutstandingStrategy() BackendStrategy {
+	next := 0
+	return BackendStrategyFunc(func(backends []BackendState) int {
+		next++
+		chosen, best := -1, 0.0
+		for n := range backends {
+			i := (next + n) % len(backends)
+			weight := backends[i].Weight
+			if weight <= 0 {
+				continue
+			}
+			load := float64(backends[i].Outstanding) / weight
+			if chosen < 0 || load < best {
+				chosen, best = i, load
+			}
+		}
+		if chosen < 0 {
+			return next % len(backends)
+		}
+		return chosen
+	})
+}
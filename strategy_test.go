@@ -0,0 +1,93 @@
+package crosscoap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func chooseMany(s BackendStrategy, backends []BackendState, n int) map[string]int {
+	chosen := map[string]int{}
+	for i := 0; i < n; i++ {
+		chosen[backends[s.Choose(backends)].Address]++
+	}
+	return chosen
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	backends := []BackendState{{Address: "a"}, {Address: "b"}, {Address: "c"}}
+	if chosen := chooseMany(NewRoundRobinStrategy(), backends, 9); !reflect.DeepEqual(chosen, map[string]int{"a": 3, "b": 3, "c": 3}) {
+		t.Errorf("chosen are %v", chosen)
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	s := NewWeightedStrategy()
+	backends := []BackendState{{Address: "a", Weight: 3}, {Address: "b", Weight: 1}, {Address: "c", Weight: 0}}
+	var order string
+	for i := 0; i < 4; i++ {
+		order += backends[s.Choose(backends)].Address
+	}
+	if order != "aaba" {
+		t.Errorf("order is '%v'", order)
+	}
+	if chosen := chooseMany(s, backends, 40); !reflect.DeepEqual(chosen, map[string]int{"a": 30, "b": 10}) {
+		t.Errorf("chosen are %v", chosen)
+	}
+	if chosen := chooseMany(s, []BackendState{{Address: "c"}}, 2); chosen["c"] != 2 {
+		t.Errorf("chosen without weights are %v", chosen)
+	}
+}
+
+func TestLeastLatencyStrategy(t *testing.T) {
+	s := NewLeastLatencyStrategy()
+	backends := []BackendState{
+		{Address: "slow", Latency: 100 * time.Millisecond},
+		{Address: "fast", Latency: 10 * time.Millisecond},
+	}
+	if i := s.Choose(backends); i != 1 {
+		t.Errorf("chosen is %v", backends[i].Address)
+	}
+	backends[1].Outstanding = 20
+	if i := s.Choose(backends); i != 0 {
+		t.Errorf("chosen with a busy fast backend is %v", backends[i].Address)
+	}
+	backends = append(backends, BackendState{Address: "new"})
+	if i := s.Choose(backends); i != 2 {
+		t.Errorf("chosen with a new backend is %v", backends[i].Address)
+	}
+}
+
+func TestLeastOutstandingStrategy(t *testing.T) {
+	s := NewLeastOutstandingStrategy()
+	backends := []BackendState{
+		{Address: "a", Weight: 1, Outstanding: 2},
+		{Address: "b", Weight: 1, Outstanding: 1},
+		{Address: "c", Weight: 4, Outstanding: 3},
+	}
+	if i := s.Choose(backends); i != 2 {
+		t.Errorf("chosen is %v", backends[i].Address)
+	}
+	backends[2].Outstanding = 4
+	if chosen := chooseMany(s, backends, 4); !reflect.DeepEqual(chosen, map[string]int{"b": 2, "c": 2}) {
+		t.Errorf("chosen among equally loaded backends are %v", chosen)
+	}
+}
+
+func TestBackendPoolLoad(t *testing.T) {
+	b := &backendPool{strategy: NewLeastOutstandingStrategy(), weights: map[string]float64{"b": 2}}
+	b.update([]string{"b", "a"})
+	first, second, third := b.pick(), b.pick(), b.pick()
+	if first.address != "b" || second.address != "a" || third.address != "b" {
+		t.Errorf("picked %v, %v and %v", first.address, second.address, third.address)
+	}
+	b.done(first, 100*time.Millisecond, nil)
+	b.done(third, 200*time.Millisecond, nil)
+	if first.outstanding != 0 || first.latency != 130*time.Millisecond {
+		t.Errorf("load of b is %v outstanding, %v", first.outstanding, first.latency)
+	}
+	b.update([]string{"a", "c"})
+	if b.addrs[0] != second || second.outstanding != 1 || b.addrs[1].address != "c" {
+		t.Errorf("addresses after update are %v and %v", b.addrs[0].address, b.addrs[1].address)
+	}
+}
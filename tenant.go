@@ -0,0 +1,154 @@
+package crosscoap
+
+import (
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// codeTooManyRequests is the 4.29 Too Many Requests response code (RFC
+// 8516), which go-coap doesn't define.
+const codeTooManyRequests coap.COAPCode = 157
+
+// Tenant is a customer whose devices share the proxy.  Its requests are
+// those to Host (the Uri-Host option, compared case-insensitively, IPv6
+// literals being given without brackets) below PathPrefix (matched on whole path segments), either being empty to match
+// any request; the first matching tenant applies.
+type Tenant struct {
+	// Name tags the tenant's requests in the access and audit logs.
+	Name       string
+	Host       string
+	PathPrefix string
+
+	// BackendURL, if set, replaces the proxy's BackendURL for the
+	// tenant's requests, with the path of the latter replaced.  Canary
+	// routes then don't apply.
+	BackendURL string
+
+	// RateLimit is the number of requests per second allowed to the
+	// tenant, with bursts of up to Burst requests (at least 1, and by
+	// default RateLimit rounded up); others get 4.29 Too Many Requests.
+	// If zero, the tenant's requests aren't limited.
+	RateLimit float64
+	Burst     int
+
+	// Routes override the settings of the tenant's requests below their
+	// PathPrefix (of the whole request path), before the Routes of the
+	// proxy; see Proxy.Routes.
+	Routes []RouteConfig
+}
+
+type tenant struct {
+	Tenant
+	url     *url.URL     // if BackendURL
+	limiter *rateLimiter // if RateLimit
+	routes  []*routeOverride
+}
+
+// tenants are the runtime state of the Tenants of a proxy.
+type tenants struct {
+	backend *url.URL
+	tenants []*tenant
+}
+
+// newTenants returns the tenants of p, or nil if it has none.
+func (p *proxyHandler) newTenants() *tenants {
+	if len(p.Tenants) == 0 {
+		return nil
+	}
+	ts := &tenants{}
+	backend, err := url.Parse(p.BackendURL)
+	if err != nil {
+		p.logError("Invalid backend URL, not sending requests to tenant backends: %v", err)
+	} else {
+		ts.backend = backend
+	}
+	for _, config := range p.Tenants {
+		t := &tenant{Tenant: config, routes: newRouteOverrides(config.Routes)}
+		if config.BackendURL != "" && ts.backend != nil {
+			if t.url, err = url.Parse(config.BackendURL); err != nil {
+				p.logError("Invalid backend URL of tenant %v: %v", config.Name, err)
+			}
+		}
+		if config.RateLimit > 0 {
+			t.limiter = newRateLimiter(config.RateLimit, config.Burst)
+		}
+		ts.tenants = append(ts.tenants, t)
+	}
+	return ts
+}
+
+// match returns the tenant of the request m, or nil.
+func (ts *tenants) match(m *coap.Message) *tenant {
+	if ts == nil {
+		return nil
+	}
+	host, _ := uriHost(m)
+	path := m.PathString()
+	for _, t := range ts.tenants {
+		if t.Host != "" && !strings.EqualFold(t.Host, host) {
+			continue
+		}
+		if hasPathPrefix(path, t.PathPrefix) {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantName returns the name of the tenant of the request m, or "-".
+func (p *proxyHandler) tenantName(m *coap.Message) string {
+	if t := p.tenants.match(m); t != nil {
+		return t.Name
+	}
+	return "-"
+}
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token at now if there is one, else it returns how long
+// until there is one.
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// tooManyRequests answers m with 4.29 Too Many Requests and a Max-Age of
+// the seconds until the client may retry.
+func (p *proxyHandler) tooManyRequests(m *coap.Message, retryAfter time.Duration) *translatedCOAPMessage {
+	coapResp := p.errorResponse(m, codeTooManyRequests, "rate limit exceeded")
+	if coapResp != nil {
+		coapResp.SetOption(coap.MaxAge, uint32(math.Ceil(retryAfter.Seconds())))
+	}
+	return coapResp
+}
@@ -0,0 +1,75 @@
+package crosscoap
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 0)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(now); !ok {
+			t.Fatalf("request %v of the burst is denied", i)
+		}
+	}
+	if ok, wait := l.allow(now); ok || wait != 500*time.Millisecond {
+		t.Errorf("request after the burst: allowed %v, wait %v", ok, wait)
+	}
+	if ok, _ := l.allow(now.Add(500 * time.Millisecond)); !ok {
+		t.Errorf("request after the wait is denied")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	var paths []string
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, name+" "+r.URL.Path)
+		}))
+	}
+	defaultBackend, acmeBackend := backend("default"), backend("acme")
+	defer defaultBackend.Close()
+	defer acmeBackend.Close()
+	var accessLog bytes.Buffer
+	p := newProxyHandler(&Proxy{
+		BackendURL: defaultBackend.URL + "/api",
+		AccessLog:  log.New(&accessLog, "", 0),
+		Tenants: []Tenant{
+			{Name: "acme", Host: "acme.example.com", BackendURL: acmeBackend.URL + "/acme", RateLimit: 0.001, Burst: 1},
+			{Name: "sensors", PathPrefix: "/sensors"},
+		},
+	})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	request := func(host, path string) *translatedCOAPMessage {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		if host != "" {
+			m.SetOption(coap.URIHost, host)
+		}
+		m.SetPathString(path)
+		return p.handleRequest(a, m, nil)
+	}
+
+	if r := request("ACME.example.com", "/a"); r == nil || r.Code != coap.Content {
+		t.Errorf("response to the tenant is '%v'", r)
+	}
+	if r := request("acme.example.com", "/a"); r == nil || r.Code != codeTooManyRequests || r.Option(coap.MaxAge) != uint32(1000) {
+		t.Errorf("response over the rate limit is '%v'", r)
+	}
+	request("", "/sensors/1")
+	request("", "/other")
+	if strings.Join(paths, ",") != "acme /acme/a,default /api/sensors/1,default /api/other" {
+		t.Errorf("backend paths are '%v'", paths)
+	}
+	if strings.Count(accessLog.String(), "Tenant=acme") != 2 || strings.Count(accessLog.String(), "Tenant=sensors") != 1 || !strings.Contains(accessLog.String(), "denied by rate limit of tenant acme") {
+		t.Errorf("access log is '%v'", accessLog.String())
+	}
+}
@@ -0,0 +1,27 @@
+package crosscoap
+
+import (
+	"net/http"
+)
+
+// mergeTrailers adds the trailers of httpResp, whose body has been read, to
+// its header, unless the header already has them.
+func mergeTrailers(httpResp *http.Response) {
+	for name, values := range httpResp.Trailer {
+		if len(values) == 0 {
+			continue
+		}
+		if _, found := httpResp.Header[name]; !found {
+			httpResp.Header[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// expectContinue asks the backend to accept req, if it has a body, before
+// the body is sent.  The HTTP client consumes the 100 Continue response,
+// and sends the body anyway if none comes within a second.
+func expectContinue(req *http.Request) {
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		req.Header.Set("Expect", "100-continue")
+	}
+}
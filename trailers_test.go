@@ -0,0 +1,75 @@
+package crosscoap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestMapTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("firmware"))
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "1234")
+	}))
+	defer backend.Close()
+
+	for _, mapTrailers := range []bool{false, true} {
+		p := newProxyHandler(&Proxy{
+			BackendURL:     backend.URL,
+			MapTrailers:    mapTrailers,
+			OptionMappings: []OptionMapping{{Option: 65002, Header: "X-Checksum", Format: UintOption}},
+		})
+		req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		req.SetPathString("/firmware")
+		coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil)
+		if coapResp == nil || coapResp.Code != coap.Content || string(coapResp.Payload) != "firmware" {
+			t.Fatalf("response is %v", coapResp)
+		}
+		value, found := findOption(coapResp.ExtraOptions, 65002)
+		if found != mapTrailers || (found && !bytes.Equal(value, []byte{0x04, 0xd2})) {
+			t.Errorf("MapTrailers %v: response options are %v", mapTrailers, coapResp.ExtraOptions)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	var uploaded bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Errorf("backend request has Expect '%v'", r.Header.Get("Expect"))
+		}
+		if r.URL.Path == "/full" {
+			http.Error(w, "no room", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		uploaded = string(body) == "data"
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, ExpectContinue: true})
+	for _, tt := range []struct {
+		path     string
+		expected coap.COAPCode
+	}{
+		{"/full", coap.RequestEntityTooLarge},
+		{"/upload", coap.Created},
+	} {
+		req := coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1, Payload: []byte("data")}
+		req.SetPathString(tt.path)
+		if coapResp := p.serveCOAP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &req, nil, nil); coapResp == nil || coapResp.Code != tt.expected {
+			t.Errorf("%v: response is %v", tt.path, coapResp)
+		}
+	}
+	if !uploaded {
+		t.Errorf("backend didn't get the body")
+	}
+}
@@ -0,0 +1,191 @@
+package crosscoap
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+// Message transmission parameters (RFC 7252 section 4.8)
+const (
+	defaultAckTimeout    = 2 * time.Second
+	ackRandomFactor      = 1.5
+	defaultMaxRetransmit = 4
+)
+
+var (
+	errNoAcknowledgement = errors.New("no acknowledgement from client")
+	errMessageRejected   = errors.New("message rejected by client")
+	errNoResponse        = errors.New("no response from server")
+)
+
+func (p *Proxy) ackTimeout() time.Duration {
+	if p.AckTimeout > 0 {
+		return p.AckTimeout
+	}
+	return defaultAckTimeout
+}
+
+func (p *Proxy) maxRetransmit() int {
+	switch {
+	case p.MaxRetransmit > 0:
+		return p.MaxRetransmit
+	case p.MaxRetransmit < 0:
+		return 0
+	}
+	return defaultMaxRetransmit
+}
+
+type transactionKey struct {
+	addr string
+	id   string
+}
+
+// transactions tracks the confirmable messages sent by the proxy which await
+// an acknowledgement (or a reset), and the requests sent by the proxy which
+// await a separate response.
+type transactions struct {
+	mu        sync.Mutex
+	pending   map[transactionKey]chan *coap.Message
+	responses map[transactionKey]chan *coap.Message
+	messageID uint32
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		pending:   make(map[transactionKey]chan *coap.Message),
+		responses: make(map[transactionKey]chan *coap.Message),
+		messageID: uint32(rand.Intn(1 << 16)),
+	}
+}
+
+func (t *transactions) nextMessageID() uint16 {
+	return uint16(atomic.AddUint32(&t.messageID, 1))
+}
+
+func messageKey(a *net.UDPAddr, messageID uint16) transactionKey {
+	return transactionKey{a.String(), strconv.Itoa(int(messageID))}
+}
+
+func tokenKey(a *net.UDPAddr, token []byte) transactionKey {
+	return transactionKey{a.String(), string(token)}
+}
+
+func (t *transactions) add(waiting map[transactionKey]chan *coap.Message, key transactionKey) chan *coap.Message {
+	return t.addQueue(waiting, key, 1)
+}
+
+// addQueue is add with room for size messages, for the notifications of an
+// observation.
+func (t *transactions) addQueue(waiting map[transactionKey]chan *coap.Message, key transactionKey, size int) chan *coap.Message {
+	reply := make(chan *coap.Message, size)
+	t.mu.Lock()
+	waiting[key] = reply
+	t.mu.Unlock()
+	return reply
+}
+
+func (t *transactions) remove(waiting map[transactionKey]chan *coap.Message, key transactionKey) {
+	t.mu.Lock()
+	delete(waiting, key)
+	t.mu.Unlock()
+}
+
+func (t *transactions) deliver(waiting map[transactionKey]chan *coap.Message, key transactionKey, m *coap.Message) bool {
+	t.mu.Lock()
+	reply, found := waiting[key]
+	t.mu.Unlock()
+	if !found {
+		return false
+	}
+	select {
+	case reply <- m:
+	default:
+	}
+	return true
+}
+
+// complete matches an ACK or RST message from the client at a with a pending
+// transaction; it returns false if there is none.
+func (t *transactions) complete(a *net.UDPAddr, m *coap.Message) bool {
+	return t.deliver(t.pending, messageKey(a, m.MessageID), m)
+}
+
+// respond matches a separate response from a with a request sent by the
+// proxy; it returns false if there is none.
+func (t *transactions) respond(a *net.UDPAddr, m *coap.Message) bool {
+	return t.deliver(t.responses, tokenKey(a, m.Token), m)
+}
+
+// sendConfirmable sends m to the client at a as a confirmable message with a
+// new message ID, retransmitting it with exponential backoff until the
+// client acknowledges it or MaxRetransmit retransmissions have been made.
+// It returns the acknowledgement.
+func (p *proxyHandler) sendConfirmable(l transport, a *net.UDPAddr, m *coap.Message, extra []rawOption) (*coap.Message, error) {
+	m.Type = coap.Confirmable
+	m.MessageID = p.transactions.nextMessageID()
+	data, err := marshalMessage(m, extra)
+	if err != nil {
+		return nil, err
+	}
+	key := messageKey(a, m.MessageID)
+	reply := p.transactions.add(p.transactions.pending, key)
+	defer p.transactions.remove(p.transactions.pending, key)
+
+	timeout := p.ackTimeout() + time.Duration(rand.Float64()*(ackRandomFactor-1)*float64(p.ackTimeout()))
+	for retransmissions := 0; ; retransmissions++ {
+		if err := l.SendMessage(a, data); err != nil {
+			return nil, err
+		}
+		p.clients.sent(a, len(data))
+		timer := time.NewTimer(timeout)
+		select {
+		case ack := <-reply:
+			timer.Stop()
+			if ack.Type == coap.Reset {
+				return nil, errMessageRejected
+			}
+			return ack, nil
+		case <-timer.C:
+		case <-p.life.aborted:
+			timer.Stop()
+			return nil, ErrProxyClosed
+		}
+		if retransmissions == p.maxRetransmit() {
+			return nil, errNoAcknowledgement
+		}
+		timeout *= 2
+	}
+}
+
+// sendRequest sends the request m from the proxy to the server at a, and
+// returns the response, whether it is piggybacked on the acknowledgement or
+// sent separately.
+func (p *proxyHandler) sendRequest(l transport, a *net.UDPAddr, m *coap.Message) (*coap.Message, error) {
+	m.Token = make([]byte, 4)
+	rand.Read(m.Token)
+	key := tokenKey(a, m.Token)
+	response := p.transactions.add(p.transactions.responses, key)
+	defer p.transactions.remove(p.transactions.responses, key)
+	ack, err := p.sendConfirmable(l, a, m, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ack.Code != 0 {
+		return ack, nil
+	}
+	timer := time.NewTimer(p.timeout())
+	defer timer.Stop()
+	select {
+	case resp := <-response:
+		return resp, nil
+	case <-timer.C:
+		return nil, errNoResponse
+	}
+}
@@ -0,0 +1,61 @@
+package crosscoap
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestSendConfirmableGivesUp(t *testing.T) {
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	p := newProxyHandler(&Proxy{AckTimeout: 10 * time.Millisecond, MaxRetransmit: 2})
+
+	m := coap.Message{Code: coap.Content, Token: []byte("t"), Payload: []byte("x")}
+	_, err := p.sendConfirmable(p.transportOf(server), client.LocalAddr().(*net.UDPAddr), &m, nil)
+	if err != errNoAcknowledgement {
+		t.Errorf("err is '%v'", err)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	transmissions := 0
+	buf := make([]byte, maxCOAPPacketLen)
+	for {
+		if _, err := client.Read(buf); err != nil {
+			break
+		}
+		transmissions++
+	}
+	if transmissions != 3 {
+		t.Errorf("transmissions is '%v'", transmissions)
+	}
+}
+
+func TestSendConfirmableReset(t *testing.T) {
+	client, _ := createLocalUDPListener(t)
+	defer client.Close()
+	server, _ := createLocalUDPListener(t)
+	defer server.Close()
+	p := newProxyHandler(&Proxy{AckTimeout: time.Second})
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	go func() {
+		buf := make([]byte, maxCOAPPacketLen)
+		n, err := client.Read(buf)
+		if err != nil {
+			return
+		}
+		m, err := coap.ParseMessage(buf[:n])
+		if err != nil {
+			return
+		}
+		p.transactions.complete(clientAddr, &coap.Message{Type: coap.Reset, MessageID: m.MessageID})
+	}()
+	m := coap.Message{Code: coap.Content}
+	if _, err := p.sendConfirmable(p.transportOf(server), clientAddr, &m, nil); err != errMessageRejected {
+		t.Errorf("err is '%v'", err)
+	}
+}
@@ -0,0 +1,95 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+var errInvalidJSON = errors.New("invalid JSON data")
+
+// A Converter converts a payload to another representation.
+type Converter func(payload []byte) ([]byte, error)
+
+// Conversion is a pair of Content-Formats, From the backend's and To the
+// client's.
+type Conversion struct {
+	From, To coap.MediaType
+}
+
+// builtinConverters converts JSON to CBOR and plain text.
+var builtinConverters = map[Conversion]Converter{
+	{coap.AppJSON, appCBOR}:        jsonToCBOR,
+	{coap.AppJSON, coap.TextPlain}: jsonToText,
+}
+
+// DefaultConverters returns a copy of the built-in response converters,
+// which convert JSON to CBOR and to plain text.
+func DefaultConverters() map[Conversion]Converter {
+	converters := make(map[Conversion]Converter, len(builtinConverters))
+	for conversion, convert := range builtinConverters {
+		converters[conversion] = convert
+	}
+	return converters
+}
+
+// RegisterConverter makes the proxy convert backend responses of the
+// Content-Format from to the Content-Format to with convert, when the
+// request's Accept option asks for to, in addition to the built-in
+// converters (see TranscodeResponses, which this implies); registering a
+// known conversion replaces its converter.  It must be called before Serve.
+func (p *Proxy) RegisterConverter(from, to coap.MediaType, convert Converter) {
+	if p.converters == nil {
+		p.converters = DefaultConverters()
+	}
+	p.converters[Conversion{From: from, To: to}] = convert
+}
+
+// responseConverters returns the converters of backend responses in use.
+func (p *Proxy) responseConverters() map[Conversion]Converter {
+	if p.converters == nil && p.TranscodeResponses {
+		return builtinConverters
+	}
+	return p.converters
+}
+
+// jsonToText serves JSON, which is UTF-8 text, as plain text.
+func jsonToText(data []byte) ([]byte, error) {
+	if !json.Valid(data) {
+		return nil, errInvalidJSON
+	}
+	return data, nil
+}
+
+// converter returns the converter from mediaType to the Content-Format
+// accept, or nil if the representation isn't converted.
+func (t *Translator) converter(mediaType coap.MediaType, accept interface{}) Converter {
+	to, ok := accept.(coap.MediaType)
+	if !ok || to == mediaType {
+		return nil
+	}
+	if mediaType == coap.AppJSON && t.transcodesCBOR(to) {
+		return jsonToCBOR
+	}
+	return t.Converters[Conversion{From: mediaType, To: to}]
+}
+
+// acceptHeader returns the Accept header asking the backend for the
+// representation acceptContent, of the Content-Format accept, or any
+// representation converted to it.
+func (t *Translator) acceptHeader(accept coap.MediaType, acceptContent Content) string {
+	types := []string{acceptContent.Type}
+	for conversion := range t.Converters {
+		if conversion.To != accept {
+			continue
+		}
+		if content, found := t.contentFormats()[conversion.From]; found && content.Encoding == "" {
+			types = append(types, content.Type)
+		}
+	}
+	sort.Strings(types[1:])
+	return strings.Join(types, ", ")
+}
@@ -0,0 +1,72 @@
+package crosscoap
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestTranscodeResponses(t *testing.T) {
+	var accept string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/invalid" {
+			w.Write([]byte(`{"temp":`))
+			return
+		}
+		w.Write([]byte(`{"temp":21}`))
+	}))
+	defer backend.Close()
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	get := func(p *proxyHandler, path string, mediaType coap.MediaType) *translatedCOAPMessage {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(path)
+		m.SetOption(coap.Accept, mediaType)
+		return p.handleRequest(a, m, nil)
+	}
+
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL})
+	if coapResp := get(p, "/temp", coap.TextPlain); coapResp.Code != coap.NotAcceptable {
+		t.Errorf("response without transcoding is %v", coapResp.Code)
+	}
+
+	p = newProxyHandler(&Proxy{BackendURL: backend.URL, TranscodeResponses: true})
+	coapResp := get(p, "/temp", coap.TextPlain)
+	if coapResp.Code != coap.Content || coapResp.Option(coap.ContentFormat) != coap.TextPlain || string(coapResp.Payload) != `{"temp":21}` {
+		t.Errorf("plain text response is %v %v '%s'", coapResp.Code, coapResp.Option(coap.ContentFormat), coapResp.Payload)
+	}
+	if accept != "text/plain;charset=utf-8, application/json" {
+		t.Errorf("backend got Accept '%v'", accept)
+	}
+	coapResp = get(p, "/temp", appCBOR)
+	if cbor, _ := jsonToCBOR([]byte(`{"temp":21}`)); coapResp.Option(coap.ContentFormat) != appCBOR || !bytes.Equal(coapResp.Payload, cbor) {
+		t.Errorf("CBOR response is %v %x", coapResp.Option(coap.ContentFormat), coapResp.Payload)
+	}
+	if coapResp := get(p, "/invalid", coap.TextPlain); coapResp.Code != coap.BadGateway {
+		t.Errorf("response to invalid JSON is %v", coapResp.Code)
+	}
+	if coapResp := get(p, "/temp", coap.AppXML); coapResp.Code != coap.NotAcceptable {
+		t.Errorf("response without converter is %v", coapResp.Code)
+	}
+
+	proxy := &Proxy{BackendURL: backend.URL}
+	proxy.RegisterConverter(coap.AppJSON, coap.AppXML, func(payload []byte) ([]byte, error) {
+		return []byte("<json>" + string(payload) + "</json>"), nil
+	})
+	p = newProxyHandler(proxy)
+	coapResp = get(p, "/temp", coap.AppXML)
+	if coapResp.Option(coap.ContentFormat) != coap.AppXML || string(coapResp.Payload) != `<json>{"temp":21}</json>` {
+		t.Errorf("XML response is %v '%s'", coapResp.Option(coap.ContentFormat), coapResp.Payload)
+	}
+	if accept != "application/xml, application/json" {
+		t.Errorf("backend got Accept '%v'", accept)
+	}
+	if coapResp := get(p, "/temp", coap.TextPlain); coapResp.Option(coap.ContentFormat) != coap.TextPlain {
+		t.Errorf("built-in conversion with a registered converter is %v", coapResp.Code)
+	}
+}
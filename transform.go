@@ -0,0 +1,73 @@
+package crosscoap
+
+import (
+	"net/http"
+
+	"github.com/dustin/go-coap"
+)
+
+// A Transform reshapes a payload exchanged with the backend for the request
+// described by rc.
+type Transform func(rc *RequestContext, payload []byte) ([]byte, error)
+
+// PayloadTransformer reshapes the payloads of the requests to PathPrefix
+// (matched on whole path segments) and their responses, for instance to map
+// device payloads to the backend's schema without a separate service.
+// Request transforms the request payload before its representation is
+// converted and it's sent to the backend, and Response the body of
+// successful backend responses before it's translated to CoAP; either may
+// be nil.
+type PayloadTransformer struct {
+	PathPrefix string
+	Request    Transform
+	Response   Transform
+}
+
+// payloadTransformer returns the first of p's PayloadTransformers for path,
+// or nil if there's none.
+func (p *Proxy) payloadTransformer(path string) *PayloadTransformer {
+	for i := range p.PayloadTransformers {
+		if hasPathPrefix(path, p.PayloadTransformers[i].PathPrefix) {
+			return &p.PayloadTransformers[i]
+		}
+	}
+	return nil
+}
+
+// transformsRequest reports whether the payload of m is transformed, and so
+// must be reassembled before it's sent to the backend.
+func (p *Proxy) transformsRequest(m *coap.Message) bool {
+	pt := p.payloadTransformer(m.PathString())
+	return pt != nil && pt.Request != nil
+}
+
+// transformsResponse reports whether the body of the response httpResp to m
+// is transformed, and so must be read as a whole.
+func (p *Proxy) transformsResponse(m *coap.Message, httpResp *http.Response) bool {
+	pt := p.payloadTransformer(m.PathString())
+	return pt != nil && pt.Response != nil && httpResp != nil && httpResp.StatusCode/100 == 2
+}
+
+// transformRequest returns m with its payload transformed, if a
+// PayloadTransformer applies.
+func (p *Proxy) transformRequest(rc *RequestContext, m *coap.Message) (*coap.Message, error) {
+	if !p.transformsRequest(m) {
+		return m, nil
+	}
+	payload, err := p.payloadTransformer(m.PathString()).Request(rc, m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	transformed := *m
+	transformed.Payload = payload
+	return &transformed, nil
+}
+
+// transformResponse returns the body of the backend response httpResp to m,
+// transformed if a PayloadTransformer applies.
+func (p *Proxy) transformResponse(rc *RequestContext, m *coap.Message, httpResp *http.Response, body []byte) ([]byte, error) {
+	if !p.transformsResponse(m, httpResp) {
+		return body, nil
+	}
+	return p.payloadTransformer(m.PathString()).Response(rc, body)
+}
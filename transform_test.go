@@ -0,0 +1,65 @@
+package crosscoap
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestPayloadTransformers(t *testing.T) {
+	var received []byte
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/sensors/missing" {
+			http.Error(w, "no sensor", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("stored"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, PayloadTransformers: []PayloadTransformer{
+		{
+			PathPrefix: "/sensors/broken",
+			Request: func(rc *RequestContext, payload []byte) ([]byte, error) {
+				return nil, errors.New("broken")
+			},
+		},
+		{
+			PathPrefix: "/sensors",
+			Request: func(rc *RequestContext, payload []byte) ([]byte, error) {
+				return append([]byte(rc.Client.String()+" "), payload...), nil
+			},
+			Response: func(rc *RequestContext, payload []byte) ([]byte, error) {
+				return bytes.ToUpper(payload), nil
+			},
+		},
+	}})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	post := func(path string) *translatedCOAPMessage {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1, Payload: []byte("21.5")}
+		m.SetPathString(path)
+		return p.handleRequest(a, m, nil)
+	}
+
+	coapResp := post("/sensors/temp")
+	if string(received) != "127.0.0.1:5683 21.5" || string(coapResp.Payload) != "STORED" {
+		t.Errorf("backend got '%s', client got '%s'", received, coapResp.Payload)
+	}
+	if coapResp := post("/sensors/missing"); string(coapResp.Payload) != "no sensor\n" || coapResp.Code != coap.NotFound {
+		t.Errorf("error response is %v '%s'", coapResp.Code, coapResp.Payload)
+	}
+	if coapResp := post("/other"); string(received) != "21.5" || string(coapResp.Payload) != "stored" {
+		t.Errorf("backend got '%s' for another path, client got '%s'", received, coapResp.Payload)
+	}
+	received = nil
+	if coapResp := post("/sensors/broken"); coapResp.Code != coap.BadRequest || received != nil {
+		t.Errorf("response to a rejected payload is %v", coapResp.Code)
+	}
+}
@@ -2,9 +2,22 @@ package crosscoap
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dustin/go-coap"
 )
@@ -14,23 +27,89 @@ const maxCOAPPacketLen = 1500
 type translatedCOAPMessage struct {
 	coap.Message
 	IsTruncated bool
+
+	// ExtraOptions holds the options which go-coap can't represent.
+	ExtraOptions []rawOption
+
+	// untruncated is the whole payload of a truncated message, and
+	// deflated tells whether the payload was compressed to fit in the
+	// packet.
+	untruncated []byte
+	deflated    bool
+
+	// revalidation revalidates a payload from the cache served with
+	// Block2, if the download is revalidated.
+	revalidation *downloadRevalidation
+
+	// requestID is the ID of the exchange answered by the message, and
+	// backendURL, backendErr, httpStatus and contentType describe the
+	// backend request (if any) and its response.  oversize is what became
+	// of a payload which didn't fit in a packet, and cache whether the
+	// response came from the cache, for the access log.
+	requestID   string
+	backendURL  string
+	backendErr  error
+	httpStatus  int
+	contentType string
+	oversize    string
+	cache       string
 }
 
-type content struct {
+// Content is the HTTP content type and content encoding corresponding to a
+// CoAP Content-Format.
+type Content struct {
 	Type     string
 	Encoding string
 }
 
-const appJSONDeflate coap.MediaType = 11050
+// Methods of RFC 8132, which go-coap doesn't know.
+const (
+	FETCH  coap.COAPCode = 5
+	PATCH  coap.COAPCode = 6
+	IPATCH coap.COAPCode = 7
+)
+
+// Response codes of RFC 8132
+const (
+	codeConflict            coap.COAPCode = 137 // 4.09
+	codeUnprocessableEntity coap.COAPCode = 150 // 4.22
+)
+
+// methodName returns the name of the request code, including the RFC 8132
+// methods.
+func methodName(code coap.COAPCode) string {
+	switch code {
+	case FETCH:
+		return "FETCH"
+	case PATCH:
+		return "PATCH"
+	case IPATCH:
+		return "iPATCH"
+	}
+	return code.String()
+}
+
+const (
+	appJSONPatch   coap.MediaType = 51
+	appMergePatch  coap.MediaType = 52
+	appCBOR        coap.MediaType = 60
+	appJSONDeflate coap.MediaType = 11050
+)
 
-var coapContentFormatContentType = map[coap.MediaType]content{
-	coap.TextPlain:     content{Type: "text/plain;charset=utf-8"},
-	coap.AppLinkFormat: content{Type: "application/link-format"},
-	coap.AppXML:        content{Type: "application/xml"},
-	coap.AppOctets:     content{Type: "application/octet-stream"},
-	coap.AppExi:        content{Type: "application/exi"},
-	coap.AppJSON:       content{Type: "application/json"},
-	appJSONDeflate:     content{Type: "application/json", Encoding: "deflate"},
+var coapContentFormatContentType = map[coap.MediaType]Content{
+	coap.TextPlain:     Content{Type: "text/plain;charset=utf-8"},
+	coap.AppLinkFormat: Content{Type: "application/link-format"},
+	coap.AppXML:        Content{Type: "application/xml"},
+	coap.AppOctets:     Content{Type: "application/octet-stream"},
+	coap.AppExi:        Content{Type: "application/exi"},
+	coap.AppJSON:       Content{Type: "application/json"},
+	appJSONPatch:       Content{Type: "application/json-patch+json"},
+	appMergePatch:      Content{Type: "application/merge-patch+json"},
+	appCBOR:            Content{Type: "application/cbor"},
+	appSenMLJSON:       Content{Type: "application/senml+json"},
+	appLinkFormatJSON:  Content{Type: "application/link-format+json"},
+	appSenMLCBOR:       Content{Type: "application/senml+cbor"},
+	appJSONDeflate:     Content{Type: "application/json", Encoding: "deflate"},
 }
 
 var httpStatusCOAPCode = map[int]coap.COAPCode{
@@ -46,9 +125,11 @@ var httpStatusCOAPCode = map[int]coap.COAPCode{
 	http.StatusNotFound:              coap.NotFound,
 	http.StatusMethodNotAllowed:      coap.MethodNotAllowed,
 	http.StatusNotAcceptable:         coap.NotAcceptable,
+	http.StatusConflict:              codeConflict,
 	http.StatusPreconditionFailed:    coap.PreconditionFailed,
 	http.StatusRequestEntityTooLarge: coap.RequestEntityTooLarge,
 	http.StatusUnsupportedMediaType:  coap.UnsupportedMediaType,
+	http.StatusUnprocessableEntity:   codeUnprocessableEntity,
 
 	http.StatusInternalServerError: coap.InternalServerError,
 	http.StatusNotImplemented:      coap.NotImplemented,
@@ -57,7 +138,24 @@ var httpStatusCOAPCode = map[int]coap.COAPCode{
 	http.StatusGatewayTimeout:      coap.GatewayTimeout,
 }
 
-func translateStatusCode(httpStatusCode int) coap.COAPCode {
+// translateStatusCode maps the backend's status code to a CoAP response
+// code.  Successful responses depend on the request method, following RFC
+// 8075 and RFC 8132: updates (POST, PUT, PATCH, iPATCH) become 2.04 Changed
+// and DELETE becomes 2.02 Deleted, while 201 Created is always 2.01 Created.
+func translateStatusCode(method coap.COAPCode, httpStatusCode int) coap.COAPCode {
+	if httpStatusCode < 200 {
+		// Interim responses are consumed by the HTTP client, so this is a
+		// protocol switch which CoAP can't follow
+		return coap.BadGateway
+	}
+	if httpStatusCode == http.StatusOK || httpStatusCode == http.StatusNoContent {
+		switch method {
+		case coap.POST, coap.PUT, PATCH, IPATCH:
+			return coap.Changed
+		case coap.DELETE:
+			return coap.Deleted
+		}
+	}
 	coapCode, found := httpStatusCOAPCode[httpStatusCode]
 	if found {
 		return coapCode
@@ -65,27 +163,80 @@ func translateStatusCode(httpStatusCode int) coap.COAPCode {
 	return coap.Content
 }
 
+var (
+	errTooManyRedirects = errors.New("too many redirects")
+	errRedirectLoop     = errors.New("redirect loop")
+)
+
+// translateBackendError classifies an error returned by the HTTP client:
+// timeouts become 5.04 Gateway Timeout, failures to reach the backend at all
+// (DNS errors, refused connections) and redirects not followed become 5.02
+// Bad Gateway, and anything else 5.03 Service Unavailable.
+func translateBackendError(err error) coap.COAPCode {
+	if errors.Is(err, errTooManyRedirects) || errors.Is(err, errRedirectLoop) {
+		return coap.BadGateway
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return coap.GatewayTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) || errors.Is(err, syscall.ECONNREFUSED) {
+		return coap.BadGateway
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return coap.BadGateway
+	}
+	return coap.ServiceUnavailable
+}
+
+// isCanceled reports whether the backend request was abandoned on purpose,
+// in which case no CoAP response is sent.
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// isSuccess reports whether code is a 2.xx response code.
+func isSuccess(code coap.COAPCode) bool {
+	return code>>5 == 2
+}
+
 func trimCharset(val string) string {
 	return strings.SplitN(val, ";", 2)[0]
 }
 
-func translateContentTypeWithEncoding(contentType, contentEncoding string) (coap.MediaType, bool) {
+// contentFormats returns the Content-Format mapping table in use.
+func (t *Translator) contentFormats() map[coap.MediaType]Content {
+	if t.ContentFormats != nil {
+		return t.ContentFormats
+	}
+	return coapContentFormatContentType
+}
+
+func (t *Translator) translateContentTypeWithEncoding(contentType, contentEncoding string) (coap.MediaType, bool) {
 	contentType = trimCharset(contentType)
-	for mediaType, ct := range coapContentFormatContentType {
+	var result coap.MediaType
+	found := false
+	for mediaType, ct := range t.contentFormats() {
 		if trimCharset(ct.Type) == contentType && ct.Encoding == contentEncoding {
-			return mediaType, true
+			// Prefer the lowest number if several formats match
+			if !found || mediaType < result {
+				result = mediaType
+				found = true
+			}
 		}
 	}
-	return 0, false
+	return result, found
 }
 
-func getContentFormatFromCoapMessage(msg coap.Message) (content, bool) {
+func (t *Translator) getContentFormatFromCoapMessage(msg coap.Message) (Content, bool) {
 	contentFormat := msg.Option(coap.ContentFormat)
 	if contentFormat != nil {
-		ct, found := coapContentFormatContentType[contentFormat.(coap.MediaType)]
+		ct, found := t.contentFormats()[contentFormat.(coap.MediaType)]
 		return ct, found
 	}
-	return content{}, false
+	return Content{}, false
 }
 
 func escapeKeyValue(s string) string {
@@ -97,35 +248,292 @@ func escapeKeyValue(s string) string {
 }
 
 func queryString(coapMsg *coap.Message) string {
-	uriQueryOptions := coapMsg.Options(coap.URIQuery)
-	parts := make([]string, 0, len(uriQueryOptions))
-	for _, part := range uriQueryOptions {
-		partStr, ok := part.(string)
-		if !ok {
-			continue
+	var queries []string
+	for _, part := range coapMsg.Options(coap.URIQuery) {
+		if partStr, ok := part.(string); ok {
+			queries = append(queries, partStr)
 		}
-		parts = append(parts, escapeKeyValue(partStr))
 	}
-	if len(parts) == 0 {
+	return encodeQueries(queries)
+}
+
+func encodeQueries(queries []string) string {
+	if len(queries) == 0 {
 		return ""
 	}
+	parts := make([]string, len(queries))
+	for i, query := range queries {
+		parts[i] = escapeKeyValue(query)
+	}
 	return "?" + strings.Join(parts, "&")
 }
 
-func translateCOAPRequestToHTTPRequest(coapMsg *coap.Message, backendURLPrefix string) *http.Request {
-	method := coapMsg.Code.String()
-	url := addFinalSlash(backendURLPrefix) + coapMsg.PathString() + queryString(coapMsg)
-	body := bytes.NewReader(coapMsg.Payload)
-	req, err := http.NewRequest(method, url, body)
+// TranslationError is returned when a CoAP request can't be translated to
+// HTTP; Code is the CoAP response code to send to the client, and Reason,
+// which Error returns, its diagnostic payload.  Err is the underlying
+// error, if any, such as the syntax error of an invalid payload; it's left
+// out of Reason, which the client sees.
+type TranslationError struct {
+	Code   coap.COAPCode
+	Reason string
+	Err    error
+}
+
+func (e *TranslationError) Error() string {
+	return e.Reason
+}
+
+func (e *TranslationError) Unwrap() error {
+	return e.Err
+}
+
+// Translator translates CoAP requests to HTTP requests and HTTP responses
+// back to CoAP, following RFC 8075.  It is used by Proxy, and may be used on
+// its own by other CoAP servers or clients.  A Translator must not be
+// modified while it is in use.
+type Translator struct {
+	// URL prefix of the HTTP backend.
+	BackendURL string
+
+	// StrictContentFormat rejects requests whose Content-Format has no
+	// known HTTP equivalent with 4.15 Unsupported Content-Format.
+	StrictContentFormat bool
+
+	// DefaultContentType is sent as the Content-Type of requests whose
+	// Content-Format has no known HTTP equivalent (unless
+	// StrictContentFormat is set).  If empty, no Content-Type is sent.
+	DefaultContentType string
+
+	// ContentFormats maps CoAP Content-Formats to HTTP content types.  If
+	// nil, the built-in table is used.
+	ContentFormats map[coap.MediaType]Content
+
+	// TranscodeCBOR converts CBOR request payloads to JSON before they are
+	// sent to the backend, and JSON responses to CBOR for clients which
+	// accept only CBOR.
+	TranscodeCBOR bool
+
+	// Converters convert backend responses to the representation asked for
+	// by the request's Accept option.  If nil, responses aren't converted.
+	Converters map[Conversion]Converter
+
+	// NormalizeSenML converts SenML request payloads to resolved senml+json
+	// records.
+	NormalizeSenML bool
+
+	// TranslateLinkFormat converts between RFC 6690 link-format, used by
+	// CoAP clients, and its JSON representation, used by the backend.
+	TranslateLinkFormat bool
+
+	// DeflateJSON compresses JSON responses for clients which accept
+	// deflated JSON, or which don't restrict the format and would otherwise
+	// get a truncated response.
+	DeflateJSON bool
+
+	// InflateRequests lists the path prefixes below which deflated JSON
+	// request payloads (Content-Format 11050) are inflated and forwarded as
+	// plain application/json, for backends which don't support
+	// Content-Encoding: deflate.  An empty prefix matches every path.
+	InflateRequests []string
+
+	// OptionMappings carries CoAP options to HTTP headers and back.
+	OptionMappings []OptionMapping
+
+	// ForwardedHeaders lists backend response headers surfaced to the
+	// client.
+	ForwardedHeaders []ForwardedHeader
+
+	// AuthChallenges, if set, surfaces the WWW-Authenticate challenges of
+	// 401 Unauthorized responses to the client.
+	AuthChallenges *AuthChallengePolicy
+
+	// Host, if set, is the Host header of backend requests, regardless of
+	// the Uri-Host option.
+	Host string
+
+	// RewriteRules are applied in order to the request path before the
+	// backend URI is built.
+	RewriteRules []RewriteRule
+
+	// QueryRules add, rename or remove query parameters of requests, or
+	// move them to headers.
+	QueryRules []QueryRule
+
+	// URITemplate optionally maps request URIs to backend URIs, instead of
+	// appending the request path and query to BackendURL.
+	URITemplate *URITemplate
+
+	// ForwardProxy enables the forward-proxy mode for requests with a
+	// Proxy-Uri or Proxy-Scheme option; if nil, they fail with 5.05
+	// Proxying Not Supported.
+	ForwardProxy *ForwardProxyPolicy
+
+	// TranslateRedirects translates backend redirects to responses carrying
+	// their target in Location-Path and Location-Query options, instead of
+	// following them.
+	TranslateRedirects bool
+
+	// MaxPacketSize is the size of CoAP responses beyond which the payload
+	// is truncated.  If zero, 1500 bytes is used.
+	MaxPacketSize int
+
+	// FetchMethod is the HTTP method of backend requests translated from
+	// FETCH requests, whose payload is the request body: GET if empty, or
+	// POST for backends which ignore the body of GET requests.  PATCH and
+	// iPATCH requests become PATCH requests.
+	FetchMethod string
+}
+
+// DefaultContentFormats returns a copy of the built-in mapping from CoAP
+// Content-Formats to HTTP content types, to be extended and set as
+// Translator.ContentFormats.
+func DefaultContentFormats() map[coap.MediaType]Content {
+	formats := make(map[coap.MediaType]Content, len(coapContentFormatContentType))
+	for mediaType, ct := range coapContentFormatContentType {
+		formats[mediaType] = ct
+	}
+	return formats
+}
+
+func (t *Translator) maxPacketSize() int {
+	if t.MaxPacketSize > 0 {
+		return t.MaxPacketSize
+	}
+	return maxCOAPPacketLen
+}
+
+// TranslateRequest translates a CoAP request to an HTTP request to the
+// backend.  If the request can't be translated, the error is a
+// *TranslationError holding the CoAP response code to send.
+func (t *Translator) TranslateRequest(coapMsg *coap.Message) (*http.Request, error) {
+	return t.translateCOAPRequestToHTTPRequest(coapMsg)
+}
+
+// TranslateResponse translates the backend's response (or the error of the
+// HTTP request, if httpError isn't nil) to the CoAP response to coapRequest.
+// truncated reports whether the body had to be truncated to fit in
+// MaxPacketSize.  Options numbered above 255, which go-coap can't represent,
+// are left out.  A non-nil error means the response couldn't be translated
+// faithfully; the returned message is then an error response which can still
+// be sent to the client.  The error is a *BackendError if httpError isn't
+// nil or the body of the backend response couldn't be converted.
+func (t *Translator) TranslateResponse(httpResp *http.Response, httpBody []byte, httpError error, coapRequest *coap.Message) (coapResp *coap.Message, truncated bool, err error) {
+	translated, err := t.translateHTTPResponseToCOAPResponse(httpResp, httpBody, httpError, coapRequest)
+	if httpError != nil {
+		err = &BackendError{Code: translated.Code, Err: httpError}
+	}
+	for _, o := range translated.ExtraOptions {
+		if o.ID <= math.MaxUint8 {
+			translated.AddOption(coap.OptionID(o.ID), o.Value)
+		}
+	}
+	return &translated.Message, translated.IsTruncated, err
+}
+
+// transcodesCBOR reports whether a CBOR representation is produced by
+// transcoding JSON.
+func (t *Translator) transcodesCBOR(mediaType interface{}) bool {
+	return t.TranscodeCBOR && mediaType == appCBOR
+}
+
+// httpMethod returns the HTTP method of the backend request of a request
+// with the code.
+func (t *Translator) httpMethod(code coap.COAPCode) string {
+	switch code {
+	case FETCH:
+		if t.FetchMethod != "" {
+			return t.FetchMethod
+		}
+		return http.MethodGet
+	case PATCH, IPATCH:
+		return http.MethodPatch
+	}
+	return code.String()
+}
+
+func (t *Translator) translateCOAPRequestToHTTPRequest(coapMsg *coap.Message) (*http.Request, error) {
+	if !validPath(coapMsg) {
+		return nil, &TranslationError{Code: coap.BadRequest, Reason: "invalid Uri-Path segment"}
+	}
+	method := t.httpMethod(coapMsg.Code)
+	path := t.rewritePath("/" + coapMsg.PathString())
+	queries, queryHeader := t.applyQueryRules(coapMsg)
+	url := addFinalSlash(t.BackendURL) + strings.TrimPrefix(path, "/") + encodeQueries(queries)
+	if t.URITemplate != nil {
+		url = t.URITemplate.expand(uriTemplateVars(coapMsg, path, queries))
+	}
+	forwardProxy := isForwardProxyRequest(coapMsg)
+	if forwardProxy {
+		var err error
+		if url, err = t.forwardProxyURL(coapMsg); err != nil {
+			return nil, err
+		}
+	}
+	payload, payloadFormat, err := t.requestPayload(coapMsg)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, &TranslationError{Code: coap.BadRequest, Reason: "invalid request URI", Err: err}
+	}
+	if forwardProxy {
+		req = withForwardProxy(req)
+	}
+
+	for name, values := range queryHeader {
+		for _, value := range values {
+			if !validHeaderValue(value) {
+				return nil, &TranslationError{Code: coap.BadRequest, Reason: "invalid " + name + " query parameter"}
+			}
+		}
+		req.Header[name] = values
+	}
+
+	if s, ok := uriHost(coapMsg); ok && !forwardProxy && t.URITemplate == nil {
+		req.Host = httpHost(s)
+	}
+	if t.Host != "" && !forwardProxy {
+		req.Host = t.Host
+	}
+
+	var etags []string
+	for _, etag := range requestValidators(coapMsg) {
+		if httpETag, ok := httpEntityTag(optionBytes(etag)); ok {
+			etags = append(etags, httpETag)
+		}
+	}
+	if len(etags) > 0 {
+		req.Header.Set("If-None-Match", strings.Join(etags, ", "))
+	}
+	if len(coapMsg.Options(coap.IfNoneMatch)) > 0 {
+		req.Header.Set("If-None-Match", "*")
+	}
+	if ifMatch := ifMatchHeader(coapMsg); ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
 	}
 
-	if s, ok := coapMsg.Option(coap.URIHost).(string); ok {
-		req.Host = s
+	if accept := coapMsg.Option(coap.Accept); accept != nil {
+		if t.transcodesCBOR(accept) {
+			accept = coap.AppJSON
+		}
+		acceptContent, found := t.contentFormats()[accept.(coap.MediaType)]
+		if !found {
+			return nil, &TranslationError{Code: coap.NotAcceptable, Reason: "unsupported accept format"}
+		}
+		req.Header.Set("Accept", t.acceptHeader(accept.(coap.MediaType), acceptContent))
+		if t.TranslateLinkFormat && accept == coap.AppLinkFormat {
+			req.Header.Set("Accept", acceptContent.Type+", "+t.contentFormats()[appLinkFormatJSON].Type)
+		}
+		if acceptContent.Encoding != "" {
+			req.Header.Set("Accept-Encoding", acceptContent.Encoding)
+		}
 	}
 
-	contentFormat, found := getContentFormatFromCoapMessage(*coapMsg)
+	contentFormat, found := t.getContentFormatFromCoapMessage(*coapMsg)
+	if payloadFormat != coapMsg.Option(coap.ContentFormat) {
+		contentFormat, found = t.contentFormats()[payloadFormat.(coap.MediaType)]
+	}
 
 	if found {
 		if contentFormat.Type != "" {
@@ -134,11 +542,162 @@ func translateCOAPRequestToHTTPRequest(coapMsg *coap.Message, backendURLPrefix s
 		if contentFormat.Encoding != "" {
 			req.Header.Set("Content-Encoding", contentFormat.Encoding)
 		}
+	} else if coapMsg.Option(coap.ContentFormat) != nil {
+		if t.StrictContentFormat {
+			return nil, &TranslationError{Code: coap.UnsupportedMediaType, Reason: "unsupported content format"}
+		}
+		if t.DefaultContentType != "" {
+			req.Header.Set("Content-Type", t.DefaultContentType)
+		}
 	}
-	return req
+	return req, nil
+}
+
+// requestPayload returns the payload sent to the backend and its
+// Content-Format, which differ from the request's if the payload is
+// converted.
+func (t *Translator) requestPayload(coapMsg *coap.Message) ([]byte, interface{}, error) {
+	mediaType := coapMsg.Option(coap.ContentFormat)
+	switch {
+	case t.transcodesCBOR(mediaType):
+		payload, err := cborToJSON(coapMsg.Payload)
+		if err != nil {
+			return nil, nil, &TranslationError{Code: coap.BadRequest, Reason: "invalid CBOR payload", Err: err}
+		}
+		return payload, coap.AppJSON, nil
+	case t.NormalizeSenML && isSenML(mediaType):
+		payload, err := normalizeSenML(coapMsg.Payload, mediaType.(coap.MediaType), time.Now())
+		if err != nil {
+			return nil, nil, &TranslationError{Code: coap.BadRequest, Reason: "invalid SenML payload", Err: err}
+		}
+		return payload, appSenMLJSON, nil
+	case t.TranslateLinkFormat && mediaType == coap.AppLinkFormat:
+		payload, err := linkFormatToJSON(coapMsg.Payload)
+		if err != nil {
+			return nil, nil, &TranslationError{Code: coap.BadRequest, Reason: "invalid link-format payload", Err: err}
+		}
+		return payload, appLinkFormatJSON, nil
+	case mediaType == appJSONDeflate && t.inflatesRequest(coapMsg):
+		payload, err := inflate(coapMsg.Payload, maxInflatedRequestBytes)
+		switch {
+		case err == errInflatedTooLarge:
+			return nil, nil, &TranslationError{Code: coap.RequestEntityTooLarge, Reason: "inflated payload too large", Err: err}
+		case err != nil:
+			return nil, nil, &TranslationError{Code: coap.BadRequest, Reason: "invalid deflated payload", Err: err}
+		}
+		return payload, coap.AppJSON, nil
+	}
+	return coapMsg.Payload, mediaType, nil
+}
+
+// inflatesRequest returns whether the path of coapMsg lies below one of
+// InflateRequests.
+func (t *Translator) inflatesRequest(coapMsg *coap.Message) bool {
+	path := coapMsg.PathString()
+	for _, prefix := range t.InflateRequests {
+		if hasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// convertsRequestPayload returns whether requestPayload converts the payload
+// of coapMsg.
+func (t *Translator) convertsRequestPayload(coapMsg *coap.Message) bool {
+	mediaType := coapMsg.Option(coap.ContentFormat)
+	return t.transcodesCBOR(mediaType) ||
+		(t.NormalizeSenML && isSenML(mediaType)) ||
+		(t.TranslateLinkFormat && mediaType == coap.AppLinkFormat) ||
+		(mediaType == appJSONDeflate && t.inflatesRequest(coapMsg))
 }
 
-func translateHTTPResponseToCOAPResponse(httpResp *http.Response, httpBody []byte, httpError error, coapRequest *coap.Message) (*translatedCOAPMessage, error) {
+// responsePayload returns the payload sent to the client and its
+// Content-Format, which differ from the backend's if the payload is
+// converted.
+func (t *Translator) responsePayload(body []byte, mediaType coap.MediaType, coapRequest *coap.Message) ([]byte, coap.MediaType, error) {
+	accept := coapRequest.Option(coap.Accept)
+	if convert := t.converter(mediaType, accept); convert != nil {
+		converted, err := convert(body)
+		return converted, accept.(coap.MediaType), err
+	}
+	switch {
+	case mediaType == coap.AppJSON && t.DeflateJSON && accept == appJSONDeflate:
+		deflated, err := deflate(body)
+		return deflated, appJSONDeflate, err
+	case t.TranslateLinkFormat && (accept == nil || accept == coap.AppLinkFormat) &&
+		(mediaType == appLinkFormatJSON || (mediaType == coap.AppJSON && isDiscovery(coapRequest))):
+		linkFormatBody, err := linkFormatFromJSON(body)
+		return linkFormatBody, coap.AppLinkFormat, err
+	}
+	return body, mediaType, nil
+}
+
+// needsWholeBody reports whether the body of the backend response httpResp
+// is converted or compressed as a whole before it's sent to the client.
+func (t *Translator) needsWholeBody(httpResp *http.Response, coapRequest *coap.Message) bool {
+	mediaType, ok := t.translateContentTypeWithEncoding(
+		httpResp.Header.Get("Content-Type"),
+		httpResp.Header.Get("Content-Encoding"))
+	if !ok {
+		return false
+	}
+	accept := coapRequest.Option(coap.Accept)
+	if t.converter(mediaType, accept) != nil || (mediaType == coap.AppJSON && t.DeflateJSON && (accept == nil || accept == appJSONDeflate)) {
+		return true
+	}
+	return t.TranslateLinkFormat && (accept == nil || accept == coap.AppLinkFormat) &&
+		(mediaType == appLinkFormatJSON || (mediaType == coap.AppJSON && isDiscovery(coapRequest)))
+}
+
+// maxInflatedRequestBytes caps the size of inflated request payloads, so
+// that a small deflated payload can't exhaust the proxy's memory.
+const maxInflatedRequestBytes = 1 << 20
+
+var errInflatedTooLarge = errors.New("inflated payload too large")
+
+// inflate decompresses body, in the "deflate" content coding, to at most
+// limit bytes.
+func inflate(body []byte, limit int64) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	inflated, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(inflated)) > limit {
+		return nil, errInflatedTooLarge
+	}
+	return inflated, nil
+}
+
+// deflate compresses body with the "deflate" content coding (zlib, RFC
+// 1950).
+func deflate(body []byte) ([]byte, error) {
+	buf := getScratchBuffer()
+	defer putScratchBuffer(buf)
+	w := zlibWriters.Get().(*zlib.Writer)
+	defer zlibWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// isDiscovery reports whether the request is for the CoRE resource
+// directory of RFC 6690 (/.well-known/core).
+func isDiscovery(coapRequest *coap.Message) bool {
+	return strings.Trim(coapRequest.PathString(), "/") == ".well-known/core"
+}
+
+func (t *Translator) translateHTTPResponseToCOAPResponse(httpResp *http.Response, httpBody []byte, httpError error, coapRequest *coap.Message) (*translatedCOAPMessage, error) {
 	coapResp := translatedCOAPMessage{
 		Message: coap.Message{
 			Type:      coap.Acknowledgement,
@@ -149,48 +708,371 @@ func translateHTTPResponseToCOAPResponse(httpResp *http.Response, httpBody []byt
 	}
 
 	if httpError != nil {
-		coapResp.Code = coap.ServiceUnavailable
+		coapResp.Code = translateBackendError(httpError)
 		return &coapResp, nil
 	}
 
-	coapResp.Code = translateStatusCode(httpResp.StatusCode)
-	contentFormat, hasContentFormat := translateContentTypeWithEncoding(
+	if t.TranslateRedirects && isRedirect(httpResp.StatusCode) {
+		return t.translateRedirect(&coapResp, httpResp)
+	}
+	coapResp.Code = translateStatusCode(coapRequest.Code, httpResp.StatusCode)
+	contentFormat, hasContentFormat := t.translateContentTypeWithEncoding(
 		httpResp.Header.Get("Content-Type"),
 		httpResp.Header.Get("Content-Encoding"))
+	if hasContentFormat && len(httpBody) > 0 {
+		body, mediaType, err := t.responsePayload(httpBody, contentFormat, coapRequest)
+		if err != nil {
+			coapResp.Code = coap.BadGateway
+			return &coapResp, &BackendError{StatusCode: httpResp.StatusCode, Code: coapResp.Code, Err: err}
+		}
+		httpBody, contentFormat = body, mediaType
+	}
 	if hasContentFormat {
 		coapResp.SetOption(coap.ContentFormat, contentFormat)
 	}
+	if accept := coapRequest.Option(coap.Accept); accept != nil && isSuccess(coapResp.Code) && len(httpBody) > 0 {
+		if !hasContentFormat || contentFormat != accept.(coap.MediaType) {
+			// The backend ignored the requested representation
+			coapResp.Code = coap.NotAcceptable
+			coapResp.RemoveOption(coap.ContentFormat)
+			return &coapResp, nil
+		}
+	}
+
+	etag := coapEntityTag(httpResp.Header.Get("ETag"))
+	if etag == nil && coapResp.Code == coap.Valid && len(coapRequest.Options(coap.ETag)) == 1 {
+		etag = optionBytes(coapRequest.Option(coap.ETag))
+	}
+	if etag != nil {
+		coapResp.SetOption(coap.ETag, etag)
+		if coapResp.Code == coap.Content && requestHasETag(coapRequest, etag) {
+			// The client's cached representation is still current
+			coapResp.Code = coap.Valid
+			coapResp.RemoveOption(coap.ContentFormat)
+			httpBody = nil
+		}
+	}
+	if maxAge, ok := responseMaxAge(httpResp.Header); ok {
+		coapResp.SetOption(coap.MaxAge, maxAge)
+	}
+	if coapResp.Code == coap.ServiceUnavailable {
+		// Tell the client when to retry (RFC 7252 section 5.9.3.4)
+		if delay, ok := retryAfter(httpResp.Header); ok {
+			coapResp.SetOption(coap.MaxAge, delay)
+		}
+	}
+	if coapResp.Code == coap.Created {
+		if location := httpResp.Header.Get("Location"); location != "" {
+			setLocationOptions(&coapResp.Message, location, httpResp.Request, t.BackendURL)
+		}
+	}
+
+	coapResp.ExtraOptions = append(t.mapResponseHeaders(httpResp.Header), t.forwardedHeaderOptions(httpResp.Header)...)
+	coapResp.ExtraOptions = append(coapResp.ExtraOptions, t.authChallengeOptions(coapResp.Code, httpResp.Header)...)
+	if isStale(httpResp.Header) {
+		coapResp.ExtraOptions = append(coapResp.ExtraOptions, rawOption{ID: optionStale})
+	}
+	if !isSuccess(coapResp.Code) && coapResp.Option(coap.ContentFormat) == nil {
+		httpBody = t.appendForwardedHeaders(httpBody, httpResp.Header)
+		httpBody = t.appendAuthChallenges(coapResp.Code, httpBody, httpResp.Header)
+	}
 
 	// intermediate marshalling
-	packetHeaders, err := coapResp.MarshalBinary()
+	scratch := getPacketBuffer()
+	defer putPacketBuffer(scratch)
+	packetHeaders, err := appendMessage((*scratch)[:0], &coapResp.Message, coapResp.ExtraOptions)
 	if err != nil {
 		coapResp.Code = coap.InternalServerError
 		coapResp.RemoveOption(coap.ContentFormat)
 		return &coapResp, err
 	}
 
-	// Check the size so far (+ 1 byte for the payload separator 0xff)
-	headersLen := len(packetHeaders) + 1
-	bytesLeft := maxCOAPPacketLen - headersLen
-	if len(httpBody) > bytesLeft {
-		coapResp.Payload = httpBody[:bytesLeft]
+	if len(httpBody) >= t.maxPacketSize()-len(packetHeaders) && t.DeflateJSON &&
+		coapResp.Option(coap.ContentFormat) == coap.AppJSON && coapRequest.Option(coap.Accept) == nil {
+		// Compressing is better than truncating
+		if deflated, err := deflate(httpBody); err == nil && len(deflated) < len(httpBody) {
+			httpBody = deflated
+			coapResp.deflated = true
+			coapResp.SetOption(coap.ContentFormat, appJSONDeflate)
+			if packetHeaders, err = appendMessage((*scratch)[:0], &coapResp.Message, coapResp.ExtraOptions); err != nil {
+				return &coapResp, err
+			}
+		}
+	}
+
+	t.setPayload(&coapResp, httpBody, len(packetHeaders))
+	return &coapResp, nil
+}
+
+// setPayload sets body as the payload of coapResp, whose options take
+// headersLen bytes, truncated to fit in a packet.
+func (t *Translator) setPayload(coapResp *translatedCOAPMessage, body []byte, headersLen int) {
+	// + 1 byte for the payload separator 0xff
+	bytesLeft := t.maxPacketSize() - headersLen - 1
+	if bytesLeft < 0 {
+		bytesLeft = 0
+	}
+	if len(body) > bytesLeft {
+		coapResp.Payload = body[:bytesLeft]
 		coapResp.IsTruncated = true
+		coapResp.untruncated = body
 	} else {
-		coapResp.Payload = httpBody
+		coapResp.Payload = body
 	}
-	return &coapResp, nil
 }
 
-func generateBadRequestCOAPResponse(coapRequest *coap.Message) *translatedCOAPMessage {
-	return &translatedCOAPMessage{
+// isRedirect reports whether the HTTP status code redirects the client to
+// the Location of the response.
+func isRedirect(httpStatusCode int) bool {
+	switch httpStatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// translateRedirect translates a backend redirect, which has no CoAP
+// counterpart, to a 2.05 Content response without payload carrying the
+// target in Location-Path and Location-Query options, for the client to
+// follow or not.  A redirect to the request URL itself, or to a URL outside
+// the backend, becomes 5.02 Bad Gateway.
+func (t *Translator) translateRedirect(coapResp *translatedCOAPMessage, httpResp *http.Response) (*translatedCOAPMessage, error) {
+	coapResp.Code = coap.BadGateway
+	location := httpResp.Header.Get("Location")
+	if location == "" {
+		return coapResp, fmt.Errorf("redirect %v without Location", httpResp.StatusCode)
+	}
+	if httpResp.Request != nil && httpResp.Request.URL != nil {
+		if u, err := httpResp.Request.URL.Parse(location); err == nil && u.String() == httpResp.Request.URL.String() {
+			return coapResp, errRedirectLoop
+		}
+	}
+	if !setLocationOptions(&coapResp.Message, location, httpResp.Request, t.BackendURL) {
+		return coapResp, fmt.Errorf("redirect to %v outside the backend", location)
+	}
+	coapResp.Code = coap.Content
+	return coapResp, nil
+}
+
+// setLocationOptions translates an HTTP Location header to Location-Path and
+// Location-Query options.  The location is resolved against the backend
+// request URL, and must lie below the backend URL prefix (which is stripped)
+// since CoAP locations are relative to the proxy; other locations are
+// dropped.
+func setLocationOptions(coapResp *coap.Message, location string, httpReq *http.Request, backendURLPrefix string) bool {
+	base, err := url.Parse(addFinalSlash(backendURLPrefix))
+	if err != nil {
+		return false
+	}
+	if httpReq != nil && httpReq.URL != nil {
+		base = httpReq.URL
+	}
+	locationURL, err := base.Parse(location)
+	if err != nil {
+		return false
+	}
+	prefixURL, err := url.Parse(addFinalSlash(backendURLPrefix))
+	if err != nil {
+		return false
+	}
+	if locationURL.Host != prefixURL.Host || !strings.HasPrefix(locationURL.EscapedPath(), prefixURL.EscapedPath()) {
+		return false
+	}
+	relativePath := strings.TrimPrefix(locationURL.EscapedPath(), prefixURL.EscapedPath())
+	var segments []string
+	for _, segment := range strings.Split(relativePath, "/") {
+		if segment == "" {
+			continue
+		}
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return false
+		}
+		segments = append(segments, unescaped)
+	}
+	var queries []string
+	if locationURL.RawQuery != "" {
+		for _, part := range strings.Split(locationURL.RawQuery, "&") {
+			unescaped, err := url.QueryUnescape(part)
+			if err != nil {
+				return false
+			}
+			queries = append(queries, unescaped)
+		}
+	}
+	coapResp.SetOption(coap.LocationPath, segments)
+	coapResp.SetOption(coap.LocationQuery, queries)
+	return true
+}
+
+// responseMaxAge derives the CoAP Max-Age (in seconds) from the backend's
+// Cache-Control or Expires headers.  Without either header, ok is false and
+// the client applies CoAP's default Max-Age of 60 seconds.
+func responseMaxAge(header http.Header) (uint32, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0, true
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.ParseUint(strings.Trim(directive[len("max-age="):], `"`), 10, 32)
+			if err != nil {
+				return 0, true
+			}
+			return uint32(seconds), true
+		}
+	}
+	expiresHeader := header.Get("Expires")
+	if expiresHeader == "" {
+		return 0, false
+	}
+	expires, err := http.ParseTime(expiresHeader)
+	if err != nil {
+		// Invalid dates (such as "0") mean already expired
+		return 0, true
+	}
+	now := time.Now()
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
+	}
+	return secondsUntil(now, expires), true
+}
+
+// retryAfter returns the delay in seconds given by the Retry-After header,
+// which is either a number of seconds or an HTTP date.
+func retryAfter(header http.Header) (uint32, bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(seconds), true
+	}
+	retryTime, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	now := time.Now()
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
+	}
+	return secondsUntil(now, retryTime), true
+}
+
+func secondsUntil(now, t time.Time) uint32 {
+	seconds := t.Sub(now) / time.Second
+	if seconds < 0 {
+		return 0
+	}
+	if seconds > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(seconds)
+}
+
+// optionBytes returns the value of an opaque option, which may have been set
+// as a string by the application.
+func optionBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+const maxCOAPETagLen = 8
+
+// coapEntityTag converts an HTTP ETag header value to a CoAP ETag option
+// value.  Entity tags which don't fit in the 8 bytes allowed by CoAP are
+// replaced by a truncated SHA-256 hash of the tag.
+func coapEntityTag(httpETag string) []byte {
+	opaque := strings.TrimPrefix(strings.TrimSpace(httpETag), "W/")
+	opaque = strings.TrimSuffix(strings.TrimPrefix(opaque, `"`), `"`)
+	if opaque == "" {
+		return nil
+	}
+	if len(opaque) <= maxCOAPETagLen {
+		return []byte(opaque)
+	}
+	sum := sha256.Sum256([]byte(opaque))
+	return sum[:maxCOAPETagLen]
+}
+
+// httpEntityTag converts a CoAP ETag option value to a quoted HTTP entity
+// tag.  Values which aren't valid entity tag characters (such as hashed
+// tags) can't have come from the backend verbatim and are skipped.
+func httpEntityTag(coapETag []byte) (string, bool) {
+	if len(coapETag) == 0 {
+		return "", false
+	}
+	for _, c := range coapETag {
+		if c <= 0x20 || c == '"' || c >= 0x7f {
+			return "", false
+		}
+	}
+	return `"` + string(coapETag) + `"`, true
+}
+
+// ifMatchHeader translates the If-Match options of a CoAP request.  An empty
+// option means "any representation" (*).  Hashed entity tags can't be
+// translated back, so they are sent hex-encoded; they never match and the
+// backend answers 412, which is the safe outcome for a condition that can't
+// be evaluated.
+func ifMatchHeader(coapMsg *coap.Message) string {
+	var tags []string
+	for _, value := range coapMsg.Options(coap.IfMatch) {
+		etag := optionBytes(value)
+		if len(etag) == 0 {
+			return "*"
+		}
+		if httpETag, ok := httpEntityTag(etag); ok {
+			tags = append(tags, httpETag)
+		} else {
+			tags = append(tags, `"`+hex.EncodeToString(etag)+`"`)
+		}
+	}
+	return strings.Join(tags, ", ")
+}
+
+func requestHasETag(coapRequest *coap.Message, etag []byte) bool {
+	for _, requestETag := range coapRequest.Options(coap.ETag) {
+		if bytes.Equal(optionBytes(requestETag), etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestValidators returns the ETag options of coapMsg if it's a GET or
+// FETCH request: only then do they list the representations the client has
+// (RFC 7252 section 5.10.6.2).
+func requestValidators(coapMsg *coap.Message) []interface{} {
+	if coapMsg.Code != coap.GET && coapMsg.Code != FETCH {
+		return nil
+	}
+	return coapMsg.Options(coap.ETag)
+}
+
+// generateErrorCOAPResponse builds an error response; a non-empty diagnostic
+// is sent as the payload (without a Content-Format option, see RFC 7252
+// section 5.5.2).
+func generateErrorCOAPResponse(coapRequest *coap.Message, code coap.COAPCode, diagnostic string) *translatedCOAPMessage {
+	coapResp := &translatedCOAPMessage{
 		Message: coap.Message{
 			Type:      coap.Acknowledgement,
-			Code:      coap.BadRequest,
+			Code:      code,
 			MessageID: coapRequest.MessageID,
 			Token:     coapRequest.Token,
 		},
 		IsTruncated: false,
 	}
+	if diagnostic != "" {
+		coapResp.Payload = []byte(diagnostic)
+	}
+	return coapResp
 }
 
 func addFinalSlash(s string) string {
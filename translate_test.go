@@ -3,17 +3,23 @@ package crosscoap
 import (
 	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/dustin/go-coap"
 )
 
-func getHTTPRespAndBody(t *testing.T, responseText string) (*http.Response, []byte) {
+func getHTTPRespAndBody(t testing.TB, responseText string) (*http.Response, []byte) {
 	responseReader := bufio.NewReader(bytes.NewReader([]byte(responseText)))
 	httpResp, err := http.ReadResponse(responseReader, nil)
 	if err != nil {
@@ -26,6 +32,14 @@ func getHTTPRespAndBody(t *testing.T, responseText string) (*http.Response, []by
 	return httpResp, httpBody
 }
 
+func mustTranslateCOAPRequest(t *testing.T, coapMsg *coap.Message, backendURLPrefix string) *http.Request {
+	httpReq, err := (&Translator{BackendURL: backendURLPrefix}).translateCOAPRequestToHTTPRequest(coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating CoAP request: %v", err)
+	}
+	return httpReq
+}
+
 func TestTranslateCOAPRequestWithoutContentFormat(t *testing.T) {
 	coapMsg := coap.Message{
 		Type:      coap.Confirmable,
@@ -36,7 +50,7 @@ func TestTranslateCOAPRequestWithoutContentFormat(t *testing.T) {
 	coapMsg.SetOption(coap.URIQuery, []string{"a=b", "c=d e&=f"})
 	coapMsg.Payload = []byte("The request body")
 
-	httpReq := translateCOAPRequestToHTTPRequest(&coapMsg, "http://localhost:9876/backend1")
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend1")
 	if httpReq.Method != "POST" {
 		t.Errorf("httpReq.Method is '%v'", httpReq.Method)
 	}
@@ -65,7 +79,7 @@ func TestTranslateCOAPRequestWithContentFormat(t *testing.T) {
 	coapMsg.SetPathString("resource")
 	coapMsg.SetOption(coap.ContentFormat, coap.TextPlain)
 
-	httpReq := translateCOAPRequestToHTTPRequest(&coapMsg, "http://localhost:9876/backend2/")
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
 	if httpReq.Method != "GET" {
 		t.Errorf("httpReq.Method is '%v'", httpReq.Method)
 	}
@@ -84,10 +98,46 @@ func TestTranslateCOAPRequestWithBadURI(t *testing.T) {
 		MessageID: 1234,
 	}
 	coapMsg.SetPathString("%")
-	httpReq := translateCOAPRequestToHTTPRequest(&coapMsg, "http://localhost:9876/backend2/")
+	httpReq, err := (&Translator{BackendURL: "http://localhost:9876/backend2/"}).translateCOAPRequestToHTTPRequest(&coapMsg)
 	if httpReq != nil {
 		t.Errorf("httpReq is not nil")
 	}
+	if err == nil || err.(*TranslationError).Code != coap.BadRequest {
+		t.Errorf("err is '%v'", err)
+	}
+}
+
+func TestTranslateCOAPRequestWithFetchAndPatch(t *testing.T) {
+	tests := []struct {
+		code          coap.COAPCode
+		contentFormat coap.MediaType
+		fetchMethod   string
+		method        string
+		contentType   string
+	}{
+		{FETCH, coap.AppJSON, "", "GET", "application/json"},
+		{FETCH, coap.AppJSON, "POST", "POST", "application/json"},
+		{PATCH, appJSONPatch, "", "PATCH", "application/json-patch+json"},
+		{IPATCH, appMergePatch, "", "PATCH", "application/merge-patch+json"},
+	}
+	for _, test := range tests {
+		coapMsg := coap.Message{Type: coap.Confirmable, Code: test.code, MessageID: 1234, Payload: []byte(`{"a":1}`)}
+		coapMsg.SetPathString("resource")
+		coapMsg.SetOption(coap.ContentFormat, test.contentFormat)
+		httpReq, err := (&Translator{BackendURL: "http://localhost:9876/", FetchMethod: test.fetchMethod}).translateCOAPRequestToHTTPRequest(&coapMsg)
+		if err != nil {
+			t.Fatalf("Error translating %v request: %v", methodName(test.code), err)
+		}
+		if httpReq.Method != test.method || httpReq.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("%v request is translated to '%v' with Content-Type '%v'", methodName(test.code), httpReq.Method, httpReq.Header.Get("Content-Type"))
+		}
+		if body, _ := ioutil.ReadAll(httpReq.Body); string(body) != `{"a":1}` {
+			t.Errorf("httpReq.Body is '%v'", string(body))
+		}
+		if cacheable(httpReq) {
+			t.Errorf("%v request is cacheable", methodName(test.code))
+		}
+	}
 }
 
 func TestTranslateCOAPRequestWithUriHost(t *testing.T) {
@@ -100,7 +150,7 @@ func TestTranslateCOAPRequestWithUriHost(t *testing.T) {
 	coapMsg.SetPathString("resource")
 	coapMsg.SetOption(coap.URIHost, []string{customUriHost})
 
-	httpReq := translateCOAPRequestToHTTPRequest(&coapMsg, "http://localhost:9876/backend2/")
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
 	if httpReq.Host != customUriHost {
 		t.Errorf("httpReq.Host is '%v'", httpReq.Host)
 	}
@@ -115,7 +165,7 @@ func TestTranslateCOAPRequestWithoutUriHost(t *testing.T) {
 	}
 	coapMsg.SetPathString("resource")
 
-	httpReq := translateCOAPRequestToHTTPRequest(&coapMsg, backendURLPrefix)
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, backendURLPrefix)
 	u, err := url.Parse(backendURLPrefix)
 	if err != nil {
 		t.Error("error parsing URL")
@@ -135,7 +185,7 @@ func TestTranslateCOAPRequestWithContentEncoding(t *testing.T) {
 	coapMsg.SetPathString("resource")
 	coapMsg.SetOption(coap.ContentFormat, appJSONDeflate)
 
-	httpReq := translateCOAPRequestToHTTPRequest(&coapMsg, backendURLPrefix)
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, backendURLPrefix)
 	if httpReq.Header.Get("Content-Type") != "application/json" {
 		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
 	}
@@ -144,6 +194,112 @@ func TestTranslateCOAPRequestWithContentEncoding(t *testing.T) {
 	}
 }
 
+func TestTranslateCOAPRequestWithInflatedPayload(t *testing.T) {
+	translator := &Translator{BackendURL: "http://localhost:9876/", InflateRequests: []string{"/telemetry"}}
+	payload, _ := deflate([]byte(`{"temp":21.5}`))
+	for _, tt := range []struct {
+		path             string
+		payload          []byte
+		expectedCode     coap.COAPCode
+		expectedEncoding string
+		expectedBody     string
+	}{
+		{"telemetry/temp", payload, 0, "", `{"temp":21.5}`},
+		{"other", payload, 0, "deflate", string(payload)},
+		{"telemetry/temp", []byte("garbage"), coap.BadRequest, "", ""},
+		{"telemetry/temp", mustDeflate(t, bytes.Repeat([]byte(" "), maxInflatedRequestBytes+1)), coap.RequestEntityTooLarge, "", ""},
+	} {
+		coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1234, Payload: tt.payload}
+		coapMsg.SetPathString(tt.path)
+		coapMsg.SetOption(coap.ContentFormat, appJSONDeflate)
+		httpReq, err := translator.translateCOAPRequestToHTTPRequest(&coapMsg)
+		if tt.expectedCode != 0 {
+			if terr, ok := err.(*TranslationError); !ok || terr.Code != tt.expectedCode {
+				t.Errorf("%v: error is '%v'", tt.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: error translating CoAP request: %v", tt.path, err)
+		}
+		body, _ := ioutil.ReadAll(httpReq.Body)
+		if httpReq.Header.Get("Content-Type") != "application/json" || httpReq.Header.Get("Content-Encoding") != tt.expectedEncoding || string(body) != tt.expectedBody {
+			t.Errorf("%v: request is %v '%s'", tt.path, httpReq.Header, body)
+		}
+	}
+}
+
+func mustDeflate(t *testing.T, body []byte) []byte {
+	deflated, err := deflate(body)
+	if err != nil {
+		t.Fatalf("Error deflating: %v", err)
+	}
+	return deflated
+}
+
+func TestTranslateCOAPRequestWithUnknownContentFormat(t *testing.T) {
+	coapMsg := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.POST,
+		MessageID: 1234,
+	}
+	coapMsg.SetPathString("resource")
+	coapMsg.SetOption(coap.ContentFormat, coap.MediaType(12345))
+
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
+	if httpReq.Header.Get("Content-Type") != "" {
+		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+
+	lenient := Translator{BackendURL: "http://localhost:9876/backend2/", DefaultContentType: "application/octet-stream"}
+	httpReq, err := lenient.translateCOAPRequestToHTTPRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating CoAP request: %v", err)
+	}
+	if httpReq.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+
+	strict := Translator{BackendURL: "http://localhost:9876/backend2/", StrictContentFormat: true}
+	_, err = strict.translateCOAPRequestToHTTPRequest(&coapMsg)
+	if err == nil || err.(*TranslationError).Code != coap.UnsupportedMediaType {
+		t.Errorf("err is '%v'", err)
+	}
+}
+
+func TestRegisterContentFormat(t *testing.T) {
+	const lwm2mTLV coap.MediaType = 11542
+	var p Proxy
+	p.RegisterContentFormat(lwm2mTLV, "application/vnd.oma.lwm2m+tlv", "")
+	tr := newProxyHandler(&p).translator
+
+	coapMsg := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.PUT,
+		MessageID: 1234,
+	}
+	coapMsg.SetPathString("resource")
+	coapMsg.SetOption(coap.ContentFormat, lwm2mTLV)
+	httpReq, err := tr.translateCOAPRequestToHTTPRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating CoAP request: %v", err)
+	}
+	if httpReq.Header.Get("Content-Type") != "application/vnd.oma.lwm2m+tlv" {
+		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+
+	mediaType, found := tr.translateContentTypeWithEncoding("application/vnd.oma.lwm2m+tlv", "")
+	if !found || mediaType != lwm2mTLV {
+		t.Errorf("content format is %v, %v", mediaType, found)
+	}
+	if _, found := tr.translateContentTypeWithEncoding("application/json", ""); !found {
+		t.Error("Expected built-in content formats to remain registered")
+	}
+	if _, found := (&Translator{}).translateContentTypeWithEncoding("application/vnd.oma.lwm2m+tlv", ""); found {
+		t.Error("Expected the built-in table to be unchanged")
+	}
+}
+
 func TestTranslateCOAPResponse(t *testing.T) {
 	coapReq := coap.Message{MessageID: 1234, Token: []byte("MY-TOKEN")}
 	coapReq.SetPathString("/path/to/resource")
@@ -153,7 +309,7 @@ func TestTranslateCOAPResponse(t *testing.T) {
 		"\r\n" +
 		`{"ok":"The response body"}`
 	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
-	coapResp, err := translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
 	if err != nil {
 		t.Fatalf("Error translating: %v", err)
 	}
@@ -187,7 +343,7 @@ func TestTranslateCOAPResponseWithContentEncoding(t *testing.T) {
 		"\r\n" +
 		`{"ok":"The response body"}`
 	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
-	coapResp, err := translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
 	if err != nil {
 		t.Fatalf("Error translating: %v", err)
 	}
@@ -220,7 +376,7 @@ func TestTranslateCOAPResponseWithPlainText(t *testing.T) {
 		"\r\n" +
 		"Response Body"
 	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
-	coapResp, err := translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
 	if err != nil {
 		t.Fatalf("Error translating: %v", err)
 	}
@@ -250,7 +406,7 @@ func TestTranslateCOAPNoContentResponse(t *testing.T) {
 
 	responseText := "HTTP/1.0 204 No Content\r\n\r\n"
 	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
-	coapResp, err := translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
 	if err != nil {
 		t.Fatalf("Error translating: %v", err)
 	}
@@ -268,10 +424,390 @@ func TestTranslateCOAPNoContentResponse(t *testing.T) {
 	}
 }
 
+func TestTranslateStatusCodeDependsOnMethod(t *testing.T) {
+	tests := []struct {
+		method     coap.COAPCode
+		statusCode int
+		expected   coap.COAPCode
+	}{
+		{coap.GET, http.StatusOK, coap.Content},
+		{coap.GET, http.StatusNoContent, coap.Content},
+		{coap.POST, http.StatusOK, coap.Changed},
+		{coap.POST, http.StatusCreated, coap.Created},
+		{coap.PUT, http.StatusNoContent, coap.Changed},
+		{coap.PUT, http.StatusCreated, coap.Created},
+		{coap.DELETE, http.StatusOK, coap.Deleted},
+		{coap.DELETE, http.StatusNoContent, coap.Deleted},
+		{coap.DELETE, http.StatusNotFound, coap.NotFound},
+		{coap.PUT, http.StatusPreconditionFailed, coap.PreconditionFailed},
+		{FETCH, http.StatusOK, coap.Content},
+		{PATCH, http.StatusNoContent, coap.Changed},
+		{IPATCH, http.StatusOK, coap.Changed},
+		{PATCH, http.StatusConflict, codeConflict},
+		{IPATCH, http.StatusUnprocessableEntity, codeUnprocessableEntity},
+		{coap.GET, http.StatusSwitchingProtocols, coap.BadGateway},
+	}
+	for _, test := range tests {
+		if code := translateStatusCode(test.method, test.statusCode); code != test.expected {
+			t.Errorf("translateStatusCode(%v, %v) is %v; expected %v", test.method, test.statusCode, code, test.expected)
+		}
+	}
+}
+
+func TestTranslateCOAPResponseWithLocation(t *testing.T) {
+	tests := []struct {
+		location     string
+		expectedPath []interface{}
+		expectedQry  []interface{}
+	}{
+		{"/backend/items/42", []interface{}{"items", "42"}, nil},
+		{"http://localhost:9876/backend/items/a%20b?x=1&y=a%26b", []interface{}{"items", "a b"}, []interface{}{"x=1", "y=a&b"}},
+		{"items/43", []interface{}{"items", "43"}, nil},
+		{"http://elsewhere.example.com/backend/items/44", nil, nil},
+		{"/other/items/45", nil, nil},
+	}
+	for _, test := range tests {
+		coapReq := coap.Message{Code: coap.POST, MessageID: 1234}
+		coapReq.SetPathString("/items")
+		responseText := "HTTP/1.0 201 Created\r\n" +
+			"Location: " + test.location + "\r\n" +
+			"\r\n"
+		httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+		coapResp, err := (&Translator{BackendURL: "http://localhost:9876/backend"}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+		if err != nil {
+			t.Fatalf("Error translating: %v", err)
+		}
+		if coapResp.Code != coap.Created {
+			t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+		}
+		if path := coapResp.Options(coap.LocationPath); !reflect.DeepEqual(path, test.expectedPath) {
+			t.Errorf("%v: Location-Path is %v", test.location, path)
+		}
+		if query := coapResp.Options(coap.LocationQuery); !reflect.DeepEqual(query, test.expectedQry) {
+			t.Errorf("%v: Location-Query is %v", test.location, query)
+		}
+	}
+}
+
+func TestTranslateCOAPResponseWithRedirect(t *testing.T) {
+	tests := []struct {
+		status       string
+		location     string
+		expectedCode coap.COAPCode
+		expectedPath []interface{}
+		expectedQry  []interface{}
+	}{
+		{"301 Moved Permanently", "/backend/v2/items?x=1", coap.Content, []interface{}{"v2", "items"}, []interface{}{"x=1"}},
+		{"307 Temporary Redirect", "v2", coap.Content, []interface{}{"v2"}, nil},
+		{"302 Found", "http://elsewhere.example.com/backend/v2", coap.BadGateway, nil, nil},
+		{"302 Found", "", coap.BadGateway, nil, nil},
+		{"308 Permanent Redirect", "/backend/items", coap.BadGateway, nil, nil},
+	}
+	for _, test := range tests {
+		coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+		coapReq.SetPathString("/items")
+		responseText := "HTTP/1.0 " + test.status + "\r\n" +
+			"Location: " + test.location + "\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<a>moved</a>"
+		httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+		httpResp.Request, _ = http.NewRequest("GET", "http://localhost:9876/backend/items", nil)
+		coapResp, err := (&Translator{BackendURL: "http://localhost:9876/backend", TranslateRedirects: true}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+		if (err != nil) != (test.expectedCode == coap.BadGateway) {
+			t.Errorf("%v: error is '%v'", test.location, err)
+		}
+		if coapResp.Code != test.expectedCode {
+			t.Errorf("%v: coapResp.Code is '%v'", test.location, coapResp.Code)
+		}
+		if len(coapResp.Payload) != 0 {
+			t.Errorf("%v: payload is '%s'", test.location, coapResp.Payload)
+		}
+		if path := coapResp.Options(coap.LocationPath); !reflect.DeepEqual(path, test.expectedPath) {
+			t.Errorf("%v: Location-Path is %v", test.location, path)
+		}
+		if query := coapResp.Options(coap.LocationQuery); !reflect.DeepEqual(query, test.expectedQry) {
+			t.Errorf("%v: Location-Query is %v", test.location, query)
+		}
+	}
+}
+
+func TestTranslateCOAPRequestWithETag(t *testing.T) {
+	coapMsg := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.GET,
+		MessageID: 1234,
+	}
+	coapMsg.SetPathString("resource")
+	coapMsg.AddOption(coap.ETag, []byte("v1"))
+	coapMsg.AddOption(coap.ETag, []byte{0x01, 0xfe})
+	coapMsg.AddOption(coap.ETag, []byte("v2"))
+
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
+	if ifNoneMatch := httpReq.Header.Get("If-None-Match"); ifNoneMatch != `"v1", "v2"` {
+		t.Errorf("If-None-Match is '%v'", ifNoneMatch)
+	}
+
+	for _, code := range []coap.COAPCode{coap.PUT, coap.POST} {
+		coapMsg.Code = code
+		httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
+		if ifNoneMatch := httpReq.Header.Get("If-None-Match"); ifNoneMatch != "" {
+			t.Errorf("%v: If-None-Match is '%v'", code, ifNoneMatch)
+		}
+	}
+}
+
+func TestTranslateCOAPRequestWithIfMatch(t *testing.T) {
+	tests := []struct {
+		ifMatch  [][]byte
+		expected string
+	}{
+		{[][]byte{[]byte("v1")}, `"v1"`},
+		{[][]byte{[]byte("v1"), {0x01, 0xfe}}, `"v1", "01fe"`},
+		{[][]byte{[]byte("v1"), {}}, "*"},
+	}
+	for _, test := range tests {
+		coapMsg := coap.Message{
+			Type:      coap.Confirmable,
+			Code:      coap.PUT,
+			MessageID: 1234,
+		}
+		coapMsg.SetPathString("resource")
+		for _, etag := range test.ifMatch {
+			coapMsg.AddOption(coap.IfMatch, etag)
+		}
+		httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
+		if ifMatch := httpReq.Header.Get("If-Match"); ifMatch != test.expected {
+			t.Errorf("If-Match is '%v'; expected '%v'", ifMatch, test.expected)
+		}
+	}
+}
+
+func TestTranslateCOAPRequestWithIfNoneMatch(t *testing.T) {
+	coapMsg := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.PUT,
+		MessageID: 1234,
+	}
+	coapMsg.SetPathString("resource")
+	coapMsg.SetOption(coap.IfNoneMatch, []byte{})
+
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
+	if ifNoneMatch := httpReq.Header.Get("If-None-Match"); ifNoneMatch != "*" {
+		t.Errorf("If-None-Match is '%v'", ifNoneMatch)
+	}
+	if httpReq.Header.Get("If-Match") != "" {
+		t.Errorf("If-Match is '%v'", httpReq.Header.Get("If-Match"))
+	}
+}
+
+func TestTranslateCOAPRequestWithAccept(t *testing.T) {
+	coapMsg := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.GET,
+		MessageID: 1234,
+	}
+	coapMsg.SetPathString("resource")
+	coapMsg.SetOption(coap.Accept, appJSONDeflate)
+
+	httpReq := mustTranslateCOAPRequest(t, &coapMsg, "http://localhost:9876/backend2/")
+	if accept := httpReq.Header.Get("Accept"); accept != "application/json" {
+		t.Errorf("Accept is '%v'", accept)
+	}
+	if acceptEncoding := httpReq.Header.Get("Accept-Encoding"); acceptEncoding != "deflate" {
+		t.Errorf("Accept-Encoding is '%v'", acceptEncoding)
+	}
+
+	coapMsg.SetOption(coap.Accept, coap.MediaType(12345))
+	_, err := (&Translator{BackendURL: "http://localhost:9876/backend2/"}).translateCOAPRequestToHTTPRequest(&coapMsg)
+	if err == nil || err.(*TranslationError).Code != coap.NotAcceptable {
+		t.Errorf("err is '%v'", err)
+	}
+}
+
+func TestTranslateCOAPResponseWithUnacceptableContentFormat(t *testing.T) {
+	coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/path/to/resource")
+	coapReq.SetOption(coap.Accept, coap.AppJSON)
+
+	responseText := "HTTP/1.0 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Response Body"
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if coapResp.Code != coap.NotAcceptable {
+		t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+	}
+	if len(coapResp.Payload) != 0 {
+		t.Errorf("coapResp.Payload is '%v'", string(coapResp.Payload))
+	}
+}
+
+func TestCOAPEntityTag(t *testing.T) {
+	tests := []struct {
+		httpETag string
+		expected []byte
+	}{
+		{`"abc"`, []byte("abc")},
+		{`W/"abc"`, []byte("abc")},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if etag := coapEntityTag(test.httpETag); !bytes.Equal(etag, test.expected) {
+			t.Errorf("coapEntityTag(%v) is %v", test.httpETag, etag)
+		}
+	}
+	if etag := coapEntityTag(`"0123456789abcdef"`); len(etag) != 8 {
+		t.Errorf("Expected long entity tag to be hashed to 8 bytes, got %v", etag)
+	}
+}
+
+func TestTranslateCOAPResponseWithETag(t *testing.T) {
+	coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/path/to/resource")
+
+	responseText := "HTTP/1.0 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"ETag: \"v1\"\r\n" +
+		"\r\n" +
+		"Response Body"
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if coapResp.Code != coap.Content {
+		t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+	}
+	if etag := optionBytes(coapResp.Option(coap.ETag)); string(etag) != "v1" {
+		t.Errorf("coapResp ETag is '%v'", etag)
+	}
+	if string(coapResp.Payload) != "Response Body" {
+		t.Errorf("coapResp.Payload is '%v'", string(coapResp.Payload))
+	}
+}
+
+func TestTranslateCOAPResponseWithMatchingETagIsValid(t *testing.T) {
+	longETag := `"0123456789abcdef"`
+	coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/path/to/resource")
+	coapReq.AddOption(coap.ETag, coapEntityTag(longETag))
+
+	responseText := "HTTP/1.0 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"ETag: " + longETag + "\r\n" +
+		"\r\n" +
+		"Response Body"
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if coapResp.Code != coap.Valid {
+		t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+	}
+	if len(coapResp.Payload) != 0 {
+		t.Errorf("coapResp.Payload is '%v'", string(coapResp.Payload))
+	}
+	if coapResp.Option(coap.ContentFormat) != nil {
+		t.Errorf("content format is %v", coapResp.Option(coap.ContentFormat))
+	}
+}
+
+func TestTranslateCOAPResponseNotModified(t *testing.T) {
+	coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/path/to/resource")
+	coapReq.AddOption(coap.ETag, []byte("v1"))
+
+	responseText := "HTTP/1.1 304 Not Modified\r\n\r\n"
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if coapResp.Code != coap.Valid {
+		t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+	}
+	if etag := optionBytes(coapResp.Option(coap.ETag)); string(etag) != "v1" {
+		t.Errorf("coapResp ETag is '%v'", etag)
+	}
+}
+
+func TestResponseMaxAge(t *testing.T) {
+	tests := []struct {
+		header   http.Header
+		expected uint32
+		ok       bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Cache-Control": {"public, max-age=300"}}, 300, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=10"}, "Expires": {"Thu, 01 Jan 2015 00:00:00 GMT"}}, 10, true},
+		{http.Header{"Date": {"Thu, 01 Jan 2015 00:00:00 GMT"}, "Expires": {"Thu, 01 Jan 2015 00:02:00 GMT"}}, 120, true},
+		{http.Header{"Date": {"Thu, 01 Jan 2015 00:02:00 GMT"}, "Expires": {"Thu, 01 Jan 2015 00:00:00 GMT"}}, 0, true},
+		{http.Header{"Expires": {"0"}}, 0, true},
+	}
+	for _, test := range tests {
+		maxAge, ok := responseMaxAge(test.header)
+		if maxAge != test.expected || ok != test.ok {
+			t.Errorf("responseMaxAge(%v) is %v, %v", test.header, maxAge, ok)
+		}
+	}
+}
+
+func TestTranslateCOAPResponseWithMaxAge(t *testing.T) {
+	coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/path/to/resource")
+
+	responseText := "HTTP/1.0 200 OK\r\n" +
+		"Cache-Control: max-age=3600\r\n" +
+		"\r\n" +
+		"Response Body"
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if maxAge := coapResp.Option(coap.MaxAge); maxAge != uint32(3600) {
+		t.Errorf("Max-Age is %v", maxAge)
+	}
+}
+
+func TestTranslateCOAPResponseWithRetryAfter(t *testing.T) {
+	tests := []struct {
+		headers  string
+		expected uint32
+	}{
+		{"Retry-After: 120\r\n", 120},
+		{"Date: Thu, 01 Jan 2015 00:00:00 GMT\r\nRetry-After: Thu, 01 Jan 2015 00:00:30 GMT\r\n", 30},
+		{"Cache-Control: max-age=600\r\nRetry-After: 5\r\n", 5},
+	}
+	for _, test := range tests {
+		coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+		coapReq.SetPathString("/path/to/resource")
+		responseText := "HTTP/1.0 503 Service Unavailable\r\n" + test.headers + "\r\n"
+		httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+		coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+		if err != nil {
+			t.Fatalf("Error translating: %v", err)
+		}
+		if coapResp.Code != coap.ServiceUnavailable {
+			t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+		}
+		if maxAge := coapResp.Option(coap.MaxAge); maxAge != test.expected {
+			t.Errorf("%q: Max-Age is %v; expected %v", test.headers, maxAge, test.expected)
+		}
+	}
+}
+
 func TestTranslateCOAPResponseWithErrorDuringRequest(t *testing.T) {
 	coapReq := coap.Message{MessageID: 1234}
 	coapReq.SetPathString("/path/to/resource")
-	coapResp, err := translateHTTPResponseToCOAPResponse(nil, nil, fmt.Errorf("dummy error"), &coapReq)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(nil, nil, fmt.Errorf("dummy error"), &coapReq)
 	if err != nil {
 		t.Fatalf("Error translating: %v", err)
 	}
@@ -289,6 +825,33 @@ func TestTranslateCOAPResponseWithErrorDuringRequest(t *testing.T) {
 	}
 }
 
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTranslateBackendError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected coap.COAPCode
+	}{
+		{fmt.Errorf("dummy error"), coap.ServiceUnavailable},
+		{&url.Error{Op: "Get", URL: "http://backend/", Err: timeoutError{}}, coap.GatewayTimeout},
+		{&url.Error{Op: "Get", URL: "http://backend/", Err: context.DeadlineExceeded}, coap.GatewayTimeout},
+		{&url.Error{Op: "Get", URL: "http://backend/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, coap.BadGateway},
+		{&url.Error{Op: "Get", URL: "http://backend/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "backend", IsNotFound: true}}}, coap.BadGateway},
+	}
+	for _, test := range tests {
+		if code := translateBackendError(test.err); code != test.expected {
+			t.Errorf("translateBackendError(%v) is %v; expected %v", test.err, code, test.expected)
+		}
+	}
+	if !isCanceled(&url.Error{Op: "Get", URL: "http://backend/", Err: context.Canceled}) {
+		t.Error("Expected canceled request to be recognized")
+	}
+}
+
 func TestTranslateCOAPResponseTrunactesBigHTTPBody(t *testing.T) {
 	coapReq := coap.Message{MessageID: 1234, Token: []byte("TOKEN")}
 	coapReq.SetPathString("/path/to/resource")
@@ -297,7 +860,7 @@ func TestTranslateCOAPResponseTrunactesBigHTTPBody(t *testing.T) {
 		"\r\n" +
 		strings.Repeat("ABCD", 1000)
 	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
-	coapResp, err := translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	coapResp, err := (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
 	if err != nil {
 		t.Fatalf("Error translating: %v", err)
 	}
@@ -309,3 +872,314 @@ func TestTranslateCOAPResponseTrunactesBigHTTPBody(t *testing.T) {
 		t.Errorf("Expected CoAP payload %v, got %v", exp, len(payload))
 	}
 }
+
+func TestTranslateCOAPRequestWithCBORTranscoding(t *testing.T) {
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1234}
+	coapMsg.SetPathString("/path/to/resource")
+	coapMsg.SetOption(coap.ContentFormat, appCBOR)
+	coapMsg.SetOption(coap.Accept, appCBOR)
+	coapMsg.Payload, _ = hex.DecodeString("a16474656d70f93e00")
+	httpReq, err := (&Translator{TranscodeCBOR: true}).translateCOAPRequestToHTTPRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating CoAP request: %v", err)
+	}
+	if httpReq.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+	if httpReq.Header.Get("Accept") != "application/json" {
+		t.Errorf("Accept is '%v'", httpReq.Header.Get("Accept"))
+	}
+	body, _ := ioutil.ReadAll(httpReq.Body)
+	if string(body) != `{"temp":1.5}` {
+		t.Errorf("body is '%v'", string(body))
+	}
+
+	coapMsg.Payload = []byte{0xa1}
+	_, err = (&Translator{TranscodeCBOR: true}).translateCOAPRequestToHTTPRequest(&coapMsg)
+	if translateErr, ok := err.(*TranslationError); !ok || translateErr.Code != coap.BadRequest {
+		t.Errorf("Expected 4.00 for invalid CBOR, got %v", err)
+	}
+
+	coapMsg.Payload = []byte{0xa0}
+	httpReq = mustTranslateCOAPRequest(t, &coapMsg, "")
+	if httpReq.Header.Get("Content-Type") != "application/cbor" {
+		t.Errorf("Content-Type without transcoding is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+}
+
+func TestTranslateCOAPResponseWithCBORTranscoding(t *testing.T) {
+	coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/path/to/resource")
+	coapReq.SetOption(coap.Accept, appCBOR)
+
+	responseText := "HTTP/1.0 200 OK\r\n" +
+		"Content-Type: application/json\r\n" +
+		"\r\n" +
+		`{"temp": 21}`
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, err := (&Translator{TranscodeCBOR: true}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if coapResp.Code != coap.Content {
+		t.Errorf("coapResp.Code is '%v'", coapResp.Code)
+	}
+	if cf := coapResp.Option(coap.ContentFormat); cf != appCBOR {
+		t.Errorf("content format is %v", cf)
+	}
+	if hex.EncodeToString(coapResp.Payload) != "a16474656d7015" {
+		t.Errorf("coapResp.Payload is '%x'", coapResp.Payload)
+	}
+
+	coapResp, err = (&Translator{}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if coapResp.Code != coap.NotAcceptable {
+		t.Errorf("coapResp.Code without transcoding is '%v'", coapResp.Code)
+	}
+}
+
+func TestTranslateCOAPRequestWithSenMLNormalization(t *testing.T) {
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1234}
+	coapMsg.SetPathString("/measurements")
+	coapMsg.SetOption(coap.ContentFormat, appSenMLJSON)
+	coapMsg.Payload = []byte(`[{"bn":"dev/","bt":1500000000,"n":"temp","v":21}]`)
+	httpReq, err := (&Translator{NormalizeSenML: true}).translateCOAPRequestToHTTPRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating CoAP request: %v", err)
+	}
+	if httpReq.Header.Get("Content-Type") != "application/senml+json" {
+		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(httpReq.Body)
+	if string(body) != `[{"n":"dev/temp","t":1500000000,"v":21}]` {
+		t.Errorf("body is '%v'", string(body))
+	}
+
+	coapMsg.Payload = []byte(`[{"v":21}]`)
+	_, err = (&Translator{NormalizeSenML: true}).translateCOAPRequestToHTTPRequest(&coapMsg)
+	if translateErr, ok := err.(*TranslationError); !ok || translateErr.Code != coap.BadRequest {
+		t.Errorf("Expected 4.00 for invalid SenML, got %v", err)
+	}
+}
+
+func TestTranslateCOAPResponseWithLinkFormatTranslation(t *testing.T) {
+	tests := []struct {
+		contentType string
+		path        string
+		translated  bool
+	}{
+		{"application/link-format+json", "/rd", true},
+		{"application/json", "/.well-known/core", true},
+		{"application/json", "/rd", false},
+	}
+	for _, test := range tests {
+		coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+		coapReq.SetPathString(test.path)
+		responseText := "HTTP/1.0 200 OK\r\n" +
+			"Content-Type: " + test.contentType + "\r\n" +
+			"\r\n" +
+			`[{"href":"/sensors/temp","rt":"temperature-c"}]`
+		httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+		coapResp, err := (&Translator{TranslateLinkFormat: true}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+		if err != nil {
+			t.Fatalf("Error translating: %v", err)
+		}
+		cf := coapResp.Option(coap.ContentFormat)
+		if translated := cf == coap.AppLinkFormat; translated != test.translated {
+			t.Errorf("%v %v: content format is %v", test.contentType, test.path, cf)
+		}
+		if test.translated && string(coapResp.Payload) != `</sensors/temp>;rt="temperature-c"` {
+			t.Errorf("%v %v: coapResp.Payload is '%v'", test.contentType, test.path, string(coapResp.Payload))
+		}
+	}
+}
+
+func TestTranslateCOAPRequestWithLinkFormatTranslation(t *testing.T) {
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 1234}
+	coapMsg.SetPathString("/rd")
+	coapMsg.SetOption(coap.ContentFormat, coap.AppLinkFormat)
+	coapMsg.SetOption(coap.Accept, coap.AppLinkFormat)
+	coapMsg.Payload = []byte(`</sensors/temp>;rt="temperature-c"`)
+	httpReq, err := (&Translator{TranslateLinkFormat: true}).translateCOAPRequestToHTTPRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating CoAP request: %v", err)
+	}
+	if httpReq.Header.Get("Content-Type") != "application/link-format+json" {
+		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+	if httpReq.Header.Get("Accept") != "application/link-format, application/link-format+json" {
+		t.Errorf("Accept is '%v'", httpReq.Header.Get("Accept"))
+	}
+	body, _ := ioutil.ReadAll(httpReq.Body)
+	if string(body) != `[{"href":"/sensors/temp","rt":"temperature-c"}]` {
+		t.Errorf("body is '%v'", string(body))
+	}
+}
+
+func mustInflate(t *testing.T, data []byte) string {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error inflating: %v", err)
+	}
+	inflated, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error inflating: %v", err)
+	}
+	return string(inflated)
+}
+
+func TestTranslateCOAPResponseWithDeflatedJSON(t *testing.T) {
+	smallJSON := `{"temp": 21}`
+	bigJSON := "[" + strings.Repeat(`{"temp": 21},`, 200) + `{"temp": 21}]`
+	tests := []struct {
+		accept   interface{}
+		body     string
+		deflated bool
+	}{
+		{appJSONDeflate, smallJSON, true},
+		{nil, smallJSON, false},
+		{nil, bigJSON, true},
+		{coap.AppJSON, bigJSON, false},
+	}
+	for _, test := range tests {
+		coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+		coapReq.SetPathString("/path/to/resource")
+		if test.accept != nil {
+			coapReq.SetOption(coap.Accept, test.accept)
+		}
+		responseText := "HTTP/1.0 200 OK\r\n" +
+			"Content-Type: application/json\r\n" +
+			"\r\n" +
+			test.body
+		httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+		coapResp, err := (&Translator{DeflateJSON: true}).translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+		if err != nil {
+			t.Fatalf("Error translating: %v", err)
+		}
+		cf := coapResp.Option(coap.ContentFormat)
+		if deflated := cf == appJSONDeflate; deflated != test.deflated {
+			t.Errorf("Accept %v, %v bytes: content format is %v", test.accept, len(test.body), cf)
+			continue
+		}
+		if test.deflated && mustInflate(t, coapResp.Payload) != test.body {
+			t.Errorf("Accept %v, %v bytes: payload doesn't inflate to the body", test.accept, len(test.body))
+		}
+		if test.deflated && coapResp.IsTruncated {
+			t.Errorf("Accept %v, %v bytes: deflated payload is truncated", test.accept, len(test.body))
+		}
+	}
+}
+
+func TestTranslateCOAPResponseWithForwardedHeaders(t *testing.T) {
+	tr := Translator{ForwardedHeaders: []ForwardedHeader{
+		{Header: "X-RateLimit-Remaining", Option: 2055},
+		{Header: "Warning"},
+	}}
+	coapReq := coap.Message{Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/path/to/resource")
+
+	responseText := "HTTP/1.1 503 Service Unavailable\r\n" +
+		"X-RateLimit-Remaining: 0\r\n" +
+		"Warning: 199 - \"slow down\"\r\n" +
+		"X-Other: 1\r\n" +
+		"\r\n"
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, err := tr.translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	expected := []rawOption{{ID: 2055, Value: []byte("0")}}
+	if !reflect.DeepEqual(coapResp.ExtraOptions, expected) {
+		t.Errorf("coapResp.ExtraOptions is %v", coapResp.ExtraOptions)
+	}
+	if string(coapResp.Payload) != `Warning: 199 - "slow down"` {
+		t.Errorf("coapResp.Payload is '%v'", string(coapResp.Payload))
+	}
+
+	responseText = "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Warning: 199 - \"slow down\"\r\n" +
+		"\r\n" +
+		"Response Body"
+	httpResp, httpBody = getHTTPRespAndBody(t, responseText)
+	coapResp, err = tr.translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if string(coapResp.Payload) != "Response Body" {
+		t.Errorf("coapResp.Payload is '%v'", string(coapResp.Payload))
+	}
+}
+
+func TestTranslatorPublicAPI(t *testing.T) {
+	formats := DefaultContentFormats()
+	formats[11542] = Content{Type: "application/vnd.oma.lwm2m+tlv"}
+	tr := Translator{
+		BackendURL:          "http://backend/api",
+		StrictContentFormat: true,
+		ContentFormats:      formats,
+		OptionMappings:      []OptionMapping{{Option: 200, Header: "X-Shard"}},
+		MaxPacketSize:       64,
+	}
+
+	coapReq := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1234}
+	coapReq.SetPathString("/sensors/temp")
+	coapReq.SetOption(coap.ContentFormat, coap.MediaType(11542))
+	httpReq, err := tr.TranslateRequest(&coapReq)
+	if err != nil {
+		t.Fatalf("Error translating CoAP request: %v", err)
+	}
+	if httpReq.URL.String() != "http://backend/api/sensors/temp" {
+		t.Errorf("URL is '%v'", httpReq.URL)
+	}
+	if httpReq.Header.Get("Content-Type") != "application/vnd.oma.lwm2m+tlv" {
+		t.Errorf("Content-Type is '%v'", httpReq.Header.Get("Content-Type"))
+	}
+	coapReq.SetOption(coap.ContentFormat, coap.MediaType(9999))
+	if _, err := tr.TranslateRequest(&coapReq); err == nil || err.(*TranslationError).Code != coap.UnsupportedMediaType {
+		t.Errorf("Expected 4.15 error, got %v", err)
+	}
+
+	responseText := "HTTP/1.0 200 OK\r\n" +
+		"X-Shard: 7\r\n" +
+		"\r\n" +
+		strings.Repeat("ABCD", 100)
+	httpResp, httpBody := getHTTPRespAndBody(t, responseText)
+	coapResp, truncated, err := tr.TranslateResponse(httpResp, httpBody, nil, &coapReq)
+	if err != nil {
+		t.Fatalf("Error translating: %v", err)
+	}
+	if !truncated {
+		t.Error("Expected CoAP response to be truncated")
+	}
+	data, _ := coapResp.MarshalBinary()
+	if len(data) != 64 {
+		t.Errorf("CoAP response is %v bytes", len(data))
+	}
+	if shard := optionBytes(coapResp.Option(coap.OptionID(200))); string(shard) != "7" {
+		t.Errorf("option 200 is '%v'", shard)
+	}
+}
+
+func BenchmarkTranslateCOAPResponse(b *testing.B) {
+	httpResp, httpBody := getHTTPRespAndBody(b, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nETag: \"v1\"\r\n\r\n{\"temperature\":21.5}")
+	translator := &Translator{}
+	req := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1, Token: []byte("tok")}
+	req.SetPathString("/sensors/1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		translator.translateHTTPResponseToCOAPResponse(httpResp, httpBody, nil, req)
+	}
+}
+
+func BenchmarkDeflate(b *testing.B) {
+	body := []byte(strings.Repeat(`{"n":"temperature","v":21.5},`, 100))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := deflate(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
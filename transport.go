@@ -0,0 +1,77 @@
+package crosscoap
+
+import (
+	"net"
+)
+
+// transport carries the CoAP messages of a listener, so that the proxy
+// doesn't depend on how they're received and sent: UDP sockets are served
+// by udpTransport, and other CoAP stacks or test fakes can implement it.
+// Clients are identified by their endpoint address.
+type transport interface {
+	// ReceiveMessages reads CoAP messages, calling handle with each of them
+	// in a new goroutine, until reading fails.  The message is only valid
+	// until handle returns.
+	ReceiveMessages(handle func(a *net.UDPAddr, message []byte)) error
+	// SendMessage sends a CoAP message to the client at a; message isn't
+	// used once it returns.
+	SendMessage(a *net.UDPAddr, message []byte) error
+	// LocalAddr returns the address of the listener.
+	LocalAddr() net.Addr
+}
+
+// udpTransport is the transport of a UDP listener, whose messages are
+// written in batches by writer where batched UDP I/O is supported.
+type udpTransport struct {
+	l      *net.UDPConn
+	writer *packetWriter
+	stop   <-chan struct{} // stops receiving, once a read times out
+}
+
+func (t *udpTransport) ReceiveMessages(handle func(a *net.UDPAddr, message []byte)) error {
+	return readPackets(t.l, t.stop, handle)
+}
+
+func (t *udpTransport) SendMessage(a *net.UDPAddr, message []byte) error {
+	if t.writer != nil {
+		buf := getPacketBuffer()
+		data := append((*buf)[:0], message...)
+		*buf = data[:cap(data)]
+		if t.writer.write(packet{buf: buf, n: len(message), addr: a}) {
+			return nil
+		}
+		putPacketBuffer(buf)
+	}
+	_, err := t.l.WriteToUDP(message, a)
+	return err
+}
+
+func (t *udpTransport) LocalAddr() net.Addr {
+	return t.l.LocalAddr()
+}
+
+// transportOf returns the transport of the UDP listener l.
+func (p *proxyHandler) transportOf(l *net.UDPConn) transport {
+	if t := p.transports[l]; t != nil {
+		return t
+	}
+	return p.paced(&udpTransport{l: l})
+}
+
+// transportFor returns the transport from which to send to a: that of the
+// first listener of the address family of a, or else of Listener, or nil if
+// there's none.
+func (p *proxyHandler) transportFor(a *net.UDPAddr) transport {
+	for _, l := range append([]*net.UDPConn{p.Listener}, p.Listeners...) {
+		if l == nil {
+			continue
+		}
+		if local, ok := l.LocalAddr().(*net.UDPAddr); ok && (local.IP.To4() != nil) == (a.IP.To4() != nil) {
+			return p.transportOf(l)
+		}
+	}
+	if p.Listener == nil {
+		return nil
+	}
+	return p.transportOf(p.Listener)
+}
@@ -0,0 +1,91 @@
+package crosscoap
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+// fakeTransport delivers its messages to the proxy and records the
+// messages sent by the proxy.
+type fakeTransport struct {
+	messages [][]byte
+	client   *net.UDPAddr
+	mu       sync.Mutex
+	sent     []*coap.Message
+}
+
+func (t *fakeTransport) ReceiveMessages(handle func(a *net.UDPAddr, message []byte)) error {
+	var wg sync.WaitGroup
+	for _, message := range t.messages {
+		message := message
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(t.client, message)
+		}()
+	}
+	wg.Wait()
+	return errors.New("no more messages")
+}
+
+func (t *fakeTransport) SendMessage(a *net.UDPAddr, message []byte) error {
+	m, _, err := parsePacket(message)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, m)
+	return nil
+}
+
+func (t *fakeTransport) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+}
+
+func TestProxyWithFakeTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL})
+
+	ping := coap.Message{Type: coap.Confirmable, MessageID: 1}
+	request := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 2, Token: []byte{7}}
+	request.SetPathString("/a")
+	tr := &fakeTransport{client: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}}
+	for _, m := range []coap.Message{ping, request} {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.messages = append(tr.messages, data)
+	}
+	tr.ReceiveMessages(func(a *net.UDPAddr, message []byte) {
+		p.handlePacket(tr, a, message)
+	})
+
+	if len(tr.sent) != 2 {
+		t.Fatalf("sent messages are %v", tr.sent)
+	}
+	for _, m := range tr.sent {
+		switch m.MessageID {
+		case 1:
+			if m.Type != coap.Reset {
+				t.Errorf("ping answered with %v", m.Type)
+			}
+		case 2:
+			if m.Type != coap.Acknowledgement || m.Code != coap.Content || string(m.Payload) != "OK" {
+				t.Errorf("response is %v '%s'", m.Code, m.Payload)
+			}
+		default:
+			t.Errorf("unexpected message %v", m)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package crosscoap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dustin/go-coap"
+)
+
+// URITemplate is an RFC 6570 URI template mapping CoAP request URIs to HTTP
+// URIs (RFC 8075 section 5.3), for example
+// "https://api.example.com/devices/{uri-host}/{+uri-path}{?uri-query*}".
+// The variables are:
+//
+//	uri-host   the Uri-Host option (IPv6 literals without brackets)
+//	uri-port   the Uri-Port option
+//	uri-path   the path, without its leading "/" (use {+uri-path} to keep
+//	           the "/" separators)
+//	uri-query  the Uri-Query options, as an associative array of the
+//	           "key=value" queries (use {?uri-query*} to keep them as they
+//	           are)
+//
+// Options absent from the request are undefined, and expand to nothing.
+type URITemplate struct {
+	template string
+	parts    []templatePart
+}
+
+type templatePart struct {
+	literal  string
+	operator *templateOperator
+	vars     []templateVar
+}
+
+type templateVar struct {
+	name      string
+	explode   bool
+	maxLength int
+}
+
+// templateOperator describes the expansion of an expression type (RFC 6570
+// appendix A).
+type templateOperator struct {
+	first         string
+	separator     string
+	named         bool
+	ifEmpty       string
+	allowReserved bool
+}
+
+var templateOperators = map[byte]*templateOperator{
+	0:   {"", ",", false, "", false},
+	'+': {"", ",", false, "", true},
+	'#': {"#", ",", false, "", true},
+	'.': {".", ".", false, "", false},
+	'/': {"/", "/", false, "", false},
+	';': {";", ";", true, "", false},
+	'?': {"?", "&", true, "=", false},
+	'&': {"&", "&", true, "=", false},
+}
+
+var uriTemplateVarNames = map[string]bool{
+	"uri-host":  true,
+	"uri-port":  true,
+	"uri-path":  true,
+	"uri-query": true,
+}
+
+// ParseURITemplate parses an RFC 6570 URI template using the variables
+// described in URITemplate.
+func ParseURITemplate(template string) (*URITemplate, error) {
+	t := &URITemplate{template: template}
+	s := template
+	for s != "" {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{literal: s})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: s[:start]})
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated expression in URI template %q", template)
+		}
+		part, err := parseTemplateExpression(s[start+1 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("%v in URI template %q", err, template)
+		}
+		t.parts = append(t.parts, part)
+		s = s[start+end+1:]
+	}
+	return t, nil
+}
+
+func parseTemplateExpression(expression string) (templatePart, error) {
+	var operatorChar byte
+	if expression != "" && strings.IndexByte("+#./;?&", expression[0]) >= 0 {
+		operatorChar, expression = expression[0], expression[1:]
+	}
+	part := templatePart{operator: templateOperators[operatorChar]}
+	for _, spec := range strings.Split(expression, ",") {
+		v := templateVar{name: spec}
+		if strings.HasSuffix(spec, "*") {
+			v.name, v.explode = strings.TrimSuffix(spec, "*"), true
+		} else if i := strings.IndexByte(spec, ':'); i >= 0 {
+			maxLength, err := strconv.Atoi(spec[i+1:])
+			if err != nil || maxLength <= 0 || maxLength >= 10000 {
+				return part, fmt.Errorf("invalid prefix modifier %q", spec)
+			}
+			v.name, v.maxLength = spec[:i], maxLength
+		}
+		if !uriTemplateVarNames[v.name] {
+			return part, fmt.Errorf("unknown variable %q", v.name)
+		}
+		part.vars = append(part.vars, v)
+	}
+	return part, nil
+}
+
+// String returns the template.
+func (t *URITemplate) String() string {
+	return t.template
+}
+
+// queryPair is a member of the uri-query associative array; a query
+// without "=" has no value.
+type queryPair struct {
+	key, value string
+	hasValue   bool
+}
+
+// uriTemplateVars returns the template variables of a CoAP request, whose
+// (rewritten) path and queries are given.
+func uriTemplateVars(coapMsg *coap.Message, path string, queries []string) map[string]interface{} {
+	vars := map[string]interface{}{"uri-path": strings.TrimPrefix(path, "/")}
+	if host, ok := uriHost(coapMsg); ok {
+		vars["uri-host"] = host
+	}
+	if port, ok := coapMsg.Option(coap.URIPort).(uint32); ok {
+		vars["uri-port"] = strconv.Itoa(int(port))
+	}
+	var pairs []queryPair
+	for _, query := range queries {
+		kv := strings.SplitN(query, "=", 2)
+		pair := queryPair{key: kv[0]}
+		if len(kv) == 2 {
+			pair.value, pair.hasValue = kv[1], true
+		}
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) > 0 {
+		vars["uri-query"] = pairs
+	}
+	return vars
+}
+
+// expand expands the template with the given variables, whose values are
+// strings or []queryPair.
+func (t *URITemplate) expand(vars map[string]interface{}) string {
+	var buf strings.Builder
+	for _, part := range t.parts {
+		if part.operator == nil {
+			buf.WriteString(part.literal)
+			continue
+		}
+		op := part.operator
+		first := true
+		for _, v := range part.vars {
+			value, defined := vars[v.name]
+			if !defined {
+				continue
+			}
+			if first {
+				buf.WriteString(op.first)
+				first = false
+			} else {
+				buf.WriteString(op.separator)
+			}
+			switch value := value.(type) {
+			case string:
+				if v.maxLength > 0 && utf8.RuneCountInString(value) > v.maxLength {
+					value = string([]rune(value)[:v.maxLength])
+				}
+				if op.named {
+					buf.WriteString(v.name)
+					if value == "" {
+						buf.WriteString(op.ifEmpty)
+						continue
+					}
+					buf.WriteString("=")
+				}
+				buf.WriteString(templateEscape(value, op.allowReserved))
+			case []queryPair:
+				if !v.explode {
+					if op.named {
+						buf.WriteString(v.name + "=")
+					}
+					for i, pair := range value {
+						if i > 0 {
+							buf.WriteString(",")
+						}
+						buf.WriteString(templateEscape(pair.key, op.allowReserved) + "," + templateEscape(pair.value, op.allowReserved))
+					}
+					continue
+				}
+				for i, pair := range value {
+					if i > 0 {
+						buf.WriteString(op.separator)
+					}
+					buf.WriteString(templateEscape(pair.key, op.allowReserved))
+					if pair.hasValue {
+						buf.WriteString("=" + templateEscape(pair.value, op.allowReserved))
+					}
+				}
+			}
+		}
+	}
+	return buf.String()
+}
+
+const templateReserved = ":/?#[]@!$&'()*+,;="
+
+// templateEscape percent-encodes the characters of s which are not
+// unreserved (or reserved, if allowReserved is set).
+func templateEscape(s string, allowReserved bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte("-._~", c) >= 0:
+			buf.WriteByte(c)
+		case allowReserved && strings.IndexByte(templateReserved, c) >= 0:
+			buf.WriteByte(c)
+		case allowReserved && c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			buf.WriteString(s[i : i+3])
+			i += 2
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
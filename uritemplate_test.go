@@ -0,0 +1,80 @@
+package crosscoap
+
+import (
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestURITemplateExpansion(t *testing.T) {
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	coapMsg.SetOption(coap.URIHost, "dev 42")
+	coapMsg.SetOption(coap.URIPort, uint32(5684))
+	coapMsg.SetPathString("/sensors/temp")
+	coapMsg.SetOption(coap.URIQuery, []string{"unit=C", "raw"})
+	vars := uriTemplateVars(&coapMsg, "/"+coapMsg.PathString(), (&Translator{}).requestQueries(&coapMsg))
+
+	for _, tt := range []struct {
+		template string
+		expected string
+	}{
+		{"https://api.example.com/devices/{uri-host}/{+uri-path}{?uri-query*}", "https://api.example.com/devices/dev%2042/sensors/temp?unit=C&raw"},
+		{"http://backend/{uri-path}", "http://backend/sensors%2Ftemp"},
+		{"http://backend/{uri-host:3}{/uri-path}", "http://backend/dev/sensors%2Ftemp"},
+		{"http://backend/x{?uri-host,uri-port}", "http://backend/x?uri-host=dev%2042&uri-port=5684"},
+		{"http://backend/x{?uri-query}", "http://backend/x?uri-query=unit,C,raw,"},
+		{"http://backend/x{;uri-port}{#uri-path}", "http://backend/x;uri-port=5684#sensors/temp"},
+	} {
+		template, err := ParseURITemplate(tt.template)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", tt.template, err)
+		}
+		if expanded := template.expand(vars); expanded != tt.expected {
+			t.Errorf("%v: expanded is '%v'", tt.template, expanded)
+		}
+	}
+}
+
+func TestURITemplateUndefinedVariables(t *testing.T) {
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	coapMsg.SetPathString("/status")
+	template, err := ParseURITemplate("http://backend/{uri-host}/{+uri-path}{?uri-query*}")
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	if expanded := template.expand(uriTemplateVars(&coapMsg, "/"+coapMsg.PathString(), (&Translator{}).requestQueries(&coapMsg))); expanded != "http://backend//status" {
+		t.Errorf("expanded is '%v'", expanded)
+	}
+}
+
+func TestParseInvalidURITemplate(t *testing.T) {
+	for _, template := range []string{
+		"http://backend/{uri-path",
+		"http://backend/{device}",
+		"http://backend/{uri-host:x}",
+	} {
+		if _, err := ParseURITemplate(template); err == nil {
+			t.Errorf("%v: expected an error", template)
+		}
+	}
+}
+
+func TestTranslateCOAPRequestWithURITemplate(t *testing.T) {
+	template, err := ParseURITemplate("https://api.example.com/devices/{uri-host}/{+uri-path}")
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	coapMsg := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	coapMsg.SetOption(coap.URIHost, "node7")
+	coapMsg.SetPathString("/temp")
+	httpReq, err := (&Translator{URITemplate: template}).TranslateRequest(&coapMsg)
+	if err != nil {
+		t.Fatalf("Error translating request: %v", err)
+	}
+	if httpReq.URL.String() != "https://api.example.com/devices/node7/temp" {
+		t.Errorf("httpReq.URL is '%v'", httpReq.URL)
+	}
+	if httpReq.Host != "api.example.com" {
+		t.Errorf("httpReq.Host is '%v'", httpReq.Host)
+	}
+}
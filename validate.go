@@ -0,0 +1,431 @@
+package crosscoap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dustin/go-coap"
+)
+
+// maxSchemaRefDepth is the number of $ref followed in a row, beyond which
+// the references are taken for a loop.
+const maxSchemaRefDepth = 32
+
+// openAPIMethods are the operations of an OpenAPI path item which CoAP
+// requests map to.
+var openAPIMethods = []string{"get", "post", "put", "delete", "patch"}
+
+// RequestValidator checks the requests translated to HTTP against an
+// OpenAPI document or JSON Schemas before they're sent to the backend, so
+// that invalid device payloads are rejected by the proxy with 4.00 Bad
+// Request and a diagnostic payload naming the offending field.  The paths
+// matched are those of the backend requests, once rewritten, relative to
+// the path of the backend URL (as OpenAPI paths are relative to the server
+// URL).  It
+// supports the JSON form of OpenAPI 3 documents, and the usual JSON Schema
+// keywords: type, enum, const, required, properties,
+// additionalProperties, items, minItems, maxItems, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern,
+// allOf, anyOf, oneOf, nullable and local $ref.
+type RequestValidator struct {
+	operations []validatedOperation
+	strict     bool // unknown paths and methods are invalid
+}
+
+type validatedOperation struct {
+	method   string   // empty for any
+	segments []string // of the path; "{name}" matches any segment
+	prefix   bool     // the paths below match too
+	schema   interface{}
+	root     interface{} // the document holding the schema, for $ref
+	required bool        // the request must have a body
+}
+
+// NewOpenAPIValidator returns a validator of the requests to the paths and
+// methods of an OpenAPI document in JSON: requests to other paths or with
+// other methods are invalid, and the application/json body of requests is
+// checked against the schema of their operation's requestBody.
+func NewOpenAPIValidator(document []byte) (*RequestValidator, error) {
+	var root interface{}
+	if err := json.Unmarshal(document, &root); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+	doc, _ := root.(map[string]interface{})
+	paths, ok := doc["paths"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid OpenAPI document: no paths")
+	}
+	v := &RequestValidator{strict: true}
+	for path, item := range paths {
+		item, _ := item.(map[string]interface{})
+		for _, method := range openAPIMethods {
+			operation, ok := item[method].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			o := validatedOperation{method: strings.ToUpper(method), segments: pathSegments(path), root: root}
+			if body, err := resolveSchemaRef(root, operation["requestBody"]); err != nil {
+				return nil, fmt.Errorf("invalid OpenAPI operation %v %v: %v", o.method, path, err)
+			} else if body, ok := body.(map[string]interface{}); ok {
+				o.required, _ = body["required"].(bool)
+				content, _ := body["content"].(map[string]interface{})
+				if media, ok := content["application/json"].(map[string]interface{}); ok {
+					o.schema = media["schema"]
+				}
+			}
+			v.operations = append(v.operations, o)
+		}
+	}
+	// Literal segments take precedence over templated ones
+	sort.SliceStable(v.operations, func(i, j int) bool {
+		return templatedSegments(v.operations[i].segments) < templatedSegments(v.operations[j].segments)
+	})
+	return v, nil
+}
+
+// AddSchema checks the JSON body of the requests with method (any method if
+// empty) to the backend path pathPrefix and below (matched on whole path
+// segments) against the JSON Schema schema.  Schemas are tried in the order they're added.
+func (v *RequestValidator) AddSchema(method, pathPrefix string, schema []byte) error {
+	var root interface{}
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return fmt.Errorf("invalid JSON Schema for %v: %v", pathPrefix, err)
+	}
+	v.operations = append(v.operations, validatedOperation{
+		method:   strings.ToUpper(method),
+		segments: pathSegments(pathPrefix),
+		prefix:   true,
+		schema:   root,
+		root:     root,
+		required: true,
+	})
+	return nil
+}
+
+func pathSegments(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func templatedSegments(segments []string) int {
+	n := 0
+	for _, segment := range segments {
+		if strings.HasPrefix(segment, "{") {
+			n++
+		}
+	}
+	return n
+}
+
+func (o *validatedOperation) matches(method string, segments []string) bool {
+	if o.method != "" && o.method != method {
+		return false
+	}
+	if len(segments) < len(o.segments) || (!o.prefix && len(segments) != len(o.segments)) {
+		return false
+	}
+	for i, segment := range o.segments {
+		if segment != segments[i] && !(strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")) {
+			return false
+		}
+	}
+	return true
+}
+
+// backendPath returns the path of u relative to the path of the backend URL
+// base; a path outside of it, such as one expanded from a URITemplate, is
+// returned whole.
+func backendPath(u *url.URL, base string) string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return u.Path
+	}
+	prefix := strings.TrimSuffix(baseURL.Path, "/")
+	if u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+		return u.Path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, prefix), "/")
+}
+
+// validate checks the translated request req to the backend URL base; the
+// body of streamed requests isn't checked.
+func (v *RequestValidator) validate(req *http.Request, base string, streamed bool) error {
+	path := backendPath(req.URL, base)
+	method, segments := req.Method, pathSegments(path)
+	var operation *validatedOperation
+	for i := range v.operations {
+		if v.operations[i].matches(method, segments) {
+			operation = &v.operations[i]
+			break
+		}
+	}
+	switch {
+	case operation == nil && v.strict:
+		return fmt.Errorf("no operation %v %v", method, path)
+	case operation == nil || operation.schema == nil || streamed:
+		return nil
+	}
+	var body []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, _ = ioutil.ReadAll(r)
+	}
+	if len(body) == 0 {
+		if operation.required {
+			return errors.New("body: missing")
+		}
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return errors.New("body: expected JSON")
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return errors.New("body: invalid JSON")
+	}
+	return validateSchema(operation.root, operation.schema, value, "body")
+}
+
+// resolveSchemaRef returns the value referenced by the $ref of schema, if
+// any, in root.
+func resolveSchemaRef(root, schema interface{}) (interface{}, error) {
+	for depth := 0; depth < maxSchemaRefDepth; depth++ {
+		s, _ := schema.(map[string]interface{})
+		ref, ok := s["$ref"].(string)
+		if !ok {
+			return schema, nil
+		}
+		if !strings.HasPrefix(ref, "#") {
+			return nil, fmt.Errorf("unsupported $ref %v", ref)
+		}
+		schema = root
+		for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+			token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+			object, _ := schema.(map[string]interface{})
+			if schema, ok = object[token]; !ok {
+				return nil, fmt.Errorf("unresolved $ref %v", ref)
+			}
+		}
+	}
+	return nil, errors.New("$ref loop")
+}
+
+// validateSchema checks value, at the location at, against schema.
+func validateSchema(root, schema, value interface{}, at string) error {
+	schema, err := resolveSchemaRef(root, schema)
+	if err != nil {
+		return fmt.Errorf("%v: %v", at, err)
+	}
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		if schema == false {
+			return fmt.Errorf("%v: not allowed", at)
+		}
+		return nil
+	}
+	if value == nil && s["nullable"] == true {
+		return nil
+	}
+	if t, ok := s["type"]; ok && !matchesSchemaType(t, value) {
+		return fmt.Errorf("%v: expected %v", at, schemaTypeName(t))
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || reflect.DeepEqual(allowed, value)
+		}
+		if !found {
+			return fmt.Errorf("%v: not one of the allowed values", at)
+		}
+	}
+	if constant, ok := s["const"]; ok && !reflect.DeepEqual(constant, value) {
+		return fmt.Errorf("%v: not the allowed value", at)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if err := validateObject(root, s, v, at); err != nil {
+			return err
+		}
+	case []interface{}:
+		if min, ok := s["minItems"].(float64); ok && float64(len(v)) < min {
+			return fmt.Errorf("%v: fewer than %v items", at, min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && float64(len(v)) > max {
+			return fmt.Errorf("%v: more than %v items", at, max)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range v {
+				if err := validateSchema(root, items, item, fmt.Sprintf("%v[%v]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case float64:
+		if min, ok := s["minimum"].(float64); ok && (v < min || (s["exclusiveMinimum"] == true && v == min)) {
+			return fmt.Errorf("%v: less than %v", at, min)
+		}
+		if max, ok := s["maximum"].(float64); ok && (v > max || (s["exclusiveMaximum"] == true && v == max)) {
+			return fmt.Errorf("%v: greater than %v", at, max)
+		}
+		if min, ok := s["exclusiveMinimum"].(float64); ok && v <= min {
+			return fmt.Errorf("%v: not greater than %v", at, min)
+		}
+		if max, ok := s["exclusiveMaximum"].(float64); ok && v >= max {
+			return fmt.Errorf("%v: not less than %v", at, max)
+		}
+	case string:
+		if min, ok := s["minLength"].(float64); ok && float64(utf8.RuneCountInString(v)) < min {
+			return fmt.Errorf("%v: shorter than %v characters", at, min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && float64(utf8.RuneCountInString(v)) > max {
+			return fmt.Errorf("%v: longer than %v characters", at, max)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%v: invalid pattern in schema", at)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%v: doesn't match %v", at, pattern)
+			}
+		}
+	}
+	return validateCombinations(root, s, value, at)
+}
+
+func validateObject(root interface{}, s, object map[string]interface{}, at string) error {
+	required, _ := s["required"].([]interface{})
+	for _, name := range required {
+		if name, ok := name.(string); ok {
+			if _, found := object[name]; !found {
+				return fmt.Errorf("%v.%v: missing", at, name)
+			}
+		}
+	}
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	properties, _ := s["properties"].(map[string]interface{})
+	for _, name := range names {
+		property, found := properties[name]
+		if !found {
+			additional, ok := s["additionalProperties"]
+			if !ok {
+				continue
+			}
+			if additional == false {
+				return fmt.Errorf("%v.%v: unexpected property", at, name)
+			}
+			property = additional
+		}
+		if err := validateSchema(root, property, object[name], at+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCombinations(root interface{}, s map[string]interface{}, value interface{}, at string) error {
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := validateSchema(root, sub, value, at); err != nil {
+				return err
+			}
+		}
+	}
+	if any, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range any {
+			matched = matched || validateSchema(root, sub, value, at) == nil
+		}
+		if !matched {
+			return fmt.Errorf("%v: matches none of the allowed schemas", at)
+		}
+	}
+	if one, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range one {
+			if validateSchema(root, sub, value, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%v: matches %v of the exclusive schemas", at, matched)
+		}
+	}
+	return nil
+}
+
+func matchesSchemaType(t interface{}, value interface{}) bool {
+	if types, ok := t.([]interface{}); ok {
+		for _, t := range types {
+			if matchesSchemaType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func schemaTypeName(t interface{}) string {
+	if types, ok := t.([]interface{}); ok {
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = fmt.Sprint(t)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// invalidRequest answers the request m, which err made invalid, with 4.00
+// Bad Request; the diagnostic payload, which tells the device what's wrong
+// with its request, is sent even without DiagnosticPayloads.
+func (p *proxyHandler) invalidRequest(m *coap.Message, err error) *translatedCOAPMessage {
+	if !p.expectsResponse(m) {
+		return nil
+	}
+	return generateErrorCOAPResponse(m, coap.BadRequest, err.Error())
+}
@@ -0,0 +1,190 @@
+package crosscoap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+const testOpenAPIDocument = `{
+  "openapi": "3.0.0",
+  "paths": {
+    "/sensors/{id}": {
+      "get": {},
+      "put": {"requestBody": {"$ref": "#/components/requestBodies/Reading"}}
+    },
+    "/sensors/all": {"delete": {}}
+  },
+  "components": {
+    "requestBodies": {
+      "Reading": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Reading"}}}}
+    },
+    "schemas": {
+      "Reading": {
+        "type": "object",
+        "required": ["temp"],
+        "additionalProperties": false,
+        "properties": {
+          "temp": {"type": "number", "minimum": -50, "maximum": 100},
+          "unit": {"enum": ["C", "F"]},
+          "tags": {"type": "array", "items": {"type": "string", "pattern": "^[a-z]+$"}, "maxItems": 2}
+        }
+      }
+    }
+  }
+}`
+
+func TestOpenAPIValidator(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	validator, err := NewOpenAPIValidator([]byte(testOpenAPIDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newProxyHandler(&Proxy{BackendURL: backend.URL, RequestValidator: validator})
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	send := func(code coap.COAPCode, path, payload string) *translatedCOAPMessage {
+		m := &coap.Message{Type: coap.Confirmable, Code: code, MessageID: 1, Payload: []byte(payload)}
+		m.SetPathString(path)
+		if payload != "" {
+			m.SetOption(coap.ContentFormat, coap.AppJSON)
+		}
+		return p.handleRequest(a, m, nil)
+	}
+
+	for _, valid := range []struct {
+		code          coap.COAPCode
+		path, payload string
+	}{
+		{coap.GET, "/sensors/7", ""},
+		{coap.PUT, "/sensors/7", `{"temp": 21.5, "unit": "C", "tags": ["roof"]}`},
+		{coap.DELETE, "/sensors/all", ""},
+	} {
+		if coapResp := send(valid.code, valid.path, valid.payload); !isSuccess(coapResp.Code) {
+			t.Errorf("response to valid %v %v is %v '%s'", valid.code, valid.path, coapResp.Code, coapResp.Payload)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("backend got %v requests", requests)
+	}
+
+	for _, invalid := range []struct {
+		code                   coap.COAPCode
+		path, payload, problem string
+	}{
+		{coap.POST, "/sensors/7", "", "no operation POST /sensors/7"},
+		{coap.GET, "/actuators/1", "", "no operation GET /actuators/1"},
+		{coap.DELETE, "/sensors/7", "", "no operation DELETE /sensors/7"},
+		{coap.PUT, "/sensors/7", "", "body: missing"},
+		{coap.PUT, "/sensors/7", `{"temp": "hot"}`, "body.temp: expected number"},
+		{coap.PUT, "/sensors/7", `{"temp": 150}`, "body.temp: greater than 100"},
+		{coap.PUT, "/sensors/7", `{"unit": "C"}`, "body.temp: missing"},
+		{coap.PUT, "/sensors/7", `{"temp": 1, "unit": "K"}`, "body.unit: not one of the allowed values"},
+		{coap.PUT, "/sensors/7", `{"temp": 1, "tags": ["ok", "Bad"]}`, "body.tags[1]: doesn't match ^[a-z]+$"},
+		{coap.PUT, "/sensors/7", `{"temp": 1, "extra": true}`, "body.extra: unexpected property"},
+		{coap.PUT, "/sensors/7", `{"temp": `, "body: invalid JSON"},
+	} {
+		coapResp := send(invalid.code, invalid.path, invalid.payload)
+		if coapResp.Code != coap.BadRequest || string(coapResp.Payload) != invalid.problem {
+			t.Errorf("response to %v %v '%v' is %v '%s'", invalid.code, invalid.path, invalid.payload, coapResp.Code, coapResp.Payload)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("backend got %v requests after invalid ones", requests)
+	}
+}
+
+func TestRequestValidatorAddSchema(t *testing.T) {
+	v := &RequestValidator{}
+	if err := v.AddSchema("POST", "/readings", []byte(`{"type": "array", "items": {"oneOf": [{"type": "integer"}, {"type": "null"}]}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddSchema("", "/config", []byte(`{"anyOf": [{"type": "object"}, {"type": "string", "minLength": 3}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddSchema("", "/broken", []byte(`{`)); err == nil {
+		t.Errorf("invalid schema was accepted")
+	}
+	validate := func(code coap.COAPCode, path, payload string) error {
+		m := &coap.Message{Type: coap.Confirmable, Code: code, MessageID: 1, Payload: []byte(payload)}
+		m.SetPathString(path)
+		m.SetOption(coap.ContentFormat, coap.AppJSON)
+		req, err := (&Translator{BackendURL: "http://localhost:9876/"}).translateCOAPRequestToHTTPRequest(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.validate(req, "http://localhost:9876/", false)
+	}
+
+	for _, valid := range []struct {
+		code          coap.COAPCode
+		path, payload string
+	}{
+		{coap.POST, "/readings/a", "[1, null, 3]"},
+		{coap.PUT, "/readings", `"anything"`},
+		{coap.PUT, "/config", `{"x": 1}`},
+		{coap.POST, "/config", `"abc"`},
+		{coap.POST, "/elsewhere", `"abc"`},
+		{coap.POST, "/readingsx", `"abc"`},
+	} {
+		if err := validate(valid.code, valid.path, valid.payload); err != nil {
+			t.Errorf("%v %v '%v' is invalid: %v", valid.code, valid.path, valid.payload, err)
+		}
+	}
+	for _, invalid := range []struct {
+		code                   coap.COAPCode
+		path, payload, problem string
+	}{
+		{coap.POST, "/readings", "[1, 2.5]", "body[1]: matches 0 of the exclusive schemas"},
+		{coap.POST, "/readings", `{}`, "body: expected array"},
+		{coap.POST, "/config", `"ab"`, "body: matches none of the allowed schemas"},
+	} {
+		if err := validate(invalid.code, invalid.path, invalid.payload); err == nil || err.Error() != invalid.problem {
+			t.Errorf("error for %v %v '%v' is '%v'", invalid.code, invalid.path, invalid.payload, err)
+		}
+	}
+}
+
+func TestRequestValidatorBackendPath(t *testing.T) {
+	var backendPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+	}))
+	defer backend.Close()
+	validator, err := NewOpenAPIValidator([]byte(testOpenAPIDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newProxyHandler(&Proxy{
+		BackendURL:       backend.URL + "/api",
+		RewriteRules:     []RewriteRule{{StripPrefix: "/v1"}},
+		RequestValidator: validator,
+	})
+	for _, tt := range []struct {
+		path         string
+		expectedCode coap.COAPCode
+	}{
+		{"/v1/sensors/7", coap.Content},
+		{"/sensors/7", coap.Content},
+		{"/v1/api/sensors/7", coap.BadRequest},
+		{"/v1/sensors", coap.BadRequest},
+	} {
+		backendPath = ""
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+		m.SetPathString(tt.path)
+		coapResp := p.handleRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}, m, nil)
+		if coapResp.Code != tt.expectedCode {
+			t.Errorf("%v: response is %v '%s'", tt.path, coapResp.Code, coapResp.Payload)
+		}
+		if tt.expectedCode == coap.Content && backendPath != "/api/sensors/7" {
+			t.Errorf("%v: backend got %v", tt.path, backendPath)
+		}
+	}
+}
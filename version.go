@@ -0,0 +1,74 @@
+package crosscoap
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// modulePath is the import path of the crosscoap module.
+const modulePath = "github.com/ibm-security-innovation/crosscoap"
+
+// metricBuildInfo is always 1, labeled with the version of crosscoap and of
+// Go, so that the build of each proxy can be told from its metrics.
+const metricBuildInfo = "build_info"
+
+// version is the version of crosscoap, if set at link time with
+// -ldflags "-X github.com/ibm-security-innovation/crosscoap.version=1.2.3";
+// otherwise it's read from the build information of the binary.
+var version string
+
+var versionOnce sync.Once
+
+// Version returns the version of crosscoap built into the running binary:
+// the module version (such as v1.2.3) when it was built as a dependency or
+// installed with go install, else the VCS revision of a build from a
+// checkout (with a "-dirty" suffix if it had local changes), else "devel".
+func Version() string {
+	versionOnce.Do(func() {
+		if version == "" {
+			version = buildVersion()
+		}
+	})
+	return version
+}
+
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	module := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			module = dep
+		}
+	}
+	if module.Path == modulePath && module.Version != "" && module.Version != "(devel)" {
+		return module.Version
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" || module.Path != modulePath {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return "devel-" + revision
+}
+
+// exportBuildInfo sets the build_info metric of p.
+func (p *proxyHandler) exportBuildInfo() {
+	p.metrics().Gauge(metricBuildInfo, 1, Labels{"version": Version(), "goversion": runtime.Version()})
+}
@@ -0,0 +1,26 @@
+package crosscoap
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	v := Version()
+	if v == "" || v != Version() {
+		t.Errorf("version is '%v'", v)
+	}
+	metrics := NewPrometheusMetrics("crosscoap")
+	p := newProxyHandler(&Proxy{Metrics: metrics})
+	if ua := p.userAgent(); ua != "crosscoap/"+v {
+		t.Errorf("User-Agent is '%v'", ua)
+	}
+	admin := p.adminHandler("secret")
+	if w := adminRequest(admin, "GET", "/config", "secret", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"version":"`+v+`"`) {
+		t.Errorf("config is %v", w.Body)
+	}
+	if w := adminRequest(admin, "GET", "/metrics", "secret", ""); !strings.Contains(w.Body.String(), `version="`+v+`"`) {
+		t.Errorf("metrics are %v", w.Body)
+	}
+}